@@ -18,6 +18,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/cli/remote_download"
 	"github.com/buildbuddy-io/buildbuddy/cli/remotebazel"
 	"github.com/buildbuddy-io/buildbuddy/cli/search"
+	"github.com/buildbuddy-io/buildbuddy/cli/shell"
 	"github.com/buildbuddy-io/buildbuddy/cli/update"
 	"github.com/buildbuddy-io/buildbuddy/cli/upload"
 	"github.com/buildbuddy-io/buildbuddy/cli/versioncmd"
@@ -102,6 +103,11 @@ func register() {
 			Help:    "Searches for code in the remote codesearch index.",
 			Handler: search.HandleSearch,
 		},
+		{
+			Name:    "shell",
+			Help:    "Starts an interactive shell in the container of a remote execution.",
+			Handler: shell.HandleShell,
+		},
 		{
 			Name:    "index",
 			Help:    "Sends updates to the remote codesearch index.",
@@ -309,7 +309,8 @@ func Diff(old, new *CompactGraph) (*spawn_diff.DiffResult, error) {
 				diffWG.Add(1)
 				go func() {
 					defer diffWG.Done()
-					result.spawnDiff.GetModified().TransitivelyInvalidated = flattenInvalidates(result.invalidates, isExecOutputPath(output))
+					m := result.spawnDiff.GetModified()
+					m.TransitivelyInvalidated, m.TransitivelyInvalidatedOutputs = flattenInvalidates(result.invalidates, isExecOutputPath(output))
 				}()
 			}
 			spawnDiffs = append(spawnDiffs, result.spawnDiff)
@@ -325,12 +326,13 @@ func Diff(old, new *CompactGraph) (*spawn_diff.DiffResult, error) {
 }
 
 // flattenInvalidates flattens a tree of Spawn nodes into a deduplicated map of mnemonic to count of transitively
-// invalidated spawns.
+// invalidated spawns as well as the sorted primary outputs of these spawns.
 // Mnemonics of spawns are suffixed with " (as tool)" if the invalidating spawn is a tool and the invalidated spawn is
 // not, that is, if the dependency path crosses an edge with an "exec" transition (ignoring "exec" transitions on
 // targets that are already in the "exec" configuration).
-func flattenInvalidates(invalidates []any, isTool bool) map[string]uint32 {
+func flattenInvalidates(invalidates []any, isTool bool) (map[string]uint32, []string) {
 	transitivelyInvalidated := make(map[string]uint32)
+	var transitivelyInvalidatedOutputs []string
 	spawnsSeen := make(map[*Spawn]struct{})
 	toVisit := invalidates
 	for len(toVisit) > 0 {
@@ -345,13 +347,15 @@ func flattenInvalidates(invalidates []any, isTool bool) map[string]uint32 {
 					suffix = " (as tool)"
 				}
 				transitivelyInvalidated[n.Mnemonic+suffix]++
+				transitivelyInvalidatedOutputs = append(transitivelyInvalidatedOutputs, n.PrimaryOutputPath())
 			}
 		default:
 			// If n is not a Spawn, it must be a slice of Spawns or slices.
 			toVisit = append(toVisit, n.([]any)...)
 		}
 	}
-	return transitivelyInvalidated
+	slices.Sort(transitivelyInvalidatedOutputs)
+	return transitivelyInvalidated, transitivelyInvalidatedOutputs
 }
 
 func diffSettings(old, new *globalSettings) []string {
@@ -414,6 +418,43 @@ func (cg *CompactGraph) findRootSet(outputs []string) map[string]struct{} {
 	return rootsSet
 }
 
+// TargetSubgraph returns the subgraph of cg consisting of the spawns of the target with the given label and all the
+// spawns they transitively depend on, as well as whether the graph contains any spawns for the target. If it doesn't,
+// the returned subgraph is empty, but can still be diffed against other graphs.
+func (cg *CompactGraph) TargetSubgraph(label string) (*CompactGraph, bool) {
+	var toVisit []any
+	visited := make(map[any]struct{})
+	markForVisit := func(n any) {
+		if _, seen := visited[n]; !seen {
+			toVisit = append(toVisit, n)
+			visited[n] = struct{}{}
+		}
+	}
+	for _, output := range cg.primaryOutputs() {
+		if spawn := cg.spawns[output]; spawn.TargetLabel == label {
+			markForVisit(spawn)
+		}
+	}
+	found := len(toVisit) > 0
+	for len(toVisit) > 0 {
+		var node any
+		node, toVisit = toVisit[0], toVisit[1:]
+		cg.visitSuccessors(node, markForVisit)
+	}
+
+	subgraph := &CompactGraph{
+		spawns:             make(map[string]*Spawn),
+		symlinkResolutions: cg.symlinkResolutions,
+		settings:           cg.settings,
+	}
+	for output, spawn := range cg.spawns {
+		if _, ok := visited[spawn]; ok {
+			subgraph.spawns[output] = spawn
+		}
+	}
+	return subgraph, found
+}
+
 // sortedPrimaryOutputs returns the primary output paths of the spawns in topological order.
 func (cg *CompactGraph) sortedPrimaryOutputs() []string {
 	toVisit := make([]any, 0, len(cg.spawns))
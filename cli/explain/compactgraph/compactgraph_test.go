@@ -199,6 +199,10 @@ func TestJavaImplChange_8_0_0(t *testing.T) {
 			"Runfiles directory": 1,
 			"TestRunner":         1,
 		}, sd.GetModified().GetTransitivelyInvalidated())
+		invalidatedOutputs := sd.GetModified().GetTransitivelyInvalidatedOutputs()
+		require.Len(t, invalidatedOutputs, 2)
+		assert.Regexp(t, "^bazel-out/[^/]+/bin/src/test/java/com/example/lib/lib_test.runfiles$", invalidatedOutputs[0])
+		assert.Regexp(t, "^bazel-out/[^/]+/testlogs/src/test/java/com/example/lib/lib_test/test.log$", invalidatedOutputs[1])
 		require.Len(t, sd.GetModified().GetDiffs(), 1)
 		d := sd.GetModified().Diffs[0]
 		require.IsType(t, &spawn_diff.Diff_InputContents{}, d.Diff)
@@ -740,7 +744,63 @@ func TestEmptyVsNonempty(t *testing.T) {
 	}
 }
 
-func diffLogsAllowingError(t *testing.T, name, bazelVersion string) ([]*spawn_diff.SpawnDiff, error) {
+func TestTargetSubgraph(t *testing.T) {
+	for _, bazelVersion := range []string{"7.3.1", "8.0.0"} {
+		t.Run(bazelVersion, func(t *testing.T) {
+			oldLog, newLog := readLogs(t, "java_header_change", bazelVersion)
+
+			oldLib, found := oldLog.TargetSubgraph("//src/main/java/com/example/lib:lib")
+			require.True(t, found)
+			newLib, found := newLog.TargetSubgraph("//src/main/java/com/example/lib:lib")
+			require.True(t, found)
+			result, err := compactgraph.Diff(oldLib, newLib)
+			require.NoError(t, err)
+			require.Len(t, result.SpawnDiffs, 2)
+			for _, sd := range result.SpawnDiffs {
+				assert.Equal(t, "//src/main/java/com/example/lib:lib", sd.TargetLabel)
+				assert.NotContains(t, sd.GetModified().GetTransitivelyInvalidated(), "TestRunner")
+			}
+
+			// The test depends on the library, so the diff scoped to the test covers the full diff.
+			oldTest, found := oldLog.TargetSubgraph("//src/test/java/com/example/lib:lib_test")
+			require.True(t, found)
+			newTest, found := newLog.TargetSubgraph("//src/test/java/com/example/lib:lib_test")
+			require.True(t, found)
+			result, err = compactgraph.Diff(oldTest, newTest)
+			require.NoError(t, err)
+			require.Len(t, result.SpawnDiffs, 3)
+		})
+	}
+}
+
+func TestTargetSubgraph_OnlyInOneLog(t *testing.T) {
+	oldLog, newLog := readLogs(t, "empty_vs_nonempty", "8.0.0")
+
+	oldTool, found := oldLog.TargetSubgraph("//pkg:gen_tool")
+	require.False(t, found)
+	newTool, found := newLog.TargetSubgraph("//pkg:gen_tool")
+	require.True(t, found)
+	result, err := compactgraph.Diff(oldTool, newTool)
+	require.NoError(t, err)
+	require.Len(t, result.SpawnDiffs, 1)
+
+	sd := result.SpawnDiffs[0]
+	assert.Equal(t, "//pkg:gen_tool", sd.TargetLabel)
+	// The tool is top-level in the subgraph since its consumer isn't part of it.
+	assert.True(t, sd.GetNewOnly().GetTopLevel())
+}
+
+func TestTargetSubgraph_UnknownTarget(t *testing.T) {
+	oldLog, _ := readLogs(t, "env_change", "7.3.1")
+
+	subgraph, found := oldLog.TargetSubgraph("//pkg:does_not_exist")
+	require.False(t, found)
+	result, err := compactgraph.Diff(subgraph, subgraph)
+	require.NoError(t, err)
+	assert.Empty(t, result.SpawnDiffs)
+}
+
+func readLogs(t *testing.T, name, bazelVersion string) (*compactgraph.CompactGraph, *compactgraph.CompactGraph) {
 	dir := "buildbuddy/cli/explain/compactgraph/testdata"
 	oldPath, err := runfiles.Rlocation(path.Join(dir, bazelVersion, name+"_old.pb.zstd"))
 	require.NoError(t, err)
@@ -756,6 +816,11 @@ func diffLogsAllowingError(t *testing.T, name, bazelVersion string) ([]*spawn_di
 	require.NoError(t, err)
 	newLog, err := compactgraph.ReadCompactLog(newLogFile)
 	require.NoError(t, err)
+	return oldLog, newLog
+}
+
+func diffLogsAllowingError(t *testing.T, name, bazelVersion string) ([]*spawn_diff.SpawnDiff, error) {
+	oldLog, newLog := readLogs(t, name, bazelVersion)
 	result, err := compactgraph.Diff(oldLog, newLog)
 	if err != nil {
 		return nil, err
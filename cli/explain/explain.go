@@ -8,6 +8,8 @@ import (
 	"maps"
 	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"regexp"
 	"runtime"
 	"runtime/pprof"
@@ -20,8 +22,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/cli/flaghistory"
 	"github.com/buildbuddy-io/buildbuddy/cli/log"
 	"github.com/buildbuddy-io/buildbuddy/cli/login"
+	"github.com/buildbuddy-io/buildbuddy/cli/workspace"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	"github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	"github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
 	"github.com/buildbuddy-io/buildbuddy/proto/spawn"
 	"github.com/buildbuddy-io/buildbuddy/proto/spawn_diff"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
@@ -31,11 +35,25 @@ import (
 	"golang.org/x/sync/errgroup"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
+	// lastGreenBaseline is the value of --old that selects the most recent
+	// successful build on --base_branch as the baseline.
+	lastGreenBaseline = "last_green"
+
+	// The number of successful builds on the base branch to consider when
+	// looking for one that has an execution log.
+	lastGreenSearchCount = 20
+
+	textOutput  = "text"
+	jsonOutput  = "json"
+	protoOutput = "proto"
+
 	explainCmdUsage = `
-usage: bb explain [--old {FILE | INVOCATION_ID} [--new {FILE | INVOCATION_ID}]]
+usage: bb explain [--old {FILE | INVOCATION_ID | last_green} [--new {FILE | INVOCATION_ID}]] [--target LABEL]
 
 Displays a human-readable, structural diff of two compact execution logs, either
 obtained from the given invocations or located at the given file paths.
@@ -44,6 +62,16 @@ If --new isn't specified, the most recent build performed with the bb CLI is
 used as the "new" log. If --old also isn't specified, the second most recent
 build is used as the "old" log.
 
+If --old is "last_green", the most recent successful invocation with an
+execution log on the --base_branch of the current git repository is used as the
+"old" log.
+
+If --target is specified, the diff is limited to the spawns of the given target
+and the spawns it transitively depends on.
+
+With --output=json or --output=proto, the full spawn_diff.DiffResult is written
+to stdout as JSON or as a binary protobuf message, respectively.
+
 Use the --execution_log_compact_file flag to have Bazel produce a compact
 execution log and upload it to the BuildBuddy BES backend.
 `
@@ -73,11 +101,14 @@ func (m MapFlag) Set(s string) error {
 }
 
 var (
-	explainCmd = flag.NewFlagSet("explain", flag.ContinueOnError)
-	oldLog     = explainCmd.String("old", "", "Path to a compact execution log or invocation ID of a build to consider as the baseline for the diff.")
-	newLog     = explainCmd.String("new", "", "Path to a compact execution log or invocation ID of a build to compare against the baseline.")
-	verbose    = explainCmd.Bool("verbose", false, "Print more detailed execution information.")
-	apiTarget  = explainCmd.String("target", "", "The API target to use for fetching logs instead of the last --bes_backend.")
+	explainCmd  = flag.NewFlagSet("explain", flag.ContinueOnError)
+	oldLog      = explainCmd.String("old", "", "Path to a compact execution log or invocation ID of a build to consider as the baseline for the diff, or \""+lastGreenBaseline+"\" to use the last successful build on --base_branch.")
+	newLog      = explainCmd.String("new", "", "Path to a compact execution log or invocation ID of a build to compare against the baseline.")
+	verbose     = explainCmd.Bool("verbose", false, "Print more detailed execution information.")
+	targetLabel = explainCmd.String("target", "", "If set, only diff the spawns of this target and its transitive dependencies. Ex: //foo:bar")
+	baseBranch  = explainCmd.String("base_branch", "main", "The branch to look for the baseline build on when --old is \""+lastGreenBaseline+"\".")
+	apiTarget   = explainCmd.String("api_target", "", "The API target to use for fetching logs instead of the last --bes_backend.")
+	output      = explainCmd.String("output", textOutput, "The format of the diff. One of: text, json, proto. The json and proto formats contain the full spawn_diff.DiffResult.")
 
 	profilePaths = make(MapFlag)
 )
@@ -91,6 +122,11 @@ func HandleExplain(args []string) (int, error) {
 		log.Print(explainCmdUsage)
 		return 1, nil
 	}
+	if *output != textOutput && *output != jsonOutput && *output != protoOutput {
+		log.Printf("Invalid --output %q, must be one of: text, json, proto", *output)
+		log.Print(explainCmdUsage)
+		return 1, nil
+	}
 	if profilePaths["cpu"] != "" {
 		f, err := os.Create(profilePaths["cpu"])
 		if err != nil {
@@ -126,13 +162,22 @@ func HandleExplain(args []string) (int, error) {
 		log.Print(explainCmdUsage)
 		return 1, nil
 	}
+	if *oldLog == lastGreenBaseline {
+		oldId, err := lastGreenInvocation(*baseBranch)
+		if err != nil {
+			return -1, err
+		}
+		log.Printf("Using last green invocation %s on %s as the baseline", oldId, *baseBranch)
+		*oldLog = oldId
+	}
 
-	diffResult, err := diff(*oldLog, *newLog)
+	diffResult, err := diff(*oldLog, *newLog, normalizeLabel(*targetLabel))
 	if err != nil {
 		return -1, err
 	}
-	writeHeader(os.Stdout, diffResult.OldInvocationId, diffResult.NewInvocationId)
-	writeSpawnDiffs(os.Stdout, diffResult.SpawnDiffs)
+	if err := writeDiffResult(os.Stdout, diffResult); err != nil {
+		return -1, err
+	}
 
 	for profile, p := range profilePaths {
 		if profile == "cpu" {
@@ -155,7 +200,7 @@ func HandleExplain(args []string) (int, error) {
 	return 0, nil
 }
 
-func diff(oldPath, newPath string) (*spawn_diff.DiffResult, error) {
+func diff(oldPath, newPath, label string) (*spawn_diff.DiffResult, error) {
 	oldSource, err := openLog(oldPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open old log: %v", err)
@@ -182,9 +227,34 @@ func diff(oldPath, newPath string) (*spawn_diff.DiffResult, error) {
 	if err := readsEG.Wait(); err != nil {
 		return nil, err
 	}
+	if label != "" {
+		var oldFound, newFound bool
+		oldGraph, oldFound = oldGraph.TargetSubgraph(label)
+		newGraph, newFound = newGraph.TargetSubgraph(label)
+		if !oldFound && !newFound {
+			return nil, fmt.Errorf("neither log contains spawns for target %s", label)
+		}
+	}
 	return compactgraph.Diff(oldGraph, newGraph)
 }
 
+// normalizeLabel converts a label to the form used in execution logs, which
+// omits the main repository name and always includes the target name.
+func normalizeLabel(label string) string {
+	if label == "" {
+		return ""
+	}
+	if strings.HasPrefix(label, "@@//") {
+		label = label[2:]
+	} else if strings.HasPrefix(label, "@//") {
+		label = label[1:]
+	}
+	if !strings.Contains(label, ":") {
+		label += ":" + path.Base(label)
+	}
+	return label
+}
+
 var uuidPattern = regexp.MustCompile("^(?:.*/invocation/)?([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})$")
 
 func openLog(pathOrId string) (io.ReadCloser, error) {
@@ -197,26 +267,11 @@ func openLog(pathOrId string) (io.ReadCloser, error) {
 	matches := uuidPattern.FindStringSubmatch(pathOrId)
 	invocationId := matches[1]
 	// This is an invocation ID, try to fetch its corresponding log.
-	apiKey, err := login.GetAPIKey()
+	ctx, conn, err := dialBackend()
 	if err != nil {
 		return nil, err
 	}
-	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-buildbuddy-api-key", apiKey)
-	backend := *apiTarget
-	if backend == "" {
-		backend, err = flaghistory.GetLastBackend()
-		if err != nil {
-			log.Debugf("Failed to get last backend: %v", err)
-		}
-		if backend == "" {
-			backend = login.DefaultApiTarget
-		}
-	}
-	conn, err := grpc_client.DialSimple(backend)
-	if err != nil {
-		return nil, err
-	}
-	resource, err := getExecLogResource(ctx, conn, invocationId)
+	resource, err := getExecLogResource(ctx, bbspb.NewBuildBuddyServiceClient(conn), invocationId)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -237,8 +292,93 @@ func openLog(pathOrId string) (io.ReadCloser, error) {
 	return in, err
 }
 
-func getExecLogResource(ctx context.Context, conn *grpc_client.ClientConnPool, invocationId string) (*digest.CASResourceName, error) {
-	resp, err := bbspb.NewBuildBuddyServiceClient(conn).GetInvocation(ctx, &invocation.GetInvocationRequest{
+// dialBackend connects to the API target, which defaults to the backend of the
+// last build, and returns a context authenticated with the user's API key.
+func dialBackend() (context.Context, *grpc_client.ClientConnPool, error) {
+	apiKey, err := login.GetAPIKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-buildbuddy-api-key", apiKey)
+	backend := *apiTarget
+	if backend == "" {
+		backend, err = flaghistory.GetLastBackend()
+		if err != nil {
+			log.Debugf("Failed to get last backend: %v", err)
+		}
+		if backend == "" {
+			backend = login.DefaultApiTarget
+		}
+	}
+	conn, err := grpc_client.DialSimple(backend)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx, conn, nil
+}
+
+// lastGreenInvocation returns the ID of the most recent successful invocation
+// on the given branch of the current workspace's git repository that uploaded
+// an execution log.
+func lastGreenInvocation(branch string) (string, error) {
+	repoURL, err := workspaceRepoURL()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the repository to find the last green invocation for: %v", err)
+	}
+	ctx, conn, err := dialBackend()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return findLastGreenInvocation(ctx, bbspb.NewBuildBuddyServiceClient(conn), repoURL, branch)
+}
+
+// findLastGreenInvocation returns the ID of the most recent successful
+// invocation on the given branch of the given repository that uploaded an
+// execution log.
+func findLastGreenInvocation(ctx context.Context, client bbspb.BuildBuddyServiceClient, repoURL, branch string) (string, error) {
+	resp, err := client.SearchInvocation(ctx, &invocation.SearchInvocationRequest{
+		Query: &invocation.InvocationQuery{
+			RepoUrl:    repoURL,
+			BranchName: branch,
+			Status:     []invocation_status.OverallStatus{invocation_status.OverallStatus_SUCCESS},
+		},
+		Sort: &invocation.InvocationSort{
+			SortField: invocation.InvocationSort_UPDATED_AT_USEC_SORT_FIELD,
+		},
+		Count: lastGreenSearchCount,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to search for invocations on %s: %v", branch, err)
+	}
+	// Not every build produces an execution log, so pick the most recent one
+	// that did.
+	for _, inv := range resp.GetInvocation() {
+		if _, err := getExecLogResource(ctx, client, inv.GetInvocationId()); err != nil {
+			log.Debugf("Skipping invocation %s: %v", inv.GetInvocationId(), err)
+			continue
+		}
+		return inv.GetInvocationId(), nil
+	}
+	return "", fmt.Errorf("no successful invocation with an execution log found on branch %s of %s", branch, repoURL)
+}
+
+func workspaceRepoURL() (string, error) {
+	ws, err := workspace.Path()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	cmd.Dir = ws
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the URL of the origin remote: %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func getExecLogResource(ctx context.Context, client bbspb.BuildBuddyServiceClient, invocationId string) (*digest.CASResourceName, error) {
+	resp, err := client.GetInvocation(ctx, &invocation.GetInvocationRequest{
 		Lookup: &invocation.InvocationLookup{InvocationId: invocationId},
 	})
 	if err != nil {
@@ -274,6 +414,27 @@ outer:
 	return resource, nil
 }
 
+func writeDiffResult(w io.Writer, diffResult *spawn_diff.DiffResult) error {
+	var b []byte
+	var err error
+	switch *output {
+	case jsonOutput:
+		b, err = protojson.MarshalOptions{Multiline: true}.Marshal(diffResult)
+		b = append(b, '\n')
+	case protoOutput:
+		b, err = proto.Marshal(diffResult)
+	default:
+		writeHeader(w, diffResult.OldInvocationId, diffResult.NewInvocationId)
+		writeSpawnDiffs(w, diffResult.SpawnDiffs)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal diff: %v", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
 func writeHeader(w io.Writer, oldInvocationId, newInvocationId string) {
 	besResultsUrl, err := flaghistory.GetPreviousFlag(flaghistory.BesResultsUrlFlagName)
 	if err != nil {
@@ -0,0 +1,318 @@
+package explain
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	inspb "github.com/buildbuddy-io/buildbuddy/proto/invocation_status"
+	"github.com/buildbuddy-io/buildbuddy/proto/spawn_diff"
+)
+
+func TestNormalizeLabel(t *testing.T) {
+	for _, tc := range []struct {
+		label string
+		want  string
+	}{
+		{label: "", want: ""},
+		{label: "//foo:bar", want: "//foo:bar"},
+		{label: "//foo/bar", want: "//foo/bar:bar"},
+		{label: "@//foo:bar", want: "//foo:bar"},
+		{label: "@//foo", want: "//foo:foo"},
+		{label: "@@//foo:bar", want: "//foo:bar"},
+		{label: "@@//foo/bar", want: "//foo/bar:bar"},
+		{label: "@repo//foo:bar", want: "@repo//foo:bar"},
+		{label: "@repo//foo", want: "@repo//foo:foo"},
+		{label: "@@repo+//foo:bar", want: "@@repo+//foo:bar"},
+	} {
+		t.Run(tc.label, func(t *testing.T) {
+			require.Equal(t, tc.want, normalizeLabel(tc.label))
+		})
+	}
+}
+
+const testLogURI = "bytestream://localhost:1985/blobs/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/123"
+
+// fakeBBClient returns the given invocations, most recent first, from
+// SearchInvocation and serves the execution log URIs in logURIs from
+// GetInvocation.
+type fakeBBClient struct {
+	bbspb.BuildBuddyServiceClient
+	invocationIDs []string
+	logURIs       map[string]string
+	searchErr     error
+
+	searchReq *inpb.SearchInvocationRequest
+}
+
+func (c *fakeBBClient) SearchInvocation(ctx context.Context, req *inpb.SearchInvocationRequest, opts ...grpc.CallOption) (*inpb.SearchInvocationResponse, error) {
+	c.searchReq = req
+	if c.searchErr != nil {
+		return nil, c.searchErr
+	}
+	rsp := &inpb.SearchInvocationResponse{}
+	for _, id := range c.invocationIDs {
+		rsp.Invocation = append(rsp.Invocation, &inpb.Invocation{InvocationId: id})
+	}
+	return rsp, nil
+}
+
+func (c *fakeBBClient) GetInvocation(ctx context.Context, req *inpb.GetInvocationRequest, opts ...grpc.CallOption) (*inpb.GetInvocationResponse, error) {
+	id := req.GetLookup().GetInvocationId()
+	inv := &inpb.Invocation{InvocationId: id}
+	if uri, ok := c.logURIs[id]; ok {
+		inv.Event = append(inv.Event, &inpb.InvocationEvent{
+			BuildEvent: &bespb.BuildEvent{
+				Payload: &bespb.BuildEvent_BuildToolLogs{BuildToolLogs: &bespb.BuildToolLogs{
+					Log: []*bespb.File{{
+						Name: "execution_log.binpb.zst",
+						File: &bespb.File_Uri{Uri: uri},
+					}},
+				}},
+			},
+		})
+	}
+	return &inpb.GetInvocationResponse{Invocation: []*inpb.Invocation{inv}}, nil
+}
+
+func TestFindLastGreenInvocation(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		invocationIDs []string
+		logURIs       map[string]string
+		searchErr     error
+		want          string
+		wantErr       bool
+	}{
+		{
+			name:          "most recent invocation has a log",
+			invocationIDs: []string{"inv-3", "inv-2", "inv-1"},
+			logURIs:       map[string]string{"inv-3": testLogURI, "inv-2": testLogURI},
+			want:          "inv-3",
+		},
+		{
+			name:          "invocations without a log are skipped",
+			invocationIDs: []string{"inv-3", "inv-2", "inv-1"},
+			logURIs:       map[string]string{"inv-1": testLogURI},
+			want:          "inv-1",
+		},
+		{
+			name:          "invocations with an unsupported log URI are skipped",
+			invocationIDs: []string{"inv-2", "inv-1"},
+			logURIs:       map[string]string{"inv-2": "file:///tmp/execution_log.binpb.zst", "inv-1": testLogURI},
+			want:          "inv-1",
+		},
+		{
+			name:          "no invocation has a log",
+			invocationIDs: []string{"inv-2", "inv-1"},
+			wantErr:       true,
+		},
+		{
+			name:    "no successful invocations",
+			wantErr: true,
+		},
+		{
+			name:      "search fails",
+			searchErr: fmt.Errorf("unavailable"),
+			wantErr:   true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &fakeBBClient{
+				invocationIDs: tc.invocationIDs,
+				logURIs:       tc.logURIs,
+				searchErr:     tc.searchErr,
+			}
+			id, err := findLastGreenInvocation(context.Background(), client, "https://github.com/org/repo", "main")
+
+			query := client.searchReq.GetQuery()
+			require.Equal(t, "https://github.com/org/repo", query.GetRepoUrl())
+			require.Equal(t, "main", query.GetBranchName())
+			require.Equal(t, []inspb.OverallStatus{inspb.OverallStatus_SUCCESS}, query.GetStatus())
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, id)
+		})
+	}
+}
+
+func testDiffResult() *spawn_diff.DiffResult {
+	return &spawn_diff.DiffResult{
+		OldInvocationId: "old-invocation",
+		NewInvocationId: "new-invocation",
+		SpawnDiffs: []*spawn_diff.SpawnDiff{
+			{
+				PrimaryOutput: "bazel-out/k8-fastbuild/bin/foo/old.a",
+				TargetLabel:   "//foo:old",
+				Mnemonic:      "GoCompile",
+				Diff:          &spawn_diff.SpawnDiff_OldOnly{OldOnly: &spawn_diff.OldOnly{TopLevel: true}},
+			},
+			{
+				PrimaryOutput: "bazel-out/k8-fastbuild/bin/foo/old_dep.a",
+				TargetLabel:   "//foo:old_dep",
+				Mnemonic:      "GoCompile",
+				Diff:          &spawn_diff.SpawnDiff_OldOnly{OldOnly: &spawn_diff.OldOnly{}},
+			},
+			{
+				PrimaryOutput: "bazel-out/k8-fastbuild/bin/foo/new",
+				TargetLabel:   "//foo:new",
+				Mnemonic:      "GoLink",
+				Diff:          &spawn_diff.SpawnDiff_NewOnly{NewOnly: &spawn_diff.NewOnly{TopLevel: true}},
+			},
+			{
+				PrimaryOutput: "bazel-out/k8-fastbuild/bin/foo/bar.a",
+				TargetLabel:   "//foo:bar",
+				Mnemonic:      "GoCompile",
+				Diff: &spawn_diff.SpawnDiff_Modified{Modified: &spawn_diff.Modified{
+					Diffs: []*spawn_diff.Diff{
+						{Diff: &spawn_diff.Diff_InputPaths{InputPaths: &spawn_diff.StringSetDiff{
+							OldOnly: []string{"foo/old.go"},
+							NewOnly: []string{"foo/new.go"},
+						}}},
+						{Diff: &spawn_diff.Diff_ExitCode{ExitCode: &spawn_diff.IntDiff{Old: 0, New: 1}}},
+					},
+					TransitivelyInvalidated: map[string]uint32{"GoLink": 1, "GoCompile": 3},
+					TransitivelyInvalidatedOutputs: []string{
+						"bazel-out/k8-fastbuild/bin/foo/bin",
+						"bazel-out/k8-fastbuild/bin/foo/baz.a",
+						"bazel-out/k8-fastbuild/bin/foo/qux.a",
+						"bazel-out/k8-fastbuild/bin/foo/quux.a",
+					},
+				}},
+			},
+			{
+				PrimaryOutput: "bazel-out/k8-fastbuild/bin/foo/stamp.txt",
+				TargetLabel:   "//foo:stamp",
+				Mnemonic:      "Genrule",
+				Diff: &spawn_diff.SpawnDiff_Modified{Modified: &spawn_diff.Modified{
+					Diffs: []*spawn_diff.Diff{
+						{Diff: &spawn_diff.Diff_InputPaths{InputPaths: &spawn_diff.StringSetDiff{
+							NewOnly: []string{"bazel-out/volatile-status.txt"},
+						}}},
+					},
+					Expected: true,
+				}},
+			},
+		},
+	}
+}
+
+func setOutputFlags(t *testing.T, format string, verboseOutput bool) {
+	oldOutput, oldVerbose := *output, *verbose
+	*output, *verbose = format, verboseOutput
+	t.Cleanup(func() {
+		*output, *verbose = oldOutput, oldVerbose
+	})
+}
+
+func TestWriteDiffResult_Text(t *testing.T) {
+	// Don't pick up the results URL from the user's flag history.
+	t.Setenv("BUILDBUDDY_CACHE_DIR", t.TempDir())
+
+	for _, tc := range []struct {
+		name    string
+		verbose bool
+		want    string
+	}{
+		{
+			name: "default",
+			want: `old invocation: old-invocation
+new invocation: new-invocation
+
+old only (pass --verbose to see details):
+       2 GoCompile
+
+new only (pass --verbose to see details):
+       1 GoLink
+
+GoCompile //foo:bar (bazel-out/k8-fastbuild/bin/foo/bar.a)
+  input paths changed:
+    - foo/old.go
+    + foo/new.go
+  exit code changed (action is flaky): 0 -> 1
+  transitively invalidated:
+         3 GoCompile
+         1 GoLink
+
+`,
+		},
+		{
+			name:    "verbose",
+			verbose: true,
+			want: `old invocation: old-invocation
+new invocation: new-invocation
+
+old only (top-level executions only):
+  GoCompile //foo:old (bazel-out/k8-fastbuild/bin/foo/old.a)
+
+old only (transitive executions):
+       1 GoCompile
+
+new only (top-level executions only):
+  GoLink //foo:new (bazel-out/k8-fastbuild/bin/foo/new)
+GoCompile //foo:bar (bazel-out/k8-fastbuild/bin/foo/bar.a)
+  input paths changed:
+    - foo/old.go
+    + foo/new.go
+  exit code changed (action is flaky): 0 -> 1
+  transitively invalidated:
+         3 GoCompile
+         1 GoLink
+
+Genrule //foo:stamp (bazel-out/k8-fastbuild/bin/foo/stamp.txt)
+  input paths changed:
+    + bazel-out/volatile-status.txt
+
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setOutputFlags(t, textOutput, tc.verbose)
+			var buf bytes.Buffer
+
+			err := writeDiffResult(&buf, testDiffResult())
+
+			require.NoError(t, err)
+			require.Equal(t, tc.want, buf.String())
+		})
+	}
+}
+
+func TestWriteDiffResult_Machine(t *testing.T) {
+	for _, tc := range []struct {
+		format    string
+		unmarshal func([]byte, proto.Message) error
+	}{
+		{format: jsonOutput, unmarshal: protojson.Unmarshal},
+		{format: protoOutput, unmarshal: proto.Unmarshal},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			// The machine-readable formats contain every spawn diff,
+			// including the ones the text format omits without --verbose.
+			setOutputFlags(t, tc.format, false)
+			var buf bytes.Buffer
+
+			err := writeDiffResult(&buf, testDiffResult())
+
+			require.NoError(t, err)
+			got := &spawn_diff.DiffResult{}
+			err = tc.unmarshal(buf.Bytes(), got)
+			require.NoError(t, err)
+			require.Empty(t, cmp.Diff(testDiffResult(), got, protocmp.Transform()))
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package shell
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/buildbuddy-io/buildbuddy/cli/arg"
+	"github.com/buildbuddy-io/buildbuddy/cli/log"
+	"github.com/buildbuddy-io/buildbuddy/cli/login"
+	"github.com/buildbuddy-io/buildbuddy/cli/terminal"
+	"github.com/buildbuddy-io/buildbuddy/server/util/grpc_client"
+	"golang.org/x/term"
+	"google.golang.org/grpc/metadata"
+
+	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
+)
+
+const (
+	// How many bytes of input to read at once.
+	stdinBufferSize = 4096
+)
+
+var (
+	flags = flag.NewFlagSet("shell", flag.ContinueOnError)
+
+	target = flags.String("target", login.DefaultApiTarget, "BuildBuddy gRPC target")
+	usage  = `
+usage: bb ` + flags.Name() + ` [--target=grpcs://remote.buildbuddy.io] execution_id
+
+Starts an interactive shell in the container of a remote execution.
+
+The execution must either still be running, or must have failed recently
+enough that its executor is still holding on to its container. The executor
+must use the oci, podman or firecracker isolation type, and must have debug
+shells enabled.
+
+The shell runs with the action's environment variables, in the action's
+working directory. Exiting the shell does not affect the execution.
+
+Example:
+  $ bb shell uploads/8f0a4f2c-.../blobs/blake3/8b0e.../142
+`
+)
+
+func HandleShell(args []string) (int, error) {
+	if err := arg.ParseFlagSet(flags, args); err != nil {
+		if err == flag.ErrHelp {
+			log.Print(usage)
+			return 1, nil
+		}
+		return 1, err
+	}
+
+	if *target == "" {
+		log.Printf("A non-empty --target must be specified")
+		return 1, nil
+	}
+	if len(flags.Args()) != 1 {
+		log.Print(usage)
+		return 1, nil
+	}
+
+	exitCode, err := runShell(flags.Arg(0))
+	if err != nil {
+		log.Print(err)
+		return 1, nil
+	}
+	return exitCode, nil
+}
+
+func runShell(executionID string) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if apiKey, err := login.GetAPIKey(); err == nil && apiKey != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-buildbuddy-api-key", apiKey)
+	}
+
+	conn, err := grpc_client.DialSimple(*target)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	stream, err := bbspb.NewBuildBuddyServiceClient(conn).DebugShell(ctx)
+	if err != nil {
+		return 0, err
+	}
+	req := &dspb.ShellRequest{
+		ExecutionId: executionID,
+		Term:        os.Getenv("TERM"),
+	}
+	if terminal.IsTTY(os.Stdin) {
+		fd := int(os.Stdin.Fd())
+		if cols, rows, err := term.GetSize(fd); err == nil {
+			req.TerminalSize = &dspb.TerminalSize{Rows: int32(rows), Cols: int32(cols)}
+		}
+		// Pass all input, including control characters like Ctrl+C, through
+		// to the remote shell.
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return 0, err
+		}
+		defer term.Restore(fd, state)
+	}
+	if err := stream.Send(req); err != nil {
+		return 0, err
+	}
+
+	go func() {
+		buf := make([]byte, stdinBufferSize)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if err := stream.Send(&dspb.ShellRequest{Stdin: append([]byte{}, buf[:n]...)}); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				stream.CloseSend()
+				return
+			}
+		}
+	}()
+
+	for {
+		rsp, err := stream.Recv()
+		if err == io.EOF {
+			return 0, errors.New("the debug shell session ended unexpectedly")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, err := os.Stdout.Write(rsp.GetOutput()); err != nil {
+			return 0, err
+		}
+		if rsp.GetExited() {
+			return int(rsp.GetExitCode()), nil
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 
 var (
 	// Match `case:yes` or `case:y` and enable case-sensitive searches.
-	caseMatcher = regexp.MustCompile(`case:(yes|y|no|n)`)
+	// `case:auto` enables case-sensitive searches only if the query contains
+	// an upper case letter.
+	caseMatcher = regexp.MustCompile(`case:(yes|y|no|n|auto)`)
 
 	// match `file:test.js`, `f:test.js`, and `path:test.js`
 	fileMatcher = regexp.MustCompile(`(?:file:|f:|path:)(?P<filepath>[[:graph:]]+)`)
@@ -21,6 +23,10 @@ var (
 
 	// match `repo:buildbuddy-io` or `repo:buildbuddy-internal`
 	repoMatcher = regexp.MustCompile(`(?:repo:)(?P<repo>[A-Za-z0-9\._-]+)`)
+
+	// match `sym:NewServer` (definitions and references of the symbol) or
+	// `def:NewServer` (only definitions of the symbol).
+	symbolMatcher = regexp.MustCompile(`(?:^|\s)(?P<kind>sym|def):(?P<symbol>[[:graph:]]+)`)
 )
 
 // TODO(tylerw): ensure that atoms inside of quotes are not parsed?
@@ -32,6 +38,8 @@ func ExtractCaseSensitivity(q string) (string, bool) {
 		q = caseMatcher.ReplaceAllString(q, "")
 		if strings.HasPrefix(caseMatch[1], "y") {
 			isCaseSensitive = true
+		} else if caseMatch[1] == "auto" {
+			isCaseSensitive = strings.ToLower(q) != q
 		}
 	}
 	return q, isCaseSensitive
@@ -71,3 +79,15 @@ func ExtractRepoFilter(q string) (string, string) {
 	}
 	return q, repo
 }
+
+// ExtractSymbolFilter extracts a `sym:` or `def:` atom from the query. It
+// returns the query without the atom, the symbol name, and whether only
+// definitions of the symbol should be matched.
+func ExtractSymbolFilter(q string) (string, string, bool) {
+	symbolMatch := symbolMatcher.FindStringSubmatch(q)
+	if len(symbolMatch) != 3 {
+		return q, "", false
+	}
+	q = symbolMatcher.ReplaceAllString(q, " ")
+	return q, symbolMatch[2], symbolMatch[1] == "def"
+}
@@ -16,6 +16,8 @@ func TestExtractCaseSensitivity(t *testing.T) {
 		{"case:n foo", " foo", false},
 		{"foo case:y", "foo ", true},
 		{"foo bar", "foo bar", false},
+		{"case:auto foo", " foo", false},
+		{"case:auto Foo", " Foo", true},
 	}
 	for _, ct := range caseTests {
 		gotQ, gotEnabled := filters.ExtractCaseSensitivity(ct.q)
@@ -74,3 +76,23 @@ func TestExtractRepoFilter(t *testing.T) {
 		assert.Equal(t, rt.wantRepo, gotRepo, "extracted repo mismatch")
 	}
 }
+
+func TestExtractSymbolFilter(t *testing.T) {
+	symbolTests := []struct {
+		q                   string // input query
+		wantQ               string // query after extraction
+		wantSymbol          string // extracted symbol
+		wantDefinitionsOnly bool   // only definitions should match
+	}{
+		{"sym:NewServer", " ", "NewServer", false},
+		{"def:server.NewServer lang:go", "  lang:go", "server.NewServer", true},
+		{"undef:foo", "undef:foo", "", false},
+		{"foo bar", "foo bar", "", false},
+	}
+	for _, st := range symbolTests {
+		gotQ, gotSymbol, gotDefinitionsOnly := filters.ExtractSymbolFilter(st.q)
+		assert.Equal(t, st.wantQ, gotQ, "extracted query should match")
+		assert.Equal(t, st.wantSymbol, gotSymbol, "extracted symbol mismatch")
+		assert.Equal(t, st.wantDefinitionsOnly, gotDefinitionsOnly, "definitions only mismatch")
+	}
+}
@@ -3,6 +3,7 @@ package github
 import (
 	"bytes"
 	"fmt"
+	"maps"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -118,6 +119,56 @@ func ProcessCommit(w types.IndexWriter, repoURL *git.RepoURL, commit *inpb.Commi
 	return nil
 }
 
+// fileChange is the net change to a single file across a range of commits.
+type fileChange struct {
+	// The SHA of the last commit that changed the file.
+	commitSHA string
+	// The content of the file after the last commit, or nil if the file was
+	// deleted (or renamed away).
+	content []byte
+}
+
+// ProcessCommits applies the net effect of a sequence of commits to the index.
+// Each file is reindexed at most once, with its content as of the last commit
+// that changed it, and files that were deleted or renamed away by the end of
+// the sequence are removed. Files that are untouched by the commits are not
+// read or rewritten.
+// The commits must be in order, with each commit following its parent. If any
+// file can't be indexed, processing is halted and an error is returned.
+// This function does not flush the index writer, so the caller is responsible for doing that.
+func ProcessCommits(w types.IndexWriter, repoURL *git.RepoURL, commits []*inpb.Commit) error {
+	changes := make(map[string]fileChange)
+	for _, commit := range commits {
+		// Deletes are processed before adds, see ProcessCommit.
+		for _, deletePath := range commit.GetDeleteFilepaths() {
+			changes[deletePath] = fileChange{commitSHA: commit.GetSha()}
+		}
+		for _, add := range commit.GetAddsAndUpdates() {
+			content := add.GetContent()
+			if content == nil {
+				content = []byte{}
+			}
+			changes[add.GetFilepath()] = fileChange{commitSHA: commit.GetSha(), content: content}
+		}
+	}
+
+	idFieldSchema := schema.GitHubFileSchema().Field(schema.IDField)
+	for _, path := range slices.Sorted(maps.Keys(changes)) {
+		change := changes[path]
+		if change.content == nil {
+			idField := idFieldSchema.MakeField(makeFileId(repoURL, path))
+			if err := w.DeleteDocumentByMatchField(idField); err != nil {
+				return status.InternalErrorf("Failed to delete document %s in commit %s: %v", path, change.commitSHA, err)
+			}
+			continue
+		}
+		if err := AddFileToIndex(w, repoURL, change.commitSHA, path, change.content); err != nil {
+			return status.InternalErrorf("Failed to add document %s in commit %s: %v", path, change.commitSHA, err)
+		}
+	}
+	return nil
+}
+
 // Records the most recently indexed commit SHA in the index.
 func SetLastIndexedCommitSha(w types.IndexWriter, repoURL *git.RepoURL, commitSHA string) error {
 	doc := makeLastIndexedDoc(repoURL, commitSHA)
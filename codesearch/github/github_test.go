@@ -320,6 +320,64 @@ func TestProcessCommit_OverlappingAddsAndDeletes(t *testing.T) {
 	assert.Equal(t, "package baz\n\nfunc Beetle() {}\n", string(doc.Field(schema.ContentField).Contents()))
 }
 
+func TestProcessCommits(t *testing.T) {
+	ctx := context.Background()
+	db := mustOpenDB(t, testfs.MakeTempDir(t))
+
+	mustApplyCommit(t, db, &inpb.Commit{
+		Sha: "abc123",
+		AddsAndUpdates: []*inpb.File{
+			{Filepath: "a.go", Content: []byte("package a // v1\n")},
+			{Filepath: "b.go", Content: []byte("package b\n")},
+			{Filepath: "c.go", Content: []byte("package c\n")},
+		},
+	})
+
+	w, err := index.NewAtomicWriter(db, "testing-namespace")
+	require.NoError(t, err)
+	err = ProcessCommits(w, repoURL, []*inpb.Commit{
+		{
+			Sha:       "def456",
+			ParentSha: "abc123",
+			AddsAndUpdates: []*inpb.File{
+				{Filepath: "a.go", Content: []byte("package a // v2\n")},
+				{Filepath: "d.go", Content: []byte("package b\n")},
+			},
+			// b.go renamed to d.go
+			DeleteFilepaths: []string{"b.go"},
+		},
+		{
+			Sha:       "ghi789",
+			ParentSha: "def456",
+			AddsAndUpdates: []*inpb.File{
+				{Filepath: "a.go", Content: []byte("package a // v3\n")},
+			},
+			DeleteFilepaths: []string{"c.go"},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+
+	r := index.NewReader(ctx, db, "testing-namespace", schema.GitHubFileSchema())
+	// The original versions of all files are gone.
+	for _, docID := range []uint64{1, 2, 3} {
+		assert.Empty(t, r.GetStoredDocument(docID).Field(schema.ContentField).Contents())
+	}
+
+	// a.go is indexed once, at its latest version.
+	doc := r.GetStoredDocument(1<<32 | 1)
+	assert.Equal(t, "a.go", string(doc.Field(schema.FilenameField).Contents()))
+	assert.Equal(t, "package a // v3\n", string(doc.Field(schema.ContentField).Contents()))
+	assert.Equal(t, "ghi789", string(doc.Field(schema.SHAField).Contents()))
+
+	doc = r.GetStoredDocument(1<<32 | 2)
+	assert.Equal(t, "d.go", string(doc.Field(schema.FilenameField).Contents()))
+	assert.Equal(t, "def456", string(doc.Field(schema.SHAField).Contents()))
+
+	doc = r.GetStoredDocument(1<<32 | 3)
+	assert.Empty(t, doc.Field(schema.FilenameField).Contents())
+}
+
 type fakeGitClient struct {
 	commands map[string]string
 	files    map[string][]byte
@@ -50,6 +50,10 @@ type Writer struct {
 	deletes           posting.List
 	batch             *pebble.Batch
 	tokenizers        map[string]types.Tokenizer
+
+	// If set, the batch is never committed before Flush is called, so that
+	// readers see either none or all of the writer's changes.
+	atomic bool
 }
 
 func NewWriter(db *pebble.DB, namespace string) (*Writer, error) {
@@ -72,6 +76,19 @@ func NewWriter(db *pebble.DB, namespace string) (*Writer, error) {
 	}, nil
 }
 
+// NewAtomicWriter returns a Writer whose changes are committed in a single
+// batch by Flush, so queries never observe a partially applied update. The
+// whole update is buffered in memory, so this is intended for updates of
+// bounded size, like incremental updates of a repo.
+func NewAtomicWriter(db *pebble.DB, namespace string) (*Writer, error) {
+	w, err := NewWriter(db, namespace)
+	if err != nil {
+		return nil, err
+	}
+	w.atomic = true
+	return w, nil
+}
+
 func BytesToUint64(buf []byte) uint64 {
 	return binary.LittleEndian.Uint64(buf)
 }
@@ -452,7 +469,7 @@ func (w *Writer) AddDocument(doc types.Document) error {
 			w.batch.Set(storedFieldKey, field.Contents(), nil)
 		}
 	}
-	if w.batch.Len() >= batchFlushSizeBytes {
+	if !w.atomic && w.batch.Len() >= batchFlushSizeBytes {
 		if err := w.flushBatch(); err != nil {
 			return err
 		}
@@ -485,7 +502,7 @@ func (w *Writer) updatePostingList(key []byte, pl posting.List, deferOp func(int
 	if err := op.Finish(); err != nil {
 		return err
 	}
-	if w.batch.Len() >= batchFlushSizeBytes {
+	if !w.atomic && w.batch.Len() >= batchFlushSizeBytes {
 		if err := w.flushBatch(); err != nil {
 			return err
 		}
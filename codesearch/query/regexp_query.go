@@ -6,7 +6,11 @@ import (
 	"context"
 	"encoding/csv"
 	"fmt"
+	"maps"
+	"path"
+	"regexp"
 	"regexp/syntax"
+	"slices"
 	"strconv"
 	"strings"
 
@@ -23,6 +27,16 @@ const (
 	// Find a way to specify them from the indexer / searcher?
 	filenameField = "filename"
 	contentField  = "content"
+	repoField     = "repo"
+
+	// The maximum number of files a `sym:` or `def:` query is restricted to.
+	maxSymbolFiles = 500
+
+	// Added to the score of files that define or reference the symbol being
+	// searched for. Definitions get a boost large enough that they always rank
+	// above references (BM25 scores are less than 2.2).
+	definitionBoost = 10.0
+	referenceBoost  = 1.0
 )
 
 var (
@@ -31,6 +45,7 @@ var (
 	_ types.Query             = (*ReQuery)(nil)
 	_ types.HighlightedRegion = (*regionMatch)(nil)
 	_ types.Scorer            = (*fieldScorer)(nil)
+	_ types.Scorer            = (*symbolScorer)(nil)
 )
 
 func countNL(b []byte) int {
@@ -228,13 +243,75 @@ func extractLine(buf []byte, lineNumber int) []byte {
 	return nil
 }
 
+// symbolFile identifies a file by the name of its repository and its path
+// within the repository.
+type symbolFile struct {
+	repo     string
+	filename string
+}
+
+func symbolFileOfLocation(l types.SymbolLocation) symbolFile {
+	return symbolFile{
+		repo:     path.Base(l.Corpus),
+		filename: path.Join(l.Root, l.Filename),
+	}
+}
+
+func symbolFileOfDoc(doc types.Document) symbolFile {
+	return symbolFile{
+		repo:     string(doc.Field(repoField).Contents()),
+		filename: string(doc.Field(filenameField).Contents()),
+	}
+}
+
+func (f symbolFile) compare(other symbolFile) int {
+	if c := strings.Compare(f.repo, other.repo); c != 0 {
+		return c
+	}
+	return strings.Compare(f.filename, other.filename)
+}
+
+// symbolScorer ranks files that define the searched-for symbol above files
+// that only reference it, and breaks ties with the scores of the rest of the
+// query.
+type symbolScorer struct {
+	locations map[symbolFile][]types.SymbolLocation
+	scorer    *fieldScorer
+}
+
+func (ss *symbolScorer) Skip() bool {
+	return false
+}
+
+func (ss *symbolScorer) Score(docMatch types.DocumentMatch, doc types.Document) float64 {
+	locations := ss.locations[symbolFileOfDoc(doc)]
+	if len(locations) == 0 {
+		return 0.0
+	}
+	score := referenceBoost
+	if slices.ContainsFunc(locations, func(l types.SymbolLocation) bool { return l.Definition }) {
+		score = definitionBoost
+	}
+	if !ss.scorer.Skip() {
+		s := ss.scorer.Score(docMatch, doc)
+		if s == 0.0 {
+			// The rest of the query doesn't match.
+			return 0.0
+		}
+		score += s
+	}
+	return score
+}
+
 type reHighlighter struct {
-	contentMatcher *dfa.Regexp
+	contentMatcher  *dfa.Regexp
+	symbolLocations map[symbolFile][]types.SymbolLocation
 }
 
 type regionMatch struct {
-	field  types.Field
-	region region
+	field      types.Field
+	region     region
+	definition bool
 }
 
 func (rm regionMatch) FieldName() string {
@@ -249,6 +326,10 @@ func (rm regionMatch) Line() int {
 	return rm.region.lineNumber
 }
 
+func (rm regionMatch) Definition() bool {
+	return rm.definition
+}
+
 func (rm regionMatch) CustomSnippet(linesBefore, linesAfter int) string {
 	lineNumber := rm.region.lineNumber
 	snippetText := ""
@@ -275,6 +356,18 @@ func (h *reHighlighter) Highlight(doc types.Document) []types.HighlightedRegion
 	results := make([]types.HighlightedRegion, 0)
 
 	field := doc.Field(contentField)
+	if locations := h.symbolLocations[symbolFileOfDoc(doc)]; len(locations) > 0 {
+		// Symbol locations are sorted by line, so each file's definitions
+		// and references are grouped into a single result, in file order.
+		for _, l := range locations {
+			results = append(results, types.HighlightedRegion(regionMatch{
+				field:      field,
+				region:     region{lineNumber: l.Line},
+				definition: l.Definition,
+			}))
+		}
+		return results
+	}
 	if h.contentMatcher != nil {
 		for _, region := range match(h.contentMatcher.Clone(), field.Contents()) {
 			region := region
@@ -308,8 +401,92 @@ type ReQuery struct {
 	parsed string
 	squery string
 
-	scorer         *fieldScorer
-	contentMatcher *dfa.Regexp
+	scorer          types.Scorer
+	contentMatcher  *dfa.Regexp
+	symbolLocations map[symbolFile][]types.SymbolLocation
+}
+
+type queryOptions struct {
+	symbolResolver types.SymbolResolver
+}
+
+// Option configures optional query features.
+type Option func(*queryOptions)
+
+// WithSymbolResolver enables `sym:` and `def:` atoms, which restrict results
+// to files that reference or define a symbol, as found by the given resolver.
+func WithSymbolResolver(r types.SymbolResolver) Option {
+	return func(o *queryOptions) {
+		o.symbolResolver = r
+	}
+}
+
+// groupSymbolLocations groups locations by file, with each file's locations
+// sorted by line. If there are more than maxSymbolFiles files, files with
+// definitions are kept in preference to files with only references.
+func groupSymbolLocations(locations []types.SymbolLocation) map[symbolFile][]types.SymbolLocation {
+	byFile := make(map[symbolFile][]types.SymbolLocation)
+	for _, l := range locations {
+		f := symbolFileOfLocation(l)
+		byFile[f] = append(byFile[f], l)
+	}
+	for f, fileLocations := range byFile {
+		slices.SortFunc(fileLocations, func(a, b types.SymbolLocation) int {
+			return a.Line - b.Line
+		})
+		// Merge locations on the same line, keeping track of whether any
+		// of them is a definition.
+		deduped := fileLocations[:1]
+		for _, l := range fileLocations[1:] {
+			last := &deduped[len(deduped)-1]
+			if l.Line == last.Line {
+				last.Definition = last.Definition || l.Definition
+				continue
+			}
+			deduped = append(deduped, l)
+		}
+		byFile[f] = deduped
+	}
+	if len(byFile) <= maxSymbolFiles {
+		return byFile
+	}
+	files := slices.Collect(maps.Keys(byFile))
+	hasDefinition := func(f symbolFile) bool {
+		return slices.ContainsFunc(byFile[f], func(l types.SymbolLocation) bool { return l.Definition })
+	}
+	slices.SortFunc(files, func(a, b symbolFile) int {
+		if hasDefinition(a) != hasDefinition(b) {
+			if hasDefinition(a) {
+				return -1
+			}
+			return 1
+		}
+		return a.compare(b)
+	})
+	for _, f := range files[maxSymbolFiles:] {
+		delete(byFile, f)
+	}
+	return byFile
+}
+
+// symbolSquery returns an s-expression that matches the given files.
+func symbolSquery(byFile map[symbolFile][]types.SymbolLocation) (string, error) {
+	if len(byFile) == 0 {
+		return "(:none)", nil
+	}
+	files := slices.SortedFunc(maps.Keys(byFile), symbolFile.compare)
+	clauses := make([]string, 0, len(files))
+	for _, f := range files {
+		filenameQ, err := expressionToSquery("^"+regexp.QuoteMeta(f.filename)+"$", filenameField)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, fmt.Sprintf("(:and (:eq %s %s) %s)", repoField, strconv.Quote(f.repo), filenameQ))
+	}
+	if len(clauses) == 1 {
+		return clauses[0], nil
+	}
+	return "(:or " + strings.Join(clauses, " ") + ")", nil
 }
 
 func expressionToSquery(expr string, fieldName string) (string, error) {
@@ -320,10 +497,15 @@ func expressionToSquery(expr string, fieldName string) (string, error) {
 	return RegexpQuery(syn).SQuery(fieldName), nil
 }
 
-func NewReQuery(ctx context.Context, q string) (*ReQuery, error) {
+func NewReQuery(ctx context.Context, q string, opts ...Option) (*ReQuery, error) {
 	subLog := log.NamedSubLogger("regexp-query")
 	subLog.Infof("raw query: [%s]", q)
 
+	options := &queryOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
+
 	// A list of s-expression strings that must be satisfied by the query.
 	// (added to the query with AND)
 	sClauses := make([]string, 0)
@@ -331,9 +513,22 @@ func NewReQuery(ctx context.Context, q string) (*ReQuery, error) {
 	// Regex options that will be applied to the main query only.
 	regexFlags := "m" // always use multiline mode.
 
-	q, caseSensitive := filters.ExtractCaseSensitivity(q)
-	if !caseSensitive {
-		regexFlags += "i"
+	var symbolLocations map[symbolFile][]types.SymbolLocation
+	q, symbol, definitionsOnly := filters.ExtractSymbolFilter(q)
+	if len(symbol) > 0 {
+		if options.symbolResolver == nil {
+			return nil, status.UnimplementedError("symbol search is not supported")
+		}
+		locations, err := options.symbolResolver.ResolveSymbol(ctx, symbol, definitionsOnly)
+		if err != nil {
+			return nil, err
+		}
+		symbolLocations = groupSymbolLocations(locations)
+		subQ, err := symbolSquery(symbolLocations)
+		if err != nil {
+			return nil, status.InvalidArgumentError(err.Error())
+		}
+		sClauses = append(sClauses, subQ)
 	}
 
 	q, filename := filters.ExtractFilenameFilter(q)
@@ -367,6 +562,13 @@ func NewReQuery(ctx context.Context, q string) (*ReQuery, error) {
 		sClauses = append(sClauses, subQ)
 	}
 
+	// Extract the case atom last, so that it isn't matched inside the value
+	// of another atom, and so that case:auto only looks at the content terms.
+	q, caseSensitive := filters.ExtractCaseSensitivity(q)
+	if !caseSensitive {
+		regexFlags += "i"
+	}
+
 	q = strings.TrimSpace(q)
 	if len(q) > 0 {
 		flagString := "(?" + regexFlags + ")"
@@ -416,12 +618,16 @@ func NewReQuery(ctx context.Context, q string) (*ReQuery, error) {
 	}
 
 	req := &ReQuery{
-		ctx:            ctx,
-		log:            subLog,
-		squery:         squery,
-		parsed:         q,
-		scorer:         scorer,
-		contentMatcher: contentMatcher,
+		ctx:             ctx,
+		log:             subLog,
+		squery:          squery,
+		parsed:          q,
+		scorer:          scorer,
+		contentMatcher:  contentMatcher,
+		symbolLocations: symbolLocations,
+	}
+	if symbolLocations != nil {
+		req.scorer = &symbolScorer{locations: symbolLocations, scorer: scorer}
 	}
 	return req, nil
 }
@@ -452,7 +658,10 @@ func (req *ReQuery) Scorer() types.Scorer {
 }
 
 func (req *ReQuery) Highlighter() types.Highlighter {
-	return &reHighlighter{req.contentMatcher}
+	return &reHighlighter{
+		contentMatcher:  req.contentMatcher,
+		symbolLocations: req.symbolLocations,
+	}
 }
 
 // TESTONLY: return content matcher to verify regexp params.
@@ -16,6 +16,7 @@ var testSchema = schema.NewDocumentSchema(
 		schema.MustFieldSchema(types.TrigramField, "filename", true),
 		schema.MustFieldSchema(types.SparseNgramField, "content", true),
 		schema.MustFieldSchema(types.KeywordField, "lang", true),
+		schema.MustFieldSchema(types.KeywordField, "repo", true),
 	},
 )
 
@@ -334,3 +335,146 @@ func TestScorerWithShortFilePathNoMatch(t *testing.T) {
 	require.NotNil(t, score)
 	assert.Equal(t, 0.0, score)
 }
+
+type fakeSymbolResolver struct {
+	locations []types.SymbolLocation
+}
+
+func (f *fakeSymbolResolver) ResolveSymbol(ctx context.Context, name string, definitionsOnly bool) ([]types.SymbolLocation, error) {
+	var locations []types.SymbolLocation
+	for _, l := range f.locations {
+		if definitionsOnly && !l.Definition {
+			continue
+		}
+		locations = append(locations, l)
+	}
+	return locations, nil
+}
+
+var testSymbolResolver = &fakeSymbolResolver{
+	locations: []types.SymbolLocation{
+		{Corpus: "github.com/buildbuddy-io/buildbuddy", Filename: "server/server.go", Line: 3, Definition: true},
+		{Corpus: "github.com/buildbuddy-io/buildbuddy", Filename: "server/server.go", Line: 7},
+		{Corpus: "github.com/buildbuddy-io/buildbuddy", Filename: "main.go", Line: 2},
+		// Same paths, but in another repository and in a generated file.
+		{Corpus: "github.com/other/other", Filename: "main.go", Line: 5, Definition: true},
+		{Corpus: "github.com/buildbuddy-io/buildbuddy", Root: "bazel-out/bin", Filename: "main.go", Line: 9, Definition: true},
+	},
+}
+
+func TestSymbolAtomNotSupported(t *testing.T) {
+	ctx := context.Background()
+	_, err := NewReQuery(ctx, "sym:NewServer")
+	require.Error(t, err)
+}
+
+func TestSymbolAtom(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewReQuery(ctx, "sym:NewServer", WithSymbolResolver(testSymbolResolver))
+	require.NoError(t, err)
+	assert.Empty(t, q.ParsedQuery())
+	squery := q.SQuery()
+	assert.Contains(t, squery, `(:eq filename "mai")`)
+	assert.Contains(t, squery, `(:eq filename "ser")`)
+	assert.Contains(t, squery, `(:eq repo "buildbuddy")`)
+	assert.Contains(t, squery, `(:eq repo "other")`)
+
+	definingDoc := newTestDocument(t, map[string][]byte{
+		"id":       []byte("1"),
+		"repo":     []byte("buildbuddy"),
+		"filename": []byte("server/server.go"),
+		"content":  []byte("package server\n\nfunc NewServer() {}\n\nfunc run() {\n\n\tNewServer()\n}\n"),
+	})
+	referencingDoc := newTestDocument(t, map[string][]byte{
+		"id":       []byte("2"),
+		"repo":     []byte("buildbuddy"),
+		"filename": []byte("main.go"),
+		"content":  []byte("func main() {\n\tserver.NewServer()\n}\n"),
+	})
+	otherDoc := newTestDocument(t, map[string][]byte{
+		"id":       []byte("3"),
+		"repo":     []byte("buildbuddy"),
+		"filename": []byte("server/server_test.go"),
+		"content":  []byte("NewServer"),
+	})
+
+	// Definitions rank above references.
+	scorer := q.Scorer()
+	definingScore := scorer.Score(nil, definingDoc)
+	referencingScore := scorer.Score(nil, referencingDoc)
+	assert.Greater(t, definingScore, referencingScore)
+	assert.Greater(t, referencingScore, 0.0)
+	assert.Equal(t, 0.0, scorer.Score(nil, otherDoc))
+
+	// All locations in a file are grouped into its result.
+	regions := q.Highlighter().Highlight(definingDoc)
+	require.Len(t, regions, 2)
+	assert.Equal(t, 3, regions[0].Line())
+	assert.True(t, regions[0].Definition())
+	assert.Equal(t, 7, regions[1].Line())
+	assert.False(t, regions[1].Definition())
+
+	// Locations in other repositories or under another root don't apply to
+	// files with the same path.
+	regions = q.Highlighter().Highlight(referencingDoc)
+	require.Len(t, regions, 1)
+	assert.Equal(t, 2, regions[0].Line())
+	assert.False(t, regions[0].Definition())
+	otherRepoDoc := newTestDocument(t, map[string][]byte{
+		"id":       []byte("4"),
+		"repo":     []byte("other"),
+		"filename": []byte("main.go"),
+		"content":  []byte("package main\n\n\n\nfunc NewServer() {}\n"),
+	})
+	assert.Greater(t, scorer.Score(nil, otherRepoDoc), referencingScore)
+	regions = q.Highlighter().Highlight(otherRepoDoc)
+	require.Len(t, regions, 1)
+	assert.Equal(t, 5, regions[0].Line())
+	assert.True(t, regions[0].Definition())
+}
+
+func TestDefinitionAtom(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewReQuery(ctx, "def:NewServer", WithSymbolResolver(testSymbolResolver))
+	require.NoError(t, err)
+	assert.NotContains(t, q.SQuery(), `(:eq repo "buildbuddy") (:eq filename "mai")`)
+
+	referencingDoc := newTestDocument(t, map[string][]byte{
+		"id":       []byte("2"),
+		"repo":     []byte("buildbuddy"),
+		"filename": []byte("main.go"),
+		"content":  []byte("func main() {\n\tserver.NewServer()\n}\n"),
+	})
+	assert.Equal(t, 0.0, q.Scorer().Score(nil, referencingDoc))
+}
+
+func TestSymbolAtomNoLocations(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewReQuery(ctx, "sym:Unknown", WithSymbolResolver(&fakeSymbolResolver{}))
+	require.NoError(t, err)
+	assert.Equal(t, "(:none)", q.SQuery())
+}
+
+func TestCaseAuto(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewReQuery(ctx, "case:auto Foo")
+	require.NoError(t, err)
+	assert.Contains(t, q.TestOnlyContentMatcher().String(), "(?m)")
+
+	q, err = NewReQuery(ctx, "case:auto foo")
+	require.NoError(t, err)
+	assert.Contains(t, q.TestOnlyContentMatcher().String(), "(?mi)")
+}
+
+func TestCaseAtomInsideOtherAtom(t *testing.T) {
+	ctx := context.Background()
+	q, err := NewReQuery(ctx, "file:case:yes.go foo")
+	require.NoError(t, err)
+	assert.Contains(t, q.TestOnlyContentMatcher().String(), "(?mi)")
+	assert.NotContains(t, q.TestOnlyContentMatcher().String(), "case")
+
+	// Upper case letters in other atoms don't make case:auto sensitive.
+	q, err = NewReQuery(ctx, "case:auto file:Foo.go lang:Go foo")
+	require.NoError(t, err)
+	assert.Contains(t, q.TestOnlyContentMatcher().String(), "(?mi)")
+}
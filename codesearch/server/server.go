@@ -41,6 +41,7 @@ import (
 	"kythe.io/kythe/go/serving/identifiers"
 	"kythe.io/kythe/go/storage/keyvalue"
 	"kythe.io/kythe/go/storage/table"
+	"kythe.io/kythe/go/util/kytheuri"
 
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/index"
 	srpb "github.com/buildbuddy-io/buildbuddy/proto/search"
@@ -50,6 +51,7 @@ import (
 	xsrv "kythe.io/kythe/go/serving/xrefs"
 
 	kgpb "kythe.io/kythe/proto/graph_go_proto"
+	ipb "kythe.io/kythe/proto/identifier_go_proto"
 	kxpb "kythe.io/kythe/proto/xref_go_proto"
 )
 
@@ -191,15 +193,15 @@ func (css *codesearchServer) incrementalUpdate(ctx context.Context, req *inpb.In
 
 	commits = commits[firstIndexToProcess:]
 
-	iw, err := index.NewWriter(css.db, req.GetNamespace())
+	// Apply the whole range in a single batch, so that queries never see a
+	// partially applied update, and only touch the files that changed.
+	iw, err := index.NewAtomicWriter(css.db, req.GetNamespace())
 	if err != nil {
 		return nil, err
 	}
 
-	for _, commit := range commits {
-		if err := github.ProcessCommit(iw, repoURL, commit); err != nil {
-			return nil, status.InternalErrorf("failed to process commit %s: %v", commit.GetSha(), err)
-		}
+	if err := github.ProcessCommits(iw, repoURL, commits); err != nil {
+		return nil, status.InternalErrorf("failed to process commits %s..%s: %v", commits[0].GetParentSha(), commits[len(commits)-1].GetSha(), err)
 	}
 
 	err = github.SetLastIndexedCommitSha(iw, repoURL, commits[len(commits)-1].GetSha())
@@ -417,7 +419,8 @@ func (css *codesearchServer) Search(ctx context.Context, req *srpb.SearchRequest
 		numResults = int(req.GetNumResults())
 	}
 	codesearcher := searcher.New(ctx, index.NewReader(ctx, css.db, namespace, schema.GitHubFileSchema()))
-	q, err := query.NewReQuery(ctx, req.GetQuery().GetTerm())
+	resolver := &kytheSymbolResolver{it: css.it, xs: css.xs}
+	q, err := query.NewReQuery(ctx, req.GetQuery().GetTerm(), query.WithSymbolResolver(resolver))
 	if err != nil {
 		return nil, err
 	}
@@ -473,7 +476,9 @@ func (css *codesearchServer) Search(ctx context.Context, req *srpb.SearchRequest
 				trailingLines = 0
 			}
 			result.Snippets = append(result.Snippets, &srpb.Snippet{
-				Lines: region.CustomSnippet(precedingLines, trailingLines),
+				Lines:      region.CustomSnippet(precedingLines, trailingLines),
+				LineNumber: int32(region.Line()),
+				Definition: region.Definition(),
 			})
 		}
 		if req.GetIncludeContent() {
@@ -497,6 +502,66 @@ func (css *codesearchServer) Search(ctx context.Context, req *srpb.SearchRequest
 	return rsp, nil
 }
 
+// kytheSymbolResolver resolves `sym:` and `def:` queries using the Kythe
+// annotations ingested by IngestAnnotations.
+type kytheSymbolResolver struct {
+	it identifiers.Service
+	xs xrefs.Service
+}
+
+func (r *kytheSymbolResolver) ResolveSymbol(ctx context.Context, name string, definitionsOnly bool) ([]types.SymbolLocation, error) {
+	findReply, err := r.it.Find(ctx, &ipb.FindRequest{
+		Identifier:         name,
+		PickCanonicalNodes: true,
+	})
+	if err != nil {
+		return nil, status.InternalErrorf("failed to find symbol %q: %v", name, err)
+	}
+	tickets := make([]string, 0, len(findReply.GetMatches()))
+	for _, match := range findReply.GetMatches() {
+		tickets = append(tickets, match.GetTicket())
+	}
+	if len(tickets) == 0 {
+		return nil, nil
+	}
+
+	xrefReq := &kxpb.CrossReferencesRequest{
+		Ticket:         tickets,
+		DefinitionKind: kxpb.CrossReferencesRequest_BINDING_DEFINITIONS,
+	}
+	if !definitionsOnly {
+		xrefReq.ReferenceKind = kxpb.CrossReferencesRequest_ALL_REFERENCES
+	}
+	xrefReply, err := r.xs.CrossReferences(ctx, xrefReq)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to get cross-references for symbol %q: %v", name, err)
+	}
+
+	var locations []types.SymbolLocation
+	addAnchors := func(anchors []*kxpb.CrossReferencesReply_RelatedAnchor, definition bool) {
+		for _, ra := range anchors {
+			anchor := ra.GetAnchor()
+			uri, err := kytheuri.Parse(anchor.GetParent())
+			if err != nil {
+				log.Debugf("Skipping anchor with invalid parent %q: %s", anchor.GetParent(), err)
+				continue
+			}
+			locations = append(locations, types.SymbolLocation{
+				Corpus:     uri.Corpus,
+				Root:       uri.Root,
+				Filename:   uri.Path,
+				Line:       int(anchor.GetSpan().GetStart().GetLineNumber()),
+				Definition: definition,
+			})
+		}
+	}
+	for _, set := range xrefReply.GetCrossReferences() {
+		addAnchors(set.GetDefinition(), true)
+		addAnchors(set.GetReference(), false)
+	}
+	return locations, nil
+}
+
 func (css *codesearchServer) extendedXrefs(ctx context.Context, req *srpb.ExtendedXrefsRequest) (*srpb.ExtendedXrefsReply, error) {
 	// This function exists to populate the references panel in the code browser UI.
 	// The overall approach is:
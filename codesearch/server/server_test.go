@@ -214,6 +214,86 @@ func TestIncrementalIndex_SkipSomeCommits(t *testing.T) {
 	}, search)
 }
 
+func TestIncrementalIndex_RenamesAndDeletes(t *testing.T) {
+	ctx := context.Background()
+	server := mustMakeServer(t)
+
+	commit1 := "a123"
+	commit2 := "b456"
+	commit3 := "c789"
+	commit4 := "d012"
+
+	bootstrapIndex(t, ctx, server, "github.com/buildbuddy-io/buildbuddy", commit1)
+
+	_, err := server.Index(ctx, &inpb.IndexRequest{
+		GitRepo: &gitpb.GitRepo{
+			RepoUrl: "github.com/buildbuddy-io/buildbuddy",
+		},
+		ReplacementStrategy: inpb.ReplacementStrategy_INCREMENTAL,
+		Update: &inpb.IncrementalUpdate{
+			Commits: []*inpb.Commit{
+				{
+					Sha:       commit2,
+					ParentSha: commit1,
+					AddsAndUpdates: []*inpb.File{
+						{Filepath: "old_name.txt", Content: []byte("renamed pineapple")},
+						{Filepath: "doomed.txt", Content: []byte("doomed pineapple")},
+					},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = server.Index(ctx, &inpb.IndexRequest{
+		GitRepo: &gitpb.GitRepo{
+			RepoUrl: "github.com/buildbuddy-io/buildbuddy",
+		},
+		ReplacementStrategy: inpb.ReplacementStrategy_INCREMENTAL,
+		Update: &inpb.IncrementalUpdate{
+			Commits: []*inpb.Commit{
+				{
+					Sha:       commit3,
+					ParentSha: commit2,
+					AddsAndUpdates: []*inpb.File{
+						{Filepath: "new_name.txt", Content: []byte("renamed pineapple")},
+					},
+					DeleteFilepaths: []string{"old_name.txt"},
+				},
+				{
+					Sha:             commit4,
+					ParentSha:       commit3,
+					DeleteFilepaths: []string{"doomed.txt"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	searchRsp, err := server.Search(ctx, &spb.SearchRequest{
+		Query: &spb.Query{
+			Term: "pineapple",
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, searchRsp.GetResults(), 1)
+	search := searchRsp.GetResults()[0]
+	search.Snippets = nil
+	assert.Equal(t, &spb.Result{
+		Owner:      "buildbuddy-io",
+		Repo:       "buildbuddy",
+		Sha:        commit3,
+		Filename:   "new_name.txt",
+		MatchCount: 1,
+	}, search)
+
+	repoStatus, err := server.RepoStatus(ctx, &inpb.RepoStatusRequest{
+		RepoUrl: "github.com/buildbuddy-io/buildbuddy",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, commit4, repoStatus.GetLastIndexedCommitSha())
+}
+
 func TestRepoStatus_NoStatus(t *testing.T) {
 	server := mustMakeServer(t)
 
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"io"
 )
 
@@ -100,6 +101,9 @@ type HighlightedRegion interface {
 	String() string
 	Line() int
 	CustomSnippet(linesBefore, linesAfter int) string
+	// Definition returns true if the region contains the definition of a
+	// symbol the query searched for.
+	Definition() bool
 }
 
 type Highlighter interface {
@@ -114,3 +118,23 @@ type Query interface {
 type Searcher interface {
 	Search(q Query, numResults, offset int) ([]Document, error)
 }
+
+// SymbolLocation is a line of a file that defines or references a symbol.
+// Like in a Kythe ticket, the file is identified by a corpus, whose last path
+// component is the name of the repository, the root directory of the file
+// within the corpus, and its path relative to that root.
+type SymbolLocation struct {
+	Corpus     string
+	Root       string
+	Filename   string
+	Line       int
+	Definition bool
+}
+
+// SymbolResolver looks up where symbols are defined and referenced, for
+// example using the Kythe annotations stored alongside the index.
+type SymbolResolver interface {
+	// ResolveSymbol returns the locations of the symbol with the given name.
+	// If definitionsOnly is true, references are omitted.
+	ResolveSymbol(ctx context.Context, name string, definitionsOnly bool) ([]SymbolLocation, error)
+}
@@ -125,6 +125,9 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
       case auditlog.ResourceType.IP_RULE:
         res = "IP Rule";
         break;
+      case auditlog.ResourceType.EXECUTION:
+        res = "Execution";
+        break;
     }
     return (
       <>
@@ -163,6 +166,8 @@ export default class AuditLogsComponent extends React.Component<AuditLogsCompone
         return "Update IP Rules Config";
       case Action.INVALIDATE_VM_SNAPSHOT:
         return "Invalidate VM Snapshot";
+      case Action.START_DEBUG_SHELL:
+        return "Start Debug Shell";
     }
     return "";
   }
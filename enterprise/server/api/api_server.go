@@ -24,28 +24,35 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/git"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/paging"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	api_common "github.com/buildbuddy-io/buildbuddy/server/api/common"
 	requestcontext "github.com/buildbuddy-io/buildbuddy/server/util/request_context"
 
 	apipb "github.com/buildbuddy-io/buildbuddy/proto/api/v1"
+	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
 	elpb "github.com/buildbuddy-io/buildbuddy/proto/eventlog"
 	gitpb "github.com/buildbuddy-io/buildbuddy/proto/git"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	pgpb "github.com/buildbuddy-io/buildbuddy/proto/pagination"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
 )
 
 var (
@@ -55,6 +62,11 @@ var (
 	enableMetricsAPI     = flag.Bool("api.enable_metrics_api", false, "If true, enable access to metrics API.")
 )
 
+const (
+	// The max number of test case runs returned per GetTestCaseHistory page.
+	testCaseHistoryPageSize = 100
+)
+
 type APIServer struct {
 	env environment.Env
 }
@@ -258,6 +270,154 @@ func (s *APIServer) GetTarget(ctx context.Context, req *apipb.GetTargetRequest)
 	}, nil
 }
 
+func (s *APIServer) GetTestCaseHistory(ctx context.Context, req *apipb.GetTestCaseHistoryRequest) (*apipb.GetTestCaseHistoryResponse, error) {
+	user, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.env.GetOLAPDBHandle() == nil {
+		return nil, status.UnimplementedError("Test case history requires an OLAP DB.")
+	}
+	selector := req.GetSelector()
+	if selector.GetRepoUrl() == "" || selector.GetLabel() == "" {
+		return nil, status.InvalidArgumentError("TestCaseSelector must contain a valid repo_url and label")
+	}
+	repoURL, err := git.NormalizeRepoURL(selector.GetRepoUrl())
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Invalid repo_url: %q", selector.GetRepoUrl())
+	}
+	pg, err := paging.DecodeOffsetLimit(req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	pg.Offset = max(pg.Offset, int64(0))
+	pg.Limit = testCaseHistoryPageSize
+
+	q := query_builder.NewQuery(`
+		SELECT invocation_uuid, commit_sha, branch_name, label, class_name, name,
+			status, start_time_usec, duration_usec, failure_message, shard, run, attempt
+		FROM "TestCaseStatuses"`)
+	q.AddWhereClause("group_id = ?", user.GetGroupID())
+	q.AddWhereClause("repo_url = ?", repoURL.String())
+	q.AddWhereClause("label = ?", selector.GetLabel())
+	if selector.GetClassName() != "" {
+		q.AddWhereClause("class_name = ?", selector.GetClassName())
+	}
+	if selector.GetName() != "" {
+		q.AddWhereClause("name = ?", selector.GetName())
+	}
+	if selector.GetBranchName() != "" {
+		q.AddWhereClause("branch_name = ?", selector.GetBranchName())
+	}
+	// Most recent invocations first, with a stable order within an invocation
+	// so that pages don't overlap.
+	q.SetOrderBy("invocation_start_time_usec DESC, class_name, name, shard, run, attempt, case_index", true /*=ascending*/)
+	// Fetch limit+1 rows to see if there's going to be another page of results.
+	q.SetLimit(pg.GetLimit() + 1)
+	q.SetOffset(pg.GetOffset())
+	qStr, qArgs := q.Build()
+
+	type row struct {
+		InvocationUUID string
+		CommitSHA      string
+		BranchName     string
+		Label          string
+		ClassName      string
+		Name           string
+		Status         int32
+		StartTimeUsec  int64
+		DurationUsec   int64
+		FailureMessage string
+		Shard          int32
+		Run            int32
+		Attempt        int32
+	}
+	rsp := &apipb.GetTestCaseHistoryResponse{}
+	rq := s.env.GetOLAPDBHandle().NewQuery(ctx, "api_server_get_test_case_history").Raw(qStr, qArgs...)
+	err = db.ScanEach(rq, func(ctx context.Context, r *row) error {
+		invocationID, err := uuid.Base64StringToString(r.InvocationUUID)
+		if err != nil {
+			return err
+		}
+		rsp.TestCaseRun = append(rsp.TestCaseRun, &apipb.TestCaseRun{
+			InvocationId:   invocationID,
+			CommitSha:      r.CommitSHA,
+			BranchName:     r.BranchName,
+			Label:          r.Label,
+			ClassName:      r.ClassName,
+			Name:           r.Name,
+			Status:         cmpb.Status(r.Status),
+			FailureMessage: r.FailureMessage,
+			Shard:          r.Shard,
+			Run:            r.Run,
+			Attempt:        r.Attempt,
+			Timing: &cmpb.Timing{
+				StartTime: timestamppb.New(time.UnixMicro(r.StartTimeUsec)),
+				Duration:  durationpb.New(time.Duration(r.DurationUsec) * time.Microsecond),
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(rsp.TestCaseRun)) > pg.GetLimit() {
+		rsp.TestCaseRun = rsp.TestCaseRun[:pg.GetLimit()]
+		rsp.NextPageToken, err = paging.EncodeOffsetLimit(&pgpb.OffsetLimit{
+			Offset: pg.GetOffset() + pg.GetLimit(),
+			Limit:  pg.GetLimit(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rsp, nil
+}
+
+func (s *APIServer) GetFlakyTargets(ctx context.Context, req *apipb.GetFlakyTargetsRequest) (*apipb.GetFlakyTargetsResponse, error) {
+	fds := s.env.GetFlakeDetectionService()
+	if fds == nil {
+		return nil, status.UnimplementedError("Flake detection is not enabled.")
+	}
+	if req.GetRepoUrl() == "" {
+		return nil, status.InvalidArgumentError("GetFlakyTargetsRequest must contain a valid repo_url")
+	}
+	repoURL, err := git.NormalizeRepoURL(req.GetRepoUrl())
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("Invalid repo_url: %q", req.GetRepoUrl())
+	}
+	flakyTargets, err := fds.GetFlakyTargets(ctx, &trpb.GetFlakyTargetsRequest{
+		Repo:              repoURL.String(),
+		MinScore:          req.GetMinScore(),
+		IncludeQuarantine: req.GetIncludeQuarantine(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := flakyTargets.GetQuarantine()
+	rsp := &apipb.GetFlakyTargetsResponse{
+		QuarantinedLabel:           q.GetLabels(),
+		QuarantineTag:              q.GetTag(),
+		QuarantineBuildozerCommand: q.GetBuildozerCommands(),
+		QuarantineTestTagFilters:   q.GetTestTagFilters(),
+	}
+	for _, s := range flakyTargets.GetScores() {
+		rsp.FlakyTarget = append(rsp.FlakyTarget, &apipb.FlakyTarget{
+			Label:                s.GetLabel(),
+			Score:                s.GetScore(),
+			TotalRuns:            s.GetTotalRuns(),
+			TotalCommits:         s.GetTotalCommits(),
+			FlakyRuns:            s.GetFlakyRuns(),
+			LikelyFlakyRuns:      s.GetLikelyFlakyRuns(),
+			PassedAfterRetryRuns: s.GetPassedAfterRetryRuns(),
+			InconsistentCommits:  s.GetInconsistentCommits(),
+			Quarantined:          s.GetQuarantined(),
+			ComputedAt:           s.GetComputedAt(),
+		})
+	}
+	return rsp, nil
+}
+
 func (s *APIServer) redisCachedActions(ctx context.Context, userInfo interfaces.UserInfo, iid, targetLabel string) ([]*apipb.Action, error) {
 	if !s.CacheEnabled() || s.env.GetMetricsCollector() == nil {
 		return nil, nil
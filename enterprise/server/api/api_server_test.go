@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/role"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
@@ -159,6 +161,147 @@ func TestGetTargetByTag(t *testing.T) {
 	assert.Equal(t, 2, len(resp.Target))
 }
 
+func TestGetTestCaseHistory_RequiresOLAPDB(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.GetTestCaseHistory(ctx, &apipb.GetTestCaseHistoryRequest{
+		Selector: &apipb.TestCaseSelector{
+			RepoUrl: "https://github.com/buildbuddy-io/buildbuddy",
+			Label:   "//server:foo_test",
+		},
+	})
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
+
+func TestGetTestCaseHistoryAuth(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "")
+	s := NewAPIServer(env)
+	resp, err := s.GetTestCaseHistory(ctx, &apipb.GetTestCaseHistoryRequest{
+		Selector: &apipb.TestCaseSelector{
+			RepoUrl: "https://github.com/buildbuddy-io/buildbuddy",
+			Label:   "//server:foo_test",
+		},
+	})
+	require.Error(t, err)
+	require.Nil(t, resp)
+}
+
+func TestGetFlakyTargets_NotEnabled(t *testing.T) {
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+	_, err := s.GetFlakyTargets(ctx, &apipb.GetFlakyTargetsRequest{
+		RepoUrl: "https://github.com/buildbuddy-io/buildbuddy",
+	})
+	require.True(t, status.IsUnimplementedError(err), "expected Unimplemented, got %v", err)
+}
+
+func testCaseStatus(groupID, invocationID, label, name string, st commonpb.Status, invocationStartTime time.Time) *schema.TestCaseStatus {
+	return &schema.TestCaseStatus{
+		GroupID:                 groupID,
+		RepoURL:                 "https://github.com/buildbuddy-io/buildbuddy",
+		Label:                   label,
+		ClassName:               "server/foo",
+		Name:                    name,
+		InvocationUUID:          strings.ReplaceAll(invocationID, "-", ""),
+		Shard:                   1,
+		Run:                     1,
+		Attempt:                 1,
+		CommitSHA:               "abc123",
+		Status:                  int32(st),
+		StartTimeUsec:           invocationStartTime.Add(time.Second).UnixMicro(),
+		DurationUsec:            (2 * time.Second).Microseconds(),
+		BranchName:              "main",
+		Role:                    "CI",
+		Command:                 "test",
+		InvocationStartTimeUsec: invocationStartTime.UnixMicro(),
+	}
+}
+
+func TestGetTestCaseHistory(t *testing.T) {
+	flags.Set(t, "testenv.use_clickhouse", true)
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+
+	olderID := uuid.NewString()
+	newerID := uuid.NewString()
+	otherGroupID := uuid.NewString()
+	start := time.UnixMicro(1_700_000_000_000_000)
+	err := env.GetOLAPDBHandle().FlushTestCaseStatuses(ctx, []*schema.TestCaseStatus{
+		testCaseStatus("group1", olderID, "//server:foo_test", "TestA", commonpb.Status_FAILED, start),
+		testCaseStatus("group1", olderID, "//server:foo_test", "TestB", commonpb.Status_PASSED, start),
+		testCaseStatus("group1", olderID, "//server:bar_test", "TestA", commonpb.Status_PASSED, start),
+		testCaseStatus("group1", newerID, "//server:foo_test", "TestA", commonpb.Status_PASSED, start.Add(time.Hour)),
+		testCaseStatus("group2", otherGroupID, "//server:foo_test", "TestA", commonpb.Status_PASSED, start.Add(2*time.Hour)),
+	})
+	require.NoError(t, err)
+
+	rsp, err := s.GetTestCaseHistory(ctx, &apipb.GetTestCaseHistoryRequest{
+		Selector: &apipb.TestCaseSelector{
+			RepoUrl: "git@github.com:buildbuddy-io/buildbuddy.git",
+			Label:   "//server:foo_test",
+			Name:    "TestA",
+		},
+	})
+
+	require.NoError(t, err)
+	assert.Empty(t, rsp.GetNextPageToken())
+	var got []string
+	for _, r := range rsp.GetTestCaseRun() {
+		got = append(got, fmt.Sprintf("%s %s %s", r.GetInvocationId(), r.GetName(), r.GetStatus()))
+	}
+	// Most recent invocation first, and nothing from other groups or labels.
+	assert.Equal(t, []string{
+		newerID + " TestA PASSED",
+		olderID + " TestA FAILED",
+	}, got)
+	first := rsp.GetTestCaseRun()[0]
+	assert.Equal(t, "abc123", first.GetCommitSha())
+	assert.Equal(t, "main", first.GetBranchName())
+	assert.Equal(t, "server/foo", first.GetClassName())
+	assert.Equal(t, start.Add(time.Hour+time.Second).UnixMicro(), first.GetTiming().GetStartTime().AsTime().UnixMicro())
+	assert.Equal(t, 2*time.Second, first.GetTiming().GetDuration().AsDuration())
+}
+
+func TestGetTestCaseHistory_Paging(t *testing.T) {
+	flags.Set(t, "testenv.use_clickhouse", true)
+	env, ctx := getEnvAndCtx(t, "user1")
+	s := NewAPIServer(env)
+
+	invocationID := uuid.NewString()
+	start := time.Now()
+	var statuses []*schema.TestCaseStatus
+	for i := range 150 {
+		statuses = append(statuses, testCaseStatus("group1", invocationID, "//server:foo_test", fmt.Sprintf("Test%03d", i), commonpb.Status_PASSED, start))
+	}
+	err := env.GetOLAPDBHandle().FlushTestCaseStatuses(ctx, statuses)
+	require.NoError(t, err)
+
+	var names []string
+	pageToken := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3, "too many pages")
+		rsp, err := s.GetTestCaseHistory(ctx, &apipb.GetTestCaseHistoryRequest{
+			Selector: &apipb.TestCaseSelector{
+				RepoUrl: "https://github.com/buildbuddy-io/buildbuddy",
+				Label:   "//server:foo_test",
+			},
+			PageToken: pageToken,
+		})
+		require.NoError(t, err)
+		for _, r := range rsp.GetTestCaseRun() {
+			names = append(names, r.GetName())
+		}
+		pageToken = rsp.GetNextPageToken()
+		if pageToken == "" {
+			break
+		}
+	}
+	require.Len(t, names, 150)
+	for i, name := range names {
+		assert.Equal(t, fmt.Sprintf("Test%03d", i), name)
+	}
+}
+
 func TestGetAction(t *testing.T) {
 	testUUID, err := uuid.NewRandom()
 	assert.NoError(t, err)
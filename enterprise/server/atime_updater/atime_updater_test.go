@@ -121,6 +121,16 @@ func (f *fakeCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRe
 	return nil, status.InternalError("Unexpected call to BatchReadBlobs")
 }
 
+func (f *fakeCAS) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	f.t.Fatal("Unexpected call to SplitBlob")
+	return nil, status.InternalError("Unexpected call to SplitBlob")
+}
+
+func (f *fakeCAS) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	f.t.Fatal("Unexpected call to SpliceBlob")
+	return nil, status.InternalError("Unexpected call to SpliceBlob")
+}
+
 func (f *fakeCAS) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
 	f.t.Fatal("Unexpected call to GetTree")
 	return status.InternalError("Unexpected call to GetTree")
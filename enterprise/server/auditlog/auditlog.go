@@ -209,6 +209,9 @@ func cleanRequest(e *alpb.Entry_Request) *alpb.Entry_Request {
 	if r := e.ApiRequest.UpdateGroupUsers; r != nil {
 		r.GroupId = ""
 	}
+	if r := e.ApiRequest.StartDebugShell; r != nil {
+		r.ExecutionId = ""
+	}
 	return e
 }
 
@@ -0,0 +1,428 @@
+package distributed
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/metrics"
+	"github.com/buildbuddy-io/buildbuddy/server/util/claims"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/retry"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	dcpb "github.com/buildbuddy-io/buildbuddy/proto/distributed_cache"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+// Anti-entropy repairs keys that are missing from some of their replicas,
+// e.g. because a write was dropped while a peer was down for longer than
+// hinted handoffs could cover.
+//
+// At every multiple of the anti-entropy interval, each node scans its local
+// cache and, for every peer it shares keys with, hashes the keys last
+// modified before the start of the interval into a fixed number of buckets.
+// Each bucket stores the XOR of its key hashes and a key count, so two peers
+// that hold the same keys compute identical buckets, even if keys were
+// written while they were scanning. Summaries only depend on fields that are
+// the same on every replica of a key, so access times, which each replica
+// tracks separately, don't make buckets differ. A node fetches the summary
+// its peers computed for it with the same cutoff, and for every bucket that
+// differs, asks the peer which of the node's keys in that bucket it is
+// missing and copies them over, unless they're too old to repair. Keys the
+// peer has but this node is missing are repaired when the peer runs the same
+// process, so every node only ever pushes data.
+
+const (
+	// The maximum number of keys sent in one FindMissing request.
+	antiEntropyBatchSize = 100
+)
+
+// digestSummary is a summary of the keys shared with one peer that were last
+// modified before a cutoff.
+type digestSummary struct {
+	hashes []uint64
+	counts []int64
+}
+
+func newDigestSummary(numBuckets int) *digestSummary {
+	return &digestSummary{
+		hashes: make([]uint64, numBuckets),
+		counts: make([]int64, numBuckets),
+	}
+}
+
+func (s *digestSummary) add(keyHash uint64) {
+	b := keyHash % uint64(len(s.hashes))
+	s.hashes[b] ^= keyHash
+	s.counts[b]++
+}
+
+func (s *digestSummary) toProto(computedAt, cutoff time.Time) *dcpb.GetDigestSummaryResponse {
+	rsp := &dcpb.GetDigestSummaryResponse{
+		ComputedAtUsec:     computedAt.UnixMicro(),
+		ModifiedBeforeUsec: cutoff.UnixMicro(),
+		Bucket:             make([]*dcpb.DigestSummaryBucket, len(s.hashes)),
+	}
+	for i := range s.hashes {
+		rsp.Bucket[i] = &dcpb.DigestSummaryBucket{
+			Hash:  s.hashes[i],
+			Count: s.counts[i],
+		}
+	}
+	return rsp
+}
+
+// mismatchedBuckets returns the set of buckets that differ between this
+// summary and a peer's.
+func (s *digestSummary) mismatchedBuckets(peerSummary *dcpb.GetDigestSummaryResponse) (map[uint64]struct{}, error) {
+	if len(peerSummary.GetBucket()) != len(s.hashes) {
+		return nil, status.FailedPreconditionErrorf("peer summary has %d buckets, expected %d", len(peerSummary.GetBucket()), len(s.hashes))
+	}
+	mismatched := make(map[uint64]struct{})
+	for i, b := range peerSummary.GetBucket() {
+		if b.GetHash() != s.hashes[i] || b.GetCount() != s.counts[i] {
+			mismatched[uint64(i)] = struct{}{}
+		}
+	}
+	return mismatched, nil
+}
+
+// antiEntropyKeyHash hashes the parts of a scanned resource that identify it
+// in a cache, mirroring how caches key their entries: AC entries are keyed by
+// instance name, CAS entries aren't.
+func antiEntropyKeyHash(r *interfaces.ScannedResource) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(r.GroupID))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(int(r.Resource.GetCacheType()))))
+	h.Write([]byte{0})
+	if r.Resource.GetCacheType() == rspb.CacheType_AC {
+		h.Write([]byte(r.Resource.GetInstanceName()))
+	}
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(int(r.Resource.GetDigestFunction()))))
+	h.Write([]byte{0})
+	h.Write([]byte(r.Resource.GetDigest().GetHash()))
+	return h.Sum64()
+}
+
+// tooOldToRepair returns true if the scanned resource hadn't been accessed
+// recently enough, as of now, to be worth copying to other peers.
+func tooOldToRepair(r *interfaces.ScannedResource, now time.Time) bool {
+	return *antiEntropyMaxAge > 0 && now.Sub(time.UnixMicro(r.LastAccessUsec)) > *antiEntropyMaxAge
+}
+
+// antiEntropyPeers returns the peers other than this one that should hold
+// the scanned resource, or nil if this node isn't one of its replicas or the
+// resource was modified after the cutoff, so isn't summarized.
+func (c *Cache) antiEntropyPeers(r *interfaces.ScannedResource, cutoff time.Time) []string {
+	if r.LastModifyUsec >= cutoff.UnixMicro() {
+		return nil
+	}
+	owners := c.ownerPeers(r.Resource.GetDigest())
+	if !slices.Contains(owners, c.config.ListenAddr) {
+		return nil
+	}
+	peers := make([]string, 0, len(owners)-1)
+	for _, p := range owners {
+		if p != c.config.ListenAddr {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// ownerPeers returns the replicationFactor peers that should hold this key,
+// i.e. the preferred peers returned by writePeers.
+func (c *Cache) ownerPeers(d *repb.Digest) []string {
+	allPeers := c.consistentHash.GetAllReplicas(d.GetHash())
+	if len(c.config.NewNodes) > 0 && !*newNodesReadOnly {
+		allPeers = c.extraConsistentHash.GetAllReplicas(d.GetHash())
+	}
+	if len(allPeers) > c.config.ReplicationFactor {
+		allPeers = allPeers[:c.config.ReplicationFactor]
+	}
+	return allPeers
+}
+
+// groupContext returns a context authenticated as the group that owns a
+// scanned resource, so that the resource can be read from the local cache
+// and written to peers on the group's behalf.
+func (c *Cache) groupContext(ctx context.Context, groupID string, encrypted bool) (context.Context, error) {
+	if groupID != interfaces.AuthAnonymousUser {
+		ctx = claims.AuthContextWithJWT(ctx, &claims.Claims{
+			GroupID:                groupID,
+			AllowedGroups:          []string{groupID},
+			CacheEncryptionEnabled: encrypted,
+		}, nil)
+	}
+	return prefix.AttachUserPrefixToContext(ctx, c.authenticator)
+}
+
+// getDigestSummary returns the summary of the keys this node shares with
+// peer, as computed by the last anti-entropy run. If no run has finished
+// computing its summaries yet, the response is empty.
+func (c *Cache) getDigestSummary(ctx context.Context, peer string) (*dcpb.GetDigestSummaryResponse, error) {
+	c.antiEntropyMu.Lock()
+	defer c.antiEntropyMu.Unlock()
+	if c.antiEntropyComputedAt.IsZero() {
+		return &dcpb.GetDigestSummaryResponse{}, nil
+	}
+	summary, ok := c.antiEntropySummaries[peer]
+	if !ok {
+		summary = newDigestSummary(*antiEntropyBuckets)
+	}
+	return summary.toProto(c.antiEntropyComputedAt, c.antiEntropyCutoff), nil
+}
+
+// getPeerDigestSummary fetches the summary that peer computed for this node
+// with the given cutoff. Peers run anti-entropy at the same time, so if the
+// peer is still computing its summaries, this polls until it's done or ctx
+// is done.
+func (c *Cache) getPeerDigestSummary(ctx context.Context, limiter *rate.Limiter, peer string, cutoff time.Time) (*dcpb.GetDigestSummaryResponse, error) {
+	r := retry.New(ctx, &retry.Options{
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		MaxRetries:     math.MaxInt, // Stop when ctx is done.
+	})
+	for r.Next() {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+		peerSummary, err := c.distributedProxy.RemoteGetDigestSummary(ctx, peer)
+		if err != nil {
+			return nil, err
+		}
+		switch peerCutoff := peerSummary.GetModifiedBeforeUsec(); {
+		case peerCutoff == cutoff.UnixMicro():
+			return peerSummary, nil
+		case peerCutoff > cutoff.UnixMicro():
+			return nil, status.FailedPreconditionErrorf("peer summary is for keys modified before %s, expected %s", time.UnixMicro(peerCutoff), cutoff)
+		}
+	}
+	return nil, status.DeadlineExceededErrorf("peer did not summarize keys modified before %s in time: %s", cutoff, ctx.Err())
+}
+
+func (c *Cache) computeDigestSummaries(ctx context.Context, scanner interfaces.ScannableCache, cutoff time.Time) (map[string]*digestSummary, error) {
+	summaries := make(map[string]*digestSummary)
+	err := scanner.ScanResources(ctx, func(r *interfaces.ScannedResource) error {
+		metrics.DistributedCacheAntiEntropyScannedKeys.Inc()
+		peers := c.antiEntropyPeers(r, cutoff)
+		if len(peers) == 0 {
+			return nil
+		}
+		keyHash := antiEntropyKeyHash(r)
+		for _, peer := range peers {
+			summary, ok := summaries[peer]
+			if !ok {
+				summary = newDigestSummary(*antiEntropyBuckets)
+				summaries[peer] = summary
+			}
+			summary.add(keyHash)
+		}
+		return nil
+	})
+	return summaries, err
+}
+
+type antiEntropyBatchKey struct {
+	peer         string
+	groupID      string
+	encrypted    bool
+	cacheType    rspb.CacheType
+	instanceName string
+}
+
+// backfillBatch copies the resources in a batch that the batch's peer is
+// missing to that peer.
+func (c *Cache) backfillBatch(ctx context.Context, limiter *rate.Limiter, k antiEntropyBatchKey, rns []*rspb.ResourceName) error {
+	ctx, err := c.groupContext(ctx, k.groupID, k.encrypted)
+	if err != nil {
+		return err
+	}
+	isolation := &dcpb.Isolation{
+		CacheType:          k.cacheType,
+		RemoteInstanceName: k.instanceName,
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return err
+	}
+	missing, err := c.distributedProxy.RemoteFindMissing(ctx, k.peer, isolation, rns)
+	if err != nil {
+		return err
+	}
+	missingHashes := make(map[string]struct{}, len(missing))
+	for _, d := range missing {
+		missingHashes[d.GetHash()] = struct{}{}
+	}
+	for _, rn := range rns {
+		if _, ok := missingHashes[rn.GetDigest().GetHash()]; !ok {
+			continue
+		}
+		if err := limiter.Wait(ctx); err != nil {
+			return err
+		}
+		err := c.sendFile(ctx, rn, k.peer)
+		metrics.DistributedCacheAntiEntropyBackfills.With(prometheus.Labels{
+			metrics.StatusHumanReadableLabel: status.MetricsLabel(err),
+		}).Inc()
+		if err != nil {
+			c.log.CtxWarningf(ctx, "Anti-entropy: unable to backfill %s to peer %q: %s", rn.GetDigest().GetHash(), k.peer, err)
+		}
+	}
+	return nil
+}
+
+// backfillMismatchedBuckets rescans the local cache and backfills the keys in
+// each peer's mismatched buckets that the peer is missing. Keys that are too
+// old to repair are skipped, so that anti-entropy doesn't undo the eviction
+// of cold keys on other replicas.
+func (c *Cache) backfillMismatchedBuckets(ctx context.Context, scanner interfaces.ScannableCache, limiter *rate.Limiter, cutoff time.Time, mismatched map[string]map[uint64]struct{}) error {
+	now := time.Now()
+	return c.backfillScannedResources(ctx, scanner, limiter, func(r *interfaces.ScannedResource) []string {
+		if tooOldToRepair(r, now) {
+			return nil
+		}
+		bucket := antiEntropyKeyHash(r) % uint64(*antiEntropyBuckets)
+		var targets []string
+		for _, peer := range c.antiEntropyPeers(r, cutoff) {
+			if _, ok := mismatched[peer][bucket]; ok {
+				targets = append(targets, peer)
+			}
+		}
+		return targets
+	})
+}
+
+// backfillScannedResources scans the local cache and copies each resource to
+// the peers returned by targets that are missing it.
+func (c *Cache) backfillScannedResources(ctx context.Context, scanner interfaces.ScannableCache, limiter *rate.Limiter, targets func(r *interfaces.ScannedResource) []string) error {
+	batches := make(map[antiEntropyBatchKey][]*rspb.ResourceName)
+	flush := func(k antiEntropyBatchKey) {
+		if err := c.backfillBatch(ctx, limiter, k, batches[k]); err != nil {
+			c.log.Warningf("Unable to backfill keys to peer %q: %s", k.peer, err)
+		}
+		delete(batches, k)
+	}
+	err := scanner.ScanResources(ctx, func(r *interfaces.ScannedResource) error {
+		for _, peer := range targets(r) {
+			k := antiEntropyBatchKey{
+				peer:         peer,
+				groupID:      r.GroupID,
+				encrypted:    r.Encrypted,
+				cacheType:    r.Resource.GetCacheType(),
+				instanceName: r.Resource.GetInstanceName(),
+			}
+			batches[k] = append(batches[k], r.Resource)
+			if len(batches[k]) >= antiEntropyBatchSize {
+				flush(k)
+			}
+		}
+		return ctx.Err()
+	})
+	for k := range batches {
+		flush(k)
+	}
+	return err
+}
+
+// runAntiEntropy recomputes this node's digest summaries of the keys
+// modified before cutoff, compares them with the summaries computed by its
+// peers for the same cutoff, and backfills peers that are missing keys.
+func (c *Cache) runAntiEntropy(ctx context.Context, cutoff time.Time) error {
+	scanner, ok := c.local.(interfaces.ScannableCache)
+	if !ok {
+		return status.UnimplementedError("the local cache does not support scanning")
+	}
+	start := time.Now()
+	summaries, err := c.computeDigestSummaries(ctx, scanner, cutoff)
+	if err != nil {
+		return err
+	}
+	c.antiEntropyMu.Lock()
+	c.antiEntropySummaries = summaries
+	c.antiEntropyComputedAt = start
+	c.antiEntropyCutoff = cutoff
+	c.antiEntropyMu.Unlock()
+
+	// All requests to peers share one limiter, so that anti-entropy doesn't
+	// compete with regular traffic.
+	limiter := rate.NewLimiter(rate.Limit(*antiEntropyPeerRequestsPerSecond), 1)
+	mismatched := make(map[string]map[uint64]struct{})
+	for _, peer := range c.consistentHash.GetItems() {
+		if peer == c.config.ListenAddr {
+			continue
+		}
+		summary, ok := summaries[peer]
+		if !ok {
+			summary = newDigestSummary(*antiEntropyBuckets)
+		}
+		peerSummary, err := c.getPeerDigestSummary(ctx, limiter, peer, cutoff)
+		if err != nil {
+			c.log.Debugf("Anti-entropy: unable to get digest summary from peer %q: %s", peer, err)
+			continue
+		}
+		buckets, err := summary.mismatchedBuckets(peerSummary)
+		if err != nil {
+			c.log.Warningf("Anti-entropy: unable to compare digest summary with peer %q: %s", peer, err)
+			continue
+		}
+		metrics.DistributedCacheAntiEntropyMismatchedBuckets.Add(float64(len(buckets)))
+		if len(buckets) > 0 {
+			mismatched[peer] = buckets
+		}
+	}
+	if len(mismatched) > 0 {
+		if err := c.backfillMismatchedBuckets(ctx, scanner, limiter, cutoff, mismatched); err != nil {
+			return err
+		}
+	}
+	c.log.Infof("Anti-entropy run finished in %s (%d peers with mismatched buckets)", time.Since(start), len(mismatched))
+	return nil
+}
+
+func (c *Cache) antiEntropyEnabled() bool {
+	if *antiEntropyInterval <= 0 || c.config.ReplicationFactor < 2 {
+		return false
+	}
+	if _, ok := c.local.(interfaces.ScannableCache); !ok {
+		c.log.Warningf("Anti-entropy is enabled, but the local cache (%T) does not support scanning; disabling it.", c.local)
+		return false
+	}
+	return true
+}
+
+func (c *Cache) antiEntropyLoop(shutDownChan chan struct{}) {
+	for {
+		// Runs start at multiples of the interval, so that all nodes
+		// summarize their keys with the same cutoff.
+		cutoff := time.Now().Truncate(*antiEntropyInterval).Add(*antiEntropyInterval)
+		select {
+		case <-shutDownChan:
+			return
+		case <-time.After(time.Until(cutoff)):
+		}
+		// Give up before the next run starts.
+		ctx, cancel := context.WithDeadline(context.Background(), cutoff.Add(*antiEntropyInterval))
+		go func() {
+			select {
+			case <-shutDownChan:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		if err := c.runAntiEntropy(ctx, cutoff); err != nil {
+			c.log.Warningf("Anti-entropy run failed: %s", err)
+		}
+		cancel()
+	}
+}
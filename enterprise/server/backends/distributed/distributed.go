@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -62,10 +63,20 @@ var (
 	lookasideCacheTTL        = flag.Duration("cache.distributed_cache.lookaside_cache_ttl", 1*time.Minute, "The maximum TTL of items served from the lookaside cache. When this flag is set to a duration >0, items will only be served from the lookaside cache if they were added less than this long ago. If it is set to a duration <=0, no TTL check will occur before serving items from the lookaside cache. This value should be << atime_update_threshold when used in the authoritative cache.")
 	maxLookasideEntryBytes   = flag.Int64("cache.distributed_cache.max_lookaside_entry_bytes", 10_000, "The biggest allowed entry size in the lookaside cache.")
 	maxHintedHandoffsPerPeer = flag.Int64("cache.distributed_cache.max_hinted_handoffs_per_peer", 100_000, "The maximum number of hinted handoffs to keep in memory. Each hinted handoff is a digest (~64 bytes), prefix, and peer (40 bytes). So keeping around 100000 of these means an extra 10MB per peer.")
+
+	antiEntropyInterval              = flag.Duration("cache.distributed_cache.anti_entropy_interval", 0, "How often to compare digest summaries with peers and backfill keys they are missing. Requires replication_factor > 1 and a local cache that supports scanning (e.g. pebble). 0 disables anti-entropy. ** Enterprise only **")
+	antiEntropyBuckets               = flag.Int("cache.distributed_cache.anti_entropy_buckets", 4096, "The number of buckets in the digest summaries compared during anti-entropy. Must be the same on all nodes. ** Enterprise only **")
+	antiEntropyPeerRequestsPerSecond = flag.Float64("cache.distributed_cache.anti_entropy_peer_requests_per_second", 100, "The maximum number of requests per second that anti-entropy sends to peers, including summary fetches, FindMissing calls and key copies. ** Enterprise only **")
+	antiEntropyMaxAge                = flag.Duration("cache.distributed_cache.anti_entropy_max_age", 7*24*time.Hour, "Keys that haven't been accessed for this long are not repaired by anti-entropy, so that it doesn't undo eviction of cold keys. 0 repairs all keys. ** Enterprise only **")
+
+	useGossip           = flag.Bool("cache.distributed_cache.use_gossip", false, "If true, peers are discovered through gossip membership (see gossip.listen_addr and gossip.join) instead of nodes or redis_target. Nodes join the ring when they start and leave it when they shut down, so cluster_size, new_nodes, and new_consistent_hash_function aren't needed to resize the cluster. ** Enterprise only **")
+	gossipHandoffPeriod = flag.Duration("cache.distributed_cache.gossip_handoff_period", 10*time.Minute, "When gossip membership changes, reads fall back to the keys' previous owners for this long, backfilling the new owners. ** Enterprise only **")
+	gossipDrainTimeout  = flag.Duration("cache.distributed_cache.gossip_drain_timeout", 30*time.Second, "When a gossip node shuts down, it spends up to this long copying its recently-accessed keys (see anti_entropy_max_age) to their new owners. Requires a local cache that supports scanning (e.g. pebble). 0 disables drain handoff. ** Enterprise only **")
 )
 
 type CacheConfig struct {
 	PubSub                       interfaces.PubSub
+	GossipService                interfaces.GossipService
 	ListenAddr                   string
 	GroupName                    string
 	Nodes                        []string
@@ -123,6 +134,15 @@ type Cache struct {
 	finishedShutdown     bool
 	config               CacheConfig
 	zone                 string
+
+	antiEntropyMu         *sync.Mutex
+	antiEntropySummaries  map[string]*digestSummary
+	antiEntropyComputedAt time.Time
+	antiEntropyCutoff     time.Time
+
+	ringMu                 *sync.RWMutex
+	previousConsistentHash *consistent_hash.ConsistentHash
+	previousRingExpiration time.Time
 }
 
 func Register(env *real_environment.RealEnv) error {
@@ -145,7 +165,13 @@ func Register(env *real_environment.RealEnv) error {
 		ReadThroughLocalCache:        *readThroughLocalCache,
 	}
 	log.Infof("Enabling distributed cache with config: %+v", dcConfig)
-	if len(dcConfig.Nodes) == 0 {
+	if *useGossip {
+		if env.GetGossipService() == nil {
+			return status.FailedPreconditionError("Distributed cache gossip membership requires gossip to be configured: please also set gossip.listen_addr and gossip.join")
+		}
+		dcConfig.GossipService = env.GetGossipService()
+	}
+	if len(dcConfig.Nodes) == 0 && dcConfig.GossipService == nil {
 		dcConfig.PubSub = pubsub.NewPubSub(redisutil.NewSimpleClient(*redisTarget, env.GetHealthChecker(), "distributed_cache_redis"))
 	}
 	dc, err := NewDistributedCache(env, env.GetCache(), dcConfig, env.GetHealthChecker())
@@ -196,6 +222,9 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	if len(config.NewNodes) > 0 && len(config.Nodes) == 0 {
 		return nil, status.FailedPreconditionError("new nodes may only be specified when all nodes are hardcoded.")
 	}
+	if config.GossipService != nil && len(config.Nodes) > 0 {
+		return nil, status.FailedPreconditionError("nodes may not be hardcoded when peers are discovered through gossip.")
+	}
 	hashFn, err := parseConsistentHash(*consistentHashFunction)
 	if err != nil {
 		return nil, err
@@ -228,6 +257,11 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 
 		hintedHandoffsMu:     &sync.RWMutex{},
 		hintedHandoffsByPeer: make(map[string]chan *hintedHandoffOrder, 0),
+
+		antiEntropyMu: &sync.Mutex{},
+
+		ringMu:                 &sync.RWMutex{},
+		previousConsistentHash: consistent_hash.NewConsistentHash(hashFn, *consistentHashVNodes),
 	}
 
 	if config.LookasideCacheSizeBytes > 0 {
@@ -261,6 +295,7 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	}
 	dc.distributedProxy.SetHeartbeatCallbackFunc(dc.recvHeartbeatCallback)
 	dc.distributedProxy.SetHintedHandoffCallbackFunc(dc.recvHintedHandoffCallback)
+	dc.distributedProxy.SetDigestSummaryCallbackFunc(dc.getDigestSummary)
 	if len(config.Nodes) > 0 {
 		// Nodes are hardcoded. Set them once and be done with it.
 		chash.Set(config.Nodes...)
@@ -268,6 +303,10 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 		if len(config.NewNodes) > 0 {
 			extraCHash.Set(config.NewNodes...)
 		}
+	} else if config.GossipService != nil {
+		// Peers are discovered through gossip. This node joins the ring
+		// once it starts listening.
+		config.GossipService.AddListener(dc)
 	} else {
 		// No nodes were hardcoded, use redis for discovery.
 		heartbeatConfig := &heartbeat.Config{
@@ -285,7 +324,7 @@ func NewDistributedCache(env environment.Env, c interfaces.Cache, config CacheCo
 	hc.RegisterShutdownFunction(func(ctx context.Context) error {
 		return dc.Shutdown(ctx)
 	})
-	if dc.config.ClusterSize > 0 {
+	if dc.config.ClusterSize > 0 || config.GossipService != nil {
 		hc.AddHealthCheck("distributed_cache", dc)
 	}
 	return dc, nil
@@ -302,6 +341,13 @@ func (c *Cache) Check(ctx context.Context) error {
 		return nil
 	}
 
+	// If peers are discovered through gossip, there's no fixed cluster
+	// size: this cache is healthy once it has joined a ring that's big
+	// enough to meet the replication factor.
+	if c.config.GossipService != nil {
+		return c.checkGossipRing()
+	}
+
 	// First check that the number of nodes in our chash
 	// matches the cluster size. If not, we can return early.
 	nodesAvailable := len(c.consistentHash.GetItems())
@@ -607,11 +653,17 @@ func (c *Cache) StartListening() {
 	}
 	c.shutDownChan = make(chan struct{})
 	go c.heartbeatPeers(c.shutDownChan)
+	if c.antiEntropyEnabled() {
+		go c.antiEntropyLoop(c.shutDownChan)
+	}
 	go func() {
 		log.Infof("Distributed cache listening on %q", c.config.ListenAddr)
 		if c.heartbeatChannel != nil {
 			c.heartbeatChannel.StartAdvertising()
 		}
+		if c.config.GossipService != nil {
+			c.joinGossipRing()
+		}
 		if err := c.distributedProxy.StartListening(); err != nil {
 			log.Warningf("Unable to start cacheproxy: %s", err)
 		}
@@ -631,6 +683,9 @@ func (c *Cache) Shutdown(ctx context.Context) error {
 	if c.heartbeatChannel != nil {
 		c.heartbeatChannel.StopAdvertising()
 	}
+	if c.config.GossipService != nil {
+		c.drainGossipRing(ctx)
+	}
 	close(c.shutDownChan)
 	c.finishedShutdown = true
 	return c.distributedProxy.Shutdown(ctx)
@@ -701,6 +756,19 @@ func (c *Cache) readPeers(d *repb.Digest) *peerset.PeerSet {
 		}
 	}
 
+	// If the ring changed recently, the new owners of this key may not
+	// have it yet, so fall back to its previous owners. Reads that are
+	// served by a fallback peer backfill the primary peers.
+	if previousPeers := c.previousOwnerPeers(d); len(previousPeers) > 0 {
+		fallbackPeers := make([]string, 0, len(previousPeers)+len(secondaryPeers))
+		for _, p := range previousPeers {
+			if !slices.Contains(primaryPeers, p) {
+				fallbackPeers = append(fallbackPeers, p)
+			}
+		}
+		secondaryPeers = dedupe(append(fallbackPeers, secondaryPeers...))
+	}
+
 	sortVal := func(peer string) int {
 		if peer == c.config.ListenAddr {
 			return 0
@@ -27,8 +27,10 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/hashicorp/serf/serf"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -2525,3 +2527,299 @@ func (t *tracedCache) Writer(ctx context.Context, r *rspb.ResourceName) (interfa
 	t.addOps(Write, r)
 	return t.Cache.Writer(ctx, r)
 }
+
+// scannableCache is a memory cache that can enumerate the resources that
+// were written to it.
+type scannableCache struct {
+	interfaces.Cache
+
+	mu          sync.Mutex
+	resources   map[string]*rspb.ResourceName
+	modifyTimes map[string]time.Time
+	// Access times of resources that weren't accessed just now.
+	accessTimes map[string]time.Time
+}
+
+func newScannableCache(t *testing.T, maxSizeBytes int64) *scannableCache {
+	return &scannableCache{
+		Cache:       newMemoryCache(t, maxSizeBytes),
+		resources:   make(map[string]*rspb.ResourceName),
+		modifyTimes: make(map[string]time.Time),
+		accessTimes: make(map[string]time.Time),
+	}
+}
+
+func (s *scannableCache) setAccessTime(r *rspb.ResourceName, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accessTimes[r.GetDigest().GetHash()] = t
+}
+
+func (s *scannableCache) record(r *rspb.ResourceName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resources[r.GetDigest().GetHash()] = r
+	s.modifyTimes[r.GetDigest().GetHash()] = time.Now()
+}
+func (s *scannableCache) Set(ctx context.Context, r *rspb.ResourceName, data []byte) error {
+	s.record(r)
+	return s.Cache.Set(ctx, r, data)
+}
+func (s *scannableCache) Writer(ctx context.Context, r *rspb.ResourceName) (interfaces.CommittedWriteCloser, error) {
+	s.record(r)
+	return s.Cache.Writer(ctx, r)
+}
+func (s *scannableCache) ScanResources(ctx context.Context, fn func(r *interfaces.ScannedResource) error) error {
+	s.mu.Lock()
+	resources := make([]*interfaces.ScannedResource, 0, len(s.resources))
+	for hash, r := range s.resources {
+		accessTime, ok := s.accessTimes[hash]
+		if !ok {
+			accessTime = time.Now()
+		}
+		resources = append(resources, &interfaces.ScannedResource{
+			Resource:       r,
+			GroupID:        interfaces.AuthAnonymousUser,
+			LastAccessUsec: accessTime.UnixMicro(),
+			LastModifyUsec: s.modifyTimes[hash].UnixMicro(),
+		})
+	}
+	s.mu.Unlock()
+	for _, r := range resources {
+		err := fn(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestAntiEntropy(t *testing.T) {
+	env, _, ctx := getEnvAuthAndCtx(t)
+	singleCacheSizeBytes := int64(1000000)
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	baseConfig := CacheConfig{
+		ReplicationFactor:  2,
+		Nodes:              []string{peer1, peer2},
+		DisableLocalLookup: true,
+	}
+
+	// Setup a distributed cache, 2 nodes, R = 2.
+	scannableCache1 := newScannableCache(t, singleCacheSizeBytes)
+	config1 := baseConfig
+	config1.ListenAddr = peer1
+	dc1 := startNewDCache(t, env, config1, scannableCache1)
+
+	scannableCache2 := newScannableCache(t, singleCacheSizeBytes)
+	config2 := baseConfig
+	config2.ListenAddr = peer2
+	dc2 := startNewDCache(t, env, config2, scannableCache2)
+
+	waitForReady(t, config1.ListenAddr)
+	waitForReady(t, config2.ListenAddr)
+
+	// Both nodes run anti-entropy at the same time, each waiting for the
+	// other's summary.
+	runAntiEntropy := func(cutoff time.Time) {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		eg, ctx := errgroup.WithContext(ctx)
+		eg.Go(func() error { return dc1.runAntiEntropy(ctx, cutoff) })
+		eg.Go(func() error { return dc2.runAntiEntropy(ctx, cutoff) })
+		require.NoError(t, eg.Wait())
+	}
+
+	// Write some digests to the first node only, as if the writes to the
+	// second node had been lost.
+	beforeWrites := time.Now()
+	var resources []*rspb.ResourceName
+	for i := 0; i < 10; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		require.NoError(t, scannableCache1.Set(ctx, rn, buf))
+		resources = append(resources, rn)
+	}
+
+	// Keys modified after the cutoff are not summarized.
+	summaries, err := dc1.computeDigestSummaries(ctx, scannableCache1, beforeWrites)
+	require.NoError(t, err)
+	assert.Empty(t, summaries)
+
+	runAntiEntropy(time.Now().Add(time.Millisecond))
+
+	for _, rn := range resources {
+		exists, err := scannableCache2.Contains(ctx, rn)
+		require.NoError(t, err)
+		assert.True(t, exists, "digest %s was not backfilled", rn.GetDigest().GetHash())
+	}
+
+	// Once the backfilled keys are before the cutoff, the nodes agree.
+	cutoff := time.Now().Add(time.Millisecond)
+	runAntiEntropy(cutoff)
+	peerSummary, err := dc2.getDigestSummary(ctx, peer1)
+	require.NoError(t, err)
+	assert.Equal(t, cutoff.UnixMicro(), peerSummary.GetModifiedBeforeUsec())
+	summaries, err = dc1.computeDigestSummaries(ctx, scannableCache1, cutoff)
+	require.NoError(t, err)
+	buckets, err := summaries[peer2].mismatchedBuckets(peerSummary)
+	require.NoError(t, err)
+	assert.Empty(t, buckets)
+}
+
+func TestAntiEntropy_AccessTimes(t *testing.T) {
+	flags.Set(t, "cache.distributed_cache.anti_entropy_max_age", 24*time.Hour)
+	env, _, ctx := getEnvAuthAndCtx(t)
+	singleCacheSizeBytes := int64(1000000)
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	baseConfig := CacheConfig{
+		ReplicationFactor:  2,
+		Nodes:              []string{peer1, peer2},
+		DisableLocalLookup: true,
+	}
+
+	// Setup a distributed cache, 2 nodes, R = 2.
+	scannableCache1 := newScannableCache(t, singleCacheSizeBytes)
+	config1 := baseConfig
+	config1.ListenAddr = peer1
+	dc1 := startNewDCache(t, env, config1, scannableCache1)
+
+	scannableCache2 := newScannableCache(t, singleCacheSizeBytes)
+	config2 := baseConfig
+	config2.ListenAddr = peer2
+	dc2 := startNewDCache(t, env, config2, scannableCache2)
+
+	waitForReady(t, config1.ListenAddr)
+	waitForReady(t, config2.ListenAddr)
+
+	// Write some digests to both nodes, but only access them recently on
+	// the second one.
+	old := time.Now().Add(-48 * time.Hour)
+	for i := 0; i < 10; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		require.NoError(t, scannableCache1.Set(ctx, rn, buf))
+		require.NoError(t, scannableCache2.Set(ctx, rn, buf))
+		scannableCache1.setAccessTime(rn, old)
+	}
+
+	// The nodes agree, since access times aren't summarized.
+	cutoff := time.Now().Add(time.Millisecond)
+	summaries1, err := dc1.computeDigestSummaries(ctx, scannableCache1, cutoff)
+	require.NoError(t, err)
+	summaries2, err := dc2.computeDigestSummaries(ctx, scannableCache2, cutoff)
+	require.NoError(t, err)
+	require.Contains(t, summaries1, peer2)
+	buckets, err := summaries1[peer2].mismatchedBuckets(summaries2[peer1].toProto(time.Now(), cutoff))
+	require.NoError(t, err)
+	assert.Empty(t, buckets)
+
+	// Write a cold and a warm digest to the first node only, as if the
+	// writes to the second node had been lost. Only the warm one is
+	// backfilled.
+	coldRN, coldBuf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, scannableCache1.Set(ctx, coldRN, coldBuf))
+	scannableCache1.setAccessTime(coldRN, old)
+	warmRN, warmBuf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, scannableCache1.Set(ctx, warmRN, warmBuf))
+
+	cutoff = time.Now().Add(time.Millisecond)
+	runCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	eg, runCtx := errgroup.WithContext(runCtx)
+	eg.Go(func() error { return dc1.runAntiEntropy(runCtx, cutoff) })
+	eg.Go(func() error { return dc2.runAntiEntropy(runCtx, cutoff) })
+	require.NoError(t, eg.Wait())
+
+	exists, err := scannableCache2.Contains(ctx, warmRN)
+	require.NoError(t, err)
+	assert.True(t, exists, "recently accessed digest was not backfilled")
+	exists, err = scannableCache2.Contains(ctx, coldRN)
+	require.NoError(t, err)
+	assert.False(t, exists, "digest that is too old to repair was backfilled")
+}
+
+func TestGossipPeers(t *testing.T) {
+	member := func(status serf.MemberStatus, tags map[string]string) serf.Member {
+		return serf.Member{Status: status, Tags: tags}
+	}
+	members := []serf.Member{
+		member(serf.StatusAlive, map[string]string{gossipAddrTag: "localhost:3", gossipGroupTag: "group", gossipStateTag: gossipServingState}),
+		member(serf.StatusAlive, map[string]string{gossipAddrTag: "localhost:1", gossipGroupTag: "group", gossipStateTag: gossipServingState}),
+		// Draining.
+		member(serf.StatusAlive, map[string]string{gossipAddrTag: "localhost:2", gossipGroupTag: "group", gossipStateTag: gossipDrainingState}),
+		// Failed.
+		member(serf.StatusFailed, map[string]string{gossipAddrTag: "localhost:4", gossipGroupTag: "group", gossipStateTag: gossipServingState}),
+		// In another group.
+		member(serf.StatusAlive, map[string]string{gossipAddrTag: "localhost:5", gossipGroupTag: "other", gossipStateTag: gossipServingState}),
+		// Not a cache node.
+		member(serf.StatusAlive, map[string]string{"grpc_address": "localhost:6"}),
+	}
+	assert.Equal(t, []string{"localhost:1", "localhost:3"}, gossipPeers(members, "group"))
+}
+
+func TestRingChangeHandoff(t *testing.T) {
+	env, _, ctx := getEnvAuthAndCtx(t)
+	singleCacheSizeBytes := int64(1000000)
+	peer1 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer2 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	peer3 := fmt.Sprintf("localhost:%d", testport.FindFree(t))
+	baseConfig := CacheConfig{
+		ReplicationFactor:  1,
+		Nodes:              []string{peer1, peer2},
+		DisableLocalLookup: true,
+	}
+
+	// Setup a distributed cache, 2 nodes, R = 1, and a third node that
+	// isn't on the ring yet.
+	memoryCache1 := newMemoryCache(t, singleCacheSizeBytes)
+	config1 := baseConfig
+	config1.ListenAddr = peer1
+	dc1 := startNewDCache(t, env, config1, memoryCache1)
+
+	memoryCache2 := newMemoryCache(t, singleCacheSizeBytes)
+	config2 := baseConfig
+	config2.ListenAddr = peer2
+	startNewDCache(t, env, config2, memoryCache2)
+
+	memoryCache3 := newMemoryCache(t, singleCacheSizeBytes)
+	config3 := baseConfig
+	config3.ListenAddr = peer3
+	startNewDCache(t, env, config3, memoryCache3)
+
+	waitForReady(t, config1.ListenAddr)
+	waitForReady(t, config2.ListenAddr)
+	waitForReady(t, config3.ListenAddr)
+
+	var resources []*rspb.ResourceName
+	for i := 0; i < 50; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		require.NoError(t, dc1.Set(ctx, rn, buf))
+		resources = append(resources, rn)
+	}
+
+	// The third node joins the ring, taking ownership of some of the keys.
+	dc1.setPeers([]string{peer1, peer2, peer3})
+
+	movedKeys := 0
+	for _, rn := range resources {
+		readAndCompareDigest(t, ctx, dc1, rn)
+		if dc1.ownerPeers(rn.GetDigest())[0] != peer3 {
+			continue
+		}
+		movedKeys++
+		// Reading the key from its previous owner should have
+		// backfilled the new owner.
+		exists, err := memoryCache3.Contains(ctx, rn)
+		require.NoError(t, err)
+		assert.True(t, exists, "digest %s was not backfilled", rn.GetDigest().GetHash())
+	}
+	assert.Greater(t, movedKeys, 0)
+
+	// Once the handoff period is over, reads no longer fall back to the
+	// previous owners.
+	flags.Set(t, "cache.distributed_cache.gossip_handoff_period", 0)
+	dc1.setPeers([]string{peer1, peer3})
+	for _, rn := range resources {
+		assert.Empty(t, dc1.previousOwnerPeers(rn.GetDigest()))
+	}
+}
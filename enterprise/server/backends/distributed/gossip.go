@@ -0,0 +1,189 @@
+package distributed
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/hashicorp/serf/serf"
+	"golang.org/x/time/rate"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+// Gossip membership lets the ring be derived from the members of the gossip
+// network instead of a hardcoded node list or redis heartbeats.
+//
+// Every cache node advertises its listen address, group name, and state as
+// gossip tags. The ring contains the alive members of the group that are
+// serving. When a node starts listening it marks itself as serving and the
+// other nodes add it to their rings; when it shuts down gracefully it marks
+// itself as draining, removes itself from its own ring, and copies its
+// recently-accessed keys to their new owners before it stops serving. Nodes
+// that crash are removed once gossip marks them as failed.
+//
+// Whenever the ring changes, the previous ring is kept for
+// gossip_handoff_period. Reads fall back to the keys' owners on the previous
+// ring, and reads that are served by them backfill the new owners, so keys
+// aren't lost when ownership moves.
+
+const (
+	// Gossip tags advertised by every cache node.
+	gossipAddrTag  = "distributed_cache_addr"
+	gossipGroupTag = "distributed_cache_group"
+	gossipStateTag = "distributed_cache_state"
+
+	// Values of the gossipStateTag.
+	gossipServingState  = "serving"
+	gossipDrainingState = "draining"
+)
+
+// gossipPeers returns the sorted listen addresses of the alive, serving cache
+// nodes in groupName.
+func gossipPeers(members []serf.Member, groupName string) []string {
+	peers := make([]string, 0, len(members))
+	for _, m := range members {
+		if m.Status != serf.StatusAlive {
+			continue
+		}
+		if m.Tags[gossipGroupTag] != groupName || m.Tags[gossipStateTag] != gossipServingState {
+			continue
+		}
+		if addr := m.Tags[gossipAddrTag]; addr != "" {
+			peers = append(peers, addr)
+		}
+	}
+	slices.Sort(peers)
+	return slices.Compact(peers)
+}
+
+// OnEvent updates the ring when gossip membership changes.
+func (c *Cache) OnEvent(eventType serf.EventType, event serf.Event) {
+	if _, ok := event.(serf.MemberEvent); !ok {
+		return
+	}
+	c.updateGossipPeers()
+}
+
+func (c *Cache) updateGossipPeers() {
+	c.setPeers(gossipPeers(c.config.GossipService.Members(), c.config.GroupName))
+}
+
+// setPeers replaces the peers on the ring. If they changed, the previous ring
+// is kept for gossip_handoff_period so that reads can fall back to the keys'
+// previous owners.
+func (c *Cache) setPeers(peers []string) {
+	peers = slices.Clone(peers)
+	slices.Sort(peers)
+
+	c.ringMu.Lock()
+	defer c.ringMu.Unlock()
+	current := c.consistentHash.GetItems()
+	if slices.Equal(current, peers) {
+		return
+	}
+	if len(peers) == 0 {
+		c.log.Warningf("Not removing the last peers %v from the ring", current)
+		return
+	}
+	c.previousRingExpiration = time.Time{}
+	if len(current) > 0 && *gossipHandoffPeriod > 0 {
+		if err := c.previousConsistentHash.Set(slices.Clone(current)...); err != nil {
+			c.log.Errorf("Error setting previous peers in consistent hash: %s", err)
+		} else {
+			c.previousRingExpiration = time.Now().Add(*gossipHandoffPeriod)
+		}
+	}
+	if err := c.consistentHash.Set(peers...); err != nil {
+		c.log.Errorf("Error setting peers in consistent hash: %s", err)
+		return
+	}
+	c.log.Infof("Peers changed from %v to %v", current, peers)
+}
+
+// previousOwnerPeers returns the peers that owned this key before the ring
+// last changed, or nil if the ring hasn't changed within
+// gossip_handoff_period.
+func (c *Cache) previousOwnerPeers(d *repb.Digest) []string {
+	c.ringMu.RLock()
+	active := time.Now().Before(c.previousRingExpiration)
+	c.ringMu.RUnlock()
+	if !active {
+		return nil
+	}
+	peers := c.previousConsistentHash.GetAllReplicas(d.GetHash())
+	if len(peers) > c.config.ReplicationFactor {
+		peers = peers[:c.config.ReplicationFactor]
+	}
+	return peers
+}
+
+// joinGossipRing advertises this node as serving, which adds it to the rings
+// of all the nodes in the group.
+func (c *Cache) joinGossipRing() {
+	err := c.config.GossipService.SetTags(map[string]string{
+		gossipAddrTag:  c.config.ListenAddr,
+		gossipGroupTag: c.config.GroupName,
+		gossipStateTag: gossipServingState,
+	})
+	if err != nil {
+		c.log.Errorf("Unable to join the gossip ring: %s", err)
+		return
+	}
+	c.updateGossipPeers()
+}
+
+// drainGossipRing advertises this node as draining, removes it from its own
+// ring, and copies its recently-accessed keys to their new owners.
+func (c *Cache) drainGossipRing(ctx context.Context) {
+	if err := c.config.GossipService.SetTags(map[string]string{gossipStateTag: gossipDrainingState}); err != nil {
+		c.log.Warningf("Unable to mark this node as draining: %s", err)
+	}
+	// Don't wait for gossip to deliver our own update before routing
+	// writes to the remaining peers.
+	remaining := slices.DeleteFunc(slices.Clone(c.consistentHash.GetItems()), func(p string) bool {
+		return p == c.config.ListenAddr
+	})
+	if len(remaining) == 0 {
+		return
+	}
+	c.setPeers(remaining)
+
+	if *gossipDrainTimeout <= 0 {
+		return
+	}
+	scanner, ok := c.local.(interfaces.ScannableCache)
+	if !ok {
+		c.log.Infof("Skipping drain handoff: the local cache (%T) does not support scanning", c.local)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, *gossipDrainTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.backfillScannedResources(ctx, scanner, rate.NewLimiter(rate.Inf, 1), func(r *interfaces.ScannedResource) []string {
+		if tooOldToRepair(r, time.Now()) {
+			return nil
+		}
+		return c.ownerPeers(r.Resource.GetDigest())
+	})
+	if err != nil {
+		c.log.Warningf("Drain handoff stopped after %s: %s", time.Since(start), err)
+		return
+	}
+	c.log.Infof("Drain handoff finished in %s", time.Since(start))
+}
+
+// checkGossipRing returns an error if this node hasn't joined the ring or the
+// ring is too small to meet the replication factor.
+func (c *Cache) checkGossipRing() error {
+	peers := c.consistentHash.GetItems()
+	if !slices.Contains(peers, c.config.ListenAddr) {
+		return status.UnavailableError("This node has not joined the gossip ring.")
+	}
+	if len(peers) < c.config.ReplicationFactor {
+		return status.UnavailableErrorf("Not enough nodes available %d to meet replication factor %d.", len(peers), c.config.ReplicationFactor)
+	}
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/keys"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/chunker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/pebble"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore"
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore/gcs"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -61,7 +62,7 @@ var (
 	rootDirectoryFlag          = flag.String("cache.pebble.root_directory", "", "The root directory to store the database in.")
 	blockCacheSizeBytesFlag    = flag.Int64("cache.pebble.block_cache_size_bytes", DefaultBlockCacheSizeBytes, "How much ram to give the block cache")
 	maxInlineFileSizeBytesFlag = flag.Int64("cache.pebble.max_inline_file_size_bytes", DefaultMaxInlineFileSizeBytes, "Files smaller than this may be inlined directly into pebble")
-	minGCSFileSizeBytesFlag    = flag.Int64("cache.pebble.min_gcs_file_size_bytes", math.MaxInt64, "Files larger than this may be stored in gcs (0 is disabled).")
+	minGCSFileSizeBytesFlag    = flag.Int64("cache.pebble.min_gcs_file_size_bytes", math.MaxInt64, "Files larger than this may be stored in gcs or the blobstore (0 is disabled).")
 	partitionsFlag             = flag.Slice("cache.pebble.partitions", []disk.Partition{}, "")
 	partitionMappingsFlag      = flag.Slice("cache.pebble.partition_mappings", []disk.PartitionMapping{}, "")
 
@@ -107,6 +108,11 @@ var (
 	gcsCredentials = flag.String("cache.pebble.gcs.credentials", "", "Credentials in JSON format that will be used to authenticate to GCS.", flag.Secret)
 	gcsProjectID   = flag.String("cache.pebble.gcs.project_id", "", "The Google Cloud project ID of the project owning the above credentials and GCS bucket.")
 	gcsAppName     = flag.String("cache.pebble.gcs.app_name", "", "The app name, under which blobstore data will be stored.")
+
+	// Blobstore Large File Support
+	blobstoreEnabled = flag.Bool("cache.pebble.blobstore.enabled", false, "If true, store files larger than cache.pebble.min_gcs_file_size_bytes in the blobstore configured under storage (e.g. storage.aws_s3, storage.azure or storage.disk). Mutually exclusive with cache.pebble.gcs.bucket.")
+	blobstoreTTLDays = flag.Int64("cache.pebble.blobstore.ttl_days", DefaultBlobstoreTTLDays, "Files in the blobstore that have not been accessed for this many days are treated as expired and deleted by the cache. Must be positive.")
+	blobstoreAppName = flag.String("cache.pebble.blobstore.app_name", "", "The app name, under which blobstore data will be stored.")
 )
 
 var (
@@ -122,6 +128,7 @@ var (
 	DefaultDeleteBufferSize         = 20
 	DefaultNumDeleteWorkers         = 16
 	DefaultMinEvictionAge           = 6 * time.Hour
+	DefaultBlobstoreTTLDays         = int64(30)
 
 	DefaultName         = "pebble_cache"
 	DefaultMaxSizeBytes = cache_config.MaxSizeBytes()
@@ -208,7 +215,14 @@ type Options struct {
 	GCSAppName          string
 	GCSTTLDays          *int64
 	MinGCSFileSizeBytes *int64
-	FileStorer          filestore.Store
+
+	// Blobstore, if set, is used instead of GCS to store files of at least
+	// MinGCSFileSizeBytes.
+	Blobstore        interfaces.Blobstore
+	BlobstoreAppName string
+	BlobstoreTTLDays *int64
+
+	FileStorer filestore.Store
 }
 
 type sizeUpdate struct {
@@ -278,6 +292,11 @@ type PebbleCache struct {
 
 	minGCSFileSizeBytes int64
 	gcsTTLDays          int64
+
+	// blobstore and blobstoreAppName are set if large files are stored in
+	// a blobstore other than GCS.
+	blobstore        interfaces.Blobstore
+	blobstoreAppName string
 }
 
 type keyMigrator interface {
@@ -364,6 +383,19 @@ func Register(env *real_environment.RealEnv) error {
 		MinGCSFileSizeBytes:         minGCSFileSizeBytesFlag,
 		EnableAutoRatchet:           *enableAutoRatchet,
 	}
+	if *blobstoreEnabled {
+		bs := env.GetBlobstore()
+		if bs == nil {
+			var err error
+			bs, err = blobstore.NewFromConfig(env.GetServerContext())
+			if err != nil {
+				return status.InternalErrorf("Error configuring pebble cache blobstore: %s", err)
+			}
+		}
+		opts.Blobstore = bs
+		opts.BlobstoreAppName = *blobstoreAppName
+		opts.BlobstoreTTLDays = blobstoreTTLDays
+	}
 	c, err := NewPebbleCache(env, opts)
 	if err != nil {
 		return status.InternalErrorf("Error configuring pebble cache: %s", err)
@@ -468,6 +500,10 @@ func SetOptionDefaults(opts *Options) {
 		var ttlInDays int64 = 0
 		opts.GCSTTLDays = &ttlInDays
 	}
+	if opts.BlobstoreTTLDays == nil || *opts.BlobstoreTTLDays == 0 {
+		var ttlInDays int64 = DefaultBlobstoreTTLDays
+		opts.BlobstoreTTLDays = &ttlInDays
+	}
 }
 
 func ensureDefaultPartitionExists(opts *Options) {
@@ -595,9 +631,33 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 		clock = clockwork.NewRealClock()
 	}
 
+	if opts.GCSBucket != "" && opts.Blobstore != nil {
+		return nil, status.InvalidArgumentError("GCS and blobstore large file storage are mutually exclusive")
+	}
+	ttlDays := *opts.GCSTTLDays
+	if opts.Blobstore != nil {
+		// Blobs are stored and listed under the app name, so without one,
+		// orphaned blob cleanup would consider everything in the blobstore.
+		if opts.BlobstoreAppName == "" {
+			return nil, status.InvalidArgumentError("cache.pebble.blobstore.app_name must be set when storing files in the blobstore")
+		}
+		if *opts.BlobstoreTTLDays <= 0 {
+			return nil, status.InvalidArgumentErrorf("blobstore TTL must be positive, got %d days", *opts.BlobstoreTTLDays)
+		}
+		ttlDays = *opts.BlobstoreTTLDays
+	}
+
 	fileStorer := opts.FileStorer
 	if fileStorer == nil {
 		filestoreOpts := make([]filestore.Option, 0)
+		if opts.Blobstore != nil {
+			// Unlike GCS, these blobstores don't support custom time
+			// lifecycle rules, so the TTL is enforced by the cache itself:
+			// expired blobs are deleted by eviction and background repair.
+			filestoreOpts = append(filestoreOpts, filestore.WithBlobstore(opts.Blobstore, opts.BlobstoreAppName), filestore.WithClock(clock))
+			log.Printf("Pebble Cache: storing files larger than %d bytes in the configured blobstore", *opts.MinGCSFileSizeBytes)
+			log.Printf("Pebble Cache: blobstore TTL is set to %d days", *opts.BlobstoreTTLDays)
+		}
 		if opts.GCSBucket != "" {
 			// Create a new GCS Client with compression disabled. This cache
 			// will already compress blobs before storing them, so we don't
@@ -653,8 +713,10 @@ func NewPebbleCache(env environment.Env, opts *Options) (*PebbleCache, error) {
 		metricsCollector:            mc,
 		includeMetadataSize:         opts.IncludeMetadataSize,
 		minGCSFileSizeBytes:         *opts.MinGCSFileSizeBytes,
-		gcsTTLDays:                  *opts.GCSTTLDays,
+		gcsTTLDays:                  ttlDays,
 		fileStorer:                  fileStorer,
+		blobstore:                   opts.Blobstore,
+		blobstoreAppName:            opts.BlobstoreAppName,
 	}
 
 	versionMetadata, err := pc.DatabaseVersionMetadata()
@@ -1102,6 +1164,26 @@ func (p *PebbleCache) processSizeUpdates() {
 	}
 }
 
+// orphanKey returns the key for a file or blob stored at the given path,
+// which is relative to the blob dir (for files) or app name (for blobs).
+// Returns false if the path does not look like a key.
+func orphanKey(relPath string) (filestore.PebbleKey, bool, error) {
+	const sep = "/"
+	var key filestore.PebbleKey
+	parts := strings.Split(relPath, sep)
+	if len(parts) < 3 {
+		return key, false, nil
+	}
+	prefixIndex := len(parts) - 2
+	// Remove the second to last element which is the 4-char hash prefix.
+	parts = append(parts[:prefixIndex], parts[prefixIndex+1:]...)
+
+	if _, err := key.FromBytes([]byte(strings.Join(parts, sep))); err != nil {
+		return key, false, err
+	}
+	return key, true, nil
+}
+
 func (p *PebbleCache) deleteOrphanedFiles(quitChan chan struct{}) error {
 	db, err := p.leaser.DB()
 	if err != nil {
@@ -1109,7 +1191,6 @@ func (p *PebbleCache) deleteOrphanedFiles(quitChan chan struct{}) error {
 	}
 	defer db.Close()
 
-	const sep = "/"
 	iter, err := db.NewIter(&pebble.IterOptions{
 		LowerBound: keys.MinByte,
 		UpperBound: keys.MaxByte,
@@ -1141,19 +1222,14 @@ func (p *PebbleCache) deleteOrphanedFiles(quitChan chan struct{}) error {
 		if err != nil {
 			return err
 		}
-		parts := strings.Split(relPath, sep)
-		if len(parts) < 3 {
+		key, ok, err := orphanKey(relPath)
+		if err != nil {
+			return err
+		}
+		if !ok {
 			log.Warningf("[%s] Skipping orphaned file: %q", p.name, path)
 			return nil
 		}
-		prefixIndex := len(parts) - 2
-		// Remove the second to last element which is the 4-char hash prefix.
-		parts = append(parts[:prefixIndex], parts[prefixIndex+1:]...)
-
-		var key filestore.PebbleKey
-		if _, err := key.FromBytes([]byte(strings.Join(parts, sep))); err != nil {
-			return err
-		}
 
 		unlockFn := p.locker.RLock(key.LockID())
 		md := sgpb.FileMetadataFromVTPool()
@@ -1186,10 +1262,164 @@ func (p *PebbleCache) deleteOrphanedFiles(quitChan chan struct{}) error {
 		alert.UnexpectedEvent("pebble_cache_error_deleting_orphans", "err [%s]: %s", p.name, err)
 	}
 	log.Infof("Pebble Cache [%s]: deleteOrphanedFiles removed %d files", p.name, orphanCount)
+
+	if p.blobstore != nil {
+		n, err := p.deleteOrphanedBlobs(quitChan, db)
+		if err != nil {
+			alert.UnexpectedEvent("pebble_cache_error_deleting_orphans", "err [%s]: %s", p.name, err)
+		}
+		log.Infof("Pebble Cache [%s]: deleteOrphanedFiles removed %d blobs", p.name, n)
+	}
 	close(p.orphanedFilesDone)
 	return nil
 }
 
+// deleteOrphanedBlobs deletes blobs in the blobstore that are not referenced
+// by any metadata, e.g. because the cache crashed between writing a blob and
+// its metadata, or while deleting an entry. Unlike GCS, the blobstore has no
+// lifecycle rules to delete these eventually. Returns the number of orphans
+// that were deleted, or that would have been deleted in dry-run mode.
+func (p *PebbleCache) deleteOrphanedBlobs(quitChan chan struct{}, db pebble.IPebbleDB) (int, error) {
+	ctx := p.env.GetServerContext()
+	// Blobs are written before their metadata, so skip recently modified
+	// blobs that may still be in the middle of a write.
+	scanStart := time.Now().Add(-time.Hour)
+	appDir := p.blobstoreAppName + "/"
+	orphanCount := 0
+	err := p.blobstore.ListBlobs(ctx, appDir, func(blobName string, modTime time.Time) error {
+		// Check if we're shutting down; exit if so.
+		select {
+		case <-quitChan:
+			return status.CanceledErrorf("cache shutting down")
+		default:
+		}
+		if modTime.After(scanStart) {
+			return nil
+		}
+
+		// Blob names are the file key, prefixed by the app name and
+		// suffixed with a random salt. See filestore.BlobWriter.
+		relPath := strings.TrimPrefix(blobName, appDir)
+		if i := strings.LastIndex(relPath, "-"); i >= 0 {
+			relPath = relPath[:i]
+		}
+		key, ok, err := orphanKey(relPath)
+		if err != nil || !ok {
+			log.Warningf("[%s] Skipping orphaned blob: %q", p.name, blobName)
+			return nil
+		}
+
+		unlockFn := p.locker.RLock(key.LockID())
+		md := sgpb.FileMetadataFromVTPool()
+		err = p.lookupFileMetadata(ctx, db, key, md)
+		referenced := err == nil && md.GetStorageMetadata().GetGcsMetadata().GetBlobName() == blobName
+		md.ReturnToVTPool()
+		unlockFn()
+
+		if err != nil && !status.IsNotFoundError(err) {
+			return err
+		}
+		if referenced {
+			return nil
+		}
+		if *orphanDeleteDryRun {
+			log.Infof("[%s] Would delete orphaned blob: %s (last modified: %s) which is not in cache", p.name, blobName, modTime)
+		} else {
+			if err := p.blobstore.DeleteBlob(ctx, blobName); err != nil {
+				log.Warningf("[%s] Failed to delete orphaned blob %q: %s", p.name, blobName, err)
+				return nil
+			}
+			log.Infof("[%s] Removed orphaned blob: %q", p.name, blobName)
+		}
+		orphanCount += 1
+		if orphanCount%1000 == 0 {
+			log.Infof("[%s] Removed %d orphaned blobs", p.name, orphanCount)
+		}
+		return nil
+	})
+	return orphanCount, err
+}
+
+// ScanResources implements interfaces.ScannableCache.
+func (p *PebbleCache) ScanResources(ctx context.Context, fn func(r *interfaces.ScannedResource) error) error {
+	db, err := p.leaser.DB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: keys.MinByte,
+		UpperBound: keys.MaxByte,
+	})
+	if err != nil {
+		return err
+	}
+	// We update the iter variable later on, so we need to wrap the Close call
+	// in a func to operate on the correct iterator instance.
+	defer func() {
+		iter.Close()
+	}()
+
+	scanned := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Create a new iterator once in a while to avoid holding on to
+		// sstables for too long.
+		scanned++
+		if scanned%1_000_000 == 0 {
+			k := make([]byte, len(iter.Key()))
+			copy(k, iter.Key())
+			newIter, err := db.NewIter(&pebble.IterOptions{
+				LowerBound: k,
+				UpperBound: keys.MaxByte,
+			})
+			if err != nil {
+				return err
+			}
+			iter.Close()
+			iter = newIter
+			if !iter.First() {
+				break
+			}
+		}
+
+		if bytes.HasPrefix(iter.Key(), SystemKeyPrefix) {
+			continue
+		}
+		md := &sgpb.FileMetadata{}
+		if err := proto.Unmarshal(iter.Value(), md); err != nil {
+			log.Errorf("[%s] Error unmarshaling metadata when scanning resources: %s", p.name, err)
+			continue
+		}
+		// Chunks are replicated as part of the file they belong to.
+		if md.GetFileType() == sgpb.FileMetadata_CHUNK_FILE_TYPE {
+			continue
+		}
+		fr := md.GetFileRecord()
+		err := fn(&interfaces.ScannedResource{
+			Resource: &rspb.ResourceName{
+				Digest:         fr.GetDigest(),
+				DigestFunction: fr.GetDigestFunction(),
+				InstanceName:   fr.GetIsolation().GetRemoteInstanceName(),
+				CacheType:      fr.GetIsolation().GetCacheType(),
+				Compressor:     fr.GetCompressor(),
+			},
+			GroupID:        fr.GetIsolation().GetGroupId(),
+			Encrypted:      md.GetEncryptionMetadata() != nil,
+			LastAccessUsec: md.GetLastAccessUsec(),
+			LastModifyUsec: md.GetLastModifyUsec(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *PebbleCache) backgroundRepair(quitChan chan struct{}) error {
 	fixMissingFiles := *scanForMissingFiles
 
@@ -1315,7 +1545,15 @@ func (p *PebbleCache) backgroundRepairPartition(db pebble.IPebbleDB, evictor *pa
 		}
 
 		removedEntry := false
-		if opts.deleteEntriesWithMissingFiles {
+		if opts.deleteEntriesWithMissingFiles && fileMetadata.GetStorageMetadata().GetGcsMetadata() != nil {
+			if p.blobIsMissing(p.env.GetServerContext(), fileMetadata.GetStorageMetadata().GetGcsMetadata()) {
+				_ = modLim.Wait(p.env.GetServerContext())
+				if p.deleteEntryWithMissingBlob(p.env.GetServerContext(), key, fileMetadata) {
+					missingFiles += 1
+					removedEntry = true
+				}
+			}
+		} else if opts.deleteEntriesWithMissingFiles {
 			blobDir = p.blobDir()
 			_, err := p.fileStorer.NewReader(p.env.GetServerContext(), blobDir, fileMetadata.GetStorageMetadata(), 0, 0)
 			if err != nil {
@@ -1566,6 +1804,64 @@ func (p *PebbleCache) handleMetadataMismatch(ctx context.Context, causeErr error
 	return false
 }
 
+// deleteUnreferencedBlob deletes a blob stored in GCS or the blobstore that is
+// not referenced by any metadata. A nil blob is ignored.
+func (p *PebbleCache) deleteUnreferencedBlob(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata) {
+	if b == nil {
+		return
+	}
+	if err := p.fileStorer.DeleteStoredBlob(ctx, b); err != nil {
+		log.Warningf("[%s] Error deleting unreferenced blob %q: %s", p.name, b.GetBlobName(), err)
+	}
+}
+
+// blobIsMissing returns true if the blob stored in GCS or the blobstore is
+// past its TTL or no longer exists.
+func (p *PebbleCache) blobIsMissing(ctx context.Context, gcsMetadata *sgpb.StorageMetadata_GCSMetadata) bool {
+	if p.gcsObjectIsPastTTL(gcsMetadata) {
+		return true
+	}
+	exists, err := p.fileStorer.BlobExists(ctx, gcsMetadata)
+	if err != nil {
+		log.Warningf("[%s] Error checking if blob %q exists: %s", p.name, gcsMetadata.GetBlobName(), err)
+		return false
+	}
+	return !exists
+}
+
+// deleteEntryWithMissingBlob deletes the metadata for a blob that is missing
+// or expired, along with the blob itself if it still exists. GCS lifecycle
+// rules delete expired blobs on their own, but other blobstores rely on this
+// to reclaim space. Returns true if the entry was deleted.
+func (p *PebbleCache) deleteEntryWithMissingBlob(ctx context.Context, key filestore.PebbleKey, fileMetadata *sgpb.FileMetadata) bool {
+	unlockFn := p.locker.Lock(key.LockID())
+	defer unlockFn()
+
+	db, err := p.leaser.DB()
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+
+	// The entry may have been overwritten since it was scanned; only delete
+	// it if it still points at the same blob.
+	md := sgpb.FileMetadataFromVTPool()
+	defer md.ReturnToVTPool()
+	version, err := p.lookupFileMetadataAndVersion(ctx, db, key, md)
+	if err != nil {
+		return false
+	}
+	if md.GetStorageMetadata().GetGcsMetadata().GetBlobName() != fileMetadata.GetStorageMetadata().GetGcsMetadata().GetBlobName() {
+		return false
+	}
+	log.Warningf("[%s] Metadata record %q was found but blob (%+v) is missing or expired", p.name, key.String(), md.GetStorageMetadata().GetGcsMetadata())
+	if err := p.deleteFileAndMetadata(ctx, key, version, md); err != nil {
+		log.Warningf("[%s] Error deleting metadata: %s", p.name, err)
+		return false
+	}
+	return true
+}
+
 func (p *PebbleCache) Contains(ctx context.Context, r *rspb.ResourceName) (bool, error) {
 	missing, err := p.FindMissing(ctx, []*rspb.ResourceName{r})
 	if err != nil {
@@ -2333,6 +2629,7 @@ func (p *PebbleCache) newWrappedWriter(ctx context.Context, fileRecord *sgpb.Fil
 		}
 		if bytesWritten == 0 {
 			log.Infof("Rejecting zero-length write. Key %q, md: %+v", key, md)
+			p.deleteUnreferencedBlob(ctx, md.GetStorageMetadata().GetGcsMetadata())
 			return status.UnavailableError("zero-length writes are not allowed")
 		}
 
@@ -2376,12 +2673,23 @@ func (p *PebbleCache) writeMetadata(ctx context.Context, db pebble.IPebbleDB, ke
 		metrics.DecompressedBlobSizeWrite.With(labels).Add(float64(md.GetFileRecord().GetDigest().GetSizeBytes()))
 	}
 
+	// If this write replaces a blob stored in GCS or the blobstore, the old
+	// blob is no longer referenced and is deleted once the lock is released.
+	var replacedBlob *sgpb.StorageMetadata_GCSMetadata
+	defer func() {
+		p.deleteUnreferencedBlob(ctx, replacedBlob)
+	}()
+
 	unlockFn := p.locker.Lock(key.LockID())
 	defer unlockFn()
 
 	oldMD := sgpb.FileMetadataFromVTPool()
 	defer oldMD.ReturnToVTPool()
+	var oldBlob *sgpb.StorageMetadata_GCSMetadata
 	if version, err := p.lookupFileMetadataAndVersion(ctx, db, key, oldMD); err == nil {
+		if b := oldMD.GetStorageMetadata().GetGcsMetadata(); b != nil && b.GetBlobName() != md.GetStorageMetadata().GetGcsMetadata().GetBlobName() {
+			oldBlob = b.CloneVT()
+		}
 		oldKeyBytes, err := key.Bytes(version)
 		if err != nil {
 			return err
@@ -2398,6 +2706,7 @@ func (p *PebbleCache) writeMetadata(ctx context.Context, db pebble.IPebbleDB, ke
 	}
 
 	if err = db.Set(keyBytes, protoBytes, pebble.NoSync); err == nil {
+		replacedBlob = oldBlob
 		if key.EncryptionKeyID() != md.GetEncryptionMetadata().GetEncryptionKeyId() && len(md.GetStorageMetadata().GetChunkedMetadata().GetResource()) == 0 {
 			err := status.FailedPreconditionErrorf("key vs metadata encryption mismatch for %q: %q vs %q", string(keyBytes), key.EncryptionKeyID(), md.GetEncryptionMetadata().GetEncryptionKeyId())
 			alert.UnexpectedEvent("key_metadata_encryption_mismatch", err.Error())
@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -51,6 +52,8 @@ import (
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
 	sgpb "github.com/buildbuddy-io/buildbuddy/proto/storage"
+
+	diskblobstore "github.com/buildbuddy-io/buildbuddy/server/backends/blobstore/disk"
 )
 
 var (
@@ -3153,6 +3156,205 @@ func TestGCSBlobStorageOverwriteObjects(t *testing.T) {
 	}
 }
 
+func TestBlobstoreBlobStorage(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	clock := clockwork.NewFakeClock()
+	ctx := getAnonContext(t, te)
+
+	blobstoreDir := testfs.MakeTempDir(t)
+	flags.Set(t, "storage.disk.root_directory", blobstoreDir)
+	bs, err := diskblobstore.NewDiskBlobStore()
+	require.NoError(t, err)
+
+	var minGCSFileSize int64 = 1
+	var ttlDays int64 = 1
+	options := &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           int64(1_000_000), // 1MB
+		Clock:                  clock,
+		MaxInlineFileSizeBytes: 1,
+		MinGCSFileSizeBytes:    &minGCSFileSize,
+		Blobstore:              bs,
+		BlobstoreAppName:       "app-name",
+		BlobstoreTTLDays:       &ttlDays,
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	defer pc.Stop()
+
+	countBlobs := func() int {
+		n := 0
+		err := filepath.WalkDir(blobstoreDir, func(_ string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				n++
+			}
+			return err
+		})
+		require.NoError(t, err)
+		return n
+	}
+
+	casRN, casBuf := testdigest.RandomCASResourceBuf(t, 100)
+	acRN, acBuf := testdigest.RandomACResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, casRN, casBuf))
+	require.NoError(t, pc.Set(ctx, acRN, acBuf))
+	require.Equal(t, 2, countBlobs())
+
+	got, err := pc.Get(ctx, casRN)
+	require.NoError(t, err)
+	require.Equal(t, casBuf, got)
+
+	// Overwriting an object deletes the blob it replaced.
+	acBuf = []byte("overwritten action result")
+	require.NoError(t, pc.Set(ctx, acRN, acBuf))
+	require.Equal(t, 2, countBlobs())
+	got, err = pc.Get(ctx, acRN)
+	require.NoError(t, err)
+	require.Equal(t, acBuf, got)
+
+	// Deleting an object deletes its blob.
+	require.NoError(t, pc.Delete(ctx, acRN))
+	require.Equal(t, 1, countBlobs())
+
+	// Objects are not found once the TTL has passed.
+	clock.Advance(25 * time.Hour)
+	exists, err := pc.Contains(ctx, casRN)
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+func TestDeleteOrphanedBlobs(t *testing.T) {
+	flags.Set(t, "cache.pebble.scan_for_orphaned_files", true)
+	flags.Set(t, "cache.pebble.scan_for_missing_files", true)
+	flags.Set(t, "cache.pebble.orphan_delete_dry_run", false)
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(emptyUserMap))
+	ctx := getAnonContext(t, te)
+
+	blobstoreDir := testfs.MakeTempDir(t)
+	flags.Set(t, "storage.disk.root_directory", blobstoreDir)
+	bs, err := diskblobstore.NewDiskBlobStore()
+	require.NoError(t, err)
+
+	rootDir := testfs.MakeTempDir(t)
+	var minGCSFileSize int64 = 1
+	options := &pebble_cache.Options{
+		RootDirectory:          rootDir,
+		MaxSizeBytes:           int64(1_000_000), // 1MB
+		MaxInlineFileSizeBytes: 1,
+		MinGCSFileSizeBytes:    &minGCSFileSize,
+		Blobstore:              bs,
+		BlobstoreAppName:       "app-name",
+	}
+	pc, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc.Start())
+	for !pc.DoneScanning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	keptRN, keptBuf := testdigest.RandomCASResourceBuf(t, 100)
+	deletedRN, deletedBuf := testdigest.RandomCASResourceBuf(t, 100)
+	require.NoError(t, pc.Set(ctx, keptRN, keptBuf))
+	require.NoError(t, pc.Set(ctx, deletedRN, deletedBuf))
+	require.NoError(t, pc.Stop())
+
+	listBlobs := func() []string {
+		var names []string
+		err := bs.ListBlobs(ctx, "app-name/", func(blobName string, _ time.Time) error {
+			names = append(names, blobName)
+			return nil
+		})
+		require.NoError(t, err)
+		return names
+	}
+	blobs := listBlobs()
+	require.Len(t, blobs, 2)
+	var keptBlob string
+	for _, b := range blobs {
+		if strings.Contains(b, keptRN.GetDigest().GetHash()) {
+			keptBlob = b
+		}
+	}
+	require.NotEmpty(t, keptBlob)
+
+	// A copy of the kept blob with another salt isn't referenced by the
+	// metadata, e.g. because a write replaced it.
+	_, err = bs.WriteBlob(ctx, keptBlob[:len(keptBlob)-len("12345")]+"abcde", []byte("replaced"))
+	require.NoError(t, err)
+
+	// Delete the metadata for the other blob.
+	db, err := pebble.Open(rootDir, &pebble.Options{})
+	require.NoError(t, err)
+	iter, err := db.NewIter(&pebble.IterOptions{
+		LowerBound: keys.MinByte,
+		UpperBound: keys.MaxByte,
+	})
+	require.NoError(t, err)
+	for iter.First(); iter.Valid(); iter.Next() {
+		if bytes.HasPrefix(iter.Key(), pebble_cache.SystemKeyPrefix) {
+			continue
+		}
+		fileMetadata := &sgpb.FileMetadata{}
+		require.NoError(t, proto.Unmarshal(iter.Value(), fileMetadata))
+		if fileMetadata.GetFileRecord().GetDigest().GetHash() == deletedRN.GetDigest().GetHash() {
+			require.NoError(t, db.Delete(iter.Key(), &pebble.WriteOptions{Sync: false}))
+		}
+	}
+	require.NoError(t, iter.Close())
+	require.NoError(t, db.Close())
+
+	// Recently written blobs may not have their metadata yet, so they are
+	// never treated as orphans.
+	pc2, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc2.Start())
+	for !pc2.DoneScanning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, pc2.Stop())
+	require.Len(t, listBlobs(), 3)
+
+	old := time.Now().Add(-2 * time.Hour)
+	err = filepath.WalkDir(blobstoreDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	})
+	require.NoError(t, err)
+
+	pc3, err := pebble_cache.NewPebbleCache(te, options)
+	require.NoError(t, err)
+	require.NoError(t, pc3.Start())
+	defer pc3.Stop()
+	for !pc3.DoneScanning() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, []string{keptBlob}, listBlobs())
+	got, err := pc3.Get(ctx, keptRN)
+	require.NoError(t, err)
+	require.Equal(t, keptBuf, got)
+}
+
+func TestBlobstoreRequiresAppName(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "storage.disk.root_directory", testfs.MakeTempDir(t))
+	bs, err := diskblobstore.NewDiskBlobStore()
+	require.NoError(t, err)
+
+	var minGCSFileSize int64 = 1
+	_, err = pebble_cache.NewPebbleCache(te, &pebble_cache.Options{
+		RootDirectory:          testfs.MakeTempDir(t),
+		MaxSizeBytes:           int64(1_000_000), // 1MB
+		MaxInlineFileSizeBytes: 1,
+		MinGCSFileSizeBytes:    &minGCSFileSize,
+		Blobstore:              bs,
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
 func pointer[T any](value T) *T {
 	return &value
 }
@@ -65,6 +65,16 @@ func (c *noOpCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRe
 	return nil, status.InternalError("Unexpected call to BatchReadBlobs")
 }
 
+func (c *noOpCAS) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	c.t.Fatal("Unexpected call to SplitBlob")
+	return nil, status.InternalError("Unexpected call to SplitBlob")
+}
+
+func (c *noOpCAS) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	c.t.Fatal("Unexpected call to SpliceBlob")
+	return nil, status.InternalError("Unexpected call to SpliceBlob")
+}
+
 func (c *noOpCAS) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
 	c.t.Fatal("Unexpected call to GetTree")
 	return status.InternalError("Unexpected call to GetTree")
@@ -18,6 +18,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/hit_tracker_client"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remoteauth"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
+	"github.com/buildbuddy-io/buildbuddy/server/gossip"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/action_cache_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
@@ -101,6 +102,9 @@ func main() {
 	if c := env.GetCache(); c == nil {
 		log.Fatalf("No local cache configured")
 	}
+	if err := gossip.Register(env); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := distributed.Register(env); err != nil {
 		log.Fatal(err.Error())
 	}
@@ -31,6 +31,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_search_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/experiments"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/flake_detector"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/gcplink"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/githubapp"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/hit_tracker_service"
@@ -39,6 +40,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/invocation_stat_service"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/iprules"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/ociregistry"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/outbound_webhooks"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/quota"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/registry"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/execution_server"
@@ -55,10 +57,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/tasksize"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/usage"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/usage_service"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/chunker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/dsingleflight"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/github"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workspace"
 	"github.com/buildbuddy-io/buildbuddy/server/config"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -127,6 +131,7 @@ func convertToProdOrDie(ctx context.Context, env *real_environment.RealEnv) {
 	env.SetGitProviders([]interfaces.GitProvider{
 		github.NewProvider(env),
 		bitbucket.NewProvider(),
+		gitlab.NewProvider(),
 	})
 	if err := githubapp.Register(env); err != nil {
 		log.Fatalf("Failed to register GitHub app: %s", err)
@@ -266,6 +271,9 @@ func main() {
 	if err := suggestion.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := flake_detector.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := crypter_service.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -284,6 +292,9 @@ func main() {
 	if err := iprules.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := outbound_webhooks.Register(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if err := clientidentity.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -302,6 +313,9 @@ func main() {
 	if err := ociregistry.Register(realEnv); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := chunker.RegisterBlobSplitter(realEnv); err != nil {
+		log.Fatalf("%v", err)
+	}
 
 	executionService := execution_service.NewExecutionService(realEnv)
 	realEnv.SetExecutionService(executionService)
@@ -296,6 +296,27 @@ func (s *CASServerProxy) batchReadBlobsRemote(ctx context.Context, readReq *repb
 	return readResp, nil
 }
 
+// SplitBlob and SpliceBlob are forwarded to the remote CAS, which owns the
+// chunking configuration. Chunks are fetched through the proxy on demand like
+// any other blob.
+func (s *CASServerProxy) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	if proxy_util.SkipRemote(ctx) {
+		return nil, status.UnimplementedError("Skip remote not implemented")
+	}
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	return s.remote.SplitBlob(ctx, req)
+}
+
+func (s *CASServerProxy) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	if proxy_util.SkipRemote(ctx) {
+		return nil, status.UnimplementedError("Skip remote not implemented")
+	}
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	return s.remote.SpliceBlob(ctx, req)
+}
+
 // TODO(iain): record per-byte metrics here as well as above.
 func (s *CASServerProxy) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
 	if proxy_util.SkipRemote(stream.Context()) {
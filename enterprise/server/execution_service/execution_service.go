@@ -9,6 +9,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/liveoutput"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/execution"
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
@@ -35,6 +36,7 @@ import (
 var (
 	primaryDBReadsEnabled = flag.Bool("remote_execution.primary_db_reads_enabled", true, "Whether to read executions from the primary database.")
 	olapReadsEnabled      = flag.Bool("remote_execution.olap_reads_enabled", false, "Whether to read executions from the OLAP database (and read in-progress execution info from Redis).")
+	outputPollInterval    = flag.Duration("remote_execution.live_output_poll_interval", 1*time.Second, "How often to check for new output when streaming the live output of an execution.")
 )
 
 type ExecutionService struct {
@@ -358,6 +360,113 @@ func (es *ExecutionService) WaitExecution(req *espb.WaitExecutionRequest, stream
 	}
 }
 
+// GetExecutionOutput returns the live output that an execution has written to
+// the given stream, starting at the requested chunk. Output is read from a
+// single attempt of the execution: the one in the request, or else the latest
+// one. Once the execution has finished, or the attempt has been superseded by
+// a retry, the response is marked complete. Executors that don't stream live
+// output write no chunks, in which case the output is only available in the
+// ExecuteResponse.
+func (es *ExecutionService) GetExecutionOutput(ctx context.Context, req *espb.GetExecutionOutputRequest) (*espb.GetExecutionOutputResponse, error) {
+	if req.GetExecutionId() == "" {
+		return nil, status.InvalidArgumentError("An execution_id must be provided")
+	}
+	ac := es.env.GetActionCacheClient()
+	attemptID := req.GetAttemptId()
+	if attemptID == "" {
+		latest, err := liveoutput.LatestAttempt(ctx, ac, req.GetExecutionId())
+		if err != nil && !status.IsNotFoundError(err) {
+			return nil, err
+		}
+		attemptID = latest
+	}
+	read := func() ([]byte, int64, bool, error) {
+		if attemptID == "" {
+			return nil, req.GetChunkIndex(), false, nil
+		}
+		return liveoutput.Read(ctx, ac, req.GetExecutionId(), attemptID, req.GetStream(), req.GetChunkIndex())
+	}
+	data, next, final, err := read()
+	if err != nil {
+		return nil, err
+	}
+	if !final && len(data) == 0 {
+		// If the executor went away before writing the final chunk, the
+		// attempt's output will never be completed, so also check whether
+		// the execution has finished or been retried.
+		done, err := es.outputAttemptDone(ctx, req.GetExecutionId(), attemptID)
+		if err != nil {
+			return nil, err
+		}
+		if done {
+			// The executor stops writing output before the execution
+			// finishes, so read once more to get any output written since
+			// the first read.
+			data, next, _, err = read()
+			if err != nil {
+				return nil, err
+			}
+			final = true
+		}
+	}
+	return &espb.GetExecutionOutputResponse{
+		Data:           data,
+		NextChunkIndex: next,
+		Complete:       final,
+		AttemptId:      attemptID,
+	}, nil
+}
+
+// outputAttemptDone returns whether no more output will be written for an
+// attempt of an execution, either because the execution has finished or
+// because a later attempt has started.
+func (es *ExecutionService) outputAttemptDone(ctx context.Context, executionID, attemptID string) (bool, error) {
+	ac := es.env.GetActionCacheClient()
+	_, err := execution.GetCachedExecuteResponse(ctx, ac, executionID)
+	if err == nil {
+		return true, nil
+	}
+	if !status.IsNotFoundError(err) {
+		return false, err
+	}
+	if attemptID == "" {
+		return false, nil
+	}
+	latest, err := liveoutput.LatestAttempt(ctx, ac, executionID)
+	if err != nil {
+		return false, err
+	}
+	return latest != attemptID, nil
+}
+
+// StreamExecutionOutput streams the live output of an execution until it
+// finishes.
+func (es *ExecutionService) StreamExecutionOutput(req *espb.GetExecutionOutputRequest, stream bbspb.BuildBuddyService_StreamExecutionOutputServer) error {
+	ctx := stream.Context()
+	req = req.CloneVT()
+	for {
+		rsp, err := es.GetExecutionOutput(ctx, req)
+		if err != nil {
+			return err
+		}
+		if len(rsp.GetData()) > 0 || rsp.GetComplete() {
+			if err := stream.Send(rsp); err != nil {
+				return status.WrapError(err, "send")
+			}
+		}
+		if rsp.GetComplete() {
+			return nil
+		}
+		req.ChunkIndex = rsp.GetNextChunkIndex()
+		req.AttemptId = rsp.GetAttemptId()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(*outputPollInterval):
+		}
+	}
+}
+
 // WriteExecutionProfile writes the uncompressed JSON execution profile in
 // Google's Trace Event Format.
 func (es *ExecutionService) WriteExecutionProfile(ctx context.Context, w io.Writer, executionID string) error {
@@ -8,17 +8,24 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/redis_execution_collector"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/execution_service"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/liveoutput"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/testredis"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/buildbuddy-io/buildbuddy/server/util/uuid"
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
 	"google.golang.org/protobuf/testing/protocmp"
 
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
@@ -193,3 +200,222 @@ func TestGetExecution_OLAPOnly(t *testing.T) {
 		})
 	}
 }
+
+func setupLiveOutputEnv(t *testing.T) *testenv.TestEnv {
+	flags.Set(t, "executor.live_output.flush_interval", 10*time.Millisecond)
+	flags.Set(t, "remote_execution.live_output_poll_interval", 10*time.Millisecond)
+	te := testenv.GetTestEnv(t)
+	enterprise_testenv.AddClientIdentity(t, te, interfaces.ClientIdentityApp)
+	_, runServer, localGRPClis := testenv.RegisterLocalGRPCServer(t, te)
+	testcache.Setup(t, te, localGRPClis)
+	go runServer()
+	return te
+}
+
+func newLiveOutputExecutionID(t *testing.T) string {
+	d, err := digest.Compute(strings.NewReader(uuid.New()), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+	return digest.NewCASResourceName(d, "test-instance-name", repb.DigestFunction_SHA256).NewUploadString()
+}
+
+// finishExecution caches an ExecuteResponse for the execution, the way the
+// scheduler does once an execution completes.
+func finishExecution(t *testing.T, ctx context.Context, ac repb.ActionCacheClient, executionID string) {
+	rn, err := digest.ParseUploadResourceName(executionID)
+	require.NoError(t, err)
+	d, err := digest.Compute(strings.NewReader(executionID), rn.GetDigestFunction())
+	require.NoError(t, err)
+	b, err := proto.Marshal(&repb.ExecuteResponse{Result: &repb.ActionResult{ExitCode: 0}})
+	require.NoError(t, err)
+	arn := digest.NewACResourceName(d, rn.GetInstanceName(), rn.GetDigestFunction())
+	err = cachetools.UploadActionResult(ctx, ac, arn, &repb.ActionResult{StdoutRaw: b})
+	require.NoError(t, err)
+}
+
+// startLiveOutput starts an attempt of the execution and returns a writer for
+// its stdout, the way an executor does when it runs the execution.
+func startLiveOutput(t *testing.T, ctx context.Context, ac repb.ActionCacheClient, executionID string) (string, *liveoutput.Writer) {
+	attemptID, err := liveoutput.StartAttempt(ctx, ac, executionID)
+	require.NoError(t, err)
+	return attemptID, liveoutput.NewWriter(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT)
+}
+
+// abandon leaves a writer open until the test finishes, simulating an
+// executor that went away without writing the final chunk.
+func abandon(t *testing.T, w *liveoutput.Writer) {
+	t.Cleanup(func() { w.Close() })
+}
+
+func TestGetExecutionOutput(t *testing.T) {
+	te := setupLiveOutputEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	es := execution_service.NewExecutionService(te)
+	executionID := newLiveOutputExecutionID(t)
+	req := &espb.GetExecutionOutputRequest{
+		ExecutionId: executionID,
+		Stream:      espb.OutputStream_STDOUT,
+	}
+
+	// No attempt has started yet.
+	rsp, err := es.GetExecutionOutput(ctx, req)
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(&espb.GetExecutionOutputResponse{}, rsp, protocmp.Transform()))
+
+	attempt1, w1 := startLiveOutput(t, ctx, ac, executionID)
+	abandon(t, w1)
+	_, err = w1.Write([]byte("first"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		rsp, err = es.GetExecutionOutput(ctx, req)
+		return err == nil && len(rsp.GetData()) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(&espb.GetExecutionOutputResponse{
+		Data:           []byte("first"),
+		NextChunkIndex: 1,
+		AttemptId:      attempt1,
+	}, rsp, protocmp.Transform()))
+
+	// The first attempt's executor goes away without finishing its output,
+	// and the execution is retried. Reading the first attempt's output
+	// completes instead of waiting forever.
+	attempt2, w2 := startLiveOutput(t, ctx, ac, executionID)
+	abandon(t, w2)
+	rsp, err = es.GetExecutionOutput(ctx, &espb.GetExecutionOutputRequest{
+		ExecutionId: executionID,
+		Stream:      espb.OutputStream_STDOUT,
+		ChunkIndex:  1,
+		AttemptId:   attempt1,
+	})
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(&espb.GetExecutionOutputResponse{
+		NextChunkIndex: 1,
+		Complete:       true,
+		AttemptId:      attempt1,
+	}, rsp, protocmp.Transform()))
+
+	// New readers read the retry's output.
+	_, err = w2.Write([]byte("second"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		rsp, err = es.GetExecutionOutput(ctx, req)
+		return err == nil && len(rsp.GetData()) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(rsp.GetData()))
+	require.Equal(t, attempt2, rsp.GetAttemptId())
+	require.False(t, rsp.GetComplete())
+
+	// The retry's executor also goes away, but the execution finishes, so
+	// the output is complete.
+	finishExecution(t, ctx, ac, executionID)
+	rsp, err = es.GetExecutionOutput(ctx, &espb.GetExecutionOutputRequest{
+		ExecutionId: executionID,
+		Stream:      espb.OutputStream_STDOUT,
+		ChunkIndex:  rsp.GetNextChunkIndex(),
+		AttemptId:   attempt2,
+	})
+	require.NoError(t, err)
+	require.Empty(t, rsp.GetData())
+	require.True(t, rsp.GetComplete())
+}
+
+func TestGetExecutionOutput_ExecutorWithoutLiveOutput(t *testing.T) {
+	te := setupLiveOutputEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	es := execution_service.NewExecutionService(te)
+	executionID := newLiveOutputExecutionID(t)
+
+	finishExecution(t, ctx, ac, executionID)
+	rsp, err := es.GetExecutionOutput(ctx, &espb.GetExecutionOutputRequest{
+		ExecutionId: executionID,
+		Stream:      espb.OutputStream_STDERR,
+	})
+	require.NoError(t, err)
+	require.Empty(t, cmp.Diff(&espb.GetExecutionOutputResponse{Complete: true}, rsp, protocmp.Transform()))
+}
+
+type fakeOutputStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses []*espb.GetExecutionOutputResponse
+}
+
+func (s *fakeOutputStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeOutputStream) Send(rsp *espb.GetExecutionOutputResponse) error {
+	s.responses = append(s.responses, rsp)
+	return nil
+}
+
+func streamedOutput(responses []*espb.GetExecutionOutputResponse) string {
+	var out []byte
+	for _, rsp := range responses {
+		out = append(out, rsp.GetData()...)
+	}
+	return string(out)
+}
+
+func TestStreamExecutionOutput(t *testing.T) {
+	te := setupLiveOutputEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	es := execution_service.NewExecutionService(te)
+	executionID := newLiveOutputExecutionID(t)
+
+	_, w := startLiveOutput(t, ctx, ac, executionID)
+	go func() {
+		for _, s := range []string{"hello ", "live ", "world"} {
+			_, _ = w.Write([]byte(s))
+			time.Sleep(20 * time.Millisecond)
+		}
+		w.Close()
+	}()
+
+	stream := &fakeOutputStream{ctx: ctx}
+	err := es.StreamExecutionOutput(&espb.GetExecutionOutputRequest{
+		ExecutionId: executionID,
+		Stream:      espb.OutputStream_STDOUT,
+	}, stream)
+	require.NoError(t, err)
+	require.NotEmpty(t, stream.responses)
+	require.True(t, stream.responses[len(stream.responses)-1].GetComplete())
+	require.Equal(t, "hello live world", streamedOutput(stream.responses))
+}
+
+func TestStreamExecutionOutput_ExecutorDisappears(t *testing.T) {
+	te := setupLiveOutputEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	es := execution_service.NewExecutionService(te)
+	executionID := newLiveOutputExecutionID(t)
+
+	// The executor writes some output and then goes away without writing
+	// the final chunk. The execution is then finished by a retry that
+	// doesn't stream live output.
+	attemptID, w := startLiveOutput(t, ctx, ac, executionID)
+	abandon(t, w)
+	_, err := w.Write([]byte("partial"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		data, _, _, err := liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, 0)
+		return err == nil && len(data) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	finishExecution(t, ctx, ac, executionID)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	stream := &fakeOutputStream{ctx: ctx}
+	err = es.StreamExecutionOutput(&espb.GetExecutionOutputRequest{
+		ExecutionId: executionID,
+		Stream:      espb.OutputStream_STDOUT,
+	}, stream)
+	require.NoError(t, err)
+	require.NotEmpty(t, stream.responses)
+	require.True(t, stream.responses[len(stream.responses)-1].GetComplete())
+	require.Equal(t, "partial", streamedOutput(stream.responses))
+}
@@ -506,6 +506,7 @@ type Store interface {
 	BlobReader(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata, offset, limit int64) (io.ReadCloser, error)
 	BlobWriter(ctx context.Context, fileRecord *sgpb.FileRecord) (interfaces.CommittedMetadataWriteCloser, error)
 	DeleteStoredBlob(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata) error
+	BlobExists(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata) (bool, error)
 	UpdateBlobAtime(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata, t time.Time) error
 
 	DeleteStoredFile(ctx context.Context, fileDir string, md *sgpb.StorageMetadata) error
@@ -517,9 +518,54 @@ type PebbleGCSStorage interface {
 	Reader(ctx context.Context, blobName string) (io.ReadCloser, error)
 	ConditionalWriter(ctx context.Context, blobName string, overwriteExisting bool, customTime time.Time) (interfaces.CommittedWriteCloser, error)
 	DeleteBlob(ctx context.Context, blobName string) error
+	BlobExists(ctx context.Context, blobName string) (bool, error)
 	UpdateCustomTime(ctx context.Context, blobName string, t time.Time) error
 }
 
+// blobstoreStorage adapts a generic interfaces.Blobstore (S3, Azure, disk,
+// etc.) to the PebbleGCSStorage interface.
+//
+// These blobstores have no equivalent of GCS custom times or custom time
+// lifecycle rules, so SetBucketCustomTimeTTL and UpdateCustomTime are no-ops.
+// The custom time is instead only tracked in the StorageMetadata stored in
+// pebble, and the cache is responsible for deleting blobs once they expire.
+type blobstoreStorage struct {
+	bs interfaces.Blobstore
+}
+
+func (b *blobstoreStorage) SetBucketCustomTimeTTL(ctx context.Context, ageInDays int64) error {
+	return nil
+}
+
+func (b *blobstoreStorage) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	return b.bs.Reader(ctx, blobName)
+}
+
+func (b *blobstoreStorage) ConditionalWriter(ctx context.Context, blobName string, overwriteExisting bool, customTime time.Time) (interfaces.CommittedWriteCloser, error) {
+	if !overwriteExisting {
+		exists, err := b.bs.BlobExists(ctx, blobName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, status.AlreadyExistsErrorf("blob %q already exists", blobName)
+		}
+	}
+	return b.bs.Writer(ctx, blobName)
+}
+
+func (b *blobstoreStorage) DeleteBlob(ctx context.Context, blobName string) error {
+	return b.bs.DeleteBlob(ctx, blobName)
+}
+
+func (b *blobstoreStorage) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	return b.bs.BlobExists(ctx, blobName)
+}
+
+func (b *blobstoreStorage) UpdateCustomTime(ctx context.Context, blobName string, t time.Time) error {
+	return nil
+}
+
 type Options struct {
 	gcs     PebbleGCSStorage
 	appName string
@@ -535,6 +581,12 @@ func WithGCSBlobstore(gcs PebbleGCSStorage, appName string) Option {
 	}
 }
 
+// WithBlobstore stores blobs in the given blobstore instead of GCS. See
+// blobstoreStorage for how this differs from WithGCSBlobstore.
+func WithBlobstore(bs interfaces.Blobstore, appName string) Option {
+	return WithGCSBlobstore(&blobstoreStorage{bs: bs}, appName)
+}
+
 func WithClock(c clockwork.Clock) Option {
 	return func(o *Options) {
 		o.clock = c
@@ -845,6 +897,13 @@ func (fs *fileStorer) DeleteStoredBlob(ctx context.Context, b *sgpb.StorageMetad
 	return err
 }
 
+func (fs *fileStorer) BlobExists(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata) (bool, error) {
+	if fs.gcs == nil || fs.appName == "" {
+		return false, status.FailedPreconditionError("gcs blobstore or appName not configured")
+	}
+	return fs.gcs.BlobExists(ctx, b.GetBlobName())
+}
+
 func (fs *fileStorer) UpdateBlobAtime(ctx context.Context, b *sgpb.StorageMetadata_GCSMetadata, t time.Time) error {
 	if fs.gcs == nil || fs.appName == "" {
 		return status.FailedPreconditionError("gcs blobstore or appName not configured")
@@ -0,0 +1,320 @@
+// Package flake_detector periodically scores the flakiness of test targets
+// from their recent history in the OLAP DB, and serves the scores along with
+// a list of targets that CI can quarantine.
+package flake_detector
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/redisutil"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/alert"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/jonboulle/clockwork"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+)
+
+var (
+	enabled             = flag.Bool("app.flake_detector.enabled", false, "If true, periodically score the flakiness of test targets from the test target statuses in the OLAP DB.")
+	scoringInterval     = flag.Duration("app.flake_detector.scoring_interval", 1*time.Hour, "How often to recompute flakiness scores.")
+	lookback            = flag.Duration("app.flake_detector.lookback", 7*24*time.Hour, "How far back to look at test target history when computing flakiness scores.")
+	minRuns             = flag.Int64("app.flake_detector.min_runs", 10, "The minimum number of runs a target needs within the lookback window to be scored.")
+	quarantineThreshold = flag.Float64("app.flake_detector.quarantine_threshold", 0.1, "Targets with a flakiness score at or above this threshold are included in the quarantine list.")
+	quarantineTag       = flag.String("app.flake_detector.quarantine_tag", "flaky", "The tag that the quarantine list asks CI to add to quarantined targets.")
+)
+
+const (
+	// Key used to get a lock on scoring, so that only one app computes scores
+	// at a time.
+	redisScoringLockKey = "lock.flake_detector"
+
+	// How long any given app can hold the scoring lock for.
+	redisScoringLockExpiry = 10 * time.Minute
+
+	// The max number of scores returned by GetFlakyTargets.
+	maxScoresPerResponse = 1000
+)
+
+type flakeDetector struct {
+	env   environment.Env
+	clock clockwork.Clock
+
+	// scoringLock serializes scoring across apps. May be nil if Redis is not
+	// configured.
+	scoringLock interfaces.DistributedLock
+	stop        chan struct{}
+}
+
+func Register(env *real_environment.RealEnv) error {
+	if !*enabled {
+		return nil
+	}
+	if env.GetOLAPDBHandle() == nil {
+		return status.FailedPreconditionError("Flake detection requires an OLAP DB.")
+	}
+	var lock interfaces.DistributedLock
+	if rdb := env.GetDefaultRedisClient(); rdb != nil {
+		l, err := redisutil.NewWeakLock(rdb, redisScoringLockKey, redisScoringLockExpiry)
+		if err != nil {
+			return err
+		}
+		lock = l
+	}
+	fd := New(env, env.GetClock(), lock)
+	env.SetFlakeDetectionService(fd)
+	fd.Start()
+	env.GetHealthChecker().RegisterShutdownFunction(func(ctx context.Context) error {
+		fd.Stop()
+		return nil
+	})
+	return nil
+}
+
+func New(env environment.Env, clock clockwork.Clock, scoringLock interfaces.DistributedLock) *flakeDetector {
+	return &flakeDetector{
+		env:         env,
+		clock:       clock,
+		scoringLock: scoringLock,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Start starts a goroutine that periodically recomputes flakiness scores.
+func (fd *flakeDetector) Start() {
+	go func() {
+		ctx := context.Background()
+		ticker := fd.clock.NewTicker(*scoringInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.Chan():
+				if err := fd.ComputeScores(ctx); err != nil {
+					alert.UnexpectedEvent("flake_detector_scoring_failed", "Error computing flakiness scores: %s", err)
+				}
+			case <-fd.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the goroutine started by Start.
+func (fd *flakeDetector) Stop() {
+	close(fd.stop)
+}
+
+// ComputeScores recomputes the flakiness scores of all test targets, unless
+// another app has already done so within the current scoring interval.
+//
+// Public for testing only; the server should call Start to periodically
+// compute scores.
+func (fd *flakeDetector) ComputeScores(ctx context.Context) error {
+	if fd.scoringLock != nil {
+		// This will immediately return ResourceExhausted if another app
+		// already holds the lock. In that case, we ignore the error.
+		err := fd.scoringLock.Lock(ctx)
+		if status.IsResourceExhaustedError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := fd.scoringLock.Unlock(ctx); err != nil {
+				log.Warningf("Failed to unlock distributed lock: %s", err)
+			}
+		}()
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisScoringLockExpiry)
+	defer cancel()
+
+	now := fd.clock.Now()
+	lastComputed, err := fd.lastComputedAt(ctx)
+	if err != nil {
+		return err
+	}
+	if now.Sub(lastComputed) < *scoringInterval/2 {
+		// Another app computed the scores recently.
+		return nil
+	}
+
+	// Scores are computed entirely within the OLAP DB from these signals:
+	// - flaky_runs: runs with a FLAKY status (2), i.e. the test passed when
+	//   Bazel retried it within the invocation.
+	// - likely_flaky_runs: failures (3, 4) immediately preceded and followed
+	//   by passing runs (1, 2).
+	// - passed_after_retry_runs: passing runs whose previous run at the same
+	//   commit failed, i.e. the test passed when CI was retried.
+	// - inconsistent_commits: commits that have both passing and failing
+	//   runs.
+	// Each signal is turned into a rate over the runs (or commits) it was
+	// counted from, and the score is the highest rate.
+	whereClause := `cached = 0 AND invocation_start_time_usec >= ? AND (status BETWEEN 1 AND 4)`
+	startUsec := now.Add(-*lookback).UnixMicro()
+	qStr := `INSERT INTO "TargetFlakinessScores"
+		(group_id, repo_url, label, computed_at_usec, total_runs, total_commits, flaky_runs, likely_flaky_runs, passed_after_retry_runs, inconsistent_commits, score)
+	SELECT runs.group_id, runs.repo_url, runs.label, ?,
+		total_runs, total_commits, flaky_runs, likely_flaky_runs, passed_after_retry_runs, inconsistent_commits,
+		greatest(
+			flaky_runs / total_runs,
+			likely_flaky_runs / total_runs,
+			passed_after_retry_runs / total_runs,
+			inconsistent_commits / total_commits)
+	FROM (
+		SELECT group_id, repo_url, label,
+			count(*) AS total_runs,
+			uniqExact(commit_sha) AS total_commits,
+			countIf(status = 2) AS flaky_runs,
+			countIf((first_status BETWEEN 1 AND 2) AND (last_status BETWEEN 1 AND 2) AND status IN (3, 4)) AS likely_flaky_runs,
+			countIf(status IN (1, 2) AND previous_commit_status IN (3, 4)) AS passed_after_retry_runs
+		FROM (
+			SELECT group_id, repo_url, label, commit_sha, status,
+				first_value(status) OVER win AS first_status,
+				last_value(status) OVER win AS last_status,
+				lagInFrame(status) OVER commit_win AS previous_commit_status
+			FROM "TestTargetStatuses"
+			WHERE ` + whereClause + `
+			WINDOW
+				win AS (
+					PARTITION BY group_id, repo_url, label
+					ORDER BY invocation_start_time_usec ASC
+					ROWS BETWEEN 1 PRECEDING AND 1 FOLLOWING),
+				commit_win AS (
+					PARTITION BY group_id, repo_url, label, commit_sha
+					ORDER BY invocation_start_time_usec ASC
+					ROWS BETWEEN 1 PRECEDING AND CURRENT ROW))
+		GROUP BY group_id, repo_url, label
+		HAVING total_runs >= ?) runs
+	LEFT JOIN (
+		SELECT group_id, repo_url, label, count(*) AS inconsistent_commits
+		FROM (
+			SELECT group_id, repo_url, label, commit_sha
+			FROM "TestTargetStatuses"
+			WHERE ` + whereClause + `
+			GROUP BY group_id, repo_url, label, commit_sha
+			HAVING countIf(status IN (1, 2)) > 0 AND countIf(status IN (3, 4)) > 0)
+		GROUP BY group_id, repo_url, label) commits
+	ON runs.group_id = commits.group_id AND runs.repo_url = commits.repo_url AND runs.label = commits.label`
+	qArgs := []interface{}{now.UnixMicro(), startUsec, *minRuns, startUsec}
+
+	start := time.Now()
+	if err := fd.env.GetOLAPDBHandle().NewQuery(ctx, "flake_detector_compute_scores").Raw(qStr, qArgs...).Exec().Error; err != nil {
+		return status.UnavailableErrorf("failed to compute flakiness scores: %s", err)
+	}
+	log.Infof("Computed flakiness scores in %s", time.Since(start))
+	return nil
+}
+
+func (fd *flakeDetector) lastComputedAt(ctx context.Context) (time.Time, error) {
+	type row struct {
+		ComputedAtUsec int64
+	}
+	qStr := `SELECT max(computed_at_usec) AS computed_at_usec FROM "TargetFlakinessScores"`
+	rq := fd.env.GetOLAPDBHandle().NewQuery(ctx, "flake_detector_last_computed_at").Raw(qStr)
+	r := &row{}
+	if err := rq.Take(r); err != nil && !db.IsRecordNotFound(err) {
+		return time.Time{}, err
+	}
+	return time.UnixMicro(r.ComputedAtUsec), nil
+}
+
+func (fd *flakeDetector) GetFlakyTargets(ctx context.Context, req *trpb.GetFlakyTargetsRequest) (*trpb.GetFlakyTargetsResponse, error) {
+	u, err := fd.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only return scores from recent scoring runs, so that targets which
+	// haven't run within the lookback window age out.
+	staleBeforeUsec := fd.clock.Now().Add(-2 * *scoringInterval).UnixMicro()
+	qStr := `SELECT repo_url, label, computed_at_usec, total_runs, total_commits, flaky_runs, likely_flaky_runs, passed_after_retry_runs, inconsistent_commits, score
+		FROM "TargetFlakinessScores" FINAL
+		WHERE group_id = ? AND computed_at_usec >= ? AND score > 0`
+	qArgs := []interface{}{u.GetGroupID(), staleBeforeUsec}
+	if req.GetRepo() != "" {
+		qStr += ` AND repo_url = ?`
+		qArgs = append(qArgs, req.GetRepo())
+	}
+	if req.GetMinScore() > 0 {
+		qStr += ` AND score >= ?`
+		qArgs = append(qArgs, req.GetMinScore())
+	}
+	qStr += ` ORDER BY score DESC, label ASC LIMIT ?`
+	qArgs = append(qArgs, maxScoresPerResponse)
+
+	rq := fd.env.GetOLAPDBHandle().NewQuery(ctx, "flake_detector_get_scores").Raw(qStr, qArgs...)
+	rsp := &trpb.GetFlakyTargetsResponse{}
+	err = db.ScanEach(rq, func(ctx context.Context, row *schemaRow) error {
+		rsp.Scores = append(rsp.Scores, &trpb.TargetFlakinessScore{
+			Label:                row.Label,
+			Repo:                 row.RepoURL,
+			Score:                row.Score,
+			TotalRuns:            row.TotalRuns,
+			TotalCommits:         row.TotalCommits,
+			FlakyRuns:            row.FlakyRuns,
+			LikelyFlakyRuns:      row.LikelyFlakyRuns,
+			PassedAfterRetryRuns: row.PassedAfterRetryRuns,
+			InconsistentCommits:  row.InconsistentCommits,
+			Quarantined:          row.Score >= *quarantineThreshold,
+			ComputedAt:           timestamppb.New(time.UnixMicro(row.ComputedAtUsec)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if req.GetIncludeQuarantine() {
+		rsp.Quarantine = QuarantineList(rsp.GetScores(), *quarantineTag)
+	}
+	return rsp, nil
+}
+
+type schemaRow struct {
+	RepoURL              string
+	Label                string
+	ComputedAtUsec       int64
+	TotalRuns            int64
+	TotalCommits         int64
+	FlakyRuns            int64
+	LikelyFlakyRuns      int64
+	PassedAfterRetryRuns int64
+	InconsistentCommits  int64
+	Score                float64
+}
+
+// QuarantineList returns the quarantine list for the quarantined targets in
+// the given scores, using the given tag to mark them.
+func QuarantineList(scores []*trpb.TargetFlakinessScore, tag string) *trpb.Quarantine {
+	seen := make(map[string]struct{}, len(scores))
+	labels := make([]string, 0, len(scores))
+	for _, s := range scores {
+		if !s.GetQuarantined() {
+			continue
+		}
+		if _, ok := seen[s.GetLabel()]; ok {
+			continue
+		}
+		seen[s.GetLabel()] = struct{}{}
+		labels = append(labels, s.GetLabel())
+	}
+	sort.Strings(labels)
+	q := &trpb.Quarantine{
+		Labels:         labels,
+		Tag:            tag,
+		TestTagFilters: "--test_tag_filters=-" + tag,
+	}
+	for _, l := range labels {
+		q.BuildozerCommands = append(q.BuildozerCommands, fmt.Sprintf("add tags %s|%s", tag, l))
+	}
+	return q
+}
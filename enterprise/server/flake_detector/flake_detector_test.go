@@ -0,0 +1,195 @@
+package flake_detector_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/flake_detector"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	bespb "github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
+)
+
+const repoURL = "https://github.com/org/repo"
+
+type run struct {
+	label  string
+	commit string
+	status bespb.TestStatus
+	cached bool
+}
+
+// testTargetStatuses returns the statuses for the given runs, in the order
+// that they ran.
+func testTargetStatuses(groupID string, start time.Time, runs []run) []*schema.TestTargetStatus {
+	var statuses []*schema.TestTargetStatus
+	for i, r := range runs {
+		statuses = append(statuses, &schema.TestTargetStatus{
+			GroupID:                 groupID,
+			RepoURL:                 repoURL,
+			CommitSHA:               r.commit,
+			Label:                   r.label,
+			InvocationUUID:          uuid.NewString(),
+			Status:                  int32(r.status),
+			Cached:                  r.cached,
+			Role:                    "CI",
+			Command:                 "test",
+			InvocationStartTimeUsec: start.Add(time.Duration(i) * time.Minute).UnixMicro(),
+		})
+	}
+	return statuses
+}
+
+func TestComputeScores(t *testing.T) {
+	flags.Set(t, "testenv.use_clickhouse", true)
+	flags.Set(t, "app.flake_detector.min_runs", int64(5))
+	flags.Set(t, "app.flake_detector.quarantine_threshold", 0.3)
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1", "US2", "GR2"))
+	te.SetAuthenticator(ta)
+	ctx := context.Background()
+
+	now := time.Now()
+	start := now.Add(-24 * time.Hour)
+	var runs []run
+	// 2 of 10 runs were FLAKY.
+	for i := range 10 {
+		status := bespb.TestStatus_PASSED
+		if i%5 == 0 {
+			status = bespb.TestStatus_FLAKY
+		}
+		runs = append(runs, run{"//a:flaky_test", fmt.Sprintf("a%d", i), status, false})
+	}
+	// CI was retried on 2 of 5 commits and passed. The failure on b2 is also
+	// between two passes.
+	runs = append(runs,
+		run{"//b:retried_test", "b1", bespb.TestStatus_FAILED, false},
+		run{"//b:retried_test", "b1", bespb.TestStatus_PASSED, false},
+		run{"//b:retried_test", "b2", bespb.TestStatus_TIMEOUT, false},
+		run{"//b:retried_test", "b2", bespb.TestStatus_PASSED, false},
+		run{"//b:retried_test", "b3", bespb.TestStatus_PASSED, false},
+		run{"//b:retried_test", "b4", bespb.TestStatus_PASSED, false},
+		run{"//b:retried_test", "b5", bespb.TestStatus_PASSED, false},
+		// Cached runs are not scored.
+		run{"//b:retried_test", "b5", bespb.TestStatus_FAILED, true},
+	)
+	// Stable targets get a zero score and are not returned.
+	for i := range 6 {
+		runs = append(runs, run{"//c:stable_test", fmt.Sprintf("c%d", i), bespb.TestStatus_PASSED, false})
+	}
+	// Targets with too few runs are not scored.
+	runs = append(runs,
+		run{"//d:rare_test", "d1", bespb.TestStatus_FAILED, false},
+		run{"//d:rare_test", "d1", bespb.TestStatus_PASSED, false},
+	)
+	statuses := testTargetStatuses("GR1", start, runs)
+	// Runs in other groups are scored separately.
+	statuses = append(statuses, testTargetStatuses("GR2", start, []run{
+		{"//a:flaky_test", "x", bespb.TestStatus_FLAKY, false},
+		{"//a:flaky_test", "x", bespb.TestStatus_FLAKY, false},
+		{"//a:flaky_test", "x", bespb.TestStatus_FLAKY, false},
+		{"//a:flaky_test", "x", bespb.TestStatus_FLAKY, false},
+		{"//a:flaky_test", "x", bespb.TestStatus_FLAKY, false},
+	})...)
+	// Runs before the lookback window are not scored.
+	statuses = append(statuses, testTargetStatuses("GR1", now.Add(-30*24*time.Hour), []run{
+		{"//c:stable_test", "old", bespb.TestStatus_FAILED, false},
+		{"//c:stable_test", "old", bespb.TestStatus_PASSED, false},
+	})...)
+	err := te.GetOLAPDBHandle().FlushTestTargetStatuses(ctx, statuses)
+	require.NoError(t, err)
+
+	fd := flake_detector.New(te, clockwork.NewFakeClockAt(now), nil /*=scoringLock*/)
+	err = fd.ComputeScores(ctx)
+	require.NoError(t, err)
+
+	userCtx, err := ta.WithAuthenticatedUser(ctx, "US1")
+	require.NoError(t, err)
+	rsp, err := fd.GetFlakyTargets(userCtx, &trpb.GetFlakyTargetsRequest{
+		Repo:              repoURL,
+		IncludeQuarantine: true,
+	})
+	require.NoError(t, err)
+
+	for _, s := range rsp.GetScores() {
+		s.ComputedAt = nil
+	}
+	assert.Empty(t, cmp.Diff([]*trpb.TargetFlakinessScore{
+		{
+			Label:                "//b:retried_test",
+			Repo:                 repoURL,
+			Score:                0.4,
+			TotalRuns:            7,
+			TotalCommits:         5,
+			LikelyFlakyRuns:      1,
+			PassedAfterRetryRuns: 2,
+			InconsistentCommits:  2,
+			Quarantined:          true,
+		},
+		{
+			Label:        "//a:flaky_test",
+			Repo:         repoURL,
+			Score:        0.2,
+			TotalRuns:    10,
+			TotalCommits: 10,
+			FlakyRuns:    2,
+		},
+	}, rsp.GetScores(), protocmp.Transform()))
+	assert.Empty(t, cmp.Diff(&trpb.Quarantine{
+		Labels:            []string{"//b:retried_test"},
+		Tag:               "flaky",
+		BuildozerCommands: []string{"add tags flaky|//b:retried_test"},
+		TestTagFilters:    "--test_tag_filters=-flaky",
+	}, rsp.GetQuarantine(), protocmp.Transform()))
+
+	// Scores aren't recomputed until half of the scoring interval has passed.
+	err = te.GetOLAPDBHandle().FlushTestTargetStatuses(ctx, testTargetStatuses("GR1", now.Add(-time.Minute), []run{
+		{"//c:stable_test", "c0", bespb.TestStatus_FAILED, false},
+	}))
+	require.NoError(t, err)
+	err = fd.ComputeScores(ctx)
+	require.NoError(t, err)
+	rsp, err = fd.GetFlakyTargets(userCtx, &trpb.GetFlakyTargetsRequest{Repo: repoURL, MinScore: 0.1})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetScores(), 2)
+	assert.Nil(t, rsp.GetQuarantine())
+}
+
+func TestQuarantineList(t *testing.T) {
+	scores := []*trpb.TargetFlakinessScore{
+		{Label: "//b:b_test", Repo: "https://github.com/org/repo1", Score: 0.5, Quarantined: true},
+		{Label: "//a:a_test", Repo: "https://github.com/org/repo1", Score: 0.3, Quarantined: true},
+		// The same label in another repo should only be listed once.
+		{Label: "//a:a_test", Repo: "https://github.com/org/repo2", Score: 0.2, Quarantined: true},
+		{Label: "//c:c_test", Repo: "https://github.com/org/repo1", Score: 0.01, Quarantined: false},
+	}
+
+	q := flake_detector.QuarantineList(scores, "quarantined")
+
+	assert.Equal(t, []string{"//a:a_test", "//b:b_test"}, q.GetLabels())
+	assert.Equal(t, "quarantined", q.GetTag())
+	assert.Equal(t, []string{
+		"add tags quarantined|//a:a_test",
+		"add tags quarantined|//b:b_test",
+	}, q.GetBuildozerCommands())
+	assert.Equal(t, "--test_tag_filters=-quarantined", q.GetTestTagFilters())
+}
+
+func TestQuarantineList_Empty(t *testing.T) {
+	q := flake_detector.QuarantineList(nil, "flaky")
+
+	assert.Empty(t, q.GetLabels())
+	assert.Empty(t, q.GetBuildozerCommands())
+}
@@ -0,0 +1,221 @@
+package ociregistry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ocicache"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcr "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	headerLink              = "Link"
+	headerOCIFiltersApplied = "OCI-Filters-Applied"
+
+	catalogPath         = "/v2/_catalog"
+	imageIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+	errorCodeNameUnknown             = "NAME_UNKNOWN"
+	errorCodePaginationNumberInvalid = "PAGINATION_NUMBER_INVALID"
+)
+
+var (
+	tagsListReqRegexp  = regexp.MustCompile("^/v2/(.+?)/tags/list$")
+	referrersReqRegexp = regexp.MustCompile("^/v2/(.+?)/referrers/([^/]+)$")
+)
+
+// handleListingRequest serves the listing endpoints of the OCI Distribution
+// Spec from the registry's indexes of cached and pushed content:
+//
+//   - GET /v2/_catalog
+//   - GET /v2/<name>/tags/list
+//   - GET /v2/<name>/referrers/<digest>
+//
+// Returns false if the request is not a listing request.
+func (r *registry) handleListingRequest(ctx context.Context, w http.ResponseWriter, req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	if req.URL.Path == catalogPath {
+		r.handleCatalogRequest(ctx, w, req)
+		return true
+	}
+	if m := tagsListReqRegexp.FindStringSubmatch(req.URL.Path); len(m) == 2 {
+		r.handleTagsListRequest(ctx, w, req, m[1])
+		return true
+	}
+	if m := referrersReqRegexp.FindStringSubmatch(req.URL.Path); len(m) == 3 {
+		r.handleReferrersRequest(ctx, w, req, m[1], m[2])
+		return true
+	}
+	return false
+}
+
+// parsePagination parses the `n` and `last` query parameters. n is -1 if the
+// client did not ask for a limit.
+func parsePagination(query url.Values) (int, string, error) {
+	n := -1
+	if v := query.Get("n"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed < 0 {
+			return 0, "", status.InvalidArgumentErrorf("invalid page size %q", v)
+		}
+		n = parsed
+	}
+	return n, query.Get("last"), nil
+}
+
+// paginate returns the names in the sorted list that come after last, limited
+// to n names if n is not negative, and whether any names follow the returned
+// page.
+func paginate(names []string, n int, last string) ([]string, bool) {
+	start := 0
+	if last != "" {
+		start = sort.Search(len(names), func(i int) bool { return names[i] > last })
+	}
+	page := names[start:]
+	if n >= 0 && len(page) > n {
+		return page[:n], true
+	}
+	return page, false
+}
+
+// writeNextLink adds an RFC 5988 Link header pointing at the next page.
+func writeNextLink(w http.ResponseWriter, path string, n int, last string) {
+	q := url.Values{}
+	q.Set("n", strconv.Itoa(n))
+	q.Set("last", last)
+	w.Header().Set(headerLink, fmt.Sprintf(`<%s?%s>; rel="next"`, path, q.Encode()))
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, contentType string, body any) {
+	w.Header().Set(headerContentType, contentType)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.CtxWarningf(ctx, "Error writing response body: %s", err)
+	}
+}
+
+func (r *registry) handleCatalogRequest(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	n, last, err := parsePagination(req.URL.Query())
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodePaginationNumberInvalid, status.Message(err))
+		return
+	}
+	repositories, err := ocicache.FetchCatalog(ctx, r.env.GetActionCacheClient())
+	if err != nil {
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeNameUnknown, fmt.Sprintf("could not fetch catalog: %s", err))
+		return
+	}
+	page, more := paginate(repositories, n, last)
+	if more {
+		writeNextLink(w, catalogPath, n, page[len(page)-1])
+	}
+	if page == nil {
+		page = []string{}
+	}
+	writeJSON(ctx, w, "application/json", map[string][]string{"repositories": page})
+}
+
+func (r *registry) handleTagsListRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, name string) {
+	repo, err := gcrname.NewRepository(name)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeNameInvalid, fmt.Sprintf("invalid repository name %q: %s", name, err))
+		return
+	}
+	n, last, err := parsePagination(req.URL.Query())
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodePaginationNumberInvalid, status.Message(err))
+		return
+	}
+	tags, err := ocicache.FetchTags(ctx, r.env.GetActionCacheClient(), repo)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			writeRegistryError(w, http.StatusNotFound, errorCodeNameUnknown, fmt.Sprintf("repository %q not known to registry", name))
+			return
+		}
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeNameUnknown, fmt.Sprintf("could not fetch tags for %q: %s", name, err))
+		return
+	}
+	page, more := paginate(tags, n, last)
+	if more {
+		writeNextLink(w, "/v2/"+name+"/tags/list", n, page[len(page)-1])
+	}
+	if page == nil {
+		page = []string{}
+	}
+	writeJSON(ctx, w, "application/json", struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{
+		Name: name,
+		Tags: page,
+	})
+}
+
+type descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type imageIndex struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []descriptor `json:"manifests"`
+}
+
+func (r *registry) handleReferrersRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, name, subject string) {
+	repo, err := gcrname.NewRepository(name)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeNameInvalid, fmt.Sprintf("invalid repository name %q: %s", name, err))
+		return
+	}
+	hash, err := gcr.NewHash(subject)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeDigestInvalid, fmt.Sprintf("invalid digest %q: %s", subject, err))
+		return
+	}
+	referrers, err := ocicache.FetchReferrers(ctx, r.env.GetActionCacheClient(), repo, hash)
+	if err != nil {
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeManifestInvalid, fmt.Sprintf("could not fetch referrers for %s: %s", hash, err))
+		return
+	}
+
+	artifactType := req.URL.Query().Get("artifactType")
+	if artifactType != "" {
+		w.Header().Set(headerOCIFiltersApplied, "artifactType")
+	}
+	// The spec requires an empty index, rather than an error, for manifests
+	// without referrers.
+	index := imageIndex{
+		SchemaVersion: 2,
+		MediaType:     imageIndexMediaType,
+		Manifests:     []descriptor{},
+	}
+	for _, d := range referrers {
+		if artifactType != "" && d.GetArtifactType() != artifactType {
+			continue
+		}
+		index.Manifests = append(index.Manifests, descriptor{
+			MediaType:    d.GetMediaType(),
+			Digest:       d.GetDigest(),
+			Size:         d.GetSize(),
+			ArtifactType: d.GetArtifactType(),
+			Annotations:  d.GetAnnotations(),
+		})
+	}
+	writeJSON(ctx, w, imageIndexMediaType, index)
+}
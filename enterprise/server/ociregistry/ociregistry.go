@@ -80,15 +80,33 @@ func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 // handleRegistryRequest implements just enough of the [OCI Distribution Spec](https://github.com/opencontainers/distribution-spec/blob/main/spec.md)
 // to allow clients to pull OCI images from remote registries that do not require authentication.
 // This registry does not support resumable pulls via the Range header.
+//
+// If pushing is enabled, the registry also accepts image pushes from clients
+// authenticated with a BuildBuddy API key (see handlePushRequest). Pushed
+// manifests, tags, and blobs are stored in the cache of the authenticated
+// group.
 func (r *registry) handleRegistryRequest(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
+	authenticated := false
+	if *enablePush {
+		ctx, authenticated = r.authenticate(ctx, req)
+		if authenticated {
+			// The credentials are for BuildBuddy, not for the upstream
+			// registry, so don't forward them.
+			req.Header.Del(headerAuthorization)
+		}
+	}
 	ctx, err := prefix.AttachUserPrefixToContext(ctx, r.env.GetAuthenticator())
 	if err != nil {
 		http.Error(w, fmt.Sprintf("could not attach user prefix: %s", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Only GET and HEAD requests for blobs and manifests are supported.
+	if *enablePush && r.handlePushRequest(ctx, w, req, authenticated) {
+		return
+	}
+
+	// Otherwise, only GET and HEAD requests for blobs and manifests are supported.
 	if req.Method != http.MethodGet && req.Method != http.MethodHead {
 		http.Error(w, fmt.Sprintf("unsupported HTTP method %s", req.Method), http.StatusNotFound)
 		return
@@ -102,10 +120,25 @@ func (r *registry) handleRegistryRequest(w http.ResponseWriter, req *http.Reques
 	// receive HTTP 401 and a `WWW-Authenticate` header. The client will then authenticate
 	// and pass Authorization headers with subsequent requests.
 	if req.RequestURI == "/v2/" {
+		if *enablePush {
+			// Clients only send credentials after being challenged, so
+			// ask for BuildBuddy credentials rather than passing along the
+			// upstream registry's challenge.
+			if !authenticated {
+				writeAuthChallenge(w)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		r.handleV2Request(ctx, w, req)
 		return
 	}
 
+	if r.handleListingRequest(ctx, w, req) {
+		return
+	}
+
 	if m := blobsOrManifestsReqRegexp.FindStringSubmatch(req.RequestURI); len(m) == 4 {
 		// The image repository name, which can include a registry host and optional port.
 		// For example, "alpine" is a repository name. By default, the registry portion is index.docker.io.
@@ -249,7 +282,22 @@ func (r *registry) handleBlobsOrManifestsRequest(ctx context.Context, w http.Res
 
 	resolvedRef := ref
 	resolvedRefIsDigest := identifierIsDigest
-	if ociResourceType == ocipb.OCIResourceType_MANIFEST && !identifierIsDigest && inreq.Method == http.MethodGet {
+	if *enablePush && ociResourceType == ocipb.OCIResourceType_MANIFEST && !identifierIsDigest {
+		// Tags pushed to this registry take precedence over upstream tags.
+		hash, err := ocicache.FetchTag(ctx, r.env.GetActionCacheClient(), ref.Context(), identifier)
+		if err == nil {
+			manifestRef, err := parseReference(repository, hash.String())
+			if err != nil {
+				log.CtxErrorf(ctx, "Could not parse manifest reference for %q: %s", repository, err)
+			} else {
+				resolvedRef = manifestRef
+				resolvedRefIsDigest = true
+			}
+		} else if !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Could not look up pushed tag %q for %q: %s", identifier, ref.Context(), err)
+		}
+	}
+	if ociResourceType == ocipb.OCIResourceType_MANIFEST && !resolvedRefIsDigest && inreq.Method == http.MethodGet {
 		// Fetching a manifest by tag.
 		// Since the mapping from tag to digest can change, we only look up manifests and blobs in the CAS by digest.
 		// Docker Hub does not count "version checks" (HEAD requests) against the rate limit.
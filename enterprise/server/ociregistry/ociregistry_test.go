@@ -1,11 +1,14 @@
 package ociregistry_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -14,13 +17,21 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/clientidentity"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/ociregistry"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testport"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testregistry"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
 	"github.com/stretchr/testify/require"
+
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcr "github.com/google/go-containerregistry/pkg/v1"
 )
 
 type simplePullTestCase struct {
@@ -383,3 +394,363 @@ func TestPull(t *testing.T) {
 		})
 	}
 }
+
+func runPushRegistry(t *testing.T) (*testenv.TestEnv, string) {
+	te := testenv.GetTestEnv(t)
+	te.SetAuthenticator(testauth.NewTestAuthenticator(testauth.TestUsers("US1", "GR1")))
+	flags.Set(t, "ociregistry.push.enabled", true)
+	flags.Set(t, "app.client_identity.client", interfaces.ClientIdentityApp)
+	key, err := random.RandomString(16)
+	require.NoError(t, err)
+	flags.Set(t, "app.client_identity.key", string(key))
+	err = clientidentity.Register(te)
+	require.NoError(t, err)
+
+	_, runServer, localGRPClis := testenv.RegisterLocalGRPCServer(t, te)
+	testcache.Setup(t, te, localGRPClis)
+	go runServer()
+
+	ocireg, err := ociregistry.New(te)
+	require.NoError(t, err)
+	server := httptest.NewServer(ocireg)
+	t.Cleanup(server.Close)
+	return te, strings.TrimPrefix(server.URL, "http://")
+}
+
+func doPushRequest(t *testing.T, method, url string, body []byte, headers map[string]string) *http.Response {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+	req.SetBasicAuth("buildbuddy", "US1")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { rsp.Body.Close() })
+	return rsp
+}
+
+func TestPush(t *testing.T) {
+	_, host := runPushRegistry(t)
+	auth := remote.WithAuth(&authn.Basic{Username: "buildbuddy", Password: "US1"})
+
+	ref, err := gcrname.ParseReference(host+"/pushed/image:v1", gcrname.Insecure)
+	require.NoError(t, err)
+	image, err := crane.Image(map[string][]byte{"/tmp/hello": []byte("hello")})
+	require.NoError(t, err)
+
+	// Pushing requires credentials.
+	err = remote.Write(ref, image)
+	require.Error(t, err)
+
+	err = remote.Write(ref, image, auth)
+	require.NoError(t, err)
+
+	pulled, err := remote.Image(ref, auth)
+	require.NoError(t, err)
+	require.NoError(t, validate.Image(pulled))
+	expectedDigest, err := image.Digest()
+	require.NoError(t, err)
+	pulledDigest, err := pulled.Digest()
+	require.NoError(t, err)
+	require.Equal(t, expectedDigest, pulledDigest)
+
+	// Pushing another image to the same tag moves the tag.
+	image2, err := crane.Image(map[string][]byte{"/tmp/hello": []byte("hello again")})
+	require.NoError(t, err)
+	err = remote.Write(ref, image2, auth)
+	require.NoError(t, err)
+	pulled, err = remote.Image(ref, auth)
+	require.NoError(t, err)
+	expectedDigest, err = image2.Digest()
+	require.NoError(t, err)
+	pulledDigest, err = pulled.Digest()
+	require.NoError(t, err)
+	require.Equal(t, expectedDigest, pulledDigest)
+
+	// Manifests can't refer to blobs that weren't pushed.
+	manifest, err := image.RawManifest()
+	require.NoError(t, err)
+	mediaType, err := image.MediaType()
+	require.NoError(t, err)
+	rsp := doPushRequest(t, http.MethodPut, "http://"+host+"/v2/other/image/manifests/v1", manifest, map[string]string{
+		"Content-Type": string(mediaType),
+	})
+	require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
+
+func TestPush_CrossRepositoryMount(t *testing.T) {
+	_, host := runPushRegistry(t)
+	auth := remote.WithAuth(&authn.Basic{Username: "buildbuddy", Password: "US1"})
+
+	ref, err := gcrname.ParseReference(host+"/source/image:v1", gcrname.Insecure)
+	require.NoError(t, err)
+	image, err := crane.Image(map[string][]byte{"/tmp/hello": []byte("hello")})
+	require.NoError(t, err)
+	err = remote.Write(ref, image, auth)
+	require.NoError(t, err)
+	layers, err := image.Layers()
+	require.NoError(t, err)
+	layerDigest, err := layers[0].Digest()
+	require.NoError(t, err)
+
+	rsp := doPushRequest(t, http.MethodPost, "http://"+host+"/v2/dest/image/blobs/uploads/?mount="+layerDigest.String()+"&from=source/image", nil, nil)
+	require.Equal(t, http.StatusCreated, rsp.StatusCode)
+	require.Equal(t, layerDigest.String(), rsp.Header.Get("Docker-Content-Digest"))
+
+	rsp = doPushRequest(t, http.MethodHead, "http://"+host+"/v2/dest/image/blobs/"+layerDigest.String(), nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	// Mounting from a repository that doesn't have the blob starts a
+	// regular upload instead.
+	rsp = doPushRequest(t, http.MethodPost, "http://"+host+"/v2/dest/image/blobs/uploads/?mount="+layerDigest.String()+"&from=unknown/image", nil, nil)
+	require.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	require.NotEmpty(t, rsp.Header.Get("Location"))
+}
+
+func TestPush_ChunkedUpload(t *testing.T) {
+	_, host := runPushRegistry(t)
+	content := []byte("some blob content that is uploaded in chunks")
+	hash, _, err := gcr.SHA256(bytes.NewReader(content))
+	require.NoError(t, err)
+
+	rsp := doPushRequest(t, http.MethodPost, "http://"+host+"/v2/chunked/blobs/uploads/", nil, nil)
+	require.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	location := rsp.Header.Get("Location")
+	require.NotEmpty(t, location)
+
+	rsp = doPushRequest(t, http.MethodPatch, "http://"+host+location, content[:10], map[string]string{
+		"Content-Range": "0-9",
+	})
+	require.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	require.Equal(t, "0-9", rsp.Header.Get("Range"))
+
+	// Out of order chunks are rejected.
+	rsp = doPushRequest(t, http.MethodPatch, "http://"+host+location, content[20:], map[string]string{
+		"Content-Range": fmt.Sprintf("20-%d", len(content)-1),
+	})
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, rsp.StatusCode)
+
+	rsp = doPushRequest(t, http.MethodPatch, "http://"+host+location, content[10:20], map[string]string{
+		"Content-Range": "10-19",
+	})
+	require.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+location, nil, nil)
+	require.Equal(t, http.StatusNoContent, rsp.StatusCode)
+	require.Equal(t, "0-19", rsp.Header.Get("Range"))
+
+	// The final chunk can be sent with the PUT, and the digest must match.
+	wrongHash, _, err := gcr.SHA256(strings.NewReader("wrong"))
+	require.NoError(t, err)
+	rsp = doPushRequest(t, http.MethodPut, "http://"+host+location+"?digest="+wrongHash.String(), nil, nil)
+	require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+
+	rsp = doPushRequest(t, http.MethodPut, "http://"+host+location+"?digest="+hash.String(), content[20:], nil)
+	require.Equal(t, http.StatusCreated, rsp.StatusCode)
+	require.Equal(t, hash.String(), rsp.Header.Get("Docker-Content-Digest"))
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/chunked/blobs/"+hash.String(), nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.Equal(t, content, body)
+}
+
+func TestTagsList(t *testing.T) {
+	_, host := runPushRegistry(t)
+	auth := remote.WithAuth(&authn.Basic{Username: "buildbuddy", Password: "US1"})
+
+	image, err := crane.Image(map[string][]byte{"/tmp/hello": []byte("hello")})
+	require.NoError(t, err)
+	for _, tag := range []string{"v2", "v1", "latest"} {
+		ref, err := gcrname.ParseReference(host+"/listed/image:"+tag, gcrname.Insecure)
+		require.NoError(t, err)
+		err = remote.Write(ref, image, auth)
+		require.NoError(t, err)
+	}
+
+	type tagsList struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	rsp := doPushRequest(t, http.MethodGet, "http://"+host+"/v2/listed/image/tags/list", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	list := tagsList{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&list))
+	require.Equal(t, tagsList{Name: "listed/image", Tags: []string{"latest", "v1", "v2"}}, list)
+	require.Empty(t, rsp.Header.Get("Link"))
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/listed/image/tags/list?n=2", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	list = tagsList{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&list))
+	require.Equal(t, []string{"latest", "v1"}, list.Tags)
+	require.Equal(t, `</v2/listed/image/tags/list?last=v1&n=2>; rel="next"`, rsp.Header.Get("Link"))
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/listed/image/tags/list?n=2&last=v1", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	list = tagsList{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(&list))
+	require.Equal(t, []string{"v2"}, list.Tags)
+	require.Empty(t, rsp.Header.Get("Link"))
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/listed/image/tags/list?n=-1", nil, nil)
+	require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/unknown/image/tags/list", nil, nil)
+	require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	// Tags are scoped to the group that pushed them.
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+"/v2/listed/image/tags/list", nil)
+	require.NoError(t, err)
+	rsp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+}
+
+func TestTagsList_MirroredTag(t *testing.T) {
+	te := testenv.GetTestEnv(t)
+	flags.Set(t, "app.client_identity.client", interfaces.ClientIdentityApp)
+	key, err := random.RandomString(16)
+	require.NoError(t, err)
+	flags.Set(t, "app.client_identity.key", string(key))
+	err = clientidentity.Register(te)
+	require.NoError(t, err)
+
+	_, runServer, localGRPClis := testenv.RegisterLocalGRPCServer(t, te)
+	testcache.Setup(t, te, localGRPClis)
+	go runServer()
+
+	testreg := testregistry.Run(t, testregistry.Opts{})
+	t.Cleanup(func() {
+		err := testreg.Shutdown(context.TODO())
+		require.NoError(t, err)
+	})
+	imageName, _ := testreg.PushNamedImage(t, "mirrored_image")
+
+	ocireg, err := ociregistry.New(te)
+	require.NoError(t, err)
+	server := httptest.NewServer(ocireg)
+	t.Cleanup(server.Close)
+
+	rsp, err := http.Get(server.URL + "/v2/" + imageName + "/tags/list")
+	require.NoError(t, err)
+	rsp.Body.Close()
+	require.Equal(t, http.StatusNotFound, rsp.StatusCode)
+
+	rsp, err = http.Get(server.URL + "/v2/" + imageName + "/manifests/latest")
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, rsp.Body)
+	require.NoError(t, err)
+	rsp.Body.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	rsp, err = http.Get(server.URL + "/v2/" + imageName + "/tags/list")
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`{"name": %q, "tags": ["latest"]}`, imageName), string(body))
+}
+
+func TestCatalog(t *testing.T) {
+	_, host := runPushRegistry(t)
+	auth := remote.WithAuth(&authn.Basic{Username: "buildbuddy", Password: "US1"})
+
+	rsp := doPushRequest(t, http.MethodGet, "http://"+host+"/v2/_catalog", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"repositories": []}`, string(body))
+
+	image, err := crane.Image(map[string][]byte{"/tmp/hello": []byte("hello")})
+	require.NoError(t, err)
+	for _, repo := range []string{"b/image", "a/image", "c/image"} {
+		ref, err := gcrname.ParseReference(host+"/"+repo+":v1", gcrname.Insecure)
+		require.NoError(t, err)
+		err = remote.Write(ref, image, auth)
+		require.NoError(t, err)
+	}
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/_catalog?n=2", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err = io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"repositories": ["a/image", "b/image"]}`, string(body))
+	require.Equal(t, `</v2/_catalog?last=b%2Fimage&n=2>; rel="next"`, rsp.Header.Get("Link"))
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/_catalog?n=2&last=b%2Fimage", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err = io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"repositories": ["c/image"]}`, string(body))
+}
+
+func TestReferrers(t *testing.T) {
+	_, host := runPushRegistry(t)
+	auth := remote.WithAuth(&authn.Basic{Username: "buildbuddy", Password: "US1"})
+
+	ref, err := gcrname.ParseReference(host+"/referred/image:v1", gcrname.Insecure)
+	require.NoError(t, err)
+	image, err := crane.Image(map[string][]byte{"/tmp/hello": []byte("hello")})
+	require.NoError(t, err)
+	err = remote.Write(ref, image, auth)
+	require.NoError(t, err)
+	subjectDigest, err := image.Digest()
+	require.NoError(t, err)
+	subjectSize, err := image.Size()
+	require.NoError(t, err)
+	mediaType, err := image.MediaType()
+	require.NoError(t, err)
+
+	referrersURL := "http://" + host + "/v2/referred/image/referrers/" + subjectDigest.String()
+	rsp := doPushRequest(t, http.MethodGet, referrersURL, nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"schemaVersion": 2, "mediaType": "application/vnd.oci.image.index.v1+json", "manifests": []}`, string(body))
+
+	// Push a manifest that refers to the image, reusing the image's blobs.
+	manifest, err := image.Manifest()
+	require.NoError(t, err)
+	referrer := manifest.DeepCopy()
+	referrer.Subject = &gcr.Descriptor{
+		MediaType: mediaType,
+		Digest:    subjectDigest,
+		Size:      subjectSize,
+	}
+	referrer.Annotations = map[string]string{"org.example.kind": "signature"}
+	rawReferrer, err := json.Marshal(referrer)
+	require.NoError(t, err)
+	referrerDigest, _, err := gcr.SHA256(bytes.NewReader(rawReferrer))
+	require.NoError(t, err)
+	rsp = doPushRequest(t, http.MethodPut, "http://"+host+"/v2/referred/image/manifests/"+referrerDigest.String(), rawReferrer, map[string]string{
+		"Content-Type": string(mediaType),
+	})
+	require.Equal(t, http.StatusCreated, rsp.StatusCode)
+
+	rsp = doPushRequest(t, http.MethodGet, referrersURL, nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, "application/vnd.oci.image.index.v1+json", rsp.Header.Get("Content-Type"))
+	index := &gcr.IndexManifest{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(index))
+	require.Len(t, index.Manifests, 1)
+	require.Equal(t, referrerDigest, index.Manifests[0].Digest)
+	require.Equal(t, int64(len(rawReferrer)), index.Manifests[0].Size)
+	require.Equal(t, string(manifest.Config.MediaType), index.Manifests[0].ArtifactType)
+	require.Equal(t, "signature", index.Manifests[0].Annotations["org.example.kind"])
+
+	// Filtering by artifact type.
+	rsp = doPushRequest(t, http.MethodGet, referrersURL+"?artifactType=application/vnd.example.sbom", nil, nil)
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	require.Equal(t, "artifactType", rsp.Header.Get("OCI-Filters-Applied"))
+	index = &gcr.IndexManifest{}
+	require.NoError(t, json.NewDecoder(rsp.Body).Decode(index))
+	require.Empty(t, index.Manifests)
+
+	rsp = doPushRequest(t, http.MethodGet, "http://"+host+"/v2/referred/image/referrers/sha256:bad", nil, nil)
+	require.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
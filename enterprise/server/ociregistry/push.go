@@ -0,0 +1,488 @@
+package ociregistry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/ocicache"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/google/uuid"
+
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	ocipb "github.com/buildbuddy-io/buildbuddy/proto/ociregistry"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcr "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	headerLocation          = "Location"
+	headerDockerUploadUUID  = "Docker-Upload-UUID"
+	headerContentRange      = "Content-Range"
+	headerOCIChunkMinLength = "OCI-Chunk-Min-Length"
+
+	// Content type recorded for pushed blobs. Registries serve all blobs as
+	// opaque bytes; the media type lives in the manifest.
+	pushedBlobContentType = "application/octet-stream"
+
+	// Upload request bodies are stored in the CAS in pieces of at most this
+	// size, so that a single large PATCH doesn't need to be buffered in
+	// memory.
+	uploadChunkSizeBytes = 8 * 1024 * 1024
+
+	// Error codes from the OCI Distribution Spec.
+	errorCodeBlobUploadInvalid   = "BLOB_UPLOAD_INVALID"
+	errorCodeBlobUploadUnknown   = "BLOB_UPLOAD_UNKNOWN"
+	errorCodeDigestInvalid       = "DIGEST_INVALID"
+	errorCodeManifestBlobUnknown = "MANIFEST_BLOB_UNKNOWN"
+	errorCodeManifestInvalid     = "MANIFEST_INVALID"
+	errorCodeNameInvalid         = "NAME_INVALID"
+	errorCodeUnauthorized        = "UNAUTHORIZED"
+	errorCodeDenied              = "DENIED"
+	errorCodeUnsupported         = "UNSUPPORTED"
+)
+
+var (
+	enablePush = flag.Bool("ociregistry.push.enabled", false, "If true, allow authenticated clients to push images to the registry. Pushed images are stored in the cache of the pushing group. Requires ociregistry.enabled.")
+
+	uploadsReqRegexp   = regexp.MustCompile("^/v2/(.+?)/blobs/uploads/([^/]*)$")
+	manifestsReqRegexp = regexp.MustCompile("^/v2/(.+?)/manifests/([^/]+)$")
+	contentRangeRegexp = regexp.MustCompile("^(?:bytes )?([0-9]+)-([0-9]+)$")
+)
+
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeRegistryError writes an error response in the format described by the
+// OCI Distribution Spec, which clients such as `docker push` display to the
+// user.
+func writeRegistryError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set(headerContentType, "application/json")
+	w.WriteHeader(statusCode)
+	body := map[string][]registryError{
+		"errors": {{Code: code, Message: message}},
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// authenticate returns a context authenticated with the BuildBuddy API key
+// in the request, and whether authentication succeeded. `docker login` and
+// `crane auth login` send the API key as the basic auth password; the
+// username is ignored.
+func (r *registry) authenticate(ctx context.Context, req *http.Request) (context.Context, bool) {
+	apiKey := req.Header.Get(authutil.APIKeyHeader)
+	if apiKey == "" {
+		if _, password, ok := req.BasicAuth(); ok {
+			apiKey = password
+		}
+	}
+	if apiKey == "" {
+		return ctx, false
+	}
+	authCtx := r.env.GetAuthenticator().AuthContextFromAPIKey(ctx, apiKey)
+	if _, err := r.env.GetAuthenticator().AuthenticatedUser(authCtx); err != nil {
+		return ctx, false
+	}
+	return authCtx, true
+}
+
+func writeAuthChallenge(w http.ResponseWriter) {
+	w.Header().Set(headerWWWAuthenticate, `Basic realm="BuildBuddy"`)
+	writeRegistryError(w, http.StatusUnauthorized, errorCodeUnauthorized, "authentication required, log in with a BuildBuddy API key as the password")
+}
+
+// checkCanPush writes an error response and returns false if the request is
+// not allowed to push to the registry.
+func (r *registry) checkCanPush(ctx context.Context, w http.ResponseWriter, authenticated bool) bool {
+	if !authenticated {
+		writeAuthChallenge(w)
+		return false
+	}
+	canWrite, err := capabilities.IsGranted(ctx, r.env.GetAuthenticator(), cappb.Capability_CACHE_WRITE)
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, errorCodeDenied, fmt.Sprintf("could not check permissions: %s", err))
+		return false
+	}
+	if !canWrite {
+		writeRegistryError(w, http.StatusForbidden, errorCodeDenied, "pushing images requires cache write permissions")
+		return false
+	}
+	return true
+}
+
+// handlePushRequest serves the parts of the OCI Distribution Spec needed to
+// push images:
+//
+//   - POST  /v2/<name>/blobs/uploads/ (including monolithic uploads and cross-repository mounts)
+//   - PATCH /v2/<name>/blobs/uploads/<uuid>
+//   - PUT   /v2/<name>/blobs/uploads/<uuid>?digest=<digest>
+//   - GET   /v2/<name>/blobs/uploads/<uuid>
+//   - PUT   /v2/<name>/manifests/<reference>
+//
+// Returns false if the request is not a push request.
+func (r *registry) handlePushRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, authenticated bool) bool {
+	if m := uploadsReqRegexp.FindStringSubmatch(req.URL.Path); len(m) == 3 {
+		if !r.checkCanPush(ctx, w, authenticated) {
+			return true
+		}
+		repo, err := gcrname.NewRepository(m[1])
+		if err != nil {
+			writeRegistryError(w, http.StatusBadRequest, errorCodeNameInvalid, fmt.Sprintf("invalid repository name %q: %s", m[1], err))
+			return true
+		}
+		r.handleUploadRequest(ctx, w, req, m[1], repo, m[2])
+		return true
+	}
+	if m := manifestsReqRegexp.FindStringSubmatch(req.URL.Path); len(m) == 3 && req.Method == http.MethodPut {
+		if !r.checkCanPush(ctx, w, authenticated) {
+			return true
+		}
+		r.handleManifestPut(ctx, w, req, m[1], m[2])
+		return true
+	}
+	return false
+}
+
+func uploadLocation(name, uploadID string) string {
+	return "/v2/" + name + "/blobs/uploads/" + uploadID
+}
+
+func blobLocation(name string, hash gcr.Hash) string {
+	return "/v2/" + name + "/blobs/" + hash.String()
+}
+
+func writeUploadProgress(w http.ResponseWriter, statusCode int, name, uploadID string, session *ocipb.OCIUploadSession) {
+	w.Header().Set(headerLocation, uploadLocation(name, uploadID))
+	w.Header().Set(headerDockerUploadUUID, uploadID)
+	// The Range header is inclusive, so an empty upload is "0-0".
+	end := session.GetSizeBytes() - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set(headerRange, fmt.Sprintf("0-%d", end))
+	w.Header().Set(headerContentLength, "0")
+	w.WriteHeader(statusCode)
+}
+
+func writeBlobCreated(w http.ResponseWriter, name string, hash gcr.Hash) {
+	w.Header().Set(headerLocation, blobLocation(name, hash))
+	w.Header().Set(headerDockerContentDigest, hash.String())
+	w.Header().Set(headerContentLength, "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (r *registry) handleUploadRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, repo gcrname.Repository, uploadID string) {
+	if uploadID == "" {
+		if req.Method != http.MethodPost {
+			writeRegistryError(w, http.StatusMethodNotAllowed, errorCodeUnsupported, fmt.Sprintf("unsupported HTTP method %s", req.Method))
+			return
+		}
+		r.startUpload(ctx, w, req, name, repo)
+		return
+	}
+
+	acClient := r.env.GetActionCacheClient()
+	session, err := ocicache.FetchUploadSession(ctx, acClient, uploadID)
+	if err != nil {
+		if status.IsNotFoundError(err) {
+			writeRegistryError(w, http.StatusNotFound, errorCodeBlobUploadUnknown, fmt.Sprintf("unknown upload %q", uploadID))
+			return
+		}
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadUnknown, fmt.Sprintf("could not fetch upload %q: %s", uploadID, err))
+		return
+	}
+	if session.GetRegistry() != repo.RegistryStr() || session.GetRepository() != repo.RepositoryStr() {
+		writeRegistryError(w, http.StatusNotFound, errorCodeBlobUploadUnknown, fmt.Sprintf("upload %q does not belong to repository %q", uploadID, name))
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeUploadProgress(w, http.StatusNoContent, name, uploadID, session)
+	case http.MethodPatch:
+		if cr := req.Header.Get(headerContentRange); cr != "" {
+			m := contentRangeRegexp.FindStringSubmatch(cr)
+			if len(m) != 3 {
+				writeRegistryError(w, http.StatusBadRequest, errorCodeBlobUploadInvalid, fmt.Sprintf("invalid %s header %q", headerContentRange, cr))
+				return
+			}
+			// Chunks must be uploaded in order.
+			if start, err := strconv.ParseInt(m[1], 10, 64); err != nil || start != session.GetSizeBytes() {
+				writeUploadProgress(w, http.StatusRequestedRangeNotSatisfiable, name, uploadID, session)
+				return
+			}
+		}
+		if err := r.appendToUpload(ctx, session, req); err != nil {
+			writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadInvalid, fmt.Sprintf("could not store upload data: %s", err))
+			return
+		}
+		if err := ocicache.WriteUploadSession(ctx, acClient, uploadID, session); err != nil {
+			writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadInvalid, fmt.Sprintf("could not store upload %q: %s", uploadID, err))
+			return
+		}
+		writeUploadProgress(w, http.StatusAccepted, name, uploadID, session)
+	case http.MethodPut:
+		if err := r.appendToUpload(ctx, session, req); err != nil {
+			writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadInvalid, fmt.Sprintf("could not store upload data: %s", err))
+			return
+		}
+		r.finishUpload(ctx, w, req, name, repo, session)
+	default:
+		writeRegistryError(w, http.StatusMethodNotAllowed, errorCodeUnsupported, fmt.Sprintf("unsupported HTTP method %s", req.Method))
+	}
+}
+
+func (r *registry) startUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, repo gcrname.Repository) {
+	query := req.URL.Query()
+
+	// Cross-repository mount: if the client already pushed this blob to
+	// another repository, link it into this repository without an upload.
+	// If the blob can't be mounted, fall back to a regular upload session as
+	// described in the spec.
+	if mount, from := query.Get("mount"), query.Get("from"); mount != "" && from != "" {
+		hash, hashErr := gcr.NewHash(mount)
+		fromRepo, repoErr := gcrname.NewRepository(from)
+		if hashErr == nil && repoErr == nil {
+			err := ocicache.MountBlob(ctx, r.env.GetByteStreamClient(), r.env.GetActionCacheClient(), fromRepo, repo, hash)
+			if err == nil {
+				writeBlobCreated(w, name, hash)
+				return
+			}
+			if !status.IsNotFoundError(err) {
+				log.CtxWarningf(ctx, "Could not mount blob %s from %q into %q: %s", hash, from, name, err)
+			}
+		}
+	}
+
+	session := &ocipb.OCIUploadSession{
+		Registry:   repo.RegistryStr(),
+		Repository: repo.RepositoryStr(),
+	}
+
+	// Monolithic upload: the whole blob is in the POST body.
+	if query.Get("digest") != "" {
+		if err := r.appendToUpload(ctx, session, req); err != nil {
+			writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadInvalid, fmt.Sprintf("could not store upload data: %s", err))
+			return
+		}
+		r.finishUpload(ctx, w, req, name, repo, session)
+		return
+	}
+
+	uploadID := uuid.New().String()
+	if err := ocicache.WriteUploadSession(ctx, r.env.GetActionCacheClient(), uploadID, session); err != nil {
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadInvalid, fmt.Sprintf("could not start upload: %s", err))
+		return
+	}
+	w.Header().Set(headerOCIChunkMinLength, "0")
+	writeUploadProgress(w, http.StatusAccepted, name, uploadID, session)
+}
+
+// appendToUpload stores the given data in the CAS and records it in the
+// upload session.
+func (r *registry) appendToUpload(ctx context.Context, session *ocipb.OCIUploadSession, req *http.Request) error {
+	if req.Body == nil || req.ContentLength == 0 {
+		return nil
+	}
+	buf := make([]byte, uploadChunkSizeBytes)
+	for {
+		n, err := io.ReadFull(req.Body, buf)
+		if n > 0 {
+			d, uploadErr := cachetools.UploadBlobToCAS(ctx, r.env.GetByteStreamClient(), "", repb.DigestFunction_SHA256, buf[:n])
+			if uploadErr != nil {
+				return uploadErr
+			}
+			session.Chunks = append(session.Chunks, &ocipb.OCIUploadChunk{
+				HashHex:   d.GetHash(),
+				SizeBytes: d.GetSizeBytes(),
+			})
+			session.SizeBytes += d.GetSizeBytes()
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return status.UnavailableErrorf("read request body: %s", err)
+		}
+	}
+}
+
+// finishUpload verifies that the uploaded data matches the digest given by
+// the client and makes the blob available in the repository.
+func (r *registry) finishUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, name string, repo gcrname.Repository, session *ocipb.OCIUploadSession) {
+	hash, err := gcr.NewHash(req.URL.Query().Get("digest"))
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeDigestInvalid, fmt.Sprintf("invalid digest: %s", err))
+		return
+	}
+	if hash.Algorithm != "sha256" {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeDigestInvalid, fmt.Sprintf("unsupported digest algorithm %q", hash.Algorithm))
+		return
+	}
+	if err := r.assembleBlob(ctx, repo, session, hash); err != nil {
+		if status.IsInvalidArgumentError(err) {
+			writeRegistryError(w, http.StatusBadRequest, errorCodeDigestInvalid, status.Message(err))
+			return
+		}
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeBlobUploadInvalid, fmt.Sprintf("could not store blob: %s", err))
+		return
+	}
+	log.CtxInfof(ctx, "Pushed blob %s:%s (%d bytes)", repo, hash, session.GetSizeBytes())
+	writeBlobCreated(w, name, hash)
+}
+
+// assembleBlob concatenates the uploaded chunks into a single CAS blob with
+// the given hash.
+func (r *registry) assembleBlob(ctx context.Context, repo gcrname.Repository, session *ocipb.OCIUploadSession, hash gcr.Hash) error {
+	bsClient := r.env.GetByteStreamClient()
+	acClient := r.env.GetActionCacheClient()
+	chunks := session.GetChunks()
+
+	// Small blobs are uploaded as a single chunk, which is already the
+	// blob itself.
+	if len(chunks) == 0 && hash.Hex == digest.EmptySha256 ||
+		len(chunks) == 1 && chunks[0].GetHashHex() == hash.Hex {
+		return ocicache.WriteBlobMetadataToCache(ctx, bsClient, acClient, repo, hash, pushedBlobContentType, session.GetSizeBytes())
+	}
+	if len(chunks) == 0 {
+		return status.InvalidArgumentErrorf("uploaded data does not match digest %s", hash)
+	}
+
+	uploader, err := ocicache.NewBlobUploader(ctx, bsClient, acClient, repo, hash, pushedBlobContentType, session.GetSizeBytes())
+	if err != nil {
+		return err
+	}
+	defer uploader.Close()
+	hasher := sha256.New()
+	mw := io.MultiWriter(uploader, hasher)
+	for _, chunk := range chunks {
+		rn := digest.NewCASResourceName(&repb.Digest{Hash: chunk.GetHashHex(), SizeBytes: chunk.GetSizeBytes()}, "", repb.DigestFunction_SHA256)
+		if err := cachetools.GetBlob(ctx, bsClient, rn, mw); err != nil {
+			return err
+		}
+	}
+	if computed := hex.EncodeToString(hasher.Sum(nil)); computed != hash.Hex {
+		return status.InvalidArgumentErrorf("uploaded data has digest sha256:%s, expected %s", computed, hash)
+	}
+	return uploader.Commit()
+}
+
+// manifestReferences holds the fields of image manifests and image indexes
+// that refer to other content in the repository.
+type manifestReferences struct {
+	Config    *gcr.Descriptor  `json:"config"`
+	Layers    []gcr.Descriptor `json:"layers"`
+	Manifests []gcr.Descriptor `json:"manifests"`
+}
+
+func (r *registry) handleManifestPut(ctx context.Context, w http.ResponseWriter, req *http.Request, name, reference string) {
+	ref, err := parseReference(name, reference)
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeNameInvalid, fmt.Sprintf("invalid repository %q or reference %q: %s", name, reference, err))
+		return
+	}
+	repo := ref.Context()
+	contentType := req.Header.Get(headerContentType)
+	if contentType == "" {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeManifestInvalid, fmt.Sprintf("missing %s header", headerContentType))
+		return
+	}
+	raw, err := io.ReadAll(io.LimitReader(req.Body, ocicache.MaxManifestSize+1))
+	if err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeManifestInvalid, fmt.Sprintf("could not read manifest: %s", err))
+		return
+	}
+	if len(raw) > ocicache.MaxManifestSize {
+		writeRegistryError(w, http.StatusRequestEntityTooLarge, errorCodeManifestInvalid, fmt.Sprintf("manifest exceeds the maximum size of %d bytes", ocicache.MaxManifestSize))
+		return
+	}
+	hash, _, err := gcr.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		writeRegistryError(w, http.StatusInternalServerError, errorCodeManifestInvalid, fmt.Sprintf("could not compute manifest digest: %s", err))
+		return
+	}
+	if isDigest(reference) && reference != hash.String() {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeDigestInvalid, fmt.Sprintf("manifest has digest %s, expected %s", hash, reference))
+		return
+	}
+
+	var refs manifestReferences
+	if err := json.Unmarshal(raw, &refs); err != nil {
+		writeRegistryError(w, http.StatusBadRequest, errorCodeManifestInvalid, fmt.Sprintf("could not parse manifest: %s", err))
+		return
+	}
+	if err := r.checkManifestReferences(ctx, repo, ref, &refs); err != nil {
+		if status.IsNotFoundError(err) {
+			writeRegistryError(w, http.StatusBadRequest, errorCodeManifestBlobUnknown, status.Message(err))
+			return
+		}
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeManifestInvalid, fmt.Sprintf("could not check manifest references: %s", err))
+		return
+	}
+
+	acClient := r.env.GetActionCacheClient()
+	if err := ocicache.WriteManifestToAC(ctx, raw, acClient, repo, hash, contentType, ref); err != nil {
+		writeRegistryError(w, http.StatusServiceUnavailable, errorCodeManifestInvalid, fmt.Sprintf("could not store manifest: %s", err))
+		return
+	}
+	if !isDigest(reference) {
+		if err := ocicache.WriteTag(ctx, acClient, repo, reference, hash); err != nil {
+			writeRegistryError(w, http.StatusServiceUnavailable, errorCodeManifestInvalid, fmt.Sprintf("could not store tag %q: %s", reference, err))
+			return
+		}
+	}
+	log.CtxInfof(ctx, "Pushed manifest %s:%s (reference %q)", repo, hash, reference)
+
+	w.Header().Set(headerLocation, "/v2/"+name+"/manifests/"+hash.String())
+	w.Header().Set(headerDockerContentDigest, hash.String())
+	w.Header().Set(headerContentLength, "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// checkManifestReferences returns a NotFound error if any blob or manifest
+// that the given manifest refers to has not been pushed to the repository.
+func (r *registry) checkManifestReferences(ctx context.Context, repo gcrname.Repository, ref gcrname.Reference, refs *manifestReferences) error {
+	bsClient := r.env.GetByteStreamClient()
+	acClient := r.env.GetActionCacheClient()
+	blobs := refs.Layers
+	if refs.Config != nil {
+		blobs = append(blobs, *refs.Config)
+	}
+	for _, d := range blobs {
+		// Non-distributable layers are fetched from their URLs by clients.
+		if len(d.URLs) > 0 {
+			continue
+		}
+		if _, err := ocicache.FetchBlobMetadataFromCache(ctx, bsClient, acClient, repo, d.Digest); err != nil {
+			if status.IsNotFoundError(err) {
+				return status.NotFoundErrorf("blob %s has not been pushed to %s", d.Digest, repo)
+			}
+			return err
+		}
+	}
+	for _, d := range refs.Manifests {
+		if _, err := ocicache.FetchManifestFromAC(ctx, acClient, repo, d.Digest, ref); err != nil {
+			if status.IsNotFoundError(err) {
+				return status.NotFoundErrorf("manifest %s has not been pushed to %s", d.Digest, repo)
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,892 @@
+// Package outbound_webhooks delivers build events to HTTP endpoints that
+// groups configure, such as chat integrations or deployment systems.
+package outbound_webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/keystore"
+	"github.com/buildbuddy-io/buildbuddy/server/endpoint_urls/build_buddy_url"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/http/httpclient"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lru"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	owpb "github.com/buildbuddy-io/buildbuddy/proto/outbound_webhook"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var (
+	enabled             = flag.Bool("integrations.outbound_webhooks.enabled", false, "Whether groups can configure webhooks that receive build events. ** Enterprise only **")
+	allowHTTP           = flag.Bool("integrations.outbound_webhooks.allow_http", false, "If true, webhook URLs may use http instead of https. Intended for testing only. ** Enterprise only **")
+	numWorkers          = flag.Int("integrations.outbound_webhooks.num_workers", 8, "The number of webhook deliveries that are made concurrently. ** Enterprise only **")
+	queueSize           = flag.Int("integrations.outbound_webhooks.queue_size", 10_000, "The number of webhook deliveries that can be waiting to be made. Events are dropped when the queue is full. ** Enterprise only **")
+	maxAttempts         = flag.Int("integrations.outbound_webhooks.max_attempts", 5, "The number of times a delivery is attempted before giving up. ** Enterprise only **")
+	initialRetryBackoff = flag.Duration("integrations.outbound_webhooks.initial_retry_backoff", 1*time.Second, "How long to wait before retrying a failed delivery. The wait doubles after each attempt. ** Enterprise only **")
+	requestTimeout      = flag.Duration("integrations.outbound_webhooks.request_timeout", 10*time.Second, "The timeout for each webhook request. ** Enterprise only **")
+	deliveryLogTTL      = flag.Duration("integrations.outbound_webhooks.delivery_log_ttl", 7*24*time.Hour, "How long delivery records are kept. ** Enterprise only **")
+)
+
+const (
+	// The maximum number of webhooks that a group can create.
+	maxWebhooksPerGroup = 20
+
+	// The maximum number of deliveries returned by GetWebhookDeliveries.
+	deliveriesPageSize = 100
+
+	// How long a group's webhooks are cached before being re-read from the
+	// DB when an event occurs.
+	webhookCacheTTL = 30 * time.Second
+
+	// The number of webhooks that are cached in memory.
+	webhookCacheSize = 100_000
+
+	// The maximum number of EXECUTION_FAILED events sent for each invocation.
+	// A broken build can fail thousands of actions, and each failure would
+	// otherwise be delivered to every subscribed webhook.
+	maxExecutionFailedEventsPerInvocation = 10
+
+	// The number of invocations whose EXECUTION_FAILED events are counted in
+	// memory.
+	executionFailureCacheSize = 100_000
+
+	// The maximum backoff between delivery attempts.
+	maxRetryBackoff = 1 * time.Minute
+
+	// The maximum number of response body bytes recorded for failed
+	// deliveries.
+	maxErrorBodyBytes = 1024
+
+	signatureHeader = "X-BuildBuddy-Signature"
+	timestampHeader = "X-BuildBuddy-Timestamp"
+	eventHeader     = "X-BuildBuddy-Event"
+	deliveryHeader  = "X-BuildBuddy-Delivery"
+)
+
+// Event is the data that a webhook's payload template is executed with.
+type Event struct {
+	EventType  string
+	EventID    string
+	GroupID    string
+	Timestamp  time.Time
+	URL        string
+	Invocation *inpb.Invocation
+	Execution  *Execution
+
+	eventType owpb.EventType
+}
+
+// Execution describes a remote execution in an EXECUTION_FAILED event.
+type Execution struct {
+	ExecutionID   string `json:"execution_id"`
+	InvocationID  string `json:"invocation_id"`
+	ExitCode      int32  `json:"exit_code"`
+	StatusCode    int32  `json:"status_code"`
+	StatusMessage string `json:"status_message"`
+}
+
+type defaultInvocationPayload struct {
+	InvocationID  string `json:"invocation_id"`
+	Status        string `json:"status"`
+	Success       bool   `json:"success"`
+	Role          string `json:"role"`
+	User          string `json:"user"`
+	Host          string `json:"host"`
+	Command       string `json:"command"`
+	Pattern       string `json:"pattern"`
+	RepoURL       string `json:"repo_url"`
+	BranchName    string `json:"branch_name"`
+	CommitSHA     string `json:"commit_sha"`
+	DurationUsec  int64  `json:"duration_usec"`
+	ActionCount   int64  `json:"action_count"`
+	BazelExitCode string `json:"bazel_exit_code"`
+	CreatedAtUsec int64  `json:"created_at_usec"`
+	UpdatedAtUsec int64  `json:"updated_at_usec"`
+	AttemptNumber uint64 `json:"attempt"`
+}
+
+// defaultPayload is the request body sent to webhooks without a payload
+// template.
+type defaultPayload struct {
+	EventType  string                    `json:"event_type"`
+	EventID    string                    `json:"event_id"`
+	GroupID    string                    `json:"group_id"`
+	Timestamp  time.Time                 `json:"timestamp"`
+	URL        string                    `json:"url"`
+	Invocation *defaultInvocationPayload `json:"invocation,omitempty"`
+	Execution  *Execution                `json:"execution,omitempty"`
+}
+
+type delivery struct {
+	webhook *tables.OutboundWebhook
+	event   *Event
+
+	// Set on the first attempt and carried across retries.
+	record  *tables.OutboundWebhookDelivery
+	secret  string
+	body    []byte
+	start   time.Time
+	backoff time.Duration
+}
+
+type Service struct {
+	env    environment.Env
+	client *http.Client
+	queue  chan *delivery
+
+	mu       sync.Mutex
+	webhooks interfaces.LRU[*webhookCacheEntry]
+	// The number of EXECUTION_FAILED events sent for recent invocations.
+	executionFailures interfaces.LRU[int]
+
+	wg sync.WaitGroup
+}
+
+type webhookCacheEntry struct {
+	webhooks     []*tables.OutboundWebhook
+	expiresAfter time.Time
+}
+
+func Register(env *real_environment.RealEnv) error {
+	if !*enabled {
+		return nil
+	}
+	s, err := New(env)
+	if err != nil {
+		return err
+	}
+	env.SetOutboundWebhookService(s)
+	env.SetWebhooks(append(env.GetWebhooks(), s))
+	env.GetHealthChecker().RegisterShutdownFunction(s.Shutdown)
+	return nil
+}
+
+func New(env environment.Env) (*Service, error) {
+	if *numWorkers <= 0 {
+		return nil, status.InvalidArgumentError("integrations.outbound_webhooks.num_workers must be positive")
+	}
+	// Signing secrets are stored encrypted with the KMS master key.
+	if env.GetKMS() == nil {
+		return nil, status.FailedPreconditionError("outbound webhooks require a KMS to be configured")
+	}
+	l, err := lru.NewLRU[*webhookCacheEntry](&lru.Config[*webhookCacheEntry]{
+		MaxSize: webhookCacheSize,
+		SizeFn:  func(v *webhookCacheEntry) int64 { return int64(len(v.webhooks) + 1) },
+	})
+	if err != nil {
+		return nil, err
+	}
+	executionFailures, err := lru.NewLRU[int](&lru.Config[int]{
+		MaxSize:       executionFailureCacheSize,
+		SizeFn:        func(int) int64 { return 1 },
+		UpdateInPlace: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Webhook URLs are user-controlled, so requests go through the client
+	// that refuses to dial private addresses, and redirects are not followed
+	// since they could point anywhere.
+	client := httpclient.New()
+	client.Timeout = *requestTimeout
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	s := &Service{
+		env:               env,
+		client:            client,
+		queue:             make(chan *delivery, *queueSize),
+		webhooks:          l,
+		executionFailures: executionFailures,
+	}
+	queue := s.queue
+	for i := 0; i < *numWorkers; i++ {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for d := range queue {
+				s.deliver(env.GetServerContext(), d)
+			}
+		}()
+	}
+	return s, nil
+}
+
+// Shutdown stops accepting events and waits for the queued deliveries to be
+// made. Deliveries that are waiting to be retried are recorded as failed once
+// their backoff elapses.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.queue != nil {
+		close(s.queue)
+		s.queue = nil
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// NotifyComplete queues an INVOCATION_COMPLETED or WORKFLOW_COMPLETED event
+// for the webhooks of the group that owns the invocation.
+func (s *Service) NotifyComplete(ctx context.Context, in *inpb.Invocation) error {
+	groupID := in.GetAcl().GetGroupId()
+	if groupID == "" {
+		return nil
+	}
+	eventType := owpb.EventType_INVOCATION_COMPLETED
+	if in.GetRole() == "CI_RUNNER" {
+		eventType = owpb.EventType_WORKFLOW_COMPLETED
+	}
+	return s.enqueue(ctx, &Event{
+		EventType: eventType.String(),
+		EventID:   in.GetInvocationId(),
+		GroupID:   groupID,
+		Timestamp: time.Now(),
+		URL:       build_buddy_url.WithPath("/invocation/" + in.GetInvocationId()).String(),
+		// Deliveries are made after this returns, so they get their own
+		// copy of the invocation.
+		Invocation: in.CloneVT(),
+		eventType:  eventType,
+	})
+}
+
+// NotifyExecutionFailed queues an EXECUTION_FAILED event for the webhooks of
+// the group that ran the execution. At most
+// maxExecutionFailedEventsPerInvocation events are sent for each invocation.
+
+func (s *Service) NotifyExecutionFailed(ctx context.Context, executionID string, rsp *repb.ExecuteResponse) error {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		if authutil.IsAnonymousUserError(err) {
+			return nil
+		}
+		return err
+	}
+	invocationID := bazel_request.GetInvocationID(ctx)
+	if !s.allowExecutionFailedEvent(invocationID) {
+		return nil
+	}
+	link := build_buddy_url.WithPath("/invocation/" + invocationID)
+	link.RawQuery = url.Values{"actionDigest": {executionID}}.Encode()
+	link.Fragment = "action"
+	st := gstatus.FromProto(rsp.GetStatus())
+	return s.enqueue(ctx, &Event{
+		EventType: owpb.EventType_EXECUTION_FAILED.String(),
+		EventID:   executionID,
+		GroupID:   u.GetGroupID(),
+		Timestamp: time.Now(),
+		URL:       link.String(),
+		Execution: &Execution{
+			ExecutionID:   executionID,
+			InvocationID:  invocationID,
+			ExitCode:      rsp.GetResult().GetExitCode(),
+			StatusCode:    int32(st.Code()),
+			StatusMessage: st.Message(),
+		},
+		eventType: owpb.EventType_EXECUTION_FAILED,
+	})
+}
+
+// allowExecutionFailedEvent returns whether an EXECUTION_FAILED event should
+// be sent for another failed execution in the given invocation, and counts it
+// if so. Executions that aren't part of an invocation are not limited.
+func (s *Service) allowExecutionFailedEvent(invocationID string) bool {
+	if invocationID == "" {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := s.executionFailures.Get(invocationID)
+	if n >= maxExecutionFailedEventsPerInvocation {
+		return false
+	}
+	s.executionFailures.Add(invocationID, n+1)
+	return true
+}
+
+func (s *Service) enqueue(ctx context.Context, e *Event) error {
+	webhooks, err := s.groupWebhooks(ctx, e.GroupID)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil {
+		return status.UnavailableError("outbound webhooks are shutting down")
+	}
+	for _, w := range webhooks {
+		if w.Disabled || !slices.Contains(parseEventTypes(w.EventTypes), e.eventType) {
+			continue
+		}
+		select {
+		case s.queue <- &delivery{webhook: w, event: e}:
+		default:
+			log.CtxWarningf(ctx, "Dropping %s event %q for webhook %q: the delivery queue is full", e.EventType, e.EventID, w.WebhookID)
+		}
+	}
+	return nil
+}
+
+// groupWebhooks returns the webhooks of a group, caching them for a short
+// time since every invocation in the group looks them up.
+func (s *Service) groupWebhooks(ctx context.Context, groupID string) ([]*tables.OutboundWebhook, error) {
+	s.mu.Lock()
+	entry, ok := s.webhooks.Get(groupID)
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAfter) {
+		return entry.webhooks, nil
+	}
+	rq := s.env.GetDBHandle().NewQueryWithOpts(ctx, "outbound_webhooks_get_for_event", db.Opts().WithStaleReads()).Raw(
+		`SELECT * FROM "OutboundWebhooks" WHERE group_id = ?`, groupID)
+	webhooks, err := db.ScanAll(rq, &tables.OutboundWebhook{})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.webhooks.Add(groupID, &webhookCacheEntry{webhooks: webhooks, expiresAfter: time.Now().Add(webhookCacheTTL)})
+	s.mu.Unlock()
+	return webhooks, nil
+}
+
+func (s *Service) invalidateGroupWebhooks(groupID string) {
+	s.mu.Lock()
+	s.webhooks.Remove(groupID)
+	s.mu.Unlock()
+}
+
+// deliver makes one attempt to POST an event to a webhook. Transient
+// failures are retried by re-queueing the delivery after a backoff, so that
+// workers don't sit idle between attempts. The outcome is recorded once the
+// delivery succeeds or gives up.
+func (s *Service) deliver(ctx context.Context, d *delivery) {
+	if d.record == nil {
+		deliveryID, err := tables.PrimaryKeyForTable("OutboundWebhookDeliveries")
+		if err != nil {
+			log.CtxWarningf(ctx, "Could not deliver webhook %q: %s", d.webhook.WebhookID, err)
+			return
+		}
+		d.start = time.Now()
+		d.backoff = *initialRetryBackoff
+		d.record = &tables.OutboundWebhookDelivery{
+			DeliveryID: deliveryID,
+			WebhookID:  d.webhook.WebhookID,
+			GroupID:    d.webhook.GroupID,
+			EventType:  int32(d.event.eventType),
+			EventID:    d.event.EventID,
+		}
+		secret, err := keystore.DecryptWithMasterKey(s.env, d.webhook.EncryptedSigningSecret, []byte(d.webhook.WebhookID))
+		if err != nil {
+			d.record.Error = status.WrapError(err, "decrypt signing secret").Error()
+			s.finish(ctx, d)
+			return
+		}
+		d.secret = string(secret)
+		d.body, err = renderPayload(d.webhook.PayloadTemplate, d.event)
+		if err != nil {
+			d.record.Error = err.Error()
+			s.finish(ctx, d)
+			return
+		}
+	}
+
+	record := d.record
+	record.Attempts++
+	code, retryable, err := s.post(ctx, d.webhook.URL, d.secret, record.DeliveryID, d.event.EventType, d.body)
+	record.ResponseStatusCode = code
+	if err == nil {
+		record.Success = true
+		record.Error = ""
+		s.finish(ctx, d)
+		return
+	}
+	record.Error = err.Error()
+	if !retryable || int(record.Attempts) >= *maxAttempts || ctx.Err() != nil {
+		s.finish(ctx, d)
+		return
+	}
+	s.retryAfterBackoff(ctx, d)
+}
+
+// retryAfterBackoff puts a failed delivery back on the queue once its backoff
+// elapses.
+func (s *Service) retryAfterBackoff(ctx context.Context, d *delivery) {
+	backoff := d.backoff
+	d.backoff = min(2*backoff, maxRetryBackoff)
+	// Called from a worker, so the wait group can't be at zero here.
+	s.wg.Add(1)
+	time.AfterFunc(backoff, func() {
+		defer s.wg.Done()
+		if err := s.requeue(d); err != nil {
+			log.CtxInfof(ctx, "Not retrying delivery to webhook %q: %s", d.webhook.WebhookID, err)
+			s.finish(ctx, d)
+		}
+	})
+}
+
+func (s *Service) requeue(d *delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.queue == nil {
+		return status.UnavailableError("outbound webhooks are shutting down")
+	}
+	select {
+	case s.queue <- d:
+		return nil
+	default:
+		return status.ResourceExhaustedError("the delivery queue is full")
+	}
+}
+
+// finish records the outcome of a delivery.
+func (s *Service) finish(ctx context.Context, d *delivery) {
+	record := d.record
+	record.DurationUsec = time.Since(d.start).Microseconds()
+	if !record.Success {
+		log.CtxInfof(ctx, "Failed to deliver %s event %q to webhook %q after %d attempt(s): %s", d.event.EventType, d.event.EventID, d.webhook.WebhookID, record.Attempts, record.Error)
+	}
+	if err := s.recordDelivery(ctx, d.event, record); err != nil {
+		log.CtxWarningf(ctx, "Could not record delivery to webhook %q: %s", d.webhook.WebhookID, err)
+	}
+}
+
+// post makes a single delivery request. It returns the response status code,
+// if any, and whether a failed request should be retried.
+func (s *Service) post(ctx context.Context, webhookURL, secret, deliveryID, eventType string, body []byte) (int32, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(signatureHeader, "sha256="+sign(secret, timestamp, body))
+	req.Header.Set(eventHeader, eventType)
+	req.Header.Set(deliveryHeader, deliveryID)
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return int32(rsp.StatusCode), false, nil
+	}
+	if rsp.StatusCode >= 300 && rsp.StatusCode < 400 {
+		return int32(rsp.StatusCode), false, status.FailedPreconditionErrorf("webhook responded with %s: redirects are not followed", rsp.Status)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(rsp.Body, maxErrorBodyBytes))
+	retryable := rsp.StatusCode >= 500 || rsp.StatusCode == http.StatusTooManyRequests
+	return int32(rsp.StatusCode), retryable, status.UnavailableErrorf("webhook responded with %s: %s", rsp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *Service) recordDelivery(ctx context.Context, e *Event, r *tables.OutboundWebhookDelivery) error {
+	err := s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_record_delivery").Raw(`
+		INSERT INTO "OutboundWebhookDeliveries" (
+			created_at_usec, updated_at_usec, delivery_id, webhook_id, group_id, event_type,
+			event_id, attempts, success, response_status_code, error, duration_usec
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Timestamp.UnixMicro(), time.Now().UnixMicro(), r.DeliveryID, r.WebhookID, r.GroupID, r.EventType,
+		r.EventID, r.Attempts, r.Success, r.ResponseStatusCode, r.Error, r.DurationUsec,
+	).Exec().Error
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-*deliveryLogTTL).UnixMicro()
+	return s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_prune_deliveries").Raw(
+		`DELETE FROM "OutboundWebhookDeliveries" WHERE webhook_id = ? AND created_at_usec < ?`,
+		r.WebhookID, cutoff,
+	).Exec().Error
+}
+
+// sign returns the hex encoded HMAC of "<timestamp>.<body>". Including the
+// timestamp lets receivers reject replayed requests.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// renderPayload returns the JSON request body for an event.
+func renderPayload(payloadTemplate string, e *Event) ([]byte, error) {
+	if payloadTemplate == "" {
+		return json.Marshal(newDefaultPayload(e))
+	}
+	tmpl, err := parseTemplate(payloadTemplate)
+	if err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, templateData(e)); err != nil {
+		return nil, status.InvalidArgumentErrorf("execute payload template: %s", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, status.InvalidArgumentError("payload template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+// templateData returns a copy of the event for a payload template to be
+// executed with. Templates can call any exported method of the event's
+// fields, including ones that modify them, and the event is shared by the
+// deliveries to all of a group's webhooks.
+func templateData(e *Event) *Event {
+	data := *e
+	data.Invocation = e.Invocation.CloneVT()
+	if e.Execution != nil {
+		execution := *e.Execution
+		data.Execution = &execution
+	}
+	return &data
+}
+
+func parseTemplate(payloadTemplate string) (*template.Template, error) {
+	tmpl, err := template.New("payload").Option("missingkey=error").Funcs(template.FuncMap{
+		"json": toJSON,
+	}).Parse(payloadTemplate)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("parse payload template: %s", err)
+	}
+	return tmpl, nil
+}
+
+func toJSON(v any) (string, error) {
+	var b []byte
+	var err error
+	if m, ok := v.(proto.Message); ok {
+		b, err = protojson.Marshal(m)
+	} else {
+		b, err = json.Marshal(v)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func newDefaultPayload(e *Event) *defaultPayload {
+	p := &defaultPayload{
+		EventType: e.EventType,
+		EventID:   e.EventID,
+		GroupID:   e.GroupID,
+		Timestamp: e.Timestamp,
+		URL:       e.URL,
+		Execution: e.Execution,
+	}
+	if in := e.Invocation; in != nil {
+		p.Invocation = &defaultInvocationPayload{
+			InvocationID:  in.GetInvocationId(),
+			Status:        in.GetInvocationStatus().String(),
+			Success:       in.GetSuccess(),
+			Role:          in.GetRole(),
+			User:          in.GetUser(),
+			Host:          in.GetHost(),
+			Command:       in.GetCommand(),
+			Pattern:       strings.Join(in.GetPattern(), " "),
+			RepoURL:       in.GetRepoUrl(),
+			BranchName:    in.GetBranchName(),
+			CommitSHA:     in.GetCommitSha(),
+			DurationUsec:  in.GetDurationUsec(),
+			ActionCount:   in.GetActionCount(),
+			BazelExitCode: in.GetBazelExitCode(),
+			CreatedAtUsec: in.GetCreatedAtUsec(),
+			UpdatedAtUsec: in.GetUpdatedAtUsec(),
+			AttemptNumber: in.GetAttempt(),
+		}
+	}
+	return p
+}
+
+// sampleEvent returns an event that payload templates are validated against
+// when webhooks are saved.
+func sampleEvent(eventType owpb.EventType) *Event {
+	e := &Event{
+		EventType: eventType.String(),
+		EventID:   "sample-event-id",
+		GroupID:   "GR123",
+		Timestamp: time.Now(),
+		URL:       build_buddy_url.WithPath("/").String(),
+		eventType: eventType,
+	}
+	if eventType == owpb.EventType_EXECUTION_FAILED {
+		e.Execution = &Execution{ExecutionID: "sample-execution-id", InvocationID: "sample-invocation-id", ExitCode: 1}
+	} else {
+		e.Invocation = &inpb.Invocation{InvocationId: "sample-invocation-id"}
+	}
+	return e
+}
+
+func parseEventTypes(s string) []owpb.EventType {
+	var eventTypes []owpb.EventType
+	for _, part := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		eventTypes = append(eventTypes, owpb.EventType(v))
+	}
+	return eventTypes
+}
+
+func formatEventTypes(eventTypes []owpb.EventType) string {
+	parts := make([]string, 0, len(eventTypes))
+	for _, t := range eventTypes {
+		parts = append(parts, strconv.Itoa(int(t)))
+	}
+	return strings.Join(parts, ",")
+}
+
+// validateWebhook checks the user-provided fields of a webhook and returns its
+// normalized event types.
+func validateWebhook(w *owpb.Webhook) ([]owpb.EventType, error) {
+	u, err := url.Parse(w.GetUrl())
+	if err != nil || u.Host == "" {
+		return nil, status.InvalidArgumentErrorf("invalid webhook URL %q", w.GetUrl())
+	}
+	if u.Scheme != "https" && !(*allowHTTP && u.Scheme == "http") {
+		return nil, status.InvalidArgumentError("webhook URL must use https")
+	}
+	if len(w.GetEventTypes()) == 0 {
+		return nil, status.InvalidArgumentError("at least one event type is required")
+	}
+	var eventTypes []owpb.EventType
+	for _, t := range w.GetEventTypes() {
+		if _, ok := owpb.EventType_name[int32(t)]; !ok || t == owpb.EventType_UNKNOWN_EVENT_TYPE {
+			return nil, status.InvalidArgumentErrorf("unknown event type %d", t)
+		}
+		if !slices.Contains(eventTypes, t) {
+			eventTypes = append(eventTypes, t)
+		}
+	}
+	slices.Sort(eventTypes)
+	if w.GetPayloadTemplate() != "" {
+		for _, t := range eventTypes {
+			if _, err := renderPayload(w.GetPayloadTemplate(), sampleEvent(t)); err != nil {
+				return nil, status.InvalidArgumentErrorf("invalid payload template for %s events: %s", t, status.Message(err))
+			}
+		}
+	}
+	return eventTypes, nil
+}
+
+func (s *Service) checkAccess(ctx context.Context, groupID string) error {
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	return authutil.AuthorizeOrgAdmin(u, groupID)
+}
+
+func webhookProto(w *tables.OutboundWebhook) *owpb.Webhook {
+	return &owpb.Webhook{
+		WebhookId:       w.WebhookID,
+		Url:             w.URL,
+		Description:     w.Description,
+		EventTypes:      parseEventTypes(w.EventTypes),
+		PayloadTemplate: w.PayloadTemplate,
+		Disabled:        w.Disabled,
+	}
+}
+
+func (s *Service) GetWebhooks(ctx context.Context, req *owpb.GetWebhooksRequest) (*owpb.GetWebhooksResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	rq := s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_get").Raw(
+		`SELECT * FROM "OutboundWebhooks" WHERE group_id = ? ORDER BY created_at_usec`, groupID)
+	webhooks, err := db.ScanAll(rq, &tables.OutboundWebhook{})
+	if err != nil {
+		return nil, err
+	}
+	rsp := &owpb.GetWebhooksResponse{}
+	for _, w := range webhooks {
+		rsp.Webhooks = append(rsp.Webhooks, webhookProto(w))
+	}
+	return rsp, nil
+}
+
+func (s *Service) CreateWebhook(ctx context.Context, req *owpb.CreateWebhookRequest) (*owpb.CreateWebhookResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	eventTypes, err := validateWebhook(req.GetWebhook())
+	if err != nil {
+		return nil, err
+	}
+
+	row := &struct{ Count int64 }{}
+	err = s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_count").Raw(
+		`SELECT COUNT(*) AS count FROM "OutboundWebhooks" WHERE group_id = ?`, groupID).Take(row)
+	if err != nil {
+		return nil, err
+	}
+	if row.Count >= maxWebhooksPerGroup {
+		return nil, status.ResourceExhaustedErrorf("groups can have at most %d webhooks", maxWebhooksPerGroup)
+	}
+
+	id, err := tables.PrimaryKeyForTable("OutboundWebhooks")
+	if err != nil {
+		return nil, err
+	}
+	secret, err := random.RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+	encryptedSecret, err := keystore.EncryptWithMasterKey(s.env, []byte(secret), []byte(id))
+	if err != nil {
+		return nil, status.WrapError(err, "encrypt signing secret")
+	}
+	w := &tables.OutboundWebhook{
+		WebhookID:              id,
+		GroupID:                groupID,
+		URL:                    req.GetWebhook().GetUrl(),
+		Description:            req.GetWebhook().GetDescription(),
+		EventTypes:             formatEventTypes(eventTypes),
+		PayloadTemplate:        req.GetWebhook().GetPayloadTemplate(),
+		EncryptedSigningSecret: encryptedSecret,
+		Disabled:               req.GetWebhook().GetDisabled(),
+	}
+	now := time.Now().UnixMicro()
+	err = s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_create").Raw(`
+		INSERT INTO "OutboundWebhooks" (
+			created_at_usec, updated_at_usec, webhook_id, group_id, url, description,
+			event_types, payload_template, encrypted_signing_secret, disabled
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		now, now, w.WebhookID, w.GroupID, w.URL, w.Description,
+		w.EventTypes, w.PayloadTemplate, w.EncryptedSigningSecret, w.Disabled,
+	).Exec().Error
+	if err != nil {
+		return nil, err
+	}
+	s.invalidateGroupWebhooks(groupID)
+
+	pb := webhookProto(w)
+	pb.SigningSecret = secret
+	return &owpb.CreateWebhookResponse{Webhook: pb}, nil
+}
+
+func (s *Service) UpdateWebhook(ctx context.Context, req *owpb.UpdateWebhookRequest) (*owpb.UpdateWebhookResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	w := req.GetWebhook()
+	eventTypes, err := validateWebhook(w)
+	if err != nil {
+		return nil, err
+	}
+	result := s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_update").Raw(`
+		UPDATE "OutboundWebhooks"
+		SET updated_at_usec = ?, url = ?, description = ?, event_types = ?, payload_template = ?, disabled = ?
+		WHERE group_id = ? AND webhook_id = ?`,
+		time.Now().UnixMicro(), w.GetUrl(), w.GetDescription(), formatEventTypes(eventTypes), w.GetPayloadTemplate(), w.GetDisabled(),
+		groupID, w.GetWebhookId(),
+	).Exec()
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, status.NotFoundErrorf("webhook %q not found", w.GetWebhookId())
+	}
+	s.invalidateGroupWebhooks(groupID)
+	return &owpb.UpdateWebhookResponse{}, nil
+}
+
+func (s *Service) DeleteWebhook(ctx context.Context, req *owpb.DeleteWebhookRequest) (*owpb.DeleteWebhookResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	err := s.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		result := tx.NewQuery(ctx, "outbound_webhooks_delete").Raw(
+			`DELETE FROM "OutboundWebhooks" WHERE group_id = ? AND webhook_id = ?`,
+			groupID, req.GetWebhookId(),
+		).Exec()
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return status.NotFoundErrorf("webhook %q not found", req.GetWebhookId())
+		}
+		return tx.NewQuery(ctx, "outbound_webhooks_delete_deliveries").Raw(
+			`DELETE FROM "OutboundWebhookDeliveries" WHERE group_id = ? AND webhook_id = ?`,
+			groupID, req.GetWebhookId(),
+		).Exec().Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.invalidateGroupWebhooks(groupID)
+	return &owpb.DeleteWebhookResponse{}, nil
+}
+
+func (s *Service) GetWebhookDeliveries(ctx context.Context, req *owpb.GetWebhookDeliveriesRequest) (*owpb.GetWebhookDeliveriesResponse, error) {
+	groupID := req.GetRequestContext().GetGroupId()
+	if err := s.checkAccess(ctx, groupID); err != nil {
+		return nil, err
+	}
+	rq := s.env.GetDBHandle().NewQuery(ctx, "outbound_webhooks_get_deliveries").Raw(`
+		SELECT * FROM "OutboundWebhookDeliveries"
+		WHERE group_id = ? AND webhook_id = ?
+		ORDER BY created_at_usec DESC
+		LIMIT ?`,
+		groupID, req.GetWebhookId(), deliveriesPageSize)
+	deliveries, err := db.ScanAll(rq, &tables.OutboundWebhookDelivery{})
+	if err != nil {
+		return nil, err
+	}
+	rsp := &owpb.GetWebhookDeliveriesResponse{}
+	for _, d := range deliveries {
+		rsp.Deliveries = append(rsp.Deliveries, &owpb.Delivery{
+			DeliveryId:         d.DeliveryID,
+			WebhookId:          d.WebhookID,
+			EventType:          owpb.EventType(d.EventType),
+			EventId:            d.EventID,
+			Attempts:           d.Attempts,
+			Success:            d.Success,
+			ResponseStatusCode: d.ResponseStatusCode,
+			Error:              d.Error,
+			CreatedAtUsec:      d.CreatedAtUsec,
+			DurationUsec:       d.DurationUsec,
+		})
+	}
+	return rsp, nil
+}
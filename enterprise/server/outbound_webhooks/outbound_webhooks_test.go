@@ -0,0 +1,305 @@
+package outbound_webhooks_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/backends/kms"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/outbound_webhooks"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testauth"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/environment"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testfs"
+	"github.com/buildbuddy-io/buildbuddy/server/util/bazel_request"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	aclpb "github.com/buildbuddy-io/buildbuddy/proto/acl"
+	ctxpb "github.com/buildbuddy-io/buildbuddy/proto/context"
+	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
+	owpb "github.com/buildbuddy-io/buildbuddy/proto/outbound_webhook"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func newService(t *testing.T, env environment.Env) *outbound_webhooks.Service {
+	flags.Set(t, "integrations.outbound_webhooks.enabled", true)
+	flags.Set(t, "integrations.outbound_webhooks.allow_http", true)
+	flags.Set(t, "integrations.outbound_webhooks.initial_retry_backoff", time.Millisecond)
+	// Test endpoints listen on localhost.
+	flags.Set(t, "http.client.allow_localhost", true)
+
+	s, err := outbound_webhooks.New(env)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := s.Shutdown(context.Background())
+		require.NoError(t, err)
+	})
+	return s
+}
+
+func getEnv(t *testing.T) environment.Env {
+	env := enterprise_testenv.New(t)
+	enterprise_testauth.Configure(t, env)
+
+	kmsDir := testfs.MakeTempDir(t)
+	masterKey := make([]byte, 32)
+	_, err := rand.Read(masterKey)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(kmsDir, "master-key"), masterKey, 0644)
+	require.NoError(t, err)
+	flags.Set(t, "keystore.local_insecure_kms_directory", kmsDir)
+	flags.Set(t, "keystore.master_key_uri", "local-insecure-kms://master-key")
+	err = kms.Register(env)
+	require.NoError(t, err)
+	return env
+}
+
+// waitForDeliveries waits until the webhook has at least n deliveries
+// recorded, and returns them.
+func waitForDeliveries(t *testing.T, ctx context.Context, s *outbound_webhooks.Service, groupID, webhookID string, n int) []*owpb.Delivery {
+	var deliveries []*owpb.Delivery
+	require.Eventually(t, func() bool {
+		rsp, err := s.GetWebhookDeliveries(ctx, &owpb.GetWebhookDeliveriesRequest{
+			RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+			WebhookId:      webhookID,
+		})
+		require.NoError(t, err)
+		deliveries = rsp.GetDeliveries()
+		return len(deliveries) >= n
+	}, 10*time.Second, 10*time.Millisecond)
+	return deliveries
+}
+
+type request struct {
+	body      []byte
+	signature string
+	timestamp string
+	event     string
+}
+
+func TestDelivery(t *testing.T) {
+	env := getEnv(t)
+	ctx := context.Background()
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	authCtx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+
+	// The endpoint fails the first request, then succeeds.
+	var mu sync.Mutex
+	var requests []*request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, &request{
+			body:      body,
+			signature: r.Header.Get("X-BuildBuddy-Signature"),
+			timestamp: r.Header.Get("X-BuildBuddy-Timestamp"),
+			event:     r.Header.Get("X-BuildBuddy-Event"),
+		})
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	s := newService(t, env)
+	createRsp, err := s.CreateWebhook(authCtx, &owpb.CreateWebhookRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Webhook: &owpb.Webhook{
+			Url:             server.URL,
+			Description:     "chat",
+			EventTypes:      []owpb.EventType{owpb.EventType_INVOCATION_COMPLETED},
+			PayloadTemplate: `{"text": {{json .Invocation.User}}, "event": {{json .EventType}}}`,
+		},
+	})
+	require.NoError(t, err)
+	webhook := createRsp.GetWebhook()
+	require.NotEmpty(t, webhook.GetWebhookId())
+	require.NotEmpty(t, webhook.GetSigningSecret())
+
+	getRsp, err := s.GetWebhooks(authCtx, &owpb.GetWebhooksRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+	})
+	require.NoError(t, err)
+	require.Len(t, getRsp.GetWebhooks(), 1)
+	assert.Equal(t, "chat", getRsp.GetWebhooks()[0].GetDescription())
+	assert.Empty(t, getRsp.GetWebhooks()[0].GetSigningSecret())
+
+	// The signing secret is only stored encrypted.
+	stored := &tables.OutboundWebhook{}
+	err = env.GetDBHandle().NewQuery(ctx, "get_webhook").Raw(
+		`SELECT * FROM "OutboundWebhooks" WHERE webhook_id = ?`, webhook.GetWebhookId()).Take(stored)
+	require.NoError(t, err)
+	require.NotEmpty(t, stored.EncryptedSigningSecret)
+	assert.NotContains(t, string(stored.EncryptedSigningSecret), webhook.GetSigningSecret())
+
+	// Workflow events don't match the webhook's event types.
+	for _, role := range []string{"CI_RUNNER", ""} {
+		in := &inpb.Invocation{
+			InvocationId: "inv-" + role,
+			User:         "alice",
+			Role:         role,
+			Acl:          &aclpb.ACL{GroupId: groupID},
+		}
+		err = s.NotifyComplete(ctx, in)
+		require.NoError(t, err)
+		// Changes made after the event is queued aren't delivered.
+		in.User = "bob"
+	}
+
+	deliveries := waitForDeliveries(t, authCtx, s, groupID, webhook.GetWebhookId(), 1)
+	require.Len(t, deliveries, 1)
+	d := deliveries[0]
+	assert.Equal(t, owpb.EventType_INVOCATION_COMPLETED, d.GetEventType())
+	assert.Equal(t, "inv-", d.GetEventId())
+	assert.True(t, d.GetSuccess())
+	assert.Equal(t, int32(2), d.GetAttempts())
+	assert.Equal(t, int32(http.StatusOK), d.GetResponseStatusCode())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 2)
+	last := requests[1]
+	payload := map[string]string{}
+	require.NoError(t, json.Unmarshal(last.body, &payload))
+	assert.Equal(t, map[string]string{"text": "alice", "event": "INVOCATION_COMPLETED"}, payload)
+	assert.Equal(t, "INVOCATION_COMPLETED", last.event)
+	timestamp, err := strconv.ParseInt(last.timestamp, 10, 64)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), time.Unix(timestamp, 0), time.Minute)
+	mac := hmac.New(sha256.New, []byte(webhook.GetSigningSecret()))
+	mac.Write([]byte(last.timestamp + "."))
+	mac.Write(last.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), last.signature)
+}
+
+func TestExecutionFailedEventsAreLimitedPerInvocation(t *testing.T) {
+	env := getEnv(t)
+	ctx := context.Background()
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	authCtx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	s := newService(t, env)
+	createRsp, err := s.CreateWebhook(authCtx, &owpb.CreateWebhookRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Webhook: &owpb.Webhook{
+			Url:        server.URL,
+			EventTypes: []owpb.EventType{owpb.EventType_EXECUTION_FAILED},
+		},
+	})
+	require.NoError(t, err)
+	webhookID := createRsp.GetWebhook().GetWebhookId()
+
+	failedRsp := &repb.ExecuteResponse{Result: &repb.ActionResult{ExitCode: 1}}
+	inv1Ctx := bazel_request.OverrideRequestMetadata(authCtx, &repb.RequestMetadata{ToolInvocationId: "inv-1"})
+	for i := 0; i < 15; i++ {
+		err := s.NotifyExecutionFailed(inv1Ctx, "exec-"+strconv.Itoa(i), failedRsp)
+		require.NoError(t, err)
+	}
+	// Failures in other invocations are counted separately.
+	inv2Ctx := bazel_request.OverrideRequestMetadata(authCtx, &repb.RequestMetadata{ToolInvocationId: "inv-2"})
+	err = s.NotifyExecutionFailed(inv2Ctx, "exec-inv-2", failedRsp)
+	require.NoError(t, err)
+
+	// Shutting down waits for the queued deliveries to be made.
+	err = s.Shutdown(ctx)
+	require.NoError(t, err)
+	rsp, err := s.GetWebhookDeliveries(authCtx, &owpb.GetWebhookDeliveriesRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		WebhookId:      webhookID,
+	})
+	require.NoError(t, err)
+	require.Len(t, rsp.GetDeliveries(), 11)
+	var eventIDs []string
+	for _, d := range rsp.GetDeliveries() {
+		assert.True(t, d.GetSuccess())
+		eventIDs = append(eventIDs, d.GetEventId())
+	}
+	assert.Contains(t, eventIDs, "exec-inv-2")
+	assert.NotContains(t, eventIDs, "exec-10")
+}
+
+func TestValidation(t *testing.T) {
+	env := getEnv(t)
+	ctx := context.Background()
+	u := enterprise_testauth.CreateRandomUser(t, env, "org1.invalid")
+	groupID := u.Groups[0].Group.GroupID
+	authCtx, err := env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(ctx, u.UserID)
+	require.NoError(t, err)
+
+	s := newService(t, env)
+	flags.Set(t, "integrations.outbound_webhooks.allow_http", false)
+
+	for _, tc := range []struct {
+		name    string
+		webhook *owpb.Webhook
+	}{
+		{
+			name:    "http URL",
+			webhook: &owpb.Webhook{Url: "http://example.com/hook", EventTypes: []owpb.EventType{owpb.EventType_INVOCATION_COMPLETED}},
+		},
+		{
+			name:    "no event types",
+			webhook: &owpb.Webhook{Url: "https://example.com/hook"},
+		},
+		{
+			name:    "unknown event type",
+			webhook: &owpb.Webhook{Url: "https://example.com/hook", EventTypes: []owpb.EventType{owpb.EventType(100)}},
+		},
+		{
+			name:    "unparseable template",
+			webhook: &owpb.Webhook{Url: "https://example.com/hook", EventTypes: []owpb.EventType{owpb.EventType_EXECUTION_FAILED}, PayloadTemplate: `{"id": {{.EventID}`},
+		},
+		{
+			name:    "template renders invalid JSON",
+			webhook: &owpb.Webhook{Url: "https://example.com/hook", EventTypes: []owpb.EventType{owpb.EventType_EXECUTION_FAILED}, PayloadTemplate: `{"id": {{.EventID}}}`},
+		},
+		{
+			name:    "template references missing field",
+			webhook: &owpb.Webhook{Url: "https://example.com/hook", EventTypes: []owpb.EventType{owpb.EventType_EXECUTION_FAILED}, PayloadTemplate: `{"user": {{json .Invocation.User}}}`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := s.CreateWebhook(authCtx, &owpb.CreateWebhookRequest{
+				RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+				Webhook:        tc.webhook,
+			})
+			require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+		})
+	}
+
+	_, err = s.UpdateWebhook(authCtx, &owpb.UpdateWebhookRequest{
+		RequestContext: &ctxpb.RequestContext{GroupId: groupID},
+		Webhook: &owpb.Webhook{
+			WebhookId:  "OW123",
+			Url:        "https://example.com/hook",
+			EventTypes: []owpb.EventType{owpb.EventType_INVOCATION_COMPLETED},
+		},
+	})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
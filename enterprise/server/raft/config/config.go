@@ -9,6 +9,7 @@ import (
 
 var (
 	maxRangeSizeBytes = flag.Int64("cache.raft.max_range_size_bytes", 1e8, "If set to a value greater than 0, ranges will be split until smaller than this size")
+	minRangeSizeBytes = flag.Int64("cache.raft.min_range_size_bytes", 0, "If set to a value greater than 0, adjacent ranges will be merged as long as their combined size is smaller than this size. Should be well below cache.raft.max_range_size_bytes.")
 	// This value should be approximately 10x the config.RTTMilliseconds,
 	// but we want to include a little more time for the operation itself to
 	// complete.
@@ -19,6 +20,10 @@ func MaxRangeSizeBytes() int64 {
 	return *maxRangeSizeBytes
 }
 
+func MinRangeSizeBytes() int64 {
+	return *minRangeSizeBytes
+}
+
 func SingleRaftOpTimeout() time.Duration {
 	return *singleRaftOpTimeout
 }
@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"bytes"
 	"cmp"
 	"container/heap"
 	"context"
@@ -33,6 +34,7 @@ var (
 	minReplicasPerRange   = flag.Int("cache.raft.min_replicas_per_range", 3, "The minimum number of replicas each range should have")
 	minMetaRangeReplicas  = flag.Int("cache.raft.min_meta_range_replicas", 5, "The minimum number of replicas each range for meta range")
 	newReplicaGracePeriod = flag.Duration("cache.raft.new_replica_grace_period", 5*time.Minute, "The amount of time we allow for a new replica to catch up to the leader's before we start to consider it to be behind.")
+	preferredLeaseZone    = flag.String("cache.raft.preferred_lease_zone", "", "If set, range leases are moved to replicas in this zone when possible. Should be set to the zone of the apps serving most requests.")
 )
 
 const (
@@ -65,6 +67,7 @@ const (
 	DriverReplaceDeadReplica
 	DriverRebalanceReplica
 	DriverRebalanceLease
+	DriverMergeRange
 )
 
 type RequeueType int
@@ -118,6 +121,8 @@ func (a DriverAction) Priority() float64 {
 		return 300
 	case DriverSplitRange:
 		return 200
+	case DriverMergeRange:
+		return 100
 	case DriverRebalanceReplica, DriverRebalanceLease, DriverNoop:
 		return 0
 	default:
@@ -140,6 +145,8 @@ func (a DriverAction) String() string {
 		return "finish-replica-removal"
 	case DriverSplitRange:
 		return "split-range"
+	case DriverMergeRange:
+		return "merge-range"
 	case DriverRebalanceReplica:
 		return "consider-rebalance-replica"
 	case DriverRebalanceLease:
@@ -160,11 +167,13 @@ type IReplica interface {
 type IStore interface {
 	GetReplica(rangeID uint64) (*replica.Replica, error)
 	GetRange(rangeID uint64) *rfpb.RangeDescriptor
+	GetRangeForKey(key []byte) *rfpb.RangeDescriptor
 	HaveLease(ctx context.Context, rangeID uint64) bool
 	AddReplica(ctx context.Context, req *rfpb.AddReplicaRequest) (*rfpb.AddReplicaResponse, error)
 	RemoveReplica(ctx context.Context, req *rfpb.RemoveReplicaRequest) (*rfpb.RemoveReplicaResponse, error)
 	GetReplicaStates(ctx context.Context, rd *rfpb.RangeDescriptor) map[uint64]constants.ReplicaState
 	SplitRange(ctx context.Context, req *rfpb.SplitRangeRequest) (*rfpb.SplitRangeResponse, error)
+	MergeRanges(ctx context.Context, req *rfpb.MergeRangesRequest) (*rfpb.MergeRangesResponse, error)
 	TransferLeadership(ctx context.Context, req *rfpb.TransferLeadershipRequest) (*rfpb.TransferLeadershipResponse, error)
 	NHID() string
 }
@@ -493,8 +502,12 @@ func (rq *Queue) computeAction(ctx context.Context, repl IReplica) (DriverAction
 				}
 			}
 		}
+		if rq.findRangeToMerge(rd, repl) != nil {
+			action = DriverMergeRange
+			return action, action.Priority()
+		}
 	} else {
-		rq.log.Debugf("cannot split range %d: num of suspect replicas: %d, num deadReplicas: %d, num replicas marked for removal: %d, allReady=%t", rd.GetRangeId(), len(replicasByStatus.SuspectReplicas), numDeadReplicas, len(rd.GetRemoved()), allReady)
+		rq.log.Debugf("cannot split or merge range %d: num of suspect replicas: %d, num deadReplicas: %d, num replicas marked for removal: %d, allReady=%t", rd.GetRangeId(), len(replicasByStatus.SuspectReplicas), numDeadReplicas, len(rd.GetRemoved()), allReady)
 	}
 
 	// Do not try to rebalance replica or leases if there is a dead or suspect,
@@ -635,10 +648,35 @@ func storeHasReplica(node *rfpb.NodeDescriptor, existing []*rfpb.ReplicaDescript
 	return false
 }
 
+// zonesByNHID returns the zone of each store, keyed by NHID. Stores that don't
+// advertise a zone are omitted.
+func zonesByNHID(usages []*rfpb.StoreUsage) map[string]string {
+	zones := make(map[string]string, len(usages))
+	for _, su := range usages {
+		if zone := su.GetNode().GetZone(); zone != "" {
+			zones[su.GetNode().GetNhid()] = zone
+		}
+	}
+	return zones
+}
+
+// countReplicasByZone returns the number of replicas in each zone. Replicas on
+// stores with an unknown zone are not counted.
+func countReplicasByZone(replicas []*rfpb.ReplicaDescriptor, zones map[string]string) map[string]int {
+	counts := make(map[string]int)
+	for _, repl := range replicas {
+		if zone, ok := zones[repl.GetNhid()]; ok {
+			counts[zone]++
+		}
+	}
+	return counts
+}
+
 // findNodeForAllocation finds a target node for the range to up-replicate.
 func (rq *Queue) findNodeForAllocation(rd *rfpb.RangeDescriptor, storesWithStats *storemap.StoresWithStats) *rfpb.NodeDescriptor {
 	var candidates []*candidate
 	existing := append(rd.GetReplicas(), rd.GetRemoved()...)
+	replicasByZone := countReplicasByZone(rd.GetReplicas(), zonesByNHID(storesWithStats.Usages))
 	for _, su := range storesWithStats.Usages {
 		if storeHasReplica(su.GetNode(), existing) {
 			rq.log.Debugf("skip node %+v because the replica is already on the node", su.GetNode())
@@ -654,9 +692,11 @@ func (rq *Queue) findNodeForAllocation(rd *rfpb.RangeDescriptor, storesWithStats
 			usage:                 su,
 			replicaCount:          su.GetReplicaCount(),
 			replicaCountMeanLevel: replicaCountMeanLevel(storesWithStats, su),
+			sameZoneReplicas:      sameZoneReplicas(su, replicasByZone),
 		})
 	}
 
+	candidates = mostZoneDiverse(candidates)
 	if len(candidates) == 0 {
 		return nil
 	}
@@ -677,6 +717,7 @@ type change struct {
 	removeOp             *rfpb.RemoveReplicaRequest
 	removeDataOp         *removeDataOp
 	splitOp              *rfpb.SplitRangeRequest
+	mergeOp              *rfpb.MergeRangesRequest
 	transferLeadershipOp *rfpb.TransferLeadershipRequest
 }
 
@@ -701,6 +742,97 @@ func (rq *Queue) splitRange(rd *rfpb.RangeDescriptor) *change {
 	}
 }
 
+// ValidateRangesMergeable returns an error if the right range cannot be
+// merged into the left range. The ranges must be adjacent, have no replica
+// changes in progress, and be replicated on the same nodes, so that the data
+// of the right range is already on every node of the left range.
+func ValidateRangesMergeable(left, right *rfpb.RangeDescriptor) error {
+	if left.GetRangeId() == constants.MetaRangeID || right.GetRangeId() == constants.MetaRangeID {
+		return status.FailedPreconditionError("meta range cannot be merged")
+	}
+	if left.GetRangeId() == right.GetRangeId() {
+		return status.InvalidArgumentErrorf("cannot merge range %d with itself", left.GetRangeId())
+	}
+	if !bytes.Equal(left.GetEnd(), right.GetStart()) {
+		return status.FailedPreconditionErrorf("range %d [%q, %q) and range %d [%q, %q) are not adjacent", left.GetRangeId(), left.GetStart(), left.GetEnd(), right.GetRangeId(), right.GetStart(), right.GetEnd())
+	}
+	for _, rd := range []*rfpb.RangeDescriptor{left, right} {
+		if len(rd.GetReplicas()) == 0 {
+			return status.FailedPreconditionErrorf("no replicas in range %d", rd.GetRangeId())
+		}
+		if len(rd.GetStaging()) > 0 || len(rd.GetRemoved()) > 0 {
+			return status.FailedPreconditionErrorf("range %d has replica changes in progress", rd.GetRangeId())
+		}
+	}
+	leftNHIDs := make(map[string]struct{}, len(left.GetReplicas()))
+	for _, r := range left.GetReplicas() {
+		leftNHIDs[r.GetNhid()] = struct{}{}
+	}
+	if len(leftNHIDs) != len(right.GetReplicas()) {
+		return status.FailedPreconditionErrorf("range %d and range %d are not replicated on the same nodes", left.GetRangeId(), right.GetRangeId())
+	}
+	for _, r := range right.GetReplicas() {
+		if _, ok := leftNHIDs[r.GetNhid()]; !ok {
+			return status.FailedPreconditionErrorf("range %d and range %d are not replicated on the same nodes", left.GetRangeId(), right.GetRangeId())
+		}
+	}
+	return nil
+}
+
+// findRangeToMerge returns the range immediately to the right of rd if it can
+// be merged into rd and the size of the two ranges combined is smaller than
+// the configured min range size; otherwise, it returns nil.
+func (rq *Queue) findRangeToMerge(rd *rfpb.RangeDescriptor, repl IReplica) *rfpb.RangeDescriptor {
+	minRangeSizeBytes := config.MinRangeSizeBytes()
+	if minRangeSizeBytes <= 0 {
+		return nil
+	}
+	if maxRangeSizeBytes := config.MaxRangeSizeBytes(); maxRangeSizeBytes > 0 && minRangeSizeBytes >= maxRangeSizeBytes {
+		// The merged range would be split again right away.
+		rq.log.Debugf("not merging ranges because min range size %d is not smaller than max range size %d", minRangeSizeBytes, maxRangeSizeBytes)
+		return nil
+	}
+	right := rq.store.GetRangeForKey(rd.GetEnd())
+	if right == nil {
+		return nil
+	}
+	if err := ValidateRangesMergeable(rd, right); err != nil {
+		rq.log.Debugf("not merging range %d into range %d: %s", right.GetRangeId(), rd.GetRangeId(), err)
+		return nil
+	}
+	rightRepl, err := rq.getReplica(right.GetRangeId())
+	if err != nil {
+		return nil
+	}
+	usage, err := repl.Usage()
+	if err != nil {
+		rq.log.Errorf("failed to get Usage of replica c%dn%d", repl.RangeID(), repl.ReplicaID())
+		return nil
+	}
+	rightUsage, err := rightRepl.Usage()
+	if err != nil {
+		rq.log.Errorf("failed to get Usage of replica c%dn%d", rightRepl.RangeID(), rightRepl.ReplicaID())
+		return nil
+	}
+	if usage.GetEstimatedDiskBytesUsed()+rightUsage.GetEstimatedDiskBytesUsed() >= minRangeSizeBytes {
+		return nil
+	}
+	return right
+}
+
+func (rq *Queue) mergeRange(rd *rfpb.RangeDescriptor, repl IReplica) *change {
+	right := rq.findRangeToMerge(rd, repl)
+	if right == nil {
+		return nil
+	}
+	return &change{
+		mergeOp: &rfpb.MergeRangesRequest{
+			Left:  rd,
+			Right: right,
+		},
+	}
+}
+
 func (rq *Queue) addReplica(rd *rfpb.RangeDescriptor) *change {
 	storesWithStats := rq.storeMap.GetStoresWithStats()
 	target := rq.findNodeForAllocation(rd, storesWithStats)
@@ -764,6 +896,10 @@ type rebalanceOp struct {
 }
 
 func compareOp(op1 *rebalanceOp, op2 *rebalanceOp) int {
+	// Moves that spread the replicas across more zones come first.
+	if z1, z2 := zoneDiversityGain(op1), zoneDiversityGain(op2); z1 != z2 {
+		return cmp.Compare(z1, z2)
+	}
 	c1 := compareByScore(op1.to, op1.from)
 	c2 := compareByScore(op2.to, op2.from)
 	if c1 != c2 {
@@ -794,6 +930,38 @@ func canConvergeByRebalanceReplica(choice *rebalanceChoice, allStores *storemap.
 	return false
 }
 
+// zoneDiversityGain returns how many fewer replicas share a zone with the
+// moved replica after the move.
+func zoneDiversityGain(op *rebalanceOp) int {
+	return op.from.sameZoneReplicas - op.to.sameZoneReplicas
+}
+
+// canImproveZoneDiversity returns whether moving the existing replica to one
+// of the candidates reduces the number of replicas sharing a zone.
+func canImproveZoneDiversity(choice *rebalanceChoice) bool {
+	for _, c := range choice.candidates {
+		if c.sameZoneReplicas < choice.existing.sameZoneReplicas {
+			return true
+		}
+	}
+	return false
+}
+
+// canMoveLeaseToPreferredZone returns whether the lease can be moved from the
+// existing store, which is not in the preferred lease zone, to a candidate in
+// the preferred lease zone.
+func canMoveLeaseToPreferredZone(choice *rebalanceChoice) bool {
+	if choice.existing.inPreferredLeaseZone {
+		return false
+	}
+	for _, c := range choice.candidates {
+		if c.inPreferredLeaseZone {
+			return true
+		}
+	}
+	return false
+}
+
 func canConvergeByRebalanceLease(choice *rebalanceChoice, allStores *storemap.StoresWithStats) bool {
 	if len(choice.candidates) == 0 {
 		return false
@@ -901,6 +1069,7 @@ func (rq *Queue) findRebalanceLeaseOp(ctx context.Context, rd *rfpb.RangeDescrip
 
 	existing.leaseCount = existing.usage.LeaseCount
 	existing.leaseCountMeanLevel = leaseCountMeanLevel(storesWithStats, existing.usage)
+	existing.inPreferredLeaseZone = isInPreferredLeaseZone(existing.usage)
 	choice := &rebalanceChoice{
 		existing:   existing,
 		candidates: make([]*candidate, 0, len(rd.GetReplicas())-1),
@@ -920,13 +1089,14 @@ func (rq *Queue) findRebalanceLeaseOp(ctx context.Context, rd *rfpb.RangeDescrip
 			continue
 		}
 		choice.candidates = append(choice.candidates, &candidate{
-			nhid:                repl.GetNhid(),
-			usage:               store.usage,
-			leaseCount:          store.usage.LeaseCount,
-			leaseCountMeanLevel: leaseCountMeanLevel(storesWithStats, store.usage),
+			nhid:                 repl.GetNhid(),
+			usage:                store.usage,
+			leaseCount:           store.usage.LeaseCount,
+			leaseCountMeanLevel:  leaseCountMeanLevel(storesWithStats, store.usage),
+			inPreferredLeaseZone: isInPreferredLeaseZone(store.usage),
 		})
 	}
-	if !canConvergeByRebalanceLease(choice, storesWithStats) {
+	if !canConvergeByRebalanceLease(choice, storesWithStats) && !canMoveLeaseToPreferredZone(choice) {
 		return nil
 	}
 
@@ -986,6 +1156,8 @@ func (rq *Queue) findRebalanceReplicaOp(rd *rfpb.RangeDescriptor, storesWithStat
 		existingStores[repl.GetNhid()] = store
 	}
 
+	replicasByZone := countReplicasByZone(rd.GetReplicas(), zonesByNHID(storesWithStats.Usages))
+
 	// Find valid targeting stores for rebalancing.
 	var choices []*rebalanceChoice
 	for _, existingNHID := range nhids {
@@ -996,6 +1168,9 @@ func (rq *Queue) findRebalanceReplicaOp(rd *rfpb.RangeDescriptor, storesWithStat
 			continue
 		}
 		existing := existingStores[existingNHID]
+		// The number of the other replicas that are in the same zone as the
+		// existing store, which are the replicas that remain after the move.
+		existing.sameZoneReplicas = max(sameZoneReplicas(existing.usage, replicasByZone)-1, 0)
 		var targetCandidates []*candidate
 		for nhid, store := range allStores {
 			if _, ok := existingStores[nhid]; ok {
@@ -1005,8 +1180,21 @@ func (rq *Queue) findRebalanceReplicaOp(rd *rfpb.RangeDescriptor, storesWithStat
 			if store.fullDisk {
 				continue
 			}
-			targetCandidates = append(targetCandidates, store)
+			// Copy the store, because the number of replicas in the same
+			// zone depends on which replica is being moved.
+			target := *store
+			target.sameZoneReplicas = sameZoneReplicas(target.usage, replicasByZone)
+			if zone := target.usage.GetNode().GetZone(); zone != "" && zone == existing.usage.GetNode().GetZone() {
+				target.sameZoneReplicas--
+			}
+			if target.sameZoneReplicas > existing.sameZoneReplicas {
+				// Never move a replica to a zone with more of the range's
+				// replicas.
+				continue
+			}
+			targetCandidates = append(targetCandidates, &target)
 		}
+		targetCandidates = mostZoneDiverse(targetCandidates)
 		if len(targetCandidates) == 0 {
 			continue
 		}
@@ -1019,7 +1207,7 @@ func (rq *Queue) findRebalanceReplicaOp(rd *rfpb.RangeDescriptor, storesWithStat
 
 	if !needRebalance {
 		for _, choice := range choices {
-			if canConvergeByRebalanceReplica(choice, storesWithStats) {
+			if canConvergeByRebalanceReplica(choice, storesWithStats) || canImproveZoneDiversity(choice) {
 				needRebalance = true
 				break
 			}
@@ -1044,7 +1232,7 @@ func (rq *Queue) findRebalanceReplicaOp(rd *rfpb.RangeDescriptor, storesWithStat
 			c.replicaCount = c.usage.ReplicaCount
 		}
 		best := slices.MaxFunc(cl, compareByScoreAndID)
-		if compareByScore(best, existing) >= 0 {
+		if zoneDiversityGain(&rebalanceOp{from: existing, to: best}) > 0 || compareByScore(best, existing) >= 0 {
 			potentialOps = append(potentialOps, &rebalanceOp{
 				from: existing,
 				to:   best,
@@ -1131,6 +1319,13 @@ func (rq *Queue) findReplicaForRemoval(rd *rfpb.RangeDescriptor, replicaStateMap
 
 	storesWithStats := rq.storeMap.GetStoresWithStatsFromIDs(nhids)
 
+	allNHIDs := make([]string, 0, len(rd.GetReplicas()))
+	for _, repl := range rd.GetReplicas() {
+		allNHIDs = append(allNHIDs, repl.GetNhid())
+	}
+	zones := zonesByNHID(rq.storeMap.GetStoresWithStatsFromIDs(allNHIDs).Usages)
+	replicasByZone := countReplicasByZone(rd.GetReplicas(), zones)
+
 	var candidates []*candidate
 	for _, su := range storesWithStats.Usages {
 		candidates = append(candidates, &candidate{
@@ -1138,6 +1333,8 @@ func (rq *Queue) findReplicaForRemoval(rd *rfpb.RangeDescriptor, replicaStateMap
 			replicaCount:          su.GetReplicaCount(),
 			replicaCountMeanLevel: replicaCountMeanLevel(storesWithStats, su),
 			fullDisk:              isDiskFull(su),
+			// Don't count the replica on this store.
+			sameZoneReplicas: max(sameZoneReplicas(su, replicasByZone)-1, 0),
 		})
 	}
 
@@ -1146,6 +1343,15 @@ func (rq *Queue) findReplicaForRemoval(rd *rfpb.RangeDescriptor, replicaStateMap
 		return nil
 	}
 
+	// Only remove replicas from the zones with the most replicas of the
+	// range, so that removal never reduces zone diversity.
+	maxSameZoneReplicas := slices.MaxFunc(candidates, func(a, b *candidate) int {
+		return cmp.Compare(a.sameZoneReplicas, b.sameZoneReplicas)
+	}).sameZoneReplicas
+	candidates = slices.DeleteFunc(candidates, func(c *candidate) bool {
+		return c.sameZoneReplicas < maxSameZoneReplicas
+	})
+
 	slices.SortFunc(candidates, compareByScoreAndID)
 
 	for _, c := range candidates {
@@ -1196,6 +1402,18 @@ func (rq *Queue) applyChange(ctx context.Context, change *change) error {
 			rq.log.Infof("Successfully split range: %+v", rsp)
 		}
 	}
+	if change.mergeOp != nil {
+		rsp, err := rq.store.MergeRanges(ctx, change.mergeOp)
+		metrics.RaftMerges.With(prometheus.Labels{
+			metrics.RaftNodeHostIDLabel:      rq.store.NHID(),
+			metrics.StatusHumanReadableLabel: status.MetricsLabel(err),
+		}).Inc()
+		if err != nil {
+			rq.log.Errorf("Error merging ranges, request: %+v: %s", change.mergeOp, err)
+			return err
+		}
+		rq.log.Infof("Successfully merged ranges: %+v", rsp)
+	}
 	if change.addOp != nil {
 		rsp, err := rq.store.AddReplica(ctx, change.addOp)
 		metrics.RaftMoves.With(prometheus.Labels{
@@ -1272,6 +1490,9 @@ func (rq *Queue) processReplica(ctx context.Context, repl IReplica, action Drive
 	case DriverSplitRange:
 		rq.log.Debugf("split range (range_id: %d)", rangeID)
 		change = rq.splitRange(rd)
+	case DriverMergeRange:
+		rq.log.Debugf("merge range (range_id: %d)", rangeID)
+		change = rq.mergeRange(rd, repl)
 	case DriverAddReplica:
 		rq.log.Debugf("add replica (range_id: %d)", rangeID)
 		change = rq.addReplica(rd)
@@ -1360,6 +1581,41 @@ type candidate struct {
 	replicaCount          int64
 	leaseCount            int64
 	leaseCountMeanLevel   meanLevel
+
+	// The number of the range's other replicas that are in the same zone as
+	// this store.
+	sameZoneReplicas int
+	// Whether the store is in the preferred lease zone. Only set when
+	// choosing a store for the range lease.
+	inPreferredLeaseZone bool
+}
+
+// mostZoneDiverse returns the candidates in the zones with the fewest of the
+// range's other replicas. Zone diversity is a hard constraint on placement
+// rather than part of the score: a store is only considered if there is no
+// candidate in a zone with fewer replicas.
+func mostZoneDiverse(candidates []*candidate) []*candidate {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	minSameZoneReplicas := slices.MinFunc(candidates, func(a, b *candidate) int {
+		return cmp.Compare(a.sameZoneReplicas, b.sameZoneReplicas)
+	}).sameZoneReplicas
+	return slices.DeleteFunc(candidates, func(c *candidate) bool {
+		return c.sameZoneReplicas > minSameZoneReplicas
+	})
+}
+
+func sameZoneReplicas(su *rfpb.StoreUsage, replicasByZone map[string]int) int {
+	zone := su.GetNode().GetZone()
+	if zone == "" {
+		return 0
+	}
+	return replicasByZone[zone]
+}
+
+func isInPreferredLeaseZone(su *rfpb.StoreUsage) bool {
+	return *preferredLeaseZone != "" && su.GetNode().GetZone() == *preferredLeaseZone
 }
 
 // compare returns
@@ -1395,6 +1651,15 @@ func compareByScore(a *candidate, b *candidate) int {
 		return -int(math.Ceil(diff / float64(a.replicaCount) * 10))
 	}
 
+	// 15 or -15: the preferred lease zone takes precedence over balancing
+	// lease counts.
+	if a.inPreferredLeaseZone != b.inPreferredLeaseZone {
+		if a.inPreferredLeaseZone {
+			return 15
+		}
+		return -15
+	}
+
 	// [10, 12] or [-12, -10]
 	if a.leaseCountMeanLevel != b.leaseCountMeanLevel {
 		score := int(10 + math.Abs(float64(a.leaseCountMeanLevel-b.leaseCountMeanLevel)))
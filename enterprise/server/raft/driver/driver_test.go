@@ -13,6 +13,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/raft/storemap"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/require"
 
@@ -313,6 +314,43 @@ func TestFindNodeForAllocation(t *testing.T) {
 			},
 			expected: &rfpb.NodeDescriptor{Nhid: "nhid-4"},
 		},
+		{
+			desc: "prefer-node-in-different-zone",
+			usages: []*rfpb.StoreUsage{
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-1", Zone: "zone-a"},
+					ReplicaCount:   10,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-2", Zone: "zone-b"},
+					ReplicaCount:   10,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-3", Zone: "zone-a"},
+					ReplicaCount:   1,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-4", Zone: "zone-c"},
+					ReplicaCount:   10,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+			},
+			rd: &rfpb.RangeDescriptor{
+				RangeId: 1,
+				Replicas: []*rfpb.ReplicaDescriptor{
+					{RangeId: 1, ReplicaId: 1, Nhid: proto.String("nhid-1")},
+					{RangeId: 1, ReplicaId: 2, Nhid: proto.String("nhid-2")},
+				},
+			},
+			expected: &rfpb.NodeDescriptor{Nhid: "nhid-4", Zone: "zone-c"},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -528,6 +566,65 @@ func TestFindReplicaForRemoval(t *testing.T) {
 				Nhid:      proto.String("nhid-4"),
 			},
 		},
+		{
+			// All replicas are current, so any replica can be removed; and
+			// we want to remove a replica in the zone that has two replicas.
+			desc: "delete-replica-in-shared-zone",
+			rd: &rfpb.RangeDescriptor{
+				RangeId: 1,
+				Replicas: []*rfpb.ReplicaDescriptor{
+					{RangeId: 1, ReplicaId: 1, Nhid: proto.String("nhid-1")}, // local
+					{RangeId: 1, ReplicaId: 2, Nhid: proto.String("nhid-2")},
+					{RangeId: 1, ReplicaId: 3, Nhid: proto.String("nhid-3")},
+					{RangeId: 1, ReplicaId: 4, Nhid: proto.String("nhid-4")},
+				},
+			},
+			replicaStateMap: map[uint64]constants.ReplicaState{
+				1: constants.ReplicaStateCurrent,
+				2: constants.ReplicaStateCurrent,
+				3: constants.ReplicaStateCurrent,
+				4: constants.ReplicaStateCurrent,
+			},
+			replicasByStatus: &storemap.ReplicasByStatus{
+				LiveReplicas: []*rfpb.ReplicaDescriptor{
+					{RangeId: 1, ReplicaId: 1, Nhid: proto.String("nhid-1")}, // local
+					{RangeId: 1, ReplicaId: 2, Nhid: proto.String("nhid-2")},
+					{RangeId: 1, ReplicaId: 3, Nhid: proto.String("nhid-3")},
+					{RangeId: 1, ReplicaId: 4, Nhid: proto.String("nhid-4")},
+				},
+			},
+			usages: []*rfpb.StoreUsage{
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-1", Zone: "zone-a"},
+					ReplicaCount:   10,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-2", Zone: "zone-a"},
+					ReplicaCount:   5,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-3", Zone: "zone-b"},
+					ReplicaCount:   20,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-4", Zone: "zone-c"},
+					ReplicaCount:   20,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+			},
+			expected: &rfpb.ReplicaDescriptor{
+				RangeId:   1,
+				ReplicaId: 2,
+				Nhid:      proto.String("nhid-2"),
+			},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -832,6 +929,54 @@ func TestRebalanceReplica(t *testing.T) {
 			},
 			expected: nil,
 		},
+		{
+			desc: "move-replica-to-different-zone",
+			rd: &rfpb.RangeDescriptor{
+				RangeId: 1,
+				Replicas: []*rfpb.ReplicaDescriptor{
+					{RangeId: 1, ReplicaId: 1, Nhid: proto.String("nhid-1")}, // local
+					{RangeId: 1, ReplicaId: 2, Nhid: proto.String("nhid-2")},
+					{RangeId: 1, ReplicaId: 3, Nhid: proto.String("nhid-3")},
+				},
+			},
+			replicasByStatus: &storemap.ReplicasByStatus{
+				LiveReplicas: []*rfpb.ReplicaDescriptor{
+					{RangeId: 1, ReplicaId: 1, Nhid: proto.String("nhid-1")}, // local
+					{RangeId: 1, ReplicaId: 2, Nhid: proto.String("nhid-2")},
+					{RangeId: 1, ReplicaId: 3, Nhid: proto.String("nhid-3")},
+				},
+			},
+			usages: []*rfpb.StoreUsage{
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-1", Zone: "zone-a"},
+					ReplicaCount:   100,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-2", Zone: "zone-a"},
+					ReplicaCount:   100,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-3", Zone: "zone-b"},
+					ReplicaCount:   100,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+				{
+					Node:           &rfpb.NodeDescriptor{Nhid: "nhid-4", Zone: "zone-c"},
+					ReplicaCount:   100,
+					TotalBytesUsed: 100,
+					TotalBytesFree: 900,
+				},
+			},
+			expected: &rebalanceOp{
+				from: &candidate{nhid: "nhid-2"},
+				to:   &candidate{nhid: "nhid-4"},
+			},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -1225,3 +1370,159 @@ func TestBaseQueueAttemptRecordReset(t *testing.T) {
 	require.Equal(t, 0, task.attemptRecord.attempts)
 	require.Equal(t, DriverAddReplica, task.attemptRecord.action)
 }
+
+func TestValidateRangesMergeable(t *testing.T) {
+	replicas := func(rangeID uint64, nhids ...string) []*rfpb.ReplicaDescriptor {
+		res := make([]*rfpb.ReplicaDescriptor, 0, len(nhids))
+		for i, nhid := range nhids {
+			res = append(res, &rfpb.ReplicaDescriptor{RangeId: rangeID, ReplicaId: uint64(i + 1), Nhid: proto.String(nhid)})
+		}
+		return res
+	}
+	left := &rfpb.RangeDescriptor{
+		RangeId:  2,
+		Start:    []byte("a"),
+		End:      []byte("m"),
+		Replicas: replicas(2, "nhid-1", "nhid-2", "nhid-3"),
+	}
+	tests := []struct {
+		desc     string
+		left     *rfpb.RangeDescriptor
+		right    *rfpb.RangeDescriptor
+		expected bool
+	}{
+		{
+			desc: "adjacent-ranges-on-same-nodes",
+			left: left,
+			right: &rfpb.RangeDescriptor{
+				RangeId:  3,
+				Start:    []byte("m"),
+				End:      []byte("z"),
+				Replicas: replicas(3, "nhid-3", "nhid-1", "nhid-2"),
+			},
+			expected: true,
+		},
+		{
+			desc: "ranges-not-adjacent",
+			left: left,
+			right: &rfpb.RangeDescriptor{
+				RangeId:  3,
+				Start:    []byte("n"),
+				End:      []byte("z"),
+				Replicas: replicas(3, "nhid-1", "nhid-2", "nhid-3"),
+			},
+			expected: false,
+		},
+		{
+			desc: "ranges-on-different-nodes",
+			left: left,
+			right: &rfpb.RangeDescriptor{
+				RangeId:  3,
+				Start:    []byte("m"),
+				End:      []byte("z"),
+				Replicas: replicas(3, "nhid-1", "nhid-2", "nhid-4"),
+			},
+			expected: false,
+		},
+		{
+			desc: "ranges-with-different-number-of-replicas",
+			left: left,
+			right: &rfpb.RangeDescriptor{
+				RangeId:  3,
+				Start:    []byte("m"),
+				End:      []byte("z"),
+				Replicas: replicas(3, "nhid-1", "nhid-2"),
+			},
+			expected: false,
+		},
+		{
+			desc: "right-range-has-staging-replica",
+			left: left,
+			right: &rfpb.RangeDescriptor{
+				RangeId:  3,
+				Start:    []byte("m"),
+				End:      []byte("z"),
+				Replicas: replicas(3, "nhid-1", "nhid-2", "nhid-3"),
+				Staging:  []*rfpb.ReplicaDescriptor{{RangeId: 3, ReplicaId: 4, Nhid: proto.String("nhid-4")}},
+			},
+			expected: false,
+		},
+		{
+			desc: "meta-range",
+			left: &rfpb.RangeDescriptor{
+				RangeId:  constants.MetaRangeID,
+				Start:    constants.MetaRangePrefix,
+				End:      []byte("a"),
+				Replicas: replicas(constants.MetaRangeID, "nhid-1", "nhid-2", "nhid-3"),
+			},
+			right:    left,
+			expected: false,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			err := ValidateRangesMergeable(tc.left, tc.right)
+			require.Equal(t, tc.expected, err == nil, "err: %v", err)
+		})
+	}
+}
+
+func TestRebalanceLeaseToPreferredZone(t *testing.T) {
+	localReplicaID := uint64(1)
+	client := &testClient{
+		repls: map[string]bool{
+			"c1n1": true,
+			"c1n2": true,
+			"c1n3": false,
+		},
+	}
+	ctx := context.Background()
+	rd := &rfpb.RangeDescriptor{
+		RangeId: 1,
+		Replicas: []*rfpb.ReplicaDescriptor{
+			{RangeId: 1, ReplicaId: 1, Nhid: proto.String("nhid-1")}, // local
+			{RangeId: 1, ReplicaId: 2, Nhid: proto.String("nhid-2")},
+			{RangeId: 1, ReplicaId: 3, Nhid: proto.String("nhid-3")},
+		},
+	}
+	replicasByStatus := &storemap.ReplicasByStatus{
+		LiveReplicas: rd.GetReplicas(),
+	}
+	// Lease counts are balanced.
+	usages := []*rfpb.StoreUsage{
+		{
+			Node:       &rfpb.NodeDescriptor{Nhid: "nhid-1", Zone: "zone-a"},
+			LeaseCount: 20,
+		},
+		{
+			Node:       &rfpb.NodeDescriptor{Nhid: "nhid-2", Zone: "zone-b"},
+			LeaseCount: 20,
+		},
+		{
+			Node:       &rfpb.NodeDescriptor{Nhid: "nhid-3", Zone: "zone-b"},
+			LeaseCount: 20,
+		},
+	}
+	rq := &Queue{
+		storeMap:  newTestStoreMap(usages, replicasByStatus),
+		apiClient: client,
+	}
+	rq.baseQueue = &baseQueue{
+		log:  log.NamedSubLogger("test"),
+		impl: rq,
+	}
+
+	require.Nil(t, rq.findRebalanceLeaseOp(ctx, rd, localReplicaID))
+
+	// The lease should be moved to the replica in the preferred zone that
+	// can be connected to.
+	flags.Set(t, "cache.raft.preferred_lease_zone", "zone-b")
+	op := rq.findRebalanceLeaseOp(ctx, rd, localReplicaID)
+	require.NotNil(t, op)
+	require.Equal(t, "nhid-1", op.from.nhid)
+	require.Equal(t, "nhid-2", op.to.nhid)
+
+	// The lease should stay in the preferred zone.
+	flags.Set(t, "cache.raft.preferred_lease_zone", "zone-a")
+	require.Nil(t, rq.findRebalanceLeaseOp(ctx, rd, localReplicaID))
+}
@@ -816,6 +816,19 @@ func (s *Store) GetRange(rangeID uint64) *rfpb.RangeDescriptor {
 	return s.lookupRange(rangeID)
 }
 
+// GetRangeForKey returns the descriptor of the range on this store that
+// contains the key, or nil if there is no such range.
+func (s *Store) GetRangeForKey(key []byte) *rfpb.RangeDescriptor {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+
+	rd, ok := s.rangeMap.Lookup(key)
+	if !ok {
+		return nil
+	}
+	return rd
+}
+
 func (s *Store) UpdateRange(rd *rfpb.RangeDescriptor, r *replica.Replica) {
 	s.log.Debugf("Update range %d: [%q, %q) gen %d", rd.GetRangeId(), rd.GetStart(), rd.GetEnd(), rd.GetGeneration())
 	_, loaded := s.replicas.LoadOrStore(rd.GetRangeId(), r)
@@ -1037,9 +1050,19 @@ func (s *Store) NodeDescriptor() *rfpb.NodeDescriptor {
 		Nhid:        s.nodeHost.ID(),
 		RaftAddress: s.nodeHost.RaftAddress(),
 		GrpcAddress: s.grpcAddr,
+		Zone:        storeZone(),
 	}
 }
 
+// storeZone returns the zone the store is running in, or "local" if the zone is
+// unknown.
+func storeZone() string {
+	if zone := resources.GetZone(); zone != "" {
+		return zone
+	}
+	return "local"
+}
+
 func (s *Store) GetReplica(rangeID uint64) (*replica.Replica, error) {
 	// This code will be called by all replicas in a range when
 	// doing a split, so we do not check for range leases here.
@@ -2171,11 +2194,7 @@ func (w *updateTagsWorker) handleTask(task *updateTagsTask) {
 func (w *updateTagsWorker) updateTags() error {
 	storeTags := make(map[string]string, 0)
 
-	if zone := resources.GetZone(); zone != "" {
-		storeTags[constants.ZoneTag] = zone
-	} else {
-		storeTags[constants.ZoneTag] = "local"
-	}
+	storeTags[constants.ZoneTag] = storeZone()
 
 	storeTags[constants.GRPCAddressTag] = w.store.grpcAddr
 
@@ -2502,6 +2521,190 @@ func (s *Store) SplitRange(ctx context.Context, req *rfpb.SplitRangeRequest) (*r
 	}, nil
 }
 
+// MergeRanges merges the right range into the left range, which must be
+// adjacent and replicated on the same nodes. Since all the replicas on a node
+// share the same pebble DB, the data of the right range is already on every
+// node that has the left range once its replicas have caught up; so merging
+// extends the left range over the keys of the right range, in the same
+// transaction that updates the meta range and retires the right range. The
+// replicas of the right range are removed afterwards.
+func (s *Store) MergeRanges(ctx context.Context, req *rfpb.MergeRangesRequest) (*rfpb.MergeRangesResponse, error) {
+	if req.GetLeft() == nil || req.GetRight() == nil {
+		return nil, status.FailedPreconditionErrorf("both left and right ranges must be provided to merge: %+v", req)
+	}
+
+	// Validate both ranges against the meta range, so that we don't attempt
+	// to merge ranges that were changed since the request was made.
+	leftRange, err := s.validatedRangeAgainstMetaRange(ctx, req.GetLeft())
+	if err != nil {
+		return nil, err
+	}
+	rightRange, err := s.validatedRangeAgainstMetaRange(ctx, req.GetRight())
+	if err != nil {
+		return nil, err
+	}
+	leftRange = leftRange.CloneVT()
+	rightRange = rightRange.CloneVT()
+	if err := driver.ValidateRangesMergeable(leftRange, rightRange); err != nil {
+		return nil, err
+	}
+
+	// The left replicas will serve the keys of the right range from their
+	// local pebble DB, so every right replica must have applied all of the
+	// writes to the right range before the cutover.
+	if err := s.waitForRangeToCatchUp(ctx, rightRange); err != nil {
+		return nil, err
+	}
+
+	// The merged range must have a higher generation than both ranges so that
+	// it replaces both of them in range maps.
+	mergedRange := leftRange.CloneVT()
+	mergedRange.End = rightRange.GetEnd()
+	mergedRange.Generation = max(leftRange.GetGeneration(), rightRange.GetGeneration()) + 1
+
+	// The retired right range doesn't have a start and end, so it no longer
+	// owns any keys.
+	retiredRightRange := rightRange.CloneVT()
+	retiredRightRange.Start = nil
+	retiredRightRange.End = nil
+	retiredRightRange.Generation += 1
+
+	leftBatch := rbuilder.NewBatchBuilder()
+	if err := addLocalRangeEdits(leftRange, mergedRange, leftBatch); err != nil {
+		return nil, err
+	}
+	// Lock both ranges when we prepare the transaction. Before we finalize
+	// the transaction, we don't allow keys in either range to be written.
+	leftBatch.SetLockMappedRange(true)
+
+	rightBatch := rbuilder.NewBatchBuilder()
+	if err := addLocalRangeEdits(rightRange, retiredRightRange, rightBatch); err != nil {
+		return nil, err
+	}
+	rightBatch.SetLockMappedRange(true)
+
+	// Replace the right range with the merged range in the meta range, and
+	// delete the left range, which was keyed by its old end.
+	metaBatch := rbuilder.NewBatchBuilder()
+	metaCAS, err := casRangeEdit(keys.RangeMetaKey(mergedRange.GetEnd()), rightRange, mergedRange)
+	if err != nil {
+		return nil, err
+	}
+	metaBatch.Add(metaCAS).Add(&rfpb.DirectDeleteRequest{
+		Key: keys.RangeMetaKey(leftRange.GetEnd()),
+	})
+	mrd := s.sender.GetMetaRangeDescriptor()
+
+	tb := rbuilder.NewTxn()
+	leftStmt := tb.AddStatement()
+	leftStmt.SetRangeDescriptor(leftRange).SetBatch(leftBatch)
+	leftStmt.AddPostCommitHook(rfpb.TransactionHook_COMMIT, &rfpb.SnapshotClusterHook{})
+	// Range Validation is required on the existing ranges to make sure that
+	// the existing leader/range lease holder has the update-to-date range
+	// descriptor. See go/raft-range-validation-in-txn.
+	leftStmt.SetRangeValidationRequired(true)
+
+	rightStmt := tb.AddStatement()
+	rightStmt.SetRangeDescriptor(rightRange).SetBatch(rightBatch)
+	rightStmt.SetRangeValidationRequired(true)
+
+	metaStmt := tb.AddStatement()
+	metaStmt.SetRangeDescriptor(mrd).SetBatch(metaBatch)
+	// The meta range descriptor is from range cache and can be not-up-to date.
+	// Validating meta range can make the txn difficult to succeed.
+	// See go/raft-range-validation-in-txn.
+	metaStmt.SetRangeValidationRequired(false)
+	if err := s.txnCoordinator.RunTxn(ctx, tb); err != nil {
+		return nil, err
+	}
+
+	// Writes to the right range may have been applied between the first
+	// catch-up and the transaction locking the range. Wait for those too
+	// before removing the replicas, since a lagging replica that is removed
+	// would never apply them.
+	if err := s.waitForRangeToCatchUp(ctx, retiredRightRange); err != nil {
+		return nil, err
+	}
+
+	// The keys of the right range now belong to the merged range, so only
+	// the raft data of its replicas is removed. If this fails, the replicas
+	// are cleaned up later by the replica janitor, since the right range is
+	// no longer in the meta range.
+	for _, repl := range rightRange.GetReplicas() {
+		c, err := s.apiClient.GetForReplica(ctx, repl)
+		if err == nil {
+			_, err = c.RemoveData(ctx, &rfpb.RemoveDataRequest{
+				RangeId:   repl.GetRangeId(),
+				ReplicaId: repl.GetReplicaId(),
+			})
+		}
+		if err != nil {
+			s.log.Warningf("failed to remove replica c%dn%d of merged range: %s", repl.GetRangeId(), repl.GetReplicaId(), err)
+		}
+	}
+
+	return &rfpb.MergeRangesResponse{
+		Range: mergedRange,
+	}, nil
+}
+
+// waitForRangeToCatchUp waits until every replica of the range has applied
+// the entries that the replica on this store has applied. The replicas must
+// also have applied the given range descriptor.
+func (s *Store) waitForRangeToCatchUp(ctx context.Context, rd *rfpb.RangeDescriptor) error {
+	var lastAppliedIndex uint64
+	var err error
+	for {
+		lastAppliedIndex, err = s.getLocalLastAppliedIndex(&rfpb.Header{
+			RangeId:    rd.GetRangeId(),
+			Generation: rd.GetGeneration(),
+		})
+		// OutOfRange means that the local replica hasn't applied the range
+		// descriptor yet.
+		if err == nil || !status.IsOutOfRangeError(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		return status.InternalErrorf("failed to get last applied index of range %d: %s", rd.GetRangeId(), err)
+	}
+	for i, r := range rd.GetReplicas() {
+		if r.GetNhid() == s.NHID() {
+			err = s.waitForReplicaToCatchUp(ctx, rd.GetRangeId(), lastAppliedIndex)
+		} else {
+			err = s.waitForRemoteReplicaToCatchUp(ctx, rd, i, lastAppliedIndex)
+		}
+		if err != nil {
+			return status.WrapErrorf(err, "failed to wait for c%dn%d to catch up", r.GetRangeId(), r.GetReplicaId())
+		}
+	}
+	return nil
+}
+
+// waitForRemoteReplicaToCatchUp is like waitForReplicaToCatchUp, but for a
+// replica on another store. Reading the index fails until the replica has
+// applied the given range descriptor, so this also waits for that.
+func (s *Store) waitForRemoteReplicaToCatchUp(ctx context.Context, rd *rfpb.RangeDescriptor, replicaIdx int, desiredLastAppliedIndex uint64) error {
+	start := time.Now()
+	for {
+		lastApplied, err := s.GetRemoteLastAppliedIndex(ctx, rd, replicaIdx)
+		if err == nil && lastApplied >= desiredLastAppliedIndex {
+			s.log.Infof("Range %d took %s to catch up on %q", rd.GetRangeId(), time.Since(start), rd.GetReplicas()[replicaIdx].GetNhid())
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
 // getLocalLastAppliedIndex returns the last applied index of the replica of a
 // given range on the store
 func (s *Store) getLocalLastAppliedIndex(header *rfpb.Header) (uint64, error) {
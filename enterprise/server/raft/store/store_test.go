@@ -1009,6 +1009,67 @@ func TestSplitNonMetaRange(t *testing.T) {
 	}
 }
 
+func TestMergeRanges(t *testing.T) {
+	flags.Set(t, "cache.raft.max_range_size_bytes", 0) // disable auto splitting
+	// store_test is sensitive to cpu pressure stall on remote executor. Increase
+	// the single op timeout to make it less sensitive.
+	flags.Set(t, "cache.raft.op_timeout", 3*time.Second)
+	sf := testutil.NewStoreFactory(t)
+	s1 := sf.NewStore(t)
+	s2 := sf.NewStore(t)
+	s3 := sf.NewStore(t)
+	ctx := context.Background()
+
+	stores := []*testutil.TestingStore{s1, s2, s3}
+	sf.StartShard(t, ctx, stores...)
+
+	s := testutil.GetStoreWithRangeLease(t, ctx, stores, 2)
+	rd := s.GetRange(2)
+
+	// Split range 2 so that there are two ranges to merge.
+	written := writeNRecords(ctx, t, s, 50)
+	splitRsp, err := s.SplitRange(ctx, &rfpb.SplitRangeRequest{
+		Header: headerFromRangeDescriptor(rd),
+		Range:  rd,
+	})
+	require.NoError(t, err)
+	testutil.WaitForRangeLease(t, ctx, stores, 3)
+
+	// Ranges can only be merged into the range on their left.
+	_, err = s.MergeRanges(ctx, &rfpb.MergeRangesRequest{
+		Left:  splitRsp.GetRight(),
+		Right: splitRsp.GetLeft(),
+	})
+	require.Error(t, err)
+
+	rsp, err := s.MergeRanges(ctx, &rfpb.MergeRangesRequest{
+		Left:  splitRsp.GetLeft(),
+		Right: splitRsp.GetRight(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), rsp.GetRange().GetRangeId())
+	require.Equal(t, rd.GetStart(), rsp.GetRange().GetStart())
+	require.Equal(t, rd.GetEnd(), rsp.GetRange().GetEnd())
+
+	// The meta range should only have the merged range.
+	ranges := fetchRangeDescriptorsFromMetaRange(ctx, t, s, s.GetRange(constants.MetaRangeID))
+	require.Equal(t, 1, len(ranges))
+	require.True(t, proto.Equal(rsp.GetRange(), ranges[0]))
+
+	// Check that all files are still found.
+	for _, fr := range written {
+		readRecord(ctx, t, s, fr)
+	}
+
+	// The replicas of the right range should be removed from all stores.
+	for _, store := range stores {
+		require.Eventually(t, func() bool {
+			_, err := store.GetReplica(3)
+			return err != nil
+		}, 10*time.Second, 100*time.Millisecond)
+	}
+}
+
 func TestPostFactoSplit(t *testing.T) {
 	flags.Set(t, "cache.raft.min_replicas_per_range", 2)
 
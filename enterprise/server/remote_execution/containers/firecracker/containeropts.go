@@ -57,6 +57,10 @@ type ContainerOpts struct {
 	// across multiple VM instances.
 	NetworkPool *networking.VMNetworkPool
 
+	// EgressPolicy optionally restricts the destinations that the VM can
+	// connect to.
+	EgressPolicy *networking.EgressPolicy
+
 	// Optional flags -- these will default to sane values.
 	// They are here primarily for debugging and running
 	// VMs outside of the normal action-execution framework.
@@ -12,6 +12,7 @@ import (
 	"math"
 	"math/rand/v2"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -102,6 +103,15 @@ var (
 //go:embed guest_api_hash.sha256
 var GuestAPIHash string
 
+// guestNameservers are the DNS servers that goinit writes to the guest's
+// /etc/resolv.conf. Egress policies only allow DNS requests to these
+// addresses.
+var guestNameservers = []netip.Addr{
+	netip.MustParseAddr("8.8.8.8"),
+	netip.MustParseAddr("8.8.4.4"),
+	netip.MustParseAddr("1.1.1.1"),
+}
+
 const (
 	//TODO(MAGGIE): Bump this when we enable the balloon in prod
 
@@ -500,6 +510,10 @@ func NewProvider(env environment.Env, buildRoot, cacheRoot string) (*Provider, e
 }
 
 func (p *Provider) New(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+	egressPolicy, err := networking.ParseEgressPolicy(args.Props.NetworkEgressAllowlist, guestNameservers)
+	if err != nil {
+		return nil, err
+	}
 	var vmConfig *fcpb.VMConfiguration
 	sizeEstimate := args.Task.GetSchedulingMetadata().GetTaskSize()
 	numCPUs := int64(max(1.0, float64(sizeEstimate.GetEstimatedMilliCpu())/1000))
@@ -535,6 +549,7 @@ func (p *Provider) New(ctx context.Context, args *container.Init) (container.Com
 		OverrideSnapshotKey:    args.Props.OverrideSnapshotKey,
 		ExecutorConfig:         p.executorConfig,
 		NetworkPool:            p.networkPool,
+		EgressPolicy:           egressPolicy,
 	}
 	c, err := NewContainer(ctx, p.env, args.Task.GetExecutionTask(), opts)
 	if err != nil {
@@ -559,8 +574,9 @@ type FirecrackerContainer struct {
 	rmOnce *sync.Once
 	rmErr  error
 
-	networkPool *networking.VMNetworkPool
-	network     *networking.VMNetwork
+	networkPool  *networking.VMNetworkPool
+	network      *networking.VMNetwork
+	egressPolicy *networking.EgressPolicy
 
 	// Whether the VM was recycled.
 	recycled bool
@@ -672,6 +688,7 @@ func NewContainer(ctx context.Context, env environment.Env, task *repb.Execution
 		cpuWeightMillis:  opts.CPUWeightMillis,
 		cgroupParent:     opts.CgroupParent,
 		networkPool:      opts.NetworkPool,
+		egressPolicy:     opts.EgressPolicy,
 		cgroupSettings:   &scpb.CgroupSettings{},
 		blockDevice:      opts.BlockDevice,
 		env:              env,
@@ -1688,7 +1705,7 @@ func (c *FirecrackerContainer) setupNetworking(ctx context.Context) error {
 	if c.networkPool != nil {
 		if network := c.networkPool.Get(ctx); network != nil {
 			c.network = network
-			return nil
+			return c.applyEgressPolicy(ctx)
 		}
 	}
 
@@ -1698,6 +1715,18 @@ func (c *FirecrackerContainer) setupNetworking(ctx context.Context) error {
 	}
 	c.network = network
 
+	return c.applyEgressPolicy(ctx)
+}
+
+// applyEgressPolicy restricts outgoing connections from the VM if the action
+// specified an egress allowlist.
+func (c *FirecrackerContainer) applyEgressPolicy(ctx context.Context) error {
+	if c.egressPolicy == nil {
+		return nil
+	}
+	if err := c.network.ApplyEgressPolicy(ctx, c.egressPolicy); err != nil {
+		return status.UnavailableErrorf("apply egress policy: %s", err)
+	}
 	return nil
 }
 
@@ -2236,6 +2265,13 @@ func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdi
 	ctx, cancel := c.monitorVMContext(ctx)
 	defer cancel()
 
+	// Only report the connections that are denied while this command runs,
+	// and leave the rest to other commands running in the VM.
+	var deniedEgressCursor networking.DeniedEgressCursor
+	if c.network != nil {
+		deniedEgressCursor = c.network.DeniedEgressCursor()
+	}
+
 	stage := "init"
 	result := &interfaces.CommandResult{ExitCode: commandutil.NoExitCode}
 	defer func() {
@@ -2248,6 +2284,13 @@ func (c *FirecrackerContainer) Exec(ctx context.Context, cmd *repb.Command, stdi
 		}
 		result.AuxiliaryLogs[vmLogTailFileName] = c.vmLog.Tail()
 
+		// Attach the connections denied by the egress policy, if any.
+		if c.network != nil {
+			if deniedLog := c.network.DeniedEgressLog(deniedEgressCursor); len(deniedLog) > 0 {
+				result.AuxiliaryLogs[networking.DeniedEgressLogName] = deniedLog
+			}
+		}
+
 		execDuration := time.Since(start)
 		log.CtxDebugf(ctx, "Exec took %s", execDuration)
 
@@ -15,6 +15,7 @@ import (
 	"io"
 	"maps"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
@@ -213,12 +214,25 @@ type provider struct {
 	// to provide "fake" cpu info that is appropriate to the container's
 	// configured memory and cpu.
 	lxcfsMount string
+
+	// Optional. nil if executor.oci.rootless == false.
+	rootless *rootlessConfig
 }
 
 func NewProvider(env environment.Env, buildRoot, cacheRoot string) (*provider, error) {
-	// Enable masquerading on the host if it isn't enabled already.
-	if err := networking.EnableMasquerading(env.GetServerContext()); err != nil {
-		return nil, status.WrapError(err, "enable masquerading")
+	var rootlessCfg *rootlessConfig
+	if *rootless {
+		cfg, err := newRootlessConfig(buildRoot)
+		if err != nil {
+			return nil, status.WrapError(err, "configure rootless mode")
+		}
+		rootlessCfg = cfg
+	} else {
+		// Enable masquerading on the host if it isn't enabled already.
+		// Rootless containers use slirp4netns instead.
+		if err := networking.EnableMasquerading(env.GetServerContext()); err != nil {
+			return nil, status.WrapError(err, "enable masquerading")
+		}
 	}
 
 	// Try to find a usable runtime if the runtime flag is not explicitly set.
@@ -322,7 +336,7 @@ func NewProvider(env environment.Env, buildRoot, cacheRoot string) (*provider, e
 	if err := os.MkdirAll(filepath.Join(imageCacheRoot, imageCacheVersion), 0755); err != nil {
 		return nil, err
 	}
-	if err := cleanStaleImageCacheDirs(imageCacheRoot); err != nil {
+	if err := cleanStaleImageCacheDirs(env.GetServerContext(), imageCacheRoot, rootlessCfg); err != nil {
 		log.Warningf("Failed to clean up old image cache versions: %s", err)
 	}
 	resolver, err := oci.NewResolver(env)
@@ -333,10 +347,14 @@ func NewProvider(env environment.Env, buildRoot, cacheRoot string) (*provider, e
 	if err != nil {
 		return nil, err
 	}
+	imageStore.rootless = rootlessCfg
 	statusz.AddSection(imagesStatuszSectionName, "OCI images", imageStore)
 
-	networkPool := networking.NewContainerNetworkPool(*netPoolSize)
-	env.GetHealthChecker().RegisterShutdownFunction(networkPool.Shutdown)
+	var networkPool *networking.ContainerNetworkPool
+	if rootlessCfg == nil {
+		networkPool = networking.NewContainerNetworkPool(*netPoolSize)
+		env.GetHealthChecker().RegisterShutdownFunction(networkPool.Shutdown)
+	}
 
 	return &provider{
 		env:            env,
@@ -348,10 +366,38 @@ func NewProvider(env environment.Env, buildRoot, cacheRoot string) (*provider, e
 		imageStore:     imageStore,
 		networkPool:    networkPool,
 		lxcfsMount:     lxcfsMount,
+		rootless:       rootlessCfg,
 	}, nil
 }
 
+// containerNameservers returns the DNS servers that containers are configured
+// to use: the executor.oci.dns server if set, otherwise the host's.
+func containerNameservers() ([]netip.Addr, error) {
+	if *dns == "" {
+		return networking.HostNameservers()
+	}
+	addr, err := netip.ParseAddr(*dns)
+	if err != nil {
+		return nil, status.FailedPreconditionErrorf("invalid executor.oci.dns address %q: %s", *dns, err)
+	}
+	return []netip.Addr{addr}, nil
+}
+
 func (p *provider) New(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+	var egressPolicy *networking.EgressPolicy
+	if len(args.Props.NetworkEgressAllowlist) > 0 {
+		if p.rootless != nil {
+			return nil, status.FailedPreconditionError("network egress allowlists are not supported by executors running in rootless mode")
+		}
+		nameservers, err := containerNameservers()
+		if err != nil {
+			return nil, err
+		}
+		egressPolicy, err = networking.ParseEgressPolicy(args.Props.NetworkEgressAllowlist, nameservers)
+		if err != nil {
+			return nil, err
+		}
+	}
 	container := &ociContainer{
 		env:            p.env,
 		runtime:        p.runtime,
@@ -362,6 +408,7 @@ func (p *provider) New(ctx context.Context, args *container.Init) (container.Com
 		imageStore:     p.imageStore,
 		networkPool:    p.networkPool,
 		lxcfsMount:     p.lxcfsMount,
+		rootless:       p.rootless,
 
 		blockDevice:       args.BlockDevice,
 		cgroupParent:      args.CgroupParent,
@@ -372,6 +419,7 @@ func (p *provider) New(ctx context.Context, args *container.Init) (container.Com
 		user:              args.Props.DockerUser,
 		forceRoot:         args.Props.DockerForceRoot,
 		persistentVolumes: args.Props.PersistentVolumes,
+		egressPolicy:      egressPolicy,
 
 		milliCPU: args.Task.GetSchedulingMetadata().GetTaskSize().GetEstimatedMilliCpu(),
 	}
@@ -405,8 +453,13 @@ type ociContainer struct {
 	stats                  container.UsageStats
 	networkPool            *networking.ContainerNetworkPool
 	network                *networking.ContainerNetwork
+	egressPolicy           *networking.EgressPolicy
 	lxcfsMount             string
 	releaseCPUs            func()
+	rootless               *rootlessConfig
+	rootlessNamespace      *rootlessNamespace
+	// The user that the container process runs as.
+	processUser *specs.User
 
 	imageRef       string
 	networkEnabled bool
@@ -499,7 +552,7 @@ func (c *ociContainer) createBundle(ctx context.Context, cmd *repb.Command) erro
 	// Note: we don't add 'host.containers.internal' here because we don't
 	// support networking across containers.
 	hostsFileLines := strings.Split(strings.TrimSpace(string(hostsFile)), "\n")
-	if c.network.HostNetwork() != nil {
+	if c.network != nil && c.network.HostNetwork() != nil {
 		hostsFileLines = append(hostsFileLines, fmt.Sprintf("%s %s", c.network.HostNetwork().NamespacedIP(), c.containerName()))
 	} else {
 		hostsFileLines = append(hostsFileLines, fmt.Sprintf("127.0.0.1 %s", c.containerName()))
@@ -593,12 +646,17 @@ func (c *ociContainer) Run(ctx context.Context, cmd *repb.Command, workDir strin
 		return commandutil.ErrorResult(status.UnavailableErrorf("create OCI bundle: %s", err))
 	}
 
-	return c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
+	res := c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
 		// Use --keep to prevent the cgroup from being deleted when the
 		// container exits, since we still want to be able to look at stats,
 		// events, etc. after completion.
 		return c.invokeRuntime(ctx, nil /*=cmd*/, &interfaces.Stdio{}, 0 /*=waitDelay*/, "run", "--keep", "--bundle="+c.bundlePath(), c.cid)
 	})
+	c.restoreWorkspaceOwnership(ctx)
+	// The network was created for this command, so report everything that
+	// was denied on it.
+	c.addDeniedEgressLog(res, networking.DeniedEgressCursor{})
+	return res
 }
 
 func (c *ociContainer) Create(ctx context.Context, workDir string) error {
@@ -669,9 +727,13 @@ func (c *ociContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *inter
 	}
 	args = append(args, c.cid)
 
-	return c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
+	deniedEgressCursor := c.deniedEgressCursor()
+	res := c.doWithStatsTracking(ctx, func(ctx context.Context) *interfaces.CommandResult {
 		return c.invokeRuntime(ctx, cmd, stdio, 1*time.Microsecond, args...)
 	})
+	c.restoreWorkspaceOwnership(ctx)
+	c.addDeniedEgressLog(res, deniedEgressCursor)
+	return res
 }
 
 func (c *ociContainer) Signal(ctx context.Context, sig syscall.Signal) error {
@@ -713,28 +775,33 @@ func (c *ociContainer) Remove(ctx context.Context) error {
 		firstErr = status.UnavailableErrorf("delete container: %s", err)
 	}
 
+	// Unmount the rootfs before the merged mounts that it uses as lower
+	// dirs. This matters for fuse-overlayfs, which keeps its lower dirs busy.
+	if c.overlayfsMounted {
+		if err := c.unmountOverlay(ctx, c.rootfsPath()); err != nil && firstErr == nil {
+			firstErr = status.UnavailableErrorf("unmount overlayfs: %s", err)
+		}
+	}
+
 	if len(c.mergedMounts) > 0 {
 		for _, merged := range c.mergedMounts {
-			if err := unix.Unmount(merged, unix.MNT_FORCE); err != nil && firstErr == nil {
+			if err := c.unmountOverlay(ctx, merged); err != nil && firstErr == nil {
 				firstErr = status.UnavailableErrorf("unmount overlayfs: %s", err)
 			}
 		}
 	}
 
-	if c.overlayfsMounted {
-		if err := unix.Unmount(c.rootfsPath(), unix.MNT_FORCE); err != nil && firstErr == nil {
-			firstErr = status.UnavailableErrorf("unmount overlayfs: %s", err)
-		}
+	// Remove the bundle before cleaning up the network, since in rootless
+	// mode, files created by non-root container users can only be removed
+	// from inside the container's user namespace.
+	if err := c.removeBundle(ctx); err != nil && firstErr == nil {
+		firstErr = status.UnavailableErrorf("remove bundle: %s", err)
 	}
 
 	if err := c.cleanupNetwork(ctx); err != nil && firstErr == nil {
 		firstErr = status.UnavailableErrorf("cleanup network: %s", err)
 	}
 
-	if err := os.RemoveAll(c.bundlePath()); err != nil && firstErr == nil {
-		firstErr = status.UnavailableErrorf("remove bundle: %s", err)
-	}
-
 	// Remove the cgroup in case the delete command didn't work as expected.
 	if err := os.Remove(c.cgroupPath()); err != nil && firstErr == nil && !os.IsNotExist(err) {
 		firstErr = status.UnavailableErrorf("remove container cgroup: %s", err)
@@ -747,13 +814,29 @@ func (c *ociContainer) Remove(ctx context.Context) error {
 	return firstErr
 }
 
+func (c *ociContainer) removeBundle(ctx context.Context) error {
+	if c.rootlessNamespace != nil {
+		return c.rootlessNamespace.RemoveAll(ctx, c.bundlePath())
+	}
+	return os.RemoveAll(c.bundlePath())
+}
+
 func (c *ociContainer) createNetwork(ctx context.Context) error {
+	if c.rootless != nil {
+		ns, err := newRootlessNamespace(ctx, c.rootless.idMappings, c.networkEnabled)
+		if err != nil {
+			return status.WrapError(err, "create rootless namespace")
+		}
+		c.rootlessNamespace = ns
+		return nil
+	}
+
 	// TODO: should we pool loopback-only networks too?
 	if c.networkEnabled {
 		network := c.networkPool.Get(ctx)
 		if network != nil {
 			c.network = network
-			return nil
+			return c.applyEgressPolicy(ctx)
 		}
 	}
 
@@ -763,10 +846,54 @@ func (c *ociContainer) createNetwork(ctx context.Context) error {
 		return status.WrapError(err, "create network")
 	}
 	c.network = network
+	return c.applyEgressPolicy(ctx)
+}
+
+// applyEgressPolicy restricts outgoing connections from the container if the
+// action specified an egress allowlist.
+func (c *ociContainer) applyEgressPolicy(ctx context.Context) error {
+	if c.egressPolicy == nil || !c.networkEnabled {
+		return nil
+	}
+	if err := c.network.ApplyEgressPolicy(ctx, c.egressPolicy); err != nil {
+		return status.WrapError(err, "apply egress policy")
+	}
 	return nil
 }
 
+// deniedEgressCursor returns the cursor to pass to addDeniedEgressLog once a
+// command that is about to run exits.
+func (c *ociContainer) deniedEgressCursor() networking.DeniedEgressCursor {
+	if c.network == nil {
+		return networking.DeniedEgressCursor{}
+	}
+	return c.network.DeniedEgressCursor()
+}
+
+// addDeniedEgressLog adds the connections that were denied by the egress
+// policy since the cursor was taken to the command's auxiliary logs. Other
+// commands running in the container, such as debug shells, may have caused
+// some of them.
+func (c *ociContainer) addDeniedEgressLog(res *interfaces.CommandResult, cursor networking.DeniedEgressCursor) {
+	if c.network == nil {
+		return
+	}
+	deniedLog := c.network.DeniedEgressLog(cursor)
+	if len(deniedLog) == 0 {
+		return
+	}
+	if res.AuxiliaryLogs == nil {
+		res.AuxiliaryLogs = map[string][]byte{}
+	}
+	res.AuxiliaryLogs[networking.DeniedEgressLogName] = deniedLog
+}
+
 func (c *ociContainer) cleanupNetwork(ctx context.Context) error {
+	if ns := c.rootlessNamespace; ns != nil {
+		c.rootlessNamespace = nil
+		return ns.Close()
+	}
+
 	n := c.network
 	c.network = nil
 
@@ -784,6 +911,25 @@ func (c *ociContainer) cleanupNetwork(ctx context.Context) error {
 	return n.Cleanup(ctx)
 }
 
+func (c *ociContainer) networkNamespacePath() string {
+	if c.rootlessNamespace != nil {
+		if !c.networkEnabled {
+			// Let the runtime create a new network namespace, which only has
+			// a loopback interface.
+			return ""
+		}
+		return c.rootlessNamespace.NetworkNamespacePath()
+	}
+	return c.network.NamespacePath()
+}
+
+func (c *ociContainer) networkStats(ctx context.Context) (*repb.NetworkStats, error) {
+	if c.rootlessNamespace != nil {
+		return c.rootlessNamespace.NetworkStats(ctx)
+	}
+	return c.network.Stats(ctx)
+}
+
 func (c *ociContainer) Stats(ctx context.Context) (*repb.UsageStats, error) {
 	return c.stats.TaskStats(), nil
 }
@@ -828,7 +974,7 @@ func (c *ociContainer) doWithStatsTracking(ctx context.Context, invokeRuntimeFn
 		log.CtxWarning(ctx, status.Message(err))
 	}
 
-	networkStats, err := c.network.Stats(ctx)
+	networkStats, err := c.networkStats(ctx)
 	if err != nil {
 		log.CtxWarningf(ctx, "Failed to get network stats: %s", err)
 	} else {
@@ -929,6 +1075,10 @@ func (c *ociContainer) createRootfs(ctx context.Context) error {
 	// - userxattr is needed for compatibility with older kernels
 	// - volatile disables fsync, as a performance optimization
 	optionsTpl := "lowerdir=%s,upperdir=%s,workdir=%s,userxattr,volatile"
+	if c.rootless != nil && *rootlessOverlay == rootlessOverlayFUSE {
+		// fuse-overlayfs doesn't support these options.
+		optionsTpl = "lowerdir=%s,upperdir=%s,workdir=%s"
+	}
 	tplLen := len(optionsTpl) - 3*len("%s")
 	var lowerDirs []string
 	for _, layer := range image.Layers {
@@ -975,7 +1125,7 @@ func (c *ociContainer) createRootfs(ctx context.Context) error {
 		if len(mntOpts) > maxMntOptsLength {
 			return fmt.Errorf("mount options too long: %d / %d. Consider using container image with fewer layers.", len(mntOpts), maxMntOptsLength)
 		}
-		if err := unix.Mount("none", merged, "overlay", 0, mntOpts); err != nil {
+		if err := c.mountOverlay(ctx, merged, mntOpts); err != nil {
 			return fmt.Errorf("mount overlayfs: %w", err)
 		}
 		c.mergedMounts = append(c.mergedMounts, merged)
@@ -991,19 +1141,33 @@ func (c *ociContainer) createRootfs(ctx context.Context) error {
 	slices.Reverse(lowerDirs)
 
 	// TODO: do this mount inside a namespace so that it gets removed even if
-	// the executor crashes (also needed for rootless support)
+	// the executor crashes (rootless mode already does this).
 	options := fmt.Sprintf(optionsTpl, strings.Join(lowerDirs, ":"), upperdir, workdir)
 	if len(options) > maxMntOptsLength {
 		return fmt.Errorf("mount options too long: %d / %d. Consider using container image with fewer layers.", len(options), maxMntOptsLength)
 	}
 	log.CtxDebugf(ctx, "Mounting overlayfs to %q, options=%q, length=%d", c.rootfsPath(), options, len(options))
-	if err := unix.Mount("none", c.rootfsPath(), "overlay", 0, options); err != nil {
+	if err := c.mountOverlay(ctx, c.rootfsPath(), options); err != nil {
 		return fmt.Errorf("mount overlayfs: %w", err)
 	}
 	c.overlayfsMounted = true
 	return nil
 }
 
+func (c *ociContainer) mountOverlay(ctx context.Context, target, options string) error {
+	if c.rootlessNamespace != nil {
+		return c.rootlessNamespace.MountOverlay(ctx, target, options)
+	}
+	return unix.Mount("none", target, "overlay", 0, options)
+}
+
+func (c *ociContainer) unmountOverlay(ctx context.Context, target string) error {
+	if c.rootlessNamespace != nil {
+		return c.rootlessNamespace.Unmount(ctx, target)
+	}
+	return unix.Unmount(target, unix.MNT_FORCE)
+}
+
 func installBusybox(ctx context.Context, path string) error {
 	busyboxPath, err := exec.LookPath("busybox")
 	if err != nil {
@@ -1160,7 +1324,7 @@ func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*spec
 				{Type: specs.CgroupNamespace},
 				{
 					Type: specs.NetworkNamespace,
-					Path: c.network.NamespacePath(),
+					Path: c.networkNamespacePath(),
 				},
 			},
 			Seccomp: &seccomp,
@@ -1231,6 +1395,12 @@ func (c *ociContainer) createSpec(ctx context.Context, cmd *repb.Command) (*spec
 	spec.Mounts = append(spec.Mounts, c.persistentVolumeMounts...)
 	spec.Mounts = append(spec.Mounts, *mounts...)
 	spec.Linux.Devices = append(spec.Linux.Devices, *devices...)
+	if c.rootless != nil {
+		if err := c.rootless.configureSpec(&spec); err != nil {
+			return nil, err
+		}
+	}
+	c.processUser = &spec.Process.User
 	return &spec, nil
 }
 
@@ -1272,6 +1442,8 @@ func (c *ociContainer) invokeRuntime(ctx context.Context, command *repb.Command,
 	}
 	if *runtimeRoot != "" {
 		globalArgs = append(globalArgs, "--root="+*runtimeRoot)
+	} else if c.rootless != nil {
+		globalArgs = append(globalArgs, "--root="+c.rootless.runtimeRoot)
 	}
 
 	runtimeArgs := append(globalArgs, args...)
@@ -1285,7 +1457,12 @@ func (c *ociContainer) invokeRuntime(ctx context.Context, command *repb.Command,
 
 	log.CtxDebugf(ctx, "Running %v", runtimeArgs)
 
-	cmd := exec.CommandContext(ctx, runtimeArgs[0], runtimeArgs[1:]...)
+	var cmd *exec.Cmd
+	if c.rootlessNamespace != nil {
+		cmd = c.rootlessNamespace.Command(ctx, true /*=mountNamespace*/, runtimeArgs...)
+	} else {
+		cmd = exec.CommandContext(ctx, runtimeArgs[0], runtimeArgs[1:]...)
+	}
 	cmd.Dir = wd
 	var stdout *bytes.Buffer
 	var stderr *bytes.Buffer
@@ -1318,7 +1495,11 @@ func (c *ociContainer) invokeRuntime(ctx context.Context, command *repb.Command,
 	// when it is killed, the container process gets killed automatically
 	// instead of getting reparented and continuing to execute.
 	// TODO: figure out why this is only needed for run and not exec.
-	if args[0] == "run" {
+	//
+	// Unprivileged users can't create pid namespaces outside of a user
+	// namespace. In rootless mode, the container is killed when it is
+	// removed instead.
+	if args[0] == "run" && c.rootlessNamespace == nil {
 		cmd.SysProcAttr.Cloneflags = syscall.CLONE_NEWPID
 	}
 
@@ -1354,9 +1535,6 @@ func (c *ociContainer) invokeRuntime(ctx context.Context, command *repb.Command,
 }
 
 func getUser(ctx context.Context, image *Image, rootfsPath string, dockerUserProp string, dockerForceRootProp bool) (*specs.User, error) {
-	// TODO: for rootless support we'll need to handle the case where the
-	// executor user doesn't have permissions to access files created as the
-	// requested user ID
 	spec := ""
 	if image != nil {
 		spec = image.ConfigFile.Config.User
@@ -1367,7 +1545,10 @@ func getUser(ctx context.Context, image *Image, rootfsPath string, dockerUserPro
 	if dockerForceRootProp {
 		spec = "0"
 	}
-	if spec == "" {
+	if spec == "" && *rootless {
+		// In rootless mode, root in the container is the executor user.
+		spec = "0:0"
+	} else if spec == "" {
 		// Inherit the current uid/gid.
 		spec = fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())
 	}
@@ -1476,6 +1657,9 @@ type ImageStore struct {
 	imagePullGroup singleflight.Group[string, *Image]
 	layerPullGroup singleflight.Group[string, any]
 
+	// Optional. nil if executor.oci.rootless == false.
+	rootless *rootlessConfig
+
 	mu           sync.RWMutex
 	cachedImages map[string]*Image
 }
@@ -1598,7 +1782,7 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 			// the credentials in the key here too.
 			key := hash.Strings(destDir, creds.Username, creds.Password)
 			_, _, err = s.layerPullGroup.Do(ctx, key, func(ctx context.Context) (any, error) {
-				return nil, downloadLayer(ctx, layer, destDir)
+				return nil, downloadLayer(ctx, layer, destDir, s.rootless)
 			})
 			return err
 		})
@@ -1620,11 +1804,12 @@ func (s *ImageStore) pull(ctx context.Context, imageName string, creds oci.Crede
 
 // downloadLayer downloads and extracts the given layer to the given destination
 // dir. The extracted layer is suitable for use as an overlayfs lowerdir.
+// rootlessCfg is nil unless the executor runs in rootless mode.
 //
 // For reference implementations, see:
 //   - Podman: https://github.com/containers/storage/blob/664fe5d9b95004e1be3eee004d56a1715c8ca790/pkg/archive/archive.go#L707-L729
 //   - Moby (Docker): https://github.com/moby/moby/blob/9633556bef3eb20dfe888903660c3df89a73605b/pkg/archive/archive.go#L726-L735
-func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
+func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string, rootlessCfg *rootlessConfig) error {
 	rc, err := layer.Uncompressed()
 	if err != nil {
 		return status.UnavailableErrorf("get layer reader: %s", err)
@@ -1635,7 +1820,34 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 	if err := os.MkdirAll(tempUnpackDir, 0755); err != nil {
 		return status.UnavailableErrorf("create layer unpack dir: %s", err)
 	}
-	defer os.RemoveAll(tempUnpackDir)
+	defer func() {
+		if rootlessCfg != nil {
+			if err := rootlessCfg.removeAll(ctx, tempUnpackDir); err != nil {
+				log.CtxWarningf(ctx, "Failed to remove temp layer dir %q: %s", tempUnpackDir, err)
+			}
+			return
+		}
+		os.RemoveAll(tempUnpackDir)
+	}()
+
+	// In rootless mode, the executor can't change file owners directly, so
+	// files are extracted as root in the container (the executor user), and
+	// files owned by other users are chowned from inside a user namespace
+	// once everything is extracted. Directories are made writable by their
+	// owner while extracting, since otherwise their contents couldn't be
+	// extracted, and their modes are restored when they're chowned.
+	preserveOwnership := rootlessCfg == nil
+	var owners map[fileOwnership][]string
+	setOwnerLater := func(path string, header *tar.Header, mode os.FileMode) {
+		if header.Uid == 0 && header.Gid == 0 {
+			return
+		}
+		if owners == nil {
+			owners = map[fileOwnership][]string{}
+		}
+		o := fileOwnership{UID: header.Uid, GID: header.Gid, Mode: mode}
+		owners[o] = append(owners[o], path)
+	}
 
 	tr := tar.NewReader(rc)
 	for {
@@ -1674,7 +1886,7 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 		if strings.HasPrefix(base, whiteoutPrefix) {
 			// Directory whiteout
 			if base == whiteoutPrefix+whiteoutPrefix+".opq" {
-				if err := unix.Setxattr(dir, "trusted.overlay.opaque", []byte{'y'}, 0); err != nil {
+				if err := unix.Setxattr(dir, opaqueXattr(), []byte{'y'}, 0); err != nil {
 					return status.UnavailableErrorf("setxattr on deleted dir: %s", err)
 				}
 				continue
@@ -1683,17 +1895,27 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 			// File whiteout: Mark the file for deletion in overlayfs.
 			originalBase := base[len(whiteoutPrefix):]
 			originalPath := filepath.Join(dir, originalBase)
-			if err := unix.Mknod(originalPath, unix.S_IFCHR, 0); err != nil {
-				return status.UnavailableErrorf("mknod for whiteout marker: %s", err)
+			if err := createWhiteout(originalPath); err != nil {
+				return err
 			}
 			continue
 		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if err := os.MkdirAll(file, os.FileMode(header.Mode)); err != nil {
+			mode := os.FileMode(header.Mode)
+			if !preserveOwnership {
+				mode |= 0700
+			}
+			if err := os.MkdirAll(file, mode); err != nil {
 				return status.UnavailableErrorf("create directory: %s", err)
 			}
+			if !preserveOwnership {
+				if file != tempUnpackDir {
+					setOwnerLater(file, header, os.FileMode(header.Mode).Perm())
+				}
+				continue
+			}
 			if err := os.Chown(file, header.Uid, header.Gid); err != nil {
 				return status.UnavailableErrorf("chown directory: %s", err)
 			}
@@ -1706,9 +1928,13 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 				f.Close()
 				return status.UnavailableErrorf("copy file content: %s", err)
 			}
-			if err := f.Chown(header.Uid, header.Gid); err != nil {
-				f.Close()
-				return status.UnavailableErrorf("chown file: %s", err)
+			if preserveOwnership {
+				if err := f.Chown(header.Uid, header.Gid); err != nil {
+					f.Close()
+					return status.UnavailableErrorf("chown file: %s", err)
+				}
+			} else {
+				setOwnerLater(file, header, 0)
 			}
 			f.Close()
 		case tar.TypeSymlink:
@@ -1717,6 +1943,10 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 			if err := os.Symlink(header.Linkname, file); err != nil {
 				return status.UnavailableErrorf("create symlink: %s", err)
 			}
+			if !preserveOwnership {
+				setOwnerLater(file, header, 0)
+				continue
+			}
 			if err := os.Lchown(file, header.Uid, header.Gid); err != nil {
 				return status.UnavailableErrorf("chown link: %s", err)
 			}
@@ -1732,6 +1962,11 @@ func downloadLayer(ctx context.Context, layer ctr.Layer, destDir string) error {
 			}
 		}
 	}
+	if rootlessCfg != nil {
+		if err := rootlessCfg.chownExtractedFiles(ctx, owners); err != nil {
+			return status.UnavailableErrorf("chown extracted files: %s", err)
+		}
+	}
 
 	if err := os.Rename(tempUnpackDir, destDir); err != nil {
 		// If the dest dir already exists then it's most likely because we were
@@ -1848,8 +2083,9 @@ func tmpSuffix() string {
 }
 
 // Removes any versioned image cache directories under the given path which
-// do not match the current version.
-func cleanStaleImageCacheDirs(root string) error {
+// do not match the current version. rootlessCfg is nil unless the executor
+// runs in rootless mode.
+func cleanStaleImageCacheDirs(ctx context.Context, root string, rootlessCfg *rootlessConfig) error {
 	entries, err := os.ReadDir(root)
 	if err != nil {
 		return fmt.Errorf("read dir %q: %w", root, err)
@@ -1860,7 +2096,11 @@ func cleanStaleImageCacheDirs(root string) error {
 		}
 		path := filepath.Join(root, e.Name())
 		log.Infof("Removing stale image cache at %q", path)
-		if err := os.RemoveAll(path); err != nil {
+		removeAll := os.RemoveAll
+		if rootlessCfg != nil {
+			removeAll = func(path string) error { return rootlessCfg.removeAll(ctx, path) }
+		}
+		if err := removeAll(path); err != nil {
 			return fmt.Errorf("remove %q: %w", path, err)
 		}
 	}
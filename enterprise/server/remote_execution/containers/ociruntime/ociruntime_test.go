@@ -11,7 +11,9 @@ import (
 	"math/rand/v2"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -70,12 +72,28 @@ func init() {
 	*ociruntime.Runtime = runtimePath
 }
 
+// The environment variable that is set when a rootless test is re-run as an
+// unprivileged user.
+const unprivilegedTestEnvVar = "OCIRUNTIME_TEST_UNPRIVILEGED"
+
+// The user that rootless tests are re-run as when the test runs as root.
+const unprivilegedTestUser = "nobody"
+
+func runningUnprivileged() bool {
+	return os.Getenv(unprivilegedTestEnvVar) != ""
+}
+
 func setupNetworking(t *testing.T) {
+	// Disable network pooling in tests to simplify cleanup.
+	flags.Set(t, "executor.oci.network_pool_size", 0)
+	if runningUnprivileged() {
+		// Rootless containers are connected to the network by slirp4netns,
+		// which doesn't need the host network to be configured.
+		return
+	}
 	err := networking.Configure(context.Background())
 	require.NoError(t, err)
 	testnetworking.Setup(t)
-	// Disable network pooling in tests to simplify cleanup.
-	flags.Set(t, "executor.oci.network_pool_size", 0)
 }
 
 // Returns a special image ref indicating that a busybox-based rootfs should
@@ -98,14 +116,14 @@ func manuallyProvisionedBusyboxImage(t *testing.T) string {
 // Skips the test if we don't have mount permissions.
 // TODO: support rootless overlayfs mounts and get rid of this
 func realBusyboxImage(t *testing.T) string {
-	if !hasMountPermissions(t) {
+	if !runningUnprivileged() && !hasMountPermissions(t) {
 		t.Skipf("using a real container image with overlayfs requires mount permissions")
 	}
 	return "mirror.gcr.io/library/busybox"
 }
 
 func netToolsImage(t *testing.T) string {
-	if !hasMountPermissions(t) {
+	if !runningUnprivileged() && !hasMountPermissions(t) {
 		t.Skipf("using a real container image with overlayfs requires mount permissions")
 	}
 	return netToolsImageRef
@@ -113,12 +131,94 @@ func netToolsImage(t *testing.T) string {
 
 // Returns a remote reference to the image in //dockerfiles/test_images/ociruntime_test/image_config_test_image
 func imageConfigTestImage(t *testing.T) string {
-	if !hasMountPermissions(t) {
+	if !runningUnprivileged() && !hasMountPermissions(t) {
 		t.Skipf("using a real container image with overlayfs requires mount permissions")
 	}
 	return "gcr.io/flame-public/image-config-test@sha256:44dc4623f3709eef89b0a6d6c8e1c3a9d54db73f6beb8cf99f402052ba9abe56"
 }
 
+// forEachMode runs a test both with and without rootless mode.
+//
+// Tests usually run as root, so the rootless variant re-runs the test binary
+// as an unprivileged user; otherwise rootless containers would map root to
+// root, and wouldn't be limited to what an unprivileged executor can do.
+func forEachMode(t *testing.T, test func(t *testing.T, rootless bool)) {
+	t.Run("Root", func(t *testing.T) {
+		test(t, false)
+	})
+	t.Run("Rootless", func(t *testing.T) {
+		for _, tool := range []string{"nsenter", "slirp4netns"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				t.Skipf("rootless mode requires %s", tool)
+			}
+		}
+		if os.Getuid() == 0 {
+			runAsUnprivilegedUser(t)
+			return
+		}
+		flags.Set(t, "executor.oci.rootless", true)
+		test(t, true)
+	})
+}
+
+// runAsUnprivilegedUser re-runs the current test in a new process as
+// unprivilegedTestUser.
+func runAsUnprivilegedUser(t *testing.T) {
+	u, err := user.Lookup(unprivilegedTestUser)
+	if err != nil {
+		t.Skipf("rootless tests run as the %q user: %s", unprivilegedTestUser, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	require.NoError(t, err)
+	gid, err := strconv.Atoi(u.Gid)
+	require.NoError(t, err)
+	tmp := testfs.MakeTempDir(t)
+	err = os.Chown(tmp, uid, gid)
+	require.NoError(t, err)
+	testBinary, err := os.Executable()
+	require.NoError(t, err)
+
+	var pattern []string
+	for _, name := range strings.Split(t.Name(), "/") {
+		pattern = append(pattern, "^"+regexp.QuoteMeta(name)+"$")
+	}
+	cmd := exec.Command(testBinary, "-test.v", "-test.run="+strings.Join(pattern, "/"))
+	for _, kv := range os.Environ() {
+		// Don't let the test runner shard the single test away, or have the
+		// child overwrite the parent's test outputs.
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "TEST_SHARD") || name == "TEST_TOTAL_SHARDS" || name == "XML_OUTPUT_FILE" || name == "TEST_TMPDIR" || name == "HOME" {
+			continue
+		}
+		cmd.Env = append(cmd.Env, kv)
+	}
+	cmd.Env = append(cmd.Env, unprivilegedTestEnvVar+"=1", "TEST_TMPDIR="+tmp, "HOME="+tmp)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	out, err := cmd.CombinedOutput()
+	t.Logf("Output of %s as user %q:\n%s", t.Name(), u.Username, out)
+	require.NoError(t, err)
+	require.NotContains(t, string(out), "no tests to run")
+	if strings.Contains(string(out), "--- SKIP: "+t.Name()) {
+		t.Skipf("skipped when run as user %q", u.Username)
+	}
+}
+
+// requireSubordinateIDs skips rootless tests that run containers as non-root
+// users if the current user has no subordinate IDs to map them to.
+func requireSubordinateIDs(t *testing.T) {
+	u, err := user.Current()
+	require.NoError(t, err)
+	entry := regexp.MustCompile("(?m)^(" + regexp.QuoteMeta(u.Username) + "|" + u.Uid + "):")
+	for _, path := range []string{"/etc/subuid", "/etc/subgid"} {
+		b, err := os.ReadFile(path)
+		if err != nil || !entry.Match(b) {
+			t.Skipf("running containers as non-root users in rootless mode requires subordinate IDs for %q in %s", u.Username, path)
+		}
+	}
+}
+
 func installLeaserInEnv(t testing.TB, env *real_environment.RealEnv) {
 	leaser, err := cpuset.NewLeaser(cpuset.LeaserOpts{})
 	require.NoError(t, err)
@@ -132,52 +232,54 @@ func installLeaserInEnv(t testing.TB, env *real_environment.RealEnv) {
 }
 
 func TestRun(t *testing.T) {
-	setupNetworking(t)
+	forEachMode(t, func(t *testing.T, rootless bool) {
+		setupNetworking(t)
 
-	image := manuallyProvisionedBusyboxImage(t)
+		image := manuallyProvisionedBusyboxImage(t)
 
-	ctx := context.Background()
-	env := testenv.GetTestEnv(t)
-	installLeaserInEnv(t, env)
+		ctx := context.Background()
+		env := testenv.GetTestEnv(t)
+		installLeaserInEnv(t, env)
 
-	runtimeRoot := testfs.MakeTempDir(t)
-	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+		runtimeRoot := testfs.MakeTempDir(t)
+		flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
 
-	buildRoot := testfs.MakeTempDir(t)
-	cacheRoot := testfs.MakeTempDir(t)
+		buildRoot := testfs.MakeTempDir(t)
+		cacheRoot := testfs.MakeTempDir(t)
 
-	provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
-	require.NoError(t, err)
-	wd := testfs.MakeDirAll(t, buildRoot, "work")
-	testfs.WriteAllFileContents(t, wd, map[string]string{
-		"input.txt": "world",
-	})
+		provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+		require.NoError(t, err)
+		wd := testfs.MakeDirAll(t, buildRoot, "work")
+		testfs.WriteAllFileContents(t, wd, map[string]string{
+			"input.txt": "world",
+		})
 
-	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
-		ContainerImage: image,
-	}})
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		err := c.Remove(ctx)
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+		}})
 		require.NoError(t, err)
-	})
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
 
-	// Run
-	cmd := &repb.Command{
-		Arguments: []string{"sh", "-c", `
-			echo "$GREETING $(cat input.txt)!"
-			touch output.txt
-		`},
-		EnvironmentVariables: []*repb.Command_EnvironmentVariable{
-			{Name: "GREETING", Value: "Hello"},
-		},
-	}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
-	require.NoError(t, res.Error)
-	assert.Equal(t, "Hello world!\n", string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
-	assert.Equal(t, 0, res.ExitCode)
-	assert.True(t, testfs.Exists(t, wd, "output.txt"), "output.txt should exist")
+		// Run
+		cmd := &repb.Command{
+			Arguments: []string{"sh", "-c", `
+				echo "$GREETING $(cat input.txt)!"
+				touch output.txt
+			`},
+			EnvironmentVariables: []*repb.Command_EnvironmentVariable{
+				{Name: "GREETING", Value: "Hello"},
+			},
+		}
+		res := c.Run(ctx, cmd, wd, oci.Credentials{})
+		require.NoError(t, res.Error)
+		assert.Equal(t, "Hello world!\n", string(res.Stdout))
+		assert.Empty(t, string(res.Stderr))
+		assert.Equal(t, 0, res.ExitCode)
+		assert.True(t, testfs.Exists(t, wd, "output.txt"), "output.txt should exist")
+	})
 }
 
 func TestCgroupSettings(t *testing.T) {
@@ -418,49 +520,51 @@ cat /sys/fs/cgroup/memory.events
 }
 
 func TestCreateExecRemove(t *testing.T) {
-	setupNetworking(t)
+	forEachMode(t, func(t *testing.T, rootless bool) {
+		setupNetworking(t)
 
-	image := manuallyProvisionedBusyboxImage(t)
+		image := manuallyProvisionedBusyboxImage(t)
 
-	ctx := context.Background()
-	env := testenv.GetTestEnv(t)
-	installLeaserInEnv(t, env)
+		ctx := context.Background()
+		env := testenv.GetTestEnv(t)
+		installLeaserInEnv(t, env)
 
-	runtimeRoot := testfs.MakeTempDir(t)
-	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+		runtimeRoot := testfs.MakeTempDir(t)
+		flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
 
-	buildRoot := testfs.MakeTempDir(t)
-	cacheRoot := testfs.MakeTempDir(t)
+		buildRoot := testfs.MakeTempDir(t)
+		cacheRoot := testfs.MakeTempDir(t)
 
-	provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
-	require.NoError(t, err)
-	wd := testfs.MakeDirAll(t, buildRoot, "work")
+		provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+		require.NoError(t, err)
+		wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
-		ContainerImage: image,
-	}})
-	require.NoError(t, err)
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+		}})
+		require.NoError(t, err)
 
-	// Create
-	require.NoError(t, err)
-	err = c.Create(ctx, wd)
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		err = c.Remove(ctx)
+		// Create
 		require.NoError(t, err)
-	})
+		err = c.Create(ctx, wd)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err = c.Remove(ctx)
+			require.NoError(t, err)
+		})
 
-	// Exec
-	cmd := &repb.Command{Arguments: []string{"sh", "-c", "cat && pwd"}}
-	stdio := interfaces.Stdio{
-		Stdin: strings.NewReader("buildbuddy was here: "),
-	}
-	res := c.Exec(ctx, cmd, &stdio)
-	require.NoError(t, res.Error)
+		// Exec
+		cmd := &repb.Command{Arguments: []string{"sh", "-c", "cat && pwd"}}
+		stdio := interfaces.Stdio{
+			Stdin: strings.NewReader("buildbuddy was here: "),
+		}
+		res := c.Exec(ctx, cmd, &stdio)
+		require.NoError(t, res.Error)
 
-	assert.Equal(t, 0, res.ExitCode)
-	assert.Empty(t, string(res.Stderr))
-	assert.Equal(t, "buildbuddy was here: /buildbuddy-execroot\n", string(res.Stdout))
+		assert.Equal(t, 0, res.ExitCode)
+		assert.Empty(t, string(res.Stderr))
+		assert.Equal(t, "buildbuddy was here: /buildbuddy-execroot\n", string(res.Stdout))
+	})
 }
 
 func TestTini_Run(t *testing.T) {
@@ -1044,15 +1148,9 @@ func TestNetwork_Enabled(t *testing.T) {
 	assert.GreaterOrEqual(t, res.UsageStats.GetNetworkStats().GetBytesReceived(), int64(100))
 }
 
-func TestNetwork_Disabled(t *testing.T) {
+func TestNetwork_EgressAllowlist(t *testing.T) {
 	setupNetworking(t)
 
-	// Note: busybox has ping, but it fails with 'permission denied (are you
-	// root?)' This is fixed by adding CAP_NET_RAW but we don't want to do this.
-	// So just use the net-tools image which doesn't have this issue for
-	// whatever reason (presumably it's some difference in the ping
-	// implementation) - it's enough to just set `net.ipv4.ping_group_range`.
-	// (Note that podman has this same issue.)
 	image := netToolsImage(t)
 
 	ctx := context.Background()
@@ -1061,7 +1159,6 @@ func TestNetwork_Disabled(t *testing.T) {
 
 	runtimeRoot := testfs.MakeTempDir(t)
 	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
-	flags.Set(t, "executor.network_stats_enabled", true)
 
 	buildRoot := testfs.MakeTempDir(t)
 	cacheRoot := testfs.MakeTempDir(t)
@@ -1071,8 +1168,8 @@ func TestNetwork_Disabled(t *testing.T) {
 	wd := testfs.MakeDirAll(t, buildRoot, "work")
 
 	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
-		ContainerImage: image,
-		DockerNetwork:  "off",
+		ContainerImage:         image,
+		NetworkEgressAllowlist: []string{"8.8.8.8"},
 	}})
 	require.NoError(t, err)
 	t.Cleanup(func() {
@@ -1083,13 +1180,8 @@ func TestNetwork_Disabled(t *testing.T) {
 	// Run
 	cmd := &repb.Command{
 		Arguments: []string{"sh", "-ec", `
-			# Should still have a loopback device available.
-			ping -c1 -W1 $(hostname)
-
-			if ping -c1 -W2 8.8.8.8 2>/dev/null; then
-				echo >&2 'Should not be able to ping external network'
-				exit 1
-			fi
+			ping -c1 -W2 8.8.8.8
+			if ping -c1 -W1 1.1.1.1; then exit 1; fi
 		`},
 	}
 	res := c.Run(ctx, cmd, wd, oci.Credentials{})
@@ -1097,8 +1189,152 @@ func TestNetwork_Disabled(t *testing.T) {
 	t.Logf("stdout: %s", string(res.Stdout))
 	assert.Empty(t, string(res.Stderr))
 	assert.Equal(t, 0, res.ExitCode)
-	assert.Equal(t, int64(0), res.UsageStats.GetNetworkStats().GetBytesSent())
-	assert.Equal(t, int64(0), res.UsageStats.GetNetworkStats().GetBytesReceived())
+	assert.Contains(t, string(res.AuxiliaryLogs["denied_egress.txt"]), "icmp 1.1.1.1")
+}
+
+func TestNetwork_EgressAllowlist_ConcurrentExec(t *testing.T) {
+	setupNetworking(t)
+
+	image := netToolsImage(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	installLeaserInEnv(t, env)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	cacheRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+	require.NoError(t, err)
+	wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:         image,
+		NetworkEgressAllowlist: []string{"8.8.8.8"},
+	}})
+	require.NoError(t, err)
+	err = c.PullImage(ctx, oci.Credentials{})
+	require.NoError(t, err)
+	err = c.Create(ctx, wd)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		err := c.Remove(ctx)
+		require.NoError(t, err)
+	})
+
+	// Exec a command that is denied a connection, then waits for a second
+	// command (e.g. a debug shell) to run to completion while it's still
+	// running.
+	actionResult := make(chan *interfaces.CommandResult, 1)
+	go func() {
+		cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+			mkfifo done.pipe
+			if ping -c1 -W1 1.1.1.1; then exit 1; fi
+			touch denied
+			read _ < done.pipe
+		`}}
+		actionResult <- c.Exec(ctx, cmd, &interfaces.Stdio{})
+	}()
+	cmd := &repb.Command{Arguments: []string{"sh", "-ec", `
+		while [ ! -e denied ]; do sleep 0.1; done
+		echo > done.pipe
+	`}}
+	res := c.Exec(ctx, cmd, &interfaces.Stdio{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+
+	// The second command shouldn't consume the connections that were denied
+	// to the first.
+	res = <-actionResult
+	require.NoError(t, res.Error)
+	assert.Empty(t, string(res.Stderr))
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Contains(t, string(res.AuxiliaryLogs["denied_egress.txt"]), "icmp 1.1.1.1")
+}
+
+func TestNetwork_InvalidEgressAllowlist(t *testing.T) {
+	setupNetworking(t)
+
+	ctx := context.Background()
+	env := testenv.GetTestEnv(t)
+	installLeaserInEnv(t, env)
+
+	runtimeRoot := testfs.MakeTempDir(t)
+	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+
+	buildRoot := testfs.MakeTempDir(t)
+	cacheRoot := testfs.MakeTempDir(t)
+
+	provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+	require.NoError(t, err)
+
+	_, err = provider.New(ctx, &container.Init{Props: &platform.Properties{
+		ContainerImage:         manuallyProvisionedBusyboxImage(t),
+		NetworkEgressAllowlist: []string{"*.example.com"},
+	}})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+}
+
+func TestNetwork_Disabled(t *testing.T) {
+	forEachMode(t, func(t *testing.T, rootless bool) {
+		setupNetworking(t)
+
+		// Note: busybox has ping, but it fails with 'permission denied (are you
+		// root?)' This is fixed by adding CAP_NET_RAW but we don't want to do this.
+		// So just use the net-tools image which doesn't have this issue for
+		// whatever reason (presumably it's some difference in the ping
+		// implementation) - it's enough to just set `net.ipv4.ping_group_range`.
+		// (Note that podman has this same issue.)
+		image := netToolsImage(t)
+
+		ctx := context.Background()
+		env := testenv.GetTestEnv(t)
+		installLeaserInEnv(t, env)
+
+		runtimeRoot := testfs.MakeTempDir(t)
+		flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+		flags.Set(t, "executor.network_stats_enabled", true)
+
+		buildRoot := testfs.MakeTempDir(t)
+		cacheRoot := testfs.MakeTempDir(t)
+
+		provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+		require.NoError(t, err)
+		wd := testfs.MakeDirAll(t, buildRoot, "work")
+
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+			DockerNetwork:  "off",
+		}})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
+
+		// Run
+		cmd := &repb.Command{
+			Arguments: []string{"sh", "-ec", `
+				# Should still have a loopback device available.
+				ping -c1 -W1 $(hostname)
+
+				if ping -c1 -W2 8.8.8.8 2>/dev/null; then
+					echo >&2 'Should not be able to ping external network'
+					exit 1
+				fi
+			`},
+		}
+		res := c.Run(ctx, cmd, wd, oci.Credentials{})
+		require.NoError(t, res.Error)
+		t.Logf("stdout: %s", string(res.Stdout))
+		assert.Empty(t, string(res.Stderr))
+		assert.Equal(t, 0, res.ExitCode)
+		assert.Equal(t, int64(0), res.UsageStats.GetNetworkStats().GetBytesSent())
+		assert.Equal(t, int64(0), res.UsageStats.GetNetworkStats().GetBytesReceived())
+	})
 }
 
 func TestUser(t *testing.T) {
@@ -1210,45 +1446,50 @@ func TestUser(t *testing.T) {
 }
 
 func TestOverlayfsEdgeCases(t *testing.T) {
-	setupNetworking(t)
+	forEachMode(t, func(t *testing.T, rootless bool) {
+		setupNetworking(t)
 
-	image := imageConfigTestImage(t)
+		image := imageConfigTestImage(t)
 
-	ctx := context.Background()
-	env := testenv.GetTestEnv(t)
-	installLeaserInEnv(t, env)
+		ctx := context.Background()
+		env := testenv.GetTestEnv(t)
+		installLeaserInEnv(t, env)
 
-	runtimeRoot := testfs.MakeTempDir(t)
-	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+		runtimeRoot := testfs.MakeTempDir(t)
+		flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
 
-	buildRoot := testfs.MakeTempDir(t)
-	cacheRoot := testfs.MakeTempDir(t)
+		buildRoot := testfs.MakeTempDir(t)
+		cacheRoot := testfs.MakeTempDir(t)
 
-	provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
-	require.NoError(t, err)
-	wd := testfs.MakeDirAll(t, buildRoot, "work")
+		provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+		require.NoError(t, err)
+		wd := testfs.MakeDirAll(t, buildRoot, "work")
 
-	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
-		ContainerImage: image,
-	}})
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		err := c.Remove(ctx)
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+			// The image runs as a non-root user, which requires subordinate
+			// IDs in rootless mode.
+			DockerForceRoot: rootless,
+		}})
 		require.NoError(t, err)
-	})
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
 
-	// Run
-	cmd := &repb.Command{Arguments: []string{"sh", "-c", `
-		test "$(cat /test/foo)" -eq 2 || echo >&2 "/test/foo contains $(cat /test/foo) but should contain '2'"
-		test -e /test/DELETED_DIR && echo >&2 "/test/DELETED_DIR unexpectedly exists"
-		test -e /test/DELETED_FILE && echo >&2 "/test/DELETED_FILE unexpectedly exists"
-		exit 0
-	`}}
-	res := c.Run(ctx, cmd, wd, oci.Credentials{})
-	require.NoError(t, res.Error)
-	assert.Empty(t, string(res.Stdout))
-	assert.Empty(t, string(res.Stderr))
-	assert.Equal(t, 0, res.ExitCode)
+		// Run
+		cmd := &repb.Command{Arguments: []string{"sh", "-c", `
+			test "$(cat /test/foo)" -eq 2 || echo >&2 "/test/foo contains $(cat /test/foo) but should contain '2'"
+			test -e /test/DELETED_DIR && echo >&2 "/test/DELETED_DIR unexpectedly exists"
+			test -e /test/DELETED_FILE && echo >&2 "/test/DELETED_FILE unexpectedly exists"
+			exit 0
+		`}}
+		res := c.Run(ctx, cmd, wd, oci.Credentials{})
+		require.NoError(t, res.Error)
+		assert.Empty(t, string(res.Stdout))
+		assert.Empty(t, string(res.Stderr))
+		assert.Equal(t, 0, res.ExitCode)
+	})
 }
 
 func TestHighLayerCount(t *testing.T) {
@@ -1360,87 +1601,104 @@ func TestEntrypoint(t *testing.T) {
 }
 
 func TestFileOwnership(t *testing.T) {
-	setupNetworking(t)
-	// Load busybox oci image
-	busyboxImg := testregistry.ImageFromRlocationpath(t, ociBusyboxRlocationpath)
-	// Append a layer with a file, dir, and symlink that are owned by a
-	// non-root user
-	layer := testregistry.NewBytesLayer(t, testtar.EntriesBytes(
-		t,
-		[]testtar.Entry{
-			{
-				Header: &tar.Header{
-					Name:     "/foo.txt",
-					Gid:      1000,
-					Uid:      1000,
-					Mode:     0644,
-					Typeflag: tar.TypeReg,
+	forEachMode(t, func(t *testing.T, rootless bool) {
+		if rootless {
+			requireSubordinateIDs(t)
+		}
+		setupNetworking(t)
+		// Load busybox oci image
+		busyboxImg := testregistry.ImageFromRlocationpath(t, ociBusyboxRlocationpath)
+		// Append a layer with a file, dir, and symlink that are owned by a
+		// non-root user
+		layer := testregistry.NewBytesLayer(t, testtar.EntriesBytes(
+			t,
+			[]testtar.Entry{
+				{
+					Header: &tar.Header{
+						Name:     "/foo.txt",
+						Gid:      1000,
+						Uid:      1000,
+						Mode:     0644,
+						Typeflag: tar.TypeReg,
+					},
 				},
-			},
-			{
-				Header: &tar.Header{
-					Name:     "/bar",
-					Gid:      1000,
-					Uid:      1000,
-					Mode:     0755,
-					Typeflag: tar.TypeDir,
+				{
+					Header: &tar.Header{
+						Name:     "/bar",
+						Gid:      1000,
+						Uid:      1000,
+						Mode:     0755,
+						Typeflag: tar.TypeDir,
+					},
 				},
-			},
-			{
-				Header: &tar.Header{
-					Name:     "/baz.ln",
-					Gid:      1000,
-					Uid:      1000,
-					Mode:     0644,
-					Typeflag: tar.TypeSymlink,
-					Linkname: "foo.txt",
+				{
+					Header: &tar.Header{
+						Name:     "/baz.ln",
+						Gid:      1000,
+						Uid:      1000,
+						Mode:     0644,
+						Typeflag: tar.TypeSymlink,
+						Linkname: "foo.txt",
+					},
 				},
-			},
-			{
-				Header: &tar.Header{
-					Name:     "/qux.hardlink",
-					Typeflag: tar.TypeLink,
-					Linkname: "/foo.txt",
+				{
+					Header: &tar.Header{
+						Name:     "/qux.hardlink",
+						Typeflag: tar.TypeLink,
+						Linkname: "/foo.txt",
+					},
 				},
 			},
-		},
-	))
-	img, err := mutate.AppendLayers(busyboxImg, layer)
-	require.NoError(t, err)
-	// Start a test registry and push the mutated busybox image to it
-	reg := testregistry.Run(t, testregistry.Opts{})
-	image := reg.Push(t, img, "test-file-ownership:latest")
-	// Set up the container
-	ctx := context.Background()
-	env := testenv.GetTestEnv(t)
-	installLeaserInEnv(t, env)
-	runtimeRoot := testfs.MakeTempDir(t)
-	flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
-	buildRoot := testfs.MakeTempDir(t)
-	cacheRoot := testfs.MakeTempDir(t)
-	provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
-	require.NoError(t, err)
-	wd := testfs.MakeDirAll(t, buildRoot, "work")
-	c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
-		ContainerImage: image,
-	}})
-	require.NoError(t, err)
-	t.Cleanup(func() {
-		err := c.Remove(ctx)
+		))
+		img, err := mutate.AppendLayers(busyboxImg, layer)
 		require.NoError(t, err)
-	})
-
-	res := c.Run(ctx, &repb.Command{
-		Arguments: []string{"stat", "-c", "%n: %u %g", "/foo.txt", "/bar", "/baz.ln", "/qux.hardlink"},
-	}, wd, oci.Credentials{})
+		// Start a test registry and push the mutated busybox image to it
+		reg := testregistry.Run(t, testregistry.Opts{})
+		image := reg.Push(t, img, "test-file-ownership:latest")
+		// Set up the container
+		ctx := context.Background()
+		env := testenv.GetTestEnv(t)
+		installLeaserInEnv(t, env)
+		runtimeRoot := testfs.MakeTempDir(t)
+		flags.Set(t, "executor.oci.runtime_root", runtimeRoot)
+		buildRoot := testfs.MakeTempDir(t)
+		cacheRoot := testfs.MakeTempDir(t)
+		provider, err := ociruntime.NewProvider(env, buildRoot, cacheRoot)
+		require.NoError(t, err)
+		wd := testfs.MakeDirAll(t, buildRoot, "work")
+		// Run as the owner of the files, which should be able to write to
+		// them.
+		c, err := provider.New(ctx, &container.Init{Props: &platform.Properties{
+			ContainerImage: image,
+			DockerUser:     "1000:1000",
+		}})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			err := c.Remove(ctx)
+			require.NoError(t, err)
+		})
 
-	require.NoError(t, res.Error)
-	require.Empty(t, string(res.Stderr))
-	assert.Equal(
-		t,
-		"/foo.txt: 1000 1000\n/bar: 1000 1000\n/baz.ln: 1000 1000\n/qux.hardlink: 1000 1000\n",
-		string(res.Stdout),
-	)
+		res := c.Run(ctx, &repb.Command{
+			Arguments: []string{"stat", "-c", "%n: %u %g", "/foo.txt", "/bar", "/baz.ln", "/qux.hardlink"},
+		}, wd, oci.Credentials{})
+
+		require.NoError(t, res.Error)
+		require.Empty(t, string(res.Stderr))
+		assert.Equal(
+			t,
+			"/foo.txt: 1000 1000\n/bar: 1000 1000\n/baz.ln: 1000 1000\n/qux.hardlink: 1000 1000\n",
+			string(res.Stdout),
+		)
+
+		res = c.Run(ctx, &repb.Command{
+			Arguments: []string{"sh", "-c", `echo hello > /foo.txt && mkdir /bar/new && stat -c "%u %g" /bar/new`},
+		}, wd, oci.Credentials{})
+
+		require.NoError(t, res.Error)
+		require.Empty(t, string(res.Stderr))
+		assert.Equal(t, 0, res.ExitCode)
+		assert.Equal(t, "1000 1000\n", string(res.Stdout))
+	})
 }
 
 func TestPathSanitization(t *testing.T) {
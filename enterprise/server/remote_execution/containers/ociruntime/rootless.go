@@ -0,0 +1,594 @@
+package ociruntime
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/networking"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sys/unix"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+// Rootless mode lets the executor run OCI containers without root privileges.
+//
+// Each container gets a "holder" process which owns a user namespace, a mount
+// namespace and a network namespace. The user namespace maps root in the
+// container to the executor's user, and all other container users to the
+// subordinate IDs assigned to the executor's user in /etc/subuid and
+// /etc/subgid. The container's root filesystem is mounted in the mount
+// namespace, and slirp4netns connects the network namespace to the host's
+// network. The OCI runtime is run inside these namespaces using nsenter, so
+// from its point of view, it runs as root.
+//
+// Since the mounts and the network only exist in the holder's namespaces,
+// they are cleaned up automatically when the holder exits, which it does when
+// the container is removed or when the executor exits.
+
+var (
+	rootless        = flag.Bool("executor.oci.rootless", false, "Run OCI containers without root privileges, using user namespaces. Requires nsenter and slirp4netns. Running containers as non-root users requires subordinate ID ranges for the executor user in /etc/subuid and /etc/subgid, as well as newuidmap and newgidmap. Resource limits require a cgroup subtree that is delegated to the executor user.")
+	rootlessOverlay = flag.String("executor.oci.rootless_overlay", rootlessOverlayNative, `How to mount container root filesystems in rootless mode. "native" uses the kernel's overlayfs, which supports user namespaces since Linux 5.11, and images that delete files from lower layers since Linux 6.7. "fuse-overlayfs" uses fuse-overlayfs, which must be installed.`)
+)
+
+const (
+	rootlessOverlayNative = "native"
+	rootlessOverlayFUSE   = "fuse-overlayfs"
+
+	// The network interface that slirp4netns creates in the container's
+	// network namespace.
+	slirpInterface = "tap0"
+
+	// The MTU recommended by slirp4netns for best throughput.
+	slirpMTU = 65520
+
+	// How long to wait for slirp4netns to configure the network.
+	slirpReadyTimeout = 10 * time.Second
+
+	// How long to wait for the ownership of the workspace to be restored
+	// after the context of a command is cancelled.
+	restoreOwnershipTimeout = 1 * time.Minute
+
+	// The maximum number of paths passed to a single chown or chmod command
+	// when changing the owners of extracted image files.
+	chownBatchSize = 1000
+)
+
+// Files listing the subordinate user and group IDs that unprivileged users may
+// map into user namespaces that they create.
+const (
+	subuidPath = "/etc/subuid"
+	subgidPath = "/etc/subgid"
+)
+
+// idMapping maps a contiguous range of IDs in a user namespace to IDs on the
+// host.
+type idMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// idMappings are the user and group ID mappings of rootless containers.
+type idMappings struct {
+	UIDs []idMapping
+	GIDs []idMapping
+}
+
+// HasSubordinateIDs returns whether IDs other than root are mapped. If they
+// are not, containers can only run as root.
+func (m *idMappings) HasSubordinateIDs() bool {
+	return len(m.UIDs) > 1 && len(m.GIDs) > 1
+}
+
+// Maps returns whether the given container user and group IDs are mapped.
+func (m *idMappings) Maps(uid, gid int) bool {
+	return containsID(m.UIDs, uid) && containsID(m.GIDs, gid)
+}
+
+func containsID(mappings []idMapping, id int) bool {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// rootlessConfig is the executor-wide configuration of rootless containers.
+type rootlessConfig struct {
+	idMappings *idMappings
+
+	// Default OCI runtime state directory. The runtime's default requires
+	// root.
+	runtimeRoot string
+}
+
+func newRootlessConfig(buildRoot string) (*rootlessConfig, error) {
+	if *enableLxcfs {
+		return nil, status.FailedPreconditionError("lxcfs is not supported in rootless mode")
+	}
+	tools := []string{"nsenter", "slirp4netns"}
+	switch *rootlessOverlay {
+	case rootlessOverlayNative:
+		tools = append(tools, "mount", "umount")
+	case rootlessOverlayFUSE:
+		tools = append(tools, "fuse-overlayfs", "umount")
+	default:
+		return nil, status.InvalidArgumentErrorf("invalid executor.oci.rootless_overlay value %q", *rootlessOverlay)
+	}
+	mappings, err := getIDMappings()
+	if err != nil {
+		return nil, err
+	}
+	if mappings.HasSubordinateIDs() {
+		tools = append(tools, "newuidmap", "newgidmap")
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return nil, status.FailedPreconditionErrorf("rootless mode requires %s: %s", tool, err)
+		}
+	}
+	runtimeRoot := filepath.Join(buildRoot, "executor", "oci", "state")
+	if err := os.MkdirAll(runtimeRoot, 0700); err != nil {
+		return nil, err
+	}
+	log.Infof("Running OCI containers in rootless mode with UID mappings %+v and GID mappings %+v", mappings.UIDs, mappings.GIDs)
+	return &rootlessConfig{
+		idMappings:  mappings,
+		runtimeRoot: runtimeRoot,
+	}, nil
+}
+
+// configureSpec adapts a container spec to rootless mode.
+func (r *rootlessConfig) configureSpec(spec *specs.Spec) error {
+	if r.idMappings.HasSubordinateIDs() {
+		return nil
+	}
+	user := &spec.Process.User
+	if user.UID != 0 || user.GID != 0 {
+		return status.FailedPreconditionErrorf("running as user %d:%d in rootless mode requires subordinate IDs for the executor user in %s and %s", user.UID, user.GID, subuidPath, subgidPath)
+	}
+	// Only root is mapped, and setgroups(2) may be denied.
+	user.AdditionalGids = nil
+	for i, m := range spec.Mounts {
+		if m.Destination == "/dev/pts" {
+			// The tty group isn't mapped.
+			spec.Mounts[i].Options = slices.DeleteFunc(slices.Clone(m.Options), func(o string) bool {
+				return o == "gid=5"
+			})
+		}
+	}
+	return nil
+}
+
+// fileOwnership is the owner of a file extracted from an image layer, as
+// container IDs.
+type fileOwnership struct {
+	UID, GID int
+	// Mode is the permissions to restore after changing the owner, or 0 to
+	// leave them as they are.
+	Mode os.FileMode
+}
+
+// chownExtractedFiles gives files extracted from an image layer, which are
+// owned by root in the container, to the given container users. The owners
+// are changed from inside a user namespace with the containers' ID mappings,
+// since the executor user can only chown files to itself. Files owned by
+// unmapped IDs stay owned by root.
+func (r *rootlessConfig) chownExtractedFiles(ctx context.Context, owners map[fileOwnership][]string) error {
+	if len(owners) == 0 || !r.idMappings.HasSubordinateIDs() {
+		// Without subordinate IDs, containers can only run as root, so
+		// root may as well own everything.
+		return nil
+	}
+	var ns *rootlessNamespace
+	for o, paths := range owners {
+		if !r.idMappings.Maps(o.UID, o.GID) {
+			log.CtxDebugf(ctx, "Not changing the owner of %d extracted files to unmapped IDs %d:%d", len(paths), o.UID, o.GID)
+			continue
+		}
+		if ns == nil {
+			var err error
+			ns, err = newRootlessNamespace(ctx, r.idMappings, false /*=networkEnabled*/)
+			if err != nil {
+				return err
+			}
+			defer ns.Close()
+		}
+		for batch := range slices.Chunk(paths, chownBatchSize) {
+			if err := ns.run(ctx, false, append([]string{"chown", "-h", fmt.Sprintf("%d:%d", o.UID, o.GID), "--"}, batch...)...); err != nil {
+				return err
+			}
+			if o.Mode == 0 {
+				continue
+			}
+			if err := ns.run(ctx, false, append([]string{"chmod", fmt.Sprintf("%o", o.Mode), "--"}, batch...)...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeAll removes a directory on the host that may contain files owned by
+// subordinate IDs, which the executor user can't remove directly.
+func (r *rootlessConfig) removeAll(ctx context.Context, path string) error {
+	err := os.RemoveAll(path)
+	if err == nil || !r.idMappings.HasSubordinateIDs() {
+		return err
+	}
+	ns, err := newRootlessNamespace(ctx, r.idMappings, false /*=networkEnabled*/)
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+	return ns.RemoveAll(ctx, path)
+}
+
+// getIDMappings returns the ID mappings for containers created by the current
+// user: root in the container is mapped to the current user, and the
+// current user's subordinate IDs, if any, are mapped starting at ID 1.
+func getIDMappings() (*idMappings, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, status.UnavailableErrorf("look up current user: %s", err)
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	mappings := &idMappings{
+		UIDs: []idMapping{{ContainerID: 0, HostID: uid, Size: 1}},
+		GIDs: []idMapping{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+	subuids, err := readSubordinateIDs(subuidPath, u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	subgids, err := readSubordinateIDs(subgidPath, u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	if subuids == nil || subgids == nil {
+		log.Warningf("User %q has no subordinate IDs in %s and %s; rootless containers can only run as root.", u.Username, subuidPath, subgidPath)
+		return mappings, nil
+	}
+	mappings.UIDs = append(mappings.UIDs, *subuids)
+	mappings.GIDs = append(mappings.GIDs, *subgids)
+	return mappings, nil
+}
+
+// readSubordinateIDs returns the first subordinate ID range of the given user
+// from an /etc/subuid or /etc/subgid formatted file, mapped starting at ID 1.
+// It returns nil if the user has no subordinate IDs.
+func readSubordinateIDs(path, username string, uid int) (*idMapping, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.UnavailableErrorf("open %s: %s", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 || (fields[0] != username && fields[0] != strconv.Itoa(uid)) {
+			continue
+		}
+		start, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid line %q in %s", line, path)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil || count <= 0 {
+			return nil, status.InvalidArgumentErrorf("invalid line %q in %s", line, path)
+		}
+		return &idMapping{ContainerID: 1, HostID: start, Size: count}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, status.UnavailableErrorf("read %s: %s", path, err)
+	}
+	return nil, nil
+}
+
+// rootlessNamespace is a set of namespaces that a rootless container runs in.
+type rootlessNamespace struct {
+	// The holder process. It waits for its stdin to be closed.
+	holder      *exec.Cmd
+	holderStdin io.WriteCloser
+
+	// slirp4netns connects the network namespace to the host network. It is
+	// nil if networking is disabled. It exits once slirpExit is closed.
+	slirp     *exec.Cmd
+	slirpExit *os.File
+}
+
+func newRootlessNamespace(ctx context.Context, mappings *idMappings, networkEnabled bool) (*rootlessNamespace, error) {
+	// Use exec.Command rather than exec.CommandContext since the holder
+	// outlives the context. If the executor exits without removing the
+	// container, the holder's stdin is closed, so it exits too.
+	holder := exec.Command("cat")
+	holder.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+		Setpgid:    true,
+	}
+	if !mappings.HasSubordinateIDs() {
+		// Mapping only the current user doesn't require newuidmap. Unprivileged
+		// users must deny setgroups(2) in order to write the GID mapping.
+		holder.SysProcAttr.UidMappings = sysProcIDMap(mappings.UIDs)
+		holder.SysProcAttr.GidMappings = sysProcIDMap(mappings.GIDs)
+		holder.SysProcAttr.GidMappingsEnableSetgroups = os.Geteuid() == 0
+	}
+	holderStdin, err := holder.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := holder.Start(); err != nil {
+		return nil, status.UnavailableErrorf("start namespace holder: %s", err)
+	}
+	n := &rootlessNamespace{holder: holder, holderStdin: holderStdin}
+	if err := n.setup(ctx, mappings, networkEnabled); err != nil {
+		n.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *rootlessNamespace) setup(ctx context.Context, mappings *idMappings, networkEnabled bool) error {
+	if mappings.HasSubordinateIDs() {
+		if err := runIDMapTool(ctx, "newuidmap", n.pid(), mappings.UIDs); err != nil {
+			return err
+		}
+		if err := runIDMapTool(ctx, "newgidmap", n.pid(), mappings.GIDs); err != nil {
+			return err
+		}
+	}
+	if networkEnabled {
+		if err := n.startSlirp(ctx); err != nil {
+			return status.UnavailableErrorf("start slirp4netns: %s", err)
+		}
+	}
+	return nil
+}
+
+func sysProcIDMap(mappings []idMapping) []syscall.SysProcIDMap {
+	var out []syscall.SysProcIDMap
+	for _, m := range mappings {
+		out = append(out, syscall.SysProcIDMap{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return out
+}
+
+// runIDMapTool writes the ID mappings of the given process using newuidmap or
+// newgidmap, which are setuid helpers that check the mappings against
+// /etc/subuid and /etc/subgid.
+func runIDMapTool(ctx context.Context, tool string, pid int, mappings []idMapping) error {
+	args := []string{strconv.Itoa(pid)}
+	for _, m := range mappings {
+		args = append(args, strconv.Itoa(m.ContainerID), strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	if b, err := exec.CommandContext(ctx, tool, args...).CombinedOutput(); err != nil {
+		return status.UnavailableErrorf("%s: %s: %q", tool, err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+func (n *rootlessNamespace) startSlirp(ctx context.Context) error {
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+	exitReader, exitWriter, err := os.Pipe()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+	// Like the holder, slirp4netns outlives the context. It exits when the
+	// exit pipe is closed.
+	cmd := exec.Command(
+		"slirp4netns",
+		"--configure",
+		fmt.Sprintf("--mtu=%d", slirpMTU),
+		// Don't let containers connect to services listening on the host's
+		// loopback interface.
+		"--disable-host-loopback",
+		"--ready-fd=3",
+		"--exit-fd=4",
+		strconv.Itoa(n.pid()),
+		slirpInterface,
+	)
+	cmd.ExtraFiles = []*os.File{readyWriter, exitReader}
+	cmd.Stdout = log.Writer("[slirp4netns] ")
+	cmd.Stderr = log.Writer("[slirp4netns] ")
+	err = cmd.Start()
+	readyWriter.Close()
+	exitReader.Close()
+	if err != nil {
+		exitWriter.Close()
+		return err
+	}
+	n.slirp = cmd
+	n.slirpExit = exitWriter
+
+	// slirp4netns writes to the ready pipe once the network is configured.
+	deadline := time.Now().Add(slirpReadyTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := readyReader.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := readyReader.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("wait for network to be configured: %w", err)
+	}
+	return nil
+}
+
+func (n *rootlessNamespace) pid() int {
+	return n.holder.Process.Pid
+}
+
+// NetworkNamespacePath returns the path of the network namespace, which is
+// connected to the host network if networking is enabled.
+func (n *rootlessNamespace) NetworkNamespacePath() string {
+	return fmt.Sprintf("/proc/%d/ns/net", n.pid())
+}
+
+// Command returns a command that runs as root in the user namespace. If
+// mountNamespace is true, the command also runs in the mount namespace, where
+// it can see the container's root filesystem. Otherwise it sees the host's
+// mounts.
+func (n *rootlessNamespace) Command(ctx context.Context, mountNamespace bool, args ...string) *exec.Cmd {
+	// nsenter switches to root in the user namespace unless
+	// --preserve-credentials is set.
+	nsenterArgs := []string{"--target=" + strconv.Itoa(n.pid()), "--user"}
+	if mountNamespace {
+		nsenterArgs = append(nsenterArgs, "--mount")
+	}
+	nsenterArgs = append(nsenterArgs, "--")
+	return exec.CommandContext(ctx, "nsenter", append(nsenterArgs, args...)...)
+}
+
+func (n *rootlessNamespace) run(ctx context.Context, mountNamespace bool, args ...string) error {
+	if b, err := n.Command(ctx, mountNamespace, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %q", args[0], err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// MountOverlay mounts an overlay filesystem in the mount namespace.
+func (n *rootlessNamespace) MountOverlay(ctx context.Context, target, options string) error {
+	if *rootlessOverlay == rootlessOverlayFUSE {
+		return n.run(ctx, true, "fuse-overlayfs", "-o", options, target)
+	}
+	return n.run(ctx, true, "mount", "-t", "overlay", "overlay", "-o", options, target)
+}
+
+// Unmount unmounts a filesystem in the mount namespace. Mounts don't need to
+// be unmounted before closing the namespace, except for FUSE mounts, whose
+// server processes would keep the namespace alive.
+func (n *rootlessNamespace) Unmount(ctx context.Context, target string) error {
+	return n.run(ctx, true, "umount", target)
+}
+
+// RemoveAll removes a directory on the host, including files owned by
+// subordinate IDs, which the executor user can't remove directly.
+func (n *rootlessNamespace) RemoveAll(ctx context.Context, path string) error {
+	return n.run(ctx, false, "rm", "-rf", path)
+}
+
+// Chown recursively changes the owner of a directory on the host to the given
+// container user and group.
+func (n *rootlessNamespace) Chown(ctx context.Context, path string, uid, gid uint32) error {
+	return n.run(ctx, false, "chown", "-R", fmt.Sprintf("%d:%d", uid, gid), path)
+}
+
+// NetworkStats returns the stats of the interface connected to the host.
+func (n *rootlessNamespace) NetworkStats(ctx context.Context) (*repb.NetworkStats, error) {
+	if n.slirp == nil {
+		return nil, nil
+	}
+	return networking.ReadProcessInterfaceStats(ctx, n.pid(), slirpInterface)
+}
+
+// Close stops slirp4netns and the holder process, which destroys the
+// namespaces.
+func (n *rootlessNamespace) Close() error {
+	var firstErr error
+	if n.slirp != nil {
+		n.slirpExit.Close()
+		if err := n.slirp.Wait(); err != nil && firstErr == nil {
+			firstErr = status.UnavailableErrorf("wait for slirp4netns to exit: %s", err)
+		}
+	}
+	n.holderStdin.Close()
+	if err := n.holder.Wait(); err != nil && firstErr == nil {
+		firstErr = status.UnavailableErrorf("wait for namespace holder to exit: %s", err)
+	}
+	return firstErr
+}
+
+// opaqueXattr returns the extended attribute that marks directories in
+// extracted image layers as opaque. Unprivileged users can't set trusted.*
+// attributes, but overlayfs reads the user.* equivalents when mounted with
+// the userxattr option, and so does fuse-overlayfs.
+func opaqueXattr() string {
+	if *rootless {
+		return "user.overlay.opaque"
+	}
+	return "trusted.overlay.opaque"
+}
+
+// createWhiteout marks a file as deleted in an extracted image layer.
+//
+// Overlayfs whiteouts are usually 0/0 character devices, which unprivileged
+// users can't create. In rootless mode, an "xattr whiteout" is created
+// instead: an empty file with the user.overlay.whiteout attribute, whose
+// parent directory has user.overlay.opaque set to "x" to tell overlayfs to
+// look for xattr whiteouts in it. Overlayfs supports these in lower layers
+// since Linux 6.7.
+func createWhiteout(path string) error {
+	if !*rootless {
+		if err := unix.Mknod(path, unix.S_IFCHR, 0); err != nil {
+			return status.UnavailableErrorf("mknod for whiteout marker: %s", err)
+		}
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return status.UnavailableErrorf("create whiteout marker: %s", err)
+	}
+	f.Close()
+	if err := unix.Setxattr(path, "user.overlay.whiteout", nil, 0); err != nil {
+		return status.UnavailableErrorf("setxattr on whiteout marker: %s", err)
+	}
+	// Don't overwrite the attribute if the directory is already opaque,
+	// since an opaque directory hides everything below it anyway.
+	dir := filepath.Dir(path)
+	_, err = unix.Getxattr(dir, opaqueXattr(), nil)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.ENODATA) {
+		return status.UnavailableErrorf("getxattr on whiteout marker directory: %s", err)
+	}
+	if err := unix.Setxattr(dir, opaqueXattr(), []byte{'x'}, 0); err != nil {
+		return status.UnavailableErrorf("setxattr on whiteout marker directory: %s", err)
+	}
+	return nil
+}
+
+// restoreWorkspaceOwnership gives ownership of the workspace back to root in
+// the container, i.e. the executor user, after running a command as a
+// non-root container user. Otherwise the executor couldn't clean up the files
+// created by the command, which are owned by subordinate IDs.
+func (c *ociContainer) restoreWorkspaceOwnership(ctx context.Context) {
+	if c.rootlessNamespace == nil || c.processUser == nil || c.processUser.UID == 0 {
+		return
+	}
+	ctx, cancel := background.ExtendContextForFinalization(ctx, restoreOwnershipTimeout)
+	defer cancel()
+	if err := c.rootlessNamespace.Chown(ctx, c.workDir, 0, 0); err != nil {
+		log.CtxWarningf(ctx, "Failed to restore ownership of workspace %q: %s", c.workDir, err)
+	}
+}
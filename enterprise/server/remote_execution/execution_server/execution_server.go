@@ -1084,9 +1084,25 @@ func (s *ExecutionServer) MarkExecutionFailed(ctx context.Context, taskID string
 	if err := s.cacheExecuteResponse(ctx, taskID, rsp); err != nil {
 		log.CtxWarningf(ctx, "MarkExecutionFailed: failed to cache execute response for execution %q: %s", taskID, err)
 	}
+	s.notifyExecutionFailed(ctx, taskID, r.GetInstanceName(), rsp)
 	return nil
 }
 
+// notifyExecutionFailed sends an EXECUTION_FAILED event to the group's
+// outbound webhooks if the execution failed.
+func (s *ExecutionServer) notifyExecutionFailed(ctx context.Context, taskID, instanceName string, rsp *repb.ExecuteResponse) {
+	ows := s.env.GetOutboundWebhookService()
+	if ows == nil || instanceName == teeInstanceName {
+		return
+	}
+	if gstatus.ErrorProto(rsp.GetStatus()) == nil && rsp.GetResult().GetExitCode() == 0 {
+		return
+	}
+	if err := ows.NotifyExecutionFailed(ctx, taskID, rsp); err != nil {
+		log.CtxWarningf(ctx, "Could not notify outbound webhooks of failed execution %q: %s", taskID, err)
+	}
+}
+
 func (s *ExecutionServer) recordFailedExecution(ctx context.Context, taskID string, executeRsp *repb.ExecuteResponse) error {
 	action, cmd, properties, err := s.metadataForClickhouse(ctx, taskID)
 	// Even if we can't get the additional metadata, update the data we have.
@@ -1248,6 +1264,7 @@ func (s *ExecutionServer) PublishOperation(stream repb.Execution_PublishOperatio
 				// Errors updating the router or recording usage are non-fatal.
 				log.CtxErrorf(ctx, "Could not update post-completion metadata: %s", err)
 			}
+			s.notifyExecutionFailed(ctx, taskID, actionRN.GetInstanceName(), response)
 		}
 		data, err := proto.Marshal(op)
 		if err != nil {
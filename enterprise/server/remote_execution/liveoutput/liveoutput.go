@@ -0,0 +1,286 @@
+// Package liveoutput streams the stdout and stderr of running executions
+// through the action cache.
+//
+// While a command runs, the executor writes its output to the action cache in
+// numbered chunks. Each chunk is stored as an ActionResult whose stdout_raw is
+// a marshaled ExecutionOutputChunk, keyed by the hash of
+// "<execution_id>/output/<attempt_id>/<stream>/<chunk_index>", similar to how
+// the final ExecuteResponse is stored under the hash of the execution ID.
+// Readers poll for chunks in order until they find one marked as final.
+//
+// An execution may be attempted more than once, for example if its executor
+// goes away and the task is retried on another executor. Each attempt writes
+// its chunks under its own ID, so that attempts never overwrite each other's
+// chunks, and records itself as the execution's latest attempt under the hash
+// of "<execution_id>/output/attempt".
+package liveoutput
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	enabled       = flag.Bool("executor.live_output.enabled", false, "If true, stream the stdout and stderr of running actions to the cache so that they can be viewed before the action completes.")
+	flushInterval = flag.Duration("executor.live_output.flush_interval", 1*time.Second, "How often to write buffered live output to the cache.")
+	maxBytes      = flag.Int64("executor.live_output.max_bytes", 16*1024*1024, "The maximum number of bytes of live output to write per stream. Output past this limit is only available once the action completes.")
+)
+
+const (
+	// The maximum size of a single chunk. Buffered output is flushed early
+	// once it reaches this size.
+	maxChunkSizeBytes = 256 * 1024
+
+	// The maximum number of bytes returned by a single Read call.
+	maxReadSizeBytes = 4 * 1024 * 1024
+
+	// How long to wait for the final chunk to be written after the command
+	// context is cancelled.
+	closeTimeout = 10 * time.Second
+
+	// The length of generated attempt IDs.
+	attemptIDLength = 16
+)
+
+// Enabled returns whether executors should stream live output.
+func Enabled() bool {
+	return *enabled
+}
+
+func chunkResourceName(executionID, attemptID string, stream espb.OutputStream, index int64) (*digest.ACResourceName, error) {
+	if stream != espb.OutputStream_STDOUT && stream != espb.OutputStream_STDERR {
+		return nil, status.InvalidArgumentErrorf("invalid output stream %s", stream)
+	}
+	if attemptID == "" || strings.Contains(attemptID, "/") {
+		return nil, status.InvalidArgumentErrorf("invalid attempt ID %q", attemptID)
+	}
+	return resourceName(executionID, fmt.Sprintf("%s/%s/%d", attemptID, strings.ToLower(stream.String()), index))
+}
+
+func attemptResourceName(executionID string) (*digest.ACResourceName, error) {
+	return resourceName(executionID, "attempt")
+}
+
+func resourceName(executionID, suffix string) (*digest.ACResourceName, error) {
+	rn, err := digest.ParseUploadResourceName(executionID)
+	if err != nil {
+		return nil, err
+	}
+	key := executionID + "/output/" + suffix
+	d, err := digest.Compute(strings.NewReader(key), rn.GetDigestFunction())
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewACResourceName(d, rn.GetInstanceName(), rn.GetDigestFunction()), nil
+}
+
+// StartAttempt records a new attempt of an execution as its latest attempt
+// and returns the attempt's ID, which the attempt's Writers must be created
+// with.
+func StartAttempt(ctx context.Context, ac repb.ActionCacheClient, executionID string) (string, error) {
+	attemptID, err := random.RandomString(attemptIDLength)
+	if err != nil {
+		return "", err
+	}
+	arn, err := attemptResourceName(executionID)
+	if err != nil {
+		return "", err
+	}
+	if err := cachetools.UploadActionResult(ctx, ac, arn, &repb.ActionResult{StdoutRaw: []byte(attemptID)}); err != nil {
+		return "", err
+	}
+	return attemptID, nil
+}
+
+// LatestAttempt returns the ID of the most recently started attempt of an
+// execution. It returns a NotFound error if no attempt has written live output.
+func LatestAttempt(ctx context.Context, ac repb.ActionCacheClient, executionID string) (string, error) {
+	arn, err := attemptResourceName(executionID)
+	if err != nil {
+		return "", err
+	}
+	ar, err := cachetools.GetActionResult(ctx, ac, arn)
+	if err != nil {
+		return "", err
+	}
+	return string(ar.GetStdoutRaw()), nil
+}
+
+// Writer buffers output written to it and periodically writes it to the
+// action cache as a sequence of chunks. Writes never fail: if the cache can't
+// be written, the rest of the output is dropped, and readers will only see it
+// once the execution completes.
+type Writer struct {
+	ctx         context.Context
+	ac          repb.ActionCacheClient
+	executionID string
+	attemptID   string
+	stream      espb.OutputStream
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu           sync.Mutex // protects buf and bytesWritten
+	buf          bytes.Buffer
+	bytesWritten int64
+
+	// Only accessed by the flush goroutine, and by Close after the flush
+	// goroutine exits.
+	nextIndex int64
+	failed    bool
+}
+
+// NewWriter returns a Writer that streams output for the given stream of an
+// execution attempt started with StartAttempt. Close must be called once the
+// command has finished to write the final chunk.
+func NewWriter(ctx context.Context, ac repb.ActionCacheClient, executionID, attemptID string, stream espb.OutputStream) *Writer {
+	w := &Writer{
+		ctx:         ctx,
+		ac:          ac,
+		executionID: executionID,
+		attemptID:   attemptID,
+		stream:      stream,
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.flushLoop()
+	}()
+	return w
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	if remaining := *maxBytes - w.bytesWritten; int64(len(p)) > remaining {
+		p = p[:max(remaining, 0)]
+	}
+	w.buf.Write(p)
+	w.bytesWritten += int64(len(p))
+	if w.buf.Len() >= maxChunkSizeBytes {
+		select {
+		case w.flush <- struct{}{}:
+		default:
+		}
+	}
+	return n, nil
+}
+
+func (w *Writer) flushLoop() {
+	ticker := time.NewTicker(*flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		case <-w.flush:
+		}
+		w.writeChunks(w.ctx, false /*=final*/)
+	}
+}
+
+// writeChunks writes the buffered output to the cache. If final is true, a
+// final chunk is always written, even if there is no buffered output.
+func (w *Writer) writeChunks(ctx context.Context, final bool) {
+	w.mu.Lock()
+	data := bytes.Clone(w.buf.Bytes())
+	w.buf.Reset()
+	w.mu.Unlock()
+
+	if w.failed {
+		return
+	}
+	for len(data) > 0 || final {
+		n := min(len(data), maxChunkSizeBytes)
+		chunk := &espb.ExecutionOutputChunk{
+			Data:  data[:n],
+			Final: final && n == len(data),
+		}
+		data = data[n:]
+		if err := w.writeChunk(ctx, chunk); err != nil {
+			log.CtxWarningf(ctx, "Failed to write live %s output chunk %d: %s", w.stream, w.nextIndex, err)
+			w.failed = true
+			return
+		}
+		w.nextIndex++
+		if chunk.GetFinal() {
+			return
+		}
+	}
+}
+
+func (w *Writer) writeChunk(ctx context.Context, chunk *espb.ExecutionOutputChunk) error {
+	arn, err := chunkResourceName(w.executionID, w.attemptID, w.stream, w.nextIndex)
+	if err != nil {
+		return err
+	}
+	b, err := proto.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	return cachetools.UploadActionResult(ctx, w.ac, arn, &repb.ActionResult{StdoutRaw: b})
+}
+
+// Close writes any remaining output followed by the final chunk.
+func (w *Writer) Close() error {
+	close(w.done)
+	w.wg.Wait()
+	ctx, cancel := background.ExtendContextForFinalization(w.ctx, closeTimeout)
+	defer cancel()
+	w.writeChunks(ctx, true /*=final*/)
+	return nil
+}
+
+// Read returns the output that has been written to the given stream of an
+// execution attempt, starting at chunk startIndex. It returns the index of the
+// chunk that follows the returned data, and whether the final chunk was read.
+func Read(ctx context.Context, ac repb.ActionCacheClient, executionID, attemptID string, stream espb.OutputStream, startIndex int64) (data []byte, nextIndex int64, final bool, err error) {
+	if startIndex < 0 {
+		return nil, 0, false, status.InvalidArgumentErrorf("invalid chunk index %d", startIndex)
+	}
+	nextIndex = startIndex
+	for len(data) < maxReadSizeBytes {
+		arn, err := chunkResourceName(executionID, attemptID, stream, nextIndex)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		ar, err := cachetools.GetActionResult(ctx, ac, arn)
+		if status.IsNotFoundError(err) {
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+		chunk := &espb.ExecutionOutputChunk{}
+		if err := proto.Unmarshal(ar.GetStdoutRaw(), chunk); err != nil {
+			return nil, 0, false, status.InternalErrorf("unmarshal output chunk: %s", err)
+		}
+		data = append(data, chunk.GetData()...)
+		nextIndex++
+		if chunk.GetFinal() {
+			return data, nextIndex, true, nil
+		}
+	}
+	return data, nextIndex, false, nil
+}
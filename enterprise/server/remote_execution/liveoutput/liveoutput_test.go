@@ -0,0 +1,154 @@
+package liveoutput_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/liveoutput"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/testutil/enterprise_testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testcache"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/require"
+
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+func setupTestEnv(t *testing.T) *testenv.TestEnv {
+	te := testenv.GetTestEnv(t)
+	enterprise_testenv.AddClientIdentity(t, te, interfaces.ClientIdentityApp)
+	_, runServer, localGRPClis := testenv.RegisterLocalGRPCServer(t, te)
+	testcache.Setup(t, te, localGRPClis)
+	go runServer()
+	return te
+}
+
+func newExecutionID() string {
+	d := &repb.Digest{Hash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", SizeBytes: 100}
+	return digest.NewCASResourceName(d, "test-instance-name", repb.DigestFunction_SHA256).NewUploadString()
+}
+
+func TestWriteAndRead(t *testing.T) {
+	flags.Set(t, "executor.live_output.flush_interval", 10*time.Millisecond)
+	te := setupTestEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	executionID := newExecutionID()
+	attemptID, err := liveoutput.StartAttempt(ctx, ac, executionID)
+	require.NoError(t, err)
+
+	stdout := liveoutput.NewWriter(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT)
+	stderr := liveoutput.NewWriter(ctx, ac, executionID, attemptID, espb.OutputStream_STDERR)
+
+	// Nothing has been written yet.
+	data, next, final, err := liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, 0)
+	require.NoError(t, err)
+	require.Empty(t, data)
+	require.Equal(t, int64(0), next)
+	require.False(t, final)
+
+	_, err = stdout.Write([]byte("hello "))
+	require.NoError(t, err)
+	_, err = stderr.Write([]byte("warning"))
+	require.NoError(t, err)
+
+	// The output becomes readable before the writer is closed.
+	require.Eventually(t, func() bool {
+		data, next, final, err = liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, 0)
+		return err == nil && len(data) > 0
+	}, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, "hello ", string(data))
+	require.False(t, final)
+
+	_, err = stdout.Write([]byte("world"))
+	require.NoError(t, err)
+	require.NoError(t, stdout.Close())
+	require.NoError(t, stderr.Close())
+
+	// Reading from the next index returns only the new output.
+	data, _, final, err = liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, next)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(data))
+	require.True(t, final)
+
+	data, _, final, err = liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+	require.True(t, final)
+
+	data, _, final, err = liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDERR, 0)
+	require.NoError(t, err)
+	require.Equal(t, "warning", string(data))
+	require.True(t, final)
+}
+
+func TestMaxBytes(t *testing.T) {
+	flags.Set(t, "executor.live_output.max_bytes", 1024*1024)
+	te := setupTestEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	executionID := newExecutionID()
+	attemptID, err := liveoutput.StartAttempt(ctx, ac, executionID)
+	require.NoError(t, err)
+
+	w := liveoutput.NewWriter(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT)
+	var expected strings.Builder
+	for i := 0; expected.Len() < 2*1024*1024; i++ {
+		line := fmt.Sprintf("line %d\n", i)
+		expected.WriteString(line)
+		n, err := w.Write([]byte(line))
+		require.NoError(t, err)
+		require.Equal(t, len(line), n)
+	}
+	require.NoError(t, w.Close())
+
+	data, _, final, err := liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, 0)
+	require.NoError(t, err)
+	require.True(t, final)
+	require.Equal(t, expected.String()[:1024*1024], string(data))
+}
+
+func TestAttempts(t *testing.T) {
+	te := setupTestEnv(t)
+	ctx := context.Background()
+	ac := te.GetActionCacheClient()
+	executionID := newExecutionID()
+
+	_, err := liveoutput.LatestAttempt(ctx, ac, executionID)
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+
+	// The first attempt writes some output but never finishes.
+	attempt1, err := liveoutput.StartAttempt(ctx, ac, executionID)
+	require.NoError(t, err)
+	w1 := liveoutput.NewWriter(ctx, ac, executionID, attempt1, espb.OutputStream_STDOUT)
+	_, err = w1.Write([]byte("first"))
+	require.NoError(t, err)
+
+	// A retry of the execution writes its output separately.
+	attempt2, err := liveoutput.StartAttempt(ctx, ac, executionID)
+	require.NoError(t, err)
+	require.NotEqual(t, attempt1, attempt2)
+	latest, err := liveoutput.LatestAttempt(ctx, ac, executionID)
+	require.NoError(t, err)
+	require.Equal(t, attempt2, latest)
+	w2 := liveoutput.NewWriter(ctx, ac, executionID, attempt2, espb.OutputStream_STDOUT)
+	_, err = w2.Write([]byte("second"))
+	require.NoError(t, err)
+	require.NoError(t, w2.Close())
+	require.NoError(t, w1.Close())
+
+	for attemptID, expected := range map[string]string{attempt1: "first", attempt2: "second"} {
+		data, _, final, err := liveoutput.Read(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT, 0)
+		require.NoError(t, err)
+		require.True(t, final)
+		require.Equal(t, expected, string(data))
+	}
+}
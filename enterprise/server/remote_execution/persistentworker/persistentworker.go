@@ -7,10 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
@@ -35,6 +37,10 @@ const (
 	// after we send the shutdown signal before giving up.
 	persistentWorkerShutdownTimeout = 10 * time.Second
 
+	// How long to wait for a multiplex worker to acknowledge a cancelled
+	// request before giving up on it.
+	multiplexCancelTimeout = 5 * time.Second
+
 	// Protocol value identifying the JSON persistent worker protocol.
 	jsonProtocol = "json"
 
@@ -49,18 +55,41 @@ var (
 
 // Worker represents a persistent worker process that receives commands over
 // stdin and sends responses on stdout.
+//
+// A singleplex worker handles one request at a time, in the workspace that it
+// was started in. A multiplex worker handles many requests concurrently, each
+// in its own workspace under the worker's working directory: requests are
+// tagged with a request ID and responses are matched to requests by ID.
 type Worker struct {
 	workspace *workspace.Workspace
 	container container.CommandContainer
 	protocol  string // "json" or "proto"
 
+	// multiplex is whether the worker uses the multiplex protocol.
+	multiplex bool
+	// workDir is the working directory of a multiplex worker. Requests are
+	// sent to workspaces relative to this directory.
+	workDir string
+
 	stdinWriter *io.PipeWriter
 	stderr      lockingbuffer.LockingBuffer
+	// writeMu serializes writes to stdin from concurrent multiplex requests.
+	writeMu sync.Mutex
 
 	stdoutReader *bufio.Reader
 	jsonDecoder  *json.Decoder
 
-	stop func() error
+	mu            sync.Mutex // protects(nextRequestID, pending, readErr)
+	nextRequestID int32
+	// pending holds the response channels for in-flight multiplex requests,
+	// keyed by request ID.
+	pending map[int32]chan *wkpb.WorkResponse
+	// readErr is the error that stopped the multiplex response reader. No
+	// more requests can be sent once it is set.
+	readErr error
+
+	terminated chan struct{}
+	stop       func() error
 }
 
 // Start spawns a persistent worker inside the given container using
@@ -68,23 +97,46 @@ type Worker struct {
 // The provided context should be a long-lived context that lives longer
 // than just a single task.
 func Start(ctx context.Context, workspace *workspace.Workspace, container container.CommandContainer, protocol string, command *repb.Command) *Worker {
-	stdinReader, stdinWriter := io.Pipe()
-	stdoutReader, stdoutWriter := io.Pipe()
-
 	w := &Worker{
 		container: container,
 		workspace: workspace,
 		protocol:  protocol,
+	}
+	w.start(ctx, command)
+	return w
+}
 
-		stdinWriter:  stdinWriter,
-		stdoutReader: bufio.NewReader(stdoutReader),
+// StartMultiplex spawns a multiplex persistent worker inside the given
+// container, which must run commands in workDir. The worker can serve tasks
+// from any workspace under workDir.
+// The provided context should be a long-lived context that lives longer
+// than just a single task.
+func StartMultiplex(ctx context.Context, workDir string, container container.CommandContainer, protocol string, command *repb.Command) *Worker {
+	w := &Worker{
+		container:     container,
+		protocol:      protocol,
+		multiplex:     true,
+		workDir:       workDir,
+		nextRequestID: 1,
+		pending:       make(map[int32]chan *wkpb.WorkResponse),
 	}
-	if protocol == jsonProtocol {
+	w.start(ctx, command)
+	go w.readResponses()
+	return w
+}
+
+func (w *Worker) start(ctx context.Context, command *repb.Command) {
+	stdinReader, stdinWriter := io.Pipe()
+	stdoutReader, stdoutWriter := io.Pipe()
+
+	w.stdinWriter = stdinWriter
+	w.stdoutReader = bufio.NewReader(stdoutReader)
+	if w.protocol == jsonProtocol {
 		w.jsonDecoder = json.NewDecoder(stdoutReader)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
-	workerTerminated := make(chan struct{})
+	w.terminated = make(chan struct{})
 	w.stop = func() error {
 		// Canceling the worker context and closing stdin should terminate the
 		// worker exec process.
@@ -97,7 +149,7 @@ func Start(ctx context.Context, workspace *workspace.Workspace, container contai
 		ctx, cancel := background.ExtendContextForFinalization(ctx, persistentWorkerShutdownTimeout)
 		defer cancel()
 		select {
-		case <-workerTerminated:
+		case <-w.terminated:
 			return nil
 		case <-ctx.Done():
 			return status.DeadlineExceededError("Timed out waiting for persistent worker to shut down.")
@@ -109,7 +161,7 @@ func Start(ctx context.Context, workspace *workspace.Workspace, container contai
 	command.Arguments = append(args.WorkerArgs, "--persistent_worker")
 
 	go func() {
-		defer close(workerTerminated)
+		defer close(w.terminated)
 		defer stdinReader.Close()
 		defer stdoutWriter.Close()
 
@@ -121,26 +173,142 @@ func Start(ctx context.Context, workspace *workspace.Workspace, container contai
 		res := w.container.Exec(ctx, command, stdio)
 		log.Debugf("Persistent worker exited with response: %+v, flagFiles: %+v, workerArgs: %+v", res, args.FlagFiles, args.WorkerArgs)
 	}()
+}
 
-	return w
+// Multiplex returns whether the worker uses the multiplex protocol.
+func (w *Worker) Multiplex() bool {
+	return w.multiplex
+}
+
+// Exited returns whether the worker process has exited.
+func (w *Worker) Exited() bool {
+	select {
+	case <-w.terminated:
+		return true
+	default:
+		return false
+	}
 }
 
+// Exec sends a request to a singleplex worker and waits for the response.
 func (w *Worker) Exec(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	if w.multiplex {
+		return commandutil.ErrorResult(status.InternalError("Exec called on a multiplex persistent worker"))
+	}
+
 	// Clear any stderr that might be associated with a previous request.
 	w.stderr.Reset()
 
+	req, err := w.workRequest(w.workspace, command)
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	if err := w.marshalWorkRequest(req); err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf(
+			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
+			err, w.stderrDebugString()))
+	}
+
+	// Decode the response from stdout.
+	rsp := &wkpb.WorkResponse{}
+	if err := w.unmarshalWorkResponse(rsp); err != nil {
+		return commandutil.ErrorResult(status.UnavailableErrorf(
+			"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
+			err, w.stderrDebugString()))
+	}
+	return &interfaces.CommandResult{
+		Stderr:   []byte(rsp.Output),
+		ExitCode: int(rsp.ExitCode),
+	}
+}
+
+// ExecMultiplex sends a request for a task in the given workspace to a
+// multiplex worker and waits for the response. If ctx is done before the
+// worker responds, the worker is asked to cancel the request, and
+// ExecMultiplex waits a bounded amount of time for the worker to acknowledge
+// the cancellation, so that the worker is done with the workspace by the time
+// it is cleaned up.
+func (w *Worker) ExecMultiplex(ctx context.Context, ws *workspace.Workspace, command *repb.Command) *interfaces.CommandResult {
+	if !w.multiplex {
+		return commandutil.ErrorResult(status.InternalError("ExecMultiplex called on a singleplex persistent worker"))
+	}
+	sandboxDir, err := filepath.Rel(w.workDir, ws.Path())
+	if err != nil || sandboxDir == ".." || strings.HasPrefix(sandboxDir, "../") {
+		return commandutil.ErrorResult(status.InternalErrorf("workspace %q is not under the multiplex worker directory %q", ws.Path(), w.workDir))
+	}
+	req, err := w.workRequest(ws, command)
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	req.SandboxDir = sandboxDir
+
+	id, responses, err := w.addPendingRequest()
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	req.RequestId = id
+	if err := w.writeWorkRequest(req); err != nil {
+		w.removePendingRequest(id)
+		return commandutil.ErrorResult(status.UnavailableErrorf(
+			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
+			err, w.stderrDebugString()))
+	}
+
+	select {
+	case rsp, ok := <-responses:
+		if !ok {
+			return commandutil.ErrorResult(status.UnavailableErrorf(
+				"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
+				w.readError(), w.stderrDebugString()))
+		}
+		return &interfaces.CommandResult{
+			Stderr:   []byte(rsp.GetOutput()),
+			ExitCode: int(rsp.GetExitCode()),
+		}
+	case <-ctx.Done():
+		w.cancelRequest(ctx, id, responses)
+		return commandutil.ErrorResult(status.FromContextError(ctx))
+	}
+}
+
+// cancelRequest asks a multiplex worker to cancel a request and waits up to
+// multiplexCancelTimeout for the worker's response to it.
+func (w *Worker) cancelRequest(ctx context.Context, id int32, responses chan *wkpb.WorkResponse) {
+	if err := w.writeWorkRequest(&wkpb.WorkRequest{RequestId: id, Cancel: true}); err != nil {
+		w.removePendingRequest(id)
+		log.CtxWarningf(ctx, "Failed to cancel persistent work request %d: %s", id, err)
+		return
+	}
+	timer := time.NewTimer(multiplexCancelTimeout)
+	defer timer.Stop()
+	select {
+	case rsp, ok := <-responses:
+		if ok && !rsp.GetWasCancelled() {
+			log.CtxDebugf(ctx, "Persistent work request %d completed before it was cancelled", id)
+		}
+	case <-timer.C:
+		// If the worker responds after all, the reader drops the response
+		// since the request is no longer pending.
+		w.removePendingRequest(id)
+		log.CtxWarningf(ctx, "Timed out waiting for persistent worker to cancel request %d", id)
+	}
+}
+
+// workRequest returns the request to send to the worker for a command that
+// runs in the given workspace.
+func (w *Worker) workRequest(ws *workspace.Workspace, command *repb.Command) (*wkpb.WorkRequest, error) {
 	args := parseArgs(command.GetArguments())
-	expandedArguments, err := w.expandFlagFiles(args.FlagFiles)
+	expandedArguments, err := expandFlagFiles(ws.Path(), args.FlagFiles)
 	if err != nil {
-		return commandutil.ErrorResult(status.WrapError(err, "expand flag files"))
+		return nil, status.WrapError(err, "expand flag files")
 	}
 
 	// Collect all of the input digests.
-	inputs := make([]*wkpb.Input, 0, len(w.workspace.Inputs))
-	for path, digest := range w.workspace.Inputs {
+	inputs := make([]*wkpb.Input, 0, len(ws.Inputs))
+	for path, digest := range ws.Inputs {
 		digestBytes, err := proto.Marshal(digest)
 		if err != nil {
-			return commandutil.ErrorResult(status.WrapError(err, "marshal input digest"))
+			return nil, status.WrapError(err, "marshal input digest")
 		}
 		inputs = append(inputs, &wkpb.Input{
 			Digest: digestBytes,
@@ -148,30 +316,80 @@ func (w *Worker) Exec(ctx context.Context, command *repb.Command) *interfaces.Co
 		})
 	}
 
-	// Write the encoded request to stdin.
-	req := &wkpb.WorkRequest{
+	return &wkpb.WorkRequest{
 		Inputs:    inputs,
 		Arguments: expandedArguments,
+	}, nil
+}
+
+// addPendingRequest allocates an ID for a multiplex request and returns the
+// channel that its response will be sent on.
+func (w *Worker) addPendingRequest() (int32, chan *wkpb.WorkResponse, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.readErr != nil {
+		return 0, nil, status.UnavailableErrorf("persistent worker is not accepting requests: %s\npersistent worker stderr:\n%s", w.readErr, w.stderrDebugString())
 	}
-	if err := w.marshalWorkRequest(req); err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf(
-			"failed to send persistent work request: %s\npersistent worker stderr:\n%s",
-			err, w.stderrDebugString()))
+	id := w.nextRequestID
+	// Request ID 0 is reserved for singleplex requests.
+	if w.nextRequestID == math.MaxInt32 {
+		w.nextRequestID = 1
+	} else {
+		w.nextRequestID++
 	}
+	ch := make(chan *wkpb.WorkResponse, 1)
+	w.pending[id] = ch
+	return id, ch, nil
+}
 
-	// Decode the response from stdout.
-	rsp := &wkpb.WorkResponse{}
-	if err := w.unmarshalWorkResponse(rsp); err != nil {
-		return commandutil.ErrorResult(status.UnavailableErrorf(
-			"failed to read persistent work response: %s\npersistent worker stderr:\n%s",
-			err, w.stderrDebugString()))
-	}
-	return &interfaces.CommandResult{
-		Stderr:   []byte(rsp.Output),
-		ExitCode: int(rsp.ExitCode),
+func (w *Worker) removePendingRequest(id int32) {
+	w.mu.Lock()
+	delete(w.pending, id)
+	w.mu.Unlock()
+}
+
+func (w *Worker) readError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.readErr
+}
+
+// readResponses reads multiplex responses from stdout and sends each one to
+// the request with the same ID. When the worker's stdout is closed, it fails
+// all pending requests.
+func (w *Worker) readResponses() {
+	for {
+		rsp := &wkpb.WorkResponse{}
+		if err := w.unmarshalWorkResponse(rsp); err != nil {
+			w.mu.Lock()
+			w.readErr = err
+			for id, ch := range w.pending {
+				close(ch)
+				delete(w.pending, id)
+			}
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Lock()
+		ch, ok := w.pending[rsp.GetRequestId()]
+		delete(w.pending, rsp.GetRequestId())
+		w.mu.Unlock()
+		if !ok {
+			if !rsp.GetWasCancelled() {
+				log.Warningf("Dropping persistent work response for unknown request %d", rsp.GetRequestId())
+			}
+			continue
+		}
+		ch <- rsp
 	}
 }
 
+func (w *Worker) writeWorkRequest(req *wkpb.WorkRequest) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.marshalWorkRequest(req)
+}
+
 // Stop kills the worker process and waits for it to exit.
 func (w *Worker) Stop() error {
 	log.Debugf("Stopping persistent worker")
@@ -246,11 +464,11 @@ func (w *Worker) unmarshalWorkResponse(responseProto *wkpb.WorkResponse) error {
 //
 // Based on:
 // https://github.com/bazelbuild/bazel/blob/e9e6978809b0214e336fee05047d5befe4f4e0c3/src/main/java/com/google/devtools/build/lib/worker/WorkerSpawnRunner.java#L324
-func (w *Worker) expandFlagFiles(args []string) ([]string, error) {
+func expandFlagFiles(dir string, args []string) ([]string, error) {
 	expandedArgs := make([]string, 0)
 	for _, arg := range args {
 		if strings.HasPrefix(arg, "@") && !strings.HasPrefix(arg, "@@") && !externalRepositoryPattern.MatchString(arg) {
-			file, err := os.Open(filepath.Join(w.workspace.Path(), arg[1:]))
+			file, err := os.Open(filepath.Join(dir, arg[1:]))
 			if err != nil {
 				return nil, err
 			}
@@ -260,7 +478,7 @@ func (w *Worker) expandFlagFiles(args []string) ([]string, error) {
 			// cases. Increase it to 1MB.
 			scanner.Buffer(nil, 1024*1024)
 			for scanner.Scan() {
-				args, err := w.expandFlagFiles([]string{scanner.Text()})
+				args, err := expandFlagFiles(dir, []string{scanner.Text()})
 				if err != nil {
 					return nil, err
 				}
@@ -94,6 +94,8 @@ const (
 	persistentWorkerPropertyName            = "persistent-workers"
 	persistentWorkerKeyPropertyName         = "persistentWorkerKey"
 	persistentWorkerProtocolPropertyName    = "persistentWorkerProtocol"
+	persistentWorkerMultiplexPropertyName   = "persistentWorkerMultiplex"
+	multiplexSandboxingPropertyName         = "supports-multiplex-sandboxing"
 	WorkflowIDPropertyName                  = "workflow-id"
 	WorkloadIsolationPropertyName           = "workload-isolation-type"
 	initDockerdPropertyName                 = "init-dockerd"
@@ -113,6 +115,7 @@ const (
 	RetryPropertyName                       = "retry"
 	SkipResavingActionSnapshotsPropertyName = "skip-resaving-action-snapshots"
 	PersistentVolumesPropertyName           = "persistent-volumes"
+	NetworkEgressAllowlistPropertyName      = "network-egress-allowlist"
 
 	OperatingSystemPropertyName = "OSFamily"
 	LinuxOperatingSystemName    = "linux"
@@ -240,6 +243,16 @@ type Properties struct {
 	WorkflowID               string
 	HostedBazelAffinityKey   string
 
+	// PersistentWorkerMultiplex specifies whether the persistent worker
+	// supports the multiplex protocol, which lets a single worker process
+	// handle requests from many tasks concurrently.
+	PersistentWorkerMultiplex bool
+	// MultiplexSandboxing specifies whether a multiplex persistent worker
+	// honors the sandbox_dir field of work requests. Workers that don't would
+	// run every request in their own working directory, so they can't be
+	// shared by tasks with separate workspaces.
+	MultiplexSandboxing bool
+
 	// DisableMeasuredTaskSize disables measurement-based task sizing, even if
 	// it is enabled via flag, and instead uses the default / platform based
 	// sizing. Intended for debugging purposes only and should not generally
@@ -276,6 +289,13 @@ type Properties struct {
 	// Persistent volumes shared across all actions within a group. Requires
 	// `executor.enable_persistent_volumes` to be enabled.
 	PersistentVolumes []PersistentVolume
+
+	// NetworkEgressAllowlist restricts outgoing network connections to the
+	// listed destinations, which have the form "<host>[:<port>[-<port>]]".
+	// Connections to other destinations are rejected and reported in the
+	// action's auxiliary logs. Only supported for OCI and firecracker
+	// isolation types.
+	NetworkEgressAllowlist []string
 }
 
 type PersistentVolume struct {
@@ -442,6 +462,8 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		PersistentWorker:          boolProp(m, persistentWorkerPropertyName, false),
 		PersistentWorkerKey:       stringProp(m, persistentWorkerKeyPropertyName, ""),
 		PersistentWorkerProtocol:  stringProp(m, persistentWorkerProtocolPropertyName, ""),
+		PersistentWorkerMultiplex: boolProp(m, persistentWorkerMultiplexPropertyName, false),
+		MultiplexSandboxing:       boolProp(m, multiplexSandboxingPropertyName, false),
 		WorkflowID:                stringProp(m, WorkflowIDPropertyName, ""),
 		HostedBazelAffinityKey:    stringProp(m, HostedBazelAffinityKeyPropertyName, ""),
 		DisableMeasuredTaskSize:   boolProp(m, disableMeasuredTaskSizePropertyName, false),
@@ -451,6 +473,7 @@ func ParseProperties(task *repb.ExecutionTask) (*Properties, error) {
 		OverrideSnapshotKey:       overrideSnapshotKey,
 		Retry:                     boolProp(m, RetryPropertyName, true),
 		PersistentVolumes:         persistentVolumes,
+		NetworkEgressAllowlist:    stringListProp(m, NetworkEgressAllowlistPropertyName),
 	}, nil
 }
 
@@ -574,6 +597,17 @@ func ApplyOverrides(env environment.Env, executorProps *ExecutorProperties, plat
 		return status.InvalidArgumentErrorf("The requested workload isolation type %q is unsupported by this executor. Supported types: %s)", platformProps.WorkloadIsolationType, executorProps.SupportedIsolationTypes)
 	}
 
+	// Egress allowlists are only enforced by isolation types that manage
+	// their own network namespace. Refuse to run the action elsewhere rather
+	// than silently giving it unrestricted network access.
+	if len(platformProps.NetworkEgressAllowlist) > 0 {
+		switch ContainerType(platformProps.WorkloadIsolationType) {
+		case OCIContainerType, FirecrackerContainerType:
+		default:
+			return status.FailedPreconditionErrorf("%s is not supported for workload isolation type %q", NetworkEgressAllowlistPropertyName, platformProps.WorkloadIsolationType)
+		}
+	}
+
 	// Normalize the container image string
 	if platformProps.WorkloadIsolationType == string(BareContainerType) {
 		// BareRunner strings become ""
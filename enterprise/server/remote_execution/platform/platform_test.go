@@ -626,6 +626,36 @@ func TestForceNetworkIsolationType(t *testing.T) {
 	}
 }
 
+func TestNetworkEgressAllowlist(t *testing.T) {
+	executorProps := &ExecutorProperties{SupportedIsolationTypes: []ContainerType{BareContainerType, PodmanContainerType, FirecrackerContainerType, OCIContainerType}}
+	for _, testCase := range []struct {
+		workloadIsolationType string
+		expectError           bool
+	}{
+		{"oci", false},
+		{"firecracker", false},
+		{"podman", true},
+		{"none", true},
+	} {
+		t.Run(testCase.workloadIsolationType, func(t *testing.T) {
+			plat := &repb.Platform{Properties: []*repb.Platform_Property{
+				{Name: "network-egress-allowlist", Value: "example.com:443"},
+				{Name: "workload-isolation-type", Value: testCase.workloadIsolationType},
+			}}
+			platformProps, err := ParseProperties(&repb.ExecutionTask{Command: &repb.Command{Platform: plat}})
+			require.NoError(t, err)
+			env := testenv.GetTestEnv(t)
+			env.SetXcodeLocator(&xcodeLocator{})
+			err = ApplyOverrides(env, executorProps, platformProps, &repb.Command{})
+			if testCase.expectError {
+				require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestExtraEnvVars(t *testing.T) {
 	for _, tc := range []struct {
 		name            string
@@ -0,0 +1,264 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/background"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+)
+
+var (
+	debugShellEnabled   = flag.Bool("executor.debug_shell.enabled", false, "If true, users can attach interactive debug shells to the containers of running executions, and of failed executions while their runners are held.")
+	failedRunnerHold    = flag.Duration("executor.debug_shell.failed_runner_hold_duration", 5*time.Minute, "How long to keep the runner of a failed execution paused so that a debug shell can be attached to it. 0 disables holding failed runners.")
+	maxHeldRunnerCount  = flag.Int("executor.debug_shell.max_held_runners", 2, "The maximum number of failed runners to hold at once. Runners of executions that fail while this many runners are held are removed as usual.")
+	debugShellIsolation = []platform.ContainerType{
+		platform.OCIContainerType,
+		platform.PodmanContainerType,
+		platform.FirecrackerContainerType,
+	}
+)
+
+// debugShellScript starts an interactive shell in the container. Commands are
+// executed with pipes rather than a terminal, so if script(1) is available,
+// it is used to run the shell in a pseudo-terminal sized to match the
+// client's terminal.
+const debugShellScript = `
+shell=/bin/sh
+if command -v bash >/dev/null 2>&1; then shell=bash; fi
+if command -v script >/dev/null 2>&1; then
+  exec script -q -c "stty rows $LINES cols $COLUMNS 2>/dev/null; exec $shell -i" /dev/null
+fi
+echo "script(1) is not available in this container; starting $shell without a terminal." >&2
+exec $shell -i
+`
+
+// heldRunner is the runner of a failed execution, which is kept paused for a
+// while after the execution finishes so that a debug shell can be attached to
+// it.
+type heldRunner struct {
+	runner *taskRunner
+	timer  *time.Timer
+	// pausing is set while the container is being paused. Shells can't be
+	// attached until it is paused.
+	pausing bool
+	// expired is set if the hold duration passes while a shell is attached or
+	// while the container is being paused. The runner is removed once the
+	// shell exits or the pause completes.
+	expired bool
+}
+
+// debugShellEnabledFor returns whether debug shells can be attached to the
+// given runner.
+func debugShellEnabledFor(r *taskRunner) bool {
+	return *debugShellEnabled && slices.Contains(debugShellIsolation, platform.ContainerType(r.PlatformProperties.WorkloadIsolationType))
+}
+
+// holdForDebugShell holds the runner of a failed execution instead of
+// recycling or removing it. It returns whether the runner was held, in which
+// case the caller must not use it any more.
+//
+// If a shell is already attached to the execution, the container is left
+// running until the shell exits, so that the session isn't frozen.
+func (p *pool) holdForDebugShell(ctx context.Context, r *taskRunner) bool {
+	if !debugShellEnabledFor(r) || !r.taskFailed || *failedRunnerHold <= 0 {
+		return false
+	}
+	executionID := r.task.GetExecutionId()
+	p.mu.Lock()
+	if p.isShuttingDown || r.state != ready || len(p.heldRunners) >= *maxHeldRunnerCount || p.heldRunners[executionID] != nil {
+		p.mu.Unlock()
+		return false
+	}
+	p.remove(r)
+	h := &heldRunner{runner: r, pausing: !r.debugShellActive}
+	h.timer = time.AfterFunc(*failedRunnerHold, func() {
+		p.releaseHeldRunner(ctx, executionID)
+	})
+	p.heldRunners[executionID] = h
+	p.mu.Unlock()
+	log.CtxInfof(ctx, "Holding runner %s of failed execution for %s so that a debug shell can be attached", r, *failedRunnerHold)
+
+	if h.pausing {
+		p.pauseHeldRunner(ctx, executionID, h)
+	}
+	return true
+}
+
+// pauseHeldRunner pauses the container of a held runner that has no shell
+// attached. The runner is removed if pausing fails, or if it stopped being
+// held while it was being paused. h.pausing must be set.
+func (p *pool) pauseHeldRunner(ctx context.Context, executionID string, h *heldRunner) {
+	err := h.runner.Container.Pause(ctx)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to pause held runner %s: %s", h.runner, err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h.pausing = false
+	if err == nil && !h.expired && !p.isShuttingDown {
+		return
+	}
+	h.timer.Stop()
+	if p.heldRunners[executionID] == h {
+		delete(p.heldRunners, executionID)
+	}
+	h.runner.RemoveInBackground(ctx)
+}
+
+// releaseHeldRunner removes a held runner once its hold duration has passed.
+func (p *pool) releaseHeldRunner(ctx context.Context, executionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.heldRunners[executionID]
+	if h == nil {
+		return
+	}
+	if h.runner.debugShellActive || h.pausing {
+		h.expired = true
+		return
+	}
+	delete(p.heldRunners, executionID)
+	log.CtxInfof(ctx, "Releasing held runner %s", h.runner)
+	h.runner.RemoveInBackground(ctx)
+}
+
+// acquireDebugShellRunner finds the runner of the given execution and marks
+// it as having a debug shell attached. It returns whether the runner is held
+// (and therefore paused) because the execution has already finished.
+func (p *pool) acquireDebugShellRunner(executionID string) (*taskRunner, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var r *taskRunner
+	h := p.heldRunners[executionID]
+	if h != nil {
+		if h.pausing {
+			return nil, false, status.UnavailableErrorf("the runner of execution %q is being paused; try again", executionID)
+		}
+		r = h.runner
+	} else {
+		for _, pr := range p.runners {
+			if pr.state == ready && pr.task.GetExecutionId() == executionID {
+				r = pr
+				break
+			}
+		}
+	}
+	if r == nil {
+		return nil, false, status.NotFoundErrorf("execution %q is not running on this executor, and its runner is not being held", executionID)
+	}
+	if !debugShellEnabledFor(r) {
+		return nil, false, status.FailedPreconditionErrorf("debug shells are not supported for isolation type %q", r.PlatformProperties.WorkloadIsolationType)
+	}
+	if r.debugShellActive {
+		return nil, false, status.AlreadyExistsErrorf("a debug shell is already attached to execution %q", executionID)
+	}
+	r.debugShellActive = true
+	return r, h != nil, nil
+}
+
+// releaseDebugShellRunner is called once a debug shell exits. If the runner
+// is held, which may have started while the shell was attached, it is paused
+// again, or removed if its hold has expired.
+func (p *pool) releaseDebugShellRunner(ctx context.Context, executionID string, r *taskRunner) {
+	// The shell's context is usually cancelled by the time it exits.
+	ctx, cancel := background.ExtendContextForFinalization(ctx, runnerCleanupTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	r.debugShellActive = false
+	h := p.heldRunners[executionID]
+	if h == nil || h.runner != r {
+		// The execution is still running, or the runner was already removed.
+		p.mu.Unlock()
+		return
+	}
+	h.pausing = true
+	p.mu.Unlock()
+	p.pauseHeldRunner(ctx, executionID, h)
+}
+
+// removeHeldRunners stops holding all runners that don't have a debug shell
+// attached and aren't being paused, and returns them so that the caller can
+// remove them. The other runners are removed when the shell exits or the
+// pause completes. p.mu must be held.
+func (p *pool) removeHeldRunners() []*taskRunner {
+	var removed []*taskRunner
+	for executionID, h := range p.heldRunners {
+		if h.runner.debugShellActive || h.pausing {
+			continue
+		}
+		h.timer.Stop()
+		delete(p.heldRunners, executionID)
+		removed = append(removed, h.runner)
+	}
+	return removed
+}
+
+func debugShellCommand(task *repb.ExecutionTask, req *dspb.ShellRequest) *repb.Command {
+	term := req.GetTerm()
+	if term == "" {
+		term = "xterm"
+	}
+	rows := req.GetTerminalSize().GetRows()
+	if rows <= 0 {
+		rows = 24
+	}
+	cols := req.GetTerminalSize().GetCols()
+	if cols <= 0 {
+		cols = 80
+	}
+	var env []*repb.Command_EnvironmentVariable
+	for _, e := range task.GetCommand().GetEnvironmentVariables() {
+		switch e.GetName() {
+		case "TERM", "LINES", "COLUMNS":
+			continue
+		}
+		env = append(env, e)
+	}
+	env = append(env,
+		&repb.Command_EnvironmentVariable{Name: "TERM", Value: term},
+		&repb.Command_EnvironmentVariable{Name: "LINES", Value: fmt.Sprint(rows)},
+		&repb.Command_EnvironmentVariable{Name: "COLUMNS", Value: fmt.Sprint(cols)},
+	)
+	return &repb.Command{
+		Arguments:            []string{"/bin/sh", "-c", debugShellScript},
+		EnvironmentVariables: env,
+		WorkingDirectory:     task.GetCommand().GetWorkingDirectory(),
+	}
+}
+
+// DebugShell runs an interactive shell in the container of the runner that is
+// executing the requested execution, or that is being held after the
+// execution failed.
+func (p *pool) DebugShell(ctx context.Context, req *dspb.ShellRequest, stdio *interfaces.Stdio) (int, error) {
+	if !*debugShellEnabled {
+		return 0, status.FailedPreconditionError("debug shells are not enabled on this executor")
+	}
+	r, held, err := p.acquireDebugShellRunner(req.GetExecutionId())
+	if err != nil {
+		return 0, err
+	}
+	defer p.releaseDebugShellRunner(ctx, req.GetExecutionId(), r)
+
+	if held {
+		if err := r.Container.Unpause(ctx); err != nil {
+			return 0, status.UnavailableErrorf("unpause held runner: %s", err)
+		}
+	}
+	log.CtxInfof(ctx, "Attaching debug shell to runner %s", r)
+	res := r.Container.Exec(ctx, debugShellCommand(r.task, req), stdio)
+	if res.Error != nil {
+		return 0, res.Error
+	}
+	return res.ExitCode, nil
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/fs"
 	"math"
 	"os"
@@ -21,6 +22,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/block_io"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/commandutil"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/container"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/liveoutput"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/persistentworker"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/platform"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/snaputil"
@@ -40,6 +42,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/fspath"
+	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/random"
@@ -49,6 +52,7 @@ import (
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/types/known/durationpb"
 
+	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
@@ -191,10 +195,20 @@ type taskRunner struct {
 	state state
 
 	worker *persistentworker.Worker
+	// multiplexWorkerKey is the key of the pool's multiplex persistent worker
+	// that this runner holds a reference to, if any.
+	multiplexWorkerKey string
 
 	// Keeps track of whether or not we encountered any errors that make the runner non-reusable.
 	doNotReuse bool
 
+	// Whether the last task executed by this runner failed, either with an
+	// error or a non-zero exit code.
+	taskFailed bool
+	// Whether a debug shell is attached to this runner. Protected by the
+	// pool's mutex.
+	debugShellActive bool
+
 	// A function that is invoked after the runner is removed. Controlled by the
 	// runner pool.
 	removeCallback func()
@@ -299,6 +313,8 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 		// reported.
 		// Also, skip recycling in this case, because the nonsensical result
 		// will persist across tasks.
+		r.taskFailed = res.Error != nil || res.ExitCode != 0
+
 		runDuration := time.Since(start)
 		stats := res.UsageStats
 		if cpuStallDuration := time.Duration(stats.GetCpuPressure().GetFull().GetTotal()) * time.Microsecond; cpuStallDuration > runDuration {
@@ -342,9 +358,12 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 		res.VfsStats = r.Workspace.ComputeVFSStats()
 	}()
 
-	if !r.PlatformProperties.RecycleRunner {
+	if !r.PlatformProperties.RecycleRunner && !liveoutput.Enabled() && !debugShellEnabledFor(r) {
 		// If the container is not recyclable, then use `Run` to walk through
-		// the entire container lifecycle in a single step.
+		// the entire container lifecycle in a single step. Live output
+		// requires `Exec`, since `Run` doesn't accept stdio, and debug shells
+		// require a container that outlives the command; the container is
+		// still removed when the runner is removed.
 		// TODO: Remove this `Run` method and call lifecycle methods directly.
 		creds, err := r.pullCredentials()
 		if err != nil {
@@ -392,7 +411,7 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 		return r.sendPersistentWorkRequest(ctx, command)
 	}
 
-	execResult := r.Container.Exec(ctx, command, &interfaces.Stdio{})
+	execResult := r.exec(ctx, command)
 
 	if r.hasMaxResourceUtilization(ctx, execResult.UsageStats) {
 		r.doNotReuse = true
@@ -401,11 +420,43 @@ func (r *taskRunner) Run(ctx context.Context, ioStats *repb.IOStats) (res *inter
 	return execResult
 }
 
+// exec executes the command in the container. If live output is enabled,
+// stdout and stderr are also streamed to the cache while the command runs.
+func (r *taskRunner) exec(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	if !liveoutput.Enabled() {
+		return r.Container.Exec(ctx, command, &interfaces.Stdio{})
+	}
+	ac := r.env.GetActionCacheClient()
+	executionID := r.task.GetExecutionId()
+	attemptID, err := liveoutput.StartAttempt(ctx, ac, executionID)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to start streaming live output: %s", err)
+		return r.Container.Exec(ctx, command, &interfaces.Stdio{})
+	}
+	liveStdout := liveoutput.NewWriter(ctx, ac, executionID, attemptID, espb.OutputStream_STDOUT)
+	liveStderr := liveoutput.NewWriter(ctx, ac, executionID, attemptID, espb.OutputStream_STDERR)
+	// When stdio is set, output is written to it instead of the command
+	// result, so keep a copy to populate the result with.
+	var stdout, stderr bytes.Buffer
+	res := r.Container.Exec(ctx, command, &interfaces.Stdio{
+		Stdout: io.MultiWriter(&stdout, liveStdout),
+		Stderr: io.MultiWriter(&stderr, liveStderr),
+	})
+	liveStdout.Close()
+	liveStderr.Close()
+	res.Stdout = stdout.Bytes()
+	res.Stderr = stderr.Bytes()
+	return res
+}
+
 func (r *taskRunner) GracefulTerminate(ctx context.Context) error {
 	return r.Container.Signal(ctx, syscall.SIGTERM)
 }
 
 func (r *taskRunner) sendPersistentWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	if usesMultiplexWorker(r.PlatformProperties) {
+		return r.sendMultiplexWorkRequest(ctx, command)
+	}
 	// Mark the runner as doNotReuse until the task is completed without error.
 	r.doNotReuse = true
 	if r.worker == nil {
@@ -419,6 +470,20 @@ func (r *taskRunner) sendPersistentWorkRequest(ctx context.Context, command *rep
 	return res
 }
 
+func (r *taskRunner) sendMultiplexWorkRequest(ctx context.Context, command *repb.Command) *interfaces.CommandResult {
+	// Mark the runner as doNotReuse until the task is completed without error.
+	r.doNotReuse = true
+	worker, err := r.p.acquireMultiplexWorker(ctx, r, command)
+	if err != nil {
+		return commandutil.ErrorResult(err)
+	}
+	res := worker.ExecMultiplex(ctx, r.Workspace, command)
+	if res.Error == nil {
+		r.doNotReuse = false
+	}
+	return res
+}
+
 func (r *taskRunner) UploadOutputs(ctx context.Context, ioStats *repb.IOStats, executeResponse *repb.ExecuteResponse, cmdResult *interfaces.CommandResult) error {
 	txInfo, err := r.Workspace.UploadOutputs(ctx, r.task.Command, executeResponse, cmdResult)
 	if err != nil {
@@ -478,6 +543,9 @@ func (r *taskRunner) Remove(ctx context.Context) error {
 			errs = append(errs, err)
 		}
 	}
+	if r.multiplexWorkerKey != "" {
+		r.p.releaseMultiplexWorker(ctx, r.multiplexWorkerKey)
+	}
 	if err := r.Container.Remove(ctx); err != nil {
 		errs = append(errs, err)
 	}
@@ -560,6 +628,43 @@ type pool struct {
 	isShuttingDown bool
 	// runners holds all runners managed by the pool.
 	runners []*taskRunner
+	// heldRunners holds the runners of failed executions that are kept
+	// paused for debug shells, keyed by execution ID. These are not in
+	// runners.
+	heldRunners map[string]*heldRunner
+
+	multiplexMu sync.Mutex // protects(multiplexWorkers)
+	// multiplexWorkers holds the multiplex persistent workers that are shared
+	// by runners with the same key, keyed by multiplexWorkerKey.
+	multiplexWorkers map[string]*multiplexWorker
+}
+
+// multiplexWorker is a multiplex persistent worker that runs in its own
+// container. It serves the tasks of all of the runners whose workspaces are in
+// its working directory.
+type multiplexWorker struct {
+	// ready is closed once the worker has started, or failed to start. The
+	// fields below it may only be read after it is closed.
+	ready     chan struct{}
+	worker    *persistentworker.Worker
+	container *container.TracedCommandContainer
+	err       error
+
+	// refs is the number of runners that have used the worker and have not
+	// been removed yet. The worker is stopped when this drops to 0. Protected
+	// by the pool's multiplexMu.
+	refs int
+}
+
+// exited returns whether the worker failed to start or has exited, in which
+// case it needs to be replaced.
+func (mw *multiplexWorker) exited() bool {
+	select {
+	case <-mw.ready:
+		return mw.err != nil || mw.worker.Exited()
+	default:
+		return false
+	}
 }
 
 func NewPool(env environment.Env, cacheRoot string, opts *PoolOptions) (*pool, error) {
@@ -578,6 +683,9 @@ func NewPool(env environment.Env, cacheRoot string, opts *PoolOptions) (*pool, e
 		cacheRoot:    cacheRoot,
 		cgroupParent: opts.CgroupParent,
 		runners:      []*taskRunner{},
+		heldRunners:  map[string]*heldRunner{},
+
+		multiplexWorkers: map[string]*multiplexWorker{},
 	}
 	if err := os.MkdirAll(p.buildRoot, fs.FileMode(0755)); err != nil {
 		return nil, status.InternalErrorf("Failed to create build root directory %q: %s", p.buildRoot, err)
@@ -1020,7 +1128,20 @@ func (p *pool) newRunner(ctx context.Context, key *rnpb.RunnerKey, props *platfo
 		UseOverlayfs:    useOverlayfs,
 		UseVFS:          props.EnableVFS && platform.ContainerType(props.WorkloadIsolationType) != platform.FirecrackerContainerType,
 	}
-	ws, err := workspace.New(p.env, p.buildRoot, wsOpts)
+	parentDir := p.buildRoot
+	if usesMultiplexWorker(props) {
+		// Create the workspace in the multiplex worker's directory so that
+		// the worker can serve this runner's tasks.
+		mk, err := multiplexWorkerKey(key)
+		if err != nil {
+			return nil, err
+		}
+		parentDir = p.multiplexWorkerDir(mk)
+		if err := os.MkdirAll(parentDir, 0755); err != nil {
+			return nil, status.UnavailableErrorf("create multiplex worker directory: %s", err)
+		}
+	}
+	ws, err := workspace.New(p.env, parentDir, wsOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -1128,6 +1249,134 @@ func keyString(k *rnpb.RunnerKey) string {
 	)
 }
 
+// usesMultiplexWorker returns whether tasks with the given properties share a
+// multiplex persistent worker. Multiplex workers are only supported for bare
+// isolation, since the worker must be able to see the workspaces of all of the
+// runners that share it, and only for workers that support sandboxing, since
+// each runner's tasks run in its own workspace. Other tasks use a singleplex
+// worker per runner.
+func usesMultiplexWorker(props *platform.Properties) bool {
+	return props.PersistentWorkerMultiplex && props.MultiplexSandboxing && platform.ContainerType(props.WorkloadIsolationType) == platform.BareContainerType
+}
+
+// multiplexWorkerKey returns the key that identifies the multiplex worker for
+// a runner key. Runners with the same group, instance name, platform, and
+// persistent worker key share a multiplex worker.
+func multiplexWorkerKey(k *rnpb.RunnerKey) (string, error) {
+	ph, err := platformHash(k.GetPlatform())
+	if err != nil {
+		return "", err
+	}
+	return hash.String(strings.Join([]string{k.GetGroupId(), k.GetInstanceName(), ph, k.GetPersistentWorkerKey()}, "/")), nil
+}
+
+// multiplexWorkerDir returns the working directory of a multiplex worker. The
+// workspaces of the runners that share the worker are created inside it.
+func (p *pool) multiplexWorkerDir(key string) string {
+	return filepath.Join(p.buildRoot, "multiplex", key)
+}
+
+// acquireMultiplexWorker returns the multiplex worker for the runner's key,
+// starting one if needed, and records that the runner is using it. The pool's
+// multiplexMu is not held while the worker's container is created, so other
+// keys aren't blocked on it; runners that need the same worker wait for it to
+// be ready instead.
+func (p *pool) acquireMultiplexWorker(ctx context.Context, r *taskRunner, command *repb.Command) (*persistentworker.Worker, error) {
+	key, err := multiplexWorkerKey(r.key)
+	if err != nil {
+		return nil, err
+	}
+
+	p.multiplexMu.Lock()
+	mw := p.multiplexWorkers[key]
+	var prev *multiplexWorker
+	if mw != nil && mw.exited() {
+		prev, mw = mw, nil
+	}
+	start := mw == nil
+	if start {
+		mw = &multiplexWorker{ready: make(chan struct{})}
+		if prev != nil {
+			// The runners using the exited worker still hold references,
+			// which they release when they are removed.
+			mw.refs = prev.refs
+		}
+		p.multiplexWorkers[key] = mw
+	}
+	if r.multiplexWorkerKey == "" {
+		r.multiplexWorkerKey = key
+		mw.refs++
+	}
+	p.multiplexMu.Unlock()
+
+	if start {
+		if prev != nil {
+			log.CtxInfof(ctx, "Multiplex persistent worker for %s exited; restarting it", keyString(r.key))
+			p.stopMultiplexWorker(ctx, prev)
+		} else {
+			log.CtxInfof(ctx, "Starting multiplex persistent worker for %s", keyString(r.key))
+		}
+		mw.worker, mw.container, mw.err = p.startMultiplexWorker(ctx, key, r, command)
+		close(mw.ready)
+	}
+	select {
+	case <-mw.ready:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx)
+	}
+	if mw.err != nil {
+		return nil, mw.err
+	}
+	return mw.worker, nil
+}
+
+func (p *pool) startMultiplexWorker(ctx context.Context, key string, r *taskRunner, command *repb.Command) (*persistentworker.Worker, *container.TracedCommandContainer, error) {
+	dir := p.multiplexWorkerDir(key)
+	ctr, err := p.newContainer(ctx, r.PlatformProperties, &repb.ScheduledTask{ExecutionTask: r.task}, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctr.Create(ctx, dir); err != nil {
+		return nil, nil, err
+	}
+	worker := persistentworker.StartMultiplex(p.env.GetServerContext(), dir, ctr, r.PlatformProperties.PersistentWorkerProtocol, command)
+	return worker, ctr, nil
+}
+
+// releaseMultiplexWorker is called when a runner that used a multiplex worker
+// is removed. The worker is stopped once no runners are using it.
+func (p *pool) releaseMultiplexWorker(ctx context.Context, key string) {
+	p.multiplexMu.Lock()
+	mw := p.multiplexWorkers[key]
+	if mw == nil {
+		p.multiplexMu.Unlock()
+		return
+	}
+	mw.refs--
+	if mw.refs > 0 {
+		p.multiplexMu.Unlock()
+		return
+	}
+	delete(p.multiplexWorkers, key)
+	p.multiplexMu.Unlock()
+	p.stopMultiplexWorker(ctx, mw)
+}
+
+// stopMultiplexWorker stops a worker that is no longer in the pool's map,
+// waiting for it to finish starting first if needed.
+func (p *pool) stopMultiplexWorker(ctx context.Context, mw *multiplexWorker) {
+	<-mw.ready
+	if mw.err != nil {
+		return
+	}
+	if err := mw.worker.Stop(); err != nil {
+		log.CtxWarningf(ctx, "Failed to stop multiplex persistent worker: %s", err)
+	}
+	if err := mw.container.Remove(ctx); err != nil {
+		log.CtxWarningf(ctx, "Failed to remove multiplex persistent worker container: %s", err)
+	}
+}
+
 func (p *pool) String() string {
 	return runnerSlice(p.runners).String()
 }
@@ -1261,7 +1510,7 @@ func (p *pool) Shutdown(ctx context.Context) error {
 			activeRunners = append(activeRunners, r)
 		}
 	}
-	runnersToRemove = pausedRunners
+	runnersToRemove = append(pausedRunners, p.removeHeldRunners()...)
 	p.runners = activeRunners
 	if len(runnersToRemove) > 0 {
 		log.Infof("Runner pool: removing %s", runnerSlice(runnersToRemove))
@@ -1329,6 +1578,12 @@ func (p *pool) TryRecycle(ctx context.Context, r interfaces.Runner, finishedClea
 		return
 	}
 
+	// Hold the runners of failed executions for a while, so that users can
+	// attach debug shells to them.
+	if p.holdForDebugShell(ctx, cr) {
+		return
+	}
+
 	recycled := false
 	defer func() {
 		if !recycled {
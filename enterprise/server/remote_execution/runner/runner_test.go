@@ -8,9 +8,12 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -34,8 +37,10 @@ import (
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/encoding/protojson"
 
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
 )
@@ -77,9 +82,11 @@ type fakeContainer struct {
 	CreateError                error
 	Removed                    chan struct{}
 	Result                     *interfaces.CommandResult
-	Isolation                  string // Fake isolation type name
-	ImageCached                bool   // Return value for IsImageCached
-	BlockPull                  bool   // PullImage blocks forever if true.
+	Isolation                  string                  // Fake isolation type name
+	ImageCached                bool                    // Return value for IsImageCached
+	BlockPull                  bool                    // PullImage blocks forever if true.
+	ExecHook                   func(cmd *repb.Command) // Called by Exec, if set.
+	Paused                     atomic.Bool
 }
 
 func NewFakeContainer() *fakeContainer {
@@ -117,6 +124,9 @@ func (c *fakeContainer) Create(ctx context.Context, workdir string) error {
 }
 
 func (c *fakeContainer) Exec(ctx context.Context, cmd *repb.Command, stdio *interfaces.Stdio) *interfaces.CommandResult {
+	if c.ExecHook != nil {
+		c.ExecHook(cmd)
+	}
 	return c.Result
 }
 
@@ -125,6 +135,16 @@ func (c *fakeContainer) Remove(ctx context.Context) error {
 	return nil
 }
 
+func (c *fakeContainer) Pause(ctx context.Context) error {
+	c.Paused.Store(true)
+	return nil
+}
+
+func (c *fakeContainer) Unpause(ctx context.Context) error {
+	c.Paused.Store(false)
+	return nil
+}
+
 // fakeFirecrackerContainer behaves like a bare container except it returns
 // 0 mem / CPU resources, like Firecracker.
 type fakeFirecrackerContainer struct {
@@ -823,6 +843,98 @@ func TestRunnerPool_PersistentWorker(t *testing.T) {
 	}
 }
 
+func TestRunnerPool_MultiplexPersistentWorker(t *testing.T) {
+	for _, protocol := range []string{"proto", "json"} {
+		t.Run(protocol, func(t *testing.T) {
+			resp := &wkpb.WorkResponse{
+				ExitCode: 0,
+				Output:   "Test output!",
+			}
+			env := newTestEnv(t)
+			pool := newRunnerPool(t, env, noLimitsCfg())
+			ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+			// Get two runners for the same worker key before running either
+			// of them, so that they are different runners.
+			var runners []*taskRunner
+			for i := 0; i < 2; i++ {
+				task := newPersistentRunnerTask(t, "abc", "--multiplex", protocol, resp)
+				props := task.ExecutionTask.Command.Platform
+				props.Properties = append(props.Properties,
+					&repb.Platform_Property{Name: "persistentWorkerMultiplex", Value: "true"},
+					&repb.Platform_Property{Name: "supports-multiplex-sandboxing", Value: "true"},
+				)
+				r, err := get(ctx, pool, task)
+				require.NoError(t, err)
+				runners = append(runners, r)
+			}
+			require.NotSame(t, runners[0], runners[1])
+
+			// Run both tasks concurrently on the shared worker. Each response
+			// should be routed back to the task that sent the request.
+			var eg errgroup.Group
+			for _, r := range runners {
+				r := r
+				eg.Go(func() error {
+					res := r.Run(ctx, &repb.IOStats{})
+					if res.Error != nil {
+						return res.Error
+					}
+					assert.Equal(t, 0, res.ExitCode)
+					assert.Equal(t, resp.Output+" "+filepath.Base(r.Workspace.Path()), string(res.Stderr))
+					return nil
+				})
+			}
+			require.NoError(t, eg.Wait())
+
+			pool.multiplexMu.Lock()
+			require.Len(t, pool.multiplexWorkers, 1)
+			for _, mw := range pool.multiplexWorkers {
+				assert.Equal(t, 2, mw.refs)
+			}
+			pool.multiplexMu.Unlock()
+
+			for _, r := range runners {
+				pool.TryRecycle(ctx, r, true)
+			}
+			assert.Equal(t, 2, pool.PausedRunnerCount())
+
+			// Removing the runners stops the shared worker.
+			err := pool.Shutdown(ctx)
+			require.NoError(t, err)
+			pool.multiplexMu.Lock()
+			assert.Empty(t, pool.multiplexWorkers)
+			pool.multiplexMu.Unlock()
+		})
+	}
+}
+
+func TestRunnerPool_MultiplexPersistentWorkerWithoutSandboxing(t *testing.T) {
+	resp := &wkpb.WorkResponse{
+		ExitCode: 0,
+		Output:   "Test output!",
+	}
+	env := newTestEnv(t)
+	pool := newRunnerPool(t, env, noLimitsCfg())
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+
+	// Workers that don't support sandboxing can't be shared, so the runner
+	// starts its own worker.
+	task := newPersistentRunnerTask(t, "abc", "--multiplex", "proto", resp)
+	props := task.ExecutionTask.Command.Platform
+	props.Properties = append(props.Properties, &repb.Platform_Property{Name: "persistentWorkerMultiplex", Value: "true"})
+	r, err := get(ctx, pool, task)
+	require.NoError(t, err)
+	res := r.Run(ctx, &repb.IOStats{})
+	require.NoError(t, res.Error)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.NotNil(t, r.worker)
+
+	pool.multiplexMu.Lock()
+	assert.Empty(t, pool.multiplexWorkers)
+	pool.multiplexMu.Unlock()
+}
+
 func TestRunnerPool_PersistentWorkerUnknownProtocol(t *testing.T) {
 	resp := &wkpb.WorkResponse{
 		ExitCode: 0,
@@ -978,3 +1090,175 @@ func TestImagePullTimeout(t *testing.T) {
 	assert.True(t, status.IsUnavailableError(err), "expected Unavailable, got %T", err)
 	assert.Contains(t, err.Error(), "deadline exceeded")
 }
+
+func TestDebugShell_HoldsFailedRunner(t *testing.T) {
+	flags.Set(t, "executor.enable_oci", true)
+	flags.Set(t, "executor.debug_shell.enabled", true)
+
+	env := newTestEnv(t)
+	cfg := noLimitsCfg()
+	var ctr *fakeContainer
+	cfg.ContainerProvider = providerFunc(func(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+		ctr = NewFakeContainer()
+		ctr.Isolation = "oci"
+		ctr.Result = &interfaces.CommandResult{ExitCode: 1}
+		return ctr, nil
+	})
+	pool := newRunnerPool(t, env, cfg)
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+	task := newTask()
+	task.ExecutionTask.ExecutionId = "test-execution"
+	plat := task.ExecutionTask.Command.Platform
+	plat.Properties = append(plat.Properties, []*repb.Platform_Property{
+		{Name: "container-image", Value: "docker://busybox"},
+		{Name: "workload-isolation-type", Value: "oci"},
+	}...)
+
+	r, err := pool.Get(ctx, task)
+	require.NoError(t, err)
+	res := r.Run(ctx, &repb.IOStats{})
+	require.NoError(t, res.Error)
+	require.Equal(t, 1, res.ExitCode)
+	pool.TryRecycle(ctx, r, true /*=finishedCleanly*/)
+
+	// The runner should be held rather than recycled.
+	assert.Equal(t, 0, pool.PausedRunnerCount())
+	select {
+	case <-ctr.Removed:
+		require.FailNow(t, "held runner should not be removed")
+	default:
+	}
+
+	exitCode, err := pool.DebugShell(ctx, &dspb.ShellRequest{ExecutionId: "test-execution"}, &interfaces.Stdio{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, exitCode)
+
+	_, err = pool.DebugShell(ctx, &dspb.ShellRequest{ExecutionId: "other-execution"}, &interfaces.Stdio{})
+	require.True(t, status.IsNotFoundError(err), "expected NotFound, got %s", err)
+}
+
+func TestDebugShell_AttachedWhenExecutionFails(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Whether the hold expires while the shell is attached.
+		expire bool
+	}{
+		{name: "hold active", expire: false},
+		{name: "hold expired", expire: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			flags.Set(t, "executor.enable_oci", true)
+			flags.Set(t, "executor.debug_shell.enabled", true)
+			flags.Set(t, "executor.debug_shell.max_held_runners", 1)
+			if test.expire {
+				flags.Set(t, "executor.debug_shell.failed_runner_hold_duration", 1*time.Millisecond)
+			}
+
+			env := newTestEnv(t)
+			cfg := noLimitsCfg()
+			var ctr *fakeContainer
+			shellStarted := make(chan struct{}, 1)
+			shellExit := make(chan struct{})
+			cfg.ContainerProvider = providerFunc(func(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+				ctr = NewFakeContainer()
+				ctr.Isolation = "oci"
+				ctr.Result = &interfaces.CommandResult{ExitCode: 1}
+				ctr.ExecHook = func(cmd *repb.Command) {
+					if slices.Contains(cmd.GetArguments(), debugShellScript) {
+						shellStarted <- struct{}{}
+						<-shellExit
+					}
+				}
+				return ctr, nil
+			})
+			pool := newRunnerPool(t, env, cfg)
+			ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+			task := newTask()
+			task.ExecutionTask.ExecutionId = "test-execution"
+			plat := task.ExecutionTask.Command.Platform
+			plat.Properties = append(plat.Properties, []*repb.Platform_Property{
+				{Name: "container-image", Value: "docker://busybox"},
+				{Name: "workload-isolation-type", Value: "oci"},
+			}...)
+
+			r, err := pool.Get(ctx, task)
+			require.NoError(t, err)
+			res := r.Run(ctx, &repb.IOStats{})
+			require.Equal(t, 1, res.ExitCode)
+
+			// Attach a shell before the execution finishes.
+			shellDone := make(chan error, 1)
+			go func() {
+				_, err := pool.DebugShell(ctx, &dspb.ShellRequest{ExecutionId: "test-execution"}, &interfaces.Stdio{})
+				shellDone <- err
+			}()
+			<-shellStarted
+
+			// The failed runner is held, but must not be paused under the
+			// attached shell.
+			pool.TryRecycle(ctx, r, true /*=finishedCleanly*/)
+			assert.False(t, ctr.Paused.Load(), "container should not be paused while a shell is attached")
+			if test.expire {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			close(shellExit)
+			require.NoError(t, <-shellDone)
+
+			if test.expire {
+				// The runner is removed once the shell exits, which frees up
+				// its held runner slot.
+				<-ctr.Removed
+				pool.mu.Lock()
+				assert.Empty(t, pool.heldRunners)
+				pool.mu.Unlock()
+				return
+			}
+			// The runner is paused once the shell exits, and stays held so
+			// that another shell can be attached.
+			assert.True(t, ctr.Paused.Load(), "container should be paused once the shell exits")
+			pool.mu.Lock()
+			assert.Len(t, pool.heldRunners, 1)
+			pool.mu.Unlock()
+			_, err = pool.DebugShell(ctx, &dspb.ShellRequest{ExecutionId: "test-execution"}, &interfaces.Stdio{})
+			require.NoError(t, err)
+			assert.True(t, ctr.Paused.Load(), "container should be paused again once the shell exits")
+		})
+	}
+}
+
+func TestDebugShell_Disabled(t *testing.T) {
+	flags.Set(t, "executor.enable_oci", true)
+
+	env := newTestEnv(t)
+	cfg := noLimitsCfg()
+	var ctr *fakeContainer
+	cfg.ContainerProvider = providerFunc(func(ctx context.Context, args *container.Init) (container.CommandContainer, error) {
+		ctr = NewFakeContainer()
+		ctr.Isolation = "oci"
+		ctr.Result = &interfaces.CommandResult{ExitCode: 1}
+		return ctr, nil
+	})
+	pool := newRunnerPool(t, env, cfg)
+	ctx := withAuthenticatedUser(t, context.Background(), env, "US1")
+	task := newTask()
+	task.ExecutionTask.ExecutionId = "test-execution"
+	plat := task.ExecutionTask.Command.Platform
+	plat.Properties = append(plat.Properties, []*repb.Platform_Property{
+		{Name: "container-image", Value: "docker://busybox"},
+		{Name: "workload-isolation-type", Value: "oci"},
+	}...)
+	// Don't recycle the runner, so that it is removed after the task.
+	plat.Properties[0].Value = "false"
+
+	r, err := pool.Get(ctx, task)
+	require.NoError(t, err)
+	res := r.Run(ctx, &repb.IOStats{})
+	require.NoError(t, res.Error)
+	pool.TryRecycle(ctx, r, true /*=finishedCleanly*/)
+	// The runner should be removed as usual.
+	<-ctr.Removed
+
+	_, err = pool.DebugShell(ctx, &dspb.ShellRequest{ExecutionId: "test-execution"}, &interfaces.Stdio{})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %s", err)
+}
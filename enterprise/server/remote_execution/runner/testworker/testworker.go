@@ -8,10 +8,17 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"sync"
 
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+
+	wkpb "github.com/buildbuddy-io/buildbuddy/proto/worker"
 )
 
 var (
@@ -20,6 +27,7 @@ var (
 	protocol       = flag.String("protocol", "proto", "Serialization protocol: 'json' or 'proto'.")
 	responseBase64 = flag.String("response_base64", "", "Base64-encoded response to return for every request. Includes varint length prefix (for proto responses).")
 	failWithStderr = flag.String("fail_with_stderr", "", "If non-empty, the worker will crash upon receiving the first request, printing the given message to stderr.")
+	multiplex      = flag.Bool("multiplex", false, "If true, the worker speaks the multiplex protocol: it handles requests concurrently, tags each response with its request ID, and appends the request's sandbox_dir to the response output.")
 )
 
 func main() {
@@ -42,6 +50,13 @@ func main() {
 		br = bufio.NewReader(os.Stdin)
 	}
 
+	if *multiplex {
+		if err := serveMultiplex(br, dec, resBytes); err != nil {
+			panic(err)
+		}
+		return
+	}
+
 	for {
 		// Note: Logging goes to stderr, so it doesn't mess with the persistent
 		// worker's output.
@@ -74,21 +89,99 @@ func main() {
 }
 
 func readProtoRequest(r io.ByteReader) error {
+	_, err := readProtoBytes(r)
+	return err
+}
+
+func readProtoBytes(r io.ByteReader) ([]byte, error) {
 	reqSizeBytes, err := binary.ReadUvarint(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	reqBytes := make([]byte, reqSizeBytes)
 	for i := 0; i < int(reqSizeBytes); i++ {
 		reqBytes[i], err = r.ReadByte()
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return reqBytes, nil
 }
 
 func readJSONRequest(decoder *json.Decoder) error {
 	raw := json.RawMessage{}
 	return decoder.Decode(&raw)
 }
+
+// serveMultiplex handles each request in its own goroutine, so responses may
+// be sent in a different order than the requests were received.
+func serveMultiplex(br io.ByteReader, dec *json.Decoder, resBytes []byte) error {
+	template := &wkpb.WorkResponse{}
+	if *protocol == "json" {
+		if err := protojson.Unmarshal(resBytes, template); err != nil {
+			return err
+		}
+	} else {
+		size, n := protowire.ConsumeVarint(resBytes)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if int(size) != len(resBytes)-n {
+			return fmt.Errorf("response size %d does not match the encoded size %d", len(resBytes)-n, size)
+		}
+		if err := proto.Unmarshal(resBytes[n:], template); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	for {
+		req := &wkpb.WorkRequest{}
+		if *protocol == "json" {
+			raw := json.RawMessage{}
+			if err := dec.Decode(&raw); err != nil {
+				return err
+			}
+			if err := protojson.Unmarshal(raw, req); err != nil {
+				return err
+			}
+		} else {
+			b, err := readProtoBytes(br)
+			if err != nil {
+				return err
+			}
+			if err := proto.Unmarshal(b, req); err != nil {
+				return err
+			}
+		}
+		log.Infof("[worker] Got request %d", req.GetRequestId())
+		if req.GetCancel() {
+			continue
+		}
+
+		go func() {
+			rsp := proto.Clone(template).(*wkpb.WorkResponse)
+			rsp.RequestId = req.GetRequestId()
+			rsp.Output += " " + req.GetSandboxDir()
+			var out []byte
+			if *protocol == "json" {
+				b, err := protojson.Marshal(rsp)
+				if err != nil {
+					panic(err)
+				}
+				out = append(b, '\n')
+			} else {
+				b, err := proto.Marshal(rsp)
+				if err != nil {
+					panic(err)
+				}
+				out = append(protowire.AppendVarint(nil, uint64(len(b))), b...)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if _, err := os.Stdout.Write(out); err != nil {
+				panic(err)
+			}
+		}()
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
 )
@@ -913,6 +914,14 @@ func (q *PriorityTaskScheduler) GetQueuedTaskReservations() []*scpb.EnqueueTaskR
 	return q.q.GetAll()
 }
 
+// DebugShell runs an interactive debug shell in the runner of the requested
+// execution.
+func (q *PriorityTaskScheduler) DebugShell(ctx context.Context, req *dspb.ShellRequest, stdio *interfaces.Stdio) (int, error) {
+	ctx = q.enrichContext(ctx)
+	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, req.GetExecutionId())
+	return q.runnerPool.DebugShell(ctx, req, stdio)
+}
+
 // HasExcessCapacity returns a boolean indicating if this executor has excess
 // capacity for work. The scheduler-client may use this to request more work
 // from the scheduler, or reset a timeout if there is no excess capacity.
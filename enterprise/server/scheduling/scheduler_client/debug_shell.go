@@ -0,0 +1,159 @@
+package scheduler_client
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/scheduling/priority_task_scheduler"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
+	gstatus "google.golang.org/grpc/status"
+)
+
+const (
+	// How many stdin messages to buffer per debug shell session. Input is
+	// typed by a human, so this should never fill up unless the shell is
+	// stuck.
+	shellStdinBufferSize = 64
+)
+
+// shellSessions runs the debug shell sessions requested over a single work
+// stream. Responses are sent to the scheduler by the work stream goroutine,
+// which reads them from the responses channel.
+type shellSessions struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	taskScheduler *priority_task_scheduler.PriorityTaskScheduler
+	responses     chan *dspb.ShellSessionResponse
+
+	mu       sync.Mutex
+	sessions map[string]*shellSession
+}
+
+type shellSession struct {
+	cancel context.CancelFunc
+	stdin  chan []byte
+}
+
+func newShellSessions(ctx context.Context, taskScheduler *priority_task_scheduler.PriorityTaskScheduler) *shellSessions {
+	ctx, cancel := context.WithCancel(ctx)
+	return &shellSessions{
+		ctx:           ctx,
+		cancel:        cancel,
+		taskScheduler: taskScheduler,
+		responses:     make(chan *dspb.ShellSessionResponse),
+		sessions:      make(map[string]*shellSession),
+	}
+}
+
+// Close kills all running shells. Their sessions can't be resumed once the
+// work stream that they were started on is gone.
+func (s *shellSessions) Close() {
+	s.cancel()
+}
+
+// Handle handles a request from the scheduler. It does not block.
+func (s *shellSessions) Handle(req *dspb.ShellSessionRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessionID := req.GetSessionId()
+	session, ok := s.sessions[sessionID]
+	if req.GetClose() {
+		if ok {
+			session.cancel()
+			delete(s.sessions, sessionID)
+		}
+		return
+	}
+	if !ok {
+		ctx, cancel := context.WithCancel(s.ctx)
+		session = &shellSession{
+			cancel: cancel,
+			stdin:  make(chan []byte, shellStdinBufferSize),
+		}
+		s.sessions[sessionID] = session
+		go s.run(ctx, sessionID, session, req.GetRequest())
+	}
+	if len(req.GetRequest().GetStdin()) == 0 {
+		return
+	}
+	select {
+	case session.stdin <- req.GetRequest().GetStdin():
+	default:
+		log.Warningf("Debug shell session %q is not reading input; closing it.", sessionID)
+		session.cancel()
+		delete(s.sessions, sessionID)
+	}
+}
+
+func (s *shellSessions) run(ctx context.Context, sessionID string, session *shellSession, req *dspb.ShellRequest) {
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.sessions[sessionID] == session {
+			delete(s.sessions, sessionID)
+		}
+		session.cancel()
+	}()
+
+	stdinReader, stdinWriter := io.Pipe()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				stdinWriter.CloseWithError(status.FromContextError(ctx))
+				return
+			case b := <-session.stdin:
+				if _, err := stdinWriter.Write(b); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	output := &shellOutputWriter{ctx: ctx, sessionID: sessionID, responses: s.responses}
+	stdio := &interfaces.Stdio{
+		Stdin:  stdinReader,
+		Stdout: output,
+		Stderr: output,
+	}
+	log.CtxInfof(ctx, "Starting debug shell session %q for execution %q", sessionID, req.GetExecutionId())
+	exitCode, err := s.taskScheduler.DebugShell(ctx, req, stdio)
+	_ = stdinReader.Close()
+
+	rsp := &dspb.ShellSessionResponse{SessionId: sessionID}
+	if err != nil {
+		log.CtxInfof(ctx, "Debug shell session %q failed: %s", sessionID, err)
+		rsp.Status = gstatus.Convert(err).Proto()
+	} else {
+		log.CtxInfof(ctx, "Debug shell session %q exited with code %d", sessionID, exitCode)
+		rsp.Response = &dspb.ShellResponse{Exited: true, ExitCode: int32(exitCode)}
+	}
+	select {
+	case s.responses <- rsp:
+	case <-s.ctx.Done():
+	}
+}
+
+// shellOutputWriter sends the output of a shell to the scheduler.
+type shellOutputWriter struct {
+	ctx       context.Context
+	sessionID string
+	responses chan<- *dspb.ShellSessionResponse
+}
+
+func (w *shellOutputWriter) Write(p []byte) (int, error) {
+	rsp := &dspb.ShellSessionResponse{
+		SessionId: w.sessionID,
+		Response:  &dspb.ShellResponse{Output: append([]byte{}, p...)},
+	}
+	select {
+	case w.responses <- rsp:
+		return len(p), nil
+	case <-w.ctx.Done():
+		return 0, status.FromContextError(w.ctx)
+	}
+}
@@ -169,7 +169,7 @@ func (r *Registration) ServeStatusz(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, schedulerErr chan error, registrationTicker, requestMoreWorkTicker *time.Ticker) (bool, error) {
+func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Scheduler_RegisterAndStreamWorkClient, schedulerMsgs chan *scpb.RegisterAndStreamWorkResponse, schedulerErr chan error, shells *shellSessions, registrationTicker, requestMoreWorkTicker *time.Ticker) (bool, error) {
 	registrationMsg := &scpb.RegisterAndStreamWorkRequest{
 		RegisterExecutorRequest: &scpb.RegisterExecutorRequest{Node: r.node},
 	}
@@ -199,6 +199,10 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 			requestMoreWorkTicker.Reset(moreWorkResponse.GetDelay().AsDuration())
 			return false, nil
 		}
+		if shellRequest := msg.GetShellSessionRequest(); shellRequest != nil {
+			shells.Handle(shellRequest)
+			return false, nil
+		}
 		if msg.EnqueueTaskReservationRequest == nil {
 			out, _ := prototext.Marshal(msg)
 			return false, status.FailedPreconditionErrorf("message from scheduler did not contain a task reservation request:\n%s", string(out))
@@ -214,6 +218,11 @@ func (r *Registration) processWorkStream(ctx context.Context, stream scpb.Schedu
 		if err := stream.Send(rspMsg); err != nil {
 			return false, status.UnavailableErrorf("could not send task reservation response: %s", err)
 		}
+	case shellResponse := <-shells.responses:
+		rspMsg := &scpb.RegisterAndStreamWorkRequest{ShellSessionResponse: shellResponse}
+		if err := stream.Send(rspMsg); err != nil {
+			return false, status.UnavailableErrorf("could not send debug shell response: %s", err)
+		}
 	case err := <-schedulerErr:
 		return false, status.WrapError(err, "failed to receive message from scheduler")
 	case <-registrationTicker.C:
@@ -304,8 +313,9 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 			}
 		}()
 
+		shells := newShellSessions(ctx, r.taskScheduler)
 		for {
-			done, err := r.processWorkStream(ctx, stream, schedulerMsgs, schedulerErr, registrationTicker, requestMoreWorkTicker)
+			done, err := r.processWorkStream(ctx, stream, schedulerMsgs, schedulerErr, shells, registrationTicker, requestMoreWorkTicker)
 			if err != nil {
 				_ = stream.CloseSend()
 				log.Warningf("Error maintaining registration with scheduler, will retry: %s", err)
@@ -313,9 +323,11 @@ func (r *Registration) maintainRegistrationAndStreamWork(ctx context.Context) {
 			}
 			if done {
 				_ = stream.CloseSend()
+				shells.Close()
 				return
 			}
 		}
+		shells.Close()
 		r.setConnected(false)
 		if done := sleepWithContext(ctx, registrationFailureRetryInterval); done {
 			log.Debugf("Context cancelled, cancelling node registration.")
@@ -0,0 +1,433 @@
+package scheduler_server
+
+import (
+	"context"
+	"flag"
+	"io"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/go-redis/redis/v8"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
+	scpb "github.com/buildbuddy-io/buildbuddy/proto/scheduler"
+	gstatus "google.golang.org/grpc/status"
+)
+
+var (
+	debugShellEnabled     = flag.Bool("remote_execution.debug_shell.enabled", false, "If true, org admins can attach interactive debug shells to remote executions on executors that have debug shells enabled.")
+	completedTaskRouteTTL = flag.Duration("remote_execution.debug_shell.completed_task_route_ttl", 5*time.Minute, "How long a debug shell can still be attached to an execution after it completes, which is only possible while the executor holds the runner of a failed execution. Should match executor.debug_shell.failed_runner_hold_duration. 0 stops routing debug shells to executions as soon as they complete.")
+)
+
+const (
+	// Names of fields in the Redis hash that records which executor claimed a
+	// task, so that debug shells can be routed to it.
+	redisDebugShellExecutorIDField = "executorID"
+	redisDebugShellPoolKeyField    = "poolKey"
+	redisDebugShellGroupIDField    = "groupID"
+
+	// How long to remember which executor claimed a task while it runs. The
+	// route is deleted, or expires after completedTaskRouteTTL, once the task
+	// completes or is released.
+	debugShellRouteTTL = taskTTL
+
+	// How many responses to buffer per debug shell session. If a client
+	// falls further behind than this, its session is closed rather than
+	// blocking the executor's work stream.
+	shellSessionBufferSize = 256
+)
+
+// shellSession receives the responses for a debug shell session running on a
+// locally connected executor.
+type shellSession struct {
+	responses chan *dspb.ShellSessionResponse
+	// Set before responses is closed.
+	err error
+}
+
+// shellSessionStream is the executor side of a debug shell session. It is
+// either a session on a locally connected executor, or a ForwardDebugShell
+// stream to the app that the executor is connected to.
+type shellSessionStream interface {
+	Send(*dspb.ShellSessionRequest) error
+	Recv() (*dspb.ShellSessionResponse, error)
+	CloseSend() error
+}
+
+func (h *executorHandle) openShellSession(sessionID string) (*shellSession, error) {
+	h.shellMu.Lock()
+	defer h.shellMu.Unlock()
+	if h.shellSessions == nil {
+		return nil, status.UnavailableError("executor is disconnected")
+	}
+	if _, ok := h.shellSessions[sessionID]; ok {
+		return nil, status.AlreadyExistsErrorf("debug shell session %q already exists", sessionID)
+	}
+	s := &shellSession{responses: make(chan *dspb.ShellSessionResponse, shellSessionBufferSize)}
+	h.shellSessions[sessionID] = s
+	return s, nil
+}
+
+// closeShellSession stops routing responses to the given session. If err is
+// non-nil, the session's receiver gets the error once it has read the
+// buffered responses.
+func (h *executorHandle) closeShellSession(sessionID string, err error) {
+	h.shellMu.Lock()
+	defer h.shellMu.Unlock()
+	s, ok := h.shellSessions[sessionID]
+	if !ok {
+		return
+	}
+	s.err = err
+	close(s.responses)
+	delete(h.shellSessions, sessionID)
+}
+
+// closeAllShellSessions closes all sessions once the executor disconnects.
+func (h *executorHandle) closeAllShellSessions() {
+	h.shellMu.Lock()
+	defer h.shellMu.Unlock()
+	for _, s := range h.shellSessions {
+		s.err = status.UnavailableError("executor disconnected")
+		close(s.responses)
+	}
+	h.shellSessions = nil
+}
+
+func (h *executorHandle) handleShellSessionResponse(rsp *dspb.ShellSessionResponse) {
+	h.shellMu.Lock()
+	defer h.shellMu.Unlock()
+	s, ok := h.shellSessions[rsp.GetSessionId()]
+	if !ok {
+		return
+	}
+	select {
+	case s.responses <- rsp:
+	default:
+		log.Warningf("Debug shell session %q is not keeping up with output; closing it.", rsp.GetSessionId())
+		s.err = status.ResourceExhaustedError("debug shell client is not keeping up with output")
+		close(s.responses)
+		delete(h.shellSessions, rsp.GetSessionId())
+	}
+}
+
+func (h *executorHandle) sendShellSessionRequest(ctx context.Context, req *dspb.ShellSessionRequest) error {
+	msg := &scpb.RegisterAndStreamWorkResponse{ShellSessionRequest: req}
+	select {
+	case h.requests <- enqueueTaskReservationRequest{proto: msg}:
+		return nil
+	case <-h.stream.Context().Done():
+		return status.UnavailableError("executor disconnected")
+	case <-ctx.Done():
+		return status.FromContextError(ctx)
+	}
+}
+
+// localShellSession is a debug shell session on an executor connected to
+// this app.
+type localShellSession struct {
+	ctx       context.Context
+	handle    *executorHandle
+	sessionID string
+	session   *shellSession
+}
+
+func (l *localShellSession) Send(req *dspb.ShellSessionRequest) error {
+	return l.handle.sendShellSessionRequest(l.ctx, req)
+}
+
+func (l *localShellSession) Recv() (*dspb.ShellSessionResponse, error) {
+	select {
+	case rsp, ok := <-l.session.responses:
+		if !ok {
+			if l.session.err != nil {
+				return nil, l.session.err
+			}
+			return nil, io.EOF
+		}
+		return rsp, nil
+	case <-l.ctx.Done():
+		return nil, status.FromContextError(l.ctx)
+	}
+}
+
+// CloseSend ends the session, telling the executor to kill the shell if it
+// is still running.
+func (l *localShellSession) CloseSend() error {
+	l.handle.closeShellSession(l.sessionID, nil)
+	// Use the stream context since the session context may already be done.
+	return l.handle.sendShellSessionRequest(l.handle.stream.Context(), &dspb.ShellSessionRequest{
+		SessionId: l.sessionID,
+		Close:     true,
+	})
+}
+
+func (s *SchedulerServer) findConnectedExecutor(executorID string) *executorHandle {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, pool := range s.pools {
+		if node := pool.FindConnectedExecutorByID(executorID); node != nil {
+			return node.handle
+		}
+	}
+	return nil
+}
+
+func (s *SchedulerServer) openLocalShellSession(ctx context.Context, executorID, sessionID string) (shellSessionStream, error) {
+	h := s.findConnectedExecutor(executorID)
+	if h == nil {
+		return nil, status.UnavailableErrorf("executor %q is not connected", executorID)
+	}
+	session, err := h.openShellSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &localShellSession{ctx: ctx, handle: h, sessionID: sessionID, session: session}, nil
+}
+
+// debugShellRoute records where a task ran, and who owns it.
+type debugShellRoute struct {
+	executorID string
+	poolKey    string
+	groupID    string
+}
+
+func (s *SchedulerServer) redisKeyForDebugShellRoute(taskID string) string {
+	return "debugShellRoute/" + taskID
+}
+
+// recordDebugShellRoute remembers which executor claimed a task so that
+// debug shells can later be attached to it.
+func (s *SchedulerServer) recordDebugShellRoute(ctx context.Context, taskID, executorID string, key nodePoolKey, groupID string) error {
+	if !*debugShellEnabled {
+		return nil
+	}
+	k := s.redisKeyForDebugShellRoute(taskID)
+	pipe := s.rdb.TxPipeline()
+	pipe.HSet(ctx, k, map[string]interface{}{
+		redisDebugShellExecutorIDField: executorID,
+		redisDebugShellPoolKeyField:    key.redisPoolKey(),
+		redisDebugShellGroupIDField:    groupID,
+	})
+	pipe.Expire(ctx, k, debugShellRouteTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// expireDebugShellRoute is called when a task's lease ends. If the task
+// completed, its executor may still be holding its runner, so the route is
+// kept for completedTaskRouteTTL. Otherwise the route is deleted, since the
+// executor is no longer running the task.
+func (s *SchedulerServer) expireDebugShellRoute(ctx context.Context, taskID string, completed bool) error {
+	if !*debugShellEnabled {
+		return nil
+	}
+	k := s.redisKeyForDebugShellRoute(taskID)
+	if completed && *completedTaskRouteTTL > 0 {
+		return s.rdb.Expire(ctx, k, *completedTaskRouteTTL).Err()
+	}
+	return s.rdb.Del(ctx, k).Err()
+}
+
+func (s *SchedulerServer) getDebugShellRoute(ctx context.Context, taskID string) (*debugShellRoute, error) {
+	vals, err := s.rdb.HGetAll(ctx, s.redisKeyForDebugShellRoute(taskID)).Result()
+	if err != nil {
+		return nil, status.InternalErrorf("could not read debug shell route from redis: %s", err)
+	}
+	if vals[redisDebugShellExecutorIDField] == "" {
+		return nil, status.NotFoundErrorf("execution %q was not found on any executor", taskID)
+	}
+	return &debugShellRoute{
+		executorID: vals[redisDebugShellExecutorIDField],
+		poolKey:    vals[redisDebugShellPoolKeyField],
+		groupID:    vals[redisDebugShellGroupIDField],
+	}, nil
+}
+
+// openShellSession opens a session on the executor in the given route, via
+// the app that the executor is connected to.
+func (s *SchedulerServer) openShellSession(ctx context.Context, route *debugShellRoute, sessionID string) (shellSessionStream, error) {
+	data, err := s.rdb.HGet(ctx, route.poolKey, route.executorID).Result()
+	if err == redis.Nil {
+		return nil, status.UnavailableErrorf("executor %q is no longer registered", route.executorID)
+	}
+	if err != nil {
+		return nil, status.InternalErrorf("could not read executor registration from redis: %s", err)
+	}
+	node := &scpb.RegisteredExecutionNode{}
+	if err := proto.Unmarshal([]byte(data), node); err != nil {
+		return nil, status.InternalErrorf("could not unmarshal executor registration: %s", err)
+	}
+	if node.GetSchedulerHostPort() == "" {
+		return nil, status.UnavailableErrorf("executor %q is not connected to a scheduler", route.executorID)
+	}
+	client, err := s.schedulerClientCache.get(node.GetSchedulerHostPort())
+	if err != nil {
+		return nil, err
+	}
+	if client.localServer != nil {
+		return s.openLocalShellSession(ctx, route.executorID, sessionID)
+	}
+	return client.rpcClient.ForwardDebugShell(ctx)
+}
+
+// pipeShellSession forwards requests from recv to the session and responses
+// from the session to send, until the shell exits or either side fails.
+func pipeShellSession(session shellSessionStream, recv func() (*dspb.ShellSessionRequest, error), send func(*dspb.ShellSessionResponse) error) error {
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			req, err := recv()
+			if err == io.EOF {
+				errs <- nil
+				return
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := session.Send(req); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			rsp, err := session.Recv()
+			if err == io.EOF {
+				errs <- status.UnavailableError("debug shell session ended unexpectedly")
+				return
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := send(rsp); err != nil {
+				errs <- err
+				return
+			}
+			if rsp.GetStatus() != nil || rsp.GetResponse().GetExited() {
+				errs <- nil
+				return
+			}
+		}
+	}()
+	return <-errs
+}
+
+// DebugShell attaches an interactive shell to the container of a running
+// execution, or of a failed execution whose runner is still being held by
+// its executor.
+//
+// Since a debug shell can read and modify anything that the execution can,
+// only org admins can start one.
+func (s *SchedulerServer) DebugShell(stream bbspb.BuildBuddyService_DebugShellServer) error {
+	if !*debugShellEnabled {
+		return status.UnimplementedError("debug shells are not enabled")
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	executionID := req.GetExecutionId()
+	if executionID == "" {
+		return status.InvalidArgumentError("An execution_id must be provided")
+	}
+	route, err := s.getDebugShellRoute(ctx, executionID)
+	if err != nil {
+		return err
+	}
+	if route.groupID == "" {
+		return status.PermissionDeniedError("debug shells are not available for anonymous executions")
+	}
+	u, err := s.env.GetAuthenticator().AuthenticatedUser(ctx)
+	if err != nil {
+		return err
+	}
+	if err := authutil.AuthorizeOrgAdmin(u, route.groupID); err != nil {
+		return err
+	}
+	if al := s.env.GetAuditLogger(); al != nil {
+		logged := req.CloneVT()
+		logged.Stdin = nil
+		al.Log(ctx, &alpb.ResourceID{Type: alpb.ResourceType_EXECUTION, Id: executionID}, alpb.Action_START_DEBUG_SHELL, logged)
+	}
+
+	sessionID, err := random.RandomString(20)
+	if err != nil {
+		return status.InternalErrorf("could not generate session ID: %s", err)
+	}
+	session, err := s.openShellSession(ctx, route, sessionID)
+	if err != nil {
+		return err
+	}
+	defer session.CloseSend()
+
+	log.CtxInfof(ctx, "Starting debug shell session %q for execution %q on executor %q", sessionID, executionID, route.executorID)
+	err = session.Send(&dspb.ShellSessionRequest{
+		SessionId:  sessionID,
+		ExecutorId: route.executorID,
+		Request:    req,
+	})
+	if err != nil {
+		return err
+	}
+	recv := func() (*dspb.ShellSessionRequest, error) {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		return &dspb.ShellSessionRequest{SessionId: sessionID, Request: req}, nil
+	}
+	send := func(rsp *dspb.ShellSessionResponse) error {
+		if rsp.GetStatus() != nil {
+			return gstatus.ErrorProto(rsp.GetStatus())
+		}
+		return stream.Send(rsp.GetResponse())
+	}
+	return pipeShellSession(session, recv, send)
+}
+
+// ForwardDebugShell runs a debug shell session started by another app on an
+// executor connected to this app.
+func (s *SchedulerServer) ForwardDebugShell(stream scpb.Scheduler_ForwardDebugShellServer) error {
+	if !*debugShellEnabled {
+		return status.UnimplementedError("debug shells are not enabled")
+	}
+	ctx := stream.Context()
+	if s.env.GetClientIdentityService() == nil {
+		return status.UnauthenticatedError("no client identity service available")
+	}
+	identity, err := s.env.GetClientIdentityService().IdentityFromContext(ctx)
+	if err != nil {
+		return status.UnauthenticatedErrorf("could not check client identity: %s", err)
+	}
+	if identity.Client != interfaces.ClientIdentityApp {
+		return status.PermissionDeniedError("debug shells may only be forwarded by apps")
+	}
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	session, err := s.openLocalShellSession(ctx, req.GetExecutorId(), req.GetSessionId())
+	if err != nil {
+		return err
+	}
+	defer session.CloseSend()
+	if err := session.Send(req); err != nil {
+		return err
+	}
+	return pipeShellSession(session, stream.Recv, stream.Send)
+}
@@ -0,0 +1,291 @@
+package scheduler_server
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/clientidentity"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauditlog"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
+	"github.com/buildbuddy-io/buildbuddy/server/util/authutil"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	alpb "github.com/buildbuddy-io/buildbuddy/proto/auditlog"
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
+)
+
+type fakeDebugShellStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests chan *dspb.ShellRequest
+}
+
+func (s *fakeDebugShellStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeDebugShellStream) Recv() (*dspb.ShellRequest, error) {
+	select {
+	case req := <-s.requests:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeDebugShellStream) Send(rsp *dspb.ShellResponse) error {
+	return nil
+}
+
+type fakeForwardDebugShellStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	requests chan *dspb.ShellSessionRequest
+}
+
+func (s *fakeForwardDebugShellStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeForwardDebugShellStream) Recv() (*dspb.ShellSessionRequest, error) {
+	select {
+	case req := <-s.requests:
+		return req, nil
+	case <-s.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+func (s *fakeForwardDebugShellStream) Send(rsp *dspb.ShellSessionResponse) error {
+	return nil
+}
+
+func startDebugShell(ctx context.Context, s *SchedulerServer, req *dspb.ShellRequest) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream := &fakeDebugShellStream{ctx: ctx, requests: make(chan *dspb.ShellRequest, 1)}
+	stream.requests <- req
+	return s.DebugShell(stream)
+}
+
+func TestDebugShell_Authorization(t *testing.T) {
+	flags.Set(t, "remote_execution.debug_shell.enabled", true)
+	env, ctx := getEnv(t, &schedulerOpts{}, "")
+	s := env.GetSchedulerService().(*SchedulerServer)
+	al := testauditlog.New(t)
+	env.SetAuditLogger(al)
+
+	admin := testauth.User("admin", "group1")
+	admin.GroupMemberships[0].Capabilities = append(admin.GroupMemberships[0].Capabilities, cappb.Capability_ORG_ADMIN)
+	developer := testauth.User("developer", "group1")
+	otherAdmin := testauth.User("other-admin", "group2")
+	otherAdmin.GroupMemberships[0].Capabilities = append(otherAdmin.GroupMemberships[0].Capabilities, cappb.Capability_ORG_ADMIN)
+	env.SetAuthenticator(testauth.NewTestAuthenticator(map[string]interfaces.UserInfo{
+		"admin":       admin,
+		"developer":   developer,
+		"other-admin": otherAdmin,
+	}))
+
+	key := nodePoolKey{groupID: "group1", os: defaultOS, arch: defaultArch}
+	err := s.recordDebugShellRoute(ctx, "task1", "executor1", key, "group1")
+	require.NoError(t, err)
+	err = s.recordDebugShellRoute(ctx, "anonymous-task", "executor1", nodePoolKey{os: defaultOS, arch: defaultArch}, "")
+	require.NoError(t, err)
+
+	for _, test := range []struct {
+		name        string
+		user        string
+		executionID string
+		wantErr     func(error) bool
+		wantLogged  bool
+	}{
+		{
+			name:        "missing execution ID",
+			user:        "admin",
+			executionID: "",
+			wantErr:     status.IsInvalidArgumentError,
+		},
+		{
+			name:        "unknown execution",
+			user:        "admin",
+			executionID: "unknown-task",
+			wantErr:     status.IsNotFoundError,
+		},
+		{
+			name:        "anonymous execution",
+			user:        "admin",
+			executionID: "anonymous-task",
+			wantErr:     status.IsPermissionDeniedError,
+		},
+		{
+			name:        "unauthenticated",
+			user:        "",
+			executionID: "task1",
+			wantErr:     status.IsUnauthenticatedError,
+		},
+		{
+			name:        "not an org admin",
+			user:        "developer",
+			executionID: "task1",
+			wantErr:     status.IsPermissionDeniedError,
+		},
+		{
+			name:        "admin of another org",
+			user:        "other-admin",
+			executionID: "task1",
+			wantErr:     status.IsPermissionDeniedError,
+		},
+		{
+			// The executor isn't registered, so the session can't be
+			// opened, but the attempt is still audit logged.
+			name:        "org admin",
+			user:        "admin",
+			executionID: "task1",
+			wantErr:     status.IsUnavailableError,
+			wantLogged:  true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			al.Reset()
+			userCtx := ctx
+			if test.user != "" {
+				var err error
+				userCtx, err = env.GetAuthenticator().(*testauth.TestAuthenticator).WithAuthenticatedUser(ctx, test.user)
+				require.NoError(t, err)
+			}
+
+			err := startDebugShell(userCtx, s, &dspb.ShellRequest{
+				ExecutionId: test.executionID,
+				Stdin:       []byte("secret input"),
+			})
+			require.Error(t, err)
+			require.True(t, test.wantErr(err), "unexpected error: %s", err)
+
+			if !test.wantLogged {
+				require.Empty(t, al.GetAllEntries())
+				return
+			}
+			entries := al.GetAllEntries()
+			require.Len(t, entries, 1)
+			require.Equal(t, alpb.Action_START_DEBUG_SHELL, entries[0].Action)
+			require.Equal(t, alpb.ResourceType_EXECUTION, entries[0].Resource.GetType())
+			require.Equal(t, test.executionID, entries[0].Resource.GetId())
+			logged := entries[0].Request.(*dspb.ShellRequest)
+			require.Equal(t, test.executionID, logged.GetExecutionId())
+			require.Empty(t, logged.GetStdin(), "stdin should not be audit logged")
+		})
+	}
+}
+
+func TestDebugShell_Disabled(t *testing.T) {
+	env, ctx := getEnv(t, &schedulerOpts{}, "user1")
+	s := env.GetSchedulerService().(*SchedulerServer)
+
+	err := startDebugShell(ctx, s, &dspb.ShellRequest{ExecutionId: "task1"})
+	require.True(t, status.IsUnimplementedError(err), "unexpected error: %s", err)
+}
+
+func TestDebugShell_RouteExpiry(t *testing.T) {
+	flags.Set(t, "remote_execution.debug_shell.enabled", true)
+	env, ctx := getEnv(t, &schedulerOpts{}, "")
+	s := env.GetSchedulerService().(*SchedulerServer)
+	key := nodePoolKey{groupID: "group1", os: defaultOS, arch: defaultArch}
+
+	for _, test := range []struct {
+		name         string
+		completed    bool
+		completedTTL time.Duration
+		wantKept     bool
+	}{
+		{name: "completed", completed: true, completedTTL: 5 * time.Minute, wantKept: true},
+		{name: "completed with no ttl", completed: true, completedTTL: 0, wantKept: false},
+		{name: "released", completed: false, completedTTL: 5 * time.Minute, wantKept: false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			flags.Set(t, "remote_execution.debug_shell.completed_task_route_ttl", test.completedTTL)
+			taskID := "task-" + test.name
+
+			err := s.recordDebugShellRoute(ctx, taskID, "executor1", key, "group1")
+			require.NoError(t, err)
+			route, err := s.getDebugShellRoute(ctx, taskID)
+			require.NoError(t, err)
+			require.Equal(t, &debugShellRoute{
+				executorID: "executor1",
+				poolKey:    key.redisPoolKey(),
+				groupID:    "group1",
+			}, route)
+
+			err = s.expireDebugShellRoute(ctx, taskID, test.completed)
+			require.NoError(t, err)
+
+			route, err = s.getDebugShellRoute(ctx, taskID)
+			if !test.wantKept {
+				require.True(t, status.IsNotFoundError(err), "unexpected error: %s", err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "executor1", route.executorID)
+			ttl, err := s.rdb.TTL(ctx, s.redisKeyForDebugShellRoute(taskID)).Result()
+			require.NoError(t, err)
+			require.Greater(t, ttl, time.Duration(0))
+			require.LessOrEqual(t, ttl, test.completedTTL)
+		})
+	}
+}
+
+func TestForwardDebugShell_ClientIdentity(t *testing.T) {
+	flags.Set(t, "remote_execution.debug_shell.enabled", true)
+	flags.Set(t, "app.client_identity.key", "debug-shell-test-key")
+	env, ctx := getEnv(t, &schedulerOpts{}, "")
+	s := env.GetSchedulerService().(*SchedulerServer)
+
+	forward := func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream := &fakeForwardDebugShellStream{ctx: ctx, requests: make(chan *dspb.ShellSessionRequest, 1)}
+		stream.requests <- &dspb.ShellSessionRequest{
+			SessionId:  "session1",
+			ExecutorId: "unknown-executor",
+			Request:    &dspb.ShellRequest{ExecutionId: "task1"},
+		}
+		return s.ForwardDebugShell(stream)
+	}
+
+	err := forward(ctx)
+	require.True(t, status.IsUnauthenticatedError(err), "unexpected error without a client identity service: %s", err)
+
+	cis, err := clientidentity.New(clockwork.NewRealClock())
+	require.NoError(t, err)
+	env.SetClientIdentityService(cis)
+	withIdentity := func(client string) context.Context {
+		header, err := cis.IdentityHeader(&interfaces.ClientIdentity{Origin: "test", Client: client}, clientidentity.DefaultExpiration)
+		require.NoError(t, err)
+		incomingCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(authutil.ClientIdentityHeaderName, header))
+		identityCtx, err := cis.ValidateIncomingIdentity(incomingCtx)
+		require.NoError(t, err)
+		return identityCtx
+	}
+
+	err = forward(ctx)
+	require.True(t, status.IsUnauthenticatedError(err), "unexpected error without an identity: %s", err)
+
+	err = forward(withIdentity(interfaces.ClientIdentityExecutor))
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error for an executor identity: %s", err)
+
+	err = forward(withIdentity(interfaces.ClientIdentityWorkflow))
+	require.True(t, status.IsPermissionDeniedError(err), "unexpected error for a workflow identity: %s", err)
+
+	// Apps are allowed to forward sessions, which then fail since the
+	// executor isn't connected to this app.
+	err = forward(withIdentity(interfaces.ClientIdentityApp))
+	require.True(t, status.IsUnavailableError(err), "unexpected error for an app identity: %s", err)
+}
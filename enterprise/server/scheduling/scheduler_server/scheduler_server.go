@@ -242,6 +242,11 @@ type executorHandle struct {
 	mu       sync.RWMutex
 	requests chan enqueueTaskReservationRequest
 	replies  map[string]chan<- *scpb.EnqueueTaskReservationResponse
+
+	// Debug shell sessions running on this executor, keyed by session ID.
+	// Set to nil once the executor disconnects.
+	shellMu       sync.Mutex
+	shellSessions map[string]*shellSession
 }
 
 func newExecutorHandle(env environment.Env, scheduler *SchedulerServer, requireAuthorization bool, stream scpb.Scheduler_RegisterAndStreamWorkServer) *executorHandle {
@@ -252,6 +257,7 @@ func newExecutorHandle(env environment.Env, scheduler *SchedulerServer, requireA
 		stream:               stream,
 		requests:             make(chan enqueueTaskReservationRequest, 10),
 		replies:              make(map[string]chan<- *scpb.EnqueueTaskReservationResponse),
+		shellSessions:        make(map[string]*shellSession),
 	}
 	h.startTaskReservationStreamer()
 	return h
@@ -324,6 +330,7 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 		h.setRegistration(nil)
 	}
 	defer removeConnectedExecutor()
+	defer h.closeAllShellSessions()
 
 	requestChan := make(chan *scpb.RegisterAndStreamWorkRequest, 1)
 	errChan := make(chan error)
@@ -378,6 +385,8 @@ func (h *executorHandle) Serve(ctx context.Context) error {
 						log.CtxWarningf(ctx, "Could not re-enqueue task reservation for executor %q going down: %s", executorID, err)
 					}
 				}
+			} else if req.GetShellSessionResponse() != nil {
+				h.handleShellSessionResponse(req.GetShellSessionResponse())
 			} else if req.GetAskForMoreWorkRequest() != nil {
 				poolKey := h.nodePoolKey(h.getRegistration())
 
@@ -1789,6 +1798,11 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 					log.CtxWarningf(ctx, "Could not remove task from unclaimed list: %s", err)
 				}
 			}
+			if req.GetExecutorId() != "" {
+				if err := s.recordDebugShellRoute(ctx, taskID, req.GetExecutorId(), key, task.metadata.GetTaskGroupId()); err != nil {
+					log.CtxWarningf(ctx, "Could not record executor for debug shells: %s", err)
+				}
+			}
 			task.serializedTask = s.modifyTaskForExperiments(ctx, req.GetExecutorHostname(), task.serializedTask)
 
 			// Prometheus: observe queue wait time.
@@ -1825,6 +1839,9 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 			if err == nil {
 				claimed = false
 				log.CtxInfof(ctx, "LeaseTask task %q successfully finalized by %q", taskID, executorID)
+				if err := s.expireDebugShellRoute(ctx, taskID, true /*=completed*/); err != nil {
+					log.CtxWarningf(ctx, "Could not expire debug shell route for task %q: %s", taskID, err)
+				}
 			} else {
 				log.CtxWarningf(ctx, "Could not delete claimed task %q: %s", taskID, err)
 			}
@@ -1840,6 +1857,9 @@ func (s *SchedulerServer) LeaseTask(stream scpb.Scheduler_LeaseTaskServer) error
 				claimed = false
 				if err == nil {
 					log.CtxInfof(ctx, "LeaseTask task %q successfully released by %q", taskID, executorID)
+					if err := s.expireDebugShellRoute(ctx, taskID, false /*=completed*/); err != nil {
+						log.CtxWarningf(ctx, "Could not delete debug shell route for task %q: %s", taskID, err)
+					}
 				} else {
 					log.CtxInfof(ctx, "LeaseTask task %q is already claimed by another executor", taskID)
 				}
@@ -521,6 +521,10 @@ func getFirstOutput(cmd *repb.Command) string {
 // Different routing keys result in totally different permutations
 // of the nodes, so tasks with different persistentWorkerKeys should be well
 // distributed.
+//
+// Sending tasks with the same key to the same nodes matters even more for
+// multiplex workers, since every task with the key on a node shares a single
+// worker process.
 type persistentWorkerRouter struct {
 	env environment.Env
 }
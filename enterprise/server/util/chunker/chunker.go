@@ -5,10 +5,16 @@ import (
 	"io"
 	"sync"
 
+	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/jotfs/fastcdc-go"
 )
 
+var (
+	splitBlobAverageChunkSizeBytes = flag.Int("cache.split_blob_average_chunk_size_bytes", 0, "Average size of the chunks returned by SplitBlob. SplitBlob and SpliceBlob are disabled if 0.")
+)
+
 type WriteFunc func([]byte) error
 
 type Chunker struct {
@@ -113,3 +119,49 @@ func New(ctx context.Context, averageSize int, writeChunkFn WriteFunc) (*Chunker
 
 	return c, nil
 }
+
+const (
+	minAverageSize = 256
+	maxAverageSize = 256 * 1024 * 1024
+)
+
+// Splitter implements interfaces.BlobSplitter using content-defined chunking.
+type Splitter struct {
+	averageSize int
+}
+
+// RegisterBlobSplitter enables the SplitBlob and SpliceBlob APIs if
+// configured.
+func RegisterBlobSplitter(env *real_environment.RealEnv) error {
+	if *splitBlobAverageChunkSizeBytes == 0 {
+		return nil
+	}
+	s, err := NewSplitter(*splitBlobAverageChunkSizeBytes)
+	if err != nil {
+		return err
+	}
+	env.SetBlobSplitter(s)
+	return nil
+}
+
+func NewSplitter(averageSize int) (*Splitter, error) {
+	// Validate the size up front rather than failing on the first request.
+	if averageSize < minAverageSize || averageSize > maxAverageSize {
+		return nil, status.InvalidArgumentErrorf("average chunk size %d must be between %d and %d", averageSize, minAverageSize, maxAverageSize)
+	}
+	return &Splitter{averageSize: averageSize}, nil
+}
+
+func (s *Splitter) Split(ctx context.Context, r io.Reader, writeChunkFn func(chunk []byte) error) error {
+	c, err := New(ctx, s.averageSize, writeChunkFn)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(c, r); err != nil {
+		// Unblock the chunking goroutine before returning.
+		c.pw.CloseWithError(err)
+		<-c.done
+		return err
+	}
+	return c.Close()
+}
@@ -46,6 +46,7 @@ type Proxy struct {
 	clients               map[string]*grpc_client.ClientConnPool
 	heartbeatCallback     func(ctx context.Context, peer string)
 	hintedHandoffCallback func(ctx context.Context, peer string, r *rspb.ResourceName)
+	digestSummaryCallback func(ctx context.Context, peer string) (*dcpb.GetDigestSummaryResponse, error)
 	listenAddr            string
 	zone                  string
 }
@@ -113,6 +114,10 @@ func (c *Proxy) SetHintedHandoffCallbackFunc(fn func(ctx context.Context, peer s
 	c.hintedHandoffCallback = fn
 }
 
+func (c *Proxy) SetDigestSummaryCallbackFunc(fn func(ctx context.Context, peer string) (*dcpb.GetDigestSummaryResponse, error)) {
+	c.digestSummaryCallback = fn
+}
+
 func digestFromKey(k *dcpb.Key) *repb.Digest {
 	return &repb.Digest{
 		Hash:      k.GetKey(),
@@ -400,6 +405,16 @@ func (c *Proxy) Heartbeat(ctx context.Context, req *dcpb.HeartbeatRequest) (*dcp
 	return &dcpb.HeartbeatResponse{}, nil
 }
 
+func (c *Proxy) GetDigestSummary(ctx context.Context, req *dcpb.GetDigestSummaryRequest) (*dcpb.GetDigestSummaryResponse, error) {
+	if req.GetSource() == "" {
+		return nil, status.InvalidArgumentError("A source is required.")
+	}
+	if c.digestSummaryCallback == nil {
+		return nil, status.UnimplementedError("Digest summaries are not supported by this peer.")
+	}
+	return c.digestSummaryCallback(ctx, req.GetSource())
+}
+
 func (c *Proxy) RemoteContains(ctx context.Context, peer string, r *rspb.ResourceName) (bool, error) {
 	isolation := &dcpb.Isolation{
 		CacheType:          r.GetCacheType(),
@@ -768,3 +783,14 @@ func (c *Proxy) SendHeartbeat(ctx context.Context, peer string) error {
 	_, err = client.Heartbeat(c.prepareContext(ctx), req)
 	return err
 }
+
+func (c *Proxy) RemoteGetDigestSummary(ctx context.Context, peer string) (*dcpb.GetDigestSummaryResponse, error) {
+	client, err := c.getClient(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	req := &dcpb.GetDigestSummaryRequest{
+		Source: c.listenAddr,
+	}
+	return client.GetDigestSummary(c.prepareContext(ctx), req)
+}
@@ -41,6 +41,34 @@ func GenerateSealedBoxKeys(env environment.Env) (string, string, error) {
 	return base64.StdEncoding.EncodeToString(pubKey[:]), base64.StdEncoding.EncodeToString(encryptedPrivKey), nil
 }
 
+// EncryptWithMasterKey encrypts the plaintext with the KMS master key, so
+// that it can be stored alongside non-secret data. The same associatedData
+// must be passed to DecryptWithMasterKey.
+func EncryptWithMasterKey(env environment.Env, plaintext, associatedData []byte) ([]byte, error) {
+	kms := env.GetKMS()
+	if kms == nil {
+		return nil, status.FailedPreconditionError("No KMS was configured")
+	}
+	masterKey, err := kms.FetchMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return masterKey.Encrypt(plaintext, associatedData)
+}
+
+// DecryptWithMasterKey decrypts a ciphertext returned by EncryptWithMasterKey.
+func DecryptWithMasterKey(env environment.Env, ciphertext, associatedData []byte) ([]byte, error) {
+	kms := env.GetKMS()
+	if kms == nil {
+		return nil, status.FailedPreconditionError("No KMS was configured")
+	}
+	masterKey, err := kms.FetchMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return masterKey.Decrypt(ciphertext, associatedData)
+}
+
 // OpenAnonymousSealedBoxes opens the provided anonymous sealed boxes using the
 // provided publicKey and (encrypted) private key. (See GenerateSealedBoxKey
 // above to generate a publicKey and privateKey). If any error is encountered it
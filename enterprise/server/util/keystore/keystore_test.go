@@ -74,6 +74,30 @@ func TestGenerateKey(t *testing.T) {
 	require.Equal(t, 60, len(encPrivKeySlice))
 }
 
+func TestEncryptWithMasterKey(t *testing.T) {
+	kmsDir := testfs.MakeTempDir(t)
+	masterKeyURI := generateKMSKey(t, kmsDir, "masterKey")
+	flags.Set(t, "keystore.local_insecure_kms_directory", kmsDir)
+	flags.Set(t, "keystore.master_key_uri", masterKeyURI)
+
+	te := testenv.GetTestEnv(t)
+	err := kms.Register(te)
+	require.NoError(t, err)
+
+	plaintext := []byte("hunter2")
+	ciphertext, err := keystore.EncryptWithMasterKey(te, plaintext, []byte("WF123"))
+	require.NoError(t, err)
+	require.NotContains(t, string(ciphertext), string(plaintext))
+
+	decrypted, err := keystore.DecryptWithMasterKey(te, ciphertext, []byte("WF123"))
+	require.NoError(t, err)
+	require.Equal(t, plaintext, decrypted)
+
+	// Ciphertexts can't be decrypted with different associated data.
+	_, err = keystore.DecryptWithMasterKey(te, ciphertext, []byte("WF456"))
+	require.Error(t, err)
+}
+
 func TestBoxSealAndOpen(t *testing.T) {
 	kmsDir := testfs.MakeTempDir(t)
 	masterKeyURI := generateKMSKey(t, kmsDir, "masterKey")
@@ -0,0 +1,234 @@
+package ocicache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/lockmap"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	ocipb "github.com/buildbuddy-io/buildbuddy/proto/ociregistry"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	gcrname "github.com/google/go-containerregistry/pkg/name"
+	gcr "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// The AC has no way to enumerate keys, so the registry keeps its own indexes
+// of the repositories, tags, and referrers it has seen, one AC entry per
+// list. Like all other OCI cache entries, these are scoped to the group of
+// the authenticated user.
+//
+// Indexes are only updated when content is written to the cache, never on
+// reads. Updates are a read-modify-write, serialized per list within an app
+// replica; concurrent updates from different replicas may occasionally drop
+// a name, which is re-added the next time it is written.
+
+const (
+	indexInstanceName = interfaces.OCIImageInstanceNamePrefix + "_index_"
+
+	// maxIndexEntries caps the number of names (or referrers) in a single
+	// index entry, so that a repository with an unbounded number of tags
+	// can't grow its entry without limit.
+	maxIndexEntries = 10_000
+)
+
+var indexLocks = lockmap.New()
+
+func indexACKey(parts ...string) (*digest.ACResourceName, error) {
+	s := hash.Strings(append(parts, *cacheSecret)...)
+	arDigest, err := digest.Compute(bytes.NewBufferString(s), cacheDigestFunction)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewACResourceName(arDigest, indexInstanceName, cacheDigestFunction), nil
+}
+
+func catalogACKey() (*digest.ACResourceName, error) {
+	return indexACKey("catalog")
+}
+
+func tagsACKey(repo gcrname.Repository) (*digest.ACResourceName, error) {
+	return indexACKey(repo.RegistryStr(), repo.RepositoryStr(), "tags")
+}
+
+func referrersACKey(repo gcrname.Repository, subject gcr.Hash) (*digest.ACResourceName, error) {
+	return indexACKey(repo.RegistryStr(), repo.RepositoryStr(), "referrers", subject.Algorithm, subject.Hex)
+}
+
+// RepositoryName returns the name of the repository as it appears in
+// request paths: without the registry for Docker Hub, and prefixed with the
+// registry otherwise.
+func RepositoryName(repo gcrname.Repository) string {
+	if repo.RegistryStr() == gcrname.DefaultRegistry {
+		return repo.RepositoryStr()
+	}
+	return repo.RegistryStr() + "/" + repo.RepositoryStr()
+}
+
+func fetchNameList(ctx context.Context, acClient repb.ActionCacheClient, arRN *digest.ACResourceName) ([]string, error) {
+	l := &ocipb.OCINameList{}
+	if err := fetchAuxiliaryMetadataFromAC(ctx, acClient, arRN, l); err != nil {
+		return nil, err
+	}
+	return l.GetNames(), nil
+}
+
+// addToNameList inserts name into the sorted list stored under arRN, if it's
+// not already there.
+func addToNameList(ctx context.Context, acClient repb.ActionCacheClient, arRN *digest.ACResourceName, name string) error {
+	unlock := indexLocks.Lock(arRN.GetDigest().GetHash())
+	defer unlock()
+	names, err := fetchNameList(ctx, acClient, arRN)
+	if err != nil && !status.IsNotFoundError(err) {
+		return err
+	}
+	i, found := slices.BinarySearch(names, name)
+	if found {
+		return nil
+	}
+	if len(names) >= maxIndexEntries {
+		log.CtxWarningf(ctx, "Not indexing %q: index is full (%d entries)", name, len(names))
+		return nil
+	}
+	names = slices.Insert(names, i, name)
+	return writeAuxiliaryMetadataToAC(ctx, acClient, arRN, &ocipb.OCINameList{Names: names})
+}
+
+// AddToCatalog records that the given repository has content in the cache.
+func AddToCatalog(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository) error {
+	arRN, err := catalogACKey()
+	if err != nil {
+		return err
+	}
+	return addToNameList(ctx, acClient, arRN, RepositoryName(repo))
+}
+
+// FetchCatalog returns the sorted names of all repositories with content in
+// the cache.
+func FetchCatalog(ctx context.Context, acClient repb.ActionCacheClient) ([]string, error) {
+	arRN, err := catalogACKey()
+	if err != nil {
+		return nil, err
+	}
+	names, err := fetchNameList(ctx, acClient, arRN)
+	if status.IsNotFoundError(err) {
+		return nil, nil
+	}
+	return names, err
+}
+
+// AddTag records that the given tag exists in the given repository.
+func AddTag(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository, tag string) error {
+	arRN, err := tagsACKey(repo)
+	if err != nil {
+		return err
+	}
+	return addToNameList(ctx, acClient, arRN, tag)
+}
+
+// FetchTags returns the sorted tags that have been pushed to the given
+// repository. Returns a NotFound error if there are none.
+func FetchTags(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository) ([]string, error) {
+	arRN, err := tagsACKey(repo)
+	if err != nil {
+		return nil, err
+	}
+	return fetchNameList(ctx, acClient, arRN)
+}
+
+// FetchReferrers returns the descriptors of the manifests in the given
+// repository whose subject is the given manifest.
+func FetchReferrers(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository, subject gcr.Hash) ([]*ocipb.OCIDescriptor, error) {
+	arRN, err := referrersACKey(repo, subject)
+	if err != nil {
+		return nil, err
+	}
+	referrers := &ocipb.OCIReferrers{}
+	if err := fetchAuxiliaryMetadataFromAC(ctx, acClient, arRN, referrers); err != nil {
+		if status.IsNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return referrers.GetDescriptors(), nil
+}
+
+func addReferrer(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository, subject gcr.Hash, desc *ocipb.OCIDescriptor) error {
+	arRN, err := referrersACKey(repo, subject)
+	if err != nil {
+		return err
+	}
+	unlock := indexLocks.Lock(arRN.GetDigest().GetHash())
+	defer unlock()
+	referrers := &ocipb.OCIReferrers{}
+	if err := fetchAuxiliaryMetadataFromAC(ctx, acClient, arRN, referrers); err != nil && !status.IsNotFoundError(err) {
+		return err
+	}
+	for _, d := range referrers.GetDescriptors() {
+		if d.GetDigest() == desc.GetDigest() {
+			return nil
+		}
+	}
+	if len(referrers.GetDescriptors()) >= maxIndexEntries {
+		log.CtxWarningf(ctx, "Not indexing referrer %s of %s: index is full (%d entries)", desc.GetDigest(), subject, len(referrers.GetDescriptors()))
+		return nil
+	}
+	referrers.Descriptors = append(referrers.Descriptors, desc)
+	slices.SortFunc(referrers.Descriptors, func(a, b *ocipb.OCIDescriptor) int {
+		return strings.Compare(a.GetDigest(), b.GetDigest())
+	})
+	return writeAuxiliaryMetadataToAC(ctx, acClient, arRN, referrers)
+}
+
+// manifestIndexFields holds the manifest fields needed to index a manifest.
+type manifestIndexFields struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType"`
+	Config       *gcr.Descriptor   `json:"config"`
+	Subject      *gcr.Descriptor   `json:"subject"`
+	Annotations  map[string]string `json:"annotations"`
+}
+
+// indexManifest adds the repository of a newly cached manifest to the
+// catalog and, if the manifest has a subject, adds it to the subject's
+// referrers.
+func indexManifest(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository, hash gcr.Hash, raw []byte, contentType string) error {
+	if err := AddToCatalog(ctx, acClient, repo); err != nil {
+		return err
+	}
+	var m manifestIndexFields
+	if err := json.Unmarshal(raw, &m); err != nil {
+		// Not all manifest types are JSON objects that we understand, and
+		// only well-formed OCI manifests can have a subject.
+		log.CtxDebugf(ctx, "Not indexing manifest %s:%s: %s", repo, hash, err)
+		return nil
+	}
+	if m.Subject == nil {
+		return nil
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = contentType
+	}
+	// Per the distribution spec, the artifact type defaults to the config
+	// media type for image manifests.
+	artifactType := m.ArtifactType
+	if artifactType == "" && m.Config != nil {
+		artifactType = string(m.Config.MediaType)
+	}
+	desc := &ocipb.OCIDescriptor{
+		MediaType:    mediaType,
+		Digest:       hash.String(),
+		Size:         int64(len(raw)),
+		ArtifactType: artifactType,
+		Annotations:  m.Annotations,
+	}
+	return addReferrer(ctx, acClient, repo, m.Subject.Digest, desc)
+}
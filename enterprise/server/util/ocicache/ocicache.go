@@ -34,8 +34,11 @@ const (
 	blobMetadataOutputFilePath  = "_bb_ociregistry_blob_metadata_"
 	actionResultInstanceName    = interfaces.OCIImageInstanceNamePrefix
 	manifestContentInstanceName = interfaces.OCIImageInstanceNamePrefix + "_manifest_content_"
+	tagInstanceName             = interfaces.OCIImageInstanceNamePrefix + "_tag_"
+	uploadSessionInstanceName   = interfaces.OCIImageInstanceNamePrefix + "_upload_session_"
 
-	maxManifestSize = 10000000
+	// MaxManifestSize is the largest manifest that will be stored in the AC.
+	MaxManifestSize = 10000000
 
 	cacheDigestFunction = repb.DigestFunction_SHA256
 )
@@ -67,6 +70,18 @@ func WriteManifestToAC(ctx context.Context, raw []byte, acClient repb.ActionCach
 		log.CtxWarningf(ctx, "Error writing manifest %s:%s (original ref %q) to AC: %s", repo, hash, originalRef, err)
 		return err
 	}
+	// The manifest is already cached; a failure to index it only affects
+	// listings.
+	if err := indexManifest(ctx, acClient, repo, hash, raw, contentType); err != nil {
+		log.CtxWarningf(ctx, "Error indexing manifest %s:%s (original ref %q): %s", repo, hash, originalRef, err)
+	}
+	// Record the tag that a mirrored manifest was fetched by, so that it shows
+	// up in tag listings.
+	if tag, ok := originalRef.(gcrname.Tag); ok {
+		if err := AddTag(ctx, acClient, repo, tag.TagStr()); err != nil {
+			log.CtxWarningf(ctx, "Error indexing tag %s:%s (manifest %s): %s", repo, tag.TagStr(), hash, err)
+		}
+	}
 	log.CtxInfof(ctx, "Successfully wrote manifest %s:%s (original ref %q)", repo, hash, originalRef)
 	return nil
 }
@@ -239,7 +254,9 @@ func FetchBlobFromCache(ctx context.Context, w io.Writer, bsClient bspb.ByteStre
 	return nil
 }
 
-func writeBlobMetadataToCache(ctx context.Context, bsClient bspb.ByteStreamClient, acClient repb.ActionCacheClient, repo gcrname.Repository, hash gcr.Hash, contentType string, contentLength int64) error {
+// WriteBlobMetadataToCache records that the blob with the given hash, which
+// must already be in the CAS, belongs to the given repository.
+func WriteBlobMetadataToCache(ctx context.Context, bsClient bspb.ByteStreamClient, acClient repb.ActionCacheClient, repo gcrname.Repository, hash gcr.Hash, contentType string, contentLength int64) error {
 	blobMetadata := &ocipb.OCIBlobMetadata{
 		ContentLength: contentLength,
 		ContentType:   contentType,
@@ -288,6 +305,17 @@ func writeBlobMetadataToCache(ctx context.Context, bsClient bspb.ByteStreamClien
 	return cachetools.UploadActionResult(ctx, acClient, arRN, ar)
 }
 
+// MountBlob makes a blob that is cached for one repository available in
+// another repository, without copying the blob contents. Returns a NotFound
+// error if the blob is not cached for the source repository.
+func MountBlob(ctx context.Context, bsClient bspb.ByteStreamClient, acClient repb.ActionCacheClient, from, to gcrname.Repository, hash gcr.Hash) error {
+	blobMetadata, err := FetchBlobMetadataFromCache(ctx, bsClient, acClient, from, hash)
+	if err != nil {
+		return err
+	}
+	return WriteBlobMetadataToCache(ctx, bsClient, acClient, to, hash, blobMetadata.GetContentType(), blobMetadata.GetContentLength())
+}
+
 func WriteBlobToCache(ctx context.Context, r io.Reader, bsClient bspb.ByteStreamClient, acClient repb.ActionCacheClient, repo gcrname.Repository, hash gcr.Hash, contentType string, contentLength int64) error {
 	blobCASDigest := &repb.Digest{
 		Hash:      hash.Hex,
@@ -303,7 +331,7 @@ func WriteBlobToCache(ctx context.Context, r io.Reader, bsClient bspb.ByteStream
 	if err != nil {
 		return err
 	}
-	return writeBlobMetadataToCache(ctx, bsClient, acClient, repo, hash, contentType, contentLength)
+	return WriteBlobMetadataToCache(ctx, bsClient, acClient, repo, hash, contentType, contentLength)
 }
 
 // NewBlobUploader creates a CommittedWriteCloser that writes OCI blobs to the CAS.
@@ -368,7 +396,7 @@ func (b *blobUploader) Commit() error {
 	if err := b.uw.Commit(); err != nil {
 		return err
 	}
-	return writeBlobMetadataToCache(
+	return WriteBlobMetadataToCache(
 		b.ctx,
 		b.bsClient,
 		b.acClient,
@@ -444,8 +472,8 @@ func (r *readThroughCacher) Close() error {
 
 func WriteBlobOrManifestToCacheAndWriter(ctx context.Context, upstream io.Reader, w io.Writer, bsClient bspb.ByteStreamClient, acClient repb.ActionCacheClient, repo gcrname.Repository, ociResourceType ocipb.OCIResourceType, hash gcr.Hash, contentType string, contentLength int64, originalRef gcrname.Reference) error {
 	if ociResourceType == ocipb.OCIResourceType_MANIFEST {
-		if contentLength > maxManifestSize {
-			return status.FailedPreconditionErrorf("manifest too large (%d bytes) to write to cache (limit %d bytes)", contentLength, maxManifestSize)
+		if contentLength > MaxManifestSize {
+			return status.FailedPreconditionErrorf("manifest too large (%d bytes) to write to cache (limit %d bytes)", contentLength, MaxManifestSize)
 		}
 		buf := bytes.NewBuffer(make([]byte, 0, contentLength))
 		mw := io.MultiWriter(w, buf)
@@ -461,3 +489,104 @@ func WriteBlobOrManifestToCacheAndWriter(ctx context.Context, upstream io.Reader
 	tr := io.TeeReader(upstream, w)
 	return WriteBlobToCache(ctx, tr, bsClient, acClient, repo, hash, contentType, contentLength)
 }
+
+func writeAuxiliaryMetadataToAC(ctx context.Context, acClient repb.ActionCacheClient, arRN *digest.ACResourceName, m proto.Message) error {
+	any, err := anypb.New(m)
+	if err != nil {
+		return err
+	}
+	ar := &repb.ActionResult{
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			AuxiliaryMetadata: []*anypb.Any{any},
+		},
+	}
+	return cachetools.UploadActionResult(ctx, acClient, arRN, ar)
+}
+
+func fetchAuxiliaryMetadataFromAC(ctx context.Context, acClient repb.ActionCacheClient, arRN *digest.ACResourceName, m proto.Message) error {
+	ar, err := cachetools.GetActionResult(ctx, acClient, arRN)
+	if err != nil {
+		return err
+	}
+	aux := ar.GetExecutionMetadata().GetAuxiliaryMetadata()
+	if len(aux) != 1 {
+		return status.InternalErrorf("expected 1 auxiliary metadata entry, found %d", len(aux))
+	}
+	if err := aux[0].UnmarshalTo(m); err != nil {
+		return status.InternalErrorf("could not unmarshal auxiliary metadata: %s", err)
+	}
+	return nil
+}
+
+func tagACKey(repo gcrname.Repository, tag string) (*digest.ACResourceName, error) {
+	s := hash.Strings(
+		repo.RegistryStr(),
+		repo.RepositoryStr(),
+		"tag",
+		tag,
+		*cacheSecret,
+	)
+	arDigest, err := digest.Compute(bytes.NewBufferString(s), cacheDigestFunction)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewACResourceName(arDigest, tagInstanceName, cacheDigestFunction), nil
+}
+
+// WriteTag points the given tag in the given repository at a manifest.
+func WriteTag(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository, tag string, manifestHash gcr.Hash) error {
+	arRN, err := tagACKey(repo, tag)
+	if err != nil {
+		return err
+	}
+	if err := writeAuxiliaryMetadataToAC(ctx, acClient, arRN, &ocipb.OCITag{ManifestDigest: manifestHash.String()}); err != nil {
+		return err
+	}
+	return AddTag(ctx, acClient, repo, tag)
+}
+
+// FetchTag returns the digest of the manifest that the given tag was last
+// pushed with. Returns a NotFound error if the tag was never pushed.
+func FetchTag(ctx context.Context, acClient repb.ActionCacheClient, repo gcrname.Repository, tag string) (gcr.Hash, error) {
+	arRN, err := tagACKey(repo, tag)
+	if err != nil {
+		return gcr.Hash{}, err
+	}
+	t := &ocipb.OCITag{}
+	if err := fetchAuxiliaryMetadataFromAC(ctx, acClient, arRN, t); err != nil {
+		return gcr.Hash{}, err
+	}
+	return gcr.NewHash(t.GetManifestDigest())
+}
+
+func uploadSessionACKey(uploadID string) (*digest.ACResourceName, error) {
+	s := hash.Strings("upload_session", uploadID, *cacheSecret)
+	arDigest, err := digest.Compute(bytes.NewBufferString(s), cacheDigestFunction)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewACResourceName(arDigest, uploadSessionInstanceName, cacheDigestFunction), nil
+}
+
+// WriteUploadSession stores the state of the blob upload with the given ID.
+func WriteUploadSession(ctx context.Context, acClient repb.ActionCacheClient, uploadID string, session *ocipb.OCIUploadSession) error {
+	arRN, err := uploadSessionACKey(uploadID)
+	if err != nil {
+		return err
+	}
+	return writeAuxiliaryMetadataToAC(ctx, acClient, arRN, session)
+}
+
+// FetchUploadSession returns the state of the blob upload with the given ID.
+// Returns a NotFound error if there is no such upload.
+func FetchUploadSession(ctx context.Context, acClient repb.ActionCacheClient, uploadID string) (*ocipb.OCIUploadSession, error) {
+	arRN, err := uploadSessionACKey(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	session := &ocipb.OCIUploadSession{}
+	if err := fetchAuxiliaryMetadataFromAC(ctx, acClient, arRN, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
@@ -1,121 +1,494 @@
 package bitbucket
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+var (
+	dataCenterHosts = flag.Slice("bitbucket.data_center_hosts", []string{}, "Hosts of Bitbucket Data Center instances that BuildBuddy workflows can be used with, e.g. \"bitbucket.example.com\". ** Enterprise only **")
+	webhookSecret   = flag.String("bitbucket.webhook_secret", "", "Secret used to derive the secret that Bitbucket signs each webhook request with. Required to register and receive Bitbucket webhooks. ** Enterprise only **", flag.Secret)
 )
 
 const (
 	expectedUserAgent = "Bitbucket-Webhooks/2.0"
-	repoBaseURL       = "https://bitbucket.org/"
+	cloudHost         = "bitbucket.org"
+	cloudAPIURL       = "https://api.bitbucket.org/2.0"
+
+	// Name used for registered webhooks.
+	webhookName = "BuildBuddy"
+
+	// Timeout for Bitbucket REST API requests.
+	apiRequestTimeout = 30 * time.Second
+
+	// Header containing the HMAC-SHA256 signature of the request body, in
+	// the form "sha256=<hex digest>". Cloud and Data Center use the same
+	// header.
+	signatureHeader = "X-Hub-Signature"
+)
+
+var (
+	// Bitbucket Cloud event names to listen for on the webhook.
+	cloudEventsToReceive = []string{"repo:push", "pullrequest:created", "pullrequest:updated", "pullrequest:approved"}
 )
 
-type bitbucketGitProvider struct{}
+type bitbucketGitProvider struct {
+	client *http.Client
+}
 
 func NewProvider() interfaces.GitProvider {
-	return &bitbucketGitProvider{}
+	return &bitbucketGitProvider{
+		client: &http.Client{Timeout: apiRequestTimeout},
+	}
 }
 
 func (*bitbucketGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
-	if userAgent := r.Header.Get("User-Agent"); userAgent != expectedUserAgent {
-		return nil, status.UnimplementedErrorf("unexpected user agent: %q; only %q is supported", userAgent, expectedUserAgent)
+	if err := verifyWebhookSignature(r); err != nil {
+		return nil, err
 	}
 	switch eventName := r.Header.Get("X-Event-Key"); eventName {
 	case "repo:push":
+		if err := checkCloudUserAgent(r); err != nil {
+			return nil, err
+		}
 		payload := &PushEventPayload{}
 		if err := unmarshalBody(r, payload); err != nil {
 			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
 		}
+		// Ignore branch deletions, which have no new ref state.
+		if payload.Push == nil || len(payload.Push.Changes) == 0 || payload.Push.Changes[0].New == nil {
+			return nil, nil
+		}
 		v, err := fieldgetter.ExtractValues(
 			payload,
 			"Push.Changes.0.New.Name",
 			"Push.Changes.0.New.Target.Hash",
 			"Push.Changes.0.New.Type",
 			"Repository.Links.HTML.Href",
+			"Repository.IsPrivate",
 		)
 		if err != nil {
 			return nil, err
 		}
 		if t := v["Push.Changes.0.New.Type"]; t != "branch" {
-			log.Printf("Ignoring non-branch push event (type %q)", t)
+			log.Debugf("Ignoring non-branch push event (type %q)", t)
 			return nil, nil
 		}
 		branch := v["Push.Changes.0.New.Name"]
 		return &interfaces.WebhookData{
-			EventName:     webhook_data.EventName.Push,
-			PushedRepoURL: v["Repository.Links.HTML.Href"],
-			PushedBranch:  branch,
-			TargetRepoURL: v["Repository.Links.HTML.Href"],
-			TargetBranch:  branch,
-			SHA:           v["Push.Changes.0.New.Target.Hash"],
+			EventName:          webhook_data.EventName.Push,
+			PushedRepoURL:      v["Repository.Links.HTML.Href"],
+			PushedBranch:       branch,
+			TargetRepoURL:      v["Repository.Links.HTML.Href"],
+			TargetBranch:       branch,
+			SHA:                v["Push.Changes.0.New.Target.Hash"],
+			IsTargetRepoPublic: v["Repository.IsPrivate"] == "false",
 		}, nil
-	case "pullrequest:created", "pullrequest:updated":
+	case "pullrequest:created", "pullrequest:updated", "pullrequest:approved":
+		if err := checkCloudUserAgent(r); err != nil {
+			return nil, err
+		}
 		payload := &PullRequestEventPayload{}
 		if err := unmarshalBody(r, payload); err != nil {
 			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
 		}
 		v, err := fieldgetter.ExtractValues(
 			payload,
-			"PullRequest.Destination.Repository.UUID",
+			"PullRequest.ID",
+			"PullRequest.Author.UUID",
 			"PullRequest.Destination.Repository.Links.HTML.Href",
 			"PullRequest.Destination.Branch.Name",
-			"PullRequest.Source.Repository.UUID",
 			"PullRequest.Source.Repository.Links.HTML.Href",
 			"PullRequest.Source.Branch.Name",
 			"PullRequest.Source.Commit.Hash",
+			"Repository.IsPrivate",
 		)
 		if err != nil {
 			return nil, err
 		}
-		return &interfaces.WebhookData{
-			EventName:     webhook_data.EventName.PullRequest,
-			PushedRepoURL: v["PullRequest.Source.Repository.Links.HTML.Href"],
-			PushedBranch:  v["PullRequest.Source.Branch.Name"],
-			SHA:           v["PullRequest.Source.Commit.Hash"],
-			TargetRepoURL: v["PullRequest.Destination.Repository.Links.HTML.Href"],
-			TargetBranch:  v["PullRequest.Destination.Branch.Name"],
-		}, nil
+		wd := &interfaces.WebhookData{
+			EventName:          webhook_data.EventName.PullRequest,
+			PushedRepoURL:      v["PullRequest.Source.Repository.Links.HTML.Href"],
+			PushedBranch:       v["PullRequest.Source.Branch.Name"],
+			SHA:                v["PullRequest.Source.Commit.Hash"],
+			TargetRepoURL:      v["PullRequest.Destination.Repository.Links.HTML.Href"],
+			TargetBranch:       v["PullRequest.Destination.Branch.Name"],
+			IsTargetRepoPublic: v["Repository.IsPrivate"] == "false",
+			PullRequestNumber:  payload.PullRequest.ID,
+			// Users are identified by UUID, since Bitbucket Cloud usernames
+			// are not exposed in the API.
+			PullRequestAuthor: v["PullRequest.Author.UUID"],
+		}
+		if eventName == "pullrequest:approved" {
+			approver, err := fieldgetter.ExtractValues(payload, "Approval.User.UUID")
+			if err != nil {
+				return nil, err
+			}
+			wd.PullRequestApprover = approver["Approval.User.UUID"]
+		}
+		return wd, nil
+	case "repo:refs_changed":
+		return parseDataCenterPushEvent(r)
+	case "pr:opened", "pr:from_ref_updated", "pr:modified", "pr:reviewer:approved":
+		return parseDataCenterPullRequestEvent(r, eventName)
 	default:
-		log.Printf("Ignoring webhook event: %s", eventName)
+		log.Debugf("Ignoring Bitbucket webhook event: %s", eventName)
 		return nil, nil
 	}
 }
 
+// webhookSecretForPath returns the secret that Bitbucket should sign requests
+// to the webhook with the given URL path with. The secret is derived from the
+// path so that each webhook gets its own secret and no per-webhook state
+// needs to be stored.
+func webhookSecretForPath(webhookPath string) (string, error) {
+	if *webhookSecret == "" {
+		return "", status.FailedPreconditionError("bitbucket.webhook_secret is not configured")
+	}
+	mac := hmac.New(sha256.New, []byte(*webhookSecret))
+	mac.Write([]byte(webhookPath))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyWebhookSignature returns an error unless the request body is signed
+// with the secret that was registered for the webhook it was sent to. The
+// request body is left in place so that it can still be parsed.
+func verifyWebhookSignature(r *http.Request) error {
+	secret, err := webhookSecretForPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return status.InvalidArgumentErrorf("failed to read webhook request body: %s", err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	got, ok := strings.CutPrefix(r.Header.Get(signatureHeader), "sha256=")
+	if !ok {
+		return status.PermissionDeniedErrorf("missing or unsupported %s", signatureHeader)
+	}
+	gotMAC, err := hex.DecodeString(got)
+	if err != nil {
+		return status.PermissionDeniedErrorf("invalid %s", signatureHeader)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(b)
+	if !hmac.Equal(gotMAC, mac.Sum(nil)) {
+		return status.PermissionDeniedErrorf("invalid %s", signatureHeader)
+	}
+	return nil
+}
+
+func checkCloudUserAgent(r *http.Request) error {
+	if userAgent := r.Header.Get("User-Agent"); userAgent != expectedUserAgent {
+		return status.UnimplementedErrorf("unexpected user agent: %q; only %q is supported", userAgent, expectedUserAgent)
+	}
+	return nil
+}
+
 func (*bitbucketGitProvider) MatchRepoURL(u *url.URL) bool {
-	return u.Host == "bitbucket.com"
+	return u.Host == cloudHost || slices.Contains(*dataCenterHosts, u.Host)
 }
 
 func (*bitbucketGitProvider) MatchWebhookRequest(r *http.Request) bool {
 	return r.Header.Get("X-Event-Key") != ""
 }
 
-func (*bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
-	return "", status.UnimplementedError("Not implemented")
+func (g *bitbucketGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid webhook URL %q: %s", webhookURL, err)
+	}
+	secret, err := webhookSecretForPath(u.Path)
+	if err != nil {
+		return "", err
+	}
+	api, err := g.repoAPI(accessToken, repoURL)
+	if err != nil {
+		return "", err
+	}
+	return api.registerWebhook(ctx, webhookURL, secret)
+}
+
+func (g *bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	api, err := g.repoAPI(accessToken, repoURL)
+	if err != nil {
+		return err
+	}
+	return api.unregisterWebhook(ctx, webhookID)
+}
+
+func (g *bitbucketGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	api, err := g.repoAPI(accessToken, repoURL)
+	if err != nil {
+		return nil, err
+	}
+	b, err := api.getFileContents(ctx, filePath, ref)
+	if status.IsNotFoundError(err) {
+		// Bitbucket also returns 404 if the repo doesn't exist or is
+		// inaccessible. Check whether the repo exists so that we can abort the
+		// workflow if it doesn't, rather than using the default config.
+		if err := api.getRepo(ctx); status.IsNotFoundError(err) {
+			return nil, status.FailedPreconditionErrorf("repository %q not found or inaccessible to this token", repoURL)
+		} else if err != nil {
+			return nil, status.UnavailableErrorf("get repository %q: %s", repoURL, err)
+		}
+		return nil, status.NotFoundErrorf("%s: not found in %s", filePath, repoURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (g *bitbucketGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	api, err := g.repoAPI(accessToken, repoURL)
+	if err != nil {
+		return false, err
+	}
+	return api.isTrusted(ctx, user)
+}
+
+// CreateStatus publishes a build status to the given commit. It accepts the
+// same payload type as the GitHub provider so that callers don't need to
+// special case Bitbucket repos.
+func (g *bitbucketGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid Bitbucket status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	api, err := g.repoAPI(accessToken, repoURL)
+	if err != nil {
+		return err
+	}
+	return api.createStatus(ctx, commitSHA, &buildStatus{
+		Key:         s.GetContext(),
+		Name:        s.GetContext(),
+		State:       buildState(gh_backend.State(s.GetState())),
+		URL:         s.GetTargetURL(),
+		Description: s.GetDescription(),
+	})
+}
+
+// buildState converts a GitHub status state to the corresponding Bitbucket
+// build status state. Cloud and Data Center use the same states.
+func buildState(state gh_backend.State) string {
+	switch state {
+	case gh_backend.PendingState:
+		return "INPROGRESS"
+	case gh_backend.SuccessState:
+		return "SUCCESSFUL"
+	default:
+		return "FAILED"
+	}
+}
+
+// bitbucketRepoAPI makes REST API calls for a single repo. The Cloud and
+// Data Center APIs differ in paths and payloads, but support the same
+// operations.
+type bitbucketRepoAPI interface {
+	getRepo(ctx context.Context) error
+	registerWebhook(ctx context.Context, webhookURL, secret string) (string, error)
+	unregisterWebhook(ctx context.Context, webhookID string) error
+	getFileContents(ctx context.Context, filePath, ref string) ([]byte, error)
+	isTrusted(ctx context.Context, user string) (bool, error)
+	createStatus(ctx context.Context, commitSHA string, s *buildStatus) error
+}
+
+func (g *bitbucketGitProvider) repoAPI(accessToken, repoURL string) (bitbucketRepoAPI, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return nil, status.WrapError(err, "Failed to parse Bitbucket repo URL")
+	}
+	c := &apiClient{client: g.client, accessToken: accessToken}
+	if u.Host == cloudHost {
+		return newCloudRepoAPI(c, u)
+	}
+	if !slices.Contains(*dataCenterHosts, u.Host) {
+		return nil, status.InvalidArgumentErrorf("%q is not a Bitbucket Cloud repo or a repo on a configured Bitbucket Data Center host", repoURL)
+	}
+	return newDataCenterRepoAPI(c, u)
+}
+
+type cloudRepoAPI struct {
+	c *apiClient
+	// repoURL is the API URL of the repo, e.g.
+	// "https://api.bitbucket.org/2.0/repositories/workspace/repo".
+	repoURL string
+}
+
+func newCloudRepoAPI(c *apiClient, u *url.URL) (*cloudRepoAPI, error) {
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	if len(parts) != 2 {
+		return nil, status.InvalidArgumentErrorf("Invalid Bitbucket workspace/repo %q", u.Path)
+	}
+	return &cloudRepoAPI{
+		c:       c,
+		repoURL: fmt.Sprintf("%s/repositories/%s/%s", cloudAPIURL, url.PathEscape(parts[0]), url.PathEscape(parts[1])),
+	}, nil
+}
+
+func (a *cloudRepoAPI) getRepo(ctx context.Context) error {
+	_, err := a.c.do(ctx, http.MethodGet, a.repoURL, nil, nil)
+	return err
+}
+
+func (a *cloudRepoAPI) registerWebhook(ctx context.Context, webhookURL, secret string) (string, error) {
+	req := map[string]any{
+		"description": webhookName,
+		"url":         webhookURL,
+		"active":      true,
+		"secret":      secret,
+		"events":      cloudEventsToReceive,
+	}
+	rsp := &struct {
+		UUID string `json:"uuid"`
+	}{}
+	if _, err := a.c.do(ctx, http.MethodPost, a.repoURL+"/hooks", req, rsp); err != nil {
+		return "", err
+	}
+	if rsp.UUID == "" {
+		return "", status.UnknownError("Bitbucket returned invalid response from hooks API (missing uuid field).")
+	}
+	return rsp.UUID, nil
 }
 
-func (*bitbucketGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
-	return status.UnimplementedError("Not implemented")
+func (a *cloudRepoAPI) unregisterWebhook(ctx context.Context, webhookID string) error {
+	_, err := a.c.do(ctx, http.MethodDelete, a.repoURL+"/hooks/"+url.PathEscape(webhookID), nil, nil)
+	return err
 }
 
-func (*bitbucketGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
-	return nil, status.UnimplementedError("Not implemented")
+func (a *cloudRepoAPI) getFileContents(ctx context.Context, filePath, ref string) ([]byte, error) {
+	return a.c.do(ctx, http.MethodGet, a.repoURL+"/src/"+url.PathEscape(ref)+"/"+escapeFilePath(filePath), nil, nil)
 }
 
-func (*bitbucketGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
-	return false, status.UnimplementedError("Not implemented")
+func (a *cloudRepoAPI) isTrusted(ctx context.Context, user string) (bool, error) {
+	rsp := &struct {
+		Permission string `json:"permission"`
+	}{}
+	if _, err := a.c.do(ctx, http.MethodGet, a.repoURL+"/permissions-config/users/"+url.PathEscape(user), nil, rsp); err != nil {
+		if status.IsNotFoundError(err) {
+			// User does not have explicit access to this repo.
+			return false, nil
+		}
+		return false, status.WrapError(err, "get repository permission")
+	}
+	// Trusted workflows get cache write perms, so if the user doesn't have
+	// write perms for the repo then don't consider the workflow trusted.
+	return rsp.Permission == "admin" || rsp.Permission == "write", nil
 }
 
-func (*bitbucketGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
-	return status.UnimplementedError("Not implemented")
+func (a *cloudRepoAPI) createStatus(ctx context.Context, commitSHA string, s *buildStatus) error {
+	_, err := a.c.do(ctx, http.MethodPost, a.repoURL+"/commit/"+url.PathEscape(commitSHA)+"/statuses/build", s, nil)
+	return err
+}
+
+// buildStatus is the build status payload accepted by both the Cloud and
+// Data Center APIs.
+type buildStatus struct {
+	Key         string `json:"key"`
+	Name        string `json:"name,omitempty"`
+	State       string `json:"state"`
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+// apiClient sends authenticated requests to the Bitbucket REST API.
+type apiClient struct {
+	client *http.Client
+	// accessToken is either an access token, or "username:app_password" for
+	// accounts authenticating with app passwords.
+	accessToken string
+}
+
+// do sends a request to the given API URL. If req is non-nil then it is sent as
+// the JSON request body, and if rsp is non-nil then the JSON response body is
+// unmarshaled into it. The raw response body is returned.
+func (c *apiClient) do(ctx context.Context, method, apiURL string, req, rsp any) ([]byte, error) {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, apiURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if user, password, ok := strings.Cut(c.accessToken, ":"); ok {
+		httpReq.SetBasicAuth(user, password)
+	} else if c.accessToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.accessToken)
+	}
+	if req != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpRsp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, status.UnavailableErrorf("%s %s: %s", method, httpReq.URL.Path, err)
+	}
+	defer httpRsp.Body.Close()
+	b, err := io.ReadAll(httpRsp.Body)
+	if err != nil {
+		return nil, status.UnavailableErrorf("read Bitbucket response: %s", err)
+	}
+	if httpRsp.StatusCode < 200 || httpRsp.StatusCode >= 300 {
+		return nil, bitbucketErrorToStatus(httpRsp.StatusCode, b)
+	}
+	if rsp != nil {
+		if err := json.Unmarshal(b, rsp); err != nil {
+			return nil, status.UnknownErrorf("unmarshal Bitbucket response: %s", err)
+		}
+	}
+	return b, nil
+}
+
+func bitbucketErrorToStatus(code int, body []byte) error {
+	msg := fmt.Sprintf("Bitbucket API returned HTTP %d: %s", code, strings.TrimSpace(string(body)))
+	switch code {
+	case http.StatusNotFound:
+		return status.NotFoundError(msg)
+	case http.StatusUnauthorized:
+		return status.UnauthenticatedError(msg)
+	case http.StatusForbidden:
+		return status.PermissionDeniedError(msg)
+	case http.StatusTooManyRequests:
+		return status.ResourceExhaustedError(msg)
+	default:
+		return status.InternalError(msg)
+	}
+}
+
+// escapeFilePath escapes each segment of a slash-separated repo file path.
+func escapeFilePath(p string) string {
+	segments := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
 }
 
 func unmarshalBody(r *http.Request, payload interface{}) error {
@@ -136,6 +509,8 @@ type PushDetails struct {
 	Changes []*PushedChange `json:"changes"`
 }
 type PushedChange struct {
+	// New is the state of the ref after the push, or nil if the ref was
+	// deleted.
 	New *RefState `json:"new"`
 }
 type RefState struct {
@@ -152,8 +527,12 @@ type RefState struct {
 type PullRequestEventPayload struct {
 	PullRequest *PullRequestDetails `json:"pullrequest"`
 	Repository  *Repository         `json:"repository"`
+	// Approval is only set for approval events.
+	Approval *Approval `json:"approval"`
 }
 type PullRequestDetails struct {
+	ID          int64            `json:"id"`
+	Author      *Account         `json:"author"`
 	Source      *PullRequestSide `json:"source"`
 	Destination *PullRequestSide `json:"destination"`
 }
@@ -165,6 +544,15 @@ type PullRequestSide struct {
 type Branch struct {
 	Name string `json:"name"`
 }
+type Approval struct {
+	User *Account `json:"user"`
+}
+
+// Account represents a subset of Bitbucket's Account schema.
+// See https://support.atlassian.com/bitbucket-cloud/docs/event-payloads/#Account
+type Account struct {
+	UUID string `json:"uuid"`
+}
 
 // Repository represents a subset of Bitbucket's Repository schema, which is
 // a common entity used in multiple webhook events.
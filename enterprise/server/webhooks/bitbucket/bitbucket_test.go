@@ -2,26 +2,66 @@ package bitbucket_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket"
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/bitbucket/test_data"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
 )
 
+const webhookSecret = "test-secret"
+
+// sign returns the X-Hub-Signature that Bitbucket sends with the given payload
+// to the webhook with the given path.
+func sign(webhookPath string, payload []byte) string {
+	secretMAC := hmac.New(sha256.New, []byte(webhookSecret))
+	secretMAC.Write([]byte(webhookPath))
+	secret := hex.EncodeToString(secretMAC.Sum(nil))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
 func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	flags.Set(t, "bitbucket.webhook_secret", webhookSecret)
 	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.Header.Add("X-Event-Key", eventType)
+	req.Header.Add("X-Hub-Signature", sign("/webhooks/foo", payload))
 	req.Header.Add("User-Agent", "Bitbucket-Webhooks/2.0")
 	req.Header.Add("Content-Type", "application/json")
 	return req
 }
 
+// fakeDataCenter starts a fake Bitbucket Data Center server, configures it as
+// a Data Center host, and returns the clone URL of a repo hosted on it.
+func fakeDataCenter(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	// Use localhost so that the repo URL isn't normalized to https.
+	u, err := url.Parse(strings.Replace(server.URL, "127.0.0.1", "localhost", 1))
+	require.NoError(t, err)
+	flags.Set(t, "bitbucket.data_center_hosts", []string{u.Host})
+	return u.String() + "/scm/bb/repo.git"
+}
+
 func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
 	req := webhookRequest(t, "repo:push", test_data.PushEvent)
 
@@ -45,11 +85,193 @@ func TestParseRequest_ValidPullRequestEvent_Success(t *testing.T) {
 
 	assert.NoError(t, err)
 	assert.Equal(t, &interfaces.WebhookData{
-		EventName:     "pull_request",
-		PushedRepoURL: "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
-		PushedBranch:  "test-1614450472",
-		SHA:           "a4822151d5d2",
-		TargetRepoURL: "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
+		EventName:         "pull_request",
+		PushedRepoURL:     "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
+		PushedBranch:      "test-1614450472",
+		SHA:               "a4822151d5d2",
+		TargetRepoURL:     "https://bitbucket.org/buildbuddy/buildbuddy-ci-playground",
+		TargetBranch:      "main",
+		PullRequestNumber: 2,
+		PullRequestAuthor: "{0cc3a8ab-9405-400d-9bf9-ebfd456a170b}",
+	}, data)
+}
+
+func TestParseRequest_ValidDataCenterPushEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "repo:refs_changed", test_data.DataCenterPushEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:     "push",
+		PushedRepoURL: "https://bitbucket.example.com/scm/bb/buildbuddy-ci-playground.git",
+		PushedBranch:  "main",
+		SHA:           "178864a7d521b6f5e720b386b2c2b0ef8563e0dc",
+		TargetRepoURL: "https://bitbucket.example.com/scm/bb/buildbuddy-ci-playground.git",
 		TargetBranch:  "main",
 	}, data)
 }
+
+func TestParseRequest_ValidDataCenterPullRequestEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "pr:opened", test_data.DataCenterPullRequestEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:          "pull_request",
+		PushedRepoURL:      "https://bitbucket.example.com/scm/~test2/buildbuddy-ci-playground.git",
+		PushedBranch:       "pr-1709058361",
+		SHA:                "5f8e6a1c2b3d4e5f60718293a4b5c6d7e8f90a1b",
+		TargetRepoURL:      "https://bitbucket.example.com/scm/bb/buildbuddy-ci-playground.git",
+		TargetBranch:       "main",
+		IsTargetRepoPublic: true,
+		PullRequestNumber:  7,
+		PullRequestAuthor:  "test2",
+	}, data)
+}
+
+func TestParseRequest_DataCenterPullRequestModifiedWithoutTargetChange_Ignored(t *testing.T) {
+	req := webhookRequest(t, "pr:modified", test_data.DataCenterPullRequestEvent)
+
+	data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_InvalidSignature_Rejected(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		signature string
+	}{
+		{"missing", ""},
+		{"unsupported algorithm", "sha1=0123456789abcdef"},
+		{"not hex", "sha256=not-hex"},
+		{"signed for another webhook", sign("/webhooks/bar", test_data.PushEvent)},
+		{"signed with another payload", sign("/webhooks/foo", test_data.PullRequestEvent)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := webhookRequest(t, "repo:push", test_data.PushEvent)
+			req.Header.Set("X-Hub-Signature", tc.signature)
+
+			data, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+			assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+			assert.Nil(t, data)
+		})
+	}
+}
+
+func TestParseRequest_NoWebhookSecret_Rejected(t *testing.T) {
+	req := webhookRequest(t, "repo:push", test_data.PushEvent)
+	flags.Set(t, "bitbucket.webhook_secret", "")
+
+	_, err := bitbucket.NewProvider().ParseWebhookData(req)
+
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+}
+
+func TestDataCenter_RegisterWebhook(t *testing.T) {
+	flags.Set(t, "bitbucket.webhook_secret", webhookSecret)
+	var gotPath string
+	gotBody := map[string]any{}
+	repoURL := fakeDataCenter(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		err := json.NewDecoder(r.Body).Decode(&gotBody)
+		require.NoError(t, err)
+		w.Write([]byte(`{"id": 42}`))
+	})
+
+	id, err := bitbucket.NewProvider().RegisterWebhook(context.Background(), "TOKEN", repoURL, "https://app.buildbuddy.io/webhooks/workflow/foo")
+
+	require.NoError(t, err)
+	assert.Equal(t, "42", id)
+	assert.Equal(t, "/rest/api/1.0/projects/bb/repos/repo/webhooks", gotPath)
+	// Requests to the webhook must be verifiable with the registered secret.
+	payload := []byte(`{}`)
+	secret := gotBody["configuration"].(map[string]any)["secret"].(string)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	assert.Equal(t, sign("/webhooks/workflow/foo", payload), "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestDataCenter_CreateStatus(t *testing.T) {
+	var gotPath, gotAuth string
+	gotBody := map[string]string{}
+	repoURL := fakeDataCenter(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		err := json.NewDecoder(r.Body).Decode(&gotBody)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/123", "Queued...", gh_backend.PendingState)
+
+	err := bitbucket.NewProvider().CreateStatus(context.Background(), "TOKEN", repoURL, "abc123", payload)
+
+	require.NoError(t, err)
+	assert.Equal(t, "/rest/api/1.0/projects/bb/repos/repo/commits/abc123/builds", gotPath)
+	assert.Equal(t, "Bearer TOKEN", gotAuth)
+	assert.Equal(t, map[string]string{
+		"key":         "Test",
+		"name":        "Test",
+		"state":       "INPROGRESS",
+		"url":         "https://app.buildbuddy.io/invocation/123",
+		"description": "Queued...",
+	}, gotBody)
+}
+
+func TestDataCenter_IsTrusted(t *testing.T) {
+	repoURL := fakeDataCenter(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/repos/") {
+			w.Write([]byte(`{"values": [
+				{"user": {"name": "repo-writer", "slug": "repo-writer"}, "permission": "REPO_WRITE"},
+				{"user": {"name": "repo-reader", "slug": "repo-reader"}, "permission": "REPO_READ"}
+			]}`))
+			return
+		}
+		w.Write([]byte(`{"values": [
+			{"user": {"name": "project-admin", "slug": "project-admin"}, "permission": "PROJECT_ADMIN"}
+		]}`))
+	})
+
+	for _, tc := range []struct {
+		user    string
+		trusted bool
+	}{
+		{"repo-writer", true},
+		{"repo-reader", false},
+		{"project-admin", true},
+		{"unknown", false},
+	} {
+		trusted, err := bitbucket.NewProvider().IsTrusted(context.Background(), "TOKEN", repoURL, tc.user)
+		require.NoError(t, err)
+		assert.Equal(t, tc.trusted, trusted, "user %q", tc.user)
+	}
+}
+
+func TestDataCenter_GetFileContents(t *testing.T) {
+	repoURL := fakeDataCenter(t, func(w http.ResponseWriter, r *http.Request) {
+		user, password, _ := r.BasicAuth()
+		require.Equal(t, "user", user)
+		require.Equal(t, "app-password", password)
+		switch r.URL.Path {
+		case "/rest/api/1.0/projects/bb/repos/repo/raw/buildbuddy.yaml":
+			require.Equal(t, "abc123", r.URL.Query().Get("at"))
+			w.Write([]byte("actions: []\n"))
+		case "/rest/api/1.0/projects/bb/repos/repo":
+			w.Write([]byte(`{"slug": "repo"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	provider := bitbucket.NewProvider()
+
+	b, err := provider.GetFileContents(context.Background(), "user:app-password", repoURL, "buildbuddy.yaml", "abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "actions: []\n", string(b))
+
+	_, err = provider.GetFileContents(context.Background(), "user:app-password", repoURL, "missing.yaml", "abc123")
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
@@ -0,0 +1,308 @@
+package bitbucket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+var (
+	// Bitbucket Data Center event names to listen for on the webhook.
+	dataCenterEventsToReceive = []string{"repo:refs_changed", "pr:opened", "pr:from_ref_updated", "pr:modified", "pr:reviewer:approved"}
+)
+
+func parseDataCenterPushEvent(r *http.Request) (*interfaces.WebhookData, error) {
+	payload := &DataCenterPushEventPayload{}
+	if err := unmarshalBody(r, payload); err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
+	}
+	if len(payload.Changes) == 0 {
+		return nil, nil
+	}
+	v, err := fieldgetter.ExtractValues(
+		payload,
+		"Changes.0.Ref.DisplayID",
+		"Changes.0.Ref.Type",
+		"Changes.0.ToHash",
+		"Changes.0.Type",
+		"Repository.Public",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if t := v["Changes.0.Ref.Type"]; t != "BRANCH" {
+		log.Debugf("Ignoring non-branch push event (type %q)", t)
+		return nil, nil
+	}
+	if v["Changes.0.Type"] == "DELETE" {
+		return nil, nil
+	}
+	repoURL, err := payload.Repository.cloneURL()
+	if err != nil {
+		return nil, err
+	}
+	branch := v["Changes.0.Ref.DisplayID"]
+	return &interfaces.WebhookData{
+		EventName:          webhook_data.EventName.Push,
+		PushedRepoURL:      repoURL,
+		PushedBranch:       branch,
+		TargetRepoURL:      repoURL,
+		TargetBranch:       branch,
+		SHA:                v["Changes.0.ToHash"],
+		IsTargetRepoPublic: v["Repository.Public"] == "true",
+	}, nil
+}
+
+func parseDataCenterPullRequestEvent(r *http.Request, eventName string) (*interfaces.WebhookData, error) {
+	payload := &DataCenterPullRequestEventPayload{}
+	if err := unmarshalBody(r, payload); err != nil {
+		return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+	}
+	// "pr:modified" is sent for title and description changes too. Only run
+	// workflows if the target branch changed, to accommodate stacked changes.
+	if eventName == "pr:modified" && payload.PreviousTarget == nil {
+		return nil, nil
+	}
+	v, err := fieldgetter.ExtractValues(
+		payload,
+		"PullRequest.ID",
+		"PullRequest.Author.User.Name",
+		"PullRequest.FromRef.DisplayID",
+		"PullRequest.FromRef.LatestCommit",
+		"PullRequest.ToRef.DisplayID",
+		"PullRequest.ToRef.Repository.Public",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if payload.PullRequest.FromRef.Repository == nil || payload.PullRequest.ToRef.Repository == nil {
+		return nil, status.InvalidArgumentErrorf("missing pull request repository in %q event payload", eventName)
+	}
+	pushedRepoURL, err := payload.PullRequest.FromRef.Repository.cloneURL()
+	if err != nil {
+		return nil, err
+	}
+	targetRepoURL, err := payload.PullRequest.ToRef.Repository.cloneURL()
+	if err != nil {
+		return nil, err
+	}
+	wd := &interfaces.WebhookData{
+		EventName:          webhook_data.EventName.PullRequest,
+		PushedRepoURL:      pushedRepoURL,
+		PushedBranch:       v["PullRequest.FromRef.DisplayID"],
+		SHA:                v["PullRequest.FromRef.LatestCommit"],
+		TargetRepoURL:      targetRepoURL,
+		TargetBranch:       v["PullRequest.ToRef.DisplayID"],
+		IsTargetRepoPublic: v["PullRequest.ToRef.Repository.Public"] == "true",
+		PullRequestNumber:  payload.PullRequest.ID,
+		PullRequestAuthor:  v["PullRequest.Author.User.Name"],
+	}
+	if eventName == "pr:reviewer:approved" {
+		approver, err := fieldgetter.ExtractValues(payload, "Participant.User.Name")
+		if err != nil {
+			return nil, err
+		}
+		wd.PullRequestApprover = approver["Participant.User.Name"]
+	}
+	return wd, nil
+}
+
+type dataCenterRepoAPI struct {
+	c *apiClient
+	// projectURL is the API URL of the repo's project, e.g.
+	// "https://bitbucket.example.com/rest/api/1.0/projects/PROJ".
+	projectURL string
+	// repoURL is the API URL of the repo, e.g.
+	// "https://bitbucket.example.com/rest/api/1.0/projects/PROJ/repos/repo".
+	repoURL string
+}
+
+// newDataCenterRepoAPI returns the API for a Data Center repo given either its
+// clone URL ("https://host/scm/PROJ/repo") or its browse URL
+// ("https://host/projects/PROJ/repos/repo").
+func newDataCenterRepoAPI(c *apiClient, u *url.URL) (*dataCenterRepoAPI, error) {
+	parts := strings.Split(strings.TrimPrefix(u.Path, "/"), "/")
+	var project, repo string
+	if len(parts) == 3 && parts[0] == "scm" {
+		project, repo = parts[1], parts[2]
+	} else if len(parts) >= 4 && parts[0] == "projects" && parts[2] == "repos" {
+		project, repo = parts[1], parts[3]
+	} else {
+		return nil, status.InvalidArgumentErrorf("Invalid Bitbucket Data Center repo path %q", u.Path)
+	}
+	projectURL := fmt.Sprintf("%s://%s/rest/api/1.0/projects/%s", u.Scheme, u.Host, url.PathEscape(project))
+	return &dataCenterRepoAPI{
+		c:          c,
+		projectURL: projectURL,
+		repoURL:    projectURL + "/repos/" + url.PathEscape(repo),
+	}, nil
+}
+
+func (a *dataCenterRepoAPI) getRepo(ctx context.Context) error {
+	_, err := a.c.do(ctx, http.MethodGet, a.repoURL, nil, nil)
+	return err
+}
+
+func (a *dataCenterRepoAPI) registerWebhook(ctx context.Context, webhookURL, secret string) (string, error) {
+	req := map[string]any{
+		"name":   webhookName,
+		"url":    webhookURL,
+		"active": true,
+		"events": dataCenterEventsToReceive,
+		"configuration": map[string]any{
+			"secret": secret,
+		},
+	}
+	rsp := &struct {
+		ID int64 `json:"id"`
+	}{}
+	if _, err := a.c.do(ctx, http.MethodPost, a.repoURL+"/webhooks", req, rsp); err != nil {
+		return "", err
+	}
+	if rsp.ID == 0 {
+		return "", status.UnknownError("Bitbucket returned invalid response from webhooks API (missing id field).")
+	}
+	return strconv.FormatInt(rsp.ID, 10), nil
+}
+
+func (a *dataCenterRepoAPI) unregisterWebhook(ctx context.Context, webhookID string) error {
+	if _, err := strconv.ParseInt(webhookID, 10, 64); err != nil {
+		return status.InvalidArgumentErrorf("invalid Bitbucket webhook ID %q", webhookID)
+	}
+	_, err := a.c.do(ctx, http.MethodDelete, a.repoURL+"/webhooks/"+webhookID, nil, nil)
+	return err
+}
+
+func (a *dataCenterRepoAPI) getFileContents(ctx context.Context, filePath, ref string) ([]byte, error) {
+	return a.c.do(ctx, http.MethodGet, a.repoURL+"/raw/"+escapeFilePath(filePath)+"?at="+url.QueryEscape(ref), nil, nil)
+}
+
+func (a *dataCenterRepoAPI) isTrusted(ctx context.Context, user string) (bool, error) {
+	// Users may be granted access to the repo directly or through its
+	// project, so check both. Trusted workflows get cache write perms, so if
+	// the user doesn't have write perms for the repo then don't consider the
+	// workflow trusted.
+	for _, check := range []struct {
+		permissionsURL string
+		permissions    []string
+	}{
+		{a.repoURL + "/permissions/users", []string{"REPO_WRITE", "REPO_ADMIN"}},
+		{a.projectURL + "/permissions/users", []string{"PROJECT_WRITE", "PROJECT_ADMIN"}},
+	} {
+		rsp := &dataCenterUserPermissions{}
+		if _, err := a.c.do(ctx, http.MethodGet, check.permissionsURL+"?filter="+url.QueryEscape(user), nil, rsp); err != nil {
+			return false, status.WrapError(err, "list user permissions")
+		}
+		for _, p := range rsp.Values {
+			// The filter also matches partial names.
+			if p.User == nil || (p.User.Name != user && p.User.Slug != user) {
+				continue
+			}
+			if slices.Contains(check.permissions, p.Permission) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (a *dataCenterRepoAPI) createStatus(ctx context.Context, commitSHA string, s *buildStatus) error {
+	_, err := a.c.do(ctx, http.MethodPost, a.repoURL+"/commits/"+url.PathEscape(commitSHA)+"/builds", s, nil)
+	return err
+}
+
+type dataCenterUserPermissions struct {
+	Values []*struct {
+		User       *DataCenterUser `json:"user"`
+		Permission string          `json:"permission"`
+	} `json:"values"`
+}
+
+// DataCenterPushEventPayload represents a subset of Bitbucket Data Center's
+// push event schema.
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Push
+type DataCenterPushEventPayload struct {
+	Repository *DataCenterRepository `json:"repository"`
+	Changes    []*DataCenterChange   `json:"changes"`
+}
+type DataCenterChange struct {
+	Ref    *DataCenterRef `json:"ref"`
+	ToHash string         `json:"toHash"`
+	// Type is one of "ADD", "UPDATE", or "DELETE".
+	Type string `json:"type"`
+}
+type DataCenterRef struct {
+	DisplayID string `json:"displayId"`
+	// Type contains the type of ref.
+	// NOTE: We're only interested in "BRANCH".
+	Type string `json:"type"`
+}
+
+// DataCenterPullRequestEventPayload represents a subset of Bitbucket Data
+// Center's pull request event schema.
+// See https://confluence.atlassian.com/bitbucketserver/event-payload-938025882.html#Eventpayload-Pullrequest
+type DataCenterPullRequestEventPayload struct {
+	PullRequest *DataCenterPullRequest `json:"pullRequest"`
+	// PreviousTarget is only set for "pr:modified" events that changed the
+	// target branch.
+	PreviousTarget *DataCenterRef `json:"previousTarget"`
+	// Participant is only set for reviewer events.
+	Participant *DataCenterParticipant `json:"participant"`
+}
+type DataCenterPullRequest struct {
+	ID      int64                     `json:"id"`
+	Author  *DataCenterParticipant    `json:"author"`
+	FromRef *DataCenterPullRequestRef `json:"fromRef"`
+	ToRef   *DataCenterPullRequestRef `json:"toRef"`
+}
+type DataCenterPullRequestRef struct {
+	DisplayID    string                `json:"displayId"`
+	LatestCommit string                `json:"latestCommit"`
+	Repository   *DataCenterRepository `json:"repository"`
+}
+type DataCenterParticipant struct {
+	User *DataCenterUser `json:"user"`
+}
+type DataCenterUser struct {
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// DataCenterRepository represents a subset of Bitbucket Data Center's
+// repository schema, which is a common entity used in multiple webhook events.
+type DataCenterRepository struct {
+	Public bool                       `json:"public"`
+	Links  *DataCenterRepositoryLinks `json:"links"`
+}
+type DataCenterRepositoryLinks struct {
+	Clone []*DataCenterLink `json:"clone"`
+}
+type DataCenterLink struct {
+	Href string `json:"href"`
+	Name string `json:"name"`
+}
+
+// cloneURL returns the HTTP(S) clone URL of the repo.
+func (r *DataCenterRepository) cloneURL() (string, error) {
+	if r != nil && r.Links != nil {
+		for _, l := range r.Links.Clone {
+			if l.Name == "http" || l.Name == "https" {
+				// Clone links may include the username of the event actor.
+				return gitutil.StripRepoURLCredentials(l.Href), nil
+			}
+		}
+	}
+	return "", status.InvalidArgumentError("missing HTTP clone link for repository")
+}
@@ -7,3 +7,9 @@ var PushEvent []byte
 
 //go:embed pull_request_event.json
 var PullRequestEvent []byte
+
+//go:embed data_center_push_event.json
+var DataCenterPushEvent []byte
+
+//go:embed data_center_pull_request_event.json
+var DataCenterPullRequestEvent []byte
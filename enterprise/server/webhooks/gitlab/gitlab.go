@@ -0,0 +1,460 @@
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/fieldgetter"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	gitutil "github.com/buildbuddy-io/buildbuddy/server/util/git"
+)
+
+var (
+	selfManagedHosts = flag.Slice("gitlab.self_managed_hosts", []string{}, "Hosts of self-managed GitLab instances that BuildBuddy workflows can be used with, e.g. \"gitlab.example.com\". ** Enterprise only **")
+	webhookSecret    = flag.String("gitlab.webhook_secret", "", "Secret used to derive the token that GitLab sends with each webhook request. Required to register and receive GitLab webhooks. ** Enterprise only **", flag.Secret)
+)
+
+const (
+	cloudHost = "gitlab.com"
+
+	// The SHA that GitLab reports as the "after" SHA of a push that deletes a
+	// branch.
+	zeroSHA = "0000000000000000000000000000000000000000"
+
+	// Project visibility level reported in webhook payloads for public
+	// projects.
+	publicVisibilityLevel = "20"
+
+	// Minimum project access level required for a user to be considered
+	// trusted. 30 is the "Developer" role, which is the lowest role that can
+	// push to the repo.
+	// See https://docs.gitlab.com/ee/api/members.html#roles
+	developerAccessLevel = 30
+
+	// Timeout for requests to the GitLab API.
+	apiRequestTimeout = 30 * time.Second
+)
+
+type gitlabGitProvider struct {
+	client *http.Client
+}
+
+func NewProvider() interfaces.GitProvider {
+	return &gitlabGitProvider{
+		// Self-managed GitLab instances may be on private IPs, so this
+		// doesn't use httpclient.New(), which blocks them.
+		client: &http.Client{Timeout: apiRequestTimeout},
+	}
+}
+
+func (*gitlabGitProvider) MatchRepoURL(u *url.URL) bool {
+	return u.Host == cloudHost || slices.Contains(*selfManagedHosts, u.Host)
+}
+
+func (*gitlabGitProvider) MatchWebhookRequest(r *http.Request) bool {
+	return r.Header.Get("X-Gitlab-Event") != ""
+}
+
+func (*gitlabGitProvider) ParseWebhookData(r *http.Request) (*interfaces.WebhookData, error) {
+	if err := verifyWebhookToken(r); err != nil {
+		return nil, err
+	}
+	switch eventName := r.Header.Get("X-Gitlab-Event"); eventName {
+	case "Push Hook":
+		payload := &PushEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal push event payload: %s", err)
+		}
+		// Ignore tag pushes and branch deletions.
+		if !strings.HasPrefix(payload.Ref, "refs/heads/") || payload.After == zeroSHA {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"After",
+			"Ref",
+			"Project.GitHTTPURL",
+			"Project.DefaultBranch",
+			"Project.VisibilityLevel",
+		)
+		if err != nil {
+			return nil, err
+		}
+		branch := strings.TrimPrefix(v["Ref"], "refs/heads/")
+		return &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.Push,
+			PushedRepoURL:           v["Project.GitHTTPURL"],
+			PushedBranch:            branch,
+			SHA:                     v["After"],
+			TargetRepoURL:           v["Project.GitHTTPURL"],
+			TargetRepoDefaultBranch: v["Project.DefaultBranch"],
+			TargetBranch:            branch,
+			IsTargetRepoPublic:      v["Project.VisibilityLevel"] == publicVisibilityLevel,
+		}, nil
+	case "Merge Request Hook":
+		payload := &MergeRequestEventPayload{}
+		if err := unmarshalBody(r, payload); err != nil {
+			return nil, status.InvalidArgumentErrorf("failed to unmarshal %q event payload: %s", eventName, err)
+		}
+		if payload.ObjectAttributes == nil || !shouldRunForMergeRequestAction(payload) {
+			return nil, nil
+		}
+		v, err := fieldgetter.ExtractValues(
+			payload,
+			"ObjectAttributes.IID",
+			"ObjectAttributes.Source.GitHTTPURL",
+			"ObjectAttributes.SourceBranch",
+			"ObjectAttributes.LastCommit.ID",
+			"ObjectAttributes.Target.GitHTTPURL",
+			"ObjectAttributes.Target.DefaultBranch",
+			"ObjectAttributes.Target.VisibilityLevel",
+			"ObjectAttributes.TargetBranch",
+			"User.Username",
+		)
+		if err != nil {
+			return nil, err
+		}
+		mrNumber, err := strconv.ParseInt(v["ObjectAttributes.IID"], 10, 64)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid merge request IID %q", v["ObjectAttributes.IID"])
+		}
+		return &interfaces.WebhookData{
+			EventName:               webhook_data.EventName.PullRequest,
+			PushedRepoURL:           v["ObjectAttributes.Source.GitHTTPURL"],
+			PushedBranch:            v["ObjectAttributes.SourceBranch"],
+			SHA:                     v["ObjectAttributes.LastCommit.ID"],
+			TargetRepoURL:           v["ObjectAttributes.Target.GitHTTPURL"],
+			TargetRepoDefaultBranch: v["ObjectAttributes.Target.DefaultBranch"],
+			IsTargetRepoPublic:      v["ObjectAttributes.Target.VisibilityLevel"] == publicVisibilityLevel,
+			TargetBranch:            v["ObjectAttributes.TargetBranch"],
+			PullRequestNumber:       mrNumber,
+			// GitLab only reports the user who triggered the event, which for
+			// the actions we handle is the user who opened the MR or pushed
+			// new commits to it.
+			PullRequestAuthor: v["User.Username"],
+		}, nil
+	default:
+		log.Debugf("Ignoring GitLab webhook event: %s", eventName)
+		return nil, nil
+	}
+}
+
+// webhookToken returns the secret token that GitLab should send in the
+// X-Gitlab-Token header of requests to the webhook with the given URL path.
+// The token is derived from the path so that each webhook gets its own token
+// and no per-webhook state needs to be stored.
+func webhookToken(webhookPath string) (string, error) {
+	if *webhookSecret == "" {
+		return "", status.FailedPreconditionError("gitlab.webhook_secret is not configured")
+	}
+	mac := hmac.New(sha256.New, []byte(*webhookSecret))
+	mac.Write([]byte(webhookPath))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyWebhookToken returns an error unless the request has the token that
+// was registered for the webhook it was sent to.
+func verifyWebhookToken(r *http.Request) error {
+	want, err := webhookToken(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	got := r.Header.Get("X-Gitlab-Token")
+	if !hmac.Equal([]byte(got), []byte(want)) {
+		return status.PermissionDeniedError("invalid X-Gitlab-Token")
+	}
+	return nil
+}
+
+// shouldRunForMergeRequestAction returns whether workflows should run for the
+// merge request event. Like GitHub PRs, workflows run when the MR is opened,
+// reopened, pushed to, or when its target branch changes.
+func shouldRunForMergeRequestAction(payload *MergeRequestEventPayload) bool {
+	switch payload.ObjectAttributes.Action {
+	case "open", "reopen":
+		return true
+	case "update":
+		// "update" is also sent for title, label, and assignee changes etc.
+		// "oldrev" is only set if new commits were pushed.
+		_, targetBranchChanged := payload.Changes["target_branch"]
+		return payload.ObjectAttributes.OldRev != "" || targetBranchChanged
+	default:
+		return false
+	}
+}
+
+// RegisterWebhook registers the given webhook to the project and returns the
+// ID of the registered webhook.
+func (g *gitlabGitProvider) RegisterWebhook(ctx context.Context, accessToken, repoURL, webhookURL string) (string, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "", status.InvalidArgumentErrorf("invalid webhook URL %q: %s", webhookURL, err)
+	}
+	token, err := webhookToken(u.Path)
+	if err != nil {
+		return "", err
+	}
+	req := &hookRequest{
+		URL:                 webhookURL,
+		Token:               token,
+		PushEvents:          true,
+		MergeRequestsEvents: true,
+	}
+	hook := &hookResponse{}
+	if _, err := g.do(ctx, accessToken, http.MethodPost, repoURL, "/hooks", req, hook); err != nil {
+		return "", err
+	}
+	if hook.ID == 0 {
+		return "", status.UnknownError("GitLab returned invalid response from hooks API (missing ID field).")
+	}
+	return strconv.FormatInt(hook.ID, 10), nil
+}
+
+// UnregisterWebhook removes the webhook from the project.
+func (g *gitlabGitProvider) UnregisterWebhook(ctx context.Context, accessToken, repoURL, webhookID string) error {
+	if _, err := strconv.ParseInt(webhookID, 10, 64); err != nil {
+		return status.InvalidArgumentErrorf("invalid GitLab webhook ID %q", webhookID)
+	}
+	_, err := g.do(ctx, accessToken, http.MethodDelete, repoURL, "/hooks/"+webhookID, nil, nil)
+	return err
+}
+
+func (g *gitlabGitProvider) GetFileContents(ctx context.Context, accessToken, repoURL, filePath, ref string) ([]byte, error) {
+	path := "/repository/files/" + url.PathEscape(filePath) + "/raw?ref=" + url.QueryEscape(ref)
+	b, err := g.do(ctx, accessToken, http.MethodGet, repoURL, path, nil, nil)
+	if status.IsNotFoundError(err) {
+		// GitLab also returns 404 if the project doesn't exist or if it's not
+		// accessible with the token. Check whether the project exists so that
+		// we can abort the workflow if it doesn't, rather than using the
+		// default config.
+		if _, err := g.do(ctx, accessToken, http.MethodGet, repoURL, "", nil, nil); status.IsNotFoundError(err) {
+			return nil, status.FailedPreconditionErrorf("repository %q not found or inaccessible to this token", repoURL)
+		} else if err != nil {
+			return nil, status.UnavailableErrorf("get repository %q: %s", repoURL, err)
+		}
+		return nil, status.NotFoundErrorf("%s: not found in %s", filePath, repoURL)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (g *gitlabGitProvider) IsTrusted(ctx context.Context, accessToken, repoURL, user string) (bool, error) {
+	// members/all includes members inherited from parent groups.
+	var members []*projectMember
+	if _, err := g.do(ctx, accessToken, http.MethodGet, repoURL, "/members/all?query="+url.QueryEscape(user), nil, &members); err != nil {
+		return false, status.WrapError(err, "list project members")
+	}
+	for _, m := range members {
+		// The query also matches partial usernames and names.
+		if m.Username != user {
+			continue
+		}
+		// Trusted workflows get cache write perms, so if the user can't push
+		// to the repo then don't consider the workflow trusted.
+		return m.AccessLevel >= developerAccessLevel, nil
+	}
+	return false, nil
+}
+
+// CreateStatus publishes a commit status to the project. It accepts the same
+// payload type as the GitHub provider so that callers don't need to special
+// case GitLab repos.
+func (g *gitlabGitProvider) CreateStatus(ctx context.Context, accessToken, repoURL, commitSHA string, payload any) error {
+	s, ok := payload.(*gh_backend.GithubStatusPayload)
+	if !ok {
+		return status.InvalidArgumentErrorf("invalid GitLab status payload type %T (expected %T)", payload, &gh_backend.GithubStatusPayload{})
+	}
+	req := &commitStatusRequest{
+		State:       commitState(gh_backend.State(s.GetState())),
+		Name:        s.GetContext(),
+		TargetURL:   s.GetTargetURL(),
+		Description: s.GetDescription(),
+	}
+	_, err := g.do(ctx, accessToken, http.MethodPost, repoURL, "/statuses/"+url.PathEscape(commitSHA), req, nil)
+	return err
+}
+
+// commitState converts a GitHub status state to the corresponding GitLab
+// commit status state.
+func commitState(state gh_backend.State) string {
+	switch state {
+	case gh_backend.PendingState:
+		return "pending"
+	case gh_backend.SuccessState:
+		return "success"
+	default:
+		// GitLab has no separate "error" state.
+		return "failed"
+	}
+}
+
+// do sends a request to the GitLab REST API for the project identified by
+// repoURL. path is relative to the project's API URL. If req is non-nil then
+// it is sent as the JSON request body, and if rsp is non-nil then the JSON
+// response body is unmarshaled into it. The raw response body is returned.
+func (g *gitlabGitProvider) do(ctx context.Context, accessToken, method, repoURL, path string, req, rsp any) ([]byte, error) {
+	projectURL, err := projectAPIURL(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, method, projectURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if accessToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	if req != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	httpRsp, err := g.client.Do(httpReq)
+	if err != nil {
+		return nil, status.UnavailableErrorf("%s %s: %s", method, httpReq.URL.Path, err)
+	}
+	defer httpRsp.Body.Close()
+	b, err := io.ReadAll(httpRsp.Body)
+	if err != nil {
+		return nil, status.UnavailableErrorf("read GitLab response: %s", err)
+	}
+	if httpRsp.StatusCode < 200 || httpRsp.StatusCode >= 300 {
+		return nil, gitLabErrorToStatus(httpRsp.StatusCode, b)
+	}
+	if rsp != nil {
+		if err := json.Unmarshal(b, rsp); err != nil {
+			return nil, status.UnknownErrorf("unmarshal GitLab response: %s", err)
+		}
+	}
+	return b, nil
+}
+
+func gitLabErrorToStatus(code int, body []byte) error {
+	msg := fmt.Sprintf("GitLab API returned HTTP %d: %s", code, strings.TrimSpace(string(body)))
+	switch code {
+	case http.StatusNotFound:
+		return status.NotFoundError(msg)
+	case http.StatusUnauthorized:
+		return status.UnauthenticatedError(msg)
+	case http.StatusForbidden:
+		return status.PermissionDeniedError(msg)
+	case http.StatusTooManyRequests:
+		return status.ResourceExhaustedError(msg)
+	default:
+		return status.InternalError(msg)
+	}
+}
+
+// projectAPIURL returns the REST API URL for the project identified by
+// repoURL, e.g. "https://gitlab.com/api/v4/projects/group%2Fsubgroup%2Frepo".
+// Projects may be nested in subgroups, so the project ID is the full
+// URL-encoded path rather than just owner/repo.
+func projectAPIURL(repoURL string) (string, error) {
+	u, err := gitutil.NormalizeRepoURL(repoURL)
+	if err != nil {
+		return "", status.WrapError(err, "Failed to parse GitLab repo URL")
+	}
+	projectPath := strings.TrimPrefix(u.Path, "/")
+	if !strings.Contains(projectPath, "/") {
+		return "", status.InvalidArgumentErrorf("Invalid GitLab project path %q", projectPath)
+	}
+	return fmt.Sprintf("%s://%s/api/v4/projects/%s", u.Scheme, u.Host, url.PathEscape(projectPath)), nil
+}
+
+func unmarshalBody(r *http.Request, payload interface{}) error {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, payload)
+}
+
+type hookRequest struct {
+	URL                 string `json:"url"`
+	Token               string `json:"token"`
+	PushEvents          bool   `json:"push_events"`
+	MergeRequestsEvents bool   `json:"merge_requests_events"`
+}
+
+type hookResponse struct {
+	ID int64 `json:"id"`
+}
+
+type projectMember struct {
+	Username    string `json:"username"`
+	AccessLevel int    `json:"access_level"`
+}
+
+type commitStatusRequest struct {
+	State       string `json:"state"`
+	Name        string `json:"name,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// PushEventPayload represents a subset of GitLab's push event schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#push-events
+type PushEventPayload struct {
+	After   string   `json:"after"`
+	Ref     string   `json:"ref"`
+	Project *Project `json:"project"`
+}
+
+// MergeRequestEventPayload represents a subset of GitLab's merge request event
+// schema.
+// See https://docs.gitlab.com/ee/user/project/integrations/webhook_events.html#merge-request-events
+type MergeRequestEventPayload struct {
+	User             *User                       `json:"user"`
+	ObjectAttributes *MergeRequestAttributes     `json:"object_attributes"`
+	Changes          map[string]*json.RawMessage `json:"changes"`
+}
+type MergeRequestAttributes struct {
+	IID          int64    `json:"iid"`
+	Action       string   `json:"action"`
+	OldRev       string   `json:"oldrev"`
+	SourceBranch string   `json:"source_branch"`
+	TargetBranch string   `json:"target_branch"`
+	Source       *Project `json:"source"`
+	Target       *Project `json:"target"`
+	LastCommit   *Commit  `json:"last_commit"`
+}
+type User struct {
+	Username string `json:"username"`
+}
+type Commit struct {
+	ID string `json:"id"`
+}
+
+// Project represents a subset of GitLab's project schema, which is a common
+// entity used in multiple webhook events.
+type Project struct {
+	GitHTTPURL      string `json:"git_http_url"`
+	DefaultBranch   string `json:"default_branch"`
+	VisibilityLevel int    `json:"visibility_level"`
+}
@@ -0,0 +1,248 @@
+package gitlab_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/gitlab/test_data"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gh_backend "github.com/buildbuddy-io/buildbuddy/server/backends/github"
+)
+
+const webhookSecret = "test-secret"
+
+func webhookRequest(t *testing.T, eventType string, payload []byte) *http.Request {
+	flags.Set(t, "gitlab.webhook_secret", webhookSecret)
+	req, err := http.NewRequest("POST", "https://buildbuddy.io/webhooks/foo", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte(webhookSecret))
+	mac.Write([]byte("/webhooks/foo"))
+	req.Header.Add("X-Gitlab-Event", eventType)
+	req.Header.Add("X-Gitlab-Token", hex.EncodeToString(mac.Sum(nil)))
+	req.Header.Add("Content-Type", "application/json")
+	return req
+}
+
+// fakeGitLab starts a fake GitLab API server and returns the URL of a repo
+// hosted on it.
+func fakeGitLab(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	// Use localhost so that the repo URL isn't normalized to https.
+	return strings.Replace(server.URL, "127.0.0.1", "localhost", 1) + "/buildbuddy/sub/repo"
+}
+
+func TestParseRequest_ValidPushEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "push",
+		PushedRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		PushedBranch:            "main",
+		SHA:                     "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		TargetRepoDefaultBranch: "main",
+		TargetBranch:            "main",
+	}, data)
+}
+
+func TestParseRequest_ValidMergeRequestEvent_Success(t *testing.T) {
+	req := webhookRequest(t, "Merge Request Hook", test_data.MergeRequestEvent)
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Equal(t, &interfaces.WebhookData{
+		EventName:               "pull_request",
+		PushedRepoURL:           "https://gitlab.com/test2/buildbuddy-ci-playground.git",
+		PushedBranch:            "mr-1709058361",
+		SHA:                     "0f3a6b5c1d2e4f708192a3b4c5d6e7f809a1b2c3",
+		TargetRepoURL:           "https://gitlab.com/buildbuddy/buildbuddy-ci-playground.git",
+		TargetRepoDefaultBranch: "main",
+		IsTargetRepoPublic:      true,
+		TargetBranch:            "main",
+		PullRequestNumber:       3,
+		PullRequestAuthor:       "test2",
+	}, data)
+}
+
+func TestParseRequest_MergeRequestUpdateWithoutNewCommits_Ignored(t *testing.T) {
+	payload := strings.Replace(string(test_data.MergeRequestEvent), `"action": "open"`, `"action": "update"`, 1)
+	req := webhookRequest(t, "Merge Request Hook", []byte(payload))
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.NoError(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_InvalidEvent_Error(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", []byte{})
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.Error(t, err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_InvalidToken_Error(t *testing.T) {
+	for _, token := range []string{"", "wrong"} {
+		req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+		req.Header.Set("X-Gitlab-Token", token)
+
+		data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+		assert.True(t, status.IsPermissionDeniedError(err), "token %q: expected PermissionDenied, got %v", token, err)
+		assert.Nil(t, data)
+	}
+}
+
+func TestParseRequest_TokenForOtherWebhook_Error(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+	req.URL.Path = "/webhooks/bar"
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.True(t, status.IsPermissionDeniedError(err), "expected PermissionDenied, got %v", err)
+	assert.Nil(t, data)
+}
+
+func TestParseRequest_SecretNotConfigured_Error(t *testing.T) {
+	req := webhookRequest(t, "Push Hook", test_data.PushEvent)
+	flags.Set(t, "gitlab.webhook_secret", "")
+
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+
+	assert.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+	assert.Nil(t, data)
+}
+
+func TestRegisterWebhook_TokenAcceptedByParse(t *testing.T) {
+	flags.Set(t, "gitlab.webhook_secret", webhookSecret)
+	var hook map[string]any
+	repoURL := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewDecoder(r.Body).Decode(&hook)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42}`))
+	})
+	webhookURL := "https://app.buildbuddy.io/webhooks/workflow/abc"
+
+	id, err := gitlab.NewProvider().RegisterWebhook(context.Background(), "TOKEN", repoURL, webhookURL)
+
+	require.NoError(t, err)
+	assert.Equal(t, "42", id)
+	assert.Equal(t, webhookURL, hook["url"])
+	token, ok := hook["token"].(string)
+	require.True(t, ok, "hook request should include a token")
+
+	// GitLab sends the registered token back with each webhook request.
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(test_data.PushEvent))
+	require.NoError(t, err)
+	req.Header.Add("X-Gitlab-Event", "Push Hook")
+	req.Header.Add("X-Gitlab-Token", token)
+	data, err := gitlab.NewProvider().ParseWebhookData(req)
+	require.NoError(t, err)
+	assert.Equal(t, "da1560886d4f094c3e6c9ef40349f7d38b5d27d7", data.SHA)
+}
+
+func TestMatchRepoURL(t *testing.T) {
+	flags.Set(t, "gitlab.self_managed_hosts", []string{"gitlab.example.com"})
+	for _, tc := range []struct {
+		url   string
+		match bool
+	}{
+		{"https://gitlab.com/buildbuddy/repo", true},
+		{"https://gitlab.example.com/buildbuddy/repo", true},
+		{"https://github.com/buildbuddy/repo", false},
+		{"https://gitlab.other.com/buildbuddy/repo", false},
+	} {
+		u, err := url.Parse(tc.url)
+		require.NoError(t, err)
+		assert.Equal(t, tc.match, gitlab.NewProvider().MatchRepoURL(u), "url %q", tc.url)
+	}
+}
+
+func TestCreateStatus(t *testing.T) {
+	var gotPath, gotAuth string
+	gotBody := map[string]string{}
+	repoURL := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		gotAuth = r.Header.Get("Authorization")
+		err := json.NewDecoder(r.Body).Decode(&gotBody)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	})
+	payload := gh_backend.NewGithubStatusPayload("Test", "https://app.buildbuddy.io/invocation/123", "Failed", gh_backend.ErrorState)
+
+	err := gitlab.NewProvider().CreateStatus(context.Background(), "TOKEN", repoURL, "abc123", payload)
+
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v4/projects/buildbuddy%2Fsub%2Frepo/statuses/abc123", gotPath)
+	assert.Equal(t, "Bearer TOKEN", gotAuth)
+	assert.Equal(t, map[string]string{
+		"state":       "failed",
+		"name":        "Test",
+		"target_url":  "https://app.buildbuddy.io/invocation/123",
+		"description": "Failed",
+	}, gotBody)
+}
+
+func TestIsTrusted(t *testing.T) {
+	repoURL := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"username": "developer", "access_level": 30},
+			{"username": "guest", "access_level": 10},
+			{"username": "reporter", "access_level": 20}
+		]`))
+	})
+
+	for _, tc := range []struct {
+		user    string
+		trusted bool
+	}{
+		{"developer", true},
+		{"guest", false},
+		{"reporter", false},
+		{"unknown", false},
+	} {
+		trusted, err := gitlab.NewProvider().IsTrusted(context.Background(), "TOKEN", repoURL, tc.user)
+		require.NoError(t, err)
+		assert.Equal(t, tc.trusted, trusted, "user %q", tc.user)
+	}
+}
+
+func TestGetFileContents_NotFound(t *testing.T) {
+	repoURL := fakeGitLab(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/repository/files/") {
+			http.Error(w, `{"message":"404 File Not Found"}`, http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id": 15}`))
+	})
+
+	_, err := gitlab.NewProvider().GetFileContents(context.Background(), "TOKEN", repoURL, "buildbuddy.yaml", "main")
+
+	assert.True(t, status.IsNotFoundError(err), "expected NotFound, got %v", err)
+}
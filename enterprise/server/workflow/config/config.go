@@ -3,14 +3,18 @@ package config
 import (
 	"fmt"
 	"io"
+	"maps"
 	"net/url"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/enterprise/server/webhooks/webhook_data"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"gopkg.in/yaml.v2"
 
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
@@ -34,6 +38,10 @@ const (
 	CSIncrementalUpdateName = "Codesearch Incremental Update"
 )
 
+// matrixRefRegexp matches references to matrix values, like
+// "${{ matrix.os }}".
+var matrixRefRegexp = regexp.MustCompile(`\$\{\{\s*matrix\.([A-Za-z0-9_-]+)\s*\}\}`)
+
 type BuildBuddyConfig struct {
 	Actions []*Action `yaml:"actions"`
 }
@@ -58,8 +66,21 @@ type Action struct {
 	Steps              []*rnpb.Step      `yaml:"steps"`
 	Timeout            *time.Duration    `yaml:"timeout"`
 
+	// Matrix maps variable names to lists of values. An action with a matrix
+	// is expanded into one action per combination of values when the config
+	// is parsed, and the values can be referenced as "${{ matrix.<name> }}".
+	Matrix map[string][]string `yaml:"matrix,omitempty"`
+	// Needs lists the names of actions that must succeed before this action
+	// is started. Naming an action with a matrix refers to all of its
+	// expanded actions.
+	Needs []string `yaml:"needs,omitempty"`
+
 	// DEPRECATED: Used `Steps` instead
 	DeprecatedBazelCommands []string `yaml:"bazel_commands"`
+
+	// matrixName is the name of the action with a matrix that this action was
+	// expanded from, if any.
+	matrixName string
 }
 
 type Step struct {
@@ -73,6 +94,12 @@ func (a *Action) GetTriggers() *Triggers {
 	return a.Triggers
 }
 
+// MatchesName returns whether the action has the given name, or was expanded
+// from an action with a matrix that has the given name.
+func (a *Action) MatchesName(name string) bool {
+	return a.Name == name || (a.matrixName != "" && a.matrixName == name)
+}
+
 func (a *Action) GetGitFetchFilters() []string {
 	if a.GitFetchFilters == nil {
 		// Default to blob:none if unspecified.
@@ -175,9 +202,168 @@ func NewConfig(r io.Reader) (*BuildBuddyConfig, error) {
 	if err := yaml.Unmarshal(byt, cfg); err != nil {
 		return nil, err
 	}
+	actions, err := expandMatrices(cfg.Actions)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Actions = actions
+	if err := validateNeeds(cfg.Actions); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
+// expandMatrices replaces each action that has a matrix with one action per
+// combination of matrix values.
+func expandMatrices(actions []*Action) ([]*Action, error) {
+	var expanded []*Action
+	for _, a := range actions {
+		if len(a.Matrix) == 0 {
+			expanded = append(expanded, a)
+			continue
+		}
+		keys := slices.Sorted(maps.Keys(a.Matrix))
+		combinations := []map[string]string{{}}
+		for _, k := range keys {
+			if len(a.Matrix[k]) == 0 {
+				return nil, status.InvalidArgumentErrorf("action %q: matrix variable %q has no values", a.Name, k)
+			}
+			var next []map[string]string
+			for _, c := range combinations {
+				for _, v := range a.Matrix[k] {
+					nc := maps.Clone(c)
+					nc[k] = v
+					next = append(next, nc)
+				}
+			}
+			combinations = next
+		}
+		for _, values := range combinations {
+			ea, err := expandAction(a, keys, values)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, ea)
+		}
+	}
+	return expanded, nil
+}
+
+// expandAction returns a copy of the action with all matrix references
+// replaced by the given values.
+func expandAction(a *Action, keys []string, values map[string]string) (*Action, error) {
+	var err error
+	expand := func(s string) string {
+		return matrixRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+			k := matrixRefRegexp.FindStringSubmatch(ref)[1]
+			v, ok := values[k]
+			if !ok && err == nil {
+				err = status.InvalidArgumentErrorf("action %q: unknown matrix variable %q", a.Name, k)
+			}
+			return v
+		})
+	}
+
+	ea := *a
+	ea.Matrix = nil
+	ea.matrixName = a.Name
+	if matrixRefRegexp.MatchString(a.Name) {
+		ea.Name = expand(a.Name)
+	} else {
+		// Make the name unique by listing the values, like GitHub Actions.
+		names := make([]string, 0, len(keys))
+		for _, k := range keys {
+			names = append(names, values[k])
+		}
+		ea.Name = fmt.Sprintf("%s (%s)", a.Name, strings.Join(names, ", "))
+	}
+	ea.OS = expand(a.OS)
+	ea.Arch = expand(a.Arch)
+	ea.Pool = expand(a.Pool)
+	ea.ContainerImage = expand(a.ContainerImage)
+	ea.User = expand(a.User)
+	ea.BazelWorkspaceDir = expand(a.BazelWorkspaceDir)
+	if a.Env != nil {
+		ea.Env = make(map[string]string, len(a.Env))
+		for k, v := range a.Env {
+			ea.Env[k] = expand(v)
+		}
+	}
+	if a.PlatformProperties != nil {
+		ea.PlatformProperties = make(map[string]string, len(a.PlatformProperties))
+		for k, v := range a.PlatformProperties {
+			ea.PlatformProperties[k] = expand(v)
+		}
+	}
+	ea.Steps = make([]*rnpb.Step, 0, len(a.Steps))
+	for _, step := range a.Steps {
+		ea.Steps = append(ea.Steps, &rnpb.Step{Run: expand(step.GetRun())})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ea, nil
+}
+
+// validateNeeds returns an error if any action needs an action that is not
+// in the config, or if the needs of the actions form a cycle.
+func validateNeeds(actions []*Action) error {
+	for _, a := range actions {
+		for _, name := range a.Needs {
+			if !slices.ContainsFunc(actions, func(b *Action) bool { return b != a && b.MatchesName(name) }) {
+				return status.InvalidArgumentErrorf("action %q needs unknown action %q", a.Name, name)
+			}
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*Action]int, len(actions))
+	var visit func(a *Action) error
+	visit = func(a *Action) error {
+		switch state[a] {
+		case visiting:
+			return status.InvalidArgumentErrorf("action %q transitively needs itself", a.Name)
+		case visited:
+			return nil
+		}
+		state[a] = visiting
+		for _, b := range NeededActions(a, actions) {
+			if err := visit(b); err != nil {
+				return err
+			}
+		}
+		state[a] = visited
+		return nil
+	}
+	for _, a := range actions {
+		if err := visit(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NeededActions returns the actions in the given list that must succeed
+// before the given action can be started.
+func NeededActions(action *Action, actions []*Action) []*Action {
+	var needed []*Action
+	for _, b := range actions {
+		if b == action {
+			continue
+		}
+		for _, name := range action.Needs {
+			if b.MatchesName(name) {
+				needed = append(needed, b)
+				break
+			}
+		}
+	}
+	return needed
+}
+
 const kytheDownloadURL = "https://storage.googleapis.com/buildbuddy-tools/archives/kythe-v0.0.76-buildbuddy.tar.gz"
 
 func checkoutKythe(dirName, downloadURL string) string {
@@ -386,7 +572,7 @@ func MatchesAnyTrigger(action *Action, event, branch string) bool {
 // given action names.
 func MatchesAnyActionName(action *Action, names []string) bool {
 	for _, name := range names {
-		if action.Name == name {
+		if action.MatchesName(name) {
 			return true
 		}
 	}
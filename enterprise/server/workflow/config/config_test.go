@@ -169,3 +169,120 @@ func TestCodeSearchAction(t *testing.T) {
 	assert.Contains(t, action.Steps[0].Run, apiURL.String())
 	assert.Contains(t, action.Steps[0].Run, ghURL)
 }
+
+func TestMatrix(t *testing.T) {
+	s := `
+actions:
+  - name: Test
+    os: "${{ matrix.os }}"
+    matrix:
+      os: [linux, darwin]
+      bazel: ["7.4.0", "8.0.0"]
+    env:
+      USE_BAZEL_VERSION: "${{ matrix.bazel }}"
+    steps:
+      - run: "bazel test //... --config=${{ matrix.os }}"
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	require.Len(t, cfg.Actions, 4)
+
+	var names []string
+	for _, a := range cfg.Actions {
+		names = append(names, a.Name)
+		assert.Nil(t, a.Matrix)
+		assert.True(t, a.MatchesName("Test"))
+		assert.True(t, config.MatchesAnyActionName(a, []string{"Test"}))
+	}
+	assert.Equal(t, []string{
+		"Test (7.4.0, linux)",
+		"Test (7.4.0, darwin)",
+		"Test (8.0.0, linux)",
+		"Test (8.0.0, darwin)",
+	}, names)
+
+	a := cfg.Actions[1]
+	assert.Equal(t, "darwin", a.OS)
+	assert.Equal(t, map[string]string{"USE_BAZEL_VERSION": "7.4.0"}, a.Env)
+	require.Len(t, a.Steps, 1)
+	assert.Equal(t, "bazel test //... --config=darwin", a.Steps[0].Run)
+}
+
+func TestMatrix_NameWithReference(t *testing.T) {
+	s := `
+actions:
+  - name: "Test on ${{ matrix.os }}"
+    matrix:
+      os: [linux, darwin]
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	require.Len(t, cfg.Actions, 2)
+	assert.Equal(t, "Test on linux", cfg.Actions[0].Name)
+	assert.Equal(t, "Test on darwin", cfg.Actions[1].Name)
+}
+
+func TestMatrix_UnknownVariable(t *testing.T) {
+	s := `
+actions:
+  - name: Test
+    matrix:
+      os: [linux]
+    steps:
+      - run: "echo ${{ matrix.arch }}"
+`
+	_, err := config.NewConfig(strings.NewReader(s))
+	require.ErrorContains(t, err, `unknown matrix variable "arch"`)
+}
+
+func TestNeeds(t *testing.T) {
+	s := `
+actions:
+  - name: Build
+    matrix:
+      os: [linux, darwin]
+  - name: Deploy
+    needs: [Build]
+  - name: Lint
+`
+	cfg, err := config.NewConfig(strings.NewReader(s))
+	require.NoError(t, err)
+	require.Len(t, cfg.Actions, 4)
+
+	deploy := cfg.Actions[2]
+	require.Equal(t, "Deploy", deploy.Name)
+	needed := config.NeededActions(deploy, cfg.Actions)
+	require.Len(t, needed, 2)
+	assert.Equal(t, "Build (linux)", needed[0].Name)
+	assert.Equal(t, "Build (darwin)", needed[1].Name)
+	assert.Empty(t, config.NeededActions(cfg.Actions[3], cfg.Actions))
+}
+
+func TestNeeds_Invalid(t *testing.T) {
+	for _, test := range []struct {
+		Name string
+		YAML string
+		Err  string
+	}{
+		{
+			Name: "UnknownAction",
+			YAML: `actions: [ { name: A, needs: [B] } ]`,
+			Err:  `action "A" needs unknown action "B"`,
+		},
+		{
+			Name: "Self",
+			YAML: `actions: [ { name: A, needs: [A] } ]`,
+			Err:  `action "A" needs unknown action "A"`,
+		},
+		{
+			Name: "Cycle",
+			YAML: `actions: [ { name: A, needs: [B] }, { name: B, needs: [A] } ]`,
+			Err:  "transitively needs itself",
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := config.NewConfig(strings.NewReader(test.YAML))
+			require.ErrorContains(t, err, test.Err)
+		})
+	}
+}
@@ -0,0 +1,593 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/remote_execution/operation"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/util/keystore"
+	"github.com/buildbuddy-io/buildbuddy/enterprise/server/workflow/config"
+	"github.com/buildbuddy-io/buildbuddy/server/backends/github"
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/tables"
+	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	guuid "github.com/google/uuid"
+	gstatus "google.golang.org/grpc/status"
+)
+
+// Action run states, stored in tables.WorkflowActionRun.State.
+const (
+	// The run is waiting for the runs it needs to succeed.
+	actionRunPending int32 = iota
+	// The run's execution was started, and other runs are waiting for its
+	// result.
+	actionRunStarted
+	// The run was started and, if other runs need it, its execution
+	// succeeded.
+	actionRunSucceeded
+	// The run failed to start, its execution failed, it was skipped because
+	// a run it needs failed, or we gave up waiting for the runs it needs.
+	actionRunFailed
+)
+
+const (
+	// How often to look for action runs that can make progress, in case
+	// another app stopped working on them.
+	actionRunPollInterval = 15 * time.Second
+
+	// How long an app may work on an action run before another app may take
+	// it over. Leases are renewed while waiting for an execution to complete.
+	actionRunLeaseDuration = 1 * time.Minute
+
+	// How long to keep finished action runs around.
+	actionRunRetention = 2 * dependentActionMaxWait
+)
+
+// actionRun tracks a single run of a workflow action, so that the actions
+// that need it can be started once it succeeds.
+type actionRun struct {
+	action       *config.Action
+	invocationID string
+
+	// needs are the runs that must succeed before this run is started.
+	needs []*actionRun
+	// neededBy is the number of runs that need this run.
+	neededBy int
+}
+
+// actionRunRequest holds the parameters needed to start an action run from
+// any app. It is stored as JSON in tables.WorkflowActionRun.
+type actionRunRequest struct {
+	WebhookData *interfaces.WebhookData
+	IsTrusted   bool
+	// Env may contain secrets, so it is only stored encrypted, as
+	// EncryptedEnv.
+	Env               map[string]string `json:"-"`
+	EncryptedEnv      []byte            `json:",omitempty"`
+	ExtraCIRunnerArgs []string
+	ShouldRetry       bool
+}
+
+// newActionRuns returns a run for each of the given actions. Actions may only
+// need other actions in the list; needs on actions that were not triggered
+// are ignored.
+func newActionRuns(actions []*config.Action) ([]*actionRun, error) {
+	runs := make([]*actionRun, 0, len(actions))
+	runByAction := make(map[*config.Action]*actionRun, len(actions))
+	for _, action := range actions {
+		invocationUUID, err := guuid.NewRandom()
+		if err != nil {
+			return nil, status.InternalErrorf("failed to generate invocation ID: %s", err)
+		}
+		run := &actionRun{
+			action:       action,
+			invocationID: invocationUUID.String(),
+		}
+		runs = append(runs, run)
+		runByAction[action] = run
+	}
+	for _, run := range runs {
+		for _, needed := range config.NeededActions(run.action, actions) {
+			neededRun := runByAction[needed]
+			run.needs = append(run.needs, neededRun)
+			neededRun.neededBy++
+		}
+	}
+	return runs, nil
+}
+
+// startActionRuns calls start for each of the given runs that don't need
+// other runs, which starts the run's action and returns its execution ID.
+// These runs are started in parallel before this function returns.
+//
+// Runs that need other runs are stored in the DB along with the runs they
+// need, and are started by the action run poller of any app once all of the
+// runs they need have succeeded. They are reported as failed if any of those
+// runs fails.
+func (ws *workflowService) startActionRuns(ctx context.Context, wf *tables.Workflow, runs []*actionRun, req *actionRunRequest, start func(ctx context.Context, run *actionRun) (string, error)) error {
+	hasNeeds := slices.ContainsFunc(runs, func(run *actionRun) bool { return len(run.needs) > 0 })
+	if hasNeeds {
+		if err := ws.insertActionRuns(ctx, wf, runs, req); err != nil {
+			return err
+		}
+		for _, run := range runs {
+			if len(run.needs) == 0 {
+				continue
+			}
+			neededNames := make([]string, 0, len(run.needs))
+			for _, needed := range run.needs {
+				neededNames = append(neededNames, needed.action.Name)
+			}
+			description := fmt.Sprintf("Waiting for %s...", strings.Join(neededNames, ", "))
+			if err := ws.createActionStatus(ctx, wf, req.WebhookData, run.action.Name, run.invocationID, description, github.PendingState); err != nil {
+				log.CtxWarningf(ctx, "Failed to publish workflow action waiting status: %s", err)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, run := range runs {
+		if len(run.needs) > 0 {
+			continue
+		}
+		// Start executions in parallel to help reduce workflow start latency
+		// for repos with lots of workflow actions.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if run.neededBy == 0 {
+				start(ctx, run)
+				return
+			}
+			// Starting the execution may take longer than the lease that the
+			// run was inserted with, so keep renewing it until the start is
+			// recorded. Otherwise the poller could start the run again.
+			stopRenewing := ws.renewActionRunLease(ctx, run.invocationID)
+			executionID, err := start(ctx, run)
+			stopRenewing()
+			ws.recordActionRunStarted(ctx, run.invocationID, true /*=needed*/, executionID, err)
+		}()
+	}
+	wg.Wait()
+	if hasNeeds {
+		ws.notifyActionRunsChanged()
+	}
+	return nil
+}
+
+func (ws *workflowService) insertActionRuns(ctx context.Context, wf *tables.Workflow, runs []*actionRun, req *actionRunRequest) error {
+	serializedRequest, err := ws.serializeActionRunRequest(wf, req)
+	if err != nil {
+		return err
+	}
+	return ws.env.GetDBHandle().Transaction(ctx, func(tx interfaces.DB) error {
+		for _, run := range runs {
+			if len(run.needs) == 0 && run.neededBy == 0 {
+				continue
+			}
+			neededInvocationIDs := make([]string, 0, len(run.needs))
+			for _, needed := range run.needs {
+				neededInvocationIDs = append(neededInvocationIDs, needed.invocationID)
+			}
+			row := &tables.WorkflowActionRun{
+				InvocationID:        run.invocationID,
+				GroupID:             wf.GroupID,
+				WorkflowID:          wf.WorkflowID,
+				ActionName:          run.action.Name,
+				NeededInvocationIDs: strings.Join(neededInvocationIDs, ","),
+				Needed:              run.neededBy > 0,
+				State:               actionRunPending,
+				SerializedRequest:   serializedRequest,
+			}
+			if len(run.needs) == 0 {
+				// Started right away by startActionRuns; make sure the
+				// poller doesn't start it again in the meantime.
+				row.LeaseExpirationUsec = time.Now().Add(actionRunLeaseDuration).UnixMicro()
+			}
+			if err := tx.NewQuery(ctx, "workflow_service_insert_action_run").Create(row); err != nil {
+				return status.InternalErrorf("failed to insert workflow action run: %s", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (ws *workflowService) serializeActionRunRequest(wf *tables.Workflow, req *actionRunRequest) ([]byte, error) {
+	stored := *req
+	if len(req.Env) > 0 {
+		env, err := json.Marshal(req.Env)
+		if err != nil {
+			return nil, status.InternalErrorf("failed to serialize workflow action env: %s", err)
+		}
+		stored.EncryptedEnv, err = keystore.EncryptWithMasterKey(ws.env, env, []byte(wf.WorkflowID))
+		if err != nil {
+			return nil, status.WrapError(err, "encrypt workflow action env")
+		}
+	}
+	serializedRequest, err := json.Marshal(&stored)
+	if err != nil {
+		return nil, status.InternalErrorf("failed to serialize workflow action run: %s", err)
+	}
+	return serializedRequest, nil
+}
+
+// recordActionRunStarted records the result of starting the action of a run.
+// An empty execution ID means that the action requires approval, so it won't
+// run.
+func (ws *workflowService) recordActionRunStarted(ctx context.Context, invocationID string, needed bool, executionID string, err error) {
+	state := actionRunSucceeded
+	if err != nil || executionID == "" {
+		state = actionRunFailed
+	} else if needed {
+		state = actionRunStarted
+	}
+	if err := ws.updateActionRun(ctx, invocationID, state, executionID); err != nil {
+		log.CtxErrorf(ctx, "Failed to record start of workflow action run %s: %s", invocationID, err)
+	}
+}
+
+func (ws *workflowService) updateActionRun(ctx context.Context, invocationID string, state int32, executionID string) error {
+	// Don't let a cancelled request or shutdown lose the update.
+	ctx = context.WithoutCancel(ctx)
+	return ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_update_action_run").Raw(`
+		UPDATE "WorkflowActionRuns"
+		SET state = ?, execution_id = ?, lease_expiration_usec = 0, updated_at_usec = ?
+		WHERE invocation_id = ?`,
+		state, executionID, time.Now().UnixMicro(), invocationID,
+	).Exec().Error
+}
+
+// notifyActionRunsChanged wakes up the action run poller.
+func (ws *workflowService) notifyActionRunsChanged() {
+	select {
+	case ws.actionRunsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// startActionRunPoller starts the background loop that waits for started
+// action runs to complete and starts the runs that need them. It returns a
+// function that stops the loop.
+func (ws *workflowService) startActionRunPoller() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	ws.actionRunsWG.Add(1)
+	go func() {
+		defer ws.actionRunsWG.Done()
+		for {
+			ws.pollActionRuns(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ws.actionRunsChanged:
+			case <-time.After(actionRunPollInterval):
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		ws.actionRunsWG.Wait()
+	}
+}
+
+func (ws *workflowService) pollActionRuns(ctx context.Context) {
+	now := time.Now()
+	err := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_delete_finished_action_runs").Raw(`
+		DELETE FROM "WorkflowActionRuns"
+		WHERE state IN ? AND created_at_usec < ?`,
+		[]int32{actionRunSucceeded, actionRunFailed}, now.Add(-actionRunRetention).UnixMicro(),
+	).Exec().Error
+	if err != nil && ctx.Err() == nil {
+		log.CtxWarningf(ctx, "Failed to delete finished workflow action runs: %s", err)
+	}
+
+	rq := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_poll_action_runs").Raw(`
+		SELECT * FROM "WorkflowActionRuns"
+		WHERE state IN ? AND lease_expiration_usec < ?`,
+		[]int32{actionRunPending, actionRunStarted}, now.UnixMicro(),
+	)
+	runs, err := db.ScanAll(rq, &tables.WorkflowActionRun{})
+	if err != nil {
+		if ctx.Err() == nil {
+			log.CtxWarningf(ctx, "Failed to poll workflow action runs: %s", err)
+		}
+		return
+	}
+	for _, run := range runs {
+		if ctx.Err() != nil {
+			return
+		}
+		claimed, err := ws.claimActionRun(ctx, run.InvocationID)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to claim workflow action run %s: %s", run.InvocationID, err)
+			continue
+		}
+		if !claimed {
+			// Another app is working on it.
+			continue
+		}
+		ws.processActionRun(ctx, run)
+	}
+}
+
+// claimActionRun takes the lease on the given run, and returns whether it
+// was available.
+func (ws *workflowService) claimActionRun(ctx context.Context, invocationID string) (bool, error) {
+	now := time.Now()
+	result := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_claim_action_run").Raw(`
+		UPDATE "WorkflowActionRuns"
+		SET lease_expiration_usec = ?
+		WHERE invocation_id = ? AND lease_expiration_usec < ?`,
+		now.Add(actionRunLeaseDuration).UnixMicro(), invocationID, now.UnixMicro(),
+	).Exec()
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (ws *workflowService) releaseActionRun(ctx context.Context, invocationID string) {
+	err := ws.env.GetDBHandle().NewQuery(context.WithoutCancel(ctx), "workflow_service_release_action_run").Raw(`
+		UPDATE "WorkflowActionRuns"
+		SET lease_expiration_usec = 0
+		WHERE invocation_id = ?`,
+		invocationID,
+	).Exec().Error
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to release workflow action run %s: %s", invocationID, err)
+	}
+}
+
+// renewActionRunLease periodically extends the lease on the given run until
+// the returned function is called. The returned function may be called more
+// than once.
+func (ws *workflowService) renewActionRunLease(ctx context.Context, invocationID string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(actionRunLeaseDuration / 3):
+			}
+			err := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_renew_action_run").Raw(`
+				UPDATE "WorkflowActionRuns"
+				SET lease_expiration_usec = ?
+				WHERE invocation_id = ?`,
+				time.Now().Add(actionRunLeaseDuration).UnixMicro(), invocationID,
+			).Exec().Error
+			if err != nil && ctx.Err() == nil {
+				log.CtxWarningf(ctx, "Failed to renew lease on workflow action run %s: %s", invocationID, err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// processActionRun makes as much progress as possible on a claimed run.
+// Started runs are waited on, and pending runs are started once all of the
+// runs they need have succeeded. Work that may block is done in the
+// background, so that the poller can move on to other runs.
+func (ws *workflowService) processActionRun(ctx context.Context, run *tables.WorkflowActionRun) {
+	ctx = log.EnrichContext(ctx, log.InvocationIDKey, run.InvocationID)
+	if time.Since(time.UnixMicro(run.CreatedAtUsec)) > dependentActionMaxWait {
+		log.CtxWarningf(ctx, "Gave up on workflow action %q after %s", run.ActionName, dependentActionMaxWait)
+		if err := ws.updateActionRun(ctx, run.InvocationID, actionRunFailed, run.ExecutionID); err != nil {
+			log.CtxWarningf(ctx, "Failed to update workflow action run: %s", err)
+		}
+		ws.notifyActionRunsChanged()
+		return
+	}
+
+	// Action runs are processed outside of the request that triggered them
+	// (which for webhooks isn't authenticated anyway), so authenticate as
+	// the group that owns the workflow.
+	apiKey, err := ws.env.GetAuthDB().GetAPIKeyForInternalUseOnly(ctx, run.GroupID)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to get API key for workflow action run: %s", err)
+		ws.releaseActionRun(ctx, run.InvocationID)
+		return
+	}
+	authCtx := ws.env.GetAuthenticator().AuthContextFromAPIKey(ctx, apiKey.Value)
+
+	switch run.State {
+	case actionRunStarted:
+		ws.actionRunsWG.Add(1)
+		go func() {
+			defer ws.actionRunsWG.Done()
+			ws.waitForActionRun(authCtx, run)
+		}()
+	case actionRunPending:
+		ready, err := ws.checkNeededActionRuns(authCtx, run)
+		if err != nil {
+			log.CtxWarningf(ctx, "Failed to check actions needed by workflow action %q: %s", run.ActionName, err)
+		}
+		if !ready {
+			ws.releaseActionRun(ctx, run.InvocationID)
+			return
+		}
+		ws.actionRunsWG.Add(1)
+		go func() {
+			defer ws.actionRunsWG.Done()
+			ws.startPendingActionRun(authCtx, apiKey, run)
+		}()
+	}
+}
+
+// waitForActionRun waits for the execution of a started run to complete and
+// records whether it succeeded.
+func (ws *workflowService) waitForActionRun(ctx context.Context, run *tables.WorkflowActionRun) {
+	ctx = log.EnrichContext(ctx, log.ExecutionIDKey, run.ExecutionID)
+	stopRenewing := ws.renewActionRunLease(ctx, run.InvocationID)
+	succeeded, err := ws.waitForExecutionSuccess(ctx, run.ExecutionID)
+	stopRenewing()
+	if err != nil {
+		if ctx.Err() == nil {
+			log.CtxWarningf(ctx, "Failed to wait for workflow action %q: %s", run.ActionName, err)
+		}
+		// Try again later, possibly from another app.
+		ws.releaseActionRun(ctx, run.InvocationID)
+		return
+	}
+	state := actionRunFailed
+	if succeeded {
+		state = actionRunSucceeded
+	}
+	if err := ws.updateActionRun(ctx, run.InvocationID, state, run.ExecutionID); err != nil {
+		log.CtxWarningf(ctx, "Failed to record result of workflow action %q: %s", run.ActionName, err)
+	}
+	ws.notifyActionRunsChanged()
+}
+
+// checkNeededActionRuns returns whether all of the runs needed by the given
+// pending run have succeeded. If any of them failed, the run is marked as
+// failed and reported as skipped.
+func (ws *workflowService) checkNeededActionRuns(ctx context.Context, run *tables.WorkflowActionRun) (bool, error) {
+	if run.NeededInvocationIDs == "" {
+		// A run that others need, whose app went away before recording
+		// that it was started. Start it again.
+		return true, nil
+	}
+	neededInvocationIDs := strings.Split(run.NeededInvocationIDs, ",")
+	rq := ws.env.GetDBHandle().NewQuery(ctx, "workflow_service_get_needed_action_runs").Raw(`
+		SELECT * FROM "WorkflowActionRuns"
+		WHERE invocation_id IN ?`,
+		neededInvocationIDs,
+	)
+	neededRuns, err := db.ScanAll(rq, &tables.WorkflowActionRun{})
+	if err != nil {
+		return false, err
+	}
+	if len(neededRuns) != len(neededInvocationIDs) {
+		return false, status.NotFoundErrorf("found %d of the %d needed action runs", len(neededRuns), len(neededInvocationIDs))
+	}
+	for _, needed := range neededRuns {
+		if needed.State != actionRunFailed {
+			continue
+		}
+		log.CtxInfof(ctx, "Skipping workflow action %q since needed action %q did not succeed", run.ActionName, needed.ActionName)
+		if err := ws.updateActionRun(ctx, run.InvocationID, actionRunFailed, ""); err != nil {
+			return false, err
+		}
+		ws.notifyActionRunsChanged()
+		req, wf, err := ws.loadActionRunRequest(ctx, run)
+		if err != nil {
+			return false, err
+		}
+		description := fmt.Sprintf("Skipped: %s did not succeed", needed.ActionName)
+		if err := ws.createActionStatus(ctx, wf, req.WebhookData, run.ActionName, run.InvocationID, description, github.ErrorState); err != nil {
+			log.CtxWarningf(ctx, "Failed to publish workflow action skipped status: %s", err)
+		}
+		return false, nil
+	}
+	for _, needed := range neededRuns {
+		if needed.State != actionRunSucceeded {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (ws *workflowService) loadActionRunRequest(ctx context.Context, run *tables.WorkflowActionRun) (*actionRunRequest, *tables.Workflow, error) {
+	req := &actionRunRequest{}
+	if err := json.Unmarshal(run.SerializedRequest, req); err != nil {
+		return nil, nil, status.InternalErrorf("failed to parse workflow action run: %s", err)
+	}
+	if len(req.EncryptedEnv) > 0 {
+		env, err := keystore.DecryptWithMasterKey(ws.env, req.EncryptedEnv, []byte(run.WorkflowID))
+		if err != nil {
+			return nil, nil, status.WrapError(err, "decrypt workflow action env")
+		}
+		if err := json.Unmarshal(env, &req.Env); err != nil {
+			return nil, nil, status.InternalErrorf("failed to parse workflow action env: %s", err)
+		}
+	}
+	wf, err := ws.getWorkflowByID(ctx, run.WorkflowID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return req, wf, nil
+}
+
+// startPendingActionRun starts the action of a run whose needed runs have all
+// succeeded.
+func (ws *workflowService) startPendingActionRun(ctx context.Context, apiKey *tables.APIKey, run *tables.WorkflowActionRun) {
+	stopRenewing := ws.renewActionRunLease(ctx, run.InvocationID)
+	defer stopRenewing()
+	req, wf, err := ws.loadActionRunRequest(ctx, run)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to load workflow action run: %s", err)
+		stopRenewing()
+		ws.releaseActionRun(ctx, run.InvocationID)
+		return
+	}
+	// Re-read the config at the same commit to get the action.
+	actions, err := ws.getActions(ctx, wf, req.WebhookData, nil /*=actionFilter*/)
+	if err != nil {
+		log.CtxWarningf(ctx, "Failed to get workflow actions: %s", err)
+		stopRenewing()
+		ws.releaseActionRun(ctx, run.InvocationID)
+		return
+	}
+	var executionID string
+	i := slices.IndexFunc(actions, func(a *config.Action) bool { return a.Name == run.ActionName })
+	if i < 0 {
+		err = status.NotFoundErrorf("workflow action %q no longer exists", run.ActionName)
+	} else {
+		executionID, err = ws.executeWorkflowAction(ctx, apiKey, wf, req.WebhookData, req.IsTrusted, actions[i], run.InvocationID, req.ExtraCIRunnerArgs, req.Env, req.ShouldRetry)
+	}
+	if err != nil {
+		log.CtxErrorf(ctx, "Failed to execute workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, run.ActionName, err)
+	}
+	// Stop renewing before recording the result, which releases the lease.
+	stopRenewing()
+	ws.recordActionRunStarted(ctx, run.InvocationID, run.Needed, executionID, err)
+	ws.notifyActionRunsChanged()
+}
+
+// waitForExecutionSuccess waits for the execution to complete and returns
+// whether the CI runner exited successfully. The context must be
+// authenticated as the group that started the execution.
+func (ws *workflowService) waitForExecutionSuccess(ctx context.Context, executionID string) (bool, error) {
+	executionClient := ws.env.GetRemoteExecutionClient()
+	if executionClient == nil {
+		return false, status.UnimplementedError("Missing remote execution client.")
+	}
+	waitStream, err := executionClient.WaitExecution(ctx, &repb.WaitExecutionRequest{
+		Name: executionID,
+	})
+	if err != nil {
+		return false, err
+	}
+	for {
+		op, err := waitStream.Recv()
+		if err == io.EOF {
+			return false, status.UnavailableErrorf("execution %s stream ended before the execution completed", executionID)
+		}
+		if err != nil {
+			return false, err
+		}
+		if !op.GetDone() {
+			continue
+		}
+		rsp := operation.ExtractExecuteResponse(op)
+		if err := gstatus.ErrorProto(rsp.GetStatus()); err != nil {
+			return false, nil
+		}
+		return rsp.GetResult().GetExitCode() == 0, nil
+	}
+}
@@ -112,6 +112,10 @@ const (
 	// some extra time for the CI runner to finish publishing the "outer"
 	// workflow invocation results after the user-specified timeout is reached.
 	timeoutGracePeriod = 10 * time.Minute
+
+	// How long to wait for the actions needed by an action to complete before
+	// giving up on starting it.
+	dependentActionMaxWait = 24 * time.Hour
 )
 
 // getWebhookID returns a string that can be used to uniquely identify a webhook.
@@ -161,6 +165,10 @@ type workflowService struct {
 	wg    sync.WaitGroup
 	tasks chan *startWorkflowTask
 	bbUrl *url.URL
+
+	// actionRunsChanged wakes up the action run poller.
+	actionRunsChanged chan struct{}
+	actionRunsWG      sync.WaitGroup
 }
 
 func NewWorkflowService(env environment.Env) *workflowService {
@@ -168,12 +176,18 @@ func NewWorkflowService(env environment.Env) *workflowService {
 		env:   env,
 		tasks: make(chan *startWorkflowTask, webhookWorkerTaskQueueSize),
 		bbUrl: build_buddy_url.WithPath(""),
+
+		actionRunsChanged: make(chan struct{}, 1),
 	}
 	ws.startBackgroundWorkers()
 	return ws
 }
 
 func (ws *workflowService) startBackgroundWorkers() {
+	stopActionRunPoller := func() {}
+	if ws.env.GetDBHandle() != nil {
+		stopActionRunPoller = ws.startActionRunPoller()
+	}
 	for i := 0; i < webhookWorkerCount; i++ {
 		ws.wg.Add(1)
 		go func() {
@@ -196,6 +210,8 @@ func (ws *workflowService) startBackgroundWorkers() {
 		close(ws.tasks)
 		// Wait for all workers to exit.
 		ws.wg.Wait()
+		// Other apps take over any action runs that are still in progress.
+		stopActionRunPoller()
 		return nil
 	})
 }
@@ -443,62 +459,66 @@ func (ws *workflowService) ExecuteWorkflow(ctx context.Context, req *wfpb.Execut
 		return nil, err
 	}
 
-	wg := sync.WaitGroup{}
-	actionStatuses := make([]*wfpb.ExecuteWorkflowResponse_ActionStatus, 0, len(actions))
-	for _, action := range actions {
-		action := action
+	runs, err := newActionRuns(actions)
+	if err != nil {
+		return nil, err
+	}
+	actionStatuses := make([]*wfpb.ExecuteWorkflowResponse_ActionStatus, 0, len(runs))
+	statusByRun := make(map[*actionRun]*wfpb.ExecuteWorkflowResponse_ActionStatus, len(runs))
+	for _, run := range runs {
 		actionStatus := &wfpb.ExecuteWorkflowResponse_ActionStatus{
-			ActionName: action.Name,
+			ActionName: run.action.Name,
+		}
+		if len(run.needs) > 0 {
+			// Actions that need other actions are started in the background,
+			// so we can only report that they were scheduled.
+			actionStatus.InvocationId = run.invocationID
+			actionStatus.Status = gstatus.Convert(nil).Proto()
 		}
 		actionStatuses = append(actionStatuses, actionStatus)
-
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-
-			var invocationID string
-			var statusErr error
-			defer func() {
-				actionStatus.InvocationId = invocationID
-				actionStatus.Status = gstatus.Convert(statusErr).Proto()
-			}()
-
-			if action == nil {
-				statusErr = status.NotFoundErrorf("action %s not found", action.Name)
-				return
-			}
-
-			invocationUUID, err := guuid.NewRandom()
-			if err != nil {
-				statusErr = status.InternalErrorf("failed to generate invocation ID: %s", err)
-				log.CtxError(ctx, statusErr.Error())
-				return
-			}
-			invocationID = invocationUUID.String()
-			executionCtx := log.EnrichContext(ctx, log.InvocationIDKey, invocationID)
-
-			// The workflow execution is trusted since we're authenticated as a member of
-			// the BuildBuddy org that owns the workflow.
-			isTrusted := true
-			shouldRetry := !req.GetDisableRetry()
-			executionID, err := ws.executeWorkflowAction(executionCtx, apiKey, wf, wd, isTrusted, action, invocationID, extraCIRunnerArgs, req.GetEnv(), shouldRetry)
-			if err != nil {
-				statusErr = status.WrapErrorf(err, "failed to execute workflow action %q", action.Name)
-				log.CtxWarning(executionCtx, statusErr.Error())
-				return
-			}
-			executionCtx = log.EnrichContext(executionCtx, log.ExecutionIDKey, executionID)
-			if req.GetAsync() {
-				return
-			}
-			if err := ws.waitForWorkflowInvocationCreated(executionCtx, executionID, invocationID); err != nil {
-				statusErr = err
-				log.CtxWarning(executionCtx, statusErr.Error())
-				return
-			}
+		statusByRun[run] = actionStatus
+	}
+
+	runReq := &actionRunRequest{
+		WebhookData: wd,
+		// The workflow execution is trusted since we're authenticated as a
+		// member of the BuildBuddy org that owns the workflow.
+		IsTrusted:         true,
+		Env:               req.GetEnv(),
+		ExtraCIRunnerArgs: extraCIRunnerArgs,
+		ShouldRetry:       !req.GetDisableRetry(),
+	}
+	err = ws.startActionRuns(ctx, wf, runs, runReq, func(ctx context.Context, run *actionRun) (string, error) {
+		action := run.action
+		invocationID := run.invocationID
+		executionCtx := log.EnrichContext(ctx, log.InvocationIDKey, invocationID)
+
+		executionID, err := ws.executeWorkflowAction(executionCtx, apiKey, wf, wd, runReq.IsTrusted, action, invocationID, runReq.ExtraCIRunnerArgs, runReq.Env, runReq.ShouldRetry)
+
+		var statusErr error
+		defer func() {
+			actionStatus := statusByRun[run]
+			actionStatus.InvocationId = invocationID
+			actionStatus.Status = gstatus.Convert(statusErr).Proto()
 		}()
+		if err != nil {
+			statusErr = status.WrapErrorf(err, "failed to execute workflow action %q", action.Name)
+			log.CtxWarning(executionCtx, statusErr.Error())
+			return "", err
+		}
+		executionCtx = log.EnrichContext(executionCtx, log.ExecutionIDKey, executionID)
+		if req.GetAsync() {
+			return executionID, nil
+		}
+		if err := ws.waitForWorkflowInvocationCreated(executionCtx, executionID, invocationID); err != nil {
+			statusErr = err
+			log.CtxWarning(executionCtx, statusErr.Error())
+		}
+		return executionID, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	wg.Wait()
 
 	return &wfpb.ExecuteWorkflowResponse{
 		ActionStatuses: actionStatuses,
@@ -1406,30 +1426,25 @@ func (ws *workflowService) startWorkflow(ctx context.Context, gitProvider interf
 		return err
 	}
 
-	var wg sync.WaitGroup
-	for _, action := range actions {
-		action := action
-		invocationUUID, err := guuid.NewRandom()
+	runs, err := newActionRuns(actions)
+	if err != nil {
+		return err
+	}
+	runReq := &actionRunRequest{
+		WebhookData: wd,
+		IsTrusted:   isTrusted,
+		Env:         env,
+		// Webhook triggered workflows should always be retried, because they
+		// don't have a client to retry for them
+		ShouldRetry: true,
+	}
+	return ws.startActionRuns(ctx, wf, runs, runReq, func(ctx context.Context, run *actionRun) (string, error) {
+		executionID, err := ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, run.action, run.invocationID, nil /*=extraCIRunnerArgs*/, env, runReq.ShouldRetry)
 		if err != nil {
-			return err
+			log.CtxErrorf(ctx, "Failed to execute workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, run.action.Name, err)
 		}
-		invocationID := invocationUUID.String()
-
-		// Start executions in parallel to help reduce workflow start latency
-		// for repos with lots of workflow actions.
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			// Webhook triggered workflows should always be retried, because they
-			// don't have a client to retry for them
-			shouldRetry := true
-			if _, err := ws.executeWorkflowAction(ctx, apiKey, wf, wd, isTrusted, action, invocationID, nil /*=extraCIRunnerArgs*/, env, shouldRetry); err != nil {
-				log.CtxErrorf(ctx, "Failed to execute workflow %s (%s) action %q: %s", wf.WorkflowID, wf.RepoURL, action.Name, err)
-			}
-		}()
-	}
-	wg.Wait()
-	return nil
+		return executionID, err
+	})
 }
 
 // Starts a CI runner execution to execute a single workflow action, and returns the execution ID.
@@ -1522,21 +1537,24 @@ func (ws *workflowService) attemptExecuteWorkflowAction(ctx context.Context, key
 func (ws *workflowService) createApprovalRequiredStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionName string) error {
 	// TODO: Create a help section in the docs that explains this error status, and link to it
 	status := github.NewGithubStatusPayload(actionName, ws.bbUrl.String(), "Check requires approving review", github.ErrorState)
-	ownerRepo, err := gitutil.OwnerRepoFromRepoURL(wd.TargetRepoURL)
+	provider, err := ws.providerForRepo(wd.TargetRepoURL)
 	if err != nil {
 		return err
 	}
-	ghc := github.NewGithubClient(ws.env, wf.AccessToken)
-	return ghc.CreateStatus(ctx, ownerRepo, wd.SHA, status)
+	return provider.CreateStatus(ctx, wf.AccessToken, wd.TargetRepoURL, wd.SHA, status)
 }
 
 func (ws *workflowService) createQueuedStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionName, invocationID string) error {
+	return ws.createActionStatus(ctx, wf, wd, actionName, invocationID, "Queued...", github.PendingState)
+}
+
+func (ws *workflowService) createActionStatus(ctx context.Context, wf *tables.Workflow, wd *interfaces.WebhookData, actionName, invocationID, description string, state github.State) error {
 	invocationURL, err := ws.createBBURL(ctx, "/invocation/"+invocationID)
 	if err != nil {
 		return err
 	}
 	invocationURL += "?queued=true"
-	status := github.NewGithubStatusPayload(actionName, invocationURL, "Queued...", github.PendingState)
+	status := github.NewGithubStatusPayload(actionName, invocationURL, description, state)
 	statusReportingURL := getStatusReportingURL(wd)
 	provider, err := ws.providerForRepo(statusReportingURL)
 	if err != nil {
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
@@ -80,6 +82,7 @@ func newTestEnv(t *testing.T) *testenv.TestEnv {
 	te.SetGitHubAppService(gh)
 
 	execClient := NewFakeExecutionClient()
+	execClient.authenticator = te.GetAuthenticator()
 	te.SetRemoteExecutionClient(execClient)
 	t.Cleanup(func() {
 		// Shut down to make sure the workflow task queue is drained.
@@ -199,6 +202,11 @@ func envVars(cmd *repb.Command) map[string]string {
 type fakeExecutionClient struct {
 	repb.ExecutionClient
 	executeRequests chan *executeRequest
+	// exitCode is the exit code reported for all completed executions.
+	exitCode int32
+	// authenticator, if set, is used to check that WaitExecution calls are
+	// authenticated, like the real execution service does.
+	authenticator interfaces.Authenticator
 }
 
 type executeRequest struct {
@@ -218,7 +226,7 @@ func (c *fakeExecutionClient) Execute(ctx context.Context, req *repb.ExecuteRequ
 		Metadata: md,
 		Payload:  req,
 	}
-	return &fakeExecuteStream{}, nil
+	return &fakeExecuteStream{exitCode: c.exitCode}, nil
 }
 
 func (c *fakeExecutionClient) NextExecuteRequest() *executeRequest {
@@ -226,19 +234,38 @@ func (c *fakeExecutionClient) NextExecuteRequest() *executeRequest {
 }
 
 func (c *fakeExecutionClient) WaitExecution(ctx context.Context, req *repb.WaitExecutionRequest, opts ...grpc.CallOption) (repb.Execution_WaitExecutionClient, error) {
-	return &fakeExecuteStream{}, nil
+	if c.authenticator != nil {
+		if _, err := c.authenticator.AuthenticatedUser(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return &fakeExecuteStream{exitCode: c.exitCode}, nil
 }
 
-type fakeExecuteStream struct{ grpc.ClientStream }
+type fakeExecuteStream struct {
+	grpc.ClientStream
+	exitCode int32
+}
 
-func (*fakeExecuteStream) Recv() (*longrunning.Operation, error) {
+func (s *fakeExecuteStream) Recv() (*longrunning.Operation, error) {
 	metadata, err := anypb.New(&repb.ExecuteOperationMetadata{
 		Stage: repb.ExecutionStage_COMPLETED,
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &longrunning.Operation{Name: "fake-operation-name", Metadata: metadata}, nil
+	response, err := anypb.New(&repb.ExecuteResponse{
+		Result: &repb.ActionResult{ExitCode: s.exitCode},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &longrunning.Operation{
+		Name:     "fake-operation-name",
+		Metadata: metadata,
+		Done:     true,
+		Result:   &longrunning.Operation_Response{Response: response},
+	}, nil
 }
 
 func authenticate(t *testing.T, ctx context.Context, env environment.Env) (authCtx context.Context, uid, gid string) {
@@ -823,3 +850,116 @@ func TestAPIDispatch_ActionFiltering(t *testing.T) {
 		}
 	}
 }
+
+func actionName(t *testing.T, ctx context.Context, te *testenv.TestEnv, req *executeRequest) string {
+	exec := getExecution(t, ctx, te, req.Payload)
+	for _, arg := range exec.Command.GetArguments() {
+		if name, ok := strings.CutPrefix(arg, "--action_name="); ok {
+			return name
+		}
+	}
+	require.FailNow(t, "missing --action_name argument")
+	return ""
+}
+
+func TestWebhook_Needs(t *testing.T) {
+	for _, test := range []struct {
+		name            string
+		exitCode        int32
+		expectedActions []string
+	}{
+		{
+			name:            "needed actions succeed",
+			exitCode:        0,
+			expectedActions: []string{"Build (linux)", "Build (darwin)", "Lint", "Deploy"},
+		},
+		{
+			name:            "needed actions fail",
+			exitCode:        1,
+			expectedActions: []string{"Build (linux)", "Build (darwin)", "Lint"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			u, lis := testhttp.NewServer(t)
+			flags.Set(t, "app.build_buddy_url", *u)
+			flags.Set(t, "remote_execution.enable_remote_exec", true)
+			te := newTestEnv(t)
+			authCtx, _, gid := authenticate(t, ctx, te)
+			execClient := te.GetRemoteExecutionClient().(*fakeExecutionClient)
+			execClient.exitCode = test.exitCode
+			go http.Serve(lis, te.GetWorkflowService())
+			provider := setupFakeGitProvider(t, te)
+			repoURL := makeTempRepo(t)
+			repo := createWorkflow(t, te, repoURL, gid, false)
+			provider.WebhookData = &interfaces.WebhookData{
+				EventName:     "push",
+				TargetRepoURL: "https://github.com/acme-inc/acme",
+				TargetBranch:  "main",
+				PushedRepoURL: "https://github.com/acme-inc/acme",
+				PushedBranch:  "main",
+				SHA:           "c04d68571cb519e095772c865847007ed3e7fea9",
+			}
+			provider.FileContents = map[string]string{"buildbuddy.yaml": `
+actions:
+  - name: "Build"
+    matrix: { os: [linux, darwin] }
+    platform_properties: { "test-os": "${{ matrix.os }}" }
+    triggers: { push: { branches: [ "*" ] } }
+    steps: [ { run: "bazel build //..." } ]
+  - name: "Deploy"
+    needs: [ "Build" ]
+    triggers: { push: { branches: [ "*" ] } }
+    steps: [ { run: "bazel run //:deploy" } ]
+  - name: "Lint"
+    triggers: { push: { branches: [ "*" ] } }
+    steps: [ { run: "bazel run //:lint" } ]
+`}
+
+			// Webhook events aren't authenticated, so the dependent actions
+			// must be started using the workflow's API key.
+			err := te.GetWorkflowService().HandleRepositoryEvent(ctx, repo, provider.WebhookData, "faketoken")
+			require.NoError(t, err)
+
+			var startedActions []string
+			for range test.expectedActions {
+				startedActions = append(startedActions, actionName(t, authCtx, te, execClient.NextExecuteRequest()))
+			}
+			require.ElementsMatch(t, test.expectedActions, startedActions)
+			if test.exitCode == 0 {
+				// Deploy must only start after both builds have completed.
+				deployIndex := slices.Index(startedActions, "Deploy")
+				assert.Greater(t, deployIndex, slices.Index(startedActions, "Build (linux)"))
+				assert.Greater(t, deployIndex, slices.Index(startedActions, "Build (darwin)"))
+			}
+
+			// The runs involved in dependencies are stored in the DB so that
+			// any app can pick them up, and are released once processed.
+			var runs []*tables.WorkflowActionRun
+			require.Eventually(t, func() bool {
+				rq := te.GetDBHandle().NewQuery(ctx, "get_action_runs").Raw(`SELECT * FROM "WorkflowActionRuns"`)
+				rows, err := db.ScanAll(rq, &tables.WorkflowActionRun{})
+				if err != nil {
+					return false
+				}
+				runs = rows
+				// Deploy is updated once it's started or skipped, which only
+				// happens after both builds have finished.
+				for _, run := range runs {
+					if run.ActionName == "Deploy" {
+						return run.UpdatedAtUsec > run.CreatedAtUsec && run.LeaseExpirationUsec == 0
+					}
+				}
+				return false
+			}, 10*time.Second, 10*time.Millisecond)
+			var storedActions []string
+			for _, run := range runs {
+				storedActions = append(storedActions, run.ActionName)
+				if run.ActionName == "Deploy" {
+					assert.Equal(t, test.exitCode == 0, run.ExecutionID != "")
+				}
+			}
+			assert.ElementsMatch(t, []string{"Build (linux)", "Build (darwin)", "Deploy"}, storedActions)
+		})
+	}
+}
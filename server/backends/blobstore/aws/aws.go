@@ -213,6 +213,42 @@ func (a *AwsS3BlobStore) download(ctx context.Context, blobName string) ([]byte,
 	return buff.Bytes(), nil
 }
 
+func (a *AwsS3BlobStore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	out, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: a.bucket,
+		Key:    &blobName,
+	})
+	if err != nil {
+		var nsk *s3types.NoSuchKey
+		if errors.As(err, &nsk) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return util.NewDecompressReader(out.Body)
+}
+
+func (a *AwsS3BlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, modTime time.Time) error) error {
+	paginator := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
+		Bucket: a.bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, object := range page.Contents {
+			if err := fn(aws.ToString(object.Key), aws.ToTime(object.LastModified)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (a *AwsS3BlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
 	compressedData, err := util.Compress(data)
 	if err != nil {
@@ -122,6 +122,36 @@ func (z *AzureBlobStore) ReadBlob(ctx context.Context, blobName string) ([]byte,
 	return util.Decompress(b, err)
 }
 
+func (z *AzureBlobStore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	blobURL := z.containerURL.NewBlockBlobURL(blobName)
+	ctx, spn := tracing.StartSpan(ctx)
+	defer spn.End()
+	response, err := blobURL.Download(ctx, 0 /*=offset*/, azblob.CountToEnd, azblob.BlobAccessConditions{}, false /*=rangeGetContentMD5*/, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if z.isAzureError(err, azblob.ServiceCodeBlobNotFound) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return util.NewDecompressReader(response.Body(azblob.RetryReaderOptions{}))
+}
+
+func (z *AzureBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, modTime time.Time) error) error {
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		segment, err := z.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if err != nil {
+			return err
+		}
+		for _, blob := range segment.Segment.BlobItems {
+			if err := fn(blob.Name, blob.Properties.LastModified); err != nil {
+				return err
+			}
+		}
+		marker = segment.NextMarker
+	}
+	return nil
+}
+
 func (z *AzureBlobStore) WriteBlob(ctx context.Context, blobName string, data []byte) (int, error) {
 	compressedData, err := util.Compress(data)
 	if err != nil {
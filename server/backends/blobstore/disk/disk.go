@@ -4,6 +4,8 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -14,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/disk"
 	"github.com/buildbuddy-io/buildbuddy/server/util/ioutil"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 )
 
@@ -151,3 +154,62 @@ func (d *DiskBlobStore) Writer(ctx context.Context, blobName string) (interfaces
 	cwc.CloseFn = fw.Close
 	return cwc, nil
 }
+
+func (d *DiskBlobStore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	fullPath, err := d.blobPath(blobName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.NotFoundError(err.Error())
+		}
+		return nil, err
+	}
+	return util.NewDecompressReader(f)
+}
+
+func (d *DiskBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, modTime time.Time) error) error {
+	// Only walk the directory containing the prefix, rather than the whole
+	// root directory.
+	walkDir := d.rootDir
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		p, err := d.blobPath(prefix[:i])
+		if err != nil {
+			return err
+		}
+		walkDir = p
+	}
+	err := filepath.WalkDir(walkDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() || disk.IsWriteTempFile(path) {
+			return nil
+		}
+		blobName, err := filepath.Rel(d.rootDir, path)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(blobName, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted since it was listed.
+				return nil
+			}
+			return err
+		}
+		return fn(blobName, info.ModTime())
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
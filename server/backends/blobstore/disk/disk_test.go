@@ -3,9 +3,11 @@ package disk
 import (
 	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/backends/blobstore/util"
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -95,6 +97,21 @@ func TestDiskBlobStore(t *testing.T) {
 			require.NoError(t, err)
 			require.Equal(t, b, tc.blob)
 
+			r, err := bs.Reader(ctx, tc.blobName)
+			require.NoError(t, err)
+			b, err = io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, b, tc.blob)
+
+			var listed []string
+			err = bs.ListBlobs(ctx, "", func(blobName string, _ time.Time) error {
+				listed = append(listed, blobName)
+				return nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, []string{tc.blobName}, listed)
+
 			err = bs.DeleteBlob(ctx, tc.blobName)
 			require.NoError(t, err)
 
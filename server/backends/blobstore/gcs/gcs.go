@@ -16,6 +16,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/tracing"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 )
 
@@ -317,6 +318,26 @@ func (g *GCSBlobStore) Reader(ctx context.Context, blobName string) (io.ReadClos
 	}
 }
 
+func (g *GCSBlobStore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, modTime time.Time) error) error {
+	query := &storage.Query{Prefix: prefix}
+	if err := query.SetAttrSelection([]string{"Name", "Updated"}); err != nil {
+		return err
+	}
+	it := g.bucketHandle.Objects(ctx, query)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(attrs.Name, attrs.Updated); err != nil {
+			return err
+		}
+	}
+}
+
 func (g *GCSBlobStore) SetBucketCustomTimeTTL(ctx context.Context, ageInDays int64) error {
 	ctx, spn := tracing.StartSpan(ctx)
 	attrs, err := g.bucketHandle.Attrs(ctx)
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
@@ -8,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
@@ -58,6 +60,46 @@ func Decompress(in []byte, err error) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// gzipMagic is the header that starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+type decompressReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressReader) Close() error {
+	var firstErr error
+	for _, c := range d.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NewDecompressReader is the streaming equivalent of Decompress: it returns a
+// reader that decompresses rc, or reads it as-is if it was not compressed.
+// Closing the returned reader closes rc.
+func NewDecompressReader(rc io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReader(rc)
+	header, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	if !bytes.Equal(header, gzipMagic) {
+		// Compatibility hack: see Decompress.
+		return &decompressReader{Reader: br, closers: []io.Closer{rc}}, nil
+	}
+	zr, err := NewCompressReader(br)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &decompressReader{Reader: zr, closers: []io.Closer{zr, rc}}, nil
+}
+
 func Compress(in []byte) ([]byte, error) {
 	var buf bytes.Buffer
 	zr := NewCompressWriter(&buf)
@@ -114,6 +156,22 @@ func (p *prefixBlobstore) Writer(ctx context.Context, blobName string) (interfac
 	return p.blobstore.Writer(ctx, p.blobPath(blobName))
 }
 
+func (p *prefixBlobstore) Reader(ctx context.Context, blobName string) (io.ReadCloser, error) {
+	return p.blobstore.Reader(ctx, p.blobPath(blobName))
+}
+
+func (p *prefixBlobstore) ListBlobs(ctx context.Context, prefix string, fn func(blobName string, modTime time.Time) error) error {
+	if p.prefix == "" {
+		return p.blobstore.ListBlobs(ctx, prefix, fn)
+	}
+	// Not using blobPath here, since filepath.Join would drop a trailing
+	// slash from the prefix.
+	dir := strings.TrimSuffix(p.prefix, "/") + "/"
+	return p.blobstore.ListBlobs(ctx, dir+prefix, func(blobName string, modTime time.Time) error {
+		return fn(strings.TrimPrefix(blobName, dir), modTime)
+	})
+}
+
 func RecordWriteMetrics(typeLabel string, startTime time.Time, size int, err error) {
 	duration := time.Since(startTime)
 	metrics.BlobstoreWriteCount.With(prometheus.Labels{
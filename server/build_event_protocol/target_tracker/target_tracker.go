@@ -1,13 +1,17 @@
 package target_tracker
 
 import (
+	"bytes"
 	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/build_event_stream"
 	"github.com/buildbuddy-io/buildbuddy/server/build_event_protocol/accumulator"
@@ -16,6 +20,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/background"
 	"github.com/buildbuddy-io/buildbuddy/server/util/clickhouse/schema"
 	"github.com/buildbuddy-io/buildbuddy/server/util/db"
+	"github.com/buildbuddy-io/buildbuddy/server/util/junit"
 	"github.com/buildbuddy-io/buildbuddy/server/util/log"
 	"github.com/buildbuddy-io/buildbuddy/server/util/perms"
 	"github.com/buildbuddy-io/buildbuddy/server/util/query_builder"
@@ -30,10 +35,19 @@ import (
 var (
 	enableTargetTracking                   = flag.Bool("app.enable_target_tracking", false, "Cloud-Only")
 	writeTestTargetStatusesToOLAPDBEnabled = flag.Bool("app.enable_write_test_target_statuses_to_olap_db", false, "If enabled, test target statuses will be flushed to OLAP DB")
+	writeTestCaseStatusesToOLAPDBEnabled   = flag.Bool("app.enable_write_test_case_statuses_to_olap_db", false, "If enabled, test cases parsed from the test.xml outputs of test targets will be flushed to OLAP DB")
 )
 
 const (
 	writeTestTargetStatusesTimeout = 15 * time.Second
+	writeTestCaseStatusesTimeout   = 30 * time.Second
+
+	// The max number of test.xml files fetched from the cache concurrently.
+	testXMLFetchConcurrency = 8
+	// test.xml files larger than this are skipped.
+	maxTestXMLSizeBytes = 8 * 1024 * 1024
+	// Failure messages are truncated to this length before being written.
+	maxFailureMessageLength = 4096
 )
 
 type targetClosure func(event *build_event_stream.BuildEvent)
@@ -61,6 +75,17 @@ type target struct {
 	targetType     cmpb.TargetType
 	testSize       build_event_stream.TestSize
 	buildSuccess   bool
+	testResults    []*testResult
+}
+
+// testResult holds the information needed to ingest the test cases of a
+// single test attempt.
+type testResult struct {
+	run        int32
+	shard      int32
+	attempt    int32
+	startTime  time.Time
+	testXMLURI string
 }
 
 func md5Int64(text string) int64 {
@@ -101,6 +126,9 @@ func (t *target) updateFromEvent(event *build_event_stream.BuildEvent) {
 	case *build_event_stream.BuildEvent_TestResult:
 		t.cached = p.TestResult.GetCachedLocally() || p.TestResult.GetExecutionInfo().GetCachedRemotely()
 		t.state = targetStateResult
+		if r := newTestResult(event); r != nil && !t.cached {
+			t.testResults = append(t.testResults, r)
+		}
 	case *build_event_stream.BuildEvent_TestSummary:
 		ts := p.TestSummary
 		t.overallStatus = ts.GetOverallStatus()
@@ -114,6 +142,26 @@ func (t *target) updateFromEvent(event *build_event_stream.BuildEvent) {
 	}
 }
 
+// newTestResult returns the test result for a TestResult event, or nil if the
+// result has no test.xml output.
+func newTestResult(event *build_event_stream.BuildEvent) *testResult {
+	for _, f := range event.GetTestResult().GetTestActionOutput() {
+		if f.GetName() != "test.xml" || f.GetUri() == "" {
+			continue
+		}
+		id := event.GetId().GetTestResult()
+		tr := event.GetTestResult()
+		return &testResult{
+			run:        id.GetRun(),
+			shard:      id.GetShard(),
+			attempt:    id.GetAttempt(),
+			startTime:  timeutil.GetTimeWithFallback(tr.GetTestAttemptStart(), tr.GetTestAttemptStartMillisEpoch()),
+			testXMLURI: f.GetUri(),
+		}
+	}
+	return nil
+}
+
 const targetIdSeparator string = "|"
 
 func getTargetIdWithAspectFromEventId(beid *build_event_stream.BuildEventId) string {
@@ -384,6 +432,150 @@ func (t *TargetTracker) writeTestTargetStatusesToOLAPDB(ctx context.Context, per
 	return err
 }
 
+func (t *TargetTracker) writeTestCaseStatusesToOLAPDB(ctx context.Context, permissions *perms.UserGroupPerm) error {
+	if !t.WriteTestCasesToOLAPDBEnabled() {
+		return nil
+	}
+	ctx, cancel := background.ExtendContextForFinalization(ctx, writeTestCaseStatusesTimeout)
+	defer cancel()
+
+	invocation := t.buildEventAccumulator.Invocation()
+	if invocation == nil {
+		return status.InternalError("failed to write test case statuses: no invocation from build accumulator")
+	}
+	if permissions.GroupID == "" {
+		log.CtxInfo(ctx, "skip writing test case statuses to OLAPDB because group_id is empty")
+		return nil
+	}
+	if invocation.GetRepoUrl() == "" {
+		log.CtxInfo(ctx, "skip writing test case statuses because repo_url is empty")
+		return nil
+	}
+	if invocation.GetCommitSha() == "" {
+		log.CtxInfo(ctx, "skip writing test case statuses because commit_sha is empty")
+		return nil
+	}
+	invocationUUID := strings.Replace(t.invocationID(), "-", "", -1)
+
+	var mu sync.Mutex
+	entries := make([]*schema.TestCaseStatus, 0)
+	eg, gctx := errgroup.WithContext(ctx)
+	eg.SetLimit(testXMLFetchConcurrency)
+	for _, target := range t.targets {
+		if !isTest(target) {
+			continue
+		}
+		for _, result := range target.testResults {
+			label := target.label
+			result := result
+			eg.Go(func() error {
+				testCases, err := t.fetchTestCases(gctx, result.testXMLURI)
+				if err != nil {
+					// Don't fail the whole invocation because of a single
+					// missing or malformed test.xml.
+					log.CtxWarningf(gctx, "Failed to read test cases for %q (shard %d, run %d, attempt %d): %s", label, result.shard, result.run, result.attempt, err)
+					return nil
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for i, tc := range testCases {
+					entries = append(entries, &schema.TestCaseStatus{
+						GroupID:        permissions.GroupID,
+						RepoURL:        invocation.GetRepoUrl(),
+						Label:          label,
+						ClassName:      tc.ClassName,
+						Name:           tc.Name,
+						InvocationUUID: invocationUUID,
+						Shard:          result.shard,
+						Run:            result.run,
+						Attempt:        result.attempt,
+						CaseIndex:      int32(i),
+
+						CommitSHA:      invocation.GetCommitSha(),
+						UserID:         permissions.UserID,
+						Status:         int32(testCaseStatus(tc.Result)),
+						StartTimeUsec:  result.startTime.UnixMicro(),
+						DurationUsec:   tc.Duration.Microseconds(),
+						FailureMessage: failureMessage(tc),
+
+						BranchName:              invocation.GetBranchName(),
+						Role:                    invocation.GetRole(),
+						Command:                 invocation.GetCommand(),
+						InvocationStartTimeUsec: t.buildEventAccumulator.StartTime().UnixMicro(),
+					})
+				}
+				return nil
+			})
+		}
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+	err := t.env.GetOLAPDBHandle().FlushTestCaseStatuses(ctx, entries)
+	if err == nil {
+		log.CtxInfof(ctx, "successfully wrote %d test case statuses", len(entries))
+	}
+	return err
+}
+
+// fetchTestCases reads the test.xml file at the given bytestream URI from the
+// cache and parses the test cases from it.
+func (t *TargetTracker) fetchTestCases(ctx context.Context, uri string) ([]*junit.TestCase, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, status.InvalidArgumentErrorf("invalid test.xml URI %q: %s", uri, err)
+	}
+	if u.Scheme != "bytestream" {
+		// The file was not uploaded to a remote cache (e.g. file://).
+		return nil, status.FailedPreconditionErrorf("unsupported test.xml URI scheme %q", u.Scheme)
+	}
+	buf := &limitedBuffer{limit: maxTestXMLSizeBytes}
+	if err := t.env.GetPooledByteStreamClient().StreamBytestreamFile(ctx, u, buf); err != nil {
+		return nil, err
+	}
+	return junit.Parse(&buf.buf)
+}
+
+// limitedBuffer is a bytes.Buffer that refuses writes past a size limit.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.buf.Len()+len(p) > b.limit {
+		return 0, status.ResourceExhaustedErrorf("test.xml exceeds the max size of %d bytes", b.limit)
+	}
+	return b.buf.Write(p)
+}
+
+func testCaseStatus(r junit.Result) cmpb.Status {
+	switch r {
+	case junit.Passed:
+		return cmpb.Status_PASSED
+	case junit.Skipped:
+		return cmpb.Status_SKIPPED
+	default:
+		return cmpb.Status_FAILED
+	}
+}
+
+func failureMessage(tc *junit.TestCase) string {
+	msg := tc.Message
+	if msg == "" {
+		msg = tc.Details
+	}
+	if len(msg) <= maxFailureMessageLength {
+		return msg
+	}
+	msg = msg[:maxFailureMessageLength]
+	// Don't leave a partial rune at the end of the truncated message.
+	for len(msg) > 0 && !utf8.ValidString(msg) {
+		msg = msg[:len(msg)-1]
+	}
+	return msg
+}
+
 func (t *TargetTracker) TrackTargetsForEvent(ctx context.Context, event *build_event_stream.BuildEvent) {
 	if !*enableTargetTracking {
 		return
@@ -495,6 +687,9 @@ func (t *TargetTracker) handleLastEvent(ctx context.Context) {
 	if err := t.writeTestTargetStatusesToOLAPDB(ctx, permissions); err != nil {
 		log.CtxErrorf(ctx, "Error writing %q target statuses: %s", t.invocationID(), err.Error())
 	}
+	if err := t.writeTestCaseStatusesToOLAPDB(ctx, permissions); err != nil {
+		log.CtxErrorf(ctx, "Error writing %q test case statuses: %s", t.invocationID(), err.Error())
+	}
 }
 
 func isTestCommand(command string) bool {
@@ -619,6 +814,12 @@ func (t *TargetTracker) WriteToOLAPDBEnabled() bool {
 	return *writeTestTargetStatusesToOLAPDBEnabled && t.env.GetOLAPDBHandle() != nil
 }
 
+// WriteTestCasesToOLAPDBEnabled returns whether the test cases reported in
+// test.xml outputs should be written to the OLAP DB.
+func (t *TargetTracker) WriteTestCasesToOLAPDBEnabled() bool {
+	return *writeTestCaseStatusesToOLAPDBEnabled && t.env.GetOLAPDBHandle() != nil && t.env.GetPooledByteStreamClient() != nil
+}
+
 func TargetTrackingEnabled() bool {
 	return *enableTargetTracking
 }
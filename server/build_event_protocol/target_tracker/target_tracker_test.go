@@ -2,6 +2,9 @@ package target_tracker_test
 
 import (
 	"context"
+	"io"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -11,10 +14,12 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/tables"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testauth"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"github.com/buildbuddy-io/buildbuddy/server/util/testing/flags"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	cmpb "github.com/buildbuddy-io/buildbuddy/proto/api/v1/common"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
@@ -773,6 +778,191 @@ func TestTrackTargetsForEventsAborted(t *testing.T) {
 	}
 }
 
+// fakeByteStreamClient serves files from memory, keyed by bytestream URI.
+type fakeByteStreamClient struct {
+	interfaces.PooledByteStreamClient
+	files map[string]string
+}
+
+func (c *fakeByteStreamClient) StreamBytestreamFile(ctx context.Context, u *url.URL, w io.Writer) error {
+	b, ok := c.files[u.String()]
+	if !ok {
+		return status.NotFoundErrorf("%s not found", u)
+	}
+	_, err := io.WriteString(w, b)
+	return err
+}
+
+func testResultEvent(label string, attempt int32, cached bool, testXMLURI string) *build_event_stream.BuildEvent {
+	return &build_event_stream.BuildEvent{
+		Id: &build_event_stream.BuildEventId{
+			Id: &build_event_stream.BuildEventId_TestResult{
+				TestResult: &build_event_stream.BuildEventId_TestResultId{
+					Label:   label,
+					Run:     1,
+					Shard:   1,
+					Attempt: attempt,
+				},
+			},
+		},
+		Payload: &build_event_stream.BuildEvent_TestResult{
+			TestResult: &build_event_stream.TestResult{
+				CachedLocally:    cached,
+				TestAttemptStart: timestamppb.New(time.UnixMicro(1_000_000 * int64(attempt))),
+				TestActionOutput: []*build_event_stream.File{
+					{Name: "test.log", File: &build_event_stream.File_Uri{Uri: testXMLURI + ".log"}},
+					{Name: "test.xml", File: &build_event_stream.File_Uri{Uri: testXMLURI}},
+				},
+			},
+		},
+	}
+}
+
+func TestTrackTargetsForEvents_TestCases(t *testing.T) {
+	flags.Set(t, "testenv.use_clickhouse", true)
+	flags.Set(t, "app.enable_target_tracking", true)
+	flags.Set(t, "app.enable_write_test_case_statuses_to_olap_db", true)
+	te := testenv.GetTestEnv(t)
+	ta := testauth.NewTestAuthenticator(testauth.TestUsers("USER1", "GROUP1"))
+	te.SetAuthenticator(ta)
+
+	const (
+		attempt1URI = "bytestream://localhost:1985/blobs/1111/100"
+		attempt2URI = "bytestream://localhost:1985/blobs/2222/100"
+		cachedURI   = "bytestream://localhost:1985/blobs/3333/100"
+		invalidURI  = "bytestream://localhost:1985/blobs/4444/100"
+	)
+	te.SetPooledByteStreamClient(&fakeByteStreamClient{files: map[string]string{
+		attempt1URI: `<testsuites><testsuite name="//server:foo_test">
+			<testcase classname="server/foo" name="TestA" time="0.5"></testcase>
+			<testcase classname="server/foo" name="TestB" time="1.5"><failure message="got 2, want 1">foo_test.go:12</failure></testcase>
+		</testsuite></testsuites>`,
+		attempt2URI: `<testsuites><testsuite name="//server:foo_test">
+			<testcase classname="server/foo" name="TestA" time="0.5"></testcase>
+			<testcase classname="server/foo" name="TestB" time="1"></testcase>
+			<testcase classname="server/foo" name="TestC"><skipped/></testcase>
+			<testcase classname="server/foo" name="TestB" time="0.25"></testcase>
+		</testsuite></testsuites>`,
+		cachedURI:  `<testsuites><testsuite><testcase classname="server/bar" name="TestCached"></testcase></testsuite></testsuites>`,
+		invalidURI: `not xml`,
+	}})
+
+	ctx, err := ta.WithAuthenticatedUser(context.Background(), "USER1")
+	require.NoError(t, err)
+	testUUID, err := uuid.NewRandom()
+	require.NoError(t, err)
+	tracker := target_tracker.NewTargetTracker(te, newFakeAccumulator(t, testUUID.String()))
+	require.True(t, tracker.WriteTestCasesToOLAPDBEnabled())
+
+	var events []*build_event_stream.BuildEvent
+	labels := []string{"//server:foo_test", "//server:bar_test", "//server:baz_test"}
+	var configured []*build_event_stream.BuildEventId
+	for _, label := range labels {
+		configured = append(configured, targetConfiguredId(label))
+	}
+	events = append(events, &build_event_stream.BuildEvent{
+		Children: configured,
+		Payload:  &build_event_stream.BuildEvent_Expanded{},
+	})
+	for _, label := range labels {
+		events = append(events, &build_event_stream.BuildEvent{
+			Id:       targetConfiguredId(label),
+			Children: []*build_event_stream.BuildEventId{targetCompletedId(label)},
+			Payload: &build_event_stream.BuildEvent_Configured{
+				Configured: &build_event_stream.TargetConfigured{
+					TargetKind: "go_test rule",
+					TestSize:   build_event_stream.TestSize_SMALL,
+				},
+			},
+		})
+	}
+	events = append(events, &build_event_stream.BuildEvent{
+		Payload: &build_event_stream.BuildEvent_WorkspaceStatus{},
+	})
+	for _, label := range labels {
+		events = append(events, &build_event_stream.BuildEvent{
+			Id:       targetCompletedId(label),
+			Children: []*build_event_stream.BuildEventId{testResultId(label), testSummaryId(label)},
+			Payload: &build_event_stream.BuildEvent_Completed{
+				Completed: &build_event_stream.TargetComplete{Success: true},
+			},
+		})
+	}
+	events = append(events,
+		testResultEvent("//server:foo_test", 1, false, attempt1URI),
+		testResultEvent("//server:foo_test", 2, false, attempt2URI),
+		// Cached results were already ingested by the invocation that ran
+		// them, and a malformed test.xml is skipped without failing the
+		// others.
+		testResultEvent("//server:bar_test", 1, true, cachedURI),
+		testResultEvent("//server:baz_test", 1, false, invalidURI),
+	)
+	for _, label := range labels {
+		events = append(events, &build_event_stream.BuildEvent{
+			Id: testSummaryId(label),
+			Payload: &build_event_stream.BuildEvent_TestSummary{
+				TestSummary: &build_event_stream.TestSummary{
+					OverallStatus: build_event_stream.TestStatus_PASSED,
+				},
+			},
+		})
+	}
+	events = append(events, &build_event_stream.BuildEvent{LastMessage: true})
+
+	for _, e := range events {
+		tracker.TrackTargetsForEvent(ctx, e)
+	}
+
+	type testCaseRow struct {
+		GroupID        string
+		RepoURL        string
+		Label          string
+		ClassName      string
+		Name           string
+		InvocationUUID string
+		Attempt        int32
+		CaseIndex      int32
+		CommitSHA      string
+		Status         int32
+		StartTimeUsec  int64
+		DurationUsec   int64
+		FailureMessage string
+	}
+	var got []testCaseRow
+	// Read with FINAL so that rows which would be collapsed by the table's
+	// sort key are collapsed before they're compared.
+	query := `SELECT group_id, repo_url, label, class_name, name, invocation_uuid, attempt, case_index, commit_sha, status, start_time_usec, duration_usec, failure_message FROM "TestCaseStatuses" FINAL`
+	err = te.GetOLAPDBHandle().NewQuery(context.Background(), "get_test_case_statuses").Raw(query).Take(&got)
+	require.NoError(t, err)
+	invocationUUID := strings.ReplaceAll(testUUID.String(), "-", "")
+	row := func(name string, attempt, caseIndex int32, st cmpb.Status, duration time.Duration, msg string) testCaseRow {
+		return testCaseRow{
+			GroupID:        "GROUP1",
+			RepoURL:        "bb/foo",
+			Label:          "//server:foo_test",
+			ClassName:      "server/foo",
+			Name:           name,
+			InvocationUUID: invocationUUID,
+			Attempt:        attempt,
+			CaseIndex:      caseIndex,
+			CommitSHA:      "abcdef",
+			Status:         int32(st),
+			StartTimeUsec:  1_000_000 * int64(attempt),
+			DurationUsec:   duration.Microseconds(),
+			FailureMessage: msg,
+		}
+	}
+	assert.ElementsMatch(t, []testCaseRow{
+		row("TestA", 1, 0, cmpb.Status_PASSED, 500*time.Millisecond, ""),
+		row("TestB", 1, 1, cmpb.Status_FAILED, 1500*time.Millisecond, "got 2, want 1"),
+		row("TestA", 2, 0, cmpb.Status_PASSED, 500*time.Millisecond, ""),
+		row("TestB", 2, 1, cmpb.Status_PASSED, time.Second, ""),
+		row("TestC", 2, 2, cmpb.Status_SKIPPED, 0, ""),
+		// Test cases with the same name are kept separately.
+		row("TestB", 2, 3, cmpb.Status_PASSED, 250*time.Millisecond, ""),
+	}, got)
+}
+
 func assertTestTargetStatusesMatchOLAPDB(t *testing.T, te *testenv.TestEnv, expected []Row) {
 	var got []Row
 	query := `SELECT group_id, commit_sha, rule_type, label, repo_url, branch_name, role, command, test_size, status, cached, target_type FROM "TestTargetStatuses"`
@@ -65,6 +65,7 @@ import (
 	csinpb "github.com/buildbuddy-io/buildbuddy/proto/index"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
+	owpb "github.com/buildbuddy-io/buildbuddy/proto/outbound_webhook"
 	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/repo"
 	rnpb "github.com/buildbuddy-io/buildbuddy/proto/runner"
@@ -1296,6 +1297,20 @@ func (s *BuildBuddyServer) WaitExecution(req *espb.WaitExecutionRequest, stream
 	return status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) GetExecutionOutput(ctx context.Context, req *espb.GetExecutionOutputRequest) (*espb.GetExecutionOutputResponse, error) {
+	if es := s.env.GetExecutionService(); es != nil {
+		return es.GetExecutionOutput(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
+func (s *BuildBuddyServer) StreamExecutionOutput(req *espb.GetExecutionOutputRequest, stream bbspb.BuildBuddyService_StreamExecutionOutputServer) error {
+	if es := s.env.GetExecutionService(); es != nil {
+		return es.StreamExecutionOutput(req, stream)
+	}
+	return status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetTreeDirectorySizes(ctx context.Context, req *capb.GetTreeDirectorySizesRequest) (*capb.GetTreeDirectorySizesResponse, error) {
 	return directory_size.GetTreeDirectorySizes(ctx, s.env, req)
 }
@@ -1308,6 +1323,13 @@ func (s *BuildBuddyServer) GetExecutionNodes(ctx context.Context, req *scpb.GetE
 	return nil, status.UnimplementedError("Not implemented")
 }
 
+func (s *BuildBuddyServer) DebugShell(stream bbspb.BuildBuddyService_DebugShellServer) error {
+	if ss := s.env.GetSchedulerService(); ss != nil {
+		return ss.DebugShell(stream)
+	}
+	return status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) SearchExecution(ctx context.Context, req *espb.SearchExecutionRequest) (*espb.SearchExecutionResponse, error) {
 	if req == nil {
 		return nil, status.InvalidArgumentErrorf("SearchExecutionRequest cannot be empty")
@@ -1335,6 +1357,13 @@ func (s *BuildBuddyServer) GetTargetFlakeSamples(ctx context.Context, req *trpb.
 	return target.GetTargetFlakeSamples(ctx, s.env, req)
 }
 
+func (s *BuildBuddyServer) GetFlakyTargets(ctx context.Context, req *trpb.GetFlakyTargetsRequest) (*trpb.GetFlakyTargetsResponse, error) {
+	if fds := s.env.GetFlakeDetectionService(); fds != nil {
+		return fds.GetFlakyTargets(ctx, req)
+	}
+	return nil, status.UnimplementedError("Not implemented")
+}
+
 func (s *BuildBuddyServer) GetEventLogChunk(ctx context.Context, req *elpb.GetEventLogChunkRequest) (*elpb.GetEventLogChunkResponse, error) {
 	resp, err := eventlog.GetEventLogChunk(ctx, s.env, req)
 	if err != nil {
@@ -2542,6 +2571,46 @@ func (s *BuildBuddyServer) DeleteIPRule(ctx context.Context, request *irpb.Delet
 	return rsp, nil
 }
 
+func (s *BuildBuddyServer) GetWebhooks(ctx context.Context, request *owpb.GetWebhooksRequest) (*owpb.GetWebhooksResponse, error) {
+	ows := s.env.GetOutboundWebhookService()
+	if ows == nil {
+		return nil, status.UnimplementedError("Outbound webhooks not enabled")
+	}
+	return ows.GetWebhooks(ctx, request)
+}
+
+func (s *BuildBuddyServer) CreateWebhook(ctx context.Context, request *owpb.CreateWebhookRequest) (*owpb.CreateWebhookResponse, error) {
+	ows := s.env.GetOutboundWebhookService()
+	if ows == nil {
+		return nil, status.UnimplementedError("Outbound webhooks not enabled")
+	}
+	return ows.CreateWebhook(ctx, request)
+}
+
+func (s *BuildBuddyServer) UpdateWebhook(ctx context.Context, request *owpb.UpdateWebhookRequest) (*owpb.UpdateWebhookResponse, error) {
+	ows := s.env.GetOutboundWebhookService()
+	if ows == nil {
+		return nil, status.UnimplementedError("Outbound webhooks not enabled")
+	}
+	return ows.UpdateWebhook(ctx, request)
+}
+
+func (s *BuildBuddyServer) DeleteWebhook(ctx context.Context, request *owpb.DeleteWebhookRequest) (*owpb.DeleteWebhookResponse, error) {
+	ows := s.env.GetOutboundWebhookService()
+	if ows == nil {
+		return nil, status.UnimplementedError("Outbound webhooks not enabled")
+	}
+	return ows.DeleteWebhook(ctx, request)
+}
+
+func (s *BuildBuddyServer) GetWebhookDeliveries(ctx context.Context, request *owpb.GetWebhookDeliveriesRequest) (*owpb.GetWebhookDeliveriesResponse, error) {
+	ows := s.env.GetOutboundWebhookService()
+	if ows == nil {
+		return nil, status.UnimplementedError("Outbound webhooks not enabled")
+	}
+	return ows.GetWebhookDeliveries(ctx, request)
+}
+
 func (s *BuildBuddyServer) GetGCPProject(ctx context.Context, request *gcpb.GetGCPProjectRequest) (*gcpb.GetGCPProjectResponse, error) {
 	gcpService := s.env.GetGCPService()
 	if gcpService == nil {
@@ -155,6 +155,14 @@ func (p *CacheProxy) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlob
 	return p.casClient.BatchReadBlobs(ctx, req)
 }
 
+func (p *CacheProxy) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	return p.casClient.SplitBlob(ctx, req)
+}
+
+func (p *CacheProxy) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	return p.casClient.SpliceBlob(ctx, req)
+}
+
 func (p *CacheProxy) GetTree(req *repb.GetTreeRequest, stream repb.ContentAddressableStorage_GetTreeServer) error {
 	clientStream, err := p.casClient.GetTree(stream.Context(), req)
 	if err != nil {
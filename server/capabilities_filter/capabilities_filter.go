@@ -37,6 +37,8 @@ var (
 		"GetTargetHistory",
 		"GetExecution",
 		"WaitExecution",
+		"GetExecutionOutput",
+		"StreamExecutionOutput",
 		"GetZipManifest",
 		// Users do not need any particular role within their current group to be
 		// able to create another group or request to join an existing group.
@@ -54,6 +56,7 @@ var (
 		"GetAction",
 		"GetFile",
 		"DeleteFile",
+		"GetTestCaseHistory",
 
 		// GitHub user-level token management does not require group membership.
 		"UnlinkUserGitHubAccount",
@@ -101,6 +104,7 @@ var (
 		"GetTargetStats",
 		"GetDailyTargetStats",
 		"GetTargetFlakeSamples",
+		"GetFlakyTargets",
 		"GetInvocationFilterSuggestions",
 		// Workflow configuration and history (read-only).
 		"GetWorkflows",
@@ -112,6 +116,7 @@ var (
 		"UpdateInvocation",
 		"DeleteInvocation",
 		"CancelExecutions",
+		"DebugShell",
 		"ExecuteWorkflow",
 		"InvalidateSnapshot",
 		// Org API keys (implementation only returns developer-visible keys
@@ -185,6 +190,12 @@ var (
 		"DeleteIPRule",
 		"GetIPRulesConfig",
 		"SetIPRulesConfig",
+		// Outbound webhooks.
+		"GetWebhooks",
+		"CreateWebhook",
+		"UpdateWebhook",
+		"DeleteWebhook",
+		"GetWebhookDeliveries",
 		// GCP
 		"GetGCPProject",
 	}
@@ -115,12 +115,14 @@ type Env interface {
 	GetSecretService() interfaces.SecretService
 	GetExecutionCollector() interfaces.ExecutionCollector
 	GetSuggestionService() interfaces.SuggestionService
+	GetFlakeDetectionService() interfaces.FlakeDetectionService
 	GetCrypter() interfaces.Crypter
 	GetSociArtifactStoreServer() socipb.SociArtifactStoreServer
 	GetSingleFlightDeduper() interfaces.SingleFlightDeduper
 	GetPromQuerier() interfaces.PromQuerier
 	GetAuditLogger() interfaces.AuditLogger
 	GetIPRulesService() interfaces.IPRulesService
+	GetOutboundWebhookService() interfaces.OutboundWebhookService
 	GetClientIdentityService() interfaces.ClientIdentityService
 	GetImageCacheAuthenticator() interfaces.ImageCacheAuthenticator
 	GetServerNotificationService() interfaces.ServerNotificationService
@@ -139,4 +141,5 @@ type Env interface {
 	GetHitTrackerFactory() interfaces.HitTrackerFactory
 	GetHitTrackerServiceServer() hitpb.HitTrackerServiceServer
 	GetExperimentFlagProvider() interfaces.ExperimentFlagProvider
+	GetBlobSplitter() interfaces.BlobSplitter
 }
@@ -27,6 +27,7 @@ import (
 	authpb "github.com/buildbuddy-io/buildbuddy/proto/auth"
 	bbspb "github.com/buildbuddy-io/buildbuddy/proto/buildbuddy_service"
 	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
+	dspb "github.com/buildbuddy-io/buildbuddy/proto/debug_shell"
 	enpb "github.com/buildbuddy-io/buildbuddy/proto/encryption"
 	espb "github.com/buildbuddy-io/buildbuddy/proto/execution_stats"
 	fcpb "github.com/buildbuddy-io/buildbuddy/proto/firecracker"
@@ -36,6 +37,7 @@ import (
 	csinpb "github.com/buildbuddy-io/buildbuddy/proto/index"
 	inpb "github.com/buildbuddy-io/buildbuddy/proto/invocation"
 	irpb "github.com/buildbuddy-io/buildbuddy/proto/iprules"
+	owpb "github.com/buildbuddy-io/buildbuddy/proto/outbound_webhook"
 	pepb "github.com/buildbuddy-io/buildbuddy/proto/publish_build_event"
 	qpb "github.com/buildbuddy-io/buildbuddy/proto/quota"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
@@ -49,6 +51,7 @@ import (
 	sgpb "github.com/buildbuddy-io/buildbuddy/proto/storage"
 	sipb "github.com/buildbuddy-io/buildbuddy/proto/stored_invocation"
 	supb "github.com/buildbuddy-io/buildbuddy/proto/suggestion"
+	trpb "github.com/buildbuddy-io/buildbuddy/proto/target"
 	telpb "github.com/buildbuddy-io/buildbuddy/proto/telemetry"
 	usagepb "github.com/buildbuddy-io/buildbuddy/proto/usage"
 	wfpb "github.com/buildbuddy-io/buildbuddy/proto/workflow"
@@ -263,6 +266,14 @@ type Blobstore interface {
 	// provide a consistent interface.
 	DeleteBlob(ctx context.Context, blobName string) error
 	Writer(ctx context.Context, blobName string) (CommittedWriteCloser, error)
+
+	// Reader streams the contents of a blob written by WriteBlob or Writer.
+	Reader(ctx context.Context, blobName string) (io.ReadCloser, error)
+
+	// ListBlobs calls fn with the name and last modification time of each
+	// blob whose name starts with prefix. Listing stops early if fn returns
+	// an error, which is returned.
+	ListBlobs(ctx context.Context, prefix string, fn func(blobName string, modTime time.Time) error) error
 }
 
 type CacheMetadata struct {
@@ -302,6 +313,30 @@ type StoppableCache interface {
 	Stop() error
 }
 
+// A ScannedResource is a resource enumerated by a ScannableCache.
+type ScannedResource struct {
+	Resource *rspb.ResourceName
+
+	// The group that owns the resource.
+	GroupID string
+
+	// Whether the resource is encrypted at rest.
+	Encrypted bool
+
+	LastAccessUsec int64
+	LastModifyUsec int64
+}
+
+// A ScannableCache can enumerate the resources stored in it, e.g. so that a
+// distributed cache can repair data missing from other replicas.
+type ScannableCache interface {
+	Cache
+
+	// ScanResources calls fn for each complete resource stored in the
+	// cache. The scan stops early if fn returns an error, which is returned.
+	ScanResources(ctx context.Context, fn func(r *ScannedResource) error) error
+}
+
 type PooledByteStreamClient interface {
 	StreamBytestreamFile(ctx context.Context, url *url.URL, writer io.Writer) error
 	FetchBytestreamZipManifest(ctx context.Context, url *url.URL) (*zipb.Manifest, error)
@@ -416,6 +451,7 @@ type OLAPDBHandle interface {
 	FlushInvocationStats(ctx context.Context, ti *tables.Invocation) error
 	FlushExecutionStats(ctx context.Context, inv *sipb.StoredInvocation, executions []*repb.StoredExecution) error
 	FlushTestTargetStatuses(ctx context.Context, entries []*schema.TestTargetStatus) error
+	FlushTestCaseStatuses(ctx context.Context, entries []*schema.TestCaseStatus) error
 	InsertAuditLog(ctx context.Context, entry *schema.AuditLog) error
 	BucketFromUsecTimestamp(fieldName string, loc *time.Location, interval string) (string, []interface{})
 }
@@ -903,6 +939,8 @@ type SchedulerService interface {
 	ReEnqueueTask(ctx context.Context, req *scpb.ReEnqueueTaskRequest) (*scpb.ReEnqueueTaskResponse, error)
 	TaskExists(ctx context.Context, req *scpb.TaskExistsRequest) (*scpb.TaskExistsResponse, error)
 	GetExecutionNodes(ctx context.Context, req *scpb.GetExecutionNodesRequest) (*scpb.GetExecutionNodesResponse, error)
+	DebugShell(stream bbspb.BuildBuddyService_DebugShellServer) error
+	ForwardDebugShell(stream scpb.Scheduler_ForwardDebugShellServer) error
 	GetPoolInfo(ctx context.Context, os, arch, requestedPool, workflowID string, poolType PoolType) (*PoolInfo, error)
 	GetSharedExecutorPoolGroupID() string
 }
@@ -927,6 +965,13 @@ type ExecutionService interface {
 	GetExecution(ctx context.Context, req *espb.GetExecutionRequest) (*espb.GetExecutionResponse, error)
 	WaitExecution(req *espb.WaitExecutionRequest, stream bbspb.BuildBuddyService_WaitExecutionServer) error
 	WriteExecutionProfile(ctx context.Context, w io.Writer, executionID string) error
+
+	// GetExecutionOutput returns the stdout or stderr that an execution has
+	// written so far, starting at the requested chunk.
+	GetExecutionOutput(ctx context.Context, req *espb.GetExecutionOutputRequest) (*espb.GetExecutionOutputResponse, error)
+	// StreamExecutionOutput streams the stdout or stderr of an execution as
+	// it is written, until the execution finishes.
+	StreamExecutionOutput(req *espb.GetExecutionOutputRequest, stream bbspb.BuildBuddyService_StreamExecutionOutputServer) error
 }
 
 // An ExecutionNode that has been ranked for scheduling.
@@ -1106,6 +1151,12 @@ type RunnerPool interface {
 	// even if runner recycling is enabled.
 	TryRecycle(ctx context.Context, r Runner, finishedCleanly bool)
 
+	// DebugShell runs an interactive shell in the container of the runner
+	// that is executing, or recently failed to execute, the requested
+	// execution. The shell's terminal is attached to the given stdio. It
+	// returns the exit code of the shell.
+	DebugShell(ctx context.Context, req *dspb.ShellRequest, stdio *Stdio) (int, error)
+
 	// Shutdown removes all runners from the pool.
 	Shutdown(ctx context.Context) error
 
@@ -1476,6 +1527,12 @@ type ExecutionCollector interface {
 	DeleteExecutionInvocationLinks(ctx context.Context, executionID string) error
 }
 
+// FlakeDetectionService periodically scores the flakiness of test targets
+// from their history in the OLAP DB.
+type FlakeDetectionService interface {
+	GetFlakyTargets(ctx context.Context, req *trpb.GetFlakyTargetsRequest) (*trpb.GetFlakyTargetsResponse, error)
+}
+
 // SuggestionService enables fetching of suggestions.
 type SuggestionService interface {
 	GetSuggestion(ctx context.Context, req *supb.GetSuggestionRequest) (*supb.GetSuggestionResponse, error)
@@ -1549,6 +1606,20 @@ type IPRulesService interface {
 	DeleteRule(ctx context.Context, req *irpb.DeleteRuleRequest) (*irpb.DeleteRuleResponse, error)
 }
 
+// OutboundWebhookService manages the HTTP webhooks that groups configure to
+// receive events, and delivers events to them.
+type OutboundWebhookService interface {
+	GetWebhooks(ctx context.Context, req *owpb.GetWebhooksRequest) (*owpb.GetWebhooksResponse, error)
+	CreateWebhook(ctx context.Context, req *owpb.CreateWebhookRequest) (*owpb.CreateWebhookResponse, error)
+	UpdateWebhook(ctx context.Context, req *owpb.UpdateWebhookRequest) (*owpb.UpdateWebhookResponse, error)
+	DeleteWebhook(ctx context.Context, req *owpb.DeleteWebhookRequest) (*owpb.DeleteWebhookResponse, error)
+	GetWebhookDeliveries(ctx context.Context, req *owpb.GetWebhookDeliveriesRequest) (*owpb.GetWebhookDeliveriesResponse, error)
+
+	// NotifyExecutionFailed queues an EXECUTION_FAILED event for the
+	// webhooks of the authenticated group. It does not block on delivery.
+	NotifyExecutionFailed(ctx context.Context, executionID string, rsp *repb.ExecuteResponse) error
+}
+
 type ClientIdentity struct {
 	Origin string
 	Client string
@@ -1710,6 +1781,15 @@ type OCIRegistry interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 }
 
+// BlobSplitter splits blobs into content-defined chunks, so that different
+// versions of a large blob share most of their chunks. It backs the REAPI
+// SplitBlob and SpliceBlob APIs.
+type BlobSplitter interface {
+	// Split reads r until EOF and calls writeChunkFn with the contents of
+	// each chunk, in order.
+	Split(ctx context.Context, r io.Reader, writeChunkFn func(chunk []byte) error) error
+}
+
 // Measures transfer time between a client and the cache. Obtained from a
 // HitTracker.
 type TransferTimer interface {
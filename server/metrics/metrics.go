@@ -785,6 +785,29 @@ var (
 		CacheHitMissStatus,
 	})
 
+	DistributedCacheAntiEntropyScannedKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_anti_entropy_scanned_keys",
+		Help:      "Number of local keys scanned by distributed cache anti-entropy.",
+	})
+
+	DistributedCacheAntiEntropyMismatchedBuckets = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_anti_entropy_mismatched_buckets",
+		Help:      "Number of digest summary buckets that differed between this node and a peer during distributed cache anti-entropy.",
+	})
+
+	DistributedCacheAntiEntropyBackfills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "remote_cache",
+		Name:      "distributed_cache_anti_entropy_backfills",
+		Help:      "Number of keys copied to a peer that was missing them by distributed cache anti-entropy.",
+	}, []string{
+		StatusHumanReadableLabel,
+	})
+
 	MigrationNotFoundErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: bbNamespace,
 		Subsystem: "remote_cache",
@@ -2512,6 +2535,16 @@ var (
 		StatusHumanReadableLabel,
 	})
 
+	RaftMerges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: bbNamespace,
+		Subsystem: "raft",
+		Name:      "merges",
+		Help:      "The total number of range merges per nodehost.",
+	}, []string{
+		RaftNodeHostIDLabel,
+		StatusHumanReadableLabel,
+	})
+
 	RaftMoves = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: bbNamespace,
 		Subsystem: "raft",
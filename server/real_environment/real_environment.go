@@ -112,6 +112,7 @@ type RealEnv struct {
 	secretService                    interfaces.SecretService
 	executionCollector               interfaces.ExecutionCollector
 	suggestionService                interfaces.SuggestionService
+	flakeDetectionService            interfaces.FlakeDetectionService
 	crypterService                   interfaces.Crypter
 	sociArtifactStoreServer          socipb.SociArtifactStoreServer
 	sociArtifactStoreClient          socipb.SociArtifactStoreClient
@@ -119,6 +120,7 @@ type RealEnv struct {
 	promQuerier                      interfaces.PromQuerier
 	auditLog                         interfaces.AuditLogger
 	ipRulesService                   interfaces.IPRulesService
+	outboundWebhookService           interfaces.OutboundWebhookService
 	serverIdentityService            interfaces.ClientIdentityService
 	imageCacheAuthenticator          interfaces.ImageCacheAuthenticator
 	serverNotificationService        interfaces.ServerNotificationService
@@ -138,6 +140,7 @@ type RealEnv struct {
 	hitTrackerFactory                interfaces.HitTrackerFactory
 	hitTrackerServiceServer          hitpb.HitTrackerServiceServer
 	experimentFlagProvider           interfaces.ExperimentFlagProvider
+	blobSplitter                     interfaces.BlobSplitter
 }
 
 // NewRealEnv returns an environment for use in servers.
@@ -670,6 +673,13 @@ func (r *RealEnv) SetSuggestionService(s interfaces.SuggestionService) {
 	r.suggestionService = s
 }
 
+func (r *RealEnv) GetFlakeDetectionService() interfaces.FlakeDetectionService {
+	return r.flakeDetectionService
+}
+func (r *RealEnv) SetFlakeDetectionService(s interfaces.FlakeDetectionService) {
+	r.flakeDetectionService = s
+}
+
 func (r *RealEnv) GetCrypter() interfaces.Crypter {
 	return r.crypterService
 }
@@ -714,6 +724,14 @@ func (r *RealEnv) SetIPRulesService(e interfaces.IPRulesService) {
 	r.ipRulesService = e
 }
 
+func (r *RealEnv) GetOutboundWebhookService() interfaces.OutboundWebhookService {
+	return r.outboundWebhookService
+}
+
+func (r *RealEnv) SetOutboundWebhookService(s interfaces.OutboundWebhookService) {
+	r.outboundWebhookService = s
+}
+
 func (r *RealEnv) GetClientIdentityService() interfaces.ClientIdentityService {
 	return r.serverIdentityService
 }
@@ -846,3 +864,10 @@ func (r *RealEnv) GetExperimentFlagProvider() interfaces.ExperimentFlagProvider
 func (r *RealEnv) SetExperimentFlagProvider(experimentFlagProvider interfaces.ExperimentFlagProvider) {
 	r.experimentFlagProvider = experimentFlagProvider
 }
+
+func (r *RealEnv) GetBlobSplitter() interfaces.BlobSplitter {
+	return r.blobSplitter
+}
+func (r *RealEnv) SetBlobSplitter(blobSplitter interfaces.BlobSplitter) {
+	r.blobSplitter = blobSplitter
+}
@@ -0,0 +1,351 @@
+// Package asset_mapping stores and resolves URI to CAS content mappings for
+// the remote asset API.
+//
+// Mappings are written by the Push service and consulted by the Fetch service
+// before any network access, so that content which was pushed ahead of time
+// (for example by release tooling, or for air-gapped executors) can be served
+// straight from the cache.
+package asset_mapping
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/interfaces"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/hash"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	ampb "github.com/buildbuddy-io/buildbuddy/proto/asset_mapping"
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+)
+
+const (
+	// Qualifier prefixes that only affect how an asset is downloaded, not
+	// which asset is identified. These are excluded from mapping keys so
+	// that, for example, rotating an auth header doesn't invalidate a
+	// pushed mapping.
+	httpHeaderPrefixQualifier    = "http_header:"
+	httpHeaderUrlPrefixQualifier = "http_header_url:"
+
+	// ChecksumQualifier pins the content of an asset. It is not part of
+	// mapping keys: a mapping is found regardless of whether it was pushed
+	// with a checksum, and Lookup verifies any requested checksum against the
+	// mapped content instead.
+	ChecksumQualifier = "checksum.sri"
+
+	// The digest function used to compute mapping keys. This is independent
+	// of the digest function of the mapped content, so that a mapping can be
+	// found regardless of which digest function the fetch request asks for.
+	keyDigestFunction = repb.DigestFunction_SHA256
+)
+
+func isTransportQualifier(name string) bool {
+	return strings.HasPrefix(name, httpHeaderPrefixQualifier) || strings.HasPrefix(name, httpHeaderUrlPrefixQualifier)
+}
+
+// KeyQualifiers returns the qualifiers that identify an asset, in a
+// canonical order. Qualifiers that only affect the transport, and the
+// checksum qualifier, are dropped.
+func KeyQualifiers(qualifiers []*rapb.Qualifier) []*rapb.Qualifier {
+	out := storedQualifiers(qualifiers)
+	return slices.DeleteFunc(out, func(q *rapb.Qualifier) bool {
+		return q.GetName() == ChecksumQualifier
+	})
+}
+
+// storedQualifiers returns the qualifiers that are stored with a mapping, in
+// a canonical order. Qualifiers that only affect the transport are dropped.
+func storedQualifiers(qualifiers []*rapb.Qualifier) []*rapb.Qualifier {
+	out := make([]*rapb.Qualifier, 0, len(qualifiers))
+	for _, q := range qualifiers {
+		if isTransportQualifier(q.GetName()) {
+			continue
+		}
+		out = append(out, q)
+	}
+	slices.SortFunc(out, func(a, b *rapb.Qualifier) int {
+		if c := strings.Compare(a.GetName(), b.GetName()); c != 0 {
+			return c
+		}
+		return strings.Compare(a.GetValue(), b.GetValue())
+	})
+	return out
+}
+
+func mappingKey(instanceName string, assetType ampb.AssetType, uri string, keyQualifiers []*rapb.Qualifier) (*digest.ACResourceName, error) {
+	parts := []string{assetType.String(), uri}
+	for _, q := range keyQualifiers {
+		parts = append(parts, q.GetName(), q.GetValue())
+	}
+	d, err := digest.Compute(strings.NewReader(hash.Strings(parts...)), keyDigestFunction)
+	if err != nil {
+		return nil, err
+	}
+	return digest.NewACResourceName(d, instanceName, keyDigestFunction), nil
+}
+
+// Write stores the given mapping in the AC under the given instance name.
+func Write(ctx context.Context, cache interfaces.Cache, instanceName string, m *ampb.AssetMapping) error {
+	return write(ctx, cache, instanceName, m, KeyQualifiers(m.GetQualifiers()))
+}
+
+// WritePinned stores a mapping to content that is known to match the
+// mapping's checksum qualifier, such as a directory extracted from an archive
+// that was fetched with a checksum. Unlike Write, the checksum is part of the
+// key, so the mapping is only returned by LookupPinned for requests with the
+// same checksum. Requests without a checksum have to fetch the current
+// content of the URI instead.
+func WritePinned(ctx context.Context, cache interfaces.Cache, instanceName string, m *ampb.AssetMapping) error {
+	if checksumQualifier(m.GetQualifiers()) == nil {
+		return status.InvalidArgumentErrorf("pinned asset mapping is missing a %s qualifier", ChecksumQualifier)
+	}
+	return write(ctx, cache, instanceName, m, storedQualifiers(m.GetQualifiers()))
+}
+
+func write(ctx context.Context, cache interfaces.Cache, instanceName string, m *ampb.AssetMapping, keyQualifiers []*rapb.Qualifier) error {
+	if m.GetUri() == "" {
+		return status.InvalidArgumentError("asset mapping is missing a URI")
+	}
+	rn, err := mappingKey(instanceName, m.GetType(), m.GetUri(), keyQualifiers)
+	if err != nil {
+		return err
+	}
+	stored := proto.Clone(m).(*ampb.AssetMapping)
+	stored.Qualifiers = storedQualifiers(m.GetQualifiers())
+	a, err := anypb.New(stored)
+	if err != nil {
+		return err
+	}
+	ar := &repb.ActionResult{
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			AuxiliaryMetadata: []*anypb.Any{a},
+		},
+	}
+	buf, err := proto.Marshal(ar)
+	if err != nil {
+		return err
+	}
+	return cache.Set(ctx, rn.ToProto(), buf)
+}
+
+func read(ctx context.Context, cache interfaces.Cache, instanceName string, assetType ampb.AssetType, uri string, keyQualifiers []*rapb.Qualifier) (*ampb.AssetMapping, error) {
+	rn, err := mappingKey(instanceName, assetType, uri, keyQualifiers)
+	if err != nil {
+		return nil, err
+	}
+	ar := &repb.ActionResult{}
+	if err := cachetools.ReadProtoFromAC(ctx, cache, rn, ar); err != nil {
+		return nil, err
+	}
+	aux := ar.GetExecutionMetadata().GetAuxiliaryMetadata()
+	if len(aux) != 1 {
+		return nil, status.InternalErrorf("malformed asset mapping for %q: expected 1 auxiliary metadata entry, got %d", uri, len(aux))
+	}
+	m := &ampb.AssetMapping{}
+	if err := aux[0].UnmarshalTo(m); err != nil {
+		return nil, status.InternalErrorf("malformed asset mapping for %q: %s", uri, err)
+	}
+	return m, nil
+}
+
+// Lookup returns the first mapping for any of the given URIs (in order) that
+// has not expired, whose content is still fully present in the CAS, and whose
+// content matches the checksum qualifier, if one is given.
+// Returns a NotFound error if there is no such mapping.
+func Lookup(ctx context.Context, cache interfaces.Cache, now time.Time, instanceName string, assetType ampb.AssetType, uris []string, qualifiers []*rapb.Qualifier) (*ampb.AssetMapping, error) {
+	return lookup(ctx, cache, now, instanceName, assetType, uris, qualifiers, KeyQualifiers(qualifiers))
+}
+
+// LookupPinned is like Lookup, but returns mappings that were stored with
+// WritePinned for the checksum qualifier in the given qualifiers.
+// Returns a NotFound error if there is no checksum qualifier.
+func LookupPinned(ctx context.Context, cache interfaces.Cache, now time.Time, instanceName string, assetType ampb.AssetType, uris []string, qualifiers []*rapb.Qualifier) (*ampb.AssetMapping, error) {
+	if checksumQualifier(qualifiers) == nil {
+		return nil, status.NotFoundErrorf("no %s qualifier to look up pinned asset mappings for", ChecksumQualifier)
+	}
+	return lookup(ctx, cache, now, instanceName, assetType, uris, qualifiers, storedQualifiers(qualifiers))
+}
+
+func checksumQualifier(qualifiers []*rapb.Qualifier) *rapb.Qualifier {
+	var checksum *rapb.Qualifier
+	for _, q := range qualifiers {
+		if q.GetName() == ChecksumQualifier {
+			checksum = q
+		}
+	}
+	return checksum
+}
+
+func lookup(ctx context.Context, cache interfaces.Cache, now time.Time, instanceName string, assetType ampb.AssetType, uris []string, qualifiers, keyQualifiers []*rapb.Qualifier) (*ampb.AssetMapping, error) {
+	checksum := checksumQualifier(qualifiers)
+	for _, uri := range uris {
+		m, err := read(ctx, cache, instanceName, assetType, uri, keyQualifiers)
+		if err != nil {
+			if !status.IsNotFoundError(err) {
+				log.CtxWarningf(ctx, "Failed to read asset mapping for %q: %s", uri, err)
+			}
+			continue
+		}
+		if m.GetExpireAt() != nil && !now.Before(m.GetExpireAt().AsTime()) {
+			log.CtxDebugf(ctx, "Asset mapping for %q expired at %s", uri, m.GetExpireAt().AsTime())
+			continue
+		}
+		if err := CheckContentExists(ctx, cache, instanceName, m); err != nil {
+			log.CtxInfof(ctx, "Ignoring asset mapping for %q: %s", uri, err)
+			continue
+		}
+		if checksum != nil {
+			if err := VerifyChecksum(ctx, cache, instanceName, m, checksum.GetValue()); err != nil {
+				log.CtxInfof(ctx, "Ignoring asset mapping for %q: %s", uri, err)
+				continue
+			}
+		}
+		return m, nil
+	}
+	return nil, status.NotFoundErrorf("no asset mapping found for %s", uris)
+}
+
+// parseChecksum returns the digest function and hex-encoded hash of a
+// subresource integrity value like "sha256-<base64 hash>".
+func parseChecksum(sri string) (repb.DigestFunction_Value, string, error) {
+	for _, digestFunction := range digest.SupportedDigestFunctions() {
+		name := strings.ToLower(repb.DigestFunction_Value_name[int32(digestFunction)])
+		b64Hash, ok := strings.CutPrefix(sri, name+"-")
+		if !ok {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(b64Hash)
+		if err != nil {
+			return repb.DigestFunction_UNKNOWN, "", status.InvalidArgumentErrorf("invalid %s qualifier %q: %s", ChecksumQualifier, sri, err)
+		}
+		return digestFunction, hex.EncodeToString(hash), nil
+	}
+	return repb.DigestFunction_UNKNOWN, "", status.InvalidArgumentErrorf("unsupported %s qualifier %q", ChecksumQualifier, sri)
+}
+
+// VerifyChecksum returns a NotFound error if the content of the mapping can't
+// be verified to match the given checksum.
+//
+// A blob mapping matches if the blob's content has the checksum, and a
+// directory mapping matches if one of the blobs that it references (usually
+// the archive that it was extracted from) has the checksum. Checksum
+// qualifiers stored with the mapping are not trusted.
+func VerifyChecksum(ctx context.Context, cache interfaces.Cache, instanceName string, m *ampb.AssetMapping, sri string) error {
+	checksumFunction, checksumHash, err := parseChecksum(sri)
+	if err != nil {
+		return status.NotFoundErrorf("cannot verify checksum: %s", status.Message(err))
+	}
+	var candidates []*repb.Digest
+	switch m.GetType() {
+	case ampb.AssetType_BLOB:
+		candidates = []*repb.Digest{m.GetDigest()}
+	case ampb.AssetType_DIRECTORY:
+		candidates = m.GetReferencesBlobs()
+	}
+	for _, d := range candidates {
+		if checksumFunction == m.GetDigestFunction() {
+			if d.GetHash() == checksumHash {
+				return nil
+			}
+			continue
+		}
+		// The checksum uses a different digest function than the mapping,
+		// so the content has to be hashed again.
+		rn := digest.NewCASResourceName(d, instanceName, m.GetDigestFunction())
+		r, err := cache.Reader(ctx, rn.ToProto(), 0, 0)
+		if err != nil {
+			return err
+		}
+		computed, err := digest.Compute(r, checksumFunction)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if computed.GetHash() == checksumHash {
+			return nil
+		}
+	}
+	return status.NotFoundErrorf("mapped content does not match checksum %q", sri)
+}
+
+// CheckContentExists returns a NotFound error if the mapped blob or
+// directory tree, or anything that the mapping references, is missing from
+// the CAS. Checking existence also extends the lifetime of the content.
+func CheckContentExists(ctx context.Context, cache interfaces.Cache, instanceName string, m *ampb.AssetMapping) error {
+	digestFunction := m.GetDigestFunction()
+	blobs := slices.Clone(m.GetReferencesBlobs())
+	dirs := slices.Clone(m.GetReferencesDirectories())
+	switch m.GetType() {
+	case ampb.AssetType_BLOB:
+		blobs = append(blobs, m.GetDigest())
+	case ampb.AssetType_DIRECTORY:
+		dirs = append(dirs, m.GetDigest())
+	default:
+		return status.InternalErrorf("unknown asset type %s", m.GetType())
+	}
+	for _, d := range dirs {
+		treeBlobs, err := directoryTreeDigests(ctx, cache, instanceName, digestFunction, d)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, treeBlobs...)
+	}
+	rns := make([]*rspb.ResourceName, 0, len(blobs))
+	for _, d := range blobs {
+		if digest.IsEmptyHash(d, digestFunction) {
+			continue
+		}
+		rns = append(rns, digest.NewResourceName(d, instanceName, rspb.CacheType_CAS, digestFunction).ToProto())
+	}
+	missing, err := cache.FindMissing(ctx, rns)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return status.NotFoundErrorf("%s not found in cache", digest.String(missing[0]))
+	}
+	return nil
+}
+
+// directoryTreeDigests returns the digests of all Directory protos and files
+// in the tree rooted at the given Directory digest.
+func directoryTreeDigests(ctx context.Context, cache interfaces.Cache, instanceName string, digestFunction repb.DigestFunction_Value, root *repb.Digest) ([]*repb.Digest, error) {
+	var out []*repb.Digest
+	visited := make(map[digest.Key]struct{})
+	queue := []*repb.Digest{root}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		if _, ok := visited[digest.NewKey(d)]; ok {
+			continue
+		}
+		visited[digest.NewKey(d)] = struct{}{}
+		out = append(out, d)
+		if digest.IsEmptyHash(d, digestFunction) {
+			continue
+		}
+		dir := &repb.Directory{}
+		rn := digest.NewCASResourceName(d, instanceName, digestFunction)
+		if err := cachetools.ReadProtoFromCAS(ctx, cache, rn, dir); err != nil {
+			return nil, err
+		}
+		for _, f := range dir.GetFiles() {
+			out = append(out, f.GetDigest())
+		}
+		for _, child := range dir.GetDirectories() {
+			queue = append(queue, child.GetDigest())
+		}
+	}
+	return out, nil
+}
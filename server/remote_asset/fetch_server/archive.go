@@ -0,0 +1,427 @@
+package fetch_server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
+	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+var (
+	maxExtractedArchiveSizeBytes = flag.Int64("remote_asset.max_extracted_archive_size_bytes", 10_000_000_000, "Maximum total size of the files extracted from an archive by FetchDirectory.")
+)
+
+type archiveFormat int
+
+const (
+	unknownArchive archiveFormat = iota
+	tarArchive
+	tarGzipArchive
+	tarZstdArchive
+	zipArchive
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic  = []byte{'P', 'K', 0x03, 0x04}
+)
+
+// archiveFormatFromResourceType returns the archive format for a MIME type
+// given in the "resource_type" qualifier.
+func archiveFormatFromResourceType(resourceType string) (archiveFormat, error) {
+	switch resourceType {
+	case "application/x-tar":
+		return tarArchive, nil
+	case "application/gzip", "application/x-gzip", "application/x-compressed-tar":
+		return tarGzipArchive, nil
+	case "application/zstd", "application/x-zstd", "application/x-zstd-compressed-tar":
+		return tarZstdArchive, nil
+	case "application/zip", "application/x-zip-compressed":
+		return zipArchive, nil
+	}
+	return unknownArchive, status.InvalidArgumentErrorf("unsupported resource type %q", resourceType)
+}
+
+// archiveFormatFromURI returns the archive format implied by the file
+// extension in the given URI, if any.
+func archiveFormatFromURI(uri string) archiveFormat {
+	p := uri
+	if u, err := url.Parse(uri); err == nil {
+		p = u.Path
+	}
+	p = strings.ToLower(path.Base(p))
+	switch {
+	case strings.HasSuffix(p, ".tar"):
+		return tarArchive
+	case strings.HasSuffix(p, ".tar.gz"), strings.HasSuffix(p, ".tgz"):
+		return tarGzipArchive
+	case strings.HasSuffix(p, ".tar.zst"), strings.HasSuffix(p, ".tzst"):
+		return tarZstdArchive
+	case strings.HasSuffix(p, ".zip"), strings.HasSuffix(p, ".jar"):
+		return zipArchive
+	}
+	return unknownArchive
+}
+
+// sniffArchiveFormat inspects the first few bytes of the archive to
+// determine its format. Uncompressed tarballs are assumed if nothing else
+// matches.
+func sniffArchiveFormat(f *os.File) (archiveFormat, error) {
+	header := make([]byte, 4)
+	n, err := f.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return unknownArchive, status.UnavailableErrorf("read archive header: %s", err)
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return tarGzipArchive, nil
+	case bytes.HasPrefix(header, zstdMagic):
+		return tarZstdArchive, nil
+	case bytes.HasPrefix(header, zipMagic):
+		return zipArchive, nil
+	}
+	return tarArchive, nil
+}
+
+// extractArchive extracts the archive at archivePath into destDir, which must
+// already exist.
+func extractArchive(archivePath string, format archiveFormat, destDir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return status.UnavailableErrorf("open archive: %s", err)
+	}
+	defer f.Close()
+
+	if format == unknownArchive {
+		format, err = sniffArchiveFormat(f)
+		if err != nil {
+			return err
+		}
+	}
+	limit := &extractionLimit{remaining: *maxExtractedArchiveSizeBytes}
+	switch format {
+	case tarArchive:
+		return extractTar(bufio.NewReader(f), destDir, limit)
+	case tarGzipArchive:
+		gzr, err := gzip.NewReader(bufio.NewReader(f))
+		if err != nil {
+			return status.InvalidArgumentErrorf("read gzip archive: %s", err)
+		}
+		defer gzr.Close()
+		return extractTar(gzr, destDir, limit)
+	case tarZstdArchive:
+		zr, err := compression.NewZstdDecompressingReader(f)
+		if err != nil {
+			return status.InvalidArgumentErrorf("read zstd archive: %s", err)
+		}
+		defer zr.Close()
+		return extractTar(zr, destDir, limit)
+	case zipArchive:
+		info, err := f.Stat()
+		if err != nil {
+			return status.UnavailableErrorf("stat archive: %s", err)
+		}
+		zr, err := zip.NewReader(f, info.Size())
+		if err != nil {
+			return status.InvalidArgumentErrorf("read zip archive: %s", err)
+		}
+		return extractZip(zr, destDir, limit)
+	}
+	return status.InvalidArgumentError("unknown archive format")
+}
+
+// extractionLimit guards against archives that expand to an unreasonable
+// size.
+type extractionLimit struct {
+	remaining int64
+}
+
+func (l *extractionLimit) copy(w io.Writer, r io.Reader) error {
+	n, err := io.Copy(w, io.LimitReader(r, l.remaining+1))
+	l.remaining -= n
+	if err != nil {
+		return status.UnavailableErrorf("extract file: %s", err)
+	}
+	if l.remaining < 0 {
+		return status.ResourceExhaustedErrorf("archive exceeds the maximum extracted size of %d bytes", *maxExtractedArchiveSizeBytes)
+	}
+	return nil
+}
+
+// safeJoin returns the path of the archive entry with the given name inside
+// destDir, or an error if the name would escape destDir.
+func safeJoin(destDir, name string) (string, error) {
+	rel, err := entryPath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(destDir, rel), nil
+}
+
+// entryPath returns the cleaned path of the archive entry with the given
+// name, relative to the extraction directory.
+func entryPath(name string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(cleaned) || escapes(cleaned) {
+		return "", status.InvalidArgumentErrorf("invalid archive entry name %q", name)
+	}
+	return cleaned, nil
+}
+
+func escapes(cleaned string) bool {
+	return cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(os.PathSeparator))
+}
+
+// extraction writes archive entries into a destination directory. All file
+// system access goes through an os.Root, so that symlinks created by earlier
+// entries can't be used to read or write files outside of the directory.
+type extraction struct {
+	root    *os.Root
+	destDir string
+	limit   *extractionLimit
+}
+
+func newExtraction(destDir string, limit *extractionLimit) (*extraction, error) {
+	root, err := os.OpenRoot(destDir)
+	if err != nil {
+		return nil, status.UnavailableErrorf("open extraction directory: %s", err)
+	}
+	return &extraction{root: root, destDir: destDir, limit: limit}, nil
+}
+
+func (e *extraction) Close() error {
+	return e.root.Close()
+}
+
+// mkdirAll creates the directory rel and any missing parents.
+func (e *extraction) mkdirAll(rel string) error {
+	if rel == "." {
+		return nil
+	}
+	if err := e.mkdirAll(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	if err := e.root.Mkdir(rel, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+		return status.InvalidArgumentErrorf("create directory %q: %s", rel, err)
+	}
+	info, err := e.root.Stat(rel)
+	if err != nil {
+		return status.InvalidArgumentErrorf("create directory %q: %s", rel, err)
+	}
+	if !info.IsDir() {
+		return status.InvalidArgumentErrorf("create directory %q: not a directory", rel)
+	}
+	return nil
+}
+
+func (e *extraction) writeFile(rel string, executable bool, r io.Reader) error {
+	if err := e.mkdirAll(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if executable {
+		mode = 0755
+	}
+	// Don't write through a symlink created by an earlier entry with the
+	// same name.
+	if info, err := e.root.Lstat(rel); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		return status.InvalidArgumentErrorf("archive entry %q overwrites a symlink", rel)
+	}
+	f, err := e.root.OpenFile(rel, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return status.InvalidArgumentErrorf("create file %q: %s", rel, err)
+	}
+	defer f.Close()
+	return e.limit.copy(f, r)
+}
+
+// symlink creates a symlink at rel. Absolute targets and targets that point
+// outside of the extraction directory are rejected.
+func (e *extraction) symlink(rel, target string) error {
+	if target == "" || filepath.IsAbs(target) || escapes(filepath.Join(filepath.Dir(rel), target)) {
+		return status.InvalidArgumentErrorf("invalid symlink %q -> %q", rel, target)
+	}
+	parent := filepath.Dir(rel)
+	if err := e.mkdirAll(parent); err != nil {
+		return err
+	}
+	// The parent was created inside the root, but may have been reached
+	// through other symlinks. Make sure the path we hand to os.Symlink
+	// resolves to the same place.
+	if err := e.checkInside(filepath.Join(e.destDir, parent)); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, filepath.Join(e.destDir, rel)); err != nil {
+		return status.InvalidArgumentErrorf("create symlink %q: %s", rel, err)
+	}
+	return nil
+}
+
+// link copies the regular file at target to rel. Links are copied rather than
+// created, so that the two files are uploaded as independent FileNodes.
+func (e *extraction) link(rel, target string) error {
+	src, err := e.root.Open(target)
+	if err != nil {
+		return status.InvalidArgumentErrorf("invalid hard link %q -> %q: %s", rel, target, err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return status.UnavailableErrorf("stat %q: %s", target, err)
+	}
+	if !info.Mode().IsRegular() {
+		return status.InvalidArgumentErrorf("invalid hard link %q -> %q: not a regular file", rel, target)
+	}
+	return e.writeFile(rel, info.Mode()&0100 != 0, src)
+}
+
+// checkInside returns an error if the given path, after resolving symlinks,
+// is outside of the extraction directory.
+func (e *extraction) checkInside(path string) error {
+	return checkResolvesInside(e.destDir, path)
+}
+
+// checkResolvesInside returns an error if path, after resolving symlinks, is
+// not dir or one of its descendants.
+func checkResolvesInside(dir, path string) error {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return status.UnavailableErrorf("resolve %q: %s", dir, err)
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return status.InvalidArgumentErrorf("resolve %q: %s", path, err)
+	}
+	rel, err := filepath.Rel(realDir, realPath)
+	if err != nil || filepath.IsAbs(rel) || escapes(rel) {
+		return status.InvalidArgumentErrorf("%q resolves outside of the archive", path)
+	}
+	return nil
+}
+
+// checkSymlinks walks the extracted tree and rejects any symlink that
+// resolves outside of destDir. Each symlink target was checked lexically when
+// it was created, but a chain of symlinks can still escape.
+func checkSymlinks(destDir string) error {
+	return filepath.WalkDir(destDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return status.UnavailableErrorf("walk extracted archive: %s", err)
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		if _, err := filepath.EvalSymlinks(path); errors.Is(err, fs.ErrNotExist) {
+			// Dangling symlinks are never followed.
+			return nil
+		}
+		return checkResolvesInside(destDir, path)
+	})
+}
+
+func extractTar(r io.Reader, destDir string, limit *extractionLimit) error {
+	e, err := newExtraction(destDir, limit)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return checkSymlinks(destDir)
+		}
+		if err != nil {
+			return status.InvalidArgumentErrorf("read tar archive: %s", err)
+		}
+		rel, err := entryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := e.mkdirAll(rel); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := e.writeFile(rel, header.Mode&0100 != 0, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := e.symlink(rel, header.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := entryPath(header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := e.link(rel, target); err != nil {
+				return err
+			}
+		default:
+			// Device files, FIFOs, etc. can't be represented in a Directory.
+			continue
+		}
+	}
+}
+
+func extractZip(zr *zip.Reader, destDir string, limit *extractionLimit) error {
+	e, err := newExtraction(destDir, limit)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	for _, entry := range zr.File {
+		rel, err := entryPath(entry.Name)
+		if err != nil {
+			return err
+		}
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			if err := e.mkdirAll(rel); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			rc, err := entry.Open()
+			if err != nil {
+				return status.InvalidArgumentErrorf("read zip entry %q: %s", entry.Name, err)
+			}
+			target := &strings.Builder{}
+			err = limit.copy(target, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := e.symlink(rel, target.String()); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := entry.Open()
+			if err != nil {
+				return status.InvalidArgumentErrorf("read zip entry %q: %s", entry.Name, err)
+			}
+			err = e.writeFile(rel, mode&0100 != 0, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return checkSymlinks(destDir)
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +18,7 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/http/httpclient"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/asset_mapping"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/util/flag"
@@ -25,7 +27,9 @@ import (
 	"github.com/buildbuddy-io/buildbuddy/server/util/scratchspace"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	ampb "github.com/buildbuddy-io/buildbuddy/proto/asset_mapping"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
 	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 	bspb "google.golang.org/genproto/googleapis/bytestream"
@@ -36,7 +40,8 @@ import (
 )
 
 var (
-	allowedPrivateIPs = flag.Slice("remote_asset.allowed_private_ips", []string{}, "Allowed IP ranges for fetching remote assets. Private IPs are disallowed by default.")
+	allowedPrivateIPs     = flag.Slice("remote_asset.allowed_private_ips", []string{}, "Allowed IP ranges for fetching remote assets. Private IPs are disallowed by default.")
+	extractedDirectoryTTL = flag.Duration("remote_asset.extracted_directory_ttl", 24*time.Hour, "How long FetchDirectory remembers the directory extracted from an archive that was fetched with a checksum.")
 )
 
 const (
@@ -44,6 +49,12 @@ const (
 	BazelCanonicalIDQualifier         = "bazel.canonical_id"
 	BazelHttpHeaderPrefixQualifier    = "http_header:"
 	BazelHttpHeaderUrlPrefixQualifier = "http_header_url:"
+	// ResourceTypeQualifier is the MIME type of the fetched archive. If it is
+	// not set, the archive type is inferred from the URI and the contents.
+	ResourceTypeQualifier = "resource_type"
+	// DirectoryQualifier is a path within the fetched archive. If set, only
+	// that subdirectory is returned by FetchDirectory.
+	DirectoryQualifier = "directory"
 
 	maxHTTPTimeout = 60 * time.Minute
 )
@@ -160,6 +171,26 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 	if storageFunc == repb.DigestFunction_UNKNOWN {
 		storageFunc = repb.DigestFunction_SHA256
 	}
+
+	// Blobs pushed via the Push service take precedence over everything
+	// else, and never require network access.
+	if m := p.findPushedAsset(ctx, req.GetInstanceName(), ampb.AssetType_BLOB, req.GetUris(), req.GetQualifiers()); m != nil {
+		blobDigest := m.GetDigest()
+		if m.GetDigestFunction() != storageFunc {
+			blobDigest = p.rewriteToCache(ctx, blobDigest, req.GetInstanceName(), m.GetDigestFunction(), storageFunc)
+		}
+		if blobDigest != nil {
+			return &rapb.FetchBlobResponse{
+				Status:         &statuspb.Status{Code: int32(gcodes.OK)},
+				Uri:            m.GetUri(),
+				Qualifiers:     m.GetQualifiers(),
+				ExpiresAt:      m.GetExpireAt(),
+				BlobDigest:     blobDigest,
+				DigestFunction: storageFunc,
+			}, nil
+		}
+	}
+
 	var unsupportedQualifierNames []string
 	sharedHeader := make(http.Header)
 	uriHeaders := make(map[int]http.Header)
@@ -309,7 +340,213 @@ func (p *FetchServer) FetchBlob(ctx context.Context, req *rapb.FetchBlobRequest)
 }
 
 func (p *FetchServer) FetchDirectory(ctx context.Context, req *rapb.FetchDirectoryRequest) (*rapb.FetchDirectoryResponse, error) {
-	return nil, status.UnimplementedError("FetchDirectory is not yet implemented")
+	// Keep the original context for FetchBlob, which attaches the user
+	// prefix itself.
+	fetchCtx := ctx
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+
+	storageFunc := req.GetDigestFunction()
+	if storageFunc == repb.DigestFunction_UNKNOWN {
+		storageFunc = repb.DigestFunction_SHA256
+	}
+	// Directory digests can't be rewritten to a different digest function
+	// without re-hashing the whole tree, so only directories stored with the
+	// requested digest function are returned. This covers both directories
+	// added with PushDirectory and archives that were previously extracted.
+	m := p.findPushedAsset(ctx, req.GetInstanceName(), ampb.AssetType_DIRECTORY, req.GetUris(), req.GetQualifiers())
+	if m == nil || m.GetDigestFunction() != storageFunc {
+		m = p.findExtractedDirectory(ctx, req.GetInstanceName(), req.GetUris(), req.GetQualifiers())
+	}
+	if m != nil && m.GetDigestFunction() == storageFunc {
+		return &rapb.FetchDirectoryResponse{
+			Status:              &statuspb.Status{Code: int32(gcodes.OK)},
+			Uri:                 m.GetUri(),
+			Qualifiers:          m.GetQualifiers(),
+			ExpiresAt:           m.GetExpireAt(),
+			RootDirectoryDigest: m.GetDigest(),
+			DigestFunction:      storageFunc,
+		}, nil
+	}
+
+	// Split off the qualifiers that describe how to turn the archive into a
+	// directory. The rest are handled by FetchBlob when fetching the archive.
+	format := unknownArchive
+	subdir := ""
+	hasChecksum := false
+	blobQualifiers := make([]*rapb.Qualifier, 0, len(req.GetQualifiers()))
+	for _, qualifier := range req.GetQualifiers() {
+		switch qualifier.GetName() {
+		case ResourceTypeQualifier:
+			format, err = archiveFormatFromResourceType(qualifier.GetValue())
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case DirectoryQualifier:
+			subdir = qualifier.GetValue()
+			continue
+		case ChecksumQualifier:
+			hasChecksum = true
+		}
+		blobQualifiers = append(blobQualifiers, qualifier)
+	}
+
+	blobRsp, err := p.FetchBlob(fetchCtx, &rapb.FetchBlobRequest{
+		InstanceName:          req.GetInstanceName(),
+		Timeout:               req.GetTimeout(),
+		OldestContentAccepted: req.GetOldestContentAccepted(),
+		Uris:                  req.GetUris(),
+		Qualifiers:            blobQualifiers,
+		DigestFunction:        storageFunc,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if blobRsp.GetStatus().GetCode() != int32(gcodes.OK) {
+		return &rapb.FetchDirectoryResponse{
+			Status: blobRsp.GetStatus(),
+			Uri:    blobRsp.GetUri(),
+			// See the comment on the FetchBlob NotFound response.
+			RootDirectoryDigest: blobRsp.GetBlobDigest(),
+		}, nil
+	}
+	if format == unknownArchive {
+		format = archiveFormatFromURI(blobRsp.GetUri())
+	}
+
+	rootDigest, err := p.extractToCache(ctx, req.GetInstanceName(), storageFunc, blobRsp.GetBlobDigest(), format, subdir)
+	if err != nil {
+		return &rapb.FetchDirectoryResponse{
+			Status: &statuspb.Status{
+				Code:    int32(gstatus.Code(err)),
+				Message: fmt.Sprintf("%s: %s", blobRsp.GetUri(), status.Message(err)),
+			},
+			Uri: blobRsp.GetUri(),
+		}, nil
+	}
+
+	// Remember the extracted directory so that subsequent fetches can skip
+	// the download and extraction. This is only safe if the request pins
+	// the archive contents with a checksum; otherwise the content at the
+	// URI may change. The mapping is keyed by the checksum, so that fetches
+	// without one still get the current content.
+	if hasChecksum && blobRsp.GetUri() != "" {
+		now := p.env.GetClock().Now()
+		mapping := &ampb.AssetMapping{
+			Type:           ampb.AssetType_DIRECTORY,
+			Uri:            blobRsp.GetUri(),
+			Qualifiers:     req.GetQualifiers(),
+			Digest:         rootDigest,
+			DigestFunction: storageFunc,
+			PushTime:       timestamppb.New(now),
+			ExpireAt:       timestamppb.New(now.Add(*extractedDirectoryTTL)),
+			// Lookups verify the checksum against the archive.
+			ReferencesBlobs: []*repb.Digest{blobRsp.GetBlobDigest()},
+		}
+		if err := asset_mapping.WritePinned(ctx, p.env.GetCache(), req.GetInstanceName(), mapping); err != nil {
+			log.CtxWarningf(ctx, "Failed to store directory mapping for %q: %s", blobRsp.GetUri(), err)
+		}
+	}
+
+	return &rapb.FetchDirectoryResponse{
+		Status:              &statuspb.Status{Code: int32(gcodes.OK)},
+		Uri:                 blobRsp.GetUri(),
+		RootDirectoryDigest: rootDigest,
+		DigestFunction:      storageFunc,
+	}, nil
+}
+
+// extractToCache downloads the archive with the given digest from the cache,
+// extracts it, and uploads the resulting directory tree to the CAS. It
+// returns the digest of the root Directory.
+func (p *FetchServer) extractToCache(ctx context.Context, instanceName string, digestFunction repb.DigestFunction_Value, archiveDigest *repb.Digest, format archiveFormat, subdir string) (*repb.Digest, error) {
+	f, err := scratchspace.CreateTemp("remote-asset-archive-*")
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create temp file for archive: %s", err)
+	}
+	defer func() {
+		if err := os.Remove(f.Name()); err != nil {
+			log.Errorf("Failed to remove temp file: %s", err)
+		}
+	}()
+	rn := digest.NewCASResourceName(archiveDigest, instanceName, digestFunction)
+	err = cachetools.GetBlob(ctx, p.env.GetByteStreamClient(), rn, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to read archive %s from cache: %s", digest.String(archiveDigest), err)
+	}
+
+	extractDir, err := scratchspace.MkdirTemp("remote-asset-extract-*")
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to create temp dir for archive: %s", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(extractDir); err != nil {
+			log.Errorf("Failed to remove temp dir: %s", err)
+		}
+	}()
+	if err := extractArchive(f.Name(), format, extractDir); err != nil {
+		return nil, err
+	}
+
+	rootDir := extractDir
+	if subdir != "" {
+		rootDir, err = safeJoin(extractDir, subdir)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(rootDir); err != nil || !info.IsDir() {
+			return nil, status.NotFoundErrorf("directory %q not found in archive", subdir)
+		}
+		// The subdirectory may be reached through symlinks in the archive;
+		// don't upload anything that lives outside of it.
+		if err := checkResolvesInside(extractDir, rootDir); err != nil {
+			return nil, err
+		}
+		if rootDir, err = filepath.EvalSymlinks(rootDir); err != nil {
+			return nil, status.NotFoundErrorf("directory %q not found in archive", subdir)
+		}
+	}
+	rootDigest, _, err := cachetools.UploadDirectoryToCAS(ctx, p.env, instanceName, digestFunction, rootDir)
+	if err != nil {
+		return nil, status.UnavailableErrorf("failed to upload extracted archive: %s", err)
+	}
+	log.CtxDebugf(ctx, "Extracted archive %s to directory %s", digest.String(archiveDigest), digest.String(rootDigest))
+	return rootDigest, nil
+}
+
+// findPushedAsset returns the mapping stored by the Push service for the
+// first of the given URIs that has a valid one, or nil if there is none.
+func (p *FetchServer) findPushedAsset(ctx context.Context, instanceName string, assetType ampb.AssetType, uris []string, qualifiers []*rapb.Qualifier) *ampb.AssetMapping {
+	m, err := asset_mapping.Lookup(ctx, p.env.GetCache(), p.env.GetClock().Now(), instanceName, assetType, uris, qualifiers)
+	if err != nil {
+		if !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Failed to look up pushed asset for %s: %s", uris, err)
+		}
+		return nil
+	}
+	log.CtxDebugf(ctx, "FetchServer found pushed asset %q -> %s", m.GetUri(), digest.String(m.GetDigest()))
+	return m
+}
+
+// findExtractedDirectory returns the directory that was previously extracted
+// from an archive fetched from the first of the given URIs with the same
+// checksum qualifier, or nil if there is none.
+func (p *FetchServer) findExtractedDirectory(ctx context.Context, instanceName string, uris []string, qualifiers []*rapb.Qualifier) *ampb.AssetMapping {
+	m, err := asset_mapping.LookupPinned(ctx, p.env.GetCache(), p.env.GetClock().Now(), instanceName, ampb.AssetType_DIRECTORY, uris, qualifiers)
+	if err != nil {
+		if !status.IsNotFoundError(err) {
+			log.CtxWarningf(ctx, "Failed to look up extracted directory for %s: %s", uris, err)
+		}
+		return nil
+	}
+	log.CtxDebugf(ctx, "FetchServer found extracted directory %q -> %s", m.GetUri(), digest.String(m.GetDigest()))
+	return m
 }
 
 func (p *FetchServer) rewriteToCache(ctx context.Context, blobDigest *repb.Digest, instanceName string, fromFunc, toFunc repb.DigestFunction_Value) *repb.Digest {
@@ -1,21 +1,30 @@
 package fetch_server_test
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/buildbuddy-io/buildbuddy/proto/resource"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/content_addressable_storage_server"
 	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
 	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/compression"
 	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
 	"github.com/buildbuddy-io/buildbuddy/server/util/scratchspace"
@@ -35,6 +44,8 @@ import (
 func runFetchServer(ctx context.Context, t *testing.T, env *testenv.TestEnv) *grpc.ClientConn {
 	byteStreamServer, err := byte_stream_server.NewByteStreamServer(env)
 	require.NoError(t, err)
+	casServer, err := content_addressable_storage_server.NewContentAddressableStorageServer(env)
+	require.NoError(t, err)
 
 	// Allow 127.0.0.1 so we can dial the server in the test.
 	flags.Set(t, "remote_asset.allowed_private_ips", []string{"127.0.0.0/8"})
@@ -44,6 +55,7 @@ func runFetchServer(ctx context.Context, t *testing.T, env *testenv.TestEnv) *gr
 
 	grpcServer, runFunc, lis := testenv.RegisterLocalGRPCServer(t, env)
 	bspb.RegisterByteStreamServer(grpcServer, byteStreamServer)
+	repb.RegisterContentAddressableStorageServer(grpcServer, casServer)
 	rapb.RegisterFetchServer(grpcServer, fetchServer)
 
 	go runFunc()
@@ -52,6 +64,7 @@ func runFetchServer(ctx context.Context, t *testing.T, env *testenv.TestEnv) *gr
 	require.NoError(t, err)
 
 	env.SetByteStreamClient(bspb.NewByteStreamClient(clientConn))
+	env.SetContentAddressableStorageClient(repb.NewContentAddressableStorageClient(clientConn))
 	return clientConn
 }
 
@@ -583,13 +596,410 @@ func TestFetchBlobWithUnknownQualifiers(t *testing.T) {
 	assert.True(t, proto.Equal(expectedDetail, actualDetail))
 }
 
-func TestFetchDirectory(t *testing.T) {
+func TestFetchDirectory_Unavailable(t *testing.T) {
 	ctx := context.Background()
 	te := testenv.GetTestEnv(t)
 	clientConn := runFetchServer(ctx, t, te)
 	fetchClient := rapb.NewFetchClient(clientConn)
 
-	resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{})
-	assert.EqualError(t, err, "rpc error: code = Unimplemented desc = FetchDirectory is not yet implemented")
-	assert.Nil(t, resp)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris: []string{ts.URL + "/archive.tar.gz"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), resp.GetStatus().GetCode())
+}
+
+func makeTar(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+		})
+		require.NoError(t, err)
+		_, err = tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func makeTarGz(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	_, err := gw.Write(makeTar(t, files))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func makeTarZst(t *testing.T, files map[string]string) []byte {
+	return compression.CompressZstd(nil, makeTar(t, files))
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestFetchDirectory(t *testing.T) {
+	files := map[string]string{
+		"repo-1.0/BUILD":         "# BUILD",
+		"repo-1.0/src/main.go":   "package main",
+		"repo-1.0/src/README.md": "readme",
+	}
+	for _, tc := range []struct {
+		name       string
+		path       string
+		archive    []byte
+		qualifiers []*rapb.Qualifier
+	}{
+		{
+			name:    "tar",
+			path:    "/archive.tar",
+			archive: makeTar(t, files),
+		},
+		{
+			name:    "tar.gz",
+			path:    "/archive.tar.gz",
+			archive: makeTarGz(t, files),
+		},
+		{
+			name:    "tar.zst",
+			path:    "/archive.tar.zst",
+			archive: makeTarZst(t, files),
+		},
+		{
+			name:    "zip",
+			path:    "/archive.zip",
+			archive: makeZip(t, files),
+		},
+		{
+			name:    "sniffed_gzip",
+			path:    "/download?id=123",
+			archive: makeTarGz(t, files),
+		},
+		{
+			name:    "resource_type",
+			path:    "/download",
+			archive: makeZip(t, files),
+			qualifiers: []*rapb.Qualifier{
+				{Name: fetch_server.ResourceTypeQualifier, Value: "application/zip"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			require.NoError(t, scratchspace.Init())
+			clientConn := runFetchServer(ctx, t, te)
+			fetchClient := rapb.NewFetchClient(clientConn)
+
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Write(tc.archive)
+			}))
+			defer ts.Close()
+
+			archiveDigest, err := digest.Compute(bytes.NewReader(tc.archive), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+			qualifiers := append(tc.qualifiers,
+				&rapb.Qualifier{
+					Name:  fetch_server.ChecksumQualifier,
+					Value: checksumQualifierFromContent(t, archiveDigest.GetHash(), repb.DigestFunction_SHA256),
+				},
+				&rapb.Qualifier{
+					Name:  fetch_server.DirectoryQualifier,
+					Value: "repo-1.0",
+				},
+			)
+			req := &rapb.FetchDirectoryRequest{
+				Uris:       []string{ts.URL + tc.path},
+				Qualifiers: qualifiers,
+			}
+			resp, err := fetchClient.FetchDirectory(ctx, req)
+			require.NoError(t, err)
+			require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+			assert.Equal(t, ts.URL+tc.path, resp.GetUri())
+
+			casClient := repb.NewContentAddressableStorageClient(clientConn)
+			rn := digest.NewCASResourceName(resp.GetRootDirectoryDigest(), "", repb.DigestFunction_SHA256)
+			tree, err := cachetools.GetTreeFromRootDirectoryDigest(ctx, casClient, rn)
+			require.NoError(t, err)
+			require.Len(t, tree.GetRoot().GetFiles(), 1)
+			assert.Equal(t, "BUILD", tree.GetRoot().GetFiles()[0].GetName())
+			require.Len(t, tree.GetRoot().GetDirectories(), 1)
+			assert.Equal(t, "src", tree.GetRoot().GetDirectories()[0].GetName())
+			require.Len(t, tree.GetChildren(), 1)
+			assert.Len(t, tree.GetChildren()[0].GetFiles(), 2)
+
+			// The extracted directory is remembered, so a second fetch
+			// doesn't hit the network.
+			resp2, err := fetchClient.FetchDirectory(ctx, req)
+			require.NoError(t, err)
+			require.Equal(t, int32(gcodes.OK), resp2.GetStatus().GetCode())
+			assert.Equal(t, resp.GetRootDirectoryDigest().GetHash(), resp2.GetRootDirectoryDigest().GetHash())
+			assert.Equal(t, int32(1), requests.Load())
+		})
+	}
+}
+
+func TestFetchDirectory_ExtractedDirectoryMapping(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ttl  time.Duration
+		// Whether the second fetch includes the checksum.
+		withChecksum     bool
+		expectedRequests int32
+	}{
+		{name: "same checksum", ttl: time.Hour, withChecksum: true, expectedRequests: 1},
+		{name: "no checksum", ttl: time.Hour, withChecksum: false, expectedRequests: 2},
+		{name: "expired", ttl: 0, withChecksum: true, expectedRequests: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flags.Set(t, "remote_asset.extracted_directory_ttl", tc.ttl)
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			require.NoError(t, scratchspace.Init())
+			clientConn := runFetchServer(ctx, t, te)
+			fetchClient := rapb.NewFetchClient(clientConn)
+
+			archive := makeTar(t, map[string]string{"BUILD": "# BUILD"})
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Write(archive)
+			}))
+			defer ts.Close()
+
+			archiveDigest, err := digest.Compute(bytes.NewReader(archive), repb.DigestFunction_SHA256)
+			require.NoError(t, err)
+			checksum := &rapb.Qualifier{
+				Name:  fetch_server.ChecksumQualifier,
+				Value: checksumQualifierFromContent(t, archiveDigest.GetHash(), repb.DigestFunction_SHA256),
+			}
+			resp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+				Uris:       []string{ts.URL + "/archive.tar"},
+				Qualifiers: []*rapb.Qualifier{checksum},
+			})
+			require.NoError(t, err)
+			require.Equal(t, int32(gcodes.OK), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+
+			req := &rapb.FetchDirectoryRequest{Uris: []string{ts.URL + "/archive.tar"}}
+			if tc.withChecksum {
+				req.Qualifiers = []*rapb.Qualifier{checksum}
+			}
+			resp2, err := fetchClient.FetchDirectory(ctx, req)
+			require.NoError(t, err)
+			require.Equal(t, int32(gcodes.OK), resp2.GetStatus().GetCode(), resp2.GetStatus().GetMessage())
+			assert.Equal(t, resp.GetRootDirectoryDigest().GetHash(), resp2.GetRootDirectoryDigest().GetHash())
+			assert.Equal(t, tc.expectedRequests, requests.Load())
+		})
+	}
+}
+
+// archiveEntry is a regular file, symlink, or hard link in a test archive.
+type archiveEntry struct {
+	name     string
+	content  string
+	symlink  string
+	hardlink string
+}
+
+func makeTarEntries(t *testing.T, entries []archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     e.name,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+		}
+		if e.symlink != "" {
+			header = &tar.Header{Typeflag: tar.TypeSymlink, Name: e.name, Linkname: e.symlink, Mode: 0777}
+		} else if e.hardlink != "" {
+			header = &tar.Header{Typeflag: tar.TypeLink, Name: e.name, Linkname: e.hardlink, Mode: 0644}
+		}
+		require.NoError(t, tw.WriteHeader(header))
+		_, err := tw.Write([]byte(e.content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func makeZipEntries(t *testing.T, entries []archiveEntry) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		header := &zip.FileHeader{Name: e.name, Method: zip.Deflate}
+		content := e.content
+		if e.symlink != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			content = e.symlink
+		}
+		w, err := zw.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func TestFetchDirectory_PathTraversal(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		archive  []byte
+		subdir   string
+		wantCode gcodes.Code
+	}{
+		{
+			name:     "tar_parent_dir_entry",
+			path:     "/archive.tar",
+			archive:  makeTar(t, map[string]string{"../escape.txt": "oops"}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name:     "zip_parent_dir_entry",
+			path:     "/archive.zip",
+			archive:  makeZip(t, map[string]string{"../escape.txt": "oops"}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name:     "tar_absolute_symlink",
+			path:     "/archive.tar",
+			archive:  makeTarEntries(t, []archiveEntry{{name: "passwd", symlink: "/etc/passwd"}}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name:     "tar_escaping_symlink",
+			path:     "/archive.tar",
+			archive:  makeTarEntries(t, []archiveEntry{{name: "a/etc", symlink: "../../../../etc"}}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name:     "zip_absolute_symlink",
+			path:     "/archive.zip",
+			archive:  makeZipEntries(t, []archiveEntry{{name: "passwd", symlink: "/etc/passwd"}}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name:     "zip_escaping_symlink",
+			path:     "/archive.zip",
+			archive:  makeZipEntries(t, []archiveEntry{{name: "a/etc", symlink: "../../../../etc"}}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			// Each target looks fine on its own, but b resolves through a
+			// to a directory above the archive root.
+			name: "tar_write_through_chained_symlinks",
+			path: "/archive.tar",
+			archive: makeTarEntries(t, []archiveEntry{
+				{name: "p/q/a", symlink: "../.."},
+				{name: "p/q/b", symlink: "a/../.."},
+				{name: "p/q/b/escape.txt", content: "oops"},
+			}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name: "tar_chained_symlinks",
+			path: "/archive.tar",
+			archive: makeTarEntries(t, []archiveEntry{
+				{name: "p/q/a", symlink: "../.."},
+				{name: "p/q/b", symlink: "a/../.."},
+			}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name: "tar_write_through_symlink_with_same_name",
+			path: "/archive.tar",
+			archive: makeTarEntries(t, []archiveEntry{
+				{name: "target.txt", content: "original"},
+				{name: "link", symlink: "target.txt"},
+				{name: "link", content: "oops"},
+			}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name: "tar_parent_dir_hard_link",
+			path: "/archive.tar",
+			archive: makeTarEntries(t, []archiveEntry{
+				{name: "passwd", hardlink: "../../../../etc/passwd"},
+			}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name: "tar_hard_link_through_symlink",
+			path: "/archive.tar",
+			archive: makeTarEntries(t, []archiveEntry{
+				{name: "p/q/a", symlink: "../.."},
+				{name: "p/q/b", symlink: "a/../.."},
+				{name: "passwd", hardlink: "p/q/b/etc/passwd"},
+			}),
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name:     "subdir_parent_dir",
+			path:     "/archive.tar",
+			archive:  makeTar(t, map[string]string{"repo/BUILD": ""}),
+			subdir:   "../..",
+			wantCode: gcodes.InvalidArgument,
+		},
+		{
+			name: "symlinks_inside_archive",
+			path: "/archive.tar",
+			archive: makeTarEntries(t, []archiveEntry{
+				{name: "repo/src/main.go", content: "package main"},
+				{name: "repo/lib", symlink: "src"},
+				{name: "repo/lib/util.go", content: "package main"},
+				{name: "repo/main.go", hardlink: "repo/src/main.go"},
+				{name: "root", symlink: "repo"},
+			}),
+			subdir:   "root",
+			wantCode: gcodes.OK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			te := testenv.GetTestEnv(t)
+			require.NoError(t, scratchspace.Init())
+			clientConn := runFetchServer(ctx, t, te)
+			fetchClient := rapb.NewFetchClient(clientConn)
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tc.archive)
+			}))
+			defer ts.Close()
+
+			req := &rapb.FetchDirectoryRequest{
+				Uris: []string{ts.URL + tc.path},
+			}
+			if tc.subdir != "" {
+				req.Qualifiers = []*rapb.Qualifier{{Name: fetch_server.DirectoryQualifier, Value: tc.subdir}}
+			}
+			resp, err := fetchClient.FetchDirectory(ctx, req)
+			require.NoError(t, err)
+			assert.Equal(t, int32(tc.wantCode), resp.GetStatus().GetCode(), resp.GetStatus().GetMessage())
+		})
+	}
 }
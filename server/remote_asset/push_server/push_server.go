@@ -5,9 +5,18 @@ import (
 
 	"github.com/buildbuddy-io/buildbuddy/server/environment"
 	"github.com/buildbuddy-io/buildbuddy/server/real_environment"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/asset_mapping"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/digest"
+	"github.com/buildbuddy-io/buildbuddy/server/util/capabilities"
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
 	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
+	ampb "github.com/buildbuddy-io/buildbuddy/proto/asset_mapping"
+	cappb "github.com/buildbuddy-io/buildbuddy/proto/capability"
 	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
 )
 
 type PushServer struct {
@@ -29,10 +38,102 @@ func NewPushServer(env environment.Env) *PushServer {
 	}
 }
 
+// PushBlob associates the given URIs and qualifiers with a blob that is
+// already in the CAS, so that later FetchBlob requests for any of the URIs
+// can be answered from the cache.
 func (p *PushServer) PushBlob(ctx context.Context, req *rapb.PushBlobRequest) (*rapb.PushBlobResponse, error) {
-	return nil, status.UnimplementedError("PushBlob is not yet implemented")
+	m := &ampb.AssetMapping{
+		Type:                  ampb.AssetType_BLOB,
+		Qualifiers:            req.GetQualifiers(),
+		Digest:                req.GetBlobDigest(),
+		DigestFunction:        req.GetDigestFunction(),
+		ExpireAt:              req.GetExpireAt(),
+		ReferencesBlobs:       req.GetReferencesBlobs(),
+		ReferencesDirectories: req.GetReferencesDirectories(),
+	}
+	if err := p.push(ctx, req.GetInstanceName(), req.GetUris(), m); err != nil {
+		return nil, err
+	}
+	return &rapb.PushBlobResponse{}, nil
 }
 
+// PushDirectory associates the given URIs and qualifiers with a Directory
+// tree that is already in the CAS, so that later FetchDirectory requests for
+// any of the URIs can be answered from the cache.
 func (p *PushServer) PushDirectory(ctx context.Context, req *rapb.PushDirectoryRequest) (*rapb.PushDirectoryResponse, error) {
-	return nil, status.UnimplementedError("PushDirectory is not yet implemented")
+	m := &ampb.AssetMapping{
+		Type:                  ampb.AssetType_DIRECTORY,
+		Qualifiers:            req.GetQualifiers(),
+		Digest:                req.GetRootDirectoryDigest(),
+		DigestFunction:        req.GetDigestFunction(),
+		ExpireAt:              req.GetExpireAt(),
+		ReferencesBlobs:       req.GetReferencesBlobs(),
+		ReferencesDirectories: req.GetReferencesDirectories(),
+	}
+	if err := p.push(ctx, req.GetInstanceName(), req.GetUris(), m); err != nil {
+		return nil, err
+	}
+	return &rapb.PushDirectoryResponse{}, nil
+}
+
+// push validates the given mapping template and stores one copy of it per
+// URI.
+func (p *PushServer) push(ctx context.Context, instanceName string, uris []string, m *ampb.AssetMapping) error {
+	if len(uris) == 0 {
+		return status.InvalidArgumentError("at least one URI is required")
+	}
+	if m.GetDigest() == nil {
+		return status.InvalidArgumentError("a content digest is required")
+	}
+	if m.GetDigestFunction() == repb.DigestFunction_UNKNOWN {
+		m.DigestFunction = repb.DigestFunction_SHA256
+	}
+	if err := digest.NewCASResourceName(m.GetDigest(), instanceName, m.GetDigestFunction()).Validate(); err != nil {
+		return err
+	}
+
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, p.env.GetAuthenticator())
+	if err != nil {
+		return err
+	}
+	canWrite, err := capabilities.IsGranted(ctx, p.env.GetAuthenticator(), cappb.Capability_CACHE_WRITE)
+	if err != nil {
+		return err
+	}
+	if !canWrite {
+		return status.PermissionDeniedError("pushing assets requires cache write permissions")
+	}
+
+	cache := p.env.GetCache()
+	// Only accept mappings to content that the client has already uploaded,
+	// so that fetches never resolve to a dangling digest.
+	if err := asset_mapping.CheckContentExists(ctx, cache, instanceName, m); err != nil {
+		if status.IsNotFoundError(err) {
+			return status.FailedPreconditionErrorf("pushed content is not in the CAS: %s", status.Message(err))
+		}
+		return err
+	}
+	// Fetches only use a mapping for a checksum if its content matches, but
+	// reject mismatched checksums up front so that the client finds out.
+	for _, q := range m.GetQualifiers() {
+		if q.GetName() != asset_mapping.ChecksumQualifier {
+			continue
+		}
+		if err := asset_mapping.VerifyChecksum(ctx, cache, instanceName, m, q.GetValue()); err != nil {
+			if status.IsNotFoundError(err) {
+				return status.InvalidArgumentErrorf("pushed content does not match the %s qualifier: %s", asset_mapping.ChecksumQualifier, status.Message(err))
+			}
+			return err
+		}
+	}
+
+	m.PushTime = timestamppb.New(p.env.GetClock().Now())
+	for _, uri := range uris {
+		m.Uri = uri
+		if err := asset_mapping.Write(ctx, cache, instanceName, m); err != nil {
+			return status.UnavailableErrorf("failed to store asset mapping for %q: %s", uri, err)
+		}
+		log.CtxDebugf(ctx, "Pushed %s asset mapping %q -> %s", m.GetType(), uri, digest.String(m.GetDigest()))
+	}
+	return nil
 }
@@ -0,0 +1,279 @@
+package push_server_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/fetch_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_asset/push_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/byte_stream_server"
+	"github.com/buildbuddy-io/buildbuddy/server/remote_cache/cachetools"
+	"github.com/buildbuddy-io/buildbuddy/server/testutil/testenv"
+	"github.com/buildbuddy-io/buildbuddy/server/util/prefix"
+	"github.com/buildbuddy-io/buildbuddy/server/util/proto"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	rapb "github.com/buildbuddy-io/buildbuddy/proto/remote_asset"
+	repb "github.com/buildbuddy-io/buildbuddy/proto/remote_execution"
+	rspb "github.com/buildbuddy-io/buildbuddy/proto/resource"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	gcodes "google.golang.org/grpc/codes"
+)
+
+// An unresolvable URI, so that any fetch that tries to go to the network
+// fails.
+const unreachableURI = "https://unreachable.invalid/asset.tar.gz"
+
+func runServers(ctx context.Context, t *testing.T, te *testenv.TestEnv) (rapb.PushClient, rapb.FetchClient) {
+	byteStreamServer, err := byte_stream_server.NewByteStreamServer(te)
+	require.NoError(t, err)
+	fetchServer, err := fetch_server.NewFetchServer(te)
+	require.NoError(t, err)
+	pushServer := push_server.NewPushServer(te)
+
+	grpcServer, runFunc, lis := testenv.RegisterLocalGRPCServer(t, te)
+	bspb.RegisterByteStreamServer(grpcServer, byteStreamServer)
+	rapb.RegisterFetchServer(grpcServer, fetchServer)
+	rapb.RegisterPushServer(grpcServer, pushServer)
+	go runFunc()
+
+	clientConn, err := testenv.LocalGRPCConn(ctx, lis)
+	require.NoError(t, err)
+	te.SetByteStreamClient(bspb.NewByteStreamClient(clientConn))
+	return rapb.NewPushClient(clientConn), rapb.NewFetchClient(clientConn)
+}
+
+func uploadToCAS(ctx context.Context, t *testing.T, te *testenv.TestEnv, data []byte) *repb.Digest {
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+	d, err := cachetools.UploadBytesToCache(ctx, te.GetCache(), rspb.CacheType_CAS, "", repb.DigestFunction_SHA256, bytes.NewReader(data))
+	require.NoError(t, err)
+	return d
+}
+
+func TestPushBlob(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	pushClient, fetchClient := runServers(ctx, t, te)
+
+	blobDigest := uploadToCAS(ctx, t, te, []byte("pushed content"))
+	qualifiers := []*rapb.Qualifier{{Name: "bazel.canonical_id", Value: "release-1.0"}}
+	_, err := pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:           []string{unreachableURI},
+		Qualifiers:     qualifiers,
+		BlobDigest:     blobDigest,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+
+	// Transport-only qualifiers don't affect the lookup.
+	rsp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{unreachableURI},
+		Qualifiers: append(qualifiers, &rapb.Qualifier{
+			Name:  "http_header:Authorization",
+			Value: "Bearer secret",
+		}),
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode())
+	assert.Equal(t, unreachableURI, rsp.GetUri())
+	assert.Equal(t, blobDigest.GetHash(), rsp.GetBlobDigest().GetHash())
+	assert.Equal(t, blobDigest.GetSizeBytes(), rsp.GetBlobDigest().GetSizeBytes())
+
+	// A different canonical ID doesn't match the pushed mapping.
+	rsp, err = fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:           []string{unreachableURI},
+		Qualifiers:     []*rapb.Qualifier{{Name: "bazel.canonical_id", Value: "release-2.0"}},
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+}
+
+func TestPushBlob_Expired(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	pushClient, fetchClient := runServers(ctx, t, te)
+
+	blobDigest := uploadToCAS(ctx, t, te, []byte("expired content"))
+	_, err := pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{unreachableURI},
+		BlobDigest: blobDigest,
+		ExpireAt:   timestamppb.New(time.Now().Add(-time.Minute)),
+	})
+	require.NoError(t, err)
+
+	rsp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{unreachableURI},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+}
+
+func TestPushBlob_FetchWithChecksum(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	pushClient, fetchClient := runServers(ctx, t, te)
+
+	content := []byte("pushed content")
+	blobDigest := uploadToCAS(ctx, t, te, content)
+	_, err := pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:           []string{unreachableURI},
+		BlobDigest:     blobDigest,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+
+	sha256Sum := sha256.Sum256(content)
+	sha512Sum := sha512.Sum512(content)
+	otherSum := sha256.Sum256([]byte("other content"))
+	for _, tc := range []struct {
+		name     string
+		checksum string
+		found    bool
+	}{
+		{name: "same digest function", checksum: "sha256-" + base64.StdEncoding.EncodeToString(sha256Sum[:]), found: true},
+		{name: "different digest function", checksum: "sha512-" + base64.StdEncoding.EncodeToString(sha512Sum[:]), found: true},
+		{name: "mismatched checksum", checksum: "sha256-" + base64.StdEncoding.EncodeToString(otherSum[:]), found: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rsp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+				Uris:           []string{unreachableURI},
+				Qualifiers:     []*rapb.Qualifier{{Name: "checksum.sri", Value: tc.checksum}},
+				DigestFunction: repb.DigestFunction_SHA256,
+			})
+			require.NoError(t, err)
+			if !tc.found {
+				assert.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+				return
+			}
+			assert.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode())
+			// Only responses served from a pushed mapping have a URI.
+			assert.Equal(t, unreachableURI, rsp.GetUri())
+			assert.Equal(t, blobDigest.GetHash(), rsp.GetBlobDigest().GetHash())
+		})
+	}
+}
+
+func TestPush_MismatchedChecksum(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	pushClient, fetchClient := runServers(ctx, t, te)
+
+	blobDigest := uploadToCAS(ctx, t, te, []byte("pushed content"))
+	otherSum := sha256.Sum256([]byte("other content"))
+	otherChecksum := "sha256-" + base64.StdEncoding.EncodeToString(otherSum[:])
+	_, err := pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:           []string{unreachableURI},
+		Qualifiers:     []*rapb.Qualifier{{Name: "checksum.sri", Value: otherChecksum}},
+		BlobDigest:     blobDigest,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	// A directory checksum must match one of the blobs that it references.
+	root := &repb.Directory{
+		Files: []*repb.FileNode{{Name: "hello.txt", Digest: blobDigest}},
+	}
+	buf, err := proto.Marshal(root)
+	require.NoError(t, err)
+	rootDigest := uploadToCAS(ctx, t, te, buf)
+	_, err = pushClient.PushDirectory(ctx, &rapb.PushDirectoryRequest{
+		Uris:                []string{unreachableURI},
+		Qualifiers:          []*rapb.Qualifier{{Name: "checksum.sri", Value: otherChecksum}},
+		RootDirectoryDigest: rootDigest,
+		ReferencesBlobs:     []*repb.Digest{blobDigest},
+	})
+	require.True(t, status.IsInvalidArgumentError(err), "expected InvalidArgument, got %v", err)
+
+	// The rejected pushes must not satisfy pinned fetches.
+	rsp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris:           []string{unreachableURI},
+		Qualifiers:     []*rapb.Qualifier{{Name: "checksum.sri", Value: otherChecksum}},
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), rsp.GetStatus().GetCode())
+
+	archiveDigest := uploadToCAS(ctx, t, te, []byte("archive content"))
+	archiveSum := sha256.Sum256([]byte("archive content"))
+	archiveChecksum := "sha256-" + base64.StdEncoding.EncodeToString(archiveSum[:])
+	_, err = pushClient.PushDirectory(ctx, &rapb.PushDirectoryRequest{
+		Uris:                []string{unreachableURI},
+		Qualifiers:          []*rapb.Qualifier{{Name: "checksum.sri", Value: archiveChecksum}},
+		RootDirectoryDigest: rootDigest,
+		ReferencesBlobs:     []*repb.Digest{archiveDigest},
+	})
+	require.NoError(t, err)
+}
+
+func TestPushBlob_MissingContent(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	pushClient, _ := runServers(ctx, t, te)
+
+	missingDigest := &repb.Digest{
+		Hash:      strings.Repeat("a", 64),
+		SizeBytes: 123,
+	}
+	_, err := pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:       []string{unreachableURI},
+		BlobDigest: missingDigest,
+	})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+
+	// A blob referenced by a mapping must exist too.
+	blobDigest := uploadToCAS(ctx, t, te, []byte("content"))
+	_, err = pushClient.PushBlob(ctx, &rapb.PushBlobRequest{
+		Uris:            []string{unreachableURI},
+		BlobDigest:      blobDigest,
+		ReferencesBlobs: []*repb.Digest{missingDigest},
+	})
+	require.True(t, status.IsFailedPreconditionError(err), "expected FailedPrecondition, got %v", err)
+}
+
+func TestPushDirectory(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	pushClient, fetchClient := runServers(ctx, t, te)
+
+	fileDigest := uploadToCAS(ctx, t, te, []byte("hello"))
+	root := &repb.Directory{
+		Files: []*repb.FileNode{{Name: "hello.txt", Digest: fileDigest}},
+	}
+	buf, err := proto.Marshal(root)
+	require.NoError(t, err)
+	rootDigest := uploadToCAS(ctx, t, te, buf)
+
+	_, err = pushClient.PushDirectory(ctx, &rapb.PushDirectoryRequest{
+		Uris:                []string{unreachableURI, "https://mirror.invalid/asset.tar.gz"},
+		RootDirectoryDigest: rootDigest,
+	})
+	require.NoError(t, err)
+
+	// Any of the pushed URIs resolves to the directory.
+	rsp, err := fetchClient.FetchDirectory(ctx, &rapb.FetchDirectoryRequest{
+		Uris: []string{"https://mirror.invalid/asset.tar.gz"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.OK), rsp.GetStatus().GetCode())
+	assert.Equal(t, "https://mirror.invalid/asset.tar.gz", rsp.GetUri())
+	assert.Equal(t, rootDigest.GetHash(), rsp.GetRootDirectoryDigest().GetHash())
+
+	// A directory mapping is not returned for blob fetches.
+	blobRsp, err := fetchClient.FetchBlob(ctx, &rapb.FetchBlobRequest{
+		Uris: []string{unreachableURI},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int32(gcodes.NotFound), blobRsp.GetStatus().GetCode())
+}
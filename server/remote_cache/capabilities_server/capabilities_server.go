@@ -80,6 +80,8 @@ func (s *CapabilitiesServer) GetCapabilities(ctx context.Context, req *repb.GetC
 			SymlinkAbsolutePathStrategy:     repb.SymlinkAbsolutePathStrategy_ALLOWED,
 			SupportedCompressors:            compressors,
 			SupportedBatchUpdateCompressors: compressors,
+			SplitBlobSupport:                s.env.GetBlobSplitter() != nil,
+			SpliceBlobSupport:               s.env.GetBlobSplitter() != nil,
 		}
 	}
 	if s.supportRemoteExec {
@@ -6,6 +6,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"slices"
@@ -384,6 +385,158 @@ func (s *ContentAddressableStorageServer) BatchReadBlobs(ctx context.Context, re
 	return rsp, nil
 }
 
+// Split a blob into content-defined chunks.
+//
+// The chunks are written to the CAS (if they are not already present) and
+// their digests are returned in order, so that a client which already has
+// some of the chunks only needs to download the ones it is missing and can
+// reassemble the blob by concatenating them.
+//
+// Errors:
+//
+//   - `UNIMPLEMENTED`: Blob splitting is not enabled on this server.
+//   - `NOT_FOUND`: The requested blob is not present in the CAS.
+func (s *ContentAddressableStorageServer) SplitBlob(ctx context.Context, req *repb.SplitBlobRequest) (*repb.SplitBlobResponse, error) {
+	splitter := s.env.GetBlobSplitter()
+	if splitter == nil {
+		return nil, status.UnimplementedError("SplitBlob is not enabled")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+	rn := digest.NewCASResourceName(req.GetBlobDigest(), req.GetInstanceName(), req.GetDigestFunction())
+	if err := rn.Validate(); err != nil {
+		return nil, err
+	}
+	digestFunction := rn.GetDigestFunction()
+	rsp := &repb.SplitBlobResponse{DigestFunction: digestFunction}
+	if rn.IsEmpty() {
+		return rsp, nil
+	}
+
+	reader, err := s.cache.Reader(ctx, rn.ToProto(), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	err = splitter.Split(ctx, reader, func(chunk []byte) error {
+		d, err := digest.Compute(bytes.NewReader(chunk), digestFunction)
+		if err != nil {
+			return err
+		}
+		rsp.ChunkDigests = append(rsp.ChunkDigests, d)
+		chunkRN := digest.NewCASResourceName(d, req.GetInstanceName(), digestFunction).ToProto()
+		if exists, err := s.cache.Contains(ctx, chunkRN); err == nil && exists {
+			return nil
+		}
+		// Chunks are written even for read-only callers: their contents come
+		// from a blob that the caller can already read, and the response
+		// isn't useful unless the chunks can be fetched.
+		// The splitter may reuse the chunk buffer once this func returns.
+		return s.cache.Set(ctx, chunkRN, slices.Clone(chunk))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// Splice a blob from chunks that are already present in the CAS.
+//
+// The chunks are concatenated in order and the result is verified against
+// the requested blob digest before it is stored.
+//
+// Errors:
+//
+//   - `UNIMPLEMENTED`: Blob splicing is not enabled on this server.
+//   - `NOT_FOUND`: One or more of the chunks are not present in the CAS.
+//   - `INVALID_ARGUMENT`: The concatenated chunks don't match the blob digest.
+func (s *ContentAddressableStorageServer) SpliceBlob(ctx context.Context, req *repb.SpliceBlobRequest) (*repb.SpliceBlobResponse, error) {
+	if s.env.GetBlobSplitter() == nil {
+		return nil, status.UnimplementedError("SpliceBlob is not enabled")
+	}
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, s.env.GetAuthenticator())
+	if err != nil {
+		return nil, err
+	}
+	rn := digest.NewCASResourceName(req.GetBlobDigest(), req.GetInstanceName(), req.GetDigestFunction())
+	if err := rn.Validate(); err != nil {
+		return nil, err
+	}
+	rsp := &repb.SpliceBlobResponse{BlobDigest: rn.GetDigest()}
+
+	canWrite, err := capabilities.IsGranted(ctx, s.env.GetAuthenticator(), cappb.Capability_CACHE_WRITE|cappb.Capability_CAS_WRITE)
+	if err != nil {
+		return nil, err
+	}
+	if !canWrite {
+		// For read-only API keys, pretend the write succeeded.
+		return rsp, nil
+	}
+	if rn.IsEmpty() {
+		return rsp, nil
+	}
+	if exists, err := s.cache.Contains(ctx, rn.ToProto()); err == nil && exists {
+		return rsp, nil
+	}
+
+	digestFunction := rn.GetDigestFunction()
+	chunkRNs := make([]*rspb.ResourceName, 0, len(req.GetChunkDigests()))
+	totalSize := int64(0)
+	for _, d := range req.GetChunkDigests() {
+		chunkRN := digest.NewCASResourceName(d, req.GetInstanceName(), digestFunction)
+		if err := chunkRN.Validate(); err != nil {
+			return nil, err
+		}
+		totalSize += d.GetSizeBytes()
+		if chunkRN.IsEmpty() {
+			continue
+		}
+		chunkRNs = append(chunkRNs, chunkRN.ToProto())
+	}
+	if totalSize != rn.GetDigest().GetSizeBytes() {
+		return nil, status.InvalidArgumentErrorf("chunk sizes add up to %d bytes, but blob size is %d bytes", totalSize, rn.GetDigest().GetSizeBytes())
+	}
+	missing, err := s.cache.FindMissing(ctx, chunkRNs)
+	if err != nil {
+		return nil, err
+	}
+	if len(missing) > 0 {
+		return nil, status.NotFoundErrorf("chunk %s not found in cache", digest.String(missing[0]))
+	}
+
+	checksum, err := digest.HashForDigestType(digestFunction)
+	if err != nil {
+		return nil, err
+	}
+	w, err := s.cache.Writer(ctx, rn.ToProto())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+	mw := io.MultiWriter(w, checksum)
+	for _, chunkRN := range chunkRNs {
+		r, err := s.cache.Reader(ctx, chunkRN, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(mw, r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	computedDigest := hex.EncodeToString(checksum.Sum(nil))
+	if computedDigest != rn.GetDigest().GetHash() {
+		return nil, status.InvalidArgumentErrorf("spliced blob checksum (%q) did not match digest (%q)", computedDigest, rn.GetDigest().GetHash())
+	}
+	if err := w.Commit(); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
 func (s *ContentAddressableStorageServer) supportsCompressor(compressor repb.Compressor_Value) bool {
 	return compressor == repb.Compressor_IDENTITY ||
 		compressor == repb.Compressor_ZSTD && remote_cache_config.ZstdTranscodingEnabled()
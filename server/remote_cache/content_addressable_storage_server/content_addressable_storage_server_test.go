@@ -832,3 +832,141 @@ func TestGetTreeMissingRoot(t *testing.T) {
 	require.Error(t, err)
 	require.True(t, hasMissingDigestError(err))
 }
+
+// fixedSizeSplitter splits blobs into chunks of a fixed size, which keeps the
+// chunk boundaries predictable in tests.
+type fixedSizeSplitter struct {
+	chunkSize int
+}
+
+func (s *fixedSizeSplitter) Split(ctx context.Context, r io.Reader, writeChunkFn func(chunk []byte) error) error {
+	buf := make([]byte, s.chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := writeChunkFn(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestSplitBlob_NotEnabled(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	rn, _ := testdigest.RandomCASResourceBuf(t, 100)
+	_, err := casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: rn.GetDigest()})
+	require.Equal(t, gcodes.Unimplemented, gstatus.Code(err))
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{BlobDigest: rn.GetDigest()})
+	require.Equal(t, gcodes.Unimplemented, gstatus.Code(err))
+}
+
+func TestSplitBlob(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	te.SetBlobSplitter(&fixedSizeSplitter{chunkSize: 100})
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	rn, buf := testdigest.RandomCASResourceBuf(t, 250)
+	err = te.GetCache().Set(ctx, rn, buf)
+	require.NoError(t, err)
+
+	rsp, err := casClient.SplitBlob(ctx, &repb.SplitBlobRequest{
+		BlobDigest:     rn.GetDigest(),
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, repb.DigestFunction_SHA256, rsp.GetDigestFunction())
+	require.Len(t, rsp.GetChunkDigests(), 3)
+
+	// The chunks are in the CAS and concatenate to the original blob.
+	readRsp, err := casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+		Digests: rsp.GetChunkDigests(),
+	})
+	require.NoError(t, err)
+	data := make(map[string][]byte)
+	for _, r := range readRsp.GetResponses() {
+		require.Equal(t, int32(gcodes.OK), r.GetStatus().GetCode())
+		data[r.GetDigest().GetHash()] = r.GetData()
+	}
+	var spliced []byte
+	for _, d := range rsp.GetChunkDigests() {
+		spliced = append(spliced, data[d.GetHash()]...)
+	}
+	require.Equal(t, buf, spliced)
+
+	// Splitting a missing blob fails.
+	missing, _ := testdigest.RandomCASResourceBuf(t, 250)
+	_, err = casClient.SplitBlob(ctx, &repb.SplitBlobRequest{BlobDigest: missing.GetDigest()})
+	require.Equal(t, gcodes.NotFound, gstatus.Code(err))
+}
+
+func TestSpliceBlob(t *testing.T) {
+	ctx := context.Background()
+	te := testenv.GetTestEnv(t)
+	te.SetBlobSplitter(&fixedSizeSplitter{chunkSize: 100})
+	ctx, err := prefix.AttachUserPrefixToContext(ctx, te.GetAuthenticator())
+	require.NoError(t, err)
+	clientConn := runCASServer(ctx, t, te)
+	casClient := repb.NewContentAddressableStorageClient(clientConn)
+
+	var chunkDigests []*repb.Digest
+	var blob []byte
+	updateReq := &repb.BatchUpdateBlobsRequest{}
+	for i := 0; i < 3; i++ {
+		rn, buf := testdigest.RandomCASResourceBuf(t, 100)
+		updateReq.Requests = append(updateReq.Requests, &repb.BatchUpdateBlobsRequest_Request{
+			Digest: rn.GetDigest(),
+			Data:   buf,
+		})
+		chunkDigests = append(chunkDigests, rn.GetDigest())
+		blob = append(blob, buf...)
+	}
+	_, err = casClient.BatchUpdateBlobs(ctx, updateReq)
+	require.NoError(t, err)
+	blobDigest, err := digest.Compute(bytes.NewReader(blob), repb.DigestFunction_SHA256)
+	require.NoError(t, err)
+
+	// Chunks in the wrong order don't match the blob digest.
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{chunkDigests[1], chunkDigests[0], chunkDigests[2]},
+	})
+	require.Equal(t, gcodes.InvalidArgument, gstatus.Code(err))
+
+	// Missing chunks are reported as NotFound.
+	missing, _ := testdigest.RandomCASResourceBuf(t, 100)
+	_, err = casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:   blobDigest,
+		ChunkDigests: []*repb.Digest{chunkDigests[0], missing.GetDigest(), chunkDigests[2]},
+	})
+	require.Equal(t, gcodes.NotFound, gstatus.Code(err))
+
+	rsp, err := casClient.SpliceBlob(ctx, &repb.SpliceBlobRequest{
+		BlobDigest:     blobDigest,
+		ChunkDigests:   chunkDigests,
+		DigestFunction: repb.DigestFunction_SHA256,
+	})
+	require.NoError(t, err)
+	require.Equal(t, blobDigest.GetHash(), rsp.GetBlobDigest().GetHash())
+
+	readRsp, err := casClient.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+		Digests: []*repb.Digest{blobDigest},
+	})
+	require.NoError(t, err)
+	require.Len(t, readRsp.GetResponses(), 1)
+	require.Equal(t, int32(gcodes.OK), readRsp.GetResponses()[0].GetStatus().GetCode())
+	require.Equal(t, blob, readRsp.GetResponses()[0].GetData())
+}
@@ -849,6 +849,74 @@ func (*IPRule) TableName() string {
 	return "IPRules"
 }
 
+// OutboundWebhook is an HTTP endpoint that receives events from the group that
+// owns it.
+type OutboundWebhook struct {
+	Model
+	WebhookID   string `gorm:"primaryKey"`
+	GroupID     string `gorm:"index:outbound_webhook_group_id_idx"`
+	URL         string `gorm:"column:url;type:text"`
+	Description string
+	// A comma-separated list of outbound_webhook.EventType values.
+	EventTypes      string
+	PayloadTemplate string `gorm:"type:text"`
+	// The secret that requests are signed with, encrypted with the KMS
+	// master key. The webhook ID is the associated data.
+	EncryptedSigningSecret []byte
+	Disabled               bool `gorm:"not null;default:0"`
+}
+
+func (*OutboundWebhook) TableName() string {
+	return "OutboundWebhooks"
+}
+
+// OutboundWebhookDelivery records the outcome of delivering an event to an
+// OutboundWebhook.
+type OutboundWebhookDelivery struct {
+	Model
+	DeliveryID         string `gorm:"primaryKey"`
+	WebhookID          string `gorm:"index:outbound_webhook_delivery_webhook_id_idx"`
+	GroupID            string
+	EventType          int32
+	EventID            string
+	Attempts           int32
+	Success            bool
+	ResponseStatusCode int32
+	Error              string `gorm:"type:text"`
+	DurationUsec       int64
+}
+
+func (*OutboundWebhookDelivery) TableName() string {
+	return "OutboundWebhookDeliveries"
+}
+
+// WorkflowActionRun is a run of a workflow action that needs, or is needed
+// by, other actions triggered by the same event. Runs are stored so that any
+// app can start dependent actions once the actions they need have succeeded.
+type WorkflowActionRun struct {
+	Model
+	InvocationID string `gorm:"primaryKey"`
+	GroupID      string
+	WorkflowID   string
+	ActionName   string
+	// A comma-separated list of the invocation IDs of the runs that must
+	// succeed before this run is started.
+	NeededInvocationIDs string `gorm:"type:text"`
+	// Whether other runs need this run to succeed.
+	Needed      bool `gorm:"not null;default:0"`
+	ExecutionID string
+	// The state of the run, one of the action run states defined by the
+	// workflow service.
+	State int32 `gorm:"index:workflow_action_run_state_idx"`
+	// The JSON-serialized parameters needed to start the run.
+	SerializedRequest   []byte `gorm:"size:max"`
+	LeaseExpirationUsec int64
+}
+
+func (*WorkflowActionRun) TableName() string {
+	return "WorkflowActionRuns"
+}
+
 type PostAutoMigrateLogic func() error
 
 // Manual migration called before auto-migration.
@@ -1344,6 +1412,8 @@ func RegisterTables() {
 	registerTable("IE", &InvocationExecution{})
 	registerTable("IN", &Invocation{})
 	registerTable("IR", &IPRule{})
+	registerTable("OD", &OutboundWebhookDelivery{})
+	registerTable("OW", &OutboundWebhook{})
 	registerTable("QB", &QuotaBucket{})
 	registerTable("QG", &QuotaGroup{})
 	registerTable("RE", &GitRepository{})
@@ -1357,4 +1427,5 @@ func RegisterTables() {
 	registerTable("UG", &UserGroup{})
 	registerTable("US", &User{})
 	registerTable("WF", &Workflow{})
+	registerTable("WR", &WorkflowActionRun{})
 }
@@ -100,6 +100,13 @@ func (m *mockGCS) DeleteBlob(ctx context.Context, blobName string) error {
 	return nil
 }
 
+func (m *mockGCS) BlobExists(ctx context.Context, blobName string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.items[blobName]
+	return ok && !m.expired(blobName), nil
+}
+
 func (m *mockGCS) UpdateCustomTime(ctx context.Context, blobName string, t time.Time) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
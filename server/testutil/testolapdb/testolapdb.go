@@ -74,6 +74,10 @@ func (h *Handle) FlushTestTargetStatuses(ctx context.Context, entries []*schema.
 	return errors.New("Not implemented")
 }
 
+func (h *Handle) FlushTestCaseStatuses(ctx context.Context, entries []*schema.TestCaseStatus) error {
+	return errors.New("Not implemented")
+}
+
 func (h *Handle) GetExecutionIDsByInvID(t *testing.T, invID string) []string {
 	v, ok := h.executionIDsByInvID.Load(invID)
 	require.True(t, ok, "invocation ID %q is not found in OLAP DB", invID)
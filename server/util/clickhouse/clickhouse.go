@@ -308,6 +308,17 @@ func (h *DBHandle) FlushTestTargetStatuses(ctx context.Context, entries []*schem
 	return nil
 }
 
+func (h *DBHandle) FlushTestCaseStatuses(ctx context.Context, entries []*schema.TestCaseStatus) error {
+	num := len(entries)
+	if num == 0 {
+		return nil
+	}
+	if err := h.insertWithRetrier(ctx, (&schema.TestCaseStatus{}).TableName(), num, &entries); err != nil {
+		return status.UnavailableErrorf("failed to insert %d test case statuses for invocation (invocation_uuid = %q), err: %s", num, entries[0].InvocationUUID, err)
+	}
+	return nil
+}
+
 func (h *DBHandle) InsertAuditLog(ctx context.Context, entry *schema.AuditLog) error {
 	if err := h.insertWithRetrier(ctx, (&schema.AuditLog{}).TableName(), 1, entry); err != nil {
 		return status.UnavailableErrorf("failed to create audit log: %s", err)
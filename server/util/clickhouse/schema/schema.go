@@ -46,6 +46,8 @@ func getAllTables() []Table {
 		&Invocation{},
 		&Execution{},
 		&TestTargetStatus{},
+		&TestCaseStatus{},
+		&TargetFlakinessScore{},
 		&AuditLog{},
 	}
 	return tbls
@@ -375,6 +377,91 @@ func (t *TestTargetStatus) TableOptions() string {
 	return fmt.Sprintf("ENGINE=%s ORDER BY (group_id, repo_url, commit_sha, label, invocation_uuid)", getEngine())
 }
 
+// TestCaseStatus represents the result of a single test case within a test
+// target, as reported by the target's test.xml output.
+type TestCaseStatus struct {
+	// Sort Keys; and the order of the following fields match TableOptions().
+	GroupID        string
+	RepoURL        string
+	Label          string
+	ClassName      string
+	Name           string
+	InvocationUUID string
+	Shard          int32
+	Run            int32
+	Attempt        int32
+	// The position of the test case within the attempt's test.xml, which
+	// distinguishes test cases that share a class name and name (e.g.
+	// parameterized tests).
+	CaseIndex int32
+
+	CommitSHA string
+	UserID    string
+	// An api.v1.Status value: PASSED, FAILED, or SKIPPED.
+	Status int32
+	// The start time of the test attempt that ran the test case.
+	StartTimeUsec  int64
+	DurationUsec   int64
+	FailureMessage string
+
+	// The following fields are from Invocation.
+	BranchName              string
+	Role                    string
+	Command                 string
+	InvocationStartTimeUsec int64
+}
+
+func (t *TestCaseStatus) ExcludedFields() []string {
+	return []string{}
+}
+
+func (t *TestCaseStatus) AdditionalFields() []string {
+	return []string{}
+}
+
+func (t *TestCaseStatus) TableName() string {
+	return "TestCaseStatuses"
+}
+
+func (t *TestCaseStatus) TableOptions() string {
+	return fmt.Sprintf("ENGINE=%s ORDER BY (group_id, repo_url, label, class_name, name, invocation_uuid, shard, run, attempt, case_index)", getEngine())
+}
+
+// TargetFlakinessScore is the flakiness score of a test target, computed
+// periodically from the target's recent TestTargetStatuses. The latest score
+// for each target replaces the previous ones.
+type TargetFlakinessScore struct {
+	// Sort Keys; and the order of the following fields match TableOptions().
+	GroupID string
+	RepoURL string
+	Label   string
+
+	ComputedAtUsec       int64
+	TotalRuns            int64
+	TotalCommits         int64
+	FlakyRuns            int64
+	LikelyFlakyRuns      int64
+	PassedAfterRetryRuns int64
+	InconsistentCommits  int64
+	Score                float64
+}
+
+func (t *TargetFlakinessScore) ExcludedFields() []string {
+	return []string{}
+}
+
+func (t *TargetFlakinessScore) AdditionalFields() []string {
+	return []string{}
+}
+
+func (t *TargetFlakinessScore) TableName() string {
+	return "TargetFlakinessScores"
+}
+
+func (t *TargetFlakinessScore) TableOptions() string {
+	return fmt.Sprintf("ENGINE=%s ORDER BY (group_id, repo_url, label)", getEngine())
+}
+
 type AuditLog struct {
 	AuditLogID    string
 	GroupID       string
@@ -40,6 +40,16 @@ func TestSchemaInSync(t *testing.T) {
 			// don't testing schema in sync
 			primaryDBTable: nil,
 		},
+		{
+			clickhouseTable: &TestCaseStatus{},
+			// Not in primary DB.
+			primaryDBTable: nil,
+		},
+		{
+			clickhouseTable: &TargetFlakinessScore{},
+			// Not in primary DB.
+			primaryDBTable: nil,
+		},
 		{
 			clickhouseTable: &AuditLog{},
 			// Not in primary DB.
@@ -0,0 +1,130 @@
+// Package junit parses JUnit-style XML test reports, such as the test.xml
+// files produced by Bazel test actions.
+package junit
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+)
+
+// Result is the outcome of a single test case.
+type Result int
+
+const (
+	Passed Result = iota
+	// Failed means that an assertion in the test case failed.
+	Failed
+	// Errored means that the test case hit an unexpected error, such as an
+	// uncaught exception or a crash.
+	Errored
+	Skipped
+)
+
+// TestCase is a single test case parsed from a report.
+type TestCase struct {
+	// SuiteName is the name of the innermost test suite containing the test
+	// case.
+	SuiteName string
+	ClassName string
+	Name      string
+	Duration  time.Duration
+	Result    Result
+	// Message is the short failure, error, or skip message, if any.
+	Message string
+	// Details contains the body of the failure, error, or skip element, which
+	// is typically a stack trace.
+	Details string
+}
+
+type xmlTestSuite struct {
+	XMLName   xml.Name
+	Name      string          `xml:"name,attr"`
+	Suites    []*xmlTestSuite `xml:"testsuite"`
+	TestCases []*xmlTestCase  `xml:"testcase"`
+}
+
+type xmlTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failures  []*xmlMessage `xml:"failure"`
+	Errors    []*xmlMessage `xml:"error"`
+	Skipped   *xmlMessage   `xml:"skipped"`
+}
+
+type xmlMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// Parse parses the test cases from a JUnit XML report. The root element may
+// be either <testsuites> or a single <testsuite>, and test suites may be
+// nested.
+func Parse(r io.Reader) ([]*TestCase, error) {
+	root := &xmlTestSuite{}
+	if err := xml.NewDecoder(r).Decode(root); err != nil {
+		return nil, status.InvalidArgumentErrorf("parse JUnit XML: %s", err)
+	}
+	if name := root.XMLName.Local; name != "testsuites" && name != "testsuite" {
+		return nil, status.InvalidArgumentErrorf("parse JUnit XML: unexpected root element <%s>", name)
+	}
+	var testCases []*TestCase
+	var visit func(s *xmlTestSuite)
+	visit = func(s *xmlTestSuite) {
+		for _, tc := range s.TestCases {
+			testCases = append(testCases, newTestCase(s.Name, tc))
+		}
+		for _, child := range s.Suites {
+			visit(child)
+		}
+	}
+	visit(root)
+	return testCases, nil
+}
+
+func newTestCase(suiteName string, tc *xmlTestCase) *TestCase {
+	out := &TestCase{
+		SuiteName: suiteName,
+		ClassName: tc.ClassName,
+		Name:      tc.Name,
+		Duration:  parseDuration(tc.Time),
+		Result:    Passed,
+	}
+	var m *xmlMessage
+	switch {
+	case len(tc.Errors) > 0:
+		out.Result = Errored
+		m = tc.Errors[0]
+	case len(tc.Failures) > 0:
+		out.Result = Failed
+		m = tc.Failures[0]
+	case tc.Skipped != nil:
+		out.Result = Skipped
+		m = tc.Skipped
+	}
+	if m != nil {
+		out.Message = strings.TrimSpace(m.Message)
+		out.Details = strings.TrimSpace(m.Body)
+	}
+	return out
+}
+
+// parseDuration parses a duration in (possibly fractional) seconds. Some
+// reporters format large values with thousands separators. Invalid durations
+// are treated as zero.
+func parseDuration(s string) time.Duration {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", "")
+	if s == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,91 @@
+package junit_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/junit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	report := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="//pkg:foo_test" tests="4" failures="1" errors="1">
+    <testcase name="TestPass" classname="pkg/foo" time="0.5"></testcase>
+    <testcase name="TestFail" classname="pkg/foo" time="1,001.25">
+      <failure message="expected 1, got 2" type="AssertionError">
+        foo_test.go:12: expected 1, got 2
+      </failure>
+    </testcase>
+    <testsuite name="nested">
+      <testcase name="TestError" classname="pkg/foo/nested" time="bogus">
+        <error message="panic: nil pointer dereference"></error>
+      </testcase>
+    </testsuite>
+    <testcase name="TestSkip" classname="pkg/foo">
+      <skipped message="not supported on this platform"/>
+    </testcase>
+  </testsuite>
+</testsuites>`
+
+	testCases, err := junit.Parse(strings.NewReader(report))
+
+	require.NoError(t, err)
+	assert.Equal(t, []*junit.TestCase{
+		{
+			SuiteName: "//pkg:foo_test",
+			ClassName: "pkg/foo",
+			Name:      "TestPass",
+			Duration:  500 * time.Millisecond,
+			Result:    junit.Passed,
+		},
+		{
+			SuiteName: "//pkg:foo_test",
+			ClassName: "pkg/foo",
+			Name:      "TestFail",
+			Duration:  1001250 * time.Millisecond,
+			Result:    junit.Failed,
+			Message:   "expected 1, got 2",
+			Details:   "foo_test.go:12: expected 1, got 2",
+		},
+		{
+			SuiteName: "//pkg:foo_test",
+			ClassName: "pkg/foo",
+			Name:      "TestSkip",
+			Result:    junit.Skipped,
+			Message:   "not supported on this platform",
+		},
+		{
+			SuiteName: "nested",
+			ClassName: "pkg/foo/nested",
+			Name:      "TestError",
+			Result:    junit.Errored,
+			Message:   "panic: nil pointer dereference",
+		},
+	}, testCases)
+}
+
+func TestParse_SingleTestSuiteRoot(t *testing.T) {
+	report := `<testsuite name="suite"><testcase name="a" classname="c" time="2"/></testsuite>`
+
+	testCases, err := junit.Parse(strings.NewReader(report))
+
+	require.NoError(t, err)
+	require.Len(t, testCases, 1)
+	assert.Equal(t, "a", testCases[0].Name)
+	assert.Equal(t, 2*time.Second, testCases[0].Duration)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, report := range []string{
+		"",
+		"not xml",
+		"<html><body/></html>",
+	} {
+		_, err := junit.Parse(strings.NewReader(report))
+		assert.Error(t, err, "report: %q", report)
+	}
+}
@@ -0,0 +1,544 @@
+package networking
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buildbuddy-io/buildbuddy/server/util/log"
+	"github.com/buildbuddy-io/buildbuddy/server/util/random"
+	"github.com/buildbuddy-io/buildbuddy/server/util/status"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DeniedEgressLogName is the name of the auxiliary log listing the
+	// connections that were denied by an action's egress policy.
+	DeniedEgressLogName = "denied_egress.txt"
+
+	// Prefix of the iptables chains that enforce egress policies. Chain names
+	// are also used as the prefix of kernel log messages for denied packets,
+	// so they must be at most 27 characters long.
+	egressChainPrefix = "bb-egress-"
+
+	// Maximum number of distinct denied destinations to include in a denied
+	// egress log.
+	maxDeniedDestinations = 1000
+
+	// Maximum number of denied packets to remember, so that the connections
+	// denied while a command was running can be reported after it exits.
+	maxDeniedPackets = 10000
+
+	kmsgPath = "/dev/kmsg"
+	// Kernel log records are limited to about 1KB, so this is plenty.
+	kmsgRecordBufferSize = 8192
+
+	resolvConfPath = "/etc/resolv.conf"
+)
+
+var hostnameRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.?$`)
+
+// EgressRule allows outgoing connections to a set of destination addresses
+// and ports.
+type EgressRule struct {
+	// Host is the hostname that connections are allowed to. It is resolved to
+	// IP addresses when the policy is applied to a network. Empty if the rule
+	// specifies an IP range instead.
+	Host string
+
+	// Prefix is the range of IP addresses that connections are allowed to.
+	// If neither Host nor Prefix is set, connections are allowed to any
+	// address.
+	Prefix netip.Prefix
+
+	// MinPort and MaxPort are the range of TCP and UDP destination ports that
+	// connections are allowed to. Both are 0 if all ports are allowed.
+	MinPort uint16
+	MaxPort uint16
+}
+
+// EgressPolicy restricts outgoing connections from a network to an
+// allowlist of destinations. Connections to other destinations are rejected.
+type EgressPolicy struct {
+	Rules []EgressRule
+
+	// Nameservers are the DNS servers that the network is configured to use.
+	// DNS requests (port 53) to these addresses are always allowed so that
+	// allowed hostnames can be resolved.
+	Nameservers []netip.Addr
+}
+
+// ParseEgressPolicy parses an egress allowlist, where each entry has the form
+// "<host>[:<port>[-<port>]]". The host is a hostname, an IPv4 address, an
+// IPv4 CIDR range, or "*" for any address. If no port is given, all ports are
+// allowed. DNS requests are allowed to the given nameservers; IPv6
+// nameservers are ignored.
+//
+// It returns nil if the allowlist is empty, which means that egress is not
+// restricted.
+func ParseEgressPolicy(allowlist []string, nameservers []netip.Addr) (*EgressPolicy, error) {
+	if len(allowlist) == 0 {
+		return nil, nil
+	}
+	policy := &EgressPolicy{}
+	for _, addr := range nameservers {
+		if addr = addr.Unmap(); addr.Is4() {
+			policy.Nameservers = append(policy.Nameservers, addr)
+		}
+	}
+	for _, entry := range allowlist {
+		rule, err := parseEgressRule(entry)
+		if err != nil {
+			return nil, status.InvalidArgumentErrorf("invalid egress allowlist entry %q: %s", entry, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+func parseEgressRule(entry string) (EgressRule, error) {
+	if strings.HasPrefix(entry, "[") || strings.Count(entry, ":") > 1 {
+		return EgressRule{}, errors.New("IPv6 destinations are not supported")
+	}
+	host, ports, hasPorts := strings.Cut(entry, ":")
+	var rule EgressRule
+	switch {
+	case host == "*":
+	case strings.Contains(host, "/"):
+		prefix, err := netip.ParsePrefix(host)
+		if err != nil {
+			return EgressRule{}, err
+		}
+		if !prefix.Addr().Is4() {
+			return EgressRule{}, errors.New("IPv6 destinations are not supported")
+		}
+		rule.Prefix = prefix.Masked()
+	default:
+		if addr, err := netip.ParseAddr(host); err == nil {
+			if !addr.Is4() {
+				return EgressRule{}, errors.New("IPv6 destinations are not supported")
+			}
+			rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+			break
+		}
+		if strings.Contains(host, "*") {
+			return EgressRule{}, errors.New("wildcard hostnames are not supported")
+		}
+		if !hostnameRegex.MatchString(host) {
+			return EgressRule{}, errors.New("expected a hostname, IPv4 address, CIDR range, or \"*\"")
+		}
+		rule.Host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if !hasPorts {
+		return rule, nil
+	}
+	minPort, maxPort, isRange := strings.Cut(ports, "-")
+	if !isRange {
+		maxPort = minPort
+	}
+	var err error
+	if rule.MinPort, err = parsePort(minPort); err != nil {
+		return EgressRule{}, err
+	}
+	if rule.MaxPort, err = parsePort(maxPort); err != nil {
+		return EgressRule{}, err
+	}
+	if rule.MinPort > rule.MaxPort {
+		return EgressRule{}, fmt.Errorf("invalid port range %q", ports)
+	}
+	return rule, nil
+}
+
+// HostNameservers returns the IPv4 nameservers listed in the host's
+// /etc/resolv.conf.
+func HostNameservers() ([]netip.Addr, error) {
+	b, err := os.ReadFile(resolvConfPath)
+	if err != nil {
+		return nil, status.UnavailableErrorf("read %s: %s", resolvConfPath, err)
+	}
+	var nameservers []netip.Addr
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(fields[1]); err == nil && addr.Is4() {
+			nameservers = append(nameservers, addr)
+		}
+	}
+	return nameservers, nil
+}
+
+func parsePort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port == 0 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return uint16(port), nil
+}
+
+// iptablesRules returns the rules of the chain that enforces the policy,
+// resolving any hostnames to their current IPv4 addresses.
+func (p *EgressPolicy) iptablesRules(ctx context.Context, logPrefix string) ([][]string, error) {
+	rules := [][]string{
+		// Only new connections are filtered, so that replies to packets that
+		// were allowed are not dropped.
+		{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"},
+	}
+	for _, nameserver := range p.Nameservers {
+		for _, protocol := range []string{"udp", "tcp"} {
+			rules = append(rules, []string{"-d", nameserver.String(), "-p", protocol, "--dport", "53", "-j", "RETURN"})
+		}
+	}
+	for _, rule := range p.Rules {
+		var destinations []string
+		switch {
+		case rule.Host != "":
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", rule.Host)
+			if err != nil {
+				return nil, status.UnavailableErrorf("resolve allowed host %q: %s", rule.Host, err)
+			}
+			for _, addr := range addrs {
+				destinations = append(destinations, addr.Unmap().String())
+			}
+			slices.Sort(destinations)
+			destinations = slices.Compact(destinations)
+		case rule.Prefix.IsValid():
+			destinations = []string{rule.Prefix.String()}
+		default:
+			destinations = []string{""}
+		}
+		for _, destination := range destinations {
+			var match []string
+			if destination != "" {
+				match = []string{"-d", destination}
+			}
+			if rule.MinPort == 0 {
+				rules = append(rules, slices.Concat(match, []string{"-j", "RETURN"}))
+				continue
+			}
+			ports := strconv.Itoa(int(rule.MinPort))
+			if rule.MaxPort != rule.MinPort {
+				ports += ":" + strconv.Itoa(int(rule.MaxPort))
+			}
+			for _, protocol := range []string{"tcp", "udp"} {
+				rules = append(rules, slices.Concat(match, []string{"-p", protocol, "--dport", ports, "-j", "RETURN"}))
+			}
+		}
+	}
+	return append(rules, [][]string{
+		// Log denied packets so that they can be reported to the user. Rate
+		// limit logging so that a misbehaving action can't flood the kernel
+		// log.
+		{"-m", "limit", "--limit", "50/second", "--limit-burst", "100", "-j", "LOG", "--log-prefix", logPrefix},
+		{"-j", "REJECT"},
+	}...), nil
+}
+
+// egressFilter enforces an EgressPolicy for the traffic sent from the
+// namespaced end of a veth pair. Packets entering the host from the host end
+// of the pair jump to an iptables chain which returns for allowed packets,
+// and logs and rejects all other packets.
+type egressFilter struct {
+	chain     string
+	logPrefix string
+
+	// kernelLog reads the log messages for denied packets. It is nil if the
+	// kernel log can't be read, in which case kernelLogErr is set.
+	kernelLog    *kernelLog
+	kernelLogErr error
+
+	// Guards the fields below, as well as reads of the kernel log, since
+	// commands may be executed concurrently in the same container.
+	mu sync.Mutex
+	// The destinations of the most recently denied packets, oldest first.
+	// dropped is the number of older packets that were discarded.
+	denied  []string
+	dropped int64
+	// The number of times that messages were lost from the kernel log or the
+	// kernel log couldn't be read.
+	losses int64
+
+	cleanup func(ctx context.Context) error
+}
+
+func newEgressFilter(ctx context.Context, hostDevice string, policy *EgressPolicy) (_ *egressFilter, err error) {
+	var cleanupStack cleanupStack
+	defer func() {
+		if err != nil {
+			_ = cleanupStack.Cleanup(ctx)
+		}
+	}()
+
+	suffix, err := random.RandomString(8)
+	if err != nil {
+		return nil, err
+	}
+	f := &egressFilter{chain: egressChainPrefix + suffix}
+	f.logPrefix = f.chain + ": "
+	rules, err := policy.iptablesRules(ctx, f.logPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start reading the kernel log before any packets can be denied.
+	f.kernelLog, f.kernelLogErr = openKernelLog()
+	if f.kernelLogErr != nil {
+		log.CtxWarningf(ctx, "Failed to open kernel log; connections denied by egress policy will not be reported: %s", f.kernelLogErr)
+	} else {
+		cleanupStack = append(cleanupStack, func(ctx context.Context) error {
+			return f.kernelLog.Close()
+		})
+	}
+
+	if err := runCommand(ctx, "iptables", "--wait", "-N", f.chain); err != nil {
+		return nil, status.WrapError(err, "create egress chain")
+	}
+	cleanupStack = append(cleanupStack, func(ctx context.Context) error {
+		return runCommand(ctx, "iptables", "--wait", "-X", f.chain)
+	})
+	cleanupStack = append(cleanupStack, func(ctx context.Context) error {
+		return runCommand(ctx, "iptables", "--wait", "-F", f.chain)
+	})
+	for _, rule := range rules {
+		if err := runCommand(ctx, slices.Concat([]string{"iptables", "--wait", "-A", f.chain}, rule)...); err != nil {
+			return nil, status.WrapError(err, "append egress rule")
+		}
+	}
+
+	// Jump to the chain before any of the rules that were added when setting
+	// up the veth pair, so that the policy is enforced first.
+	for _, builtinChain := range []string{"FORWARD", "INPUT"} {
+		jump := []string{builtinChain, "-i", hostDevice, "-j", f.chain}
+		if err := runCommand(ctx, slices.Concat([]string{"iptables", "--wait", "-I"}, jump)...); err != nil {
+			return nil, status.WrapError(err, "insert egress chain jump")
+		}
+		cleanupStack = append(cleanupStack, func(ctx context.Context) error {
+			return runCommand(ctx, slices.Concat([]string{"iptables", "--wait", "--delete"}, jump)...)
+		})
+	}
+
+	f.cleanup = cleanupStack.Cleanup
+	return f, nil
+}
+
+// DeniedEgressCursor is a position in the log of packets denied by an egress
+// policy. Each command takes a cursor when it starts, so that it reports only
+// the connections denied while it ran, without consuming them from commands
+// that are running concurrently in the same container. The zero value is the
+// start of the log.
+type DeniedEgressCursor struct {
+	filter *egressFilter
+	pos    int64
+	losses int64
+}
+
+// readKernelLog records the packets that were denied since the last call.
+// f.mu must be held.
+func (f *egressFilter) readKernelLog() {
+	messages, lost, err := f.kernelLog.ReadMessages()
+	if err != nil {
+		log.Warningf("Failed to read kernel log: %s", err)
+		lost = true
+	}
+	if lost {
+		f.losses++
+	}
+	for _, msg := range messages {
+		if fields, ok := strings.CutPrefix(msg, f.logPrefix); ok {
+			f.denied = append(f.denied, deniedDestination(fields))
+		}
+	}
+	if n := len(f.denied) - maxDeniedPackets; n > 0 {
+		f.denied = slices.Delete(f.denied, 0, n)
+		f.dropped += int64(n)
+	}
+}
+
+// Cursor returns a cursor at the end of the log of denied packets.
+func (f *egressFilter) Cursor() DeniedEgressCursor {
+	if f.kernelLog == nil {
+		return DeniedEgressCursor{filter: f}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readKernelLog()
+	return DeniedEgressCursor{
+		filter: f,
+		pos:    f.dropped + int64(len(f.denied)),
+		losses: f.losses,
+	}
+}
+
+// DeniedLog returns a human-readable list of the destinations that packets
+// were denied to since the cursor was taken, or nil if none were denied. A
+// cursor that was taken from another filter is treated as the start of the
+// log.
+func (f *egressFilter) DeniedLog(cursor DeniedEgressCursor) []byte {
+	if f.kernelLog == nil {
+		return []byte(fmt.Sprintf("Connections denied by the network egress policy could not be recorded: %s\n", f.kernelLogErr))
+	}
+	if cursor.filter != f {
+		cursor = DeniedEgressCursor{filter: f}
+	}
+	f.mu.Lock()
+	f.readKernelLog()
+	lost := f.losses > cursor.losses
+	dropped := cursor.pos < f.dropped
+	denied := f.denied[max(cursor.pos-f.dropped, 0):]
+	var destinations []string
+	seen := map[string]bool{}
+	truncated := false
+	for _, destination := range denied {
+		if seen[destination] {
+			continue
+		}
+		if len(destinations) >= maxDeniedDestinations {
+			truncated = true
+			break
+		}
+		seen[destination] = true
+		destinations = append(destinations, destination)
+	}
+	f.mu.Unlock()
+	if len(destinations) == 0 && !lost && !dropped {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Connections denied by the network egress policy:\n")
+	for _, destination := range destinations {
+		buf.WriteString(destination + "\n")
+	}
+	if truncated {
+		fmt.Fprintf(&buf, "(more than %d destinations were denied; the rest are omitted)\n", maxDeniedDestinations)
+	}
+	if dropped {
+		fmt.Fprintf(&buf, "(only the last %d denied packets were recorded; earlier ones are omitted)\n", maxDeniedPackets)
+	}
+	if lost {
+		buf.WriteString("(some denied connections may be missing, because the kernel log could not be fully read)\n")
+	}
+	return buf.Bytes()
+}
+
+func (f *egressFilter) Close(ctx context.Context) error {
+	return f.cleanup(ctx)
+}
+
+// deniedDestination formats the destination of a packet that was logged by
+// the iptables LOG target, e.g. "IN=veth0 OUT=eth0 SRC=192.168.0.6
+// DST=1.1.1.1 ... PROTO=TCP SPT=41234 DPT=443 ...", as "tcp 1.1.1.1:443".
+func deniedDestination(fields string) string {
+	values := map[string]string{}
+	for _, field := range strings.Fields(fields) {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			values[k] = v
+		}
+	}
+	destination := values["DST"]
+	if port := values["DPT"]; port != "" {
+		destination += ":" + port
+	}
+	return strings.ToLower(values["PROTO"]) + " " + destination
+}
+
+// kernelLog reads the messages that are logged to the kernel log buffer.
+type kernelLog struct {
+	fd int
+}
+
+// openKernelLog opens the kernel log. Only messages that are logged after it
+// is opened are returned by ReadMessages.
+func openKernelLog() (*kernelLog, error) {
+	fd, err := unix.Open(kmsgPath, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", kmsgPath, err)
+	}
+	if _, err := unix.Seek(fd, 0, io.SeekEnd); err != nil {
+		_ = unix.Close(fd)
+		return nil, fmt.Errorf("seek to end of %s: %w", kmsgPath, err)
+	}
+	return &kernelLog{fd: fd}, nil
+}
+
+// ReadMessages returns the messages that were logged since the last call. It
+// also returns whether any messages were overwritten in the kernel log buffer
+// before they could be read.
+func (k *kernelLog) ReadMessages() (messages []string, lost bool, err error) {
+	buf := make([]byte, kmsgRecordBufferSize)
+	for {
+		// Each read returns a single record, formatted like
+		// "<priority>,<sequence>,<timestamp>,<flags>;<message>\n", optionally
+		// followed by indented key-value lines.
+		n, err := unix.Read(k.fd, buf)
+		switch {
+		case err == unix.EAGAIN:
+			return messages, lost, nil
+		case err == unix.EPIPE:
+			lost = true
+			continue
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return messages, lost, err
+		}
+		_, msg, ok := strings.Cut(string(buf[:n]), ";")
+		if !ok {
+			continue
+		}
+		msg, _, _ = strings.Cut(msg, "\n")
+		messages = append(messages, msg)
+	}
+}
+
+func (k *kernelLog) Close() error {
+	return unix.Close(k.fd)
+}
+
+func (v *vethPair) applyEgressPolicy(ctx context.Context, policy *EgressPolicy) error {
+	if v.egressFilter != nil {
+		return status.FailedPreconditionError("an egress policy is already applied to the network")
+	}
+	f, err := newEgressFilter(ctx, v.hostDevice, policy)
+	if err != nil {
+		return err
+	}
+	v.egressFilter = f
+	return nil
+}
+
+func (v *vethPair) deniedEgressCursor() DeniedEgressCursor {
+	if v.egressFilter == nil {
+		return DeniedEgressCursor{}
+	}
+	return v.egressFilter.Cursor()
+}
+
+func (v *vethPair) deniedEgressLog(cursor DeniedEgressCursor) []byte {
+	if v.egressFilter == nil {
+		return nil
+	}
+	return v.egressFilter.DeniedLog(cursor)
+}
+
+// removeEgressFilter removes the applied egress policy, if any.
+func (v *vethPair) removeEgressFilter(ctx context.Context) error {
+	if v.egressFilter == nil {
+		return nil
+	}
+	if err := v.egressFilter.Close(ctx); err != nil {
+		return status.WrapError(err, "remove egress filter")
+	}
+	v.egressFilter = nil
+	return nil
+}
@@ -424,6 +424,13 @@ func (p *VethNetworkPool[T]) get() T {
 // It returns whether the veth pair was successfully added.
 // The caller should clean up the veth pair if this returns false.
 func (p *VethNetworkPool[T]) Add(ctx context.Context, n T) (ok bool) {
+	// Egress policies are specific to the action that the network was used
+	// for, so remove the policy before pooling.
+	if err := n.getVethPair().removeEgressFilter(ctx); err != nil {
+		log.CtxErrorf(ctx, "Failed to remove egress policy before pooling: %s", err)
+		return false
+	}
+
 	// Run any implementation-specific logic needed to deactivate the network
 	// before pooling.
 	if err := n.deactivate(ctx); err != nil {
@@ -644,6 +651,10 @@ type vethPair struct {
 	// Network information for the veth pair.
 	network *HostNet
 
+	// The egress policy filter applied to traffic from the namespaced end of
+	// the pair, if any.
+	egressFilter *egressFilter
+
 	// Cleanup deletes the veth pair and associated host IP configuration
 	// changes.
 	Cleanup func(ctx context.Context) error
@@ -976,7 +987,30 @@ func (v *VMNetwork) NamespacePath() string {
 	return v.netns.Path()
 }
 
+// ApplyEgressPolicy restricts outgoing connections from the VM to the
+// destinations allowed by the policy. Hostnames in the policy are resolved
+// once, when the policy is applied.
+func (v *VMNetwork) ApplyEgressPolicy(ctx context.Context, policy *EgressPolicy) error {
+	return v.vethPair.applyEgressPolicy(ctx, policy)
+}
+
+// DeniedEgressCursor returns a cursor that can be passed to DeniedEgressLog
+// to report the connections denied after this call.
+func (v *VMNetwork) DeniedEgressCursor() DeniedEgressCursor {
+	return v.vethPair.deniedEgressCursor()
+}
+
+// DeniedEgressLog returns a human-readable list of the destinations that the
+// applied egress policy denied connections to since the cursor was taken. It
+// returns nil if no policy is applied or if no connections were denied.
+func (v *VMNetwork) DeniedEgressLog(cursor DeniedEgressCursor) []byte {
+	return v.vethPair.deniedEgressLog(cursor)
+}
+
 func (v *VMNetwork) Cleanup(ctx context.Context) error {
+	if err := v.vethPair.removeEgressFilter(ctx); err != nil {
+		return err
+	}
 	return v.cleanup(ctx)
 }
 
@@ -1105,7 +1139,41 @@ func (c *ContainerNetwork) Stats(ctx context.Context) (*repb.NetworkStats, error
 	return c.vethPair.Stats(ctx)
 }
 
+// ApplyEgressPolicy restricts outgoing connections from the container to the
+// destinations allowed by the policy. Hostnames in the policy are resolved
+// once, when the policy is applied.
+func (c *ContainerNetwork) ApplyEgressPolicy(ctx context.Context, policy *EgressPolicy) error {
+	if c.vethPair == nil {
+		return status.FailedPreconditionError("egress policies can't be applied to loopback-only networks")
+	}
+	return c.vethPair.applyEgressPolicy(ctx, policy)
+}
+
+// DeniedEgressCursor returns a cursor that can be passed to DeniedEgressLog
+// to report the connections denied after this call.
+func (c *ContainerNetwork) DeniedEgressCursor() DeniedEgressCursor {
+	if c.vethPair == nil {
+		return DeniedEgressCursor{}
+	}
+	return c.vethPair.deniedEgressCursor()
+}
+
+// DeniedEgressLog returns a human-readable list of the destinations that the
+// applied egress policy denied connections to since the cursor was taken. It
+// returns nil if no policy is applied or if no connections were denied.
+func (c *ContainerNetwork) DeniedEgressLog(cursor DeniedEgressCursor) []byte {
+	if c.vethPair == nil {
+		return nil
+	}
+	return c.vethPair.deniedEgressLog(cursor)
+}
+
 func (c *ContainerNetwork) Cleanup(ctx context.Context) error {
+	if c.vethPair != nil {
+		if err := c.vethPair.removeEgressFilter(ctx); err != nil {
+			return err
+		}
+	}
 	return c.cleanup(ctx)
 }
 
@@ -1255,6 +1323,49 @@ func ReadInterfaceStats(ctx context.Context, device string) (*repb.NetworkStats,
 	return s, nil
 }
 
+// ReadProcessInterfaceStats reads networking metrics for the given device in
+// the network namespace of the given process, as seen from inside the
+// namespace. This works without root privileges if the namespace is owned by
+// the current user.
+func ReadProcessInterfaceStats(ctx context.Context, pid int, device string) (*repb.NetworkStats, error) {
+	if !*networkStatsEnabled {
+		return nil, nil
+	}
+	// Each interface is listed as "<device>: <rx_bytes> <rx_packets> <rx_errs>
+	// <rx_drop> <rx_fifo> <rx_frame> <rx_compressed> <rx_multicast>
+	// <tx_bytes> <tx_packets> ..." after two header lines.
+	path := fmt.Sprintf("/proc/%d/net/dev", pid)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		name, counters, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) != device {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("invalid %s line for device %s: %q", path, device, line)
+		}
+		var values [4]int64
+		for i, field := range []string{fields[0], fields[1], fields[8], fields[9]} {
+			v, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s line for device %s: %q", path, device, line)
+			}
+			values[i] = v
+		}
+		return &repb.NetworkStats{
+			BytesReceived:   values[0],
+			PacketsReceived: values[1],
+			BytesSent:       values[2],
+			PacketsSent:     values[3],
+		}, nil
+	}
+	return nil, fmt.Errorf("device %s not found in %s", device, path)
+}
+
 // setStatFromSysfs sets the value of a network stat from its corresponding file
 // name under /sys/class/net/[device]/statistics.
 func setStatFromSysfs(s *repb.NetworkStats, name string, v int64) error {
@@ -9,6 +9,7 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -231,6 +232,97 @@ func TestContainerNetworkPool(t *testing.T) {
 	netnsExec(t, cn.NamespacePath(), `ping -c 1 -W 3 8.8.8.8`)
 }
 
+func TestParseEgressPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		allowlist   []string
+		nameservers []netip.Addr
+		expected    *networking.EgressPolicy
+		wantErr     bool
+	}{
+		{
+			name:      "empty",
+			allowlist: nil,
+			expected:  nil,
+		},
+		{
+			name:        "nameservers",
+			allowlist:   []string{"example.com"},
+			nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("2001:4860:4860::8888"), netip.MustParseAddr("::ffff:1.1.1.1")},
+			expected: &networking.EgressPolicy{
+				Rules:       []networking.EgressRule{{Host: "example.com"}},
+				Nameservers: []netip.Addr{netip.MustParseAddr("8.8.8.8"), netip.MustParseAddr("1.1.1.1")},
+			},
+		},
+		{
+			name:      "hosts and ranges",
+			allowlist: []string{"Example.com", "github.com:443", "10.1.2.3", "10.1.2.0/23:80", "*:8000-8100"},
+			expected: &networking.EgressPolicy{Rules: []networking.EgressRule{
+				{Host: "example.com"},
+				{Host: "github.com", MinPort: 443, MaxPort: 443},
+				{Prefix: netip.MustParsePrefix("10.1.2.3/32")},
+				{Prefix: netip.MustParsePrefix("10.1.2.0/23"), MinPort: 80, MaxPort: 80},
+				{MinPort: 8000, MaxPort: 8100},
+			}},
+		},
+		{name: "IPv6 address", allowlist: []string{"::1"}, wantErr: true},
+		{name: "IPv6 address with port", allowlist: []string{"[::1]:443"}, wantErr: true},
+		{name: "wildcard hostname", allowlist: []string{"*.example.com"}, wantErr: true},
+		{name: "invalid hostname", allowlist: []string{"example_.com"}, wantErr: true},
+		{name: "invalid CIDR", allowlist: []string{"10.0.0.0/33"}, wantErr: true},
+		{name: "invalid port", allowlist: []string{"example.com:http"}, wantErr: true},
+		{name: "port 0", allowlist: []string{"example.com:0"}, wantErr: true},
+		{name: "reversed port range", allowlist: []string{"example.com:443-80"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := networking.ParseEgressPolicy(tc.allowlist, tc.nameservers)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, policy)
+		})
+	}
+}
+
+func TestContainerNetworkEgressPolicy(t *testing.T) {
+	testnetworking.Setup(t)
+
+	ctx := context.Background()
+	err := networking.EnableMasquerading(ctx)
+	require.NoError(t, err)
+	pool := networking.NewContainerNetworkPool(-1 /*=default size*/)
+
+	cn := createContainerNetwork(ctx, t)
+	policy, err := networking.ParseEgressPolicy([]string{"8.8.8.8"}, nil /*=nameservers*/)
+	require.NoError(t, err)
+	err = cn.ApplyEgressPolicy(ctx, policy)
+	require.NoError(t, err)
+	cursor := cn.DeniedEgressCursor()
+
+	// Allowed destinations should be reachable, and others should not.
+	netnsExec(t, cn.NamespacePath(), `ping -c 1 -W 3 8.8.8.8`)
+	netnsExec(t, cn.NamespacePath(), `if ping -c 1 -W 1 1.1.1.1 ; then exit 1; fi`)
+
+	// Denied connections should be logged. Reading the log shouldn't consume
+	// it, and connections denied before a cursor was taken shouldn't be
+	// reported from it.
+	deniedLog := string(cn.DeniedEgressLog(cursor))
+	assert.Contains(t, deniedLog, "icmp 1.1.1.1\n")
+	assert.NotContains(t, deniedLog, "8.8.8.8")
+	assert.Equal(t, deniedLog, string(cn.DeniedEgressLog(cursor)))
+	assert.Empty(t, cn.DeniedEgressLog(cn.DeniedEgressCursor()))
+
+	// The policy should be removed when the network is pooled.
+	ok := pool.Add(ctx, cn)
+	require.True(t, ok, "add to pool")
+	cn = pool.Get(ctx)
+	require.NotNil(t, cn, "take from pool")
+	netnsExec(t, cn.NamespacePath(), `ping -c 1 -W 3 1.1.1.1`)
+	assert.Empty(t, cn.DeniedEgressLog(cursor))
+}
+
 func TestNetworkStats(t *testing.T) {
 	// Set this to true to enable packet capture for debugging. If an assertion
 	// fails about metrics for a given interface, a packet capture from that